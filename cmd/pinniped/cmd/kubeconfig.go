@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package cmd
@@ -65,6 +65,8 @@ type getKubeconfigOIDCParams struct {
 	sessionCachePath  string
 	debugSessionCache bool
 	caBundle          caBundleFlag
+	clientCertificate string
+	clientKey         string
 	requestAudience   string
 	upstreamIDPName   string
 	upstreamIDPType   string
@@ -135,11 +137,13 @@ func kubeconfigCommand(deps kubeconfigDeps) *cobra.Command {
 	f.BoolVar(&flags.oidc.skipListen, "oidc-skip-listen", false, "During OpenID Connect login, skip starting a localhost callback listener (manual copy/paste flow only)")
 	f.StringVar(&flags.oidc.sessionCachePath, "oidc-session-cache", "", "Path to OpenID Connect session cache file")
 	f.Var(&flags.oidc.caBundle, "oidc-ca-bundle", "Path to TLS certificate authority bundle (PEM format, optional, can be repeated)")
+	f.StringVar(&flags.oidc.clientCertificate, "oidc-client-certificate", "", "Path to TLS client certificate to present to the Supervisor during login (PEM format, optional, requires --oidc-client-key)")
+	f.StringVar(&flags.oidc.clientKey, "oidc-client-key", "", "Path to TLS client private key for --oidc-client-certificate (PEM format, optional)")
 	f.BoolVar(&flags.oidc.debugSessionCache, "oidc-debug-session-cache", false, "Print debug logs related to the OpenID Connect session cache")
 	f.StringVar(&flags.oidc.requestAudience, "oidc-request-audience", "", "Request a token with an alternate audience using RFC8693 token exchange")
 	f.StringVar(&flags.oidc.upstreamIDPName, "upstream-identity-provider-name", "", "The name of the upstream identity provider used during login with a Supervisor")
-	f.StringVar(&flags.oidc.upstreamIDPType, "upstream-identity-provider-type", "", fmt.Sprintf("The type of the upstream identity provider used during login with a Supervisor (e.g. '%s', '%s', '%s')", idpdiscoveryv1alpha1.IDPTypeOIDC, idpdiscoveryv1alpha1.IDPTypeLDAP, idpdiscoveryv1alpha1.IDPTypeActiveDirectory))
-	f.StringVar(&flags.oidc.upstreamIDPFlow, "upstream-identity-provider-flow", "", fmt.Sprintf("The type of client flow to use with the upstream identity provider during login with a Supervisor (e.g. '%s', '%s')", idpdiscoveryv1alpha1.IDPFlowCLIPassword, idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode))
+	f.StringVar(&flags.oidc.upstreamIDPType, "upstream-identity-provider-type", "", fmt.Sprintf("The type of the upstream identity provider used during login with a Supervisor (e.g. '%s', '%s', '%s', '%s', '%s', '%s')", idpdiscoveryv1alpha1.IDPTypeOIDC, idpdiscoveryv1alpha1.IDPTypeLDAP, idpdiscoveryv1alpha1.IDPTypeActiveDirectory, idpdiscoveryv1alpha1.IDPTypeGitHub, idpdiscoveryv1alpha1.IDPTypeSAML, idpdiscoveryv1alpha1.IDPTypeCertificate))
+	f.StringVar(&flags.oidc.upstreamIDPFlow, "upstream-identity-provider-flow", "", fmt.Sprintf("The type of client flow to use with the upstream identity provider during login with a Supervisor (e.g. '%s', '%s', '%s')", idpdiscoveryv1alpha1.IDPFlowCLIPassword, idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode, idpdiscoveryv1alpha1.IDPFlowCLICertificate))
 	f.StringVar(&flags.kubeconfigPath, "kubeconfig", os.Getenv("KUBECONFIG"), "Path to kubeconfig file")
 	f.StringVar(&flags.kubeconfigContextOverride, "kubeconfig-context", "", "Kubeconfig context name (default: current active context)")
 	f.BoolVar(&flags.skipValidate, "skip-validation", false, "Skip final validation of the kubeconfig (default: false)")
@@ -321,6 +325,12 @@ func newExecConfig(deps kubeconfigDeps, flags getKubeconfigParams) (*clientcmdap
 	if len(flags.oidc.caBundle) != 0 {
 		execConfig.Args = append(execConfig.Args, "--ca-bundle-data="+base64.StdEncoding.EncodeToString(flags.oidc.caBundle))
 	}
+	if flags.oidc.clientCertificate != "" {
+		execConfig.Args = append(execConfig.Args, "--client-certificate="+flags.oidc.clientCertificate)
+	}
+	if flags.oidc.clientKey != "" {
+		execConfig.Args = append(execConfig.Args, "--client-key="+flags.oidc.clientKey)
+	}
 	if flags.oidc.sessionCachePath != "" {
 		execConfig.Args = append(execConfig.Args, "--session-cache="+flags.oidc.sessionCachePath)
 	}
@@ -921,6 +931,16 @@ func selectUpstreamIDPFlow(discoveredIDPFlows []idpdiscoveryv1alpha1.IDPFlow, se
 	case len(discoveredIDPFlows) == 1:
 		// The user did not specify a flow, but there is only one found, so select it.
 		return discoveredIDPFlows[0], nil
+	case (selectedIDPType == idpdiscoveryv1alpha1.IDPTypeLDAP || selectedIDPType == idpdiscoveryv1alpha1.IDPTypeActiveDirectory) &&
+		flowsContain(discoveredIDPFlows, idpdiscoveryv1alpha1.IDPFlowCLIPassword):
+		// The user did not specify a flow for an LDAP or AD IDP. Keep using the CLI password flow, which was the
+		// only flow available for these IDPs before the Supervisor offered a login page.
+		return idpdiscoveryv1alpha1.IDPFlowCLIPassword, nil
+	case selectedIDPType == idpdiscoveryv1alpha1.IDPTypeCertificate &&
+		flowsContain(discoveredIDPFlows, idpdiscoveryv1alpha1.IDPFlowCLICertificate):
+		// The user did not specify a flow for a client certificate IDP. Prefer presenting the certificate from the
+		// CLI, since it does not require a browser which has access to the certificate.
+		return idpdiscoveryv1alpha1.IDPFlowCLICertificate, nil
 	default:
 		// The user did not specify a flow, and more than one was found.
 		return "", fmt.Errorf(
@@ -930,3 +950,12 @@ func selectUpstreamIDPFlow(discoveredIDPFlows []idpdiscoveryv1alpha1.IDPFlow, se
 			selectedIDPName, selectedIDPType, discoveredIDPFlows)
 	}
 }
+
+func flowsContain(flows []idpdiscoveryv1alpha1.IDPFlow, flow idpdiscoveryv1alpha1.IDPFlow) bool {
+	for _, f := range flows {
+		if f == flow {
+			return true
+		}
+	}
+	return false
+}
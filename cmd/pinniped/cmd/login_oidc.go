@@ -1,10 +1,11 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
@@ -64,6 +65,8 @@ type oidcLoginFlags struct {
 	sessionCachePath             string
 	caBundlePaths                []string
 	caBundleData                 []string
+	clientCertificatePath        string
+	clientKeyPath                string
 	debugSessionCache            bool
 	requestAudience              string
 	conciergeEnabled             bool
@@ -98,6 +101,8 @@ func oidcLoginCommand(deps oidcLoginCommandDeps) *cobra.Command {
 	cmd.Flags().StringVar(&flags.sessionCachePath, "session-cache", filepath.Join(mustGetConfigDir(), "sessions.yaml"), "Path to session cache file")
 	cmd.Flags().StringSliceVar(&flags.caBundlePaths, "ca-bundle", nil, "Path to TLS certificate authority bundle (PEM format, optional, can be repeated)")
 	cmd.Flags().StringSliceVar(&flags.caBundleData, "ca-bundle-data", nil, "Base64 encoded TLS certificate authority bundle (base64 encoded PEM format, optional, can be repeated)")
+	cmd.Flags().StringVar(&flags.clientCertificatePath, "client-certificate", "", "Path to TLS client certificate to present to the Supervisor during login (PEM format, optional, requires --client-key)")
+	cmd.Flags().StringVar(&flags.clientKeyPath, "client-key", "", "Path to TLS client private key for --client-certificate (PEM format, optional)")
 	cmd.Flags().BoolVar(&flags.debugSessionCache, "debug-session-cache", false, "Print debug logs related to the session cache")
 	cmd.Flags().StringVar(&flags.requestAudience, "request-audience", "", "Request a token with an alternate audience using RFC8693 token exchange")
 	cmd.Flags().BoolVar(&flags.conciergeEnabled, "enable-concierge", false, "Use the Concierge to login")
@@ -109,8 +114,8 @@ func oidcLoginCommand(deps oidcLoginCommandDeps) *cobra.Command {
 	cmd.Flags().StringVar(&flags.conciergeAPIGroupSuffix, "concierge-api-group-suffix", groupsuffix.PinnipedDefaultSuffix, "Concierge API group suffix")
 	cmd.Flags().StringVar(&flags.credentialCachePath, "credential-cache", filepath.Join(mustGetConfigDir(), "credentials.yaml"), "Path to cluster-specific credentials cache (\"\" disables the cache)")
 	cmd.Flags().StringVar(&flags.upstreamIdentityProviderName, "upstream-identity-provider-name", "", "The name of the upstream identity provider used during login with a Supervisor")
-	cmd.Flags().StringVar(&flags.upstreamIdentityProviderType, "upstream-identity-provider-type", idpdiscoveryv1alpha1.IDPTypeOIDC.String(), fmt.Sprintf("The type of the upstream identity provider used during login with a Supervisor (e.g. '%s', '%s', '%s')", idpdiscoveryv1alpha1.IDPTypeOIDC, idpdiscoveryv1alpha1.IDPTypeLDAP, idpdiscoveryv1alpha1.IDPTypeActiveDirectory))
-	cmd.Flags().StringVar(&flags.upstreamIdentityProviderFlow, "upstream-identity-provider-flow", "", fmt.Sprintf("The type of client flow to use with the upstream identity provider during login with a Supervisor (e.g. '%s', '%s')", idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode, idpdiscoveryv1alpha1.IDPFlowCLIPassword))
+	cmd.Flags().StringVar(&flags.upstreamIdentityProviderType, "upstream-identity-provider-type", idpdiscoveryv1alpha1.IDPTypeOIDC.String(), fmt.Sprintf("The type of the upstream identity provider used during login with a Supervisor (e.g. '%s', '%s', '%s', '%s', '%s', '%s')", idpdiscoveryv1alpha1.IDPTypeOIDC, idpdiscoveryv1alpha1.IDPTypeLDAP, idpdiscoveryv1alpha1.IDPTypeActiveDirectory, idpdiscoveryv1alpha1.IDPTypeGitHub, idpdiscoveryv1alpha1.IDPTypeSAML, idpdiscoveryv1alpha1.IDPTypeCertificate))
+	cmd.Flags().StringVar(&flags.upstreamIdentityProviderFlow, "upstream-identity-provider-flow", "", fmt.Sprintf("The type of client flow to use with the upstream identity provider during login with a Supervisor (e.g. '%s', '%s', '%s')", idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode, idpdiscoveryv1alpha1.IDPFlowCLIPassword, idpdiscoveryv1alpha1.IDPFlowCLICertificate))
 
 	// --skip-listen is mainly needed for testing. We'll leave it hidden until we have a non-testing use case.
 	mustMarkHidden(cmd, "skip-listen")
@@ -196,8 +201,8 @@ func runOIDCLogin(cmd *cobra.Command, deps oidcLoginCommandDeps, flags oidcLogin
 		opts = append(opts, oidcclient.WithSkipListen())
 	}
 
-	if len(flags.caBundlePaths) > 0 || len(flags.caBundleData) > 0 {
-		client, err := makeClient(flags.caBundlePaths, flags.caBundleData)
+	if len(flags.caBundlePaths) > 0 || len(flags.caBundleData) > 0 || flags.clientCertificatePath != "" || flags.clientKeyPath != "" {
+		client, err := makeClient(flags.caBundlePaths, flags.caBundleData, flags.clientCertificatePath, flags.clientKeyPath)
 		if err != nil {
 			return err
 		}
@@ -271,11 +276,33 @@ func flowOptions(requestedIDPType idpdiscoveryv1alpha1.IDPType, requestedFlow id
 		case idpdiscoveryv1alpha1.IDPFlowCLIPassword, "":
 			return useCLIFlow, nil
 		case idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode:
-			fallthrough // not supported for LDAP providers, so fallthrough to error case
+			return nil, nil // the Supervisor's login page will ask for the username and password in the browser
 		default:
 			return nil, fmt.Errorf(
 				"--upstream-identity-provider-flow value not recognized for identity provider type %q: %s (supported values: %s)",
-				requestedIDPType, requestedFlow, []string{idpdiscoveryv1alpha1.IDPFlowCLIPassword.String()})
+				requestedIDPType, requestedFlow, strings.Join([]string{idpdiscoveryv1alpha1.IDPFlowCLIPassword.String(), idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode.String()}, ", "))
+		}
+	case idpdiscoveryv1alpha1.IDPTypeGitHub, idpdiscoveryv1alpha1.IDPTypeSAML:
+		switch requestedFlow {
+		case idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode, "":
+			return nil, nil // browser authcode flow is the default Option, so don't need to return an Option here
+		case idpdiscoveryv1alpha1.IDPFlowCLIPassword:
+			fallthrough // not supported for GitHub or SAML providers, so fallthrough to error case
+		default:
+			return nil, fmt.Errorf(
+				"--upstream-identity-provider-flow value not recognized for identity provider type %q: %s (supported values: %s)",
+				requestedIDPType, requestedFlow, []string{idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode.String()})
+		}
+	case idpdiscoveryv1alpha1.IDPTypeCertificate:
+		switch requestedFlow {
+		case idpdiscoveryv1alpha1.IDPFlowCLICertificate, "":
+			return []oidcclient.Option{oidcclient.WithCLISendingClientCertificate()}, nil
+		case idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode:
+			return nil, nil // the browser will present the user's client certificate to the Supervisor
+		default:
+			return nil, fmt.Errorf(
+				"--upstream-identity-provider-flow value not recognized for identity provider type %q: %s (supported values: %s)",
+				requestedIDPType, requestedFlow, strings.Join([]string{idpdiscoveryv1alpha1.IDPFlowCLICertificate.String(), idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode.String()}, ", "))
 		}
 	default:
 		// Surprisingly cobra does not support this kind of flag validation. See https://github.com/spf13/pflag/issues/236
@@ -286,13 +313,20 @@ func flowOptions(requestedIDPType idpdiscoveryv1alpha1.IDPType, requestedFlow id
 				idpdiscoveryv1alpha1.IDPTypeOIDC.String(),
 				idpdiscoveryv1alpha1.IDPTypeLDAP.String(),
 				idpdiscoveryv1alpha1.IDPTypeActiveDirectory.String(),
+				idpdiscoveryv1alpha1.IDPTypeGitHub.String(),
+				idpdiscoveryv1alpha1.IDPTypeSAML.String(),
+				idpdiscoveryv1alpha1.IDPTypeCertificate.String(),
 			}, ", "),
 		)
 	}
 }
 
-func makeClient(caBundlePaths []string, caBundleData []string) (*http.Client, error) {
-	pool := x509.NewCertPool()
+func makeClient(caBundlePaths []string, caBundleData []string, clientCertificatePath, clientKeyPath string) (*http.Client, error) {
+	// When no CA bundle was provided, leave the pool nil so that the system roots are used.
+	var pool *x509.CertPool
+	if len(caBundlePaths) > 0 || len(caBundleData) > 0 {
+		pool = x509.NewCertPool()
+	}
 	for _, p := range caBundlePaths {
 		pem, err := ioutil.ReadFile(p)
 		if err != nil {
@@ -307,6 +341,13 @@ func makeClient(caBundlePaths []string, caBundleData []string) (*http.Client, er
 		}
 		pool.AppendCertsFromPEM(pem)
 	}
+	if clientCertificatePath != "" || clientKeyPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(clientCertificatePath, clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read --client-certificate and --client-key: %w", err)
+		}
+		return phttp.DefaultWithClientCertificate(pool, clientCert), nil
+	}
 	return phttp.Default(pool), nil
 }
 
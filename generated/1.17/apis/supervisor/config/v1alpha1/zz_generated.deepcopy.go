@@ -1,6 +1,6 @@
 // +build !ignore_autogenerated
 
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Code generated by deepcopy-gen. DO NOT EDIT.
@@ -39,6 +39,66 @@ func (in *FederationDomain) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainACMESpec) DeepCopyInto(out *FederationDomainACMESpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainACMESpec.
+func (in *FederationDomainACMESpec) DeepCopy() *FederationDomainACMESpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainACMESpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainACMEStatus) DeepCopyInto(out *FederationDomainACMEStatus) {
+	*out = *in
+	if in.LastAttemptTime != nil {
+		in, out := &in.LastAttemptTime, &out.LastAttemptTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NotAfter != nil {
+		in, out := &in.NotAfter, &out.NotAfter
+		*out = (*in).DeepCopy()
+	}
+	if in.RenewalTime != nil {
+		in, out := &in.RenewalTime, &out.RenewalTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainACMEStatus.
+func (in *FederationDomainACMEStatus) DeepCopy() *FederationDomainACMEStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainACMEStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainBrandingSpec) DeepCopyInto(out *FederationDomainBrandingSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainBrandingSpec.
+func (in *FederationDomainBrandingSpec) DeepCopy() *FederationDomainBrandingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainBrandingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomainList) DeepCopyInto(out *FederationDomainList) {
 	*out = *in
@@ -98,6 +158,16 @@ func (in *FederationDomainSpec) DeepCopyInto(out *FederationDomainSpec) {
 	if in.TLS != nil {
 		in, out := &in.TLS, &out.TLS
 		*out = new(FederationDomainTLSSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TokenExchange != nil {
+		in, out := &in.TokenExchange, &out.TokenExchange
+		*out = new(FederationDomainTokenExchangeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Branding != nil {
+		in, out := &in.Branding, &out.Branding
+		*out = new(FederationDomainBrandingSpec)
 		**out = **in
 	}
 	return
@@ -121,6 +191,11 @@ func (in *FederationDomainStatus) DeepCopyInto(out *FederationDomainStatus) {
 		*out = (*in).DeepCopy()
 	}
 	out.Secrets = in.Secrets
+	if in.ACME != nil {
+		in, out := &in.ACME, &out.ACME
+		*out = new(FederationDomainACMEStatus)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -137,6 +212,11 @@ func (in *FederationDomainStatus) DeepCopy() *FederationDomainStatus {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomainTLSSpec) DeepCopyInto(out *FederationDomainTLSSpec) {
 	*out = *in
+	if in.ACME != nil {
+		in, out := &in.ACME, &out.ACME
+		*out = new(FederationDomainACMESpec)
+		**out = **in
+	}
 	return
 }
 
@@ -149,3 +229,168 @@ func (in *FederationDomainTLSSpec) DeepCopy() *FederationDomainTLSSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTokenExchangeAudience) DeepCopyInto(out *FederationDomainTokenExchangeAudience) {
+	*out = *in
+	if in.AllowedGroups != nil {
+		in, out := &in.AllowedGroups, &out.AllowedGroups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTokenExchangeAudience.
+func (in *FederationDomainTokenExchangeAudience) DeepCopy() *FederationDomainTokenExchangeAudience {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTokenExchangeAudience)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTokenExchangeSpec) DeepCopyInto(out *FederationDomainTokenExchangeSpec) {
+	*out = *in
+	if in.AllowedAudiences != nil {
+		in, out := &in.AllowedAudiences, &out.AllowedAudiences
+		*out = make([]FederationDomainTokenExchangeAudience, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.TrustedServiceAccountIssuers != nil {
+		in, out := &in.TrustedServiceAccountIssuers, &out.TrustedServiceAccountIssuers
+		*out = make([]FederationDomainTrustedServiceAccountIssuer, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.TrustedOIDCIssuers != nil {
+		in, out := &in.TrustedOIDCIssuers, &out.TrustedOIDCIssuers
+		*out = make([]FederationDomainTrustedOIDCIssuer, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTokenExchangeSpec.
+func (in *FederationDomainTokenExchangeSpec) DeepCopy() *FederationDomainTokenExchangeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTokenExchangeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTokenExchangeTLSSpec) DeepCopyInto(out *FederationDomainTokenExchangeTLSSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTokenExchangeTLSSpec.
+func (in *FederationDomainTokenExchangeTLSSpec) DeepCopy() *FederationDomainTokenExchangeTLSSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTokenExchangeTLSSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTrustedOIDCIssuer) DeepCopyInto(out *FederationDomainTrustedOIDCIssuer) {
+	*out = *in
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]FederationDomainTrustedOIDCIssuerRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(FederationDomainTokenExchangeTLSSpec)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTrustedOIDCIssuer.
+func (in *FederationDomainTrustedOIDCIssuer) DeepCopy() *FederationDomainTrustedOIDCIssuer {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTrustedOIDCIssuer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTrustedOIDCIssuerClaimRequirement) DeepCopyInto(out *FederationDomainTrustedOIDCIssuerClaimRequirement) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTrustedOIDCIssuerClaimRequirement.
+func (in *FederationDomainTrustedOIDCIssuerClaimRequirement) DeepCopy() *FederationDomainTrustedOIDCIssuerClaimRequirement {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTrustedOIDCIssuerClaimRequirement)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTrustedOIDCIssuerRule) DeepCopyInto(out *FederationDomainTrustedOIDCIssuerRule) {
+	*out = *in
+	if in.Claims != nil {
+		in, out := &in.Claims, &out.Claims
+		*out = make([]FederationDomainTrustedOIDCIssuerClaimRequirement, len(*in))
+		copy(*out, *in)
+	}
+	if in.Groups != nil {
+		in, out := &in.Groups, &out.Groups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTrustedOIDCIssuerRule.
+func (in *FederationDomainTrustedOIDCIssuerRule) DeepCopy() *FederationDomainTrustedOIDCIssuerRule {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTrustedOIDCIssuerRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTrustedServiceAccountIssuer) DeepCopyInto(out *FederationDomainTrustedServiceAccountIssuer) {
+	*out = *in
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(FederationDomainTokenExchangeTLSSpec)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTrustedServiceAccountIssuer.
+func (in *FederationDomainTrustedServiceAccountIssuer) DeepCopy() *FederationDomainTrustedServiceAccountIssuer {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTrustedServiceAccountIssuer)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,34 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+// TOTPMode controls whether users of an identity provider must provide a time-based one-time password.
+// +kubebuilder:validation:Enum=Disabled;Optional;Required
+type TOTPMode string
+
+const (
+	// TOTPModeDisabled means that users only provide their password.
+	TOTPModeDisabled TOTPMode = "Disabled"
+
+	// TOTPModeOptional means that users who have enrolled must provide a time-based one-time password after their
+	// password. Users who have not enrolled may log in with only their password. Users may choose to enroll when they
+	// log in using the Supervisor's login page.
+	TOTPModeOptional TOTPMode = "Optional"
+
+	// TOTPModeRequired means that all users must provide a time-based one-time password after their password.
+	// Users who have not enrolled will be asked to enroll during their next login.
+	TOTPModeRequired TOTPMode = "Required"
+)
+
+// TOTPSpec configures the verification of time-based one-time passwords (TOTP, RFC 6238) by the Supervisor, as a
+// second factor after the user's password. Each user's TOTP secret is stored encrypted in a Secret in the Supervisor's
+// namespace. To reset the enrollment of a user, delete their Secret, which can be found using the
+// label "storage.pinniped.dev/type=totp".
+type TOTPSpec struct {
+	// Mode controls whether users must provide a time-based one-time password.
+	// Optional. When not specified, the mode is Disabled.
+	// +kubebuilder:default=Disabled
+	// +optional
+	Mode TOTPMode `json:"mode,omitempty"`
+}
@@ -15,9 +15,13 @@ const (
 	IDPTypeOIDC            IDPType = "oidc"
 	IDPTypeLDAP            IDPType = "ldap"
 	IDPTypeActiveDirectory IDPType = "activedirectory"
+	IDPTypeGitHub          IDPType = "github"
+	IDPTypeSAML            IDPType = "saml"
+	IDPTypeCertificate     IDPType = "certificate"
 
 	IDPFlowCLIPassword     IDPFlow = "cli_password"
 	IDPFlowBrowserAuthcode IDPFlow = "browser_authcode"
+	IDPFlowCLICertificate  IDPFlow = "cli_certificate"
 )
 
 // Equals is a convenience function for comparing an IDPType to a string.
@@ -41,6 +41,10 @@ type ActiveDirectoryIdentityProviderBind struct {
 	// of type "kubernetes.io/basic-auth" which includes "username" and "password" keys. The username value
 	// should be the full dn (distinguished name) of your bind account, e.g. "cn=bind-account,ou=users,dc=example,dc=com".
 	// The password must be non-empty.
+	// Alternatively, the Secret may be of type "kubernetes.io/tls" which includes "tls.crt" and "tls.key" keys, to
+	// bind using a client certificate instead of a password. The client certificate will be presented to the server
+	// during the TLS handshake and a SASL EXTERNAL bind will be performed, so the server must be configured to map
+	// the certificate to the bind account.
 	// +kubebuilder:validation:MinLength=1
 	SecretName string `json:"secretName"`
 }
@@ -131,6 +135,14 @@ type ActiveDirectoryIdentityProviderGroupSearch struct {
 	// the result of the group search.
 	// +optional
 	Attributes ActiveDirectoryIdentityProviderGroupSearchAttributes `json:"attributes,omitempty"`
+
+	// NestedGroups, when true, causes each part of the Filter which compares an attribute to the pattern "{}", e.g.
+	// "member={}", to use the LDAP_MATCHING_RULE_IN_CHAIN matching rule, e.g. "member:1.2.840.113556.1.4.1941:={}".
+	// This causes the Active Directory server to also find the groups of which the user is an indirect member.
+	// This is only useful when a custom Filter is specified, since the default Filter already searches nested groups.
+	// Optional. When not specified, the Filter will be used exactly as specified.
+	// +optional
+	NestedGroups bool `json:"nestedGroups,omitempty"`
 }
 
 // Spec for configuring an ActiveDirectory identity provider.
@@ -139,6 +151,15 @@ type ActiveDirectoryIdentityProviderSpec struct {
 	// +kubebuilder:validation:MinLength=1
 	Host string `json:"host"`
 
+	// FailoverHosts is an ordered list of the hostnames of other Active Directory servers which serve the same directory as
+	// the Host, for example: dc-2.example.com:636. When the Host cannot be reached, the FailoverHosts will be tried in order.
+	// Hosts which recently could not be reached will be tried after the other hosts. The TLS settings and the bind
+	// account are the same for all hosts. Note that the Host is also used to identify users in the downstream
+	// subject, so that the downstream subject of a user does not depend on which host was used during their login.
+	// Optional. When not specified, only the Host will be used.
+	// +optional
+	FailoverHosts []string `json:"failoverHosts,omitempty"`
+
 	// TLS contains the connection settings for how to establish the connection to the Host.
 	TLS *TLSSpec `json:"tls,omitempty"`
 
@@ -151,6 +172,10 @@ type ActiveDirectoryIdentityProviderSpec struct {
 
 	// GroupSearch contains the configuration for searching for a user's group membership in ActiveDirectory.
 	GroupSearch ActiveDirectoryIdentityProviderGroupSearch `json:"groupSearch,omitempty"`
+
+	// TOTP configures a second factor for logins using this identity provider.
+	// +optional
+	TOTP TOTPSpec `json:"totp,omitempty"`
 }
 
 // ActiveDirectoryIdentityProvider describes the configuration of an upstream Microsoft Active Directory identity provider.
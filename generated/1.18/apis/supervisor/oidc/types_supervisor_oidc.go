@@ -1,4 +1,4 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
@@ -15,6 +15,27 @@ const (
 	// or an LDAPIdentityProvider.
 	AuthorizePasswordHeaderName = "Pinniped-Password" //nolint:gosec // this is not a credential
 
+	// AuthorizeTOTPCodeHeaderName is the name of the HTTP header which can be used to transmit a TOTP code
+	// to the authorize endpoint when using a password flow, after the authorize endpoint responded with the
+	// AuthorizeTOTPRequiredHeaderName header.
+	AuthorizeTOTPCodeHeaderName = "Pinniped-TOTP-Code"
+
+	// AuthorizeTOTPRequiredHeaderName is the name of the HTTP header which the authorize endpoint includes in its
+	// response when the username and password were valid, but the user must also provide a TOTP code. Its value is
+	// either AuthorizeTOTPRequiredCode or AuthorizeTOTPRequiredEnroll.
+	AuthorizeTOTPRequiredHeaderName = "Pinniped-TOTP-Required"
+
+	// AuthorizeTOTPRequiredCode means that the user has already enrolled their authenticator app.
+	AuthorizeTOTPRequiredCode = "code"
+
+	// AuthorizeTOTPRequiredEnroll means that the user must first add the secret from the
+	// AuthorizeTOTPEnrollmentURIHeaderName header to their authenticator app.
+	AuthorizeTOTPRequiredEnroll = "enroll"
+
+	// AuthorizeTOTPEnrollmentURIHeaderName is the name of the HTTP header which the authorize endpoint includes in its
+	// response when the user must enroll. Its value is an otpauth:// URI which contains the user's new TOTP secret.
+	AuthorizeTOTPEnrollmentURIHeaderName = "Pinniped-TOTP-Enrollment-URI"
+
 	// AuthorizeUpstreamIDPNameParamName is the name of the HTTP request parameter which can be used to help select which
 	// identity provider should be used for authentication by sending the name of the desired identity provider.
 	AuthorizeUpstreamIDPNameParamName = "pinniped_idp_name"
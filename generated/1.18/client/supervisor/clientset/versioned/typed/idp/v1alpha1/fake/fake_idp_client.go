@@ -19,6 +19,14 @@ func (c *FakeIDPV1alpha1) ActiveDirectoryIdentityProviders(namespace string) v1a
 	return &FakeActiveDirectoryIdentityProviders{c, namespace}
 }
 
+func (c *FakeIDPV1alpha1) CertificateIdentityProviders(namespace string) v1alpha1.CertificateIdentityProviderInterface {
+	return &FakeCertificateIdentityProviders{c, namespace}
+}
+
+func (c *FakeIDPV1alpha1) GitHubIdentityProviders(namespace string) v1alpha1.GitHubIdentityProviderInterface {
+	return &FakeGitHubIdentityProviders{c, namespace}
+}
+
 func (c *FakeIDPV1alpha1) LDAPIdentityProviders(namespace string) v1alpha1.LDAPIdentityProviderInterface {
 	return &FakeLDAPIdentityProviders{c, namespace}
 }
@@ -27,6 +35,10 @@ func (c *FakeIDPV1alpha1) OIDCIdentityProviders(namespace string) v1alpha1.OIDCI
 	return &FakeOIDCIdentityProviders{c, namespace}
 }
 
+func (c *FakeIDPV1alpha1) SAMLIdentityProviders(namespace string) v1alpha1.SAMLIdentityProviderInterface {
+	return &FakeSAMLIdentityProviders{c, namespace}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeIDPV1alpha1) RESTClient() rest.Interface {
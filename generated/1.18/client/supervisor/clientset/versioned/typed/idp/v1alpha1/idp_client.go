@@ -14,8 +14,11 @@ import (
 type IDPV1alpha1Interface interface {
 	RESTClient() rest.Interface
 	ActiveDirectoryIdentityProvidersGetter
+	CertificateIdentityProvidersGetter
+	GitHubIdentityProvidersGetter
 	LDAPIdentityProvidersGetter
 	OIDCIdentityProvidersGetter
+	SAMLIdentityProvidersGetter
 }
 
 // IDPV1alpha1Client is used to interact with features provided by the idp.supervisor.pinniped.dev group.
@@ -27,6 +30,14 @@ func (c *IDPV1alpha1Client) ActiveDirectoryIdentityProviders(namespace string) A
 	return newActiveDirectoryIdentityProviders(c, namespace)
 }
 
+func (c *IDPV1alpha1Client) CertificateIdentityProviders(namespace string) CertificateIdentityProviderInterface {
+	return newCertificateIdentityProviders(c, namespace)
+}
+
+func (c *IDPV1alpha1Client) GitHubIdentityProviders(namespace string) GitHubIdentityProviderInterface {
+	return newGitHubIdentityProviders(c, namespace)
+}
+
 func (c *IDPV1alpha1Client) LDAPIdentityProviders(namespace string) LDAPIdentityProviderInterface {
 	return newLDAPIdentityProviders(c, namespace)
 }
@@ -35,6 +46,10 @@ func (c *IDPV1alpha1Client) OIDCIdentityProviders(namespace string) OIDCIdentity
 	return newOIDCIdentityProviders(c, namespace)
 }
 
+func (c *IDPV1alpha1Client) SAMLIdentityProviders(namespace string) SAMLIdentityProviderInterface {
+	return newSAMLIdentityProviders(c, namespace)
+}
+
 // NewForConfig creates a new IDPV1alpha1Client for the given config.
 func NewForConfig(c *rest.Config) (*IDPV1alpha1Client, error) {
 	config := *c
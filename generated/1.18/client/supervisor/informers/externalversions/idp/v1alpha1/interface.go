@@ -13,10 +13,16 @@ import (
 type Interface interface {
 	// ActiveDirectoryIdentityProviders returns a ActiveDirectoryIdentityProviderInformer.
 	ActiveDirectoryIdentityProviders() ActiveDirectoryIdentityProviderInformer
+	// CertificateIdentityProviders returns a CertificateIdentityProviderInformer.
+	CertificateIdentityProviders() CertificateIdentityProviderInformer
+	// GitHubIdentityProviders returns a GitHubIdentityProviderInformer.
+	GitHubIdentityProviders() GitHubIdentityProviderInformer
 	// LDAPIdentityProviders returns a LDAPIdentityProviderInformer.
 	LDAPIdentityProviders() LDAPIdentityProviderInformer
 	// OIDCIdentityProviders returns a OIDCIdentityProviderInformer.
 	OIDCIdentityProviders() OIDCIdentityProviderInformer
+	// SAMLIdentityProviders returns a SAMLIdentityProviderInformer.
+	SAMLIdentityProviders() SAMLIdentityProviderInformer
 }
 
 type version struct {
@@ -35,6 +41,16 @@ func (v *version) ActiveDirectoryIdentityProviders() ActiveDirectoryIdentityProv
 	return &activeDirectoryIdentityProviderInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
 
+// CertificateIdentityProviders returns a CertificateIdentityProviderInformer.
+func (v *version) CertificateIdentityProviders() CertificateIdentityProviderInformer {
+	return &certificateIdentityProviderInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
+// GitHubIdentityProviders returns a GitHubIdentityProviderInformer.
+func (v *version) GitHubIdentityProviders() GitHubIdentityProviderInformer {
+	return &gitHubIdentityProviderInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
 // LDAPIdentityProviders returns a LDAPIdentityProviderInformer.
 func (v *version) LDAPIdentityProviders() LDAPIdentityProviderInformer {
 	return &lDAPIdentityProviderInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
@@ -44,3 +60,8 @@ func (v *version) LDAPIdentityProviders() LDAPIdentityProviderInformer {
 func (v *version) OIDCIdentityProviders() OIDCIdentityProviderInformer {
 	return &oIDCIdentityProviderInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// SAMLIdentityProviders returns a SAMLIdentityProviderInformer.
+func (v *version) SAMLIdentityProviders() SAMLIdentityProviderInformer {
+	return &sAMLIdentityProviderInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package v1alpha1
@@ -18,6 +18,50 @@ const (
 	InvalidFederationDomainStatusCondition                         = FederationDomainStatusCondition("Invalid")
 )
 
+// +kubebuilder:validation:Enum=HTTP-01;TLS-ALPN-01
+type FederationDomainACMEChallengeType string
+
+const (
+	HTTP01FederationDomainACMEChallengeType    = FederationDomainACMEChallengeType("HTTP-01")
+	TLSALPN01FederationDomainACMEChallengeType = FederationDomainACMEChallengeType("TLS-ALPN-01")
+)
+
+// +kubebuilder:validation:Enum=Pending;Ready;Error
+type FederationDomainACMEPhase string
+
+const (
+	PendingFederationDomainACMEPhase = FederationDomainACMEPhase("Pending")
+	ReadyFederationDomainACMEPhase   = FederationDomainACMEPhase("Ready")
+	ErrorFederationDomainACMEPhase   = FederationDomainACMEPhase("Error")
+)
+
+// FederationDomainACMESpec configures how the Supervisor obtains the TLS serving certificate of a FederationDomain
+// from a certificate authority using ACME (RFC 8555).
+type FederationDomainACMESpec struct {
+	// DirectoryURL is the URL of the ACME directory of the certificate authority, e.g.
+	// https://acme-v02.api.letsencrypt.org/directory. By configuring it, you agree to the terms of service of the
+	// certificate authority.
+	// +kubebuilder:validation:Pattern=`^https://`
+	DirectoryURL string `json:"directoryURL"`
+
+	// Email is an optional contact address of the ACME account, which the certificate authority may use to send
+	// notices about the certificates.
+	// +optional
+	Email string `json:"email,omitempty"`
+
+	// ChallengeType is how the certificate authority validates that the Supervisor serves the hostname of the issuer.
+	// HTTP-01 requires the HTTP endpoints of the Supervisor to be reachable on port 80 of the hostname, and
+	// TLS-ALPN-01 requires its HTTPS endpoints to be reachable on port 443 of the hostname. Defaults to HTTP-01.
+	// +kubebuilder:default=HTTP-01
+	// +optional
+	ChallengeType FederationDomainACMEChallengeType `json:"challengeType,omitempty"`
+
+	// X.509 Certificate Authority (base64-encoded PEM bundle) to trust when connecting to the ACME directory, e.g.
+	// for a private certificate authority. If omitted, a default set of system roots will be trusted.
+	// +optional
+	CertificateAuthorityData string `json:"certificateAuthorityData,omitempty"`
+}
+
 // FederationDomainTLSSpec is a struct that describes the TLS configuration for an OIDC Provider.
 type FederationDomainTLSSpec struct {
 	// SecretName is an optional name of a Secret in the same namespace, of type `kubernetes.io/tls`, which contains
@@ -39,6 +83,163 @@ type FederationDomainTLSSpec struct {
 	//
 	// +optional
 	SecretName string `json:"secretName,omitempty"`
+
+	// ACME configures the Supervisor to obtain and renew the TLS serving certificate for the hostname of the issuer
+	// from a certificate authority using ACME (RFC 8555), such as Let's Encrypt. The certificate is stored in the
+	// Secret named by SecretName, which is required when ACME is configured. The Supervisor renews the certificate
+	// when two thirds of its lifetime have passed.
+	// +optional
+	ACME *FederationDomainACMESpec `json:"acme,omitempty"`
+}
+
+// FederationDomainTokenExchangeAudience is an audience for which tokens may be requested using token exchange.
+type FederationDomainTokenExchangeAudience struct {
+	// Name is the audience, which will be the value of the aud claim of the issued tokens. Clusters usually
+	// expect an audience which is unique to them.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// AllowedGroups optionally restricts which users may request tokens for this audience. When it is set, only
+	// users who are members of at least one of these groups may request tokens for this audience. When it is not
+	// set, any user may request tokens for this audience.
+	// +optional
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+}
+
+// FederationDomainTokenExchangeTLSSpec configures how the Supervisor connects to a trusted issuer.
+type FederationDomainTokenExchangeTLSSpec struct {
+	// X.509 Certificate Authority (base64-encoded PEM bundle). If omitted, a default set of system roots will be trusted.
+	// +optional
+	CertificateAuthorityData string `json:"certificateAuthorityData,omitempty"`
+}
+
+// FederationDomainTrustedServiceAccountIssuer is the service account issuer of a Kubernetes cluster whose
+// ServiceAccount tokens may be exchanged for tokens of this FederationDomain.
+type FederationDomainTrustedServiceAccountIssuer struct {
+	// Issuer is the issuer of the ServiceAccount tokens of the cluster, which is the value of the
+	// --service-account-issuer flag of its Kubernetes API server.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:Pattern=`^https://`
+	Issuer string `json:"issuer"`
+
+	// JWKSURL is the URL of the JSON Web Key Set which is used to verify the signatures of the ServiceAccount
+	// tokens. When it is not set, it is discovered from the OpenID Connect discovery document of the issuer, which
+	// the Kubernetes API server serves when service account issuer discovery is enabled.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^https://`
+	JWKSURL string `json:"jwksURL,omitempty"`
+
+	// Audience is the audience which the ServiceAccount tokens must have. Pods should use projected ServiceAccount
+	// tokens which were requested for this audience, so that their tokens for other audiences cannot be exchanged.
+	// +kubebuilder:validation:MinLength=1
+	Audience string `json:"audience"`
+
+	// UsernamePrefix is prepended to the username of the ServiceAccount, which has the form
+	// system:serviceaccount:<namespace>:<name>, and to the names of its groups. It should be unique for each
+	// trusted issuer, e.g. "mgmt-cluster:", so that the ServiceAccounts of different clusters cannot be confused.
+	// +kubebuilder:validation:MinLength=1
+	UsernamePrefix string `json:"usernamePrefix"`
+
+	// TLS configures how the Supervisor connects to the issuer to fetch its keys.
+	// +optional
+	TLS *FederationDomainTokenExchangeTLSSpec `json:"tls,omitempty"`
+}
+
+// FederationDomainTrustedOIDCIssuer is an OpenID Connect issuer, such as a CI platform, whose ID tokens identify
+// workloads and may be exchanged for tokens of this FederationDomain.
+type FederationDomainTrustedOIDCIssuer struct {
+	// Issuer is the issuer of the ID tokens, e.g. https://token.actions.githubusercontent.com.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:Pattern=`^https://`
+	Issuer string `json:"issuer"`
+
+	// JWKSURL is the URL of the JSON Web Key Set which is used to verify the signatures of the ID tokens. When it
+	// is not set, it is discovered from the OpenID Connect discovery document of the issuer.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^https://`
+	JWKSURL string `json:"jwksURL,omitempty"`
+
+	// Audience is the audience which the ID tokens must have. Workloads should request their ID tokens for this
+	// audience, so that their ID tokens for other audiences cannot be exchanged.
+	// +kubebuilder:validation:MinLength=1
+	Audience string `json:"audience"`
+
+	// Rules decide which ID tokens may be exchanged, and map their claims to the username and groups of their
+	// downstream identity. The first rule whose claims match an ID token applies to it. ID tokens which do not
+	// match any rule may not be exchanged.
+	// +kubebuilder:validation:MinItems=1
+	Rules []FederationDomainTrustedOIDCIssuerRule `json:"rules"`
+
+	// TLS configures how the Supervisor connects to the issuer to fetch its keys.
+	// +optional
+	TLS *FederationDomainTokenExchangeTLSSpec `json:"tls,omitempty"`
+}
+
+// FederationDomainTrustedOIDCIssuerRule maps the ID tokens whose claims match to a downstream identity.
+type FederationDomainTrustedOIDCIssuerRule struct {
+	// Claims are the requirements on the claims of the ID token, which must all be met for the rule to match.
+	// There must be at least one requirement, so that a rule cannot match every ID token of the issuer.
+	// +kubebuilder:validation:MinItems=1
+	Claims []FederationDomainTrustedOIDCIssuerClaimRequirement `json:"claims"`
+
+	// Username is the username of the downstream identity. It may reference the string claims of the ID token by
+	// their names in braces, e.g. "github:{repository}:{ref}".
+	// +kubebuilder:validation:MinLength=1
+	Username string `json:"username"`
+
+	// Groups are the groups of the downstream identity. Like the username, they may reference the string claims of
+	// the ID token by their names in braces, e.g. "github:{repository_owner}".
+	// +optional
+	Groups []string `json:"groups,omitempty"`
+}
+
+// FederationDomainTrustedOIDCIssuerClaimRequirement is a requirement on a claim of an ID token.
+type FederationDomainTrustedOIDCIssuerClaimRequirement struct {
+	// Claim is the name of a string claim of the ID token, e.g. "repository" or "ref".
+	// +kubebuilder:validation:MinLength=1
+	Claim string `json:"claim"`
+
+	// Value is the value which the claim must have, e.g. "refs/heads/main". When it ends with "*", the claim must
+	// start with the rest of the value instead, e.g. "refs/heads/release-*".
+	// +kubebuilder:validation:MinLength=1
+	Value string `json:"value"`
+}
+
+// FederationDomainTokenExchangeSpec describes which tokens may be requested from this FederationDomain using
+// RFC 8693 token exchange.
+type FederationDomainTokenExchangeSpec struct {
+	// AllowedAudiences lists the audiences for which tokens may be requested using token exchange. When it is not
+	// set, tokens may be requested for any audience.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	AllowedAudiences []FederationDomainTokenExchangeAudience `json:"allowedAudiences,omitempty"`
+
+	// TrustedServiceAccountIssuers lists the Kubernetes clusters whose ServiceAccount tokens may be exchanged for
+	// tokens of this FederationDomain, so that the workloads of those clusters can reach other clusters without
+	// any user.
+	// +optional
+	// +listType=map
+	// +listMapKey=issuer
+	TrustedServiceAccountIssuers []FederationDomainTrustedServiceAccountIssuer `json:"trustedServiceAccountIssuers,omitempty"`
+
+	// TrustedOIDCIssuers lists the OpenID Connect issuers, such as CI platforms, whose ID tokens may be exchanged
+	// for tokens of this FederationDomain, so that their workloads can reach clusters without any user.
+	// +optional
+	// +listType=map
+	// +listMapKey=issuer
+	TrustedOIDCIssuers []FederationDomainTrustedOIDCIssuer `json:"trustedOIDCIssuers,omitempty"`
+}
+
+// FederationDomainBrandingSpec configures how the HTML pages of a FederationDomain look to users.
+type FederationDomainBrandingSpec struct {
+	// ConfigMapName is the name of a ConfigMap in the same namespace which configures the branding of the HTML
+	// pages which this FederationDomain serves to users, such as its login page. It may contain the keys
+	// `displayName`, `logo` (a PNG, JPEG, GIF or WebP image of at most 64 KiB), `primaryColor` and
+	// `backgroundColor` (hex colors), and `formPost.gohtml`, `login.gohtml` and `consent.gohtml`, which override
+	// the Go templates of the pages. When the ConfigMap does not exist or is invalid, the default pages are used.
+	// +kubebuilder:validation:MinLength=1
+	ConfigMapName string `json:"configMapName"`
 }
 
 // FederationDomainSpec is a struct that describes an OIDC Provider.
@@ -57,6 +258,15 @@ type FederationDomainSpec struct {
 	// TLS configures how this FederationDomain is served over Transport Layer Security (TLS).
 	// +optional
 	TLS *FederationDomainTLSSpec `json:"tls,omitempty"`
+
+	// TokenExchange configures which tokens may be requested from this FederationDomain using RFC 8693 token
+	// exchange.
+	// +optional
+	TokenExchange *FederationDomainTokenExchangeSpec `json:"tokenExchange,omitempty"`
+
+	// Branding configures how the HTML pages of this FederationDomain look to users.
+	// +optional
+	Branding *FederationDomainBrandingSpec `json:"branding,omitempty"`
 }
 
 // FederationDomainSecrets holds information about this OIDC Provider's secrets.
@@ -83,6 +293,30 @@ type FederationDomainSecrets struct {
 	StateEncryptionKey corev1.LocalObjectReference `json:"stateEncryptionKey,omitempty"`
 }
 
+// FederationDomainACMEStatus describes the TLS serving certificate which the Supervisor obtains using ACME.
+type FederationDomainACMEStatus struct {
+	// Phase is Pending while the Supervisor obtains a certificate, Ready when it has a valid certificate, and Error
+	// when it could not obtain a certificate the last time it tried.
+	// +optional
+	Phase FederationDomainACMEPhase `json:"phase,omitempty"`
+
+	// Message provides human-readable details about the Phase.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastAttemptTime is when the Supervisor last tried to obtain a certificate.
+	// +optional
+	LastAttemptTime *metav1.Time `json:"lastAttemptTime,omitempty"`
+
+	// NotAfter is when the current certificate expires.
+	// +optional
+	NotAfter *metav1.Time `json:"notAfter,omitempty"`
+
+	// RenewalTime is when the Supervisor will renew the current certificate.
+	// +optional
+	RenewalTime *metav1.Time `json:"renewalTime,omitempty"`
+}
+
 // FederationDomainStatus is a struct that describes the actual state of an OIDC Provider.
 type FederationDomainStatus struct {
 	// Status holds an enum that describes the state of this OIDC Provider. Note that this Status can
@@ -103,6 +337,10 @@ type FederationDomainStatus struct {
 	// Secrets contains information about this OIDC Provider's secrets.
 	// +optional
 	Secrets FederationDomainSecrets `json:"secrets,omitempty"`
+
+	// ACME describes the TLS serving certificate which the Supervisor obtains using ACME, when it is configured.
+	// +optional
+	ACME *FederationDomainACMEStatus `json:"acme,omitempty"`
 }
 
 // FederationDomain describes the configuration of an OIDC provider.
@@ -7,6 +7,12 @@ package v1alpha1
 
 type ActiveDirectoryIdentityProviderExpansion interface{}
 
+type CertificateIdentityProviderExpansion interface{}
+
+type GitHubIdentityProviderExpansion interface{}
+
 type LDAPIdentityProviderExpansion interface{}
 
 type OIDCIdentityProviderExpansion interface{}
+
+type SAMLIdentityProviderExpansion interface{}
@@ -13,6 +13,22 @@ type ActiveDirectoryIdentityProviderListerExpansion interface{}
 // ActiveDirectoryIdentityProviderNamespaceLister.
 type ActiveDirectoryIdentityProviderNamespaceListerExpansion interface{}
 
+// CertificateIdentityProviderListerExpansion allows custom methods to be added to
+// CertificateIdentityProviderLister.
+type CertificateIdentityProviderListerExpansion interface{}
+
+// CertificateIdentityProviderNamespaceListerExpansion allows custom methods to be added to
+// CertificateIdentityProviderNamespaceLister.
+type CertificateIdentityProviderNamespaceListerExpansion interface{}
+
+// GitHubIdentityProviderListerExpansion allows custom methods to be added to
+// GitHubIdentityProviderLister.
+type GitHubIdentityProviderListerExpansion interface{}
+
+// GitHubIdentityProviderNamespaceListerExpansion allows custom methods to be added to
+// GitHubIdentityProviderNamespaceLister.
+type GitHubIdentityProviderNamespaceListerExpansion interface{}
+
 // LDAPIdentityProviderListerExpansion allows custom methods to be added to
 // LDAPIdentityProviderLister.
 type LDAPIdentityProviderListerExpansion interface{}
@@ -28,3 +44,11 @@ type OIDCIdentityProviderListerExpansion interface{}
 // OIDCIdentityProviderNamespaceListerExpansion allows custom methods to be added to
 // OIDCIdentityProviderNamespaceLister.
 type OIDCIdentityProviderNamespaceListerExpansion interface{}
+
+// SAMLIdentityProviderListerExpansion allows custom methods to be added to
+// SAMLIdentityProviderLister.
+type SAMLIdentityProviderListerExpansion interface{}
+
+// SAMLIdentityProviderNamespaceListerExpansion allows custom methods to be added to
+// SAMLIdentityProviderNamespaceLister.
+type SAMLIdentityProviderNamespaceListerExpansion interface{}
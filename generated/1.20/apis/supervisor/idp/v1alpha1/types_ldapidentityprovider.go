@@ -41,6 +41,10 @@ type LDAPIdentityProviderBind struct {
 	// of type "kubernetes.io/basic-auth" which includes "username" and "password" keys. The username value
 	// should be the full dn (distinguished name) of your bind account, e.g. "cn=bind-account,ou=users,dc=example,dc=com".
 	// The password must be non-empty.
+	// Alternatively, the Secret may be of type "kubernetes.io/tls" which includes "tls.crt" and "tls.key" keys, to
+	// bind using a client certificate instead of a password. The client certificate will be presented to the server
+	// during the TLS handshake and a SASL EXTERNAL bind will be performed, so the server must be configured to map
+	// the certificate to the bind account.
 	// +kubebuilder:validation:MinLength=1
 	SecretName string `json:"secretName"`
 }
@@ -119,6 +123,16 @@ type LDAPIdentityProviderGroupSearch struct {
 	// the result of the group search.
 	// +optional
 	Attributes LDAPIdentityProviderGroupSearchAttributes `json:"attributes,omitempty"`
+
+	// NestedGroups, when true, causes the user's groups to also include the groups of which the user is an indirect
+	// member, i.e. the groups which contain one of the user's groups, and so on. The nested groups are found by
+	// repeating the group search with the pattern "{}" in the Filter replaced by the dn (distinguished name) of each
+	// group which was found, up to a depth of 10 levels of groups. Each group is only searched once, so memberships
+	// which form a cycle are allowed. Note that this performs one additional search per group, which can be slow for
+	// users who belong to many groups.
+	// Optional. When not specified, only the groups found by the Filter will be included.
+	// +optional
+	NestedGroups bool `json:"nestedGroups,omitempty"`
 }
 
 // Spec for configuring an LDAP identity provider.
@@ -127,6 +141,15 @@ type LDAPIdentityProviderSpec struct {
 	// +kubebuilder:validation:MinLength=1
 	Host string `json:"host"`
 
+	// FailoverHosts is an ordered list of the hostnames of other LDAP servers which serve the same directory as
+	// the Host, for example: ldap-2.example.com:636. When the Host cannot be reached, the FailoverHosts will be tried in order.
+	// Hosts which recently could not be reached will be tried after the other hosts. The TLS settings and the bind
+	// account are the same for all hosts. Note that the Host is also used to identify users in the downstream
+	// subject, so that the downstream subject of a user does not depend on which host was used during their login.
+	// Optional. When not specified, only the Host will be used.
+	// +optional
+	FailoverHosts []string `json:"failoverHosts,omitempty"`
+
 	// TLS contains the connection settings for how to establish the connection to the Host.
 	TLS *TLSSpec `json:"tls,omitempty"`
 
@@ -139,6 +162,10 @@ type LDAPIdentityProviderSpec struct {
 
 	// GroupSearch contains the configuration for searching for a user's group membership in the LDAP provider.
 	GroupSearch LDAPIdentityProviderGroupSearch `json:"groupSearch,omitempty"`
+
+	// TOTP configures a second factor for logins using this identity provider.
+	// +optional
+	TOTP TOTPSpec `json:"totp,omitempty"`
 }
 
 // LDAPIdentityProvider describes the configuration of an upstream Lightweight Directory Access
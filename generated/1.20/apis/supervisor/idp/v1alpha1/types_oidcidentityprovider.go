@@ -175,6 +175,12 @@ type OIDCIdentityProviderSpec struct {
 	// OIDCClient contains OIDC client information to be used used with this OIDC identity
 	// provider.
 	Client OIDCClient `json:"client"`
+
+	// TOTP configures a second factor for logins using this identity provider. It only applies to logins which use
+	// the resource owner password credentials grant, as allowed by AuthorizationConfig.AllowPasswordGrant, because
+	// the upstream provider is responsible for the login of users who log in with a web browser.
+	// +optional
+	TOTP TOTPSpec `json:"totp,omitempty"`
 }
 
 // OIDCIdentityProvider describes the configuration of an upstream OpenID Connect identity provider.
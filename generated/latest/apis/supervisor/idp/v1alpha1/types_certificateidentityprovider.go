@@ -0,0 +1,167 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type CertificateIdentityProviderPhase string
+
+const (
+	// CertificatePhasePending is the default phase for newly-created CertificateIdentityProvider resources.
+	CertificatePhasePending CertificateIdentityProviderPhase = "Pending"
+
+	// CertificatePhaseReady is the phase for a CertificateIdentityProvider resource in a healthy state.
+	CertificatePhaseReady CertificateIdentityProviderPhase = "Ready"
+
+	// CertificatePhaseError is the phase for a CertificateIdentityProvider in an unhealthy state.
+	CertificatePhaseError CertificateIdentityProviderPhase = "Error"
+)
+
+// CertificateField is a field of a client certificate from which a username or group names can be taken.
+type CertificateField string
+
+const (
+	// CertificateFieldCommonName is the common name (CN) of the certificate's subject.
+	CertificateFieldCommonName CertificateField = "CommonName"
+
+	// CertificateFieldEmailAddress is the first email address subject alternative name of the certificate.
+	CertificateFieldEmailAddress CertificateField = "EmailAddress"
+
+	// CertificateFieldUserPrincipalName is the first Microsoft user principal name (UPN) subject alternative name
+	// of the certificate, which is commonly used by smart card certificates.
+	CertificateFieldUserPrincipalName CertificateField = "UserPrincipalName"
+
+	// CertificateFieldDNSName is the first DNS name subject alternative name of the certificate.
+	CertificateFieldDNSName CertificateField = "DNSName"
+
+	// CertificateFieldURI is the first URI subject alternative name of the certificate.
+	CertificateFieldURI CertificateField = "URI"
+
+	// CertificateFieldOrganization is the organizations (O) of the certificate's subject.
+	CertificateFieldOrganization CertificateField = "Organization"
+
+	// CertificateFieldOrganizationalUnit is the organizational units (OU) of the certificate's subject.
+	CertificateFieldOrganizationalUnit CertificateField = "OrganizationalUnit"
+)
+
+// CertificateIdentityProviderStatus is the status of a client certificate identity provider.
+type CertificateIdentityProviderStatus struct {
+	// Phase summarizes the overall status of the CertificateIdentityProvider.
+	// +kubebuilder:default=Pending
+	// +kubebuilder:validation:Enum=Pending;Ready;Error
+	Phase CertificateIdentityProviderPhase `json:"phase,omitempty"`
+
+	// Represents the observations of an identity provider's current state.
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// CertificateClaims provides a mapping from fields of client certificates to Kubernetes usernames and groups.
+type CertificateClaims struct {
+	// Username is the field of the client certificate from which the username shall be determined.
+	// Can be "CommonName", "EmailAddress", "UserPrincipalName", "DNSName", or "URI". Defaults to "CommonName".
+	// Certificates which do not have a non-empty value for the field are rejected.
+	// +kubebuilder:default=CommonName
+	// +kubebuilder:validation:Enum=CommonName;EmailAddress;UserPrincipalName;DNSName;URI
+	// +optional
+	Username CertificateField `json:"username,omitempty"`
+
+	// Groups is the field of the client certificate's subject from which the group memberships shall be determined.
+	// Can be "Organization" or "OrganizationalUnit". Each value of the field is treated as the name of a group.
+	// When not specified, no group memberships will be provided to Kubernetes.
+	// +kubebuilder:validation:Enum=Organization;OrganizationalUnit
+	// +optional
+	Groups CertificateField `json:"groups,omitempty"`
+}
+
+// CertificateRevocationListSourceKind is the kind of object which contains certificate revocation lists.
+type CertificateRevocationListSourceKind string
+
+const (
+	// CertificateRevocationListSourceKindConfigMap is a ConfigMap. Its data and binary data values are loaded.
+	CertificateRevocationListSourceKindConfigMap CertificateRevocationListSourceKind = "ConfigMap"
+
+	// CertificateRevocationListSourceKindSecret is a Secret. Its data values are loaded.
+	CertificateRevocationListSourceKindSecret CertificateRevocationListSourceKind = "Secret"
+)
+
+// CertificateRevocationListSource is a ConfigMap or Secret which contains certificate revocation lists.
+type CertificateRevocationListSource struct {
+	// Kind is the kind of the object which contains the CRLs. Can be "ConfigMap" or "Secret".
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	Kind CertificateRevocationListSourceKind `json:"kind"`
+
+	// Name is the name of the ConfigMap or Secret, which must be in the same namespace as the
+	// CertificateIdentityProvider.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// CertificateRevocationSpec describes how to check whether client certificates have been revoked.
+type CertificateRevocationSpec struct {
+	// CRLSources are ConfigMaps or Secrets which contain PEM or DER encoded certificate revocation lists (CRLs).
+	// Every value of their data is loaded, so one ConfigMap or Secret may contain the CRLs of many issuers. They are
+	// loaded again whenever they change, so they can be updated without restarting the Supervisor. A client
+	// certificate is rejected when it is listed on a CRL of its issuer, or when the CRL of its issuer has passed
+	// its next update time. When any CRLs are configured, a client certificate is also rejected when one of its
+	// issuers has no CRL.
+	// +optional
+	CRLSources []CertificateRevocationListSource `json:"crlSources,omitempty"`
+}
+
+// CertificateIdentityProviderSpec is the spec for configuring a client certificate identity provider.
+type CertificateIdentityProviderSpec struct {
+	// CertificateAuthorityData is a base64 encoded PEM bundle of the CA certificates which issue the client
+	// certificates of users. Clients may present any intermediate certificates along with their own certificate.
+	// +kubebuilder:validation:MinLength=1
+	CertificateAuthorityData string `json:"certificateAuthorityData"`
+
+	// Claims provides a mapping from fields of client certificates to Kubernetes usernames and groups.
+	// +kubebuilder:default={}
+	// +optional
+	Claims CertificateClaims `json:"claims,omitempty"`
+
+	// Revocation describes how to check whether client certificates have been revoked.
+	// +optional
+	Revocation CertificateRevocationSpec `json:"revocation,omitempty"`
+}
+
+// CertificateIdentityProvider describes the configuration of an upstream identity provider which authenticates
+// users by the client certificates which they present to the Supervisor during the TLS handshake, for example
+// from a smart card.
+//
+// Both web-based logins and CLI-based logins are supported. While any CertificateIdentityProvider is configured,
+// the Supervisor asks every client which connects to the hostname of a FederationDomain issuer for a certificate
+// issued by one of the configured CAs during the TLS handshake.
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:categories=pinniped;pinniped-idp;pinniped-idps
+// +kubebuilder:printcolumn:name="Username",type=string,JSONPath=`.spec.claims.username`
+// +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+// +kubebuilder:subresource:status
+type CertificateIdentityProvider struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec for configuring the identity provider.
+	Spec CertificateIdentityProviderSpec `json:"spec"`
+
+	// Status of the identity provider.
+	Status CertificateIdentityProviderStatus `json:"status,omitempty"`
+}
+
+// CertificateIdentityProviderList lists CertificateIdentityProvider objects.
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type CertificateIdentityProviderList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []CertificateIdentityProvider `json:"items"`
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type SAMLIdentityProviderPhase string
+
+const (
+	// SAMLPhasePending is the default phase for newly-created SAMLIdentityProvider resources.
+	SAMLPhasePending SAMLIdentityProviderPhase = "Pending"
+
+	// SAMLPhaseReady is the phase for a SAMLIdentityProvider resource in a healthy state.
+	SAMLPhaseReady SAMLIdentityProviderPhase = "Ready"
+
+	// SAMLPhaseError is the phase for a SAMLIdentityProvider in an unhealthy state.
+	SAMLPhaseError SAMLIdentityProviderPhase = "Error"
+)
+
+// SAMLIdentityProviderStatus is the status of a SAML identity provider.
+type SAMLIdentityProviderStatus struct {
+	// Phase summarizes the overall status of the SAMLIdentityProvider.
+	// +kubebuilder:default=Pending
+	// +kubebuilder:validation:Enum=Pending;Ready;Error
+	Phase SAMLIdentityProviderPhase `json:"phase,omitempty"`
+
+	// Represents the observations of an identity provider's current state.
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// SAMLMetadataSpec describes where to find the metadata of the SAML identity provider.
+// Exactly one of URL or XML must be specified.
+type SAMLMetadataSpec struct {
+	// URL is the location of the identity provider's SAML metadata document, for example
+	// "https://adfs.example.com/FederationMetadata/2007-06/FederationMetadata.xml".
+	// The metadata will be periodically re-fetched from this URL.
+	// +kubebuilder:validation:Pattern=`^https://`
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// TLS configuration for fetching the metadata from the URL.
+	// +optional
+	TLS *TLSSpec `json:"tls,omitempty"`
+
+	// XML is the identity provider's SAML metadata document, for use when the identity provider does not
+	// publish its metadata at a URL which is reachable by the Supervisor.
+	// +optional
+	XML string `json:"xml,omitempty"`
+}
+
+// SAMLClaims provides a mapping from attributes of SAML assertions to Kubernetes usernames and groups.
+type SAMLClaims struct {
+	// Username is the name of the assertion attribute from which the username shall be determined.
+	// When not specified, the NameID of the assertion's subject will be used as the username.
+	// +optional
+	Username string `json:"username,omitempty"`
+
+	// Groups is the name of the assertion attribute from which the group memberships shall be determined.
+	// Each value of the attribute is treated as the name of a group.
+	// When not specified, no group memberships will be provided to Kubernetes.
+	// +optional
+	Groups string `json:"groups,omitempty"`
+}
+
+// SAMLIdentityProviderSpec is the spec for configuring a SAML identity provider.
+type SAMLIdentityProviderSpec struct {
+	// Metadata describes where to find the identity provider's SAML metadata.
+	Metadata SAMLMetadataSpec `json:"metadata"`
+
+	// Claims provides a mapping from attributes of SAML assertions to Kubernetes usernames and groups.
+	// +optional
+	Claims SAMLClaims `json:"claims,omitempty"`
+}
+
+// SAMLIdentityProvider describes the configuration of an upstream SAML 2.0 identity provider.
+//
+// Only web-based logins are supported, using the SP-initiated flow with the HTTP-Redirect binding for
+// authentication requests and the HTTP-POST binding for responses.
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:categories=pinniped;pinniped-idp;pinniped-idps
+// +kubebuilder:printcolumn:name="Metadata URL",type=string,JSONPath=`.spec.metadata.url`
+// +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+// +kubebuilder:subresource:status
+type SAMLIdentityProvider struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec for configuring the identity provider.
+	Spec SAMLIdentityProviderSpec `json:"spec"`
+
+	// Status of the identity provider.
+	Status SAMLIdentityProviderStatus `json:"status,omitempty"`
+}
+
+// SAMLIdentityProviderList lists SAMLIdentityProvider objects.
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type SAMLIdentityProviderList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []SAMLIdentityProvider `json:"items"`
+}
@@ -0,0 +1,216 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package acmecert obtains the TLS serving certificates of FederationDomains from certificate authorities using
+// ACME (RFC 8555). The responses to the challenges of the certificate authorities are stored in Secrets, so that
+// every Supervisor pod can answer them, no matter which pod requested the certificate.
+package acmecert
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// TypeLabelValue is the value of the storage.pinniped.dev/type label of the Secrets which hold the responses to
+	// ACME challenges.
+	TypeLabelValue = "acme-challenge"
+
+	// HTTP01ChallengePathPrefix is the path prefix of the URLs at which certificate authorities request the responses
+	// to HTTP-01 challenges.
+	HTTP01ChallengePathPrefix = "/.well-known/acme-challenge/"
+
+	// TLSALPN01Protocol is the ALPN protocol of the TLS connections in which certificate authorities request the
+	// responses to TLS-ALPN-01 challenges (RFC 8737).
+	TLSALPN01Protocol = "acme-tls/1"
+
+	// challengeLifetime is how long a challenge response is kept, which is much longer than any validation takes.
+	// Responses are deleted right after the validation anyway.
+	challengeLifetime = time.Hour
+
+	ErrInvalidChallengeData = constable.Error("acme challenge data is not valid")
+
+	challengeStorageVersion = "1"
+)
+
+type storedChallenge struct {
+	// KeyAuthorization is the response to an HTTP-01 challenge.
+	KeyAuthorization string `json:"keyAuthorization,omitempty"`
+	// Certificate and PrivateKey are the PEM encoded certificate of a TLS-ALPN-01 challenge and its key.
+	Certificate []byte `json:"certificate,omitempty"`
+	PrivateKey  []byte `json:"privateKey,omitempty"`
+	Version     string `json:"version"`
+}
+
+// ChallengeStorage stores the responses to ACME challenges in Secrets, which are garbage collected after an hour.
+// The responses are written with the client and read from the informer cache, since certificate authorities may
+// request them many times and from anywhere.
+type ChallengeStorage struct {
+	storage      crud.Storage
+	secretLister corev1listers.SecretNamespaceLister
+}
+
+// NewChallengeStorage returns a ChallengeStorage which writes with the given client and reads with the given lister
+// of the same namespace.
+func NewChallengeStorage(
+	secrets corev1client.SecretInterface,
+	secretLister corev1listers.SecretNamespaceLister,
+	clock func() time.Time,
+) *ChallengeStorage {
+	return &ChallengeStorage{
+		storage:      crud.New(TypeLabelValue, secrets, clock, challengeLifetime),
+		secretLister: secretLister,
+	}
+}
+
+// PutHTTP01 stores the key authorization which is the response to the HTTP-01 challenge with the given token.
+func (s *ChallengeStorage) PutHTTP01(ctx context.Context, token string, keyAuthorization string) error {
+	_, err := s.storage.Create(ctx, signature("http-01", token), &storedChallenge{
+		KeyAuthorization: keyAuthorization,
+		Version:          challengeStorageVersion,
+	}, nil)
+	return err
+}
+
+// DeleteHTTP01 deletes the response to the HTTP-01 challenge with the given token.
+func (s *ChallengeStorage) DeleteHTTP01(ctx context.Context, token string) error {
+	return s.storage.Delete(ctx, signature("http-01", token))
+}
+
+// GetHTTP01 returns the key authorization which is the response to the HTTP-01 challenge with the given token.
+func (s *ChallengeStorage) GetHTTP01(token string) (string, error) {
+	stored, err := s.get(signature("http-01", token))
+	if err != nil {
+		return "", err
+	}
+	return stored.KeyAuthorization, nil
+}
+
+// PutTLSALPN01 stores the certificate which is the response to the TLS-ALPN-01 challenge for the given hostname.
+// There is only one challenge per hostname at a time, so any leftover response of an earlier attempt is replaced.
+func (s *ChallengeStorage) PutTLSALPN01(ctx context.Context, host string, cert *tls.Certificate) error {
+	certPEM, keyPEM, err := encodeCertificate(cert)
+	if err != nil {
+		return err
+	}
+	if err := s.DeleteTLSALPN01(ctx, host); err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	_, err = s.storage.Create(ctx, signature("tls-alpn-01", strings.ToLower(host)), &storedChallenge{
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+		Version:     challengeStorageVersion,
+	}, nil)
+	return err
+}
+
+// DeleteTLSALPN01 deletes the response to the TLS-ALPN-01 challenge for the given hostname.
+func (s *ChallengeStorage) DeleteTLSALPN01(ctx context.Context, host string) error {
+	return s.storage.Delete(ctx, signature("tls-alpn-01", strings.ToLower(host)))
+}
+
+// GetTLSALPN01 returns the certificate which is the response to the TLS-ALPN-01 challenge for the given hostname.
+func (s *ChallengeStorage) GetTLSALPN01(host string) (*tls.Certificate, error) {
+	stored, err := s.get(signature("tls-alpn-01", strings.ToLower(host)))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(stored.Certificate, stored.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidChallengeData, err)
+	}
+	return &cert, nil
+}
+
+func (s *ChallengeStorage) get(signature string) (*storedChallenge, error) {
+	secret, err := s.secretLister.Get(crud.SecretName(TypeLabelValue, signature))
+	if err != nil {
+		return nil, err
+	}
+	var stored storedChallenge
+	if err := crud.FromSecret(TypeLabelValue, secret, &stored); err != nil {
+		return nil, err
+	}
+	if stored.Version != challengeStorageVersion {
+		return nil, fmt.Errorf("%w: version %q is not supported", ErrInvalidChallengeData, stored.Version)
+	}
+	return &stored, nil
+}
+
+// IsTLSALPN01Hello returns whether the TLS handshake was started by a certificate authority to validate a
+// TLS-ALPN-01 challenge, which only offers the acme-tls/1 protocol.
+func IsTLSALPN01Hello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == TLSALPN01Protocol
+}
+
+// GetTLSALPN01Certificate returns the certificate of the TLS-ALPN-01 challenge for the server name of the TLS
+// handshake, which is meant to be used by a tls.Config.GetCertificate function for handshakes for which
+// IsTLSALPN01Hello is true.
+func (s *ChallengeStorage) GetTLSALPN01Certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := s.GetTLSALPN01(hello.ServerName)
+	if err != nil {
+		plog.DebugErr("could not find the certificate of a TLS-ALPN-01 challenge", err, "serverName", hello.ServerName)
+		return nil, fmt.Errorf("no TLS-ALPN-01 challenge for %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// NewHTTP01Handler returns an http.Handler that serves the responses to HTTP-01 challenges at
+// HTTP01ChallengePathPrefix, for any hostname.
+func NewHTTP01Handler(storage *ChallengeStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed (try GET)", http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(r.URL.Path, HTTP01ChallengePathPrefix)
+		if token == "" || strings.Contains(token, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		keyAuthorization, err := storage.GetHTTP01(token)
+		if k8serrors.IsNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			plog.WarningErr("could not get the response to an HTTP-01 challenge", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(keyAuthorization))
+	})
+}
+
+func encodeCertificate(cert *tls.Certificate) ([]byte, []byte, error) {
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err := encodePrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func signature(challengeType string, value string) string {
+	sum := sha256.Sum256([]byte(challengeType + ":" + value))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package acmecert
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+
+	"go.pinniped.dev/internal/certauthority"
+)
+
+// newTestChallengeStorage returns a ChallengeStorage whose informer cache is updated right when Secrets are created
+// or deleted, like a running informer would eventually do.
+func newTestChallengeStorage(t *testing.T) (*ChallengeStorage, *fake.Clientset) {
+	t.Helper()
+	kubeClient := fake.NewSimpleClientset()
+	secretInformer := kubeinformers.NewSharedInformerFactory(kubeClient, 0).Core().V1().Secrets()
+	indexer := secretInformer.Informer().GetIndexer()
+	kubeClient.PrependReactor("create", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+		secret := action.(coretesting.CreateAction).GetObject().(*corev1.Secret).DeepCopy()
+		secret.Namespace = action.GetNamespace()
+		require.NoError(t, indexer.Add(secret))
+		return false, nil, nil
+	})
+	kubeClient.PrependReactor("delete", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+		require.NoError(t, indexer.Delete(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Namespace: action.GetNamespace(),
+			Name:      action.(coretesting.DeleteAction).GetName(),
+		}}))
+		return false, nil, nil
+	})
+	storage := NewChallengeStorage(
+		kubeClient.CoreV1().Secrets("some-namespace"),
+		secretInformer.Lister().Secrets("some-namespace"),
+		time.Now,
+	)
+	return storage, kubeClient
+}
+
+func TestHTTP01Handler(t *testing.T) {
+	storage, kubeClient := newTestChallengeStorage(t)
+	require.NoError(t, storage.PutHTTP01(context.Background(), "some-token", "some-token.some-thumbprint"))
+
+	secrets, err := kubeClient.CoreV1().Secrets("some-namespace").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, secrets.Items, 1)
+	require.Equal(t, TypeLabelValue, secrets.Items[0].Labels["storage.pinniped.dev/type"])
+	require.Contains(t, secrets.Items[0].Annotations, "storage.pinniped.dev/garbage-collect-after")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "known token",
+			method:     http.MethodGet,
+			path:       "/.well-known/acme-challenge/some-token",
+			wantStatus: http.StatusOK,
+			wantBody:   "some-token.some-thumbprint",
+		},
+		{
+			name:       "unknown token",
+			method:     http.MethodGet,
+			path:       "/.well-known/acme-challenge/other-token",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "404 page not found\n",
+		},
+		{
+			name:       "no token",
+			method:     http.MethodGet,
+			path:       "/.well-known/acme-challenge/",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "404 page not found\n",
+		},
+		{
+			name:       "wrong method",
+			method:     http.MethodPost,
+			path:       "/.well-known/acme-challenge/some-token",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   "Method not allowed (try GET)\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			rsp := httptest.NewRecorder()
+			NewHTTP01Handler(storage).ServeHTTP(rsp, httptest.NewRequest(test.method, test.path, nil))
+			require.Equal(t, test.wantStatus, rsp.Code)
+			require.Equal(t, test.wantBody, rsp.Body.String())
+		})
+	}
+
+	require.NoError(t, storage.DeleteHTTP01(context.Background(), "some-token"))
+	rsp := httptest.NewRecorder()
+	NewHTTP01Handler(storage).ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/some-token", nil))
+	require.Equal(t, http.StatusNotFound, rsp.Code)
+}
+
+func TestTLSALPN01Certificate(t *testing.T) {
+	ca, err := certauthority.New("some-ca", time.Hour)
+	require.NoError(t, err)
+	cert, err := ca.IssueServerCert([]string{"issuer.example.com"}, nil, time.Hour)
+	require.NoError(t, err)
+	otherCert, err := ca.IssueServerCert([]string{"issuer.example.com"}, nil, time.Hour)
+	require.NoError(t, err)
+
+	storage, _ := newTestChallengeStorage(t)
+	require.NoError(t, storage.PutTLSALPN01(context.Background(), "issuer.example.com", cert))
+	// A leftover challenge of an earlier attempt is replaced.
+	require.NoError(t, storage.PutTLSALPN01(context.Background(), "Issuer.Example.com", otherCert))
+
+	hello := &tls.ClientHelloInfo{ServerName: "issuer.example.com", SupportedProtos: []string{TLSALPN01Protocol}}
+	require.True(t, IsTLSALPN01Hello(hello))
+	require.False(t, IsTLSALPN01Hello(&tls.ClientHelloInfo{ServerName: "issuer.example.com", SupportedProtos: []string{"h2", "http/1.1"}}))
+	require.False(t, IsTLSALPN01Hello(&tls.ClientHelloInfo{ServerName: "issuer.example.com", SupportedProtos: []string{TLSALPN01Protocol, "h2"}}))
+
+	got, err := storage.GetTLSALPN01Certificate(hello)
+	require.NoError(t, err)
+	require.Equal(t, otherCert.Certificate, got.Certificate)
+
+	_, err = storage.GetTLSALPN01Certificate(&tls.ClientHelloInfo{ServerName: "other.example.com", SupportedProtos: []string{TLSALPN01Protocol}})
+	require.EqualError(t, err, `no TLS-ALPN-01 challenge for "other.example.com"`)
+
+	require.NoError(t, storage.DeleteTLSALPN01(context.Background(), "issuer.example.com"))
+	_, err = storage.GetTLSALPN01Certificate(hello)
+	require.EqualError(t, err, `no TLS-ALPN-01 challenge for "issuer.example.com"`)
+}
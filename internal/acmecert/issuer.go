@@ -0,0 +1,235 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package acmecert
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+// ChallengeType is the type of challenge which is used to prove the control of a hostname to a certificate authority.
+type ChallengeType string
+
+const (
+	HTTP01ChallengeType    ChallengeType = "http-01"
+	TLSALPN01ChallengeType ChallengeType = "tls-alpn-01"
+)
+
+// Request describes the certificate which should be obtained from a certificate authority.
+type Request struct {
+	// HTTPClient is used to talk to the certificate authority.
+	HTTPClient *http.Client
+	// DirectoryURL is the URL of the ACME directory of the certificate authority.
+	DirectoryURL string
+	// AccountKey is the key of the ACME account. The account is registered when it does not exist yet.
+	AccountKey crypto.Signer
+	// Email is the optional contact address of the ACME account.
+	Email string
+	// Host is the DNS name for which the certificate is requested.
+	Host string
+	// ChallengeType is the type of challenge which is used to prove the control of Host.
+	ChallengeType ChallengeType
+}
+
+// Certificate is a certificate which was obtained from a certificate authority.
+type Certificate struct {
+	// CertificatePEM is the PEM encoded certificate chain, starting with the leaf certificate.
+	CertificatePEM []byte
+	// PrivateKeyPEM is the PEM encoded private key of the leaf certificate.
+	PrivateKeyPEM []byte
+	// NotBefore and NotAfter are the validity period of the leaf certificate.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Issuer obtains certificates from certificate authorities using ACME.
+type Issuer struct {
+	challenges *ChallengeStorage
+	rand       io.Reader
+}
+
+// NewIssuer returns an Issuer which stores the responses to challenges in the given ChallengeStorage, where they
+// can be found by the handlers of the Supervisor.
+func NewIssuer(challenges *ChallengeStorage, rand io.Reader) *Issuer {
+	return &Issuer{challenges: challenges, rand: rand}
+}
+
+// Obtain registers the ACME account when needed, proves the control of the host to the certificate authority,
+// and returns the certificate which was issued for the host along with a newly generated private key.
+func (i *Issuer) Obtain(ctx context.Context, req *Request) (*Certificate, error) {
+	client := &acme.Client{
+		Key:          req.AccountKey,
+		HTTPClient:   req.HTTPClient,
+		DirectoryURL: req.DirectoryURL,
+		UserAgent:    "pinniped-supervisor",
+	}
+
+	account := &acme.Account{}
+	if req.Email != "" {
+		account.Contact = []string{"mailto:" + req.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("could not register ACME account: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(req.Host))
+	if err != nil {
+		return nil, fmt.Errorf("could not create ACME order: %w", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := i.authorize(ctx, client, authzURL, req); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("ACME order did not become ready: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), i.rand)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate private key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(i.rand, &x509.CertificateRequest{DNSNames: []string{req.Host}}, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create certificate signing request: %w", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not finalize ACME order: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse issued certificate: %w", err)
+	}
+	if err := leaf.VerifyHostname(req.Host); err != nil {
+		return nil, fmt.Errorf("issued certificate is not valid for the requested host: %w", err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{
+		CertificatePEM: certPEM,
+		PrivateKeyPEM:  keyPEM,
+		NotBefore:      leaf.NotBefore,
+		NotAfter:       leaf.NotAfter,
+	}, nil
+}
+
+func (i *Issuer) authorize(ctx context.Context, client *acme.Client, authzURL string, req *Request) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("could not get ACME authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == string(req.ChallengeType) {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("certificate authority did not offer a %s challenge for %q", req.ChallengeType, req.Host)
+	}
+
+	switch req.ChallengeType {
+	case HTTP01ChallengeType:
+		keyAuthorization, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return fmt.Errorf("could not create %s challenge response: %w", req.ChallengeType, err)
+		}
+		if err := i.challenges.PutHTTP01(ctx, challenge.Token, keyAuthorization); err != nil {
+			return fmt.Errorf("could not store %s challenge response: %w", req.ChallengeType, err)
+		}
+		defer func() {
+			if err := i.challenges.DeleteHTTP01(ctx, challenge.Token); err != nil {
+				plog.DebugErr("could not delete ACME challenge response", err, "host", req.Host)
+			}
+		}()
+	case TLSALPN01ChallengeType:
+		cert, err := client.TLSALPN01ChallengeCert(challenge.Token, req.Host)
+		if err != nil {
+			return fmt.Errorf("could not create %s challenge response: %w", req.ChallengeType, err)
+		}
+		if err := i.challenges.PutTLSALPN01(ctx, req.Host, &cert); err != nil {
+			return fmt.Errorf("could not store %s challenge response: %w", req.ChallengeType, err)
+		}
+		defer func() {
+			if err := i.challenges.DeleteTLSALPN01(ctx, req.Host); err != nil {
+				plog.DebugErr("could not delete ACME challenge response", err, "host", req.Host)
+			}
+		}()
+	default:
+		return fmt.Errorf("unsupported challenge type %q", req.ChallengeType)
+	}
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("could not accept %s challenge: %w", req.ChallengeType, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s challenge for %q failed: %w", req.ChallengeType, req.Host, err)
+	}
+	return nil
+}
+
+// GenerateAccountKey returns a new key for an ACME account.
+func GenerateAccountKey(rand io.Reader) (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand)
+}
+
+// EncodeAccountKey returns the PEM encoding of a key for an ACME account.
+func EncodeAccountKey(key crypto.Signer) ([]byte, error) {
+	return encodePrivateKey(key)
+}
+
+// ParseAccountKey parses the PEM encoding of a key for an ACME account.
+func ParseAccountKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T is not supported", key)
+	}
+	return signer, nil
+}
+
+func encodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
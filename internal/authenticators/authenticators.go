@@ -6,6 +6,7 @@ package authenticators
 
 import (
 	"context"
+	"fmt"
 
 	"k8s.io/apiserver/pkg/authentication/user"
 )
@@ -26,6 +27,10 @@ import (
 //    - nil response
 //    - false
 //    - an error
+// 4. For a user who may not log in because of the state of their account, e.g. an expired password:
+//    - nil response
+//    - false
+//    - an *AccountStateError
 // Other combinations of return values must be avoided.
 //
 // See k8s.io/apiserver/pkg/authentication/authenticator/interfaces.go for the token authenticator
@@ -39,3 +44,60 @@ type Response struct {
 	DN                     string
 	ExtraRefreshAttributes map[string]string
 }
+
+// AccountStateReason describes why the state of a user's account prevented them from logging in.
+type AccountStateReason string
+
+const (
+	AccountStatePasswordExpired    = AccountStateReason("PasswordExpired")
+	AccountStatePasswordMustChange = AccountStateReason("PasswordMustChange")
+	AccountStateAccountLocked      = AccountStateReason("AccountLocked")
+	AccountStateAccountDisabled    = AccountStateReason("AccountDisabled")
+	AccountStateAccountExpired     = AccountStateReason("AccountExpired")
+	AccountStateLoginNotPermitted  = AccountStateReason("LoginNotPermitted")
+)
+
+// accountStateDescriptions are safe to show to the end user, because they do not include any details from the
+// upstream identity provider.
+var accountStateDescriptions = map[AccountStateReason]string{
+	AccountStatePasswordExpired:    "Your password has expired. Please change your password and try again.",
+	AccountStatePasswordMustChange: "Your password must be changed before you can log in. Please change your password and try again.",
+	AccountStateAccountLocked:      "Your account is locked. Please contact your administrator.",
+	AccountStateAccountDisabled:    "Your account is disabled. Please contact your administrator.",
+	AccountStateAccountExpired:     "Your account has expired. Please contact your administrator.",
+	AccountStateLoginNotPermitted:  "Your account is not permitted to log in at this time. Please contact your administrator.",
+}
+
+// AccountStateError is returned by a UserAuthenticator when a user may not log in because of the state of their
+// account. Its Description is safe to show to the end user. The wrapped error may include details from the upstream
+// identity provider, so it should only be logged.
+type AccountStateError struct {
+	Reason AccountStateReason
+	Err    error
+}
+
+func (e *AccountStateError) Error() string {
+	if e.Err == nil {
+		return string(e.Reason)
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err.Error())
+}
+
+func (e *AccountStateError) Unwrap() error {
+	return e.Err
+}
+
+// Description returns a description of the error which is safe to show to the end user.
+func (e *AccountStateError) Description() string {
+	if description, ok := AccountStateDescription(e.Reason); ok {
+		return description
+	}
+	return "Your account is not permitted to log in. Please contact your administrator."
+}
+
+// AccountStateDescription returns the description of a known reason which is safe to show to the end user.
+// It returns false when the reason is not known.
+func AccountStateDescription(reason AccountStateReason) (string, bool) {
+	description, ok := accountStateDescriptions[reason]
+	return description, ok
+}
@@ -38,6 +38,8 @@ func TestFromPath(t *testing.T) {
 				    address: :1234
 				  http:
 				    network: disabled
+				loginLimits:
+				  clientIP: true
 			`),
 			wantConfig: &Config{
 				APIGroupSuffix: pointer.StringPtr("some.suffix.com"),
@@ -57,6 +59,9 @@ func TestFromPath(t *testing.T) {
 						Network: "disabled",
 					},
 				},
+				LoginLimits: LoginLimitsSpec{
+					ClientIP: true,
+				},
 			},
 		},
 		{
@@ -12,6 +12,7 @@ type Config struct {
 	NamesConfig    NamesConfigSpec   `json:"names"`
 	LogLevel       plog.LogLevel     `json:"logLevel"`
 	Endpoints      *Endpoints        `json:"endpoints"`
+	LoginLimits    LoginLimitsSpec   `json:"loginLimits"`
 }
 
 // NamesConfigSpec configures the names of some Kubernetes resources for the Supervisor.
@@ -19,6 +20,14 @@ type NamesConfigSpec struct {
 	DefaultTLSCertificateSecret string `json:"defaultTLSCertificateSecret"`
 }
 
+// LoginLimitsSpec configures the limits of failed password logins. The failed logins of each username are always
+// limited.
+type LoginLimitsSpec struct {
+	// ClientIP also limits the failed logins of each client IP address. It should only be enabled when clients
+	// connect to the Supervisor directly, since all clients behind the same proxy or load balancer share its address.
+	ClientIP bool `json:"clientIP"`
+}
+
 type Endpoints struct {
 	HTTPS *Endpoint `json:"https,omitempty"`
 	HTTP  *Endpoint `json:"http,omitempty"`
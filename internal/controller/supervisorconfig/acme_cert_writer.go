@@ -0,0 +1,459 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorconfig
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
+	configinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/config/v1alpha1"
+	"go.pinniped.dev/internal/acmecert"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamwatchers"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/net/phttp"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// acmeAccountKeyKey is the key in the Data map of a FederationDomain's ACME account Secret which holds the
+	// PEM encoded private key of the ACME account.
+	//
+	// Note! The value for this key will contain private key material!
+	acmeAccountKeyKey = "accountKey"
+
+	acmeAccountSecretTypeValue corev1.SecretType = "secrets.pinniped.dev/federation-domain-acme-account"
+
+	// acmeErrorRetryInterval is how long to wait before trying again after a certificate could not be obtained.
+	acmeErrorRetryInterval = 15 * time.Minute
+
+	// acmeObtainTimeout is how long an attempt to obtain a certificate may take, including the validation of the
+	// challenges by the certificate authority.
+	acmeObtainTimeout = 5 * time.Minute
+)
+
+// CertificateIssuer obtains certificates using ACME. It is implemented by acmecert.Issuer.
+type CertificateIssuer interface {
+	Obtain(ctx context.Context, req *acmecert.Request) (*acmecert.Certificate, error)
+}
+
+type acmeCertWriterController struct {
+	secretLabels             map[string]string
+	issuer                   CertificateIssuer
+	clock                    clock.Clock
+	kubeClient               kubernetes.Interface
+	pinnipedClient           pinnipedclientset.Interface
+	federationDomainInformer configinformers.FederationDomainInformer
+	secretInformer           corev1informers.SecretInformer
+}
+
+// NewACMECertWriterController returns a controllerlib.Controller that obtains the TLS certificates of the
+// FederationDomains which configure spec.tls.acme, and renews them when two thirds of their lifetime have passed.
+// The certificates are written into the Secrets named by spec.tls.secretName, from where they are loaded by the
+// TLS cert observer controller like any other certificate. The progress is reported in status.acme.
+func NewACMECertWriterController(
+	secretLabels map[string]string,
+	issuer CertificateIssuer,
+	clock clock.Clock,
+	kubeClient kubernetes.Interface,
+	pinnipedClient pinnipedclientset.Interface,
+	secretInformer corev1informers.SecretInformer,
+	federationDomainInformer configinformers.FederationDomainInformer,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+	initialEventFunc pinnipedcontroller.WithInitialEventOptionFunc,
+) controllerlib.Controller {
+	return controllerlib.New(
+		controllerlib.Config{
+			Name: "acme-cert-writer-controller",
+			Syncer: &acmeCertWriterController{
+				secretLabels:             secretLabels,
+				issuer:                   issuer,
+				clock:                    clock,
+				kubeClient:               kubeClient,
+				pinnipedClient:           pinnipedClient,
+				federationDomainInformer: federationDomainInformer,
+				secretInformer:           secretInformer,
+			},
+		},
+		// Check all FederationDomains whenever a TLS Secret changes, e.g. when one is deleted, since it is not
+		// cheap to find out which FederationDomains refer to a given Secret.
+		withInformer(
+			secretInformer,
+			pinnipedcontroller.MatchAnySecretOfTypeFilter(corev1.SecretTypeTLS, pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			federationDomainInformer,
+			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
+		initialEventFunc(controllerlib.Key{}),
+	)
+}
+
+// Sync implements controllerlib.Syncer.
+func (c *acmeCertWriterController) Sync(ctx controllerlib.Context) error {
+	federationDomains, err := c.federationDomainInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list FederationDomains: %w", err)
+	}
+
+	var errs []error
+	var requeueAfter time.Duration
+	for _, federationDomain := range federationDomains {
+		dueIn, err := c.syncFederationDomain(ctx.Context, federationDomain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not sync ACME certificate of FederationDomain %s/%s: %w",
+				federationDomain.Namespace, federationDomain.Name, err))
+		}
+		if dueIn > 0 && (requeueAfter == 0 || dueIn < requeueAfter) {
+			requeueAfter = dueIn
+		}
+	}
+
+	if requeueAfter > 0 {
+		ctx.Queue.AddAfter(ctx.Key, requeueAfter)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// syncFederationDomain makes sure that the FederationDomain has a valid certificate when it configures ACME, and
+// returns when it needs to be checked again.
+func (c *acmeCertWriterController) syncFederationDomain(ctx context.Context, federationDomain *configv1alpha1.FederationDomain) (time.Duration, error) {
+	if federationDomain.Spec.TLS == nil || federationDomain.Spec.TLS.ACME == nil {
+		return 0, c.updateStatus(ctx, federationDomain, nil)
+	}
+	acmeSpec := federationDomain.Spec.TLS.ACME
+	secretName := federationDomain.Spec.TLS.SecretName
+	now := c.clock.Now()
+
+	var lastAttemptTime *metav1.Time
+	if federationDomain.Status.ACME != nil {
+		lastAttemptTime = federationDomain.Status.ACME.LastAttemptTime
+	}
+
+	// Configuration errors are not retried, since the FederationDomain will be synced again when it is fixed.
+	if secretName == "" {
+		return 0, c.updateStatus(ctx, federationDomain, acmeErrorStatus(lastAttemptTime,
+			"spec.tls.secretName must name the Secret in which the certificate will be stored"))
+	}
+	host, err := acmeHost(federationDomain.Spec.Issuer)
+	if err != nil {
+		return 0, c.updateStatus(ctx, federationDomain, acmeErrorStatus(lastAttemptTime, err.Error()))
+	}
+
+	secret, err := c.secretInformer.Lister().Secrets(federationDomain.Namespace).Get(secretName)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return 0, fmt.Errorf("cannot get secret: %w", err)
+	}
+
+	if leaf := certificateForHost(secret, host); leaf != nil {
+		renewalTime := acmeRenewalTime(leaf)
+		if now.Before(renewalTime) {
+			return renewalTime.Sub(now), c.updateStatus(ctx, federationDomain, acmeReadyStatus(lastAttemptTime, host, leaf.NotAfter, renewalTime))
+		}
+	}
+
+	// Do not keep asking the certificate authority after a failure, and do not interrupt an attempt in progress.
+	if status := federationDomain.Status.ACME; status != nil && status.LastAttemptTime != nil {
+		var wait time.Duration
+		switch status.Phase {
+		case configv1alpha1.ErrorFederationDomainACMEPhase:
+			wait = acmeErrorRetryInterval
+		case configv1alpha1.PendingFederationDomainACMEPhase:
+			wait = acmeObtainTimeout
+		}
+		if nextAttemptTime := status.LastAttemptTime.Add(wait); now.Before(nextAttemptTime) {
+			return nextAttemptTime.Sub(now), nil
+		}
+	}
+
+	// Record the attempt before talking to the certificate authority. This write fails when this pod is not the
+	// leader, so only one pod tries to obtain the certificate.
+	attemptTime := metav1.NewTime(now).Rfc3339Copy()
+	if err := c.updateStatus(ctx, federationDomain, &configv1alpha1.FederationDomainACMEStatus{
+		Phase:           configv1alpha1.PendingFederationDomainACMEPhase,
+		Message:         fmt.Sprintf("requesting a certificate for %q from %s", host, acmeSpec.DirectoryURL),
+		LastAttemptTime: &attemptTime,
+	}); err != nil {
+		return 0, err
+	}
+
+	cert, err := c.obtainCertificate(ctx, federationDomain, host)
+	if err == nil {
+		err = c.createOrUpdateCertificateSecret(ctx, federationDomain.Namespace, secretName, cert)
+	}
+	if err != nil {
+		plog.WarningErr("could not obtain ACME certificate", err, "federationdomain", klog.KObj(federationDomain), "host", host)
+		return acmeErrorRetryInterval, c.updateStatus(ctx, federationDomain, acmeErrorStatus(&attemptTime,
+			fmt.Sprintf("could not obtain a certificate for %q: %v", host, err)))
+	}
+	plog.Info("obtained ACME certificate", "federationdomain", klog.KObj(federationDomain), "host", host, "notAfter", cert.NotAfter)
+
+	renewalTime := acmeRenewalTime(&x509.Certificate{NotBefore: cert.NotBefore, NotAfter: cert.NotAfter})
+	return renewalTime.Sub(now), c.updateStatus(ctx, federationDomain, acmeReadyStatus(&attemptTime, host, cert.NotAfter, renewalTime))
+}
+
+func (c *acmeCertWriterController) obtainCertificate(
+	ctx context.Context,
+	federationDomain *configv1alpha1.FederationDomain,
+	host string,
+) (*acmecert.Certificate, error) {
+	acmeSpec := federationDomain.Spec.TLS.ACME
+
+	var rootCAs *x509.CertPool
+	if acmeSpec.CertificateAuthorityData != "" {
+		bundle, err := base64.StdEncoding.DecodeString(acmeSpec.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("spec.tls.acme.certificateAuthorityData is invalid: %w", err)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("spec.tls.acme.certificateAuthorityData is invalid: %w", upstreamwatchers.ErrNoCertificates)
+		}
+	}
+	httpClient := phttp.Default(rootCAs)
+	httpClient.Timeout = time.Minute
+
+	accountKey, err := c.accountKey(ctx, federationDomain)
+	if err != nil {
+		return nil, err
+	}
+
+	challengeType := acmecert.HTTP01ChallengeType
+	if acmeSpec.ChallengeType == configv1alpha1.TLSALPN01FederationDomainACMEChallengeType {
+		challengeType = acmecert.TLSALPN01ChallengeType
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, acmeObtainTimeout)
+	defer cancel()
+	return c.issuer.Obtain(ctx, &acmecert.Request{
+		HTTPClient:    httpClient,
+		DirectoryURL:  acmeSpec.DirectoryURL,
+		AccountKey:    accountKey,
+		Email:         acmeSpec.Email,
+		Host:          host,
+		ChallengeType: challengeType,
+	})
+}
+
+// accountKey returns the key of the FederationDomain's ACME account, which is kept in a Secret owned by the
+// FederationDomain, so that the same account is used for every renewal. A Secret of another type with the same
+// name belongs to someone else, so it is reported instead of being replaced.
+func (c *acmeCertWriterController) accountKey(ctx context.Context, federationDomain *configv1alpha1.FederationDomain) (crypto.Signer, error) {
+	secretName := federationDomain.Name + "-acme-account"
+	secret, err := c.secretInformer.Lister().Secrets(federationDomain.Namespace).Get(secretName)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, fmt.Errorf("cannot get secret: %w", err)
+	}
+	if err == nil {
+		if secret.Type != acmeAccountSecretTypeValue {
+			return nil, fmt.Errorf("secret %q has type %q, but it must have type %q", secretName, secret.Type, acmeAccountSecretTypeValue)
+		}
+		if key, err := acmecert.ParseAccountKey(secret.Data[acmeAccountKeyKey]); err == nil {
+			return key, nil
+		}
+	}
+
+	key, err := acmecert.GenerateAccountKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate ACME account key: %w", err)
+	}
+	keyPEM, err := acmecert.EncodeAccountKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	newSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: federationDomain.Namespace,
+			Labels:    c.secretLabels,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(federationDomain, schema.GroupVersionKind{
+					Group:   configv1alpha1.SchemeGroupVersion.Group,
+					Version: configv1alpha1.SchemeGroupVersion.Version,
+					Kind:    federationDomainKind,
+				}),
+			},
+		},
+		Data: map[string][]byte{acmeAccountKeyKey: keyPEM},
+		Type: acmeAccountSecretTypeValue,
+	}
+	secretClient := c.kubeClient.CoreV1().Secrets(federationDomain.Namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		oldSecret, err := secretClient.Get(ctx, secretName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			_, err = secretClient.Create(ctx, newSecret, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if oldSecret.Type != acmeAccountSecretTypeValue {
+			return fmt.Errorf("secret %q has type %q, but it must have type %q", secretName, oldSecret.Type, acmeAccountSecretTypeValue)
+		}
+		oldSecret.Data = newSecret.Data
+		_, err = secretClient.Update(ctx, oldSecret, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot store ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+// createOrUpdateCertificateSecret writes the certificate into the Secret named by spec.tls.secretName. The Secret
+// may also be managed by the user, so it is not owned by the FederationDomain and unrelated data is kept.
+func (c *acmeCertWriterController) createOrUpdateCertificateSecret(
+	ctx context.Context,
+	namespace string,
+	secretName string,
+	cert *acmecert.Certificate,
+) error {
+	secretClient := c.kubeClient.CoreV1().Secrets(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		oldSecret, err := secretClient.Get(ctx, secretName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			_, err = secretClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      secretName,
+					Namespace: namespace,
+					Labels:    c.secretLabels,
+				},
+				Data: map[string][]byte{
+					corev1.TLSCertKey:       cert.CertificatePEM,
+					corev1.TLSPrivateKeyKey: cert.PrivateKeyPEM,
+				},
+				Type: corev1.SecretTypeTLS,
+			}, metav1.CreateOptions{})
+			if err != nil {
+				return fmt.Errorf("cannot create secret: %w", err)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot get secret: %w", err)
+		}
+		if oldSecret.Type != corev1.SecretTypeTLS {
+			return fmt.Errorf("secret %q has type %q, but it must have type %q", secretName, oldSecret.Type, corev1.SecretTypeTLS)
+		}
+		if oldSecret.Data == nil {
+			oldSecret.Data = map[string][]byte{}
+		}
+		oldSecret.Data[corev1.TLSCertKey] = cert.CertificatePEM
+		oldSecret.Data[corev1.TLSPrivateKeyKey] = cert.PrivateKeyPEM
+		if _, err := secretClient.Update(ctx, oldSecret, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("cannot update secret: %w", err)
+		}
+		return nil
+	})
+}
+
+// updateStatus sets status.acme of the FederationDomain, unless it is already up to date.
+func (c *acmeCertWriterController) updateStatus(
+	ctx context.Context,
+	federationDomain *configv1alpha1.FederationDomain,
+	status *configv1alpha1.FederationDomainACMEStatus,
+) error {
+	if equality.Semantic.DeepEqual(federationDomain.Status.ACME, status) {
+		return nil
+	}
+
+	federationDomainClient := c.pinnipedClient.ConfigV1alpha1().FederationDomains(federationDomain.Namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		oldFederationDomain, err := federationDomainClient.Get(ctx, federationDomain.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("cannot get FederationDomain: %w", err)
+		}
+
+		oldFederationDomain.Status.ACME = status
+		_, err = federationDomainClient.UpdateStatus(ctx, oldFederationDomain, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot update FederationDomain status: %w", err)
+	}
+	return nil
+}
+
+// acmeHost returns the hostname of the issuer, for which the certificate is requested.
+func acmeHost(issuer string) (string, error) {
+	issuerURL, err := url.Parse(issuer)
+	if err != nil || issuerURL.Hostname() == "" {
+		return "", fmt.Errorf("spec.issuer %q is not a valid URL", issuer)
+	}
+	host := strings.ToLower(issuerURL.Hostname())
+	if net.ParseIP(host) != nil {
+		return "", fmt.Errorf("ACME certificates can only be requested for DNS names, but the host of spec.issuer is the IP address %q", host)
+	}
+	return host, nil
+}
+
+// certificateForHost returns the leaf certificate in the Secret, if the Secret holds a certificate and key pair
+// which is valid for the host.
+func certificateForHost(secret *corev1.Secret, host string) *x509.Certificate {
+	if secret == nil || secret.Type != corev1.SecretTypeTLS {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.VerifyHostname(host) != nil {
+		return nil
+	}
+	return leaf
+}
+
+// acmeRenewalTime returns when the certificate should be renewed, which is after two thirds of its lifetime, like
+// most ACME clients do.
+func acmeRenewalTime(leaf *x509.Certificate) time.Time {
+	return leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 3)
+}
+
+func acmeReadyStatus(lastAttemptTime *metav1.Time, host string, notAfter, renewalTime time.Time) *configv1alpha1.FederationDomainACMEStatus {
+	notAfterTime := metav1.NewTime(notAfter).Rfc3339Copy()
+	renewalMetaTime := metav1.NewTime(renewalTime).Rfc3339Copy()
+	return &configv1alpha1.FederationDomainACMEStatus{
+		Phase:           configv1alpha1.ReadyFederationDomainACMEPhase,
+		Message:         fmt.Sprintf("the certificate for %q is valid until %s", host, notAfterTime.UTC().Format(time.RFC3339)),
+		LastAttemptTime: lastAttemptTime,
+		NotAfter:        &notAfterTime,
+		RenewalTime:     &renewalMetaTime,
+	}
+}
+
+func acmeErrorStatus(lastAttemptTime *metav1.Time, message string) *configv1alpha1.FederationDomainACMEStatus {
+	return &configv1alpha1.FederationDomainACMEStatus{
+		Phase:           configv1alpha1.ErrorFederationDomainACMEPhase,
+		Message:         message,
+		LastAttemptTime: lastAttemptTime,
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorconfig
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	kubetesting "k8s.io/client-go/testing"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/acmecert"
+	"go.pinniped.dev/internal/certauthority"
+	"go.pinniped.dev/internal/controllerlib"
+)
+
+type fakeCertificateIssuer struct {
+	cert     *acmecert.Certificate
+	err      error
+	requests []*acmecert.Request
+}
+
+func (f *fakeCertificateIssuer) Obtain(_ context.Context, req *acmecert.Request) (*acmecert.Certificate, error) {
+	f.requests = append(f.requests, req)
+	return f.cert, f.err
+}
+
+type acmeTestQueue struct {
+	duration time.Duration
+
+	controllerlib.Queue // panic if any other methods called
+}
+
+func (q *acmeTestQueue) AddAfter(_ controllerlib.Key, duration time.Duration) {
+	q.duration = duration
+}
+
+func TestACMECertWriterControllerSync(t *testing.T) {
+	const namespace = "some-namespace"
+
+	ca, err := certauthority.New("some-ca", time.Hour)
+	require.NoError(t, err)
+	newCertPEM := func(host string, ttl time.Duration) ([]byte, []byte, *x509.Certificate) {
+		certPEM, keyPEM, err := ca.IssueServerCertPEM([]string{host}, nil, ttl)
+		require.NoError(t, err)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return certPEM, keyPEM, leaf
+	}
+	validCertPEM, validKeyPEM, validLeaf := newCertPEM("issuer.example.com", 90*24*time.Hour)
+	expiringCertPEM, expiringKeyPEM, _ := newCertPEM("issuer.example.com", time.Minute)
+	otherHostCertPEM, otherHostKeyPEM, _ := newCertPEM("other.example.com", 90*24*time.Hour)
+	obtainedCertPEM, obtainedKeyPEM, obtainedLeaf := newCertPEM("issuer.example.com", 90*24*time.Hour)
+
+	accountKey, err := acmecert.GenerateAccountKey(rand.Reader)
+	require.NoError(t, err)
+	accountKeyPEM, err := acmecert.EncodeAccountKey(accountKey)
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	nowMetaTime := metav1.NewTime(now)
+	recentMetaTime := metav1.NewTime(now.Add(-5 * time.Minute))
+	longAgoMetaTime := metav1.NewTime(now.Add(-time.Hour))
+	metaTime := func(t time.Time) *metav1.Time {
+		m := metav1.NewTime(t).Rfc3339Copy()
+		return &m
+	}
+
+	newFederationDomain := func(issuer string, tlsSpec *configv1alpha1.FederationDomainTLSSpec, status *configv1alpha1.FederationDomainACMEStatus) *configv1alpha1.FederationDomain {
+		return &configv1alpha1.FederationDomain{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-federation-domain", Namespace: namespace, UID: "some-uid"},
+			Spec:       configv1alpha1.FederationDomainSpec{Issuer: issuer, TLS: tlsSpec},
+			Status:     configv1alpha1.FederationDomainStatus{ACME: status},
+		}
+	}
+	acmeTLSSpec := func(challengeType configv1alpha1.FederationDomainACMEChallengeType) *configv1alpha1.FederationDomainTLSSpec {
+		return &configv1alpha1.FederationDomainTLSSpec{
+			SecretName: "some-tls-secret",
+			ACME: &configv1alpha1.FederationDomainACMESpec{
+				DirectoryURL:  "https://acme.example.com/directory",
+				Email:         "admin@example.com",
+				ChallengeType: challengeType,
+			},
+		}
+	}
+	newTLSSecret := func(certPEM, keyPEM []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-tls-secret", Namespace: namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM, "ca.crt": []byte("some-ca")},
+		}
+	}
+	accountSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-federation-domain-acme-account", Namespace: namespace},
+		Type:       "secrets.pinniped.dev/federation-domain-acme-account",
+		Data:       map[string][]byte{"accountKey": accountKeyPEM},
+	}
+	obtainedCert := &acmecert.Certificate{
+		CertificatePEM: obtainedCertPEM,
+		PrivateKeyPEM:  obtainedKeyPEM,
+		NotBefore:      obtainedLeaf.NotBefore,
+		NotAfter:       obtainedLeaf.NotAfter,
+	}
+	readyStatus := func(lastAttemptTime *metav1.Time, leaf *x509.Certificate) *configv1alpha1.FederationDomainACMEStatus {
+		renewalTime := leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 3)
+		return &configv1alpha1.FederationDomainACMEStatus{
+			Phase:           configv1alpha1.ReadyFederationDomainACMEPhase,
+			Message:         `the certificate for "issuer.example.com" is valid until ` + leaf.NotAfter.UTC().Format(time.RFC3339),
+			LastAttemptTime: lastAttemptTime,
+			NotAfter:        metaTime(leaf.NotAfter),
+			RenewalTime:     metaTime(renewalTime),
+		}
+	}
+	validRenewalIn := validLeaf.NotAfter.Add(-validLeaf.NotAfter.Sub(validLeaf.NotBefore) / 3).Sub(now)
+	obtainedRenewalIn := obtainedLeaf.NotAfter.Add(-obtainedLeaf.NotAfter.Sub(obtainedLeaf.NotBefore) / 3).Sub(now)
+
+	tests := []struct {
+		name                       string
+		federationDomain           *configv1alpha1.FederationDomain
+		secrets                    []*corev1.Secret
+		issuer                     *fakeCertificateIssuer
+		configPinnipedClient       func(*pinnipedfake.Clientset)
+		wantErr                    string
+		wantStatus                 *configv1alpha1.FederationDomainACMEStatus
+		wantStatusUpdates          int
+		wantRequeueAfter           time.Duration
+		wantRequest                *acmecert.Request
+		wantTLSSecretData          map[string][]byte
+		wantNewAccountKey          bool
+		wantAccountSecretUnchanged bool
+	}{
+		{
+			name:             "no ACME configured",
+			federationDomain: newFederationDomain("https://issuer.example.com", &configv1alpha1.FederationDomainTLSSpec{SecretName: "some-tls-secret"}, nil),
+		},
+		{
+			name: "ACME configuration was removed",
+			federationDomain: newFederationDomain("https://issuer.example.com", nil, &configv1alpha1.FederationDomainACMEStatus{
+				Phase: configv1alpha1.ReadyFederationDomainACMEPhase,
+			}),
+			wantStatusUpdates: 1,
+		},
+		{
+			name: "secret name is missing",
+			federationDomain: newFederationDomain("https://issuer.example.com", &configv1alpha1.FederationDomainTLSSpec{
+				ACME: &configv1alpha1.FederationDomainACMESpec{DirectoryURL: "https://acme.example.com/directory"},
+			}, nil),
+			wantStatus: &configv1alpha1.FederationDomainACMEStatus{
+				Phase:   configv1alpha1.ErrorFederationDomainACMEPhase,
+				Message: "spec.tls.secretName must name the Secret in which the certificate will be stored",
+			},
+			wantStatusUpdates: 1,
+		},
+		{
+			name:             "issuer host is an IP address",
+			federationDomain: newFederationDomain("https://127.0.0.1/issuer", acmeTLSSpec(""), nil),
+			wantStatus: &configv1alpha1.FederationDomainACMEStatus{
+				Phase:   configv1alpha1.ErrorFederationDomainACMEPhase,
+				Message: `ACME certificates can only be requested for DNS names, but the host of spec.issuer is the IP address "127.0.0.1"`,
+			},
+			wantStatusUpdates: 1,
+		},
+		{
+			name:              "secret holds a valid certificate",
+			federationDomain:  newFederationDomain("https://issuer.example.com/some/path", acmeTLSSpec(""), nil),
+			secrets:           []*corev1.Secret{newTLSSecret(validCertPEM, validKeyPEM)},
+			wantStatus:        readyStatus(nil, validLeaf),
+			wantStatusUpdates: 1,
+			wantRequeueAfter:  validRenewalIn,
+		},
+		{
+			name:             "secret holds a valid certificate and the status is up to date",
+			federationDomain: newFederationDomain("https://issuer.example.com", acmeTLSSpec(""), readyStatus(&longAgoMetaTime, validLeaf)),
+			secrets:          []*corev1.Secret{newTLSSecret(validCertPEM, validKeyPEM)},
+			wantStatus:       readyStatus(&longAgoMetaTime, validLeaf),
+			wantRequeueAfter: validRenewalIn,
+		},
+		{
+			name:              "no secret yet",
+			federationDomain:  newFederationDomain("https://issuer.example.com", acmeTLSSpec(""), nil),
+			issuer:            &fakeCertificateIssuer{cert: obtainedCert},
+			wantStatus:        readyStatus(&nowMetaTime, obtainedLeaf),
+			wantStatusUpdates: 2,
+			wantRequeueAfter:  obtainedRenewalIn,
+			wantRequest: &acmecert.Request{
+				DirectoryURL:  "https://acme.example.com/directory",
+				Email:         "admin@example.com",
+				Host:          "issuer.example.com",
+				ChallengeType: acmecert.HTTP01ChallengeType,
+			},
+			wantTLSSecretData: map[string][]byte{"tls.crt": obtainedCertPEM, "tls.key": obtainedKeyPEM},
+			wantNewAccountKey: true,
+		},
+		{
+			name:              "certificate is due for renewal",
+			federationDomain:  newFederationDomain("https://issuer.example.com", acmeTLSSpec(configv1alpha1.TLSALPN01FederationDomainACMEChallengeType), readyStatus(&longAgoMetaTime, validLeaf)),
+			secrets:           []*corev1.Secret{newTLSSecret(expiringCertPEM, expiringKeyPEM), accountSecret},
+			issuer:            &fakeCertificateIssuer{cert: obtainedCert},
+			wantStatus:        readyStatus(&nowMetaTime, obtainedLeaf),
+			wantStatusUpdates: 2,
+			wantRequeueAfter:  obtainedRenewalIn,
+			wantRequest: &acmecert.Request{
+				DirectoryURL:  "https://acme.example.com/directory",
+				Email:         "admin@example.com",
+				Host:          "issuer.example.com",
+				ChallengeType: acmecert.TLSALPN01ChallengeType,
+			},
+			wantTLSSecretData: map[string][]byte{"tls.crt": obtainedCertPEM, "tls.key": obtainedKeyPEM, "ca.crt": []byte("some-ca")},
+		},
+		{
+			name:              "secret holds a certificate for another host",
+			federationDomain:  newFederationDomain("https://issuer.example.com", acmeTLSSpec(""), nil),
+			secrets:           []*corev1.Secret{newTLSSecret(otherHostCertPEM, otherHostKeyPEM), accountSecret},
+			issuer:            &fakeCertificateIssuer{cert: obtainedCert},
+			wantStatus:        readyStatus(&nowMetaTime, obtainedLeaf),
+			wantStatusUpdates: 2,
+			wantRequeueAfter:  obtainedRenewalIn,
+			wantRequest: &acmecert.Request{
+				DirectoryURL:  "https://acme.example.com/directory",
+				Email:         "admin@example.com",
+				Host:          "issuer.example.com",
+				ChallengeType: acmecert.HTTP01ChallengeType,
+			},
+			wantTLSSecretData: map[string][]byte{"tls.crt": obtainedCertPEM, "tls.key": obtainedKeyPEM, "ca.crt": []byte("some-ca")},
+		},
+		{
+			name:             "certificate authority fails",
+			federationDomain: newFederationDomain("https://issuer.example.com", acmeTLSSpec(""), nil),
+			secrets:          []*corev1.Secret{accountSecret},
+			issuer:           &fakeCertificateIssuer{err: errors.New("some ACME error")},
+			wantStatus: &configv1alpha1.FederationDomainACMEStatus{
+				Phase:           configv1alpha1.ErrorFederationDomainACMEPhase,
+				Message:         `could not obtain a certificate for "issuer.example.com": some ACME error`,
+				LastAttemptTime: &nowMetaTime,
+			},
+			wantStatusUpdates: 2,
+			wantRequeueAfter:  15 * time.Minute,
+			wantRequest: &acmecert.Request{
+				DirectoryURL:  "https://acme.example.com/directory",
+				Email:         "admin@example.com",
+				Host:          "issuer.example.com",
+				ChallengeType: acmecert.HTTP01ChallengeType,
+			},
+		},
+		{
+			name:             "secret has the wrong type",
+			federationDomain: newFederationDomain("https://issuer.example.com", acmeTLSSpec(""), nil),
+			secrets: []*corev1.Secret{accountSecret, {
+				ObjectMeta: metav1.ObjectMeta{Name: "some-tls-secret", Namespace: namespace},
+				Type:       corev1.SecretTypeOpaque,
+			}},
+			issuer: &fakeCertificateIssuer{cert: obtainedCert},
+			wantStatus: &configv1alpha1.FederationDomainACMEStatus{
+				Phase:           configv1alpha1.ErrorFederationDomainACMEPhase,
+				Message:         `could not obtain a certificate for "issuer.example.com": secret "some-tls-secret" has type "Opaque", but it must have type "kubernetes.io/tls"`,
+				LastAttemptTime: &nowMetaTime,
+			},
+			wantStatusUpdates: 2,
+			wantRequeueAfter:  15 * time.Minute,
+			wantRequest: &acmecert.Request{
+				DirectoryURL:  "https://acme.example.com/directory",
+				Email:         "admin@example.com",
+				Host:          "issuer.example.com",
+				ChallengeType: acmecert.HTTP01ChallengeType,
+			},
+		},
+		{
+			name:             "account secret has the wrong type",
+			federationDomain: newFederationDomain("https://issuer.example.com", acmeTLSSpec(""), nil),
+			secrets: []*corev1.Secret{{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-federation-domain-acme-account", Namespace: namespace},
+				Type:       corev1.SecretTypeOpaque,
+				Data:       map[string][]byte{"some-key": []byte("some-value")},
+			}},
+			issuer: &fakeCertificateIssuer{cert: obtainedCert},
+			wantStatus: &configv1alpha1.FederationDomainACMEStatus{
+				Phase:           configv1alpha1.ErrorFederationDomainACMEPhase,
+				Message:         `could not obtain a certificate for "issuer.example.com": secret "some-federation-domain-acme-account" has type "Opaque", but it must have type "secrets.pinniped.dev/federation-domain-acme-account"`,
+				LastAttemptTime: &nowMetaTime,
+			},
+			wantStatusUpdates:          2,
+			wantRequeueAfter:           15 * time.Minute,
+			wantAccountSecretUnchanged: true,
+		},
+		{
+			name: "recent failure",
+			federationDomain: newFederationDomain("https://issuer.example.com", acmeTLSSpec(""), &configv1alpha1.FederationDomainACMEStatus{
+				Phase:           configv1alpha1.ErrorFederationDomainACMEPhase,
+				Message:         "some error",
+				LastAttemptTime: &recentMetaTime,
+			}),
+			wantStatus: &configv1alpha1.FederationDomainACMEStatus{
+				Phase:           configv1alpha1.ErrorFederationDomainACMEPhase,
+				Message:         "some error",
+				LastAttemptTime: &recentMetaTime,
+			},
+			wantRequeueAfter: 10 * time.Minute,
+		},
+		{
+			name:             "status cannot be written, e.g. because this pod is not the leader",
+			federationDomain: newFederationDomain("https://issuer.example.com", acmeTLSSpec(""), nil),
+			issuer:           &fakeCertificateIssuer{cert: obtainedCert},
+			configPinnipedClient: func(client *pinnipedfake.Clientset) {
+				client.PrependReactor("update", "federationdomains", func(_ kubetesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("some update error")
+				})
+			},
+			wantErr: "could not sync ACME certificate of FederationDomain some-namespace/some-federation-domain: " +
+				"cannot update FederationDomain status: some update error",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			kubeAPIClient := kubernetesfake.NewSimpleClientset()
+			kubeInformerClient := kubernetesfake.NewSimpleClientset()
+			for _, secret := range test.secrets {
+				require.NoError(t, kubeAPIClient.Tracker().Add(secret))
+				require.NoError(t, kubeInformerClient.Tracker().Add(secret))
+			}
+			pinnipedAPIClient := pinnipedfake.NewSimpleClientset(test.federationDomain)
+			pinnipedInformerClient := pinnipedfake.NewSimpleClientset(test.federationDomain)
+			if test.configPinnipedClient != nil {
+				test.configPinnipedClient(pinnipedAPIClient)
+			}
+			kubeInformers := kubeinformers.NewSharedInformerFactory(kubeInformerClient, 0)
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(pinnipedInformerClient, 0)
+
+			issuer := test.issuer
+			if issuer == nil {
+				issuer = &fakeCertificateIssuer{err: errors.New("should not be called")}
+			}
+			c := NewACMECertWriterController(
+				map[string]string{"myLabelKey1": "myLabelValue1"},
+				issuer,
+				clocktesting.NewFakeClock(now),
+				kubeAPIClient,
+				pinnipedAPIClient,
+				kubeInformers.Core().V1().Secrets(),
+				pinnipedInformers.Config().V1alpha1().FederationDomains(),
+				controllerlib.WithInformer,
+				controllerlib.WithInitialEvent,
+			)
+
+			// Must start informers before calling TestRunSynchronously().
+			kubeInformers.Start(ctx.Done())
+			pinnipedInformers.Start(ctx.Done())
+			controllerlib.TestRunSynchronously(t, c)
+
+			queue := &acmeTestQueue{}
+			err := controllerlib.TestSync(t, c, controllerlib.Context{Context: ctx, Queue: queue})
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Empty(t, issuer.requests)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantRequeueAfter, queue.duration)
+
+			statusUpdates := 0
+			for _, action := range pinnipedAPIClient.Actions() {
+				if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+					statusUpdates++
+				}
+			}
+			require.Equal(t, test.wantStatusUpdates, statusUpdates)
+			federationDomain, err := pinnipedAPIClient.ConfigV1alpha1().FederationDomains(namespace).Get(ctx, test.federationDomain.Name, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, test.wantStatus, federationDomain.Status.ACME)
+
+			if test.wantRequest == nil {
+				require.Empty(t, issuer.requests)
+			} else {
+				require.Len(t, issuer.requests, 1)
+				got := *issuer.requests[0]
+				require.NotNil(t, got.HTTPClient)
+				gotAccountKey := got.AccountKey
+				got.HTTPClient, got.AccountKey = nil, nil
+				require.Equal(t, test.wantRequest, &got)
+
+				storedAccountSecret, err := kubeAPIClient.CoreV1().Secrets(namespace).Get(ctx, "some-federation-domain-acme-account", metav1.GetOptions{})
+				require.NoError(t, err)
+				storedAccountKey, err := acmecert.ParseAccountKey(storedAccountSecret.Data["accountKey"])
+				require.NoError(t, err)
+				require.Equal(t, gotAccountKey.Public(), storedAccountKey.Public())
+				if test.wantNewAccountKey {
+					require.Equal(t, map[string]string{"myLabelKey1": "myLabelValue1"}, storedAccountSecret.Labels)
+					require.Len(t, storedAccountSecret.OwnerReferences, 1)
+					require.Equal(t, "some-uid", string(storedAccountSecret.OwnerReferences[0].UID))
+				} else {
+					require.Equal(t, accountKey.Public(), storedAccountKey.Public())
+				}
+			}
+
+			if test.wantAccountSecretUnchanged {
+				storedAccountSecret, err := kubeAPIClient.CoreV1().Secrets(namespace).Get(ctx, "some-federation-domain-acme-account", metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, test.secrets[0].Type, storedAccountSecret.Type)
+				require.Equal(t, test.secrets[0].Data, storedAccountSecret.Data)
+			}
+
+			if test.wantTLSSecretData != nil {
+				tlsSecret, err := kubeAPIClient.CoreV1().Secrets(namespace).Get(ctx, "some-tls-secret", metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, corev1.SecretTypeTLS, tlsSecret.Type)
+				require.Equal(t, test.wantTLSSecretData, tlsSecret.Data)
+				require.Empty(t, tlsSecret.OwnerReferences)
+			}
+		})
+	}
+}
+
+func TestACMEHost(t *testing.T) {
+	host, err := acmeHost("https://Issuer.Example.com:8443/some/path")
+	require.NoError(t, err)
+	require.Equal(t, "issuer.example.com", host)
+
+	_, err = acmeHost("https://[::1]/issuer")
+	require.EqualError(t, err, `ACME certificates can only be requested for DNS names, but the host of spec.issuer is the IP address "::1"`)
+
+	_, err = acmeHost("not a url")
+	require.EqualError(t, err, `spec.issuer "not a url" is not a valid URL`)
+}
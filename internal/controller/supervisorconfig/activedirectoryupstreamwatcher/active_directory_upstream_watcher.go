@@ -28,6 +28,7 @@ import (
 	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamwatchers"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/internal/upstreamldap"
 )
 
@@ -211,6 +212,13 @@ func (g *activeDirectoryUpstreamGenericLDAPGroupSearch) GroupNameAttribute() str
 	return g.groupSearch.Attributes.GroupName
 }
 
+func (g *activeDirectoryUpstreamGenericLDAPGroupSearch) NestedGroupSearch() upstreamldap.NestedGroupSearchMode {
+	if g.groupSearch.NestedGroups {
+		return upstreamldap.NestedGroupSearchMatchingRuleInChain
+	}
+	return upstreamldap.NestedGroupSearchDisabled
+}
+
 type activeDirectoryUpstreamGenericLDAPStatus struct {
 	activeDirectoryIdentityProvider v1alpha1.ActiveDirectoryIdentityProvider
 }
@@ -228,6 +236,7 @@ type activeDirectoryWatcherController struct {
 	cache                                   UpstreamActiveDirectoryIdentityProviderICache
 	validatedSettingsCache                  upstreamwatchers.ValidatedSettingsCacheI
 	ldapDialer                              upstreamldap.LDAPDialer
+	connectionPool                          *upstreamldap.ConnectionPool
 	client                                  pinnipedclientset.Interface
 	activeDirectoryIdentityProviderInformer idpinformers.ActiveDirectoryIdentityProviderInformer
 	secretInformer                          corev1informers.SecretInformer
@@ -247,6 +256,8 @@ func New(
 		upstreamwatchers.NewValidatedSettingsCache(),
 		// nil means to use a real production dialer when creating objects to add to the cache
 		nil,
+		// start with an empty pool, which is shared by all the providers created by this controller
+		upstreamldap.NewConnectionPool(),
 		client,
 		activeDirectoryIdentityProviderInformer,
 		secretInformer,
@@ -259,6 +270,7 @@ func newInternal(
 	idpCache UpstreamActiveDirectoryIdentityProviderICache,
 	validatedSettingsCache upstreamwatchers.ValidatedSettingsCacheI,
 	ldapDialer upstreamldap.LDAPDialer,
+	connectionPool *upstreamldap.ConnectionPool,
 	client pinnipedclientset.Interface,
 	activeDirectoryIdentityProviderInformer idpinformers.ActiveDirectoryIdentityProviderInformer,
 	secretInformer corev1informers.SecretInformer,
@@ -268,6 +280,7 @@ func newInternal(
 		cache:                                   idpCache,
 		validatedSettingsCache:                  validatedSettingsCache,
 		ldapDialer:                              ldapDialer,
+		connectionPool:                          connectionPool,
 		client:                                  client,
 		activeDirectoryIdentityProviderInformer: activeDirectoryIdentityProviderInformer,
 		secretInformer:                          secretInformer,
@@ -281,7 +294,7 @@ func newInternal(
 		),
 		withInformer(
 			secretInformer,
-			pinnipedcontroller.MatchAnySecretOfTypeFilter(upstreamwatchers.LDAPBindAccountSecretType, pinnipedcontroller.SingletonQueue()),
+			pinnipedcontroller.MatchAnySecretOfTypesFilter(upstreamwatchers.LDAPBindAccountSecretTypes, pinnipedcontroller.SingletonQueue()),
 			controllerlib.InformerOption{},
 		),
 	)
@@ -320,9 +333,10 @@ func (c *activeDirectoryWatcherController) validateUpstream(ctx context.Context,
 	adUpstreamImpl := &activeDirectoryUpstreamGenericLDAPImpl{activeDirectoryIdentityProvider: *upstream}
 
 	config := &upstreamldap.ProviderConfig{
-		Name:        upstream.Name,
-		ResourceUID: upstream.UID,
-		Host:        spec.Host,
+		Name:          upstream.Name,
+		ResourceUID:   upstream.UID,
+		Host:          spec.Host,
+		FailoverHosts: spec.FailoverHosts,
 		UserSearch: upstreamldap.UserSearchConfig{
 			Base:              spec.UserSearch.Base,
 			Filter:            adUpstreamImpl.Spec().UserSearch().Filter(),
@@ -333,8 +347,11 @@ func (c *activeDirectoryWatcherController) validateUpstream(ctx context.Context,
 			Base:               spec.GroupSearch.Base,
 			Filter:             adUpstreamImpl.Spec().GroupSearch().Filter(),
 			GroupNameAttribute: adUpstreamImpl.Spec().GroupSearch().GroupNameAttribute(),
+			NestedGroupSearch:  adUpstreamImpl.Spec().GroupSearch().NestedGroupSearch(),
 		},
-		Dialer: c.ldapDialer,
+		Dialer:         c.ldapDialer,
+		ConnectionPool: c.connectionPool,
+		TOTPMode:       totp.Mode(spec.TOTP.Mode),
 		UIDAttributeParsingOverrides: map[string]func(*ldap.Entry) (string, error){
 			"objectGUID": microsoftUUIDFromBinaryAttr("objectGUID"),
 		},
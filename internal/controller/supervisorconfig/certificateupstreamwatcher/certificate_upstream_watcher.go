@@ -0,0 +1,324 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package certificateupstreamwatcher implements a controller which watches CertificateIdentityProviders.
+package certificateupstreamwatcher
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
+	idpinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/idp/v1alpha1"
+	"go.pinniped.dev/internal/constable"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controller/conditionsutil"
+	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamwatchers"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/upstreamcertificate"
+)
+
+const (
+	// Setup for the name of our controller in logs.
+	certificateControllerName = "certificate-upstream-observer"
+
+	// Constants related to conditions.
+	typeCertificateAuthorityValid = "CertificateAuthorityValid"
+	typeRevocationListsValid      = "RevocationListsValid"
+
+	reasonInvalidCertificateAuthority = "InvalidCertificateAuthority"
+	reasonUnableToLoadRevocationLists = "UnableToLoadRevocationLists"
+
+	// Errors that are generated by our reconcile process.
+	errCertificateFailureStatus = constable.Error("CertificateIdentityProvider has a failing condition")
+)
+
+// UpstreamCertificateIdentityProviderICache is a thread safe cache that holds a list of validated upstream client
+// certificate IDP configurations.
+type UpstreamCertificateIdentityProviderICache interface {
+	SetCertificateIdentityProviders([]provider.UpstreamCertificateIdentityProviderI)
+}
+
+type certificateWatcherController struct {
+	cache                               UpstreamCertificateIdentityProviderICache
+	log                                 logr.Logger
+	client                              pinnipedclientset.Interface
+	certificateIdentityProviderInformer idpinformers.CertificateIdentityProviderInformer
+	secretInformer                      corev1informers.SecretInformer
+	configMapInformer                   corev1informers.ConfigMapInformer
+}
+
+// New instantiates a new controllerlib.Controller which will populate the provided
+// UpstreamCertificateIdentityProviderICache. The CRLs of each CertificateIdentityProvider are loaded again
+// whenever one of its ConfigMaps or Secrets changes.
+func New(
+	idpCache UpstreamCertificateIdentityProviderICache,
+	client pinnipedclientset.Interface,
+	certificateIdentityProviderInformer idpinformers.CertificateIdentityProviderInformer,
+	secretInformer corev1informers.SecretInformer,
+	configMapInformer corev1informers.ConfigMapInformer,
+	log logr.Logger,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+) controllerlib.Controller {
+	c := certificateWatcherController{
+		cache:                               idpCache,
+		log:                                 log.WithName(certificateControllerName),
+		client:                              client,
+		certificateIdentityProviderInformer: certificateIdentityProviderInformer,
+		secretInformer:                      secretInformer,
+		configMapInformer:                   configMapInformer,
+	}
+	return controllerlib.New(
+		controllerlib.Config{Name: certificateControllerName, Syncer: &c},
+		withInformer(
+			certificateIdentityProviderInformer,
+			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			secretInformer,
+			pinnipedcontroller.SimpleFilterWithSingletonQueue(c.isRevocationListSource(v1alpha1.CertificateRevocationListSourceKindSecret)),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			configMapInformer,
+			pinnipedcontroller.SimpleFilterWithSingletonQueue(c.isRevocationListSource(v1alpha1.CertificateRevocationListSourceKindConfigMap)),
+			controllerlib.InformerOption{},
+		),
+	)
+}
+
+// isRevocationListSource returns a filter which matches the objects of the given kind which are CRL sources of any
+// CertificateIdentityProvider, so that other Secrets and ConfigMaps do not cause syncs.
+func (c *certificateWatcherController) isRevocationListSource(kind v1alpha1.CertificateRevocationListSourceKind) func(obj metav1.Object) bool {
+	return func(obj metav1.Object) bool {
+		upstreams, err := c.certificateIdentityProviderInformer.Lister().CertificateIdentityProviders(obj.GetNamespace()).List(labels.Everything())
+		if err != nil {
+			return false
+		}
+		for _, upstream := range upstreams {
+			for _, source := range upstream.Spec.Revocation.CRLSources {
+				if source.Kind == kind && source.Name == obj.GetName() {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// Sync implements controllerlib.Syncer.
+func (c *certificateWatcherController) Sync(ctx controllerlib.Context) error {
+	actualUpstreams, err := c.certificateIdentityProviderInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list CertificateIdentityProviders: %w", err)
+	}
+
+	requeue := false
+	validatedUpstreams := make([]provider.UpstreamCertificateIdentityProviderI, 0, len(actualUpstreams))
+	for _, upstream := range actualUpstreams {
+		valid := c.validateUpstream(ctx.Context, upstream)
+		if valid == nil {
+			requeue = true
+		} else {
+			validatedUpstreams = append(validatedUpstreams, provider.UpstreamCertificateIdentityProviderI(valid))
+		}
+	}
+	c.cache.SetCertificateIdentityProviders(validatedUpstreams)
+	if requeue {
+		return controllerlib.ErrSyntheticRequeue
+	}
+	return nil
+}
+
+// validateUpstream validates the provided v1alpha1.CertificateIdentityProvider and returns the validated configuration
+// as a provider.UpstreamCertificateIdentityProviderI. As a side effect, it also updates the status of the
+// v1alpha1.CertificateIdentityProvider.
+func (c *certificateWatcherController) validateUpstream(ctx context.Context, upstream *v1alpha1.CertificateIdentityProvider) *upstreamcertificate.ProviderConfig {
+	result := upstreamcertificate.ProviderConfig{
+		Name:          upstream.Name,
+		ResourceUID:   upstream.UID,
+		UsernameField: upstream.Spec.Claims.Username,
+		GroupsField:   upstream.Spec.Claims.Groups,
+		Clock:         time.Now,
+	}
+
+	conditions := []*v1alpha1.Condition{
+		validateCertificateAuthority(upstream, &result),
+		c.validateRevocationLists(upstream, &result),
+	}
+
+	c.updateStatus(ctx, upstream, conditions)
+
+	valid := true
+	log := c.log.WithValues("namespace", upstream.Namespace, "name", upstream.Name)
+	for _, condition := range conditions {
+		if condition.Status == v1alpha1.ConditionFalse {
+			valid = false
+			log.WithValues(
+				"type", condition.Type,
+				"reason", condition.Reason,
+				"message", condition.Message,
+			).Error(errCertificateFailureStatus, "found failing condition")
+		}
+	}
+	if valid {
+		return &result
+	}
+	return nil
+}
+
+// validateCertificateAuthority validates the .spec.certificateAuthorityData field and returns the appropriate
+// CertificateAuthorityValid condition.
+func validateCertificateAuthority(upstream *v1alpha1.CertificateIdentityProvider, result *upstreamcertificate.ProviderConfig) *v1alpha1.Condition {
+	invalid := func(err error) *v1alpha1.Condition {
+		return &v1alpha1.Condition{
+			Type:    typeCertificateAuthorityValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonInvalidCertificateAuthority,
+			Message: fmt.Sprintf("spec.certificateAuthorityData is not valid: %s", err.Error()),
+		}
+	}
+
+	bundle, err := base64.StdEncoding.DecodeString(upstream.Spec.CertificateAuthorityData)
+	if err != nil {
+		return invalid(err)
+	}
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return invalid(err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return invalid(upstreamwatchers.ErrNoCertificates)
+	}
+
+	result.CertificateAuthorities = certificates
+	return &v1alpha1.Condition{
+		Type:    typeCertificateAuthorityValid,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  upstreamwatchers.ReasonSuccess,
+		Message: fmt.Sprintf("loaded %d certificate authorities", len(certificates)),
+	}
+}
+
+// validateRevocationLists loads the CRLs from the ConfigMaps and Secrets listed in the .spec.revocation.crlSources
+// field and returns the appropriate RevocationListsValid condition.
+func (c *certificateWatcherController) validateRevocationLists(upstream *v1alpha1.CertificateIdentityProvider, result *upstreamcertificate.ProviderConfig) *v1alpha1.Condition {
+	var revocationLists []*pkix.CertificateList
+	for _, source := range upstream.Spec.Revocation.CRLSources {
+		crls, err := c.loadRevocationLists(upstream.Namespace, source)
+		if err != nil {
+			return &v1alpha1.Condition{
+				Type:    typeRevocationListsValid,
+				Status:  v1alpha1.ConditionFalse,
+				Reason:  reasonUnableToLoadRevocationLists,
+				Message: fmt.Sprintf("failed to load certificate revocation lists from %s %q: %s", source.Kind, source.Name, err.Error()),
+			}
+		}
+		revocationLists = append(revocationLists, crls...)
+	}
+
+	result.RevocationLists = revocationLists
+	return &v1alpha1.Condition{
+		Type:    typeRevocationListsValid,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  upstreamwatchers.ReasonSuccess,
+		Message: fmt.Sprintf("loaded %d certificate revocation lists", len(revocationLists)),
+	}
+}
+
+// loadRevocationLists parses the CRLs in every value of the ConfigMap or Secret, in the order of their keys.
+func (c *certificateWatcherController) loadRevocationLists(namespace string, source v1alpha1.CertificateRevocationListSource) ([]*pkix.CertificateList, error) {
+	data := map[string][]byte{}
+	switch source.Kind {
+	case v1alpha1.CertificateRevocationListSourceKindConfigMap:
+		configMap, err := c.configMapInformer.Lister().ConfigMaps(namespace).Get(source.Name)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range configMap.Data {
+			data[key] = []byte(value)
+		}
+		for key, value := range configMap.BinaryData {
+			data[key] = value
+		}
+	case v1alpha1.CertificateRevocationListSourceKindSecret:
+		secret, err := c.secretInformer.Lister().Secrets(namespace).Get(source.Name)
+		if err != nil {
+			return nil, err
+		}
+		data = secret.Data
+	default:
+		return nil, fmt.Errorf("unsupported kind %q", source.Kind)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("no data found")
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var revocationLists []*pkix.CertificateList
+	for _, key := range keys {
+		crls, err := upstreamcertificate.ParseRevocationLists(data[key])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		revocationLists = append(revocationLists, crls...)
+	}
+	return revocationLists, nil
+}
+
+func (c *certificateWatcherController) updateStatus(ctx context.Context, upstream *v1alpha1.CertificateIdentityProvider, conditions []*v1alpha1.Condition) {
+	log := c.log.WithValues("namespace", upstream.Namespace, "name", upstream.Name)
+	updated := upstream.DeepCopy()
+
+	hadErrorCondition := conditionsutil.Merge(conditions, upstream.Generation, &updated.Status.Conditions, log)
+
+	updated.Status.Phase = v1alpha1.CertificatePhaseReady
+	if hadErrorCondition {
+		updated.Status.Phase = v1alpha1.CertificatePhaseError
+	}
+
+	if equality.Semantic.DeepEqual(upstream, updated) {
+		return
+	}
+
+	_, err := c.client.
+		IDPV1alpha1().
+		CertificateIdentityProviders(upstream.Namespace).
+		UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		log.Error(err, "failed to update status")
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package certificateupstreamwatcher
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/testlogger"
+	"go.pinniped.dev/internal/upstreamcertificate"
+)
+
+func TestCertificateUpstreamWatcherControllerSync(t *testing.T) {
+	t.Parallel()
+	now := metav1.NewTime(time.Now().UTC())
+
+	// Build a CA which may sign CRLs, which the certauthority package does not support.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "some-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	twoCABundleBase64 := base64.StdEncoding.EncodeToString(append(append([]byte{}, caBundle...), caBundle...))
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, caCert, caKey)
+	require.NoError(t, err)
+
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+
+	const (
+		testNamespace = "test-namespace"
+		testName      = "test-name"
+	)
+
+	crlConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "crl-configmap"},
+		BinaryData: map[string][]byte{"crl.der": crlDER},
+	}
+	crlSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "crl-secret"},
+		Data:       map[string][]byte{"crls.pem": append(append([]byte{}, crlPEM...), crlPEM...)},
+	}
+	emptyConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "empty-configmap"},
+	}
+	invalidCRLSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "invalid-secret"},
+		Data:       map[string][]byte{"crl.der": crlDER, "invalid.pem": []byte("not a crl")},
+	}
+	kubeObjects := []runtime.Object{crlConfigMap, crlSecret, emptyConfigMap, invalidCRLSecret}
+	crlSource := func(kind v1alpha1.CertificateRevocationListSourceKind, name string) v1alpha1.CertificateRevocationListSource {
+		return v1alpha1.CertificateRevocationListSource{Kind: kind, Name: name}
+	}
+
+	validUpstream := &v1alpha1.CertificateIdentityProvider{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, UID: "test-uid", Generation: 1234},
+		Spec: v1alpha1.CertificateIdentityProviderSpec{
+			CertificateAuthorityData: base64.StdEncoding.EncodeToString(caBundle),
+			Claims: v1alpha1.CertificateClaims{
+				Username: v1alpha1.CertificateFieldEmailAddress,
+				Groups:   v1alpha1.CertificateFieldOrganizationalUnit,
+			},
+		},
+	}
+
+	condition := func(typ string, status v1alpha1.ConditionStatus, reason, message string) v1alpha1.Condition {
+		return v1alpha1.Condition{
+			Type:               typ,
+			Status:             status,
+			ObservedGeneration: 1234,
+			LastTransitionTime: now,
+			Reason:             reason,
+			Message:            message,
+		}
+	}
+	happyCA := condition("CertificateAuthorityValid", "True", "Success", "loaded 1 certificate authorities")
+	happyNoCRLs := condition("RevocationListsValid", "True", "Success", "loaded 0 certificate revocation lists")
+
+	tests := []struct {
+		name                 string
+		inputUpstream        *v1alpha1.CertificateIdentityProvider
+		wantErr              string
+		wantResultingCache   bool
+		wantCAs              int
+		wantCRLs             int
+		wantPhase            v1alpha1.CertificateIdentityProviderPhase
+		wantStatusConditions []v1alpha1.Condition
+	}{
+		{
+			name:                 "valid upstream without CRLs",
+			inputUpstream:        validUpstream,
+			wantResultingCache:   true,
+			wantCAs:              1,
+			wantPhase:            "Ready",
+			wantStatusConditions: []v1alpha1.Condition{happyCA, happyNoCRLs},
+		},
+		{
+			name: "valid upstream with CRLs",
+			inputUpstream: func() *v1alpha1.CertificateIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.CertificateAuthorityData = twoCABundleBase64
+				u.Spec.Revocation.CRLSources = []v1alpha1.CertificateRevocationListSource{
+					crlSource("ConfigMap", crlConfigMap.Name),
+					crlSource("Secret", crlSecret.Name),
+				}
+				return u
+			}(),
+			wantResultingCache: true,
+			wantCAs:            2,
+			wantCRLs:           3,
+			wantPhase:          "Ready",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("CertificateAuthorityValid", "True", "Success", "loaded 2 certificate authorities"),
+				condition("RevocationListsValid", "True", "Success", "loaded 3 certificate revocation lists"),
+			},
+		},
+		{
+			name: "CA data is not base64",
+			inputUpstream: func() *v1alpha1.CertificateIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.CertificateAuthorityData = "%"
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("CertificateAuthorityValid", "False", "InvalidCertificateAuthority", "spec.certificateAuthorityData is not valid: illegal base64 data at input byte 0"),
+				happyNoCRLs,
+			},
+		},
+		{
+			name: "CA data has no certificates",
+			inputUpstream: func() *v1alpha1.CertificateIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.CertificateAuthorityData = base64.StdEncoding.EncodeToString([]byte("not a cert"))
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("CertificateAuthorityValid", "False", "InvalidCertificateAuthority", "spec.certificateAuthorityData is not valid: no certificates found"),
+				happyNoCRLs,
+			},
+		},
+		{
+			name: "CRL ConfigMap is missing",
+			inputUpstream: func() *v1alpha1.CertificateIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Revocation.CRLSources = []v1alpha1.CertificateRevocationListSource{
+					crlSource("ConfigMap", crlConfigMap.Name),
+					crlSource("ConfigMap", "missing"),
+				}
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				happyCA,
+				condition("RevocationListsValid", "False", "UnableToLoadRevocationLists", `failed to load certificate revocation lists from ConfigMap "missing": configmap "missing" not found`),
+			},
+		},
+		{
+			name: "CRL Secret is missing",
+			inputUpstream: func() *v1alpha1.CertificateIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Revocation.CRLSources = []v1alpha1.CertificateRevocationListSource{crlSource("Secret", "missing")}
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				happyCA,
+				condition("RevocationListsValid", "False", "UnableToLoadRevocationLists", `failed to load certificate revocation lists from Secret "missing": secret "missing" not found`),
+			},
+		},
+		{
+			name: "CRL ConfigMap has no data",
+			inputUpstream: func() *v1alpha1.CertificateIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Revocation.CRLSources = []v1alpha1.CertificateRevocationListSource{crlSource("ConfigMap", emptyConfigMap.Name)}
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				happyCA,
+				condition("RevocationListsValid", "False", "UnableToLoadRevocationLists", `failed to load certificate revocation lists from ConfigMap "empty-configmap": no data found`),
+			},
+		},
+		{
+			name: "CRL Secret has an invalid value",
+			inputUpstream: func() *v1alpha1.CertificateIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Revocation.CRLSources = []v1alpha1.CertificateRevocationListSource{crlSource("Secret", invalidCRLSecret.Name)}
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				happyCA,
+				condition("RevocationListsValid", "False", "UnableToLoadRevocationLists", `failed to load certificate revocation lists from Secret "invalid-secret": key "invalid.pem": no PEM encoded CRLs were found, and could not parse as a DER encoded CRL: asn1: structure error: tags don't match (16 vs {class:1 tag:14 length:111 isCompound:true}) {optional:false explicit:false application:false private:false defaultValue:<nil> tag:<nil> stringType:0 timeType:0 set:false omitEmpty:false} CertificateList @2`),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinnipedClient := pinnipedfake.NewSimpleClientset(tt.inputUpstream)
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(fakePinnipedClient, 0)
+			fakeKubeClient := fake.NewSimpleClientset(kubeObjects...)
+			kubeInformers := informers.NewSharedInformerFactory(fakeKubeClient, 0)
+			testLog := testlogger.New(t)
+			cache := provider.NewDynamicUpstreamIDPProvider()
+			cache.SetCertificateIdentityProviders([]provider.UpstreamCertificateIdentityProviderI{
+				&upstreamcertificate.ProviderConfig{Name: "initial-entry"},
+			})
+
+			controller := New(
+				cache,
+				fakePinnipedClient,
+				pinnipedInformers.IDP().V1alpha1().CertificateIdentityProviders(),
+				kubeInformers.Core().V1().Secrets(),
+				kubeInformers.Core().V1().ConfigMaps(),
+				testLog.Logger,
+				controllerlib.WithInformer,
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			pinnipedInformers.Start(ctx.Done())
+			kubeInformers.Start(ctx.Done())
+			controllerlib.TestRunSynchronously(t, controller)
+
+			syncCtx := controllerlib.Context{Context: ctx, Key: controllerlib.Key{}}
+
+			if err := controllerlib.TestSync(t, controller, syncCtx); tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			actualIDPList := cache.GetCertificateIdentityProviders()
+			if tt.wantResultingCache {
+				require.Len(t, actualIDPList, 1)
+				actualIDP := actualIDPList[0].(*upstreamcertificate.ProviderConfig)
+				require.Equal(t, testName, actualIDP.GetName())
+				require.Equal(t, "test-uid", string(actualIDP.GetResourceUID()))
+				require.Equal(t, v1alpha1.CertificateFieldEmailAddress, actualIDP.UsernameField)
+				require.Equal(t, v1alpha1.CertificateFieldOrganizationalUnit, actualIDP.GroupsField)
+				require.Len(t, actualIDP.GetCertificateAuthorities(), tt.wantCAs)
+				require.Equal(t, caCert.Raw, actualIDP.GetCertificateAuthorities()[0].Raw)
+				require.Len(t, actualIDP.RevocationLists, tt.wantCRLs)
+				require.NotNil(t, actualIDP.Clock)
+			} else {
+				require.Empty(t, actualIDPList)
+			}
+
+			actualUpstream, err := fakePinnipedClient.IDPV1alpha1().CertificateIdentityProviders(testNamespace).Get(ctx, testName, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantPhase, actualUpstream.Status.Phase)
+			for i := range actualUpstream.Status.Conditions {
+				if time.Since(actualUpstream.Status.Conditions[i].LastTransitionTime.Time) < 5*time.Second {
+					actualUpstream.Status.Conditions[i].LastTransitionTime = now
+				}
+			}
+			require.Equal(t, tt.wantStatusConditions, actualUpstream.Status.Conditions)
+		})
+	}
+}
+
+func TestCertificateUpstreamWatcherControllerFilterRevocationListSources(t *testing.T) {
+	t.Parallel()
+
+	upstream := &v1alpha1.CertificateIdentityProvider{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "some-namespace", Name: "some-name"},
+		Spec: v1alpha1.CertificateIdentityProviderSpec{
+			Revocation: v1alpha1.CertificateRevocationSpec{
+				CRLSources: []v1alpha1.CertificateRevocationListSource{
+					{Kind: "Secret", Name: "crl-secret"},
+					{Kind: "ConfigMap", Name: "crl-configmap"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		secret    metav1.Object
+		configMap metav1.Object
+		want      bool
+	}{
+		{
+			name:      "CRL sources of a CertificateIdentityProvider",
+			secret:    &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "some-namespace", Name: "crl-secret"}},
+			configMap: &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "some-namespace", Name: "crl-configmap"}},
+			want:      true,
+		},
+		{
+			name:      "objects of the other kind with the same name",
+			secret:    &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "some-namespace", Name: "crl-configmap"}},
+			configMap: &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "some-namespace", Name: "crl-secret"}},
+		},
+		{
+			name:      "objects in another namespace",
+			secret:    &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "other-namespace", Name: "crl-secret"}},
+			configMap: &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "other-namespace", Name: "crl-configmap"}},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(pinnipedfake.NewSimpleClientset(), 0)
+			certificateIDPInformer := pinnipedInformers.IDP().V1alpha1().CertificateIdentityProviders()
+			require.NoError(t, certificateIDPInformer.Informer().GetIndexer().Add(upstream))
+			kubeInformers := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+			secretInformer := kubeInformers.Core().V1().Secrets()
+			configMapInformer := kubeInformers.Core().V1().ConfigMaps()
+			withInformer := testutil.NewObservableWithInformerOption()
+
+			New(nil, nil, certificateIDPInformer, secretInformer, configMapInformer, testlogger.New(t).Logger, withInformer.WithInformer)
+
+			for informer, obj := range map[controllerlib.InformerGetter]metav1.Object{secretInformer: test.secret, configMapInformer: test.configMap} {
+				filter := withInformer.GetFilterForInformer(informer)
+				require.Equal(t, test.want, filter.Add(obj))
+				require.Equal(t, test.want, filter.Update(obj, obj))
+				require.Equal(t, test.want, filter.Delete(obj))
+			}
+		})
+	}
+}
@@ -5,13 +5,19 @@ package supervisorconfig
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/errors"
+	corev1informers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/clock"
@@ -20,8 +26,12 @@ import (
 	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
 	configinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/config/v1alpha1"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamwatchers"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/net/phttp"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/provider/branding"
+	"go.pinniped.dev/internal/oidc/trustedissuer"
 	"go.pinniped.dev/internal/plog"
 )
 
@@ -37,6 +47,7 @@ type federationDomainWatcherController struct {
 	clock                    clock.Clock
 	client                   pinnipedclientset.Interface
 	federationDomainInformer configinformers.FederationDomainInformer
+	configMapInformer        corev1informers.ConfigMapInformer
 }
 
 // NewFederationDomainWatcherController creates a controllerlib.Controller that watches
@@ -46,6 +57,7 @@ func NewFederationDomainWatcherController(
 	clock clock.Clock,
 	client pinnipedclientset.Interface,
 	federationDomainInformer configinformers.FederationDomainInformer,
+	configMapInformer corev1informers.ConfigMapInformer,
 	withInformer pinnipedcontroller.WithInformerOptionFunc,
 ) controllerlib.Controller {
 	return controllerlib.New(
@@ -56,6 +68,7 @@ func NewFederationDomainWatcherController(
 				clock:                    clock,
 				client:                   client,
 				federationDomainInformer: federationDomainInformer,
+				configMapInformer:        configMapInformer,
 			},
 		},
 		withInformer(
@@ -63,6 +76,12 @@ func NewFederationDomainWatcherController(
 			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
 			controllerlib.InformerOption{},
 		),
+		// Watch all ConfigMaps, since any of them could be the branding of a FederationDomain.
+		withInformer(
+			configMapInformer,
+			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
 	)
 }
 
@@ -143,7 +162,34 @@ func (c *federationDomainWatcherController) Sync(ctx controllerlib.Context) erro
 			continue
 		}
 
-		federationDomainIssuer, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer) // This validates the Issuer URL.
+		policy, err := tokenExchangePolicy(federationDomain.Spec.TokenExchange)
+		if err != nil {
+			if err := c.updateStatus(
+				ctx.Context,
+				federationDomain.Namespace,
+				federationDomain.Name,
+				configv1alpha1.InvalidFederationDomainStatusCondition,
+				"Invalid: "+err.Error(),
+			); err != nil {
+				errs = append(errs, fmt.Errorf("could not update status: %w", err))
+			}
+			continue
+		}
+
+		// Invalid branding should not take down the logins of a FederationDomain, so use the default pages instead.
+		successMessage := "Provider successfully created"
+		pages, err := c.brandedPages(federationDomain)
+		if err != nil {
+			plog.WarningErr("using the default pages because the branding is invalid", err,
+				"federationdomain", klog.KObj(federationDomain))
+			successMessage += ", but using the default pages because the branding is invalid: " + err.Error()
+		}
+
+		federationDomainIssuer, err := provider.NewFederationDomainIssuer( // This validates the Issuer URL.
+			federationDomain.Spec.Issuer,
+			policy,
+			pages,
+		)
 		if err != nil {
 			if err := c.updateStatus(
 				ctx.Context,
@@ -162,7 +208,7 @@ func (c *federationDomainWatcherController) Sync(ctx controllerlib.Context) erro
 			federationDomain.Namespace,
 			federationDomain.Name,
 			configv1alpha1.SuccessFederationDomainStatusCondition,
-			"Provider successfully created",
+			successMessage,
 		); err != nil {
 			errs = append(errs, fmt.Errorf("could not update status: %w", err))
 			continue
@@ -210,3 +256,100 @@ func (c *federationDomainWatcherController) updateStatus(
 }
 
 func timePtr(t metav1.Time) *metav1.Time { return &t }
+
+// brandedPages returns the pages of a FederationDomain with the branding of its ConfigMap, or nil when it does not
+// have branding.
+func (c *federationDomainWatcherController) brandedPages(federationDomain *configv1alpha1.FederationDomain) (*provider.Pages, error) {
+	if federationDomain.Spec.Branding == nil {
+		return nil, nil
+	}
+	configMapName := federationDomain.Spec.Branding.ConfigMapName
+	configMap, err := c.configMapInformer.Lister().ConfigMaps(federationDomain.Namespace).Get(configMapName)
+	if k8serrors.IsNotFound(err) {
+		return nil, fmt.Errorf("configmap %q not found", configMapName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configmap %q: %w", configMapName, err)
+	}
+	b, err := branding.FromConfigMap(configMap)
+	if err != nil {
+		return nil, fmt.Errorf("configmap %q: %w", configMapName, err)
+	}
+	pages, err := provider.NewPages(b)
+	if err != nil {
+		return nil, fmt.Errorf("configmap %q: %w", configMapName, err)
+	}
+	return pages, nil
+}
+
+// tokenExchangePolicy returns the token exchange policy of a FederationDomain, or nil when it does not restrict
+// token exchange and does not trust any other issuers.
+func tokenExchangePolicy(spec *configv1alpha1.FederationDomainTokenExchangeSpec) (*provider.TokenExchangePolicy, error) {
+	if spec == nil || (len(spec.AllowedAudiences) == 0 && len(spec.TrustedServiceAccountIssuers) == 0 && len(spec.TrustedOIDCIssuers) == 0) {
+		return nil, nil
+	}
+	policy := &provider.TokenExchangePolicy{}
+	if len(spec.AllowedAudiences) > 0 {
+		policy.AllowedAudiences = make(map[string][]string, len(spec.AllowedAudiences))
+		for _, audience := range spec.AllowedAudiences {
+			policy.AllowedAudiences[audience.Name] = append(policy.AllowedAudiences[audience.Name], audience.AllowedGroups...)
+		}
+	}
+	if len(spec.TrustedServiceAccountIssuers) > 0 {
+		policy.TrustedServiceAccountIssuers = make(map[string]provider.TrustedTokenVerifier, len(spec.TrustedServiceAccountIssuers))
+		for _, trusted := range spec.TrustedServiceAccountIssuers {
+			client, err := trustedIssuerClient(trusted.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("trusted service account issuer %q: %w", trusted.Issuer, err)
+			}
+			policy.TrustedServiceAccountIssuers[trusted.Issuer] = trustedissuer.NewServiceAccountVerifier(
+				trusted.Issuer, trusted.JWKSURL, trusted.Audience, trusted.UsernamePrefix, client,
+			)
+		}
+	}
+	if len(spec.TrustedOIDCIssuers) > 0 {
+		policy.TrustedOIDCIssuers = make(map[string]provider.TrustedTokenVerifier, len(spec.TrustedOIDCIssuers))
+		for _, trusted := range spec.TrustedOIDCIssuers {
+			client, err := trustedIssuerClient(trusted.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("trusted OIDC issuer %q: %w", trusted.Issuer, err)
+			}
+			if len(trusted.Rules) == 0 {
+				return nil, fmt.Errorf("trusted OIDC issuer %q: must have at least one rule", trusted.Issuer)
+			}
+			rules := make([]trustedissuer.ClaimRule, 0, len(trusted.Rules))
+			for i, rule := range trusted.Rules {
+				if len(rule.Claims) == 0 {
+					return nil, fmt.Errorf("trusted OIDC issuer %q: rule %d must have at least one claim requirement", trusted.Issuer, i)
+				}
+				claimRule := trustedissuer.ClaimRule{Username: rule.Username, Groups: rule.Groups}
+				for _, requirement := range rule.Claims {
+					claimRule.Claims = append(claimRule.Claims, trustedissuer.ClaimRequirement{Claim: requirement.Claim, Value: requirement.Value})
+				}
+				rules = append(rules, claimRule)
+			}
+			policy.TrustedOIDCIssuers[trusted.Issuer] = trustedissuer.NewOIDCVerifier(
+				trusted.Issuer, trusted.JWKSURL, trusted.Audience, rules, client,
+			)
+		}
+	}
+	return policy, nil
+}
+
+// trustedIssuerClient returns the client which is used to fetch the keys of a trusted issuer.
+func trustedIssuerClient(tlsSpec *configv1alpha1.FederationDomainTokenExchangeTLSSpec) (*http.Client, error) {
+	var rootCAs *x509.CertPool
+	if tlsSpec != nil && tlsSpec.CertificateAuthorityData != "" {
+		bundle, err := base64.StdEncoding.DecodeString(tlsSpec.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("tls.certificateAuthorityData is invalid: %w", err)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("tls.certificateAuthorityData is invalid: %w", upstreamwatchers.ErrNoCertificates)
+		}
+	}
+	client := phttp.Default(rootCAs)
+	client.Timeout = time.Minute
+	return client, nil
+}
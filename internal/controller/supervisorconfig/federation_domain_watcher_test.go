@@ -5,6 +5,7 @@ package supervisorconfig
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/url"
@@ -16,16 +17,20 @@ import (
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubeinformers "k8s.io/client-go/informers"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	coretesting "k8s.io/client-go/testing"
 	clocktesting "k8s.io/utils/clock/testing"
 
 	"go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
 	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
 	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/certauthority"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/oidc/provider"
@@ -37,19 +42,23 @@ func TestInformerFilters(t *testing.T) {
 		var r *require.Assertions
 		var observableWithInformerOption *testutil.ObservableWithInformerOption
 		var configMapInformerFilter controllerlib.Filter
+		var brandingConfigMapInformerFilter controllerlib.Filter
 
 		it.Before(func() {
 			r = require.New(t)
 			observableWithInformerOption = testutil.NewObservableWithInformerOption()
 			federationDomainInformer := pinnipedinformers.NewSharedInformerFactoryWithOptions(nil, 0).Config().V1alpha1().FederationDomains()
+			configMapInformer := kubeinformers.NewSharedInformerFactoryWithOptions(nil, 0).Core().V1().ConfigMaps()
 			_ = NewFederationDomainWatcherController(
 				nil,
 				nil,
 				nil,
 				federationDomainInformer,
+				configMapInformer,
 				observableWithInformerOption.WithInformer, // make it possible to observe the behavior of the Filters
 			)
 			configMapInformerFilter = observableWithInformerOption.GetFilterForInformer(federationDomainInformer)
+			brandingConfigMapInformerFilter = observableWithInformerOption.GetFilterForInformer(configMapInformer)
 		})
 
 		when("watching FederationDomain objects", func() {
@@ -80,6 +89,30 @@ func TestInformerFilters(t *testing.T) {
 				})
 			})
 		})
+
+		when("watching ConfigMap objects", func() {
+			var subject controllerlib.Filter
+			var target, otherNamespace, otherName *corev1.ConfigMap
+
+			it.Before(func() {
+				subject = brandingConfigMapInformerFilter
+				target = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "some-name", Namespace: "some-namespace"}}
+				otherNamespace = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "some-name", Namespace: "other-namespace"}}
+				otherName = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "other-name", Namespace: "some-namespace"}}
+			})
+
+			when("any ConfigMap changes", func() {
+				it("returns true to trigger the sync method", func() {
+					r.True(subject.Add(target))
+					r.True(subject.Add(otherName))
+					r.True(subject.Add(otherNamespace))
+					r.True(subject.Update(target, otherName))
+					r.True(subject.Update(otherNamespace, otherName))
+					r.True(subject.Delete(target))
+					r.True(subject.Delete(otherNamespace))
+				})
+			})
+		})
 	}, spec.Parallel(), spec.Report(report.Terminal{}))
 }
 
@@ -102,6 +135,8 @@ func TestSync(t *testing.T) {
 		var subject controllerlib.Controller
 		var federationDomainInformerClient *pinnipedfake.Clientset
 		var federationDomainInformers pinnipedinformers.SharedInformerFactory
+		var kubeInformerClient *kubernetesfake.Clientset
+		var kubeInformers kubeinformers.SharedInformerFactory
 		var pinnipedAPIClient *pinnipedfake.Clientset
 		var cancelContext context.Context
 		var cancelContextCancelFunc context.CancelFunc
@@ -119,6 +154,7 @@ func TestSync(t *testing.T) {
 				clocktesting.NewFakeClock(frozenNow),
 				pinnipedAPIClient,
 				federationDomainInformers.Config().V1alpha1().FederationDomains(),
+				kubeInformers.Core().V1().ConfigMaps(),
 				controllerlib.WithInformer,
 			)
 
@@ -134,6 +170,7 @@ func TestSync(t *testing.T) {
 
 			// Must start informers before calling TestRunSynchronously()
 			federationDomainInformers.Start(cancelContext.Done())
+			kubeInformers.Start(cancelContext.Done())
 			controllerlib.TestRunSynchronously(t, subject)
 		}
 
@@ -148,6 +185,8 @@ func TestSync(t *testing.T) {
 			federationDomainInformerClient = pinnipedfake.NewSimpleClientset()
 			federationDomainInformers = pinnipedinformers.NewSharedInformerFactory(federationDomainInformerClient, 0)
 			pinnipedAPIClient = pinnipedfake.NewSimpleClientset()
+			kubeInformerClient = kubernetesfake.NewSimpleClientset()
+			kubeInformers = kubeinformers.NewSharedInformerFactory(kubeInformerClient, 0)
 
 			federationDomainGVR = schema.GroupVersionResource{
 				Group:    v1alpha1.SchemeGroupVersion.Group,
@@ -187,10 +226,10 @@ func TestSync(t *testing.T) {
 				err := controllerlib.TestSync(t, subject, *syncContext)
 				r.NoError(err)
 
-				provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer)
+				provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer, nil, nil)
 				r.NoError(err)
 
-				provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer)
+				provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer, nil, nil)
 				r.NoError(err)
 
 				r.True(providersSetter.SetProvidersWasCalled)
@@ -288,10 +327,10 @@ func TestSync(t *testing.T) {
 					err := controllerlib.TestSync(t, subject, *syncContext)
 					r.NoError(err)
 
-					provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer)
+					provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer, nil, nil)
 					r.NoError(err)
 
-					provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer)
+					provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer, nil, nil)
 					r.NoError(err)
 
 					r.True(providersSetter.SetProvidersWasCalled)
@@ -326,10 +365,10 @@ func TestSync(t *testing.T) {
 					err := controllerlib.TestSync(t, subject, *syncContext)
 					r.EqualError(err, "could not update status: some update error")
 
-					provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer)
+					provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer, nil, nil)
 					r.NoError(err)
 
-					provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer)
+					provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer, nil, nil)
 					r.NoError(err)
 
 					r.True(providersSetter.SetProvidersWasCalled)
@@ -545,7 +584,7 @@ func TestSync(t *testing.T) {
 				err := controllerlib.TestSync(t, subject, *syncContext)
 				r.NoError(err)
 
-				validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer)
+				validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer, nil, nil)
 				r.NoError(err)
 
 				r.True(providersSetter.SetProvidersWasCalled)
@@ -619,7 +658,7 @@ func TestSync(t *testing.T) {
 					err := controllerlib.TestSync(t, subject, *syncContext)
 					r.EqualError(err, "could not update status: some update error")
 
-					validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer)
+					validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer, nil, nil)
 					r.NoError(err)
 
 					r.True(providersSetter.SetProvidersWasCalled)
@@ -709,7 +748,7 @@ func TestSync(t *testing.T) {
 				err := controllerlib.TestSync(t, subject, *syncContext)
 				r.NoError(err)
 
-				nonDuplicateProvider, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer)
+				nonDuplicateProvider, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer, nil, nil)
 				r.NoError(err)
 
 				r.True(providersSetter.SetProvidersWasCalled)
@@ -882,7 +921,7 @@ func TestSync(t *testing.T) {
 				err := controllerlib.TestSync(t, subject, *syncContext)
 				r.NoError(err)
 
-				nonDuplicateProvider, err := provider.NewFederationDomainIssuer(federationDomainDifferentIssuerAddress.Spec.Issuer)
+				nonDuplicateProvider, err := provider.NewFederationDomainIssuer(federationDomainDifferentIssuerAddress.Spec.Issuer, nil, nil)
 				r.NoError(err)
 
 				r.True(providersSetter.SetProvidersWasCalled)
@@ -1014,6 +1053,89 @@ func TestSync(t *testing.T) {
 			})
 		})
 
+		when("there is a FederationDomain with branding in the informer", func() {
+			var federationDomain *v1alpha1.FederationDomain
+
+			it.Before(func() {
+				federationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "config1", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:   "https://issuer1.com",
+						Branding: &v1alpha1.FederationDomainBrandingSpec{ConfigMapName: "some-branding"},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+			})
+
+			requireStatusMessage := func(message string) {
+				federationDomain.Status.Status = v1alpha1.SuccessFederationDomainStatusCondition
+				federationDomain.Status.Message = message
+				federationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+				r.Equal([]coretesting.Action{
+					coretesting.NewGetAction(federationDomainGVR, federationDomain.Namespace, federationDomain.Name),
+					coretesting.NewUpdateSubresourceAction(federationDomainGVR, "status", federationDomain.Namespace, federationDomain),
+				}, pinnipedAPIClient.Actions())
+			}
+
+			when("the branding ConfigMap is valid", func() {
+				it.Before(func() {
+					r.NoError(kubeInformerClient.Tracker().Add(&corev1.ConfigMap{
+						ObjectMeta: metav1.ObjectMeta{Name: "some-branding", Namespace: namespace},
+						Data:       map[string]string{"displayName": "ACME Corp", "primaryColor": "#1b3951"},
+					}))
+				})
+
+				it("calls the ProvidersSetter with the branded pages", func() {
+					startInformersAndController()
+					r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+					r.True(providersSetter.SetProvidersWasCalled)
+					r.Len(providersSetter.FederationDomainsReceived, 1)
+					pages := providersSetter.FederationDomainsReceived[0].Pages()
+					r.NotEqual(provider.DefaultPages(), pages)
+					r.NotEqual(provider.DefaultPages().Login.ContentSecurityPolicy(), pages.Login.ContentSecurityPolicy())
+
+					requireStatusMessage("Provider successfully created")
+				})
+			})
+
+			when("the branding ConfigMap is invalid", func() {
+				it.Before(func() {
+					r.NoError(kubeInformerClient.Tracker().Add(&corev1.ConfigMap{
+						ObjectMeta: metav1.ObjectMeta{Name: "some-branding", Namespace: namespace},
+						Data:       map[string]string{"primaryColor": "blue"},
+					}))
+				})
+
+				it("calls the ProvidersSetter with the default pages and explains why in the status", func() {
+					startInformersAndController()
+					r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+					r.True(providersSetter.SetProvidersWasCalled)
+					r.Len(providersSetter.FederationDomainsReceived, 1)
+					r.Equal(provider.DefaultPages(), providersSetter.FederationDomainsReceived[0].Pages())
+
+					requireStatusMessage(`Provider successfully created, but using the default pages because the branding is invalid: ` +
+						`configmap "some-branding": primaryColor must be a hex color such as #1b3951: "blue"`)
+				})
+			})
+
+			when("the branding ConfigMap does not exist", func() {
+				it("calls the ProvidersSetter with the default pages and explains why in the status", func() {
+					startInformersAndController()
+					r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+					r.True(providersSetter.SetProvidersWasCalled)
+					r.Len(providersSetter.FederationDomainsReceived, 1)
+					r.Equal(provider.DefaultPages(), providersSetter.FederationDomainsReceived[0].Pages())
+
+					requireStatusMessage(`Provider successfully created, but using the default pages because the branding is invalid: ` +
+						`configmap "some-branding" not found`)
+				})
+			})
+		})
+
 		when("there are no FederationDomains in the informer", func() {
 			it("keeps waiting for one", func() {
 				startInformersAndController()
@@ -1026,3 +1148,102 @@ func TestSync(t *testing.T) {
 		})
 	}, spec.Parallel(), spec.Report(report.Terminal{}))
 }
+
+func TestTokenExchangePolicy(t *testing.T) {
+	policy, err := tokenExchangePolicy(nil)
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	policy, err = tokenExchangePolicy(&v1alpha1.FederationDomainTokenExchangeSpec{})
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	policy, err = tokenExchangePolicy(&v1alpha1.FederationDomainTokenExchangeSpec{AllowedAudiences: []v1alpha1.FederationDomainTokenExchangeAudience{
+		{Name: "some-cluster"},
+		{Name: "other-cluster", AllowedGroups: []string{"some-group", "other-group"}},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, &provider.TokenExchangePolicy{AllowedAudiences: map[string][]string{
+		"some-cluster":  nil,
+		"other-cluster": {"some-group", "other-group"},
+	}}, policy)
+
+	ca, err := certauthority.New("Test CA", time.Hour)
+	require.NoError(t, err)
+	policy, err = tokenExchangePolicy(&v1alpha1.FederationDomainTokenExchangeSpec{TrustedServiceAccountIssuers: []v1alpha1.FederationDomainTrustedServiceAccountIssuer{
+		{Issuer: "https://some-cluster.example.com", Audience: "some-audience", UsernamePrefix: "some-cluster:"},
+		{
+			Issuer:         "https://other-cluster.example.com",
+			JWKSURL:        "https://other-cluster.example.com/openid/v1/jwks",
+			Audience:       "some-audience",
+			UsernamePrefix: "other-cluster:",
+			TLS:            &v1alpha1.FederationDomainTokenExchangeTLSSpec{CertificateAuthorityData: base64.StdEncoding.EncodeToString(ca.Bundle())},
+		},
+	}})
+	require.NoError(t, err)
+	require.Nil(t, policy.AllowedAudiences)
+	require.Len(t, policy.TrustedServiceAccountIssuers, 2)
+	require.NotNil(t, policy.TrustedServiceAccountIssuer("https://some-cluster.example.com"))
+	require.NotNil(t, policy.TrustedServiceAccountIssuer("https://other-cluster.example.com"))
+	require.Nil(t, policy.TrustedServiceAccountIssuer("https://unknown-cluster.example.com"))
+
+	policy, err = tokenExchangePolicy(&v1alpha1.FederationDomainTokenExchangeSpec{TrustedServiceAccountIssuers: []v1alpha1.FederationDomainTrustedServiceAccountIssuer{
+		{
+			Issuer:         "https://some-cluster.example.com",
+			Audience:       "some-audience",
+			UsernamePrefix: "some-cluster:",
+			TLS:            &v1alpha1.FederationDomainTokenExchangeTLSSpec{CertificateAuthorityData: base64.StdEncoding.EncodeToString([]byte("not a certificate"))},
+		},
+	}})
+	require.EqualError(t, err, `trusted service account issuer "https://some-cluster.example.com": tls.certificateAuthorityData is invalid: no certificates found`)
+	require.Nil(t, policy)
+
+	policy, err = tokenExchangePolicy(&v1alpha1.FederationDomainTokenExchangeSpec{TrustedServiceAccountIssuers: []v1alpha1.FederationDomainTrustedServiceAccountIssuer{
+		{
+			Issuer:         "https://some-cluster.example.com",
+			Audience:       "some-audience",
+			UsernamePrefix: "some-cluster:",
+			TLS:            &v1alpha1.FederationDomainTokenExchangeTLSSpec{CertificateAuthorityData: "this is not base64"},
+		},
+	}})
+	require.EqualError(t, err, `trusted service account issuer "https://some-cluster.example.com": tls.certificateAuthorityData is invalid: illegal base64 data at input byte 4`)
+	require.Nil(t, policy)
+
+	policy, err = tokenExchangePolicy(&v1alpha1.FederationDomainTokenExchangeSpec{TrustedOIDCIssuers: []v1alpha1.FederationDomainTrustedOIDCIssuer{
+		{
+			Issuer:   "https://ci.example.com",
+			Audience: "some-audience",
+			Rules: []v1alpha1.FederationDomainTrustedOIDCIssuerRule{{
+				Claims:   []v1alpha1.FederationDomainTrustedOIDCIssuerClaimRequirement{{Claim: "repository", Value: "some-org/some-repo"}},
+				Username: "ci:{repository}",
+			}},
+		},
+	}})
+	require.NoError(t, err)
+	require.Nil(t, policy.TrustedServiceAccountIssuers)
+	require.Len(t, policy.TrustedOIDCIssuers, 1)
+	require.NotNil(t, policy.TrustedOIDCIssuer("https://ci.example.com"))
+	require.Nil(t, policy.TrustedServiceAccountIssuer("https://ci.example.com"))
+
+	policy, err = tokenExchangePolicy(&v1alpha1.FederationDomainTokenExchangeSpec{TrustedOIDCIssuers: []v1alpha1.FederationDomainTrustedOIDCIssuer{
+		{Issuer: "https://ci.example.com", Audience: "some-audience"},
+	}})
+	require.EqualError(t, err, `trusted OIDC issuer "https://ci.example.com": must have at least one rule`)
+	require.Nil(t, policy)
+
+	policy, err = tokenExchangePolicy(&v1alpha1.FederationDomainTokenExchangeSpec{TrustedOIDCIssuers: []v1alpha1.FederationDomainTrustedOIDCIssuer{
+		{
+			Issuer:   "https://ci.example.com",
+			Audience: "some-audience",
+			Rules: []v1alpha1.FederationDomainTrustedOIDCIssuerRule{
+				{
+					Claims:   []v1alpha1.FederationDomainTrustedOIDCIssuerClaimRequirement{{Claim: "repository", Value: "some-org/some-repo"}},
+					Username: "ci:{repository}",
+				},
+				{Username: "ci:{repository}"},
+			},
+		},
+	}})
+	require.EqualError(t, err, `trusted OIDC issuer "https://ci.example.com": rule 1 must have at least one claim requirement`)
+	require.Nil(t, policy)
+}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package generator
@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
@@ -15,6 +16,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 
 	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
 	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
@@ -31,11 +33,13 @@ type federationDomainSecretsController struct {
 	pinnipedClient           pinnipedclientset.Interface
 	federationDomainInformer configinformers.FederationDomainInformer
 	secretInformer           corev1informers.SecretInformer
+	keyRotator               keyRotator
 }
 
 // NewFederationDomainSecretsController returns a controllerlib.Controller that ensures a child Secret
 // always exists for a parent FederationDomain. It does this using the provided secretHelper, which
-// provides the parent/child mapping logic.
+// provides the parent/child mapping logic. The key of the child Secret is replaced every rotationInterval,
+// unless it is zero, and the replaced keys are kept in the Secret.
 func NewFederationDomainSecretsController(
 	secretHelper SecretHelper,
 	secretRefFunc func(domain *configv1alpha1.FederationDomainStatus) *corev1.LocalObjectReference,
@@ -43,6 +47,8 @@ func NewFederationDomainSecretsController(
 	pinnipedClient pinnipedclientset.Interface,
 	secretInformer corev1informers.SecretInformer,
 	federationDomainInformer configinformers.FederationDomainInformer,
+	rotationInterval time.Duration,
+	clock clock.Clock,
 	withInformer pinnipedcontroller.WithInformerOptionFunc,
 ) controllerlib.Controller {
 	return controllerlib.New(
@@ -55,6 +61,7 @@ func NewFederationDomainSecretsController(
 				pinnipedClient:           pinnipedClient,
 				secretInformer:           secretInformer,
 				federationDomainInformer: federationDomainInformer,
+				keyRotator:               keyRotator{interval: rotationInterval, clock: clock},
 			},
 		},
 		// We want to be notified when a FederationDomain's secret gets updated or deleted. When this happens, we
@@ -101,8 +108,10 @@ func (c *federationDomainSecretsController) Sync(ctx controllerlib.Context) erro
 	if err != nil {
 		return fmt.Errorf("failed to generate secret: %w", err)
 	}
+	now := c.keyRotator.clock.Now()
+	c.keyRotator.markRotated(newSecret, now)
 
-	secretNeedsUpdate, existingSecret, err := c.secretNeedsUpdate(federationDomain, newSecret.Name)
+	secretNeedsUpdate, existingSecret, err := c.secretNeedsUpdate(federationDomain, newSecret.Name, now)
 	if err != nil {
 		return fmt.Errorf("failed to determine secret status: %w", err)
 	}
@@ -121,13 +130,14 @@ func (c *federationDomainSecretsController) Sync(ctx controllerlib.Context) erro
 			return fmt.Errorf("failed to update federationdomain: %w", err)
 		}
 		plog.Debug("updated federationdomain", "federationdomain", klog.KObj(federationDomain), "secret", klog.KObj(newSecret))
+		c.keyRotator.requeue(ctx, existingSecret, now)
 
 		return nil
 	}
 
-	// If the FederationDomain does not have a secret associated with it, that secret does not exist, or the secret
-	// is invalid, we will create a new secret.
-	if err := c.createOrUpdateSecret(ctx.Context, federationDomain, &newSecret); err != nil {
+	// If the FederationDomain does not have a secret associated with it, that secret does not exist, the secret
+	// is invalid, or its key is due to be rotated, we will create a new secret.
+	if err := c.createOrUpdateSecret(ctx.Context, federationDomain, &newSecret, now); err != nil {
 		return fmt.Errorf("failed to create or update secret: %w", err)
 	}
 	plog.Debug("created/updated secret", "federationdomain", klog.KObj(federationDomain), "secret", klog.KObj(newSecret))
@@ -137,6 +147,7 @@ func (c *federationDomainSecretsController) Sync(ctx controllerlib.Context) erro
 		return fmt.Errorf("failed to update federationdomain: %w", err)
 	}
 	plog.Debug("updated federationdomain", "federationdomain", klog.KObj(federationDomain), "secret", klog.KObj(newSecret))
+	c.keyRotator.requeue(ctx, newSecret, now)
 
 	return nil
 }
@@ -146,6 +157,7 @@ func (c *federationDomainSecretsController) Sync(ctx controllerlib.Context) erro
 func (c *federationDomainSecretsController) secretNeedsUpdate(
 	federationDomain *configv1alpha1.FederationDomain,
 	secretName string,
+	now time.Time,
 ) (bool, *corev1.Secret, error) {
 	// This FederationDomain says it has a secret associated with it. Let's try to get it from the cache.
 	secret, err := c.secretInformer.Lister().Secrets(federationDomain.Namespace).Get(secretName)
@@ -163,6 +175,11 @@ func (c *federationDomainSecretsController) secretNeedsUpdate(
 		return true, secret, nil
 	}
 
+	if c.keyRotator.isDue(secret, now) {
+		// If the key of this secret is too old, we need to replace it.
+		return true, secret, nil
+	}
+
 	return false, secret, nil
 }
 
@@ -170,6 +187,7 @@ func (c *federationDomainSecretsController) createOrUpdateSecret(
 	ctx context.Context,
 	federationDomain *configv1alpha1.FederationDomain,
 	newSecret **corev1.Secret,
+	now time.Time,
 ) error {
 	secretClient := c.kubeClient.CoreV1().Secrets((*newSecret).Namespace)
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
@@ -189,7 +207,7 @@ func (c *federationDomainSecretsController) createOrUpdateSecret(
 		}
 
 		// New secret already exists, so ensure it is up to date.
-		if c.secretHelper.IsValid(federationDomain, oldSecret) {
+		if c.secretHelper.IsValid(federationDomain, oldSecret) && !c.keyRotator.isDue(oldSecret, now) {
 			// If the secret already has valid a valid Secret, then we are good to go and we don't need an
 			// update.
 			*newSecret = oldSecret
@@ -198,7 +216,7 @@ func (c *federationDomainSecretsController) createOrUpdateSecret(
 
 		oldSecret.Labels = (*newSecret).Labels
 		oldSecret.Type = (*newSecret).Type
-		oldSecret.Data = (*newSecret).Data
+		c.keyRotator.rotate(oldSecret, (*newSecret).Data, now)
 		*newSecret = oldSecret
 		_, err = secretClient.Update(ctx, oldSecret, metav1.UpdateOptions{})
 		return err
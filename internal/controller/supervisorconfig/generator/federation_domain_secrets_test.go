@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package generator
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
@@ -21,6 +22,7 @@ import (
 	kubeinformers "k8s.io/client-go/informers"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
+	clocktesting "k8s.io/utils/clock/testing"
 
 	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
 	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
@@ -177,7 +179,7 @@ func TestFederationDomainControllerFilterSecret(t *testing.T) {
 				map[string]string{},
 				rand.Reader,
 				SecretUsageTokenSigningKey,
-				func(cacheKey string, cacheValue []byte) {},
+				func(cacheKey string, cacheValue []byte, previousCacheValues [][]byte) {},
 			)
 
 			secretInformer := kubeinformers.NewSharedInformerFactory(
@@ -196,6 +198,8 @@ func TestFederationDomainControllerFilterSecret(t *testing.T) {
 				nil, // pinnipedClient, not needed
 				secretInformer,
 				federationDomainInformer,
+				0,   // rotationInterval, not needed
+				nil, // clock, not needed
 				withInformer.WithInformer,
 			)
 
@@ -240,7 +244,7 @@ func TestNewFederationDomainSecretsControllerFilterFederationDomain(t *testing.T
 				map[string]string{},
 				rand.Reader,
 				SecretUsageTokenSigningKey,
-				func(cacheKey string, cacheValue []byte) {},
+				func(cacheKey string, cacheValue []byte, previousCacheValues [][]byte) {},
 			)
 
 			secretInformer := kubeinformers.NewSharedInformerFactory(
@@ -259,6 +263,8 @@ func TestNewFederationDomainSecretsControllerFilterFederationDomain(t *testing.T
 				nil, // pinnipedClient, not needed
 				secretInformer,
 				federationDomainInformer,
+				0,   // rotationInterval, not needed
+				nil, // clock, not needed
 				withInformer.WithInformer,
 			)
 
@@ -359,13 +365,33 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 		},
 	}
 
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	rotationInterval := 30 * 24 * time.Hour
+	oldKey := []byte("some-old-32-byte-key-for-testing")
+	newKey := []byte("some-new-32-byte-key-for-testing")
+
+	secretWithKeyRotatedAt := func(key []byte, rotatedAt time.Time) *corev1.Secret {
+		secret := goodSecret.DeepCopy()
+		secret.Annotations = map[string]string{"supervisor.pinniped.dev/key-rotated-at": rotatedAt.Format(time.RFC3339)}
+		secret.Data = map[string][]byte{"key": key}
+		return secret
+	}
+	recentlyRotatedSecret := secretWithKeyRotatedAt(oldKey, now.Add(-10*24*time.Hour))
+	dueForRotationSecret := secretWithKeyRotatedAt(oldKey, now.Add(-31*24*time.Hour))
+	generatedSecret := goodSecret.DeepCopy()
+	generatedSecret.Data = map[string][]byte{"key": newKey}
+	rotatedSecret := secretWithKeyRotatedAt(newKey, now)
+	rotatedSecret.Data["previousKeys"] = oldKey
+
 	tests := []struct {
 		name                        string
 		storage                     func(**configv1alpha1.FederationDomain, **corev1.Secret)
 		client                      func(*pinnipedfake.Clientset, *kubernetesfake.Clientset)
 		secretHelper                func(*mocksecrethelper.MockSecretHelper)
+		rotationInterval            time.Duration
 		wantFederationDomainActions []kubetesting.Action
 		wantSecretActions           []kubetesting.Action
+		wantRequeueAfter            time.Duration
 		wantError                   string
 	}{
 		{
@@ -623,6 +649,79 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
 			},
 		},
+		{
+			name: "FederationDomain exists and secret does not exist and keys are rotated",
+			storage: func(federationDomain **configv1alpha1.FederationDomain, s **corev1.Secret) {
+				*s = nil
+			},
+			secretHelper: func(secretHelper *mocksecrethelper.MockSecretHelper) {
+				secretHelper.EXPECT().Generate(goodFederationDomain).Times(1).Return(generatedSecret.DeepCopy(), nil)
+				secretHelper.EXPECT().ObserveActiveSecretAndUpdateParentFederationDomain(goodFederationDomain, secretWithKeyRotatedAt(newKey, now)).Times(1).Return(goodFederationDomainWithTokenSigningKey)
+			},
+			rotationInterval: rotationInterval,
+			wantFederationDomainActions: []kubetesting.Action{
+				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, goodFederationDomainWithTokenSigningKey),
+			},
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
+				kubetesting.NewCreateAction(secretGVR, namespace, secretWithKeyRotatedAt(newKey, now)),
+			},
+			wantRequeueAfter: rotationInterval,
+		},
+		{
+			name: "FederationDomain exists and valid secret exists whose key is not due to be rotated yet",
+			storage: func(federationDomain **configv1alpha1.FederationDomain, s **corev1.Secret) {
+				*s = recentlyRotatedSecret.DeepCopy()
+			},
+			secretHelper: func(secretHelper *mocksecrethelper.MockSecretHelper) {
+				secretHelper.EXPECT().Generate(goodFederationDomain).Times(1).Return(generatedSecret.DeepCopy(), nil)
+				secretHelper.EXPECT().IsValid(goodFederationDomain, recentlyRotatedSecret).Times(1).Return(true)
+				secretHelper.EXPECT().ObserveActiveSecretAndUpdateParentFederationDomain(goodFederationDomain, recentlyRotatedSecret).Times(1).Return(goodFederationDomainWithTokenSigningKey)
+			},
+			rotationInterval: rotationInterval,
+			wantFederationDomainActions: []kubetesting.Action{
+				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, goodFederationDomainWithTokenSigningKey),
+			},
+			wantRequeueAfter: 20 * 24 * time.Hour,
+		},
+		{
+			name: "FederationDomain exists and valid secret exists whose key is due to be rotated",
+			storage: func(federationDomain **configv1alpha1.FederationDomain, s **corev1.Secret) {
+				*s = dueForRotationSecret.DeepCopy()
+			},
+			secretHelper: func(secretHelper *mocksecrethelper.MockSecretHelper) {
+				secretHelper.EXPECT().Generate(goodFederationDomain).Times(1).Return(generatedSecret.DeepCopy(), nil)
+				secretHelper.EXPECT().IsValid(goodFederationDomain, dueForRotationSecret).Times(2).Return(true)
+				secretHelper.EXPECT().ObserveActiveSecretAndUpdateParentFederationDomain(goodFederationDomain, rotatedSecret).Times(1).Return(goodFederationDomainWithTokenSigningKey)
+			},
+			rotationInterval: rotationInterval,
+			wantFederationDomainActions: []kubetesting.Action{
+				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, goodFederationDomainWithTokenSigningKey),
+			},
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, rotatedSecret),
+			},
+			wantRequeueAfter: rotationInterval,
+		},
+		{
+			name: "FederationDomain exists and valid secret exists whose key is due to be rotated but keys are not rotated",
+			storage: func(federationDomain **configv1alpha1.FederationDomain, s **corev1.Secret) {
+				*s = dueForRotationSecret.DeepCopy()
+			},
+			secretHelper: func(secretHelper *mocksecrethelper.MockSecretHelper) {
+				secretHelper.EXPECT().Generate(goodFederationDomain).Times(1).Return(generatedSecret.DeepCopy(), nil)
+				secretHelper.EXPECT().IsValid(goodFederationDomain, dueForRotationSecret).Times(1).Return(true)
+				secretHelper.EXPECT().ObserveActiveSecretAndUpdateParentFederationDomain(goodFederationDomain, dueForRotationSecret).Times(1).Return(goodFederationDomainWithTokenSigningKey)
+			},
+			wantFederationDomainActions: []kubetesting.Action{
+				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, goodFederationDomainWithTokenSigningKey),
+			},
+		},
 	}
 	for _, test := range tests {
 		test := test
@@ -683,6 +782,8 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 				pinnipedAPIClient,
 				kubeInformers.Core().V1().Secrets(),
 				pinnipedInformers.Config().V1alpha1().FederationDomains(),
+				test.rotationInterval,
+				clocktesting.NewFakeClock(now),
 				controllerlib.WithInformer,
 			)
 
@@ -691,12 +792,14 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 			pinnipedInformers.Start(ctx.Done())
 			controllerlib.TestRunSynchronously(t, c)
 
+			queue := &testQueue{t: t}
 			err := controllerlib.TestSync(t, c, controllerlib.Context{
 				Context: ctx,
 				Key: controllerlib.Key{
 					Namespace: namespace,
 					Name:      federationDomainName,
 				},
+				Queue: queue,
 			})
 			if test.wantError != "" {
 				require.EqualError(t, err, test.wantError)
@@ -712,6 +815,9 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 				test.wantSecretActions = []kubetesting.Action{}
 			}
 			require.Equal(t, test.wantSecretActions, kubeAPIClient.Actions())
+
+			require.Equal(t, test.wantRequeueAfter != 0, queue.called)
+			require.Equal(t, test.wantRequeueAfter, queue.duration)
 		})
 	}
 }
@@ -0,0 +1,145 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// DefaultKeyRotationInterval is how often the Supervisor replaces the keys which sign and encrypt short-lived
+	// values, like the upstream state param and the CSRF cookie. Keys which encrypt long-lived data, like the TOTP
+	// enrollments of users, must never be rotated, since that data could not be decrypted after maxPreviousKeys
+	// rotations.
+	DefaultKeyRotationInterval = 30 * 24 * time.Hour
+
+	// previousSymmetricSecretDataKey is the corev1.Secret.Data key for the keys which were replaced by rotations,
+	// concatenated with the most recently replaced key first.
+	previousSymmetricSecretDataKey = "previousKeys"
+
+	// keyRotatedAtAnnotationKey is the annotation which records when the key of a Secret was generated.
+	keyRotatedAtAnnotationKey = "supervisor.pinniped.dev/key-rotated-at"
+
+	// maxPreviousKeys is how many replaced keys are kept. Values which were encoded with an older key can no
+	// longer be decoded, so this times the rotation interval must be longer than the lifespan of those values.
+	maxPreviousKeys = 3
+)
+
+// SupervisorKeyRotationInterval returns how often the key of the Supervisor-wide Secret of the secretType is replaced.
+// Zero means that it is never replaced, which is the case for any key that is not known to only protect short-lived
+// values.
+func SupervisorKeyRotationInterval(secretType corev1.SecretType) time.Duration {
+	switch secretType {
+	case SupervisorCSRFSigningKeySecretType:
+		return DefaultKeyRotationInterval
+	case SupervisorTOTPEncryptionKeySecretType:
+		// TOTP enrollments are kept for as long as users are enrolled.
+		return 0
+	default:
+		return 0
+	}
+}
+
+// keyRotator decides when the symmetric key of a generated Secret is replaced by a new key. The replaced keys are
+// kept in the Secret, so that values which were encoded with them can still be decoded for a while.
+type keyRotator struct {
+	// interval is how long a key is used before it is replaced. Zero means that keys are never replaced.
+	interval time.Duration
+	clock    clock.Clock
+}
+
+// isDue returns whether the key of the secret should be replaced now.
+func (r keyRotator) isDue(secret *corev1.Secret, now time.Time) bool {
+	dueIn, rotates := r.dueIn(secret, now)
+	return rotates && dueIn <= 0
+}
+
+// dueIn returns how long until the key of the secret should be replaced, and false when keys are never replaced.
+// Secrets which were generated before rotation was introduced do not have the annotation, so their age is used.
+func (r keyRotator) dueIn(secret *corev1.Secret, now time.Time) (time.Duration, bool) {
+	if r.interval <= 0 {
+		return 0, false
+	}
+	rotatedAt := secret.CreationTimestamp.Time
+	if value, ok := secret.Annotations[keyRotatedAtAnnotationKey]; ok {
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			rotatedAt = parsed
+		}
+	}
+	return rotatedAt.Add(r.interval).Sub(now), true
+}
+
+// rotate changes the data of the old secret to the data of the new secret, keeping the key of the old secret and
+// its previous keys. It does nothing to the previous keys when keys are never replaced.
+func (r keyRotator) rotate(oldSecret *corev1.Secret, newData map[string][]byte, now time.Time) {
+	if r.interval <= 0 {
+		oldSecret.Data = newData
+		return
+	}
+
+	replacedKeys := previousKeys(oldSecret)
+	if oldKey := oldSecret.Data[symmetricSecretDataKey]; len(oldKey) == symmetricKeySize {
+		replacedKeys = append([][]byte{oldKey}, replacedKeys...)
+	}
+	if len(replacedKeys) > maxPreviousKeys {
+		replacedKeys = replacedKeys[:maxPreviousKeys]
+	}
+
+	data := make(map[string][]byte, len(newData)+1)
+	for key, value := range newData {
+		data[key] = value
+	}
+	if len(replacedKeys) > 0 {
+		var concatenated []byte
+		for _, replacedKey := range replacedKeys {
+			concatenated = append(concatenated, replacedKey...)
+		}
+		data[previousSymmetricSecretDataKey] = concatenated
+	}
+	oldSecret.Data = data
+	r.markRotated(oldSecret, now)
+}
+
+// markRotated records that the key of the secret was generated now. It does nothing when keys are never replaced.
+func (r keyRotator) markRotated(secret *corev1.Secret, now time.Time) {
+	if r.interval <= 0 {
+		return
+	}
+	annotations := make(map[string]string, len(secret.Annotations)+1)
+	for key, value := range secret.Annotations {
+		annotations[key] = value
+	}
+	annotations[keyRotatedAtAnnotationKey] = now.UTC().Format(time.RFC3339)
+	secret.Annotations = annotations
+}
+
+// requeue makes sure that the controller syncs again when the key of the secret is due to be replaced.
+func (r keyRotator) requeue(ctx controllerlib.Context, secret *corev1.Secret, now time.Time) {
+	dueIn, rotates := r.dueIn(secret, now)
+	if !rotates {
+		return
+	}
+	plog.Debug("scheduling key rotation", "secret", klog.KObj(secret), "dueIn", dueIn)
+	ctx.Queue.AddAfter(ctx.Key, dueIn)
+}
+
+// previousKeys returns the keys of the secret which were replaced by rotations, most recently replaced first.
+func previousKeys(secret *corev1.Secret) [][]byte {
+	concatenated := secret.Data[previousSymmetricSecretDataKey]
+	if len(concatenated)%symmetricKeySize != 0 {
+		return nil
+	}
+	var keys [][]byte
+	for i := 0; i < len(concatenated); i += symmetricKeySize {
+		keys = append(keys, concatenated[i:i+symmetricKeySize])
+	}
+	return keys
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.pinniped.dev/internal/controllerlib"
+)
+
+func TestKeyRotator(t *testing.T) {
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	interval := 30 * 24 * time.Hour
+	key := func(b byte) []byte { return bytes.Repeat([]byte{b}, symmetricKeySize) }
+
+	t.Run("keys are never rotated without an interval", func(t *testing.T) {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(now.Add(-365 * 24 * time.Hour))}}
+		r := keyRotator{}
+		_, rotates := r.dueIn(secret, now)
+		require.False(t, rotates)
+		require.False(t, r.isDue(secret, now))
+
+		r.markRotated(secret, now)
+		require.Empty(t, secret.Annotations)
+		r.rotate(secret, map[string][]byte{"key": key(1)}, now)
+		require.Equal(t, map[string][]byte{"key": key(1)}, secret.Data)
+	})
+
+	t.Run("rotation is due an interval after the key was generated", func(t *testing.T) {
+		r := keyRotator{interval: interval}
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			CreationTimestamp: metav1.NewTime(now.Add(-100 * 24 * time.Hour)),
+			Annotations:       map[string]string{"supervisor.pinniped.dev/key-rotated-at": "2029-12-22T00:00:00Z"},
+		}}
+		dueIn, rotates := r.dueIn(secret, now)
+		require.True(t, rotates)
+		require.Equal(t, 20*24*time.Hour, dueIn)
+		require.False(t, r.isDue(secret, now))
+		require.True(t, r.isDue(secret, now.Add(20*24*time.Hour)))
+
+		// Secrets which were generated before keys were rotated use their age.
+		delete(secret.Annotations, "supervisor.pinniped.dev/key-rotated-at")
+		require.True(t, r.isDue(secret, now))
+		secret.CreationTimestamp = metav1.NewTime(now.Add(-24 * time.Hour))
+		dueIn, _ = r.dueIn(secret, now)
+		require.Equal(t, 29*24*time.Hour, dueIn)
+	})
+
+	t.Run("rotation keeps a limited number of previous keys", func(t *testing.T) {
+		r := keyRotator{interval: interval}
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"some-annotation": "some-value"}},
+			Data:       map[string][]byte{"key": key(1)},
+		}
+		require.Empty(t, previousKeys(secret))
+
+		for i := byte(2); i <= 5; i++ {
+			r.rotate(secret, map[string][]byte{"key": key(i)}, now)
+		}
+		require.Equal(t, key(5), secret.Data["key"])
+		require.Equal(t, [][]byte{key(4), key(3), key(2)}, previousKeys(secret))
+		require.Equal(t, map[string]string{
+			"some-annotation":                        "some-value",
+			"supervisor.pinniped.dev/key-rotated-at": "2030-01-01T00:00:00Z",
+		}, secret.Annotations)
+	})
+
+	t.Run("keys which are not valid are not kept", func(t *testing.T) {
+		r := keyRotator{interval: interval}
+		secret := &corev1.Secret{Data: map[string][]byte{"key": []byte("too short"), "previousKeys": []byte("also too short")}}
+		require.Empty(t, previousKeys(secret))
+		r.rotate(secret, map[string][]byte{"key": key(1)}, now)
+		require.Equal(t, map[string][]byte{"key": key(1)}, secret.Data)
+	})
+}
+
+func TestSupervisorKeyRotationInterval(t *testing.T) {
+	require.Equal(t, DefaultKeyRotationInterval, SupervisorKeyRotationInterval(SupervisorCSRFSigningKeySecretType))
+	require.Zero(t, SupervisorKeyRotationInterval(SupervisorTOTPEncryptionKeySecretType))
+	require.Zero(t, SupervisorKeyRotationInterval("secrets.pinniped.dev/some-unknown-type"))
+}
+
+type testQueue struct {
+	t *testing.T
+
+	called   bool
+	key      controllerlib.Key
+	duration time.Duration
+
+	controllerlib.Queue // panic if any other methods called
+}
+
+func (q *testQueue) AddAfter(key controllerlib.Key, duration time.Duration) {
+	q.t.Helper()
+
+	require.False(q.t, q.called, "AddAfter should only be called once")
+
+	q.called = true
+	q.key = key
+	q.duration = duration
+}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package generator
@@ -30,6 +30,9 @@ const (
 	// SupervisorCSRFSigningKeySecretType for the Secret storing the CSRF signing key.
 	SupervisorCSRFSigningKeySecretType corev1.SecretType = "secrets.pinniped.dev/supervisor-csrf-signing-key"
 
+	// SupervisorTOTPEncryptionKeySecretType for the Secret storing the key which encrypts the TOTP enrollments of users.
+	SupervisorTOTPEncryptionKeySecretType corev1.SecretType = "secrets.pinniped.dev/supervisor-totp-encryption-key"
+
 	// FederationDomainTokenSigningKeyType for the Secret storing the FederationDomain token signing key.
 	FederationDomainTokenSigningKeyType corev1.SecretType = "secrets.pinniped.dev/federation-domain-token-signing-key"
 
@@ -61,13 +64,13 @@ const (
 )
 
 // New returns a SecretHelper that has been parameterized with common symmetric secret generation
-// knobs.
+// knobs. The updateCacheFunc is also passed the keys which were replaced by rotations, most recent first.
 func NewSymmetricSecretHelper(
 	namePrefix string,
 	labels map[string]string,
 	rand io.Reader,
 	secretUsage SecretUsage,
-	updateCacheFunc func(cacheKey string, cacheValue []byte),
+	updateCacheFunc func(cacheKey string, cacheValue []byte, previousCacheValues [][]byte),
 ) SecretHelper {
 	return &symmetricSecretHelper{
 		namePrefix:      namePrefix,
@@ -83,7 +86,7 @@ type symmetricSecretHelper struct {
 	labels          map[string]string
 	rand            io.Reader
 	secretUsage     SecretUsage
-	updateCacheFunc func(cacheKey string, cacheValue []byte)
+	updateCacheFunc func(cacheKey string, cacheValue []byte, previousCacheValues [][]byte)
 }
 
 func (s *symmetricSecretHelper) NamePrefix() string { return s.namePrefix }
@@ -141,7 +144,7 @@ func (s *symmetricSecretHelper) ObserveActiveSecretAndUpdateParentFederationDoma
 	federationDomain *configv1alpha1.FederationDomain,
 	secret *corev1.Secret,
 ) *configv1alpha1.FederationDomain {
-	s.updateCacheFunc(federationDomain.Spec.Issuer, secret.Data[symmetricSecretDataKey])
+	s.updateCacheFunc(federationDomain.Spec.Issuer, secret.Data[symmetricSecretDataKey], previousKeys(secret))
 
 	switch s.secretUsage {
 	case SecretUsageTokenSigningKey:
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package generator
@@ -63,15 +63,17 @@ func TestSymmetricSecretHelper(t *testing.T) {
 			randSource := strings.NewReader(keyWith32Bytes)
 			var federationDomainIssuerValue string
 			var symmetricKeyValue []byte
+			var previousSymmetricKeysValue [][]byte
 			h := NewSymmetricSecretHelper(
 				"some-name-prefix-",
 				labels,
 				randSource,
 				test.secretUsage,
-				func(federationDomainIssuer string, symmetricKey []byte) {
+				func(federationDomainIssuer string, symmetricKey []byte, previousSymmetricKeys [][]byte) {
 					require.True(t, federationDomainIssuer == "" && symmetricKeyValue == nil, "expected notify func not to have been called yet")
 					federationDomainIssuerValue = federationDomainIssuer
 					symmetricKeyValue = symmetricKey
+					previousSymmetricKeysValue = previousSymmetricKeys
 				},
 			)
 
@@ -108,6 +110,7 @@ func TestSymmetricSecretHelper(t *testing.T) {
 			require.Equal(t, parent.Spec.Issuer, federationDomainIssuerValue)
 			require.Equal(t, child.Name, test.wantSetFederationDomainField(parent))
 			require.Equal(t, child.Data["key"], symmetricKeyValue)
+			require.Nil(t, previousSymmetricKeysValue)
 
 			require.True(t, h.Handles(child))
 			wrongTypedChild := child.DeepCopy()
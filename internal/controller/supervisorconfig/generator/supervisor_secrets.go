@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package secretgenerator provides a supervisorSecretsController that can ensure existence of a generated secret.
@@ -8,6 +8,7 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -17,6 +18,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controllerlib"
@@ -28,30 +30,41 @@ import (
 var generateKey = generateSymmetricKey
 
 type supervisorSecretsController struct {
+	secretType     corev1.SecretType
 	labels         map[string]string
 	kubeClient     kubernetes.Interface
 	secretInformer corev1informers.SecretInformer
-	setCacheFunc   func(secret []byte)
+	setCacheFunc   func(secret []byte, previousSecrets [][]byte)
+	keyRotator     keyRotator
 }
 
 // NewSupervisorSecretsController instantiates a new controllerlib.Controller which will ensure existence of a generated secret.
+// The secret is named after the owner with the nameSuffix appended, and has the secretType. The key of the secret is
+// replaced every rotationInterval, unless it is zero. The replaced keys are passed to setCacheFunc along with the
+// current key, so that values which were encoded with them can still be decoded.
 func NewSupervisorSecretsController(
 	owner *appsv1.Deployment,
+	nameSuffix string,
+	secretType corev1.SecretType,
 	labels map[string]string,
 	kubeClient kubernetes.Interface,
 	secretInformer corev1informers.SecretInformer,
-	setCacheFunc func(secret []byte),
+	setCacheFunc func(secret []byte, previousSecrets [][]byte),
+	rotationInterval time.Duration,
+	clock clock.Clock,
 	withInformer pinnipedcontroller.WithInformerOptionFunc,
 	initialEventFunc pinnipedcontroller.WithInitialEventOptionFunc,
 ) controllerlib.Controller {
 	c := supervisorSecretsController{
+		secretType:     secretType,
 		labels:         labels,
 		kubeClient:     kubeClient,
 		secretInformer: secretInformer,
 		setCacheFunc:   setCacheFunc,
+		keyRotator:     keyRotator{interval: rotationInterval, clock: clock},
 	}
 	return controllerlib.New(
-		controllerlib.Config{Name: owner.Name + "-secret-generator", Syncer: &c},
+		controllerlib.Config{Name: owner.Name + nameSuffix + "-secret-generator", Syncer: &c},
 		withInformer(
 			secretInformer,
 			pinnipedcontroller.SimpleFilter(func(obj metav1.Object) bool {
@@ -59,7 +72,7 @@ func NewSupervisorSecretsController(
 				if !ok {
 					return false
 				}
-				if secret.Type != SupervisorCSRFSigningKeySecretType {
+				if secret.Type != secretType {
 					return false
 				}
 				return true
@@ -68,7 +81,7 @@ func NewSupervisorSecretsController(
 		),
 		initialEventFunc(controllerlib.Key{
 			Namespace: owner.Namespace,
-			Name:      owner.Name + "-key",
+			Name:      owner.Name + nameSuffix,
 		}),
 	)
 }
@@ -81,28 +94,32 @@ func (c *supervisorSecretsController) Sync(ctx controllerlib.Context) error {
 		return fmt.Errorf("failed to list secret %s/%s: %w", ctx.Key.Namespace, ctx.Key.Name, err)
 	}
 
-	secretNeedsUpdate := isNotFound || !isValid(secret, c.labels)
+	now := c.keyRotator.clock.Now()
+	secretNeedsUpdate := isNotFound || !isValid(secret, c.secretType, c.labels) || c.keyRotator.isDue(secret, now)
 	if !secretNeedsUpdate {
 		plog.Debug("secret is up to date", "secret", klog.KObj(secret))
-		c.setCacheFunc(secret.Data[symmetricSecretDataKey])
+		c.setCacheFunc(secret.Data[symmetricSecretDataKey], previousKeys(secret))
+		c.keyRotator.requeue(ctx, secret, now)
 		return nil
 	}
 
-	newSecret, err := generateSecret(ctx.Key.Namespace, ctx.Key.Name, c.labels, secretDataFunc)
+	newSecret, err := generateSecret(ctx.Key.Namespace, ctx.Key.Name, c.secretType, c.labels, secretDataFunc)
 	if err != nil {
 		return fmt.Errorf("failed to generate secret: %w", err)
 	}
+	c.keyRotator.markRotated(newSecret, now)
 
 	if isNotFound {
 		err = c.createSecret(ctx.Context, newSecret)
 	} else {
-		err = c.updateSecret(ctx.Context, &newSecret, ctx.Key.Name)
+		err = c.updateSecret(ctx.Context, &newSecret, ctx.Key.Name, now)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to create/update secret %s/%s: %w", newSecret.Namespace, newSecret.Name, err)
 	}
 
-	c.setCacheFunc(newSecret.Data[symmetricSecretDataKey])
+	c.setCacheFunc(newSecret.Data[symmetricSecretDataKey], previousKeys(newSecret))
+	c.keyRotator.requeue(ctx, newSecret, now)
 
 	return nil
 }
@@ -112,7 +129,7 @@ func (c *supervisorSecretsController) createSecret(ctx context.Context, newSecre
 	return err
 }
 
-func (c *supervisorSecretsController) updateSecret(ctx context.Context, newSecret **corev1.Secret, secretName string) error {
+func (c *supervisorSecretsController) updateSecret(ctx context.Context, newSecret **corev1.Secret, secretName string, now time.Time) error {
 	secrets := c.kubeClient.CoreV1().Secrets((*newSecret).Namespace)
 	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
 		currentSecret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
@@ -128,19 +145,22 @@ func (c *supervisorSecretsController) updateSecret(ctx context.Context, newSecre
 			return nil
 		}
 
-		if isValid(currentSecret, c.labels) {
+		if isValid(currentSecret, c.secretType, c.labels) && !c.keyRotator.isDue(currentSecret, now) {
 			*newSecret = currentSecret
 			return nil
 		}
 
 		currentSecret.Type = (*newSecret).Type
-		currentSecret.Data = (*newSecret).Data
+		c.keyRotator.rotate(currentSecret, (*newSecret).Data, now)
 		for key, value := range c.labels {
 			currentSecret.Labels[key] = value
 		}
 
-		_, err = secrets.Update(ctx, currentSecret, metav1.UpdateOptions{})
-		return err
+		if _, err := secrets.Update(ctx, currentSecret, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		*newSecret = currentSecret
+		return nil
 	})
 }
 
@@ -152,8 +172,8 @@ func generateSymmetricKey() ([]byte, error) {
 	return b, nil
 }
 
-func isValid(secret *corev1.Secret, labels map[string]string) bool {
-	if secret.Type != SupervisorCSRFSigningKeySecretType {
+func isValid(secret *corev1.Secret, secretType corev1.SecretType, labels map[string]string) bool {
+	if secret.Type != secretType {
 		return false
 	}
 
@@ -185,7 +205,7 @@ func secretDataFunc() (map[string][]byte, error) {
 	}, nil
 }
 
-func generateSecret(namespace, name string, labels map[string]string, secretDataFunc func() (map[string][]byte, error)) (*corev1.Secret, error) {
+func generateSecret(namespace, name string, secretType corev1.SecretType, labels map[string]string, secretDataFunc func() (map[string][]byte, error)) (*corev1.Secret, error) {
 	secretData, err := secretDataFunc()
 	if err != nil {
 		return nil, err
@@ -197,7 +217,7 @@ func generateSecret(namespace, name string, labels map[string]string, secretData
 			Namespace: namespace,
 			Labels:    labels,
 		},
-		Type: SupervisorCSRFSigningKeySecretType,
+		Type: secretType,
 		Data: secretData,
 	}, nil
 }
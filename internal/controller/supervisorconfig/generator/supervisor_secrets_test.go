@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package generator
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	appsv1 "k8s.io/api/apps/v1"
@@ -19,6 +20,7 @@ import (
 	kubeinformers "k8s.io/client-go/informers"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
+	clocktesting "k8s.io/utils/clock/testing"
 
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/testutil"
@@ -76,6 +78,15 @@ func TestSupervisorSecretsControllerFilterSecret(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "Secret of another Supervisor secrets controller",
+			secret: &corev1.Secret{
+				Type: "secrets.pinniped.dev/supervisor-totp-encryption-key",
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "some-namespace",
+				},
+			},
+		},
 		{
 			name:   "not a secret",
 			secret: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "some-namespace"}},
@@ -111,10 +122,14 @@ func TestSupervisorSecretsControllerFilterSecret(t *testing.T) {
 			withInformer := testutil.NewObservableWithInformerOption()
 			_ = NewSupervisorSecretsController(
 				owner,
+				"-key",
+				SupervisorCSRFSigningKeySecretType,
 				labels,
 				nil, // kubeClient, not needed
 				secretInformer,
 				nil, // setCache, not needed
+				0,   // rotationInterval, not needed
+				nil, // clock, not needed
 				withInformer.WithInformer,
 				testutil.NewObservableWithInitialEventOption().WithInitialEvent,
 			)
@@ -137,16 +152,20 @@ func TestSupervisorSecretsControllerInitialEvent(t *testing.T) {
 	).Core().V1().Secrets()
 	_ = NewSupervisorSecretsController(
 		owner,
+		"-totp-key",
+		SupervisorTOTPEncryptionKeySecretType,
 		nil,
 		nil, // kubeClient, not needed
 		secretInformer,
 		nil, // setCache, not needed
+		0,   // rotationInterval, not needed
+		nil, // clock, not needed
 		testutil.NewObservableWithInformerOption().WithInformer,
 		initialEventOption.WithInitialEvent,
 	)
 	require.Equal(t, &controllerlib.Key{
 		Namespace: owner.Namespace,
-		Name:      owner.Name + "-key",
+		Name:      owner.Name + "-totp-key",
 	}, initialEventOption.GetInitialEventKey())
 }
 
@@ -194,16 +213,29 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 	// Add an extra label to make sure we don't overwrite existing labels on a Secret.
 	generatedSecret.Labels["extra-label-key"] = "extra-label-value"
 
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	rotationInterval := 30 * 24 * time.Hour
+	withKeyRotatedAt := func(secret *corev1.Secret, rotatedAt time.Time) *corev1.Secret {
+		secret = secret.DeepCopy()
+		secret.Annotations = map[string]string{"supervisor.pinniped.dev/key-rotated-at": rotatedAt.Format(time.RFC3339)}
+		return secret
+	}
+	rotatedSecret := withKeyRotatedAt(generatedSecret, now)
+	rotatedSecret.Data["previousKeys"] = otherGeneratedSymmetricKey
+
 	once := sync.Once{}
 
 	tests := []struct {
-		name               string
-		storedSecret       func(**corev1.Secret)
-		generateKey        func() ([]byte, error)
-		apiClient          func(*testing.T, *kubernetesfake.Clientset)
-		wantError          string
-		wantActions        []kubetesting.Action
-		wantCallbackSecret []byte
+		name                        string
+		storedSecret                func(**corev1.Secret)
+		generateKey                 func() ([]byte, error)
+		apiClient                   func(*testing.T, *kubernetesfake.Clientset)
+		rotationInterval            time.Duration
+		wantError                   string
+		wantActions                 []kubetesting.Action
+		wantCallbackSecret          []byte
+		wantCallbackPreviousSecrets [][]byte
+		wantRequeueAfter            time.Duration
 	}{
 		{
 			name: "when the secrets does not exist, it gets generated",
@@ -405,6 +437,51 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			},
 			wantError: "failed to generate secret: some generate error",
 		},
+		{
+			name: "when the secret does not exist and keys are rotated, it gets generated with its rotation time",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = nil
+			},
+			rotationInterval: rotationInterval,
+			wantActions: []kubetesting.Action{
+				kubetesting.NewCreateAction(secretsGVR, generatedSecretNamespace, withKeyRotatedAt(generatedSecret, now)),
+			},
+			wantCallbackSecret: generatedSymmetricKey,
+			wantRequeueAfter:   rotationInterval,
+		},
+		{
+			name: "when the key of a valid secret is not due to be rotated, the rotation is scheduled",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = withKeyRotatedAt(*secret, now.Add(-10*24*time.Hour))
+				(*secret).Data["previousKeys"] = otherGeneratedSymmetricKey
+			},
+			rotationInterval:            rotationInterval,
+			wantCallbackSecret:          generatedSymmetricKey,
+			wantCallbackPreviousSecrets: [][]byte{otherGeneratedSymmetricKey},
+			wantRequeueAfter:            20 * 24 * time.Hour,
+		},
+		{
+			name: "when the key of a valid secret is due to be rotated, a new key is generated and the old key is kept",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = withKeyRotatedAt(*secret, now.Add(-31*24*time.Hour))
+				(*secret).Data["key"] = otherGeneratedSymmetricKey
+			},
+			rotationInterval: rotationInterval,
+			wantActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
+				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace, rotatedSecret),
+			},
+			wantCallbackSecret:          generatedSymmetricKey,
+			wantCallbackPreviousSecrets: [][]byte{otherGeneratedSymmetricKey},
+			wantRequeueAfter:            rotationInterval,
+		},
+		{
+			name: "when the key of a valid secret is old but keys are not rotated, nothing happens",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = withKeyRotatedAt(*secret, now.Add(-365*24*time.Hour))
+			},
+			wantCallbackSecret: generatedSymmetricKey,
+		},
 	}
 	for _, test := range tests {
 		test := test
@@ -441,15 +518,21 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			secrets := informers.Core().V1().Secrets()
 
 			var callbackSecret []byte
+			var callbackPreviousSecrets [][]byte
 			c := NewSupervisorSecretsController(
 				owner,
+				"-key",
+				SupervisorCSRFSigningKeySecretType,
 				labels,
 				apiClient,
 				secrets,
-				func(secret []byte) {
+				func(secret []byte, previousSecrets [][]byte) {
 					require.Nil(t, callbackSecret, "callback was called twice")
 					callbackSecret = secret
+					callbackPreviousSecrets = previousSecrets
 				},
+				test.rotationInterval,
+				clocktesting.NewFakeClock(now),
 				testutil.NewObservableWithInformerOption().WithInformer,
 				testutil.NewObservableWithInitialEventOption().WithInitialEvent,
 			)
@@ -458,12 +541,14 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			informers.Start(ctx.Done())
 			controllerlib.TestRunSynchronously(t, c)
 
+			queue := &testQueue{t: t}
 			err := controllerlib.TestSync(t, c, controllerlib.Context{
 				Context: ctx,
 				Key: controllerlib.Key{
 					Namespace: generatedSecretNamespace,
 					Name:      generatedSecretName,
 				},
+				Queue: queue,
 			})
 			if test.wantError != "" {
 				require.EqualError(t, err, test.wantError)
@@ -477,6 +562,9 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			require.Equal(t, test.wantActions, apiClient.Actions())
 
 			require.Equal(t, test.wantCallbackSecret, callbackSecret)
+			require.Equal(t, test.wantCallbackPreviousSecrets, callbackPreviousSecrets)
+			require.Equal(t, test.wantRequeueAfter != 0, queue.called)
+			require.Equal(t, test.wantRequeueAfter, queue.duration)
 		})
 	}
 }
@@ -0,0 +1,438 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package githubupstreamwatcher implements a controller which watches GitHubIdentityProviders.
+package githubupstreamwatcher
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/oauth2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/cache"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
+	idpinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/idp/v1alpha1"
+	"go.pinniped.dev/internal/constable"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controller/conditionsutil"
+	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamwatchers"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/net/phttp"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/upstreamgithub"
+)
+
+const (
+	// Setup for the name of our controller in logs.
+	githubControllerName = "github-upstream-observer"
+
+	// Constants related to the client credentials Secret.
+	githubClientSecretType corev1.SecretType = "secrets.pinniped.dev/github-client"
+
+	clientIDDataKey     = "clientID"
+	clientSecretDataKey = "clientSecret"
+
+	// Successful connection probes are remembered for this long, to avoid probing GitHub on every sync.
+	connectionProbeCacheTTL = 15 * time.Minute
+
+	// Constants related to conditions.
+	typeClientCredentialsValid   = "ClientCredentialsValid"
+	typeHostValid                = "HostValid"
+	typeTLSConfigurationValid    = "TLSConfigurationValid"
+	typeOrganizationsPolicyValid = "OrganizationsPolicyValid"
+	typeGitHubConnectionValid    = "GitHubConnectionValid"
+
+	reasonInvalid            = "Invalid"
+	reasonUnableToDialServer = "UnableToDialServer"
+	reasonUnableToValidate   = "UnableToValidate"
+
+	// Errors that are generated by our reconcile process.
+	errGitHubFailureStatus = constable.Error("GitHubIdentityProvider has a failing condition")
+)
+
+// UpstreamGitHubIdentityProviderICache is a thread safe cache that holds a list of validated upstream GitHub IDP configurations.
+type UpstreamGitHubIdentityProviderICache interface {
+	SetGitHubIdentityProviders([]provider.UpstreamGitHubIdentityProviderI)
+}
+
+type gitHubWatcherController struct {
+	cache                          UpstreamGitHubIdentityProviderICache
+	log                            logr.Logger
+	client                         pinnipedclientset.Interface
+	gitHubIdentityProviderInformer idpinformers.GitHubIdentityProviderInformer
+	secretInformer                 corev1informers.SecretInformer
+	probeCache                     *cache.Expiring
+}
+
+// New instantiates a new controllerlib.Controller which will populate the provided UpstreamGitHubIdentityProviderICache.
+func New(
+	idpCache UpstreamGitHubIdentityProviderICache,
+	client pinnipedclientset.Interface,
+	gitHubIdentityProviderInformer idpinformers.GitHubIdentityProviderInformer,
+	secretInformer corev1informers.SecretInformer,
+	log logr.Logger,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+) controllerlib.Controller {
+	c := gitHubWatcherController{
+		cache:                          idpCache,
+		log:                            log.WithName(githubControllerName),
+		client:                         client,
+		gitHubIdentityProviderInformer: gitHubIdentityProviderInformer,
+		secretInformer:                 secretInformer,
+		probeCache:                     cache.NewExpiring(),
+	}
+	return controllerlib.New(
+		controllerlib.Config{Name: githubControllerName, Syncer: &c},
+		withInformer(
+			gitHubIdentityProviderInformer,
+			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			secretInformer,
+			pinnipedcontroller.MatchAnySecretOfTypeFilter(githubClientSecretType, pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
+	)
+}
+
+// Sync implements controllerlib.Syncer.
+func (c *gitHubWatcherController) Sync(ctx controllerlib.Context) error {
+	actualUpstreams, err := c.gitHubIdentityProviderInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list GitHubIdentityProviders: %w", err)
+	}
+
+	requeue := false
+	validatedUpstreams := make([]provider.UpstreamGitHubIdentityProviderI, 0, len(actualUpstreams))
+	for _, upstream := range actualUpstreams {
+		valid := c.validateUpstream(ctx.Context, upstream)
+		if valid == nil {
+			requeue = true
+		} else {
+			validatedUpstreams = append(validatedUpstreams, provider.UpstreamGitHubIdentityProviderI(valid))
+		}
+	}
+	c.cache.SetGitHubIdentityProviders(validatedUpstreams)
+	if requeue {
+		return controllerlib.ErrSyntheticRequeue
+	}
+	return nil
+}
+
+// validateUpstream validates the provided v1alpha1.GitHubIdentityProvider and returns the validated configuration as a
+// provider.UpstreamGitHubIdentityProviderI. As a side effect, it also updates the status of the v1alpha1.GitHubIdentityProvider.
+func (c *gitHubWatcherController) validateUpstream(ctx context.Context, upstream *v1alpha1.GitHubIdentityProvider) *upstreamgithub.ProviderConfig {
+	result := upstreamgithub.ProviderConfig{
+		Name:                 upstream.Name,
+		ResourceUID:          upstream.UID,
+		UsernameAttribute:    upstream.Spec.Claims.Username,
+		GroupNameAttribute:   upstream.Spec.Claims.Groups,
+		AllowedOrganizations: upstream.Spec.AllowAuthentication.Organizations.Allowed,
+		Config: &oauth2.Config{
+			// read:user is needed to read the user's profile, and read:org is needed to read org and team memberships.
+			Scopes: []string{"read:user", "read:org"},
+		},
+	}
+
+	hostCondition := validateHost(upstream, &result)
+	tlsCondition, rootCAs := validateTLS(upstream)
+	conditions := []*v1alpha1.Condition{
+		c.validateSecret(upstream, &result),
+		hostCondition,
+		tlsCondition,
+		validateOrganizationsPolicy(upstream),
+		c.validateConnection(ctx, upstream, &result, hostCondition, tlsCondition, rootCAs),
+	}
+
+	c.updateStatus(ctx, upstream, conditions)
+
+	valid := true
+	log := c.log.WithValues("namespace", upstream.Namespace, "name", upstream.Name)
+	for _, condition := range conditions {
+		if condition.Status == v1alpha1.ConditionFalse {
+			valid = false
+			log.WithValues(
+				"type", condition.Type,
+				"reason", condition.Reason,
+				"message", condition.Message,
+			).Error(errGitHubFailureStatus, "found failing condition")
+		}
+	}
+	if valid {
+		return &result
+	}
+	return nil
+}
+
+// validateSecret validates the .spec.client.secretName field and returns the appropriate ClientCredentialsValid condition.
+func (c *gitHubWatcherController) validateSecret(upstream *v1alpha1.GitHubIdentityProvider, result *upstreamgithub.ProviderConfig) *v1alpha1.Condition {
+	secretName := upstream.Spec.Client.SecretName
+
+	// Fetch the Secret from informer cache.
+	secret, err := c.secretInformer.Lister().Secrets(upstream.Namespace).Get(secretName)
+	if err != nil {
+		return &v1alpha1.Condition{
+			Type:    typeClientCredentialsValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  upstreamwatchers.ReasonNotFound,
+			Message: err.Error(),
+		}
+	}
+
+	// Validate the secret .type field.
+	if secret.Type != githubClientSecretType {
+		return &v1alpha1.Condition{
+			Type:    typeClientCredentialsValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  upstreamwatchers.ReasonWrongType,
+			Message: fmt.Sprintf("referenced Secret %q has wrong type %q (should be %q)", secretName, secret.Type, githubClientSecretType),
+		}
+	}
+
+	// Validate the secret .data field.
+	clientID := secret.Data[clientIDDataKey]
+	clientSecret := secret.Data[clientSecretDataKey]
+	if len(clientID) == 0 || len(clientSecret) == 0 {
+		return &v1alpha1.Condition{
+			Type:    typeClientCredentialsValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  upstreamwatchers.ReasonMissingKeys,
+			Message: fmt.Sprintf("referenced Secret %q is missing required keys %q", secretName, []string{clientIDDataKey, clientSecretDataKey}),
+		}
+	}
+
+	// If everything is valid, update the result and set the condition to true.
+	result.Config.ClientID = string(clientID)
+	result.Config.ClientSecret = string(clientSecret)
+	return &v1alpha1.Condition{
+		Type:    typeClientCredentialsValid,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  upstreamwatchers.ReasonSuccess,
+		Message: "loaded client credentials",
+	}
+}
+
+// validateHost validates the .spec.githubAPI.host field and returns the appropriate HostValid condition.
+func validateHost(upstream *v1alpha1.GitHubIdentityProvider, result *upstreamgithub.ProviderConfig) *v1alpha1.Condition {
+	host := upstream.Spec.GitHubAPI.Host
+	if host == "" {
+		host = "github.com"
+	}
+
+	invalid := func(reason string) *v1alpha1.Condition {
+		return &v1alpha1.Condition{
+			Type:    typeHostValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonInvalid,
+			Message: fmt.Sprintf("spec.githubAPI.host (%q) is not valid: %s", host, reason),
+		}
+	}
+
+	// Parsing the host as the authority section of a URL catches schemes, paths, queries, fragments, and userinfo.
+	parsed, err := url.Parse("https://" + host)
+	if err != nil {
+		return invalid(err.Error())
+	}
+	if parsed.Host != host || parsed.User != nil || parsed.Path != "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return invalid("must only contain a hostname or IP address and an optional port")
+	}
+	if parsed.Hostname() == "" {
+		return invalid("missing hostname")
+	}
+	if port := parsed.Port(); port != "" {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return invalid(fmt.Sprintf("invalid port %q", port))
+		}
+	}
+
+	apiBaseURL, err := upstreamgithub.APIBaseURL(host)
+	if err != nil {
+		return invalid(err.Error())
+	}
+	result.APIBaseURL = apiBaseURL
+	result.Config.Endpoint = upstreamgithub.Endpoint(host)
+	return &v1alpha1.Condition{
+		Type:    typeHostValid,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  upstreamwatchers.ReasonSuccess,
+		Message: fmt.Sprintf("spec.githubAPI.host (%q) is valid", host),
+	}
+}
+
+// validateTLS validates the .spec.githubAPI.tls field and returns the appropriate TLSConfigurationValid condition.
+func validateTLS(upstream *v1alpha1.GitHubIdentityProvider) (*v1alpha1.Condition, *x509.CertPool) {
+	tlsSpec := upstream.Spec.GitHubAPI.TLS
+	if tlsSpec == nil || tlsSpec.CertificateAuthorityData == "" {
+		return &v1alpha1.Condition{
+			Type:    typeTLSConfigurationValid,
+			Status:  v1alpha1.ConditionTrue,
+			Reason:  upstreamwatchers.ReasonSuccess,
+			Message: "spec.githubAPI.tls is valid: no TLS configuration provided",
+		}, nil
+	}
+
+	invalid := func(err error) (*v1alpha1.Condition, *x509.CertPool) {
+		return &v1alpha1.Condition{
+			Type:    typeTLSConfigurationValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  upstreamwatchers.ReasonInvalidTLSConfig,
+			Message: fmt.Sprintf("spec.githubAPI.tls.certificateAuthorityData is not valid: %s", err.Error()),
+		}, nil
+	}
+
+	bundle, err := base64.StdEncoding.DecodeString(tlsSpec.CertificateAuthorityData)
+	if err != nil {
+		return invalid(err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(bundle) {
+		return invalid(upstreamwatchers.ErrNoCertificates)
+	}
+
+	return &v1alpha1.Condition{
+		Type:    typeTLSConfigurationValid,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  upstreamwatchers.ReasonSuccess,
+		Message: "spec.githubAPI.tls is valid: loaded TLS configuration",
+	}, rootCAs
+}
+
+// validateOrganizationsPolicy validates the .spec.allowAuthentication.organizations field and returns the
+// appropriate OrganizationsPolicyValid condition.
+func validateOrganizationsPolicy(upstream *v1alpha1.GitHubIdentityProvider) *v1alpha1.Condition {
+	organizations := upstream.Spec.AllowAuthentication.Organizations
+	policy := organizations.Policy
+	if policy == "" {
+		policy = v1alpha1.GitHubAllowedAuthOrganizationsPolicyOnlyUsersFromAllowedOrganizations
+	}
+
+	switch {
+	case policy == v1alpha1.GitHubAllowedAuthOrganizationsPolicyAllGitHubUsers && len(organizations.Allowed) > 0:
+		return &v1alpha1.Condition{
+			Type:    typeOrganizationsPolicyValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonInvalid,
+			Message: "spec.allowAuthentication.organizations.policy must be 'OnlyUsersFromAllowedOrganizations' when spec.allowAuthentication.organizations.allowed has organizations listed",
+		}
+	case policy == v1alpha1.GitHubAllowedAuthOrganizationsPolicyOnlyUsersFromAllowedOrganizations && len(organizations.Allowed) == 0:
+		return &v1alpha1.Condition{
+			Type:    typeOrganizationsPolicyValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonInvalid,
+			Message: "spec.allowAuthentication.organizations.policy must be 'AllGitHubUsers' when spec.allowAuthentication.organizations.allowed is empty",
+		}
+	default:
+		return &v1alpha1.Condition{
+			Type:    typeOrganizationsPolicyValid,
+			Status:  v1alpha1.ConditionTrue,
+			Reason:  upstreamwatchers.ReasonSuccess,
+			Message: fmt.Sprintf("spec.allowAuthentication.organizations.policy (%q) is valid", policy),
+		}
+	}
+}
+
+// validateConnection makes a request to the GitHub API to check that it is reachable using the configured TLS settings,
+// and returns the appropriate GitHubConnectionValid condition.
+func (c *gitHubWatcherController) validateConnection(
+	ctx context.Context,
+	upstream *v1alpha1.GitHubIdentityProvider,
+	result *upstreamgithub.ProviderConfig,
+	hostCondition, tlsCondition *v1alpha1.Condition,
+	rootCAs *x509.CertPool,
+) *v1alpha1.Condition {
+	if hostCondition.Status != v1alpha1.ConditionTrue || tlsCondition.Status != v1alpha1.ConditionTrue {
+		return &v1alpha1.Condition{
+			Type:    typeGitHubConnectionValid,
+			Status:  v1alpha1.ConditionUnknown,
+			Reason:  reasonUnableToValidate,
+			Message: "unable to validate; see other conditions for details",
+		}
+	}
+
+	httpClient := phttp.Default(rootCAs)
+	httpClient.Timeout = time.Minute
+	result.Client = httpClient
+
+	apiURL := result.APIBaseURL.String()
+	cacheKey := struct{ apiURL, caBundle string }{apiURL: apiURL}
+	if upstream.Spec.GitHubAPI.TLS != nil {
+		cacheKey.caBundle = upstream.Spec.GitHubAPI.TLS.CertificateAuthorityData
+	}
+
+	if _, ok := c.probeCache.Get(cacheKey); !ok {
+		if err := probe(ctx, httpClient, apiURL); err != nil {
+			return &v1alpha1.Condition{
+				Type:    typeGitHubConnectionValid,
+				Status:  v1alpha1.ConditionFalse,
+				Reason:  reasonUnableToDialServer,
+				Message: fmt.Sprintf("cannot make connection probe request for %q: %s", apiURL, err.Error()),
+			}
+		}
+		c.probeCache.Set(cacheKey, true, connectionProbeCacheTTL)
+	}
+
+	return &v1alpha1.Condition{
+		Type:    typeGitHubConnectionValid,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  upstreamwatchers.ReasonSuccess,
+		Message: fmt.Sprintf("probed connection to %q successfully", apiURL),
+	}
+}
+
+func probe(ctx context.Context, httpClient *http.Client, apiURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	// Any response proves that the server is reachable and that its certificate is trusted.
+	// Only server errors indicate that the server is not currently able to serve requests.
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected response status: %s", strings.TrimSpace(resp.Status))
+	}
+	return nil
+}
+
+func (c *gitHubWatcherController) updateStatus(ctx context.Context, upstream *v1alpha1.GitHubIdentityProvider, conditions []*v1alpha1.Condition) {
+	log := c.log.WithValues("namespace", upstream.Namespace, "name", upstream.Name)
+	updated := upstream.DeepCopy()
+
+	hadErrorCondition := conditionsutil.Merge(conditions, upstream.Generation, &updated.Status.Conditions, log)
+
+	updated.Status.Phase = v1alpha1.GitHubPhaseReady
+	if hadErrorCondition {
+		updated.Status.Phase = v1alpha1.GitHubPhaseError
+	}
+
+	if equality.Semantic.DeepEqual(upstream, updated) {
+		return
+	}
+
+	_, err := c.client.
+		IDPV1alpha1().
+		GitHubIdentityProviders(upstream.Namespace).
+		UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		log.Error(err, "failed to update status")
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package githubupstreamwatcher
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/certauthority"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/testlogger"
+	"go.pinniped.dev/internal/upstreamgithub"
+)
+
+func TestGitHubUpstreamWatcherControllerFilterSecret(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		secret     metav1.Object
+		wantAdd    bool
+		wantUpdate bool
+		wantDelete bool
+	}{
+		{
+			name: "a secret of the right type",
+			secret: &corev1.Secret{
+				Type:       "secrets.pinniped.dev/github-client",
+				ObjectMeta: metav1.ObjectMeta{Name: "some-name", Namespace: "some-namespace"},
+			},
+			wantAdd:    true,
+			wantUpdate: true,
+			wantDelete: true,
+		},
+		{
+			name: "a secret of the wrong type",
+			secret: &corev1.Secret{
+				Type:       "secrets.pinniped.dev/oidc-client",
+				ObjectMeta: metav1.ObjectMeta{Name: "some-name", Namespace: "some-namespace"},
+			},
+		},
+		{
+			name: "resource of wrong data type",
+			secret: &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-name", Namespace: "some-namespace"},
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			fakePinnipedClient := pinnipedfake.NewSimpleClientset()
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(fakePinnipedClient, 0)
+			fakeKubeClient := fake.NewSimpleClientset()
+			kubeInformers := informers.NewSharedInformerFactory(fakeKubeClient, 0)
+			testLog := testlogger.New(t)
+			cache := provider.NewDynamicUpstreamIDPProvider()
+			secretInformer := kubeInformers.Core().V1().Secrets()
+			withInformer := testutil.NewObservableWithInformerOption()
+
+			New(
+				cache,
+				nil,
+				pinnipedInformers.IDP().V1alpha1().GitHubIdentityProviders(),
+				secretInformer,
+				testLog.Logger,
+				withInformer.WithInformer,
+			)
+
+			unrelated := corev1.Secret{}
+			filter := withInformer.GetFilterForInformer(secretInformer)
+			require.Equal(t, test.wantAdd, filter.Add(test.secret))
+			require.Equal(t, test.wantUpdate, filter.Update(&unrelated, test.secret))
+			require.Equal(t, test.wantUpdate, filter.Update(test.secret, &unrelated))
+			require.Equal(t, test.wantDelete, filter.Delete(test.secret))
+		})
+	}
+}
+
+func TestGitHubUpstreamWatcherControllerSync(t *testing.T) {
+	t.Parallel()
+	now := metav1.NewTime(time.Now().UTC())
+
+	// A fake GitHub Enterprise Server, which only needs to answer the connection probe.
+	probed := 0
+	caBundle, serverURL := testutil.TLSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v3", r.URL.Path)
+		probed++
+		_, _ = w.Write([]byte(`{}`))
+	})
+	parsedServerURL, err := url.Parse(serverURL)
+	require.NoError(t, err)
+	serverHost := parsedServerURL.Host
+	caBundleBase64 := base64.StdEncoding.EncodeToString([]byte(caBundle))
+
+	wrongCA, err := certauthority.New("foo", time.Hour)
+	require.NoError(t, err)
+	wrongCABase64 := base64.StdEncoding.EncodeToString(wrongCA.Bundle())
+
+	const (
+		testNamespace  = "test-namespace"
+		testName       = "test-name"
+		testSecretName = "test-client-secret"
+	)
+
+	validSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testSecretName},
+		Type:       "secrets.pinniped.dev/github-client",
+		Data: map[string][]byte{
+			"clientID":     []byte("test-client-id"),
+			"clientSecret": []byte("test-client-secret"),
+		},
+	}
+
+	validUpstream := &v1alpha1.GitHubIdentityProvider{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, UID: "test-uid", Generation: 1234},
+		Spec: v1alpha1.GitHubIdentityProviderSpec{
+			GitHubAPI: v1alpha1.GitHubAPIConfig{
+				Host: serverHost,
+				TLS:  &v1alpha1.TLSSpec{CertificateAuthorityData: caBundleBase64},
+			},
+			Claims: v1alpha1.GitHubClaims{
+				Username: v1alpha1.GitHubUsernameLogin,
+				Groups:   v1alpha1.GitHubUseTeamNameForGroupName,
+			},
+			AllowAuthentication: v1alpha1.GitHubAllowAuthenticationSpec{
+				Organizations: v1alpha1.GitHubOrganizationsSpec{
+					Policy:  v1alpha1.GitHubAllowedAuthOrganizationsPolicyOnlyUsersFromAllowedOrganizations,
+					Allowed: []string{"org1", "org2"},
+				},
+			},
+			Client: v1alpha1.GitHubClientSpec{SecretName: testSecretName},
+		},
+	}
+
+	condition := func(typ string, status v1alpha1.ConditionStatus, reason, message string) v1alpha1.Condition {
+		return v1alpha1.Condition{
+			Type:               typ,
+			Status:             status,
+			ObservedGeneration: 1234,
+			LastTransitionTime: now,
+			Reason:             reason,
+			Message:            message,
+		}
+	}
+	happyClientCredentials := condition("ClientCredentialsValid", "True", "Success", "loaded client credentials")
+	happyConnection := condition("GitHubConnectionValid", "True", "Success", `probed connection to "https://`+serverHost+`/api/v3" successfully`)
+	happyHost := condition("HostValid", "True", "Success", `spec.githubAPI.host ("`+serverHost+`") is valid`)
+	happyOrganizationsPolicy := condition("OrganizationsPolicyValid", "True", "Success", `spec.allowAuthentication.organizations.policy ("OnlyUsersFromAllowedOrganizations") is valid`)
+	happyTLS := condition("TLSConfigurationValid", "True", "Success", "spec.githubAPI.tls is valid: loaded TLS configuration")
+	unknownConnection := condition("GitHubConnectionValid", "Unknown", "UnableToValidate", "unable to validate; see other conditions for details")
+
+	tests := []struct {
+		name                 string
+		inputUpstream        *v1alpha1.GitHubIdentityProvider
+		inputSecrets         []runtime.Object
+		wantErr              string
+		wantResultingCache   []*upstreamgithub.ProviderConfig
+		wantPhase            v1alpha1.GitHubIdentityProviderPhase
+		wantStatusConditions []v1alpha1.Condition
+	}{
+		{
+			name:          "valid upstream",
+			inputUpstream: validUpstream,
+			inputSecrets:  []runtime.Object{validSecret},
+			wantResultingCache: []*upstreamgithub.ProviderConfig{{
+				Name:                 testName,
+				ResourceUID:          "test-uid",
+				UsernameAttribute:    v1alpha1.GitHubUsernameLogin,
+				GroupNameAttribute:   v1alpha1.GitHubUseTeamNameForGroupName,
+				AllowedOrganizations: []string{"org1", "org2"},
+			}},
+			wantPhase:            "Ready",
+			wantStatusConditions: []v1alpha1.Condition{happyClientCredentials, happyConnection, happyHost, happyOrganizationsPolicy, happyTLS},
+		},
+		{
+			name: "missing secret and invalid organizations policy",
+			inputUpstream: func() *v1alpha1.GitHubIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.AllowAuthentication.Organizations.Policy = v1alpha1.GitHubAllowedAuthOrganizationsPolicyAllGitHubUsers
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("ClientCredentialsValid", "False", "SecretNotFound", `secret "test-client-secret" not found`),
+				happyConnection,
+				happyHost,
+				condition("OrganizationsPolicyValid", "False", "Invalid", "spec.allowAuthentication.organizations.policy must be 'OnlyUsersFromAllowedOrganizations' when spec.allowAuthentication.organizations.allowed has organizations listed"),
+				happyTLS,
+			},
+		},
+		{
+			name: "empty allowed organizations requires the AllGitHubUsers policy",
+			inputUpstream: func() *v1alpha1.GitHubIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.AllowAuthentication.Organizations.Allowed = nil
+				return u
+			}(),
+			inputSecrets: []runtime.Object{validSecret},
+			wantErr:      controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase:    "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				happyClientCredentials,
+				happyConnection,
+				happyHost,
+				condition("OrganizationsPolicyValid", "False", "Invalid", "spec.allowAuthentication.organizations.policy must be 'AllGitHubUsers' when spec.allowAuthentication.organizations.allowed is empty"),
+				happyTLS,
+			},
+		},
+		{
+			name: "invalid host",
+			inputUpstream: func() *v1alpha1.GitHubIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.GitHubAPI.Host = "https://example.com/path"
+				return u
+			}(),
+			inputSecrets: []runtime.Object{validSecret},
+			wantErr:      controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase:    "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				happyClientCredentials,
+				unknownConnection,
+				condition("HostValid", "False", "Invalid", `spec.githubAPI.host ("https://example.com/path") is not valid: must only contain a hostname or IP address and an optional port`),
+				happyOrganizationsPolicy,
+				happyTLS,
+			},
+		},
+		{
+			name: "invalid CA bundle",
+			inputUpstream: func() *v1alpha1.GitHubIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.GitHubAPI.TLS.CertificateAuthorityData = base64.StdEncoding.EncodeToString([]byte("not a cert"))
+				return u
+			}(),
+			inputSecrets: []runtime.Object{validSecret},
+			wantErr:      controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase:    "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				happyClientCredentials,
+				unknownConnection,
+				happyHost,
+				happyOrganizationsPolicy,
+				condition("TLSConfigurationValid", "False", "InvalidTLSConfig", "spec.githubAPI.tls.certificateAuthorityData is not valid: no certificates found"),
+			},
+		},
+		{
+			name: "server is not trusted by the CA bundle",
+			inputUpstream: func() *v1alpha1.GitHubIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.GitHubAPI.TLS.CertificateAuthorityData = wrongCABase64
+				return u
+			}(),
+			inputSecrets: []runtime.Object{validSecret},
+			wantErr:      controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase:    "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				happyClientCredentials,
+				condition("GitHubConnectionValid", "False", "UnableToDialServer", `cannot make connection probe request for "https://`+serverHost+`/api/v3": Get "https://`+serverHost+`/api/v3": tls: failed to verify certificate: x509: certificate signed by unknown authority`),
+				happyHost,
+				happyOrganizationsPolicy,
+				happyTLS,
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinnipedClient := pinnipedfake.NewSimpleClientset(tt.inputUpstream)
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(fakePinnipedClient, 0)
+			fakeKubeClient := fake.NewSimpleClientset(tt.inputSecrets...)
+			kubeInformers := informers.NewSharedInformerFactory(fakeKubeClient, 0)
+			testLog := testlogger.New(t)
+			cache := provider.NewDynamicUpstreamIDPProvider()
+			cache.SetGitHubIdentityProviders([]provider.UpstreamGitHubIdentityProviderI{
+				&upstreamgithub.ProviderConfig{Name: "initial-entry"},
+			})
+
+			controller := New(
+				cache,
+				fakePinnipedClient,
+				pinnipedInformers.IDP().V1alpha1().GitHubIdentityProviders(),
+				kubeInformers.Core().V1().Secrets(),
+				testLog.Logger,
+				controllerlib.WithInformer,
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			pinnipedInformers.Start(ctx.Done())
+			kubeInformers.Start(ctx.Done())
+			controllerlib.TestRunSynchronously(t, controller)
+
+			syncCtx := controllerlib.Context{Context: ctx, Key: controllerlib.Key{}}
+
+			if err := controllerlib.TestSync(t, controller, syncCtx); tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			actualIDPList := cache.GetGitHubIdentityProviders()
+			require.Len(t, actualIDPList, len(tt.wantResultingCache))
+			for i := range actualIDPList {
+				actualIDP := actualIDPList[i].(*upstreamgithub.ProviderConfig)
+				want := tt.wantResultingCache[i]
+				require.Equal(t, want.Name, actualIDP.GetName())
+				require.Equal(t, want.ResourceUID, actualIDP.GetResourceUID())
+				require.Equal(t, want.UsernameAttribute, actualIDP.UsernameAttribute)
+				require.Equal(t, want.GroupNameAttribute, actualIDP.GroupNameAttribute)
+				require.Equal(t, want.AllowedOrganizations, actualIDP.AllowedOrganizations)
+				require.Equal(t, "test-client-id", actualIDP.GetClientID())
+				require.Equal(t, "test-client-secret", actualIDP.Config.ClientSecret)
+				require.Equal(t, []string{"read:user", "read:org"}, actualIDP.GetScopes())
+				require.Equal(t, "https://"+serverHost+"/login/oauth/authorize", actualIDP.GetAuthorizationURL().String())
+				require.Equal(t, "https://"+serverHost+"/login/oauth/access_token", actualIDP.Config.Endpoint.TokenURL)
+				require.Equal(t, "https://"+serverHost+"/api/v3", actualIDP.APIBaseURL.String())
+				require.Equal(t, time.Minute, actualIDP.Client.Timeout)
+			}
+
+			actualUpstream, err := fakePinnipedClient.IDPV1alpha1().GitHubIdentityProviders(testNamespace).Get(ctx, testName, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantPhase, actualUpstream.Status.Phase)
+			for i := range actualUpstream.Status.Conditions {
+				if time.Since(actualUpstream.Status.Conditions[i].LastTransitionTime.Time) < 5*time.Second {
+					actualUpstream.Status.Conditions[i].LastTransitionTime = now
+				}
+			}
+			require.Equal(t, tt.wantStatusConditions, actualUpstream.Status.Conditions)
+		})
+	}
+
+	require.Greater(t, probed, 0)
+}
+
+func TestValidateHost(t *testing.T) {
+	tests := []struct {
+		host          string
+		wantValid     bool
+		wantAPIBase   string
+		wantAuthorize string
+	}{
+		{host: "", wantValid: true, wantAPIBase: "https://api.github.com", wantAuthorize: "https://github.com/login/oauth/authorize"},
+		{host: "github.com", wantValid: true, wantAPIBase: "https://api.github.com", wantAuthorize: "https://github.com/login/oauth/authorize"},
+		{host: "ghe.example.com:8443", wantValid: true, wantAPIBase: "https://ghe.example.com:8443/api/v3", wantAuthorize: "https://ghe.example.com:8443/login/oauth/authorize"},
+		{host: "[::1]:443", wantValid: true, wantAPIBase: "https://[::1]:443/api/v3", wantAuthorize: "https://[::1]:443/login/oauth/authorize"},
+		{host: "user@example.com"},
+		{host: "example.com/path"},
+		{host: "example.com?query"},
+		{host: "example.com:notaport"},
+		{host: ":443"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.host, func(t *testing.T) {
+			upstream := &v1alpha1.GitHubIdentityProvider{Spec: v1alpha1.GitHubIdentityProviderSpec{
+				GitHubAPI: v1alpha1.GitHubAPIConfig{Host: tt.host},
+			}}
+			result := &upstreamgithub.ProviderConfig{Config: &oauth2.Config{}}
+			cond := validateHost(upstream, result)
+			if !tt.wantValid {
+				require.Equal(t, v1alpha1.ConditionFalse, cond.Status, cond.Message)
+				require.True(t, strings.HasPrefix(cond.Message, "spec.githubAPI.host"))
+				return
+			}
+			require.Equal(t, v1alpha1.ConditionTrue, cond.Status, cond.Message)
+			require.Equal(t, tt.wantAPIBase, result.APIBaseURL.String())
+			require.Equal(t, tt.wantAuthorize, result.GetAuthorizationURL().String())
+		})
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamwatchers"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/internal/upstreamldap"
 )
 
@@ -119,6 +120,14 @@ func (g *ldapUpstreamGenericLDAPGroupSearch) GroupNameAttribute() string {
 	return g.groupSearch.Attributes.GroupName
 }
 
+func (g *ldapUpstreamGenericLDAPGroupSearch) NestedGroupSearch() upstreamldap.NestedGroupSearchMode {
+	if g.groupSearch.NestedGroups {
+		// Generic LDAP servers do not have a standard way to search nested groups, so search recursively.
+		return upstreamldap.NestedGroupSearchRecursive
+	}
+	return upstreamldap.NestedGroupSearchDisabled
+}
+
 type ldapUpstreamGenericLDAPStatus struct {
 	ldapIdentityProvider v1alpha1.LDAPIdentityProvider
 }
@@ -136,6 +145,7 @@ type ldapWatcherController struct {
 	cache                        UpstreamLDAPIdentityProviderICache
 	validatedSettingsCache       upstreamwatchers.ValidatedSettingsCacheI
 	ldapDialer                   upstreamldap.LDAPDialer
+	connectionPool               *upstreamldap.ConnectionPool
 	client                       pinnipedclientset.Interface
 	ldapIdentityProviderInformer idpinformers.LDAPIdentityProviderInformer
 	secretInformer               corev1informers.SecretInformer
@@ -155,6 +165,8 @@ func New(
 		upstreamwatchers.NewValidatedSettingsCache(),
 		// nil means to use a real production dialer when creating objects to add to the cache
 		nil,
+		// start with an empty pool, which is shared by all the providers created by this controller
+		upstreamldap.NewConnectionPool(),
 		client,
 		ldapIdentityProviderInformer,
 		secretInformer,
@@ -167,6 +179,7 @@ func newInternal(
 	idpCache UpstreamLDAPIdentityProviderICache,
 	validatedSettingsCache upstreamwatchers.ValidatedSettingsCacheI,
 	ldapDialer upstreamldap.LDAPDialer,
+	connectionPool *upstreamldap.ConnectionPool,
 	client pinnipedclientset.Interface,
 	ldapIdentityProviderInformer idpinformers.LDAPIdentityProviderInformer,
 	secretInformer corev1informers.SecretInformer,
@@ -176,6 +189,7 @@ func newInternal(
 		cache:                        idpCache,
 		validatedSettingsCache:       validatedSettingsCache,
 		ldapDialer:                   ldapDialer,
+		connectionPool:               connectionPool,
 		client:                       client,
 		ldapIdentityProviderInformer: ldapIdentityProviderInformer,
 		secretInformer:               secretInformer,
@@ -189,7 +203,7 @@ func newInternal(
 		),
 		withInformer(
 			secretInformer,
-			pinnipedcontroller.MatchAnySecretOfTypeFilter(upstreamwatchers.LDAPBindAccountSecretType, pinnipedcontroller.SingletonQueue()),
+			pinnipedcontroller.MatchAnySecretOfTypesFilter(upstreamwatchers.LDAPBindAccountSecretTypes, pinnipedcontroller.SingletonQueue()),
 			controllerlib.InformerOption{},
 		),
 	)
@@ -225,10 +239,13 @@ func (c *ldapWatcherController) Sync(ctx controllerlib.Context) error {
 func (c *ldapWatcherController) validateUpstream(ctx context.Context, upstream *v1alpha1.LDAPIdentityProvider) (p provider.UpstreamLDAPIdentityProviderI, requeue bool) {
 	spec := upstream.Spec
 
+	ldapUpstreamImpl := &ldapUpstreamGenericLDAPImpl{*upstream}
+
 	config := &upstreamldap.ProviderConfig{
-		Name:        upstream.Name,
-		ResourceUID: upstream.UID,
-		Host:        spec.Host,
+		Name:          upstream.Name,
+		ResourceUID:   upstream.UID,
+		Host:          spec.Host,
+		FailoverHosts: spec.FailoverHosts,
 		UserSearch: upstreamldap.UserSearchConfig{
 			Base:              spec.UserSearch.Base,
 			Filter:            spec.UserSearch.Filter,
@@ -239,11 +256,14 @@ func (c *ldapWatcherController) validateUpstream(ctx context.Context, upstream *
 			Base:               spec.GroupSearch.Base,
 			Filter:             spec.GroupSearch.Filter,
 			GroupNameAttribute: spec.GroupSearch.Attributes.GroupName,
+			NestedGroupSearch:  ldapUpstreamImpl.Spec().GroupSearch().NestedGroupSearch(),
 		},
-		Dialer: c.ldapDialer,
+		Dialer:         c.ldapDialer,
+		ConnectionPool: c.connectionPool,
+		TOTPMode:       totp.Mode(spec.TOTP.Mode),
 	}
 
-	conditions := upstreamwatchers.ValidateGenericLDAP(ctx, &ldapUpstreamGenericLDAPImpl{*upstream}, c.secretInformer, c.validatedSettingsCache, config)
+	conditions := upstreamwatchers.ValidateGenericLDAP(ctx, ldapUpstreamImpl, c.secretInformer, c.validatedSettingsCache, config)
 
 	c.updateStatus(ctx, upstream, conditions.Conditions())
 
@@ -0,0 +1,386 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package samlupstreamwatcher implements a controller which watches SAMLIdentityProviders.
+package samlupstreamwatcher
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/cache"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
+	idpinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/idp/v1alpha1"
+	"go.pinniped.dev/internal/constable"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controller/conditionsutil"
+	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamwatchers"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/net/phttp"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/upstreamsaml"
+)
+
+const (
+	// Setup for the name of our controller in logs.
+	samlControllerName = "saml-upstream-observer"
+
+	// Metadata fetched from a URL is remembered for this long before it is fetched again, so that changes
+	// to the identity provider's configuration (e.g. rotation of its signing certificates) are noticed.
+	metadataCacheTTL = 15 * time.Minute
+
+	// maxMetadataSize protects against an unexpectedly large metadata document.
+	maxMetadataSize = 10 * 1024 * 1024
+
+	// Constants related to conditions.
+	typeTLSConfigurationValid = "TLSConfigurationValid"
+	typeMetadataValid         = "MetadataValid"
+
+	reasonInvalid               = "Invalid"
+	reasonUnableToFetchMetadata = "UnableToFetchMetadata"
+
+	// Errors that are generated by our reconcile process.
+	errSAMLFailureStatus = constable.Error("SAMLIdentityProvider has a failing condition")
+)
+
+// UpstreamSAMLIdentityProviderICache is a thread safe cache that holds a list of validated upstream SAML IDP configurations.
+type UpstreamSAMLIdentityProviderICache interface {
+	SetSAMLIdentityProviders([]provider.UpstreamSAMLIdentityProviderI)
+}
+
+type samlWatcherController struct {
+	cache                        UpstreamSAMLIdentityProviderICache
+	log                          logr.Logger
+	client                       pinnipedclientset.Interface
+	samlIdentityProviderInformer idpinformers.SAMLIdentityProviderInformer
+	metadataCache                *cache.Expiring
+}
+
+// New instantiates a new controllerlib.Controller which will populate the provided UpstreamSAMLIdentityProviderICache.
+func New(
+	idpCache UpstreamSAMLIdentityProviderICache,
+	client pinnipedclientset.Interface,
+	samlIdentityProviderInformer idpinformers.SAMLIdentityProviderInformer,
+	log logr.Logger,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+) controllerlib.Controller {
+	c := samlWatcherController{
+		cache:                        idpCache,
+		log:                          log.WithName(samlControllerName),
+		client:                       client,
+		samlIdentityProviderInformer: samlIdentityProviderInformer,
+		metadataCache:                cache.NewExpiring(),
+	}
+	return controllerlib.New(
+		controllerlib.Config{Name: samlControllerName, Syncer: &c},
+		withInformer(
+			samlIdentityProviderInformer,
+			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
+	)
+}
+
+// Sync implements controllerlib.Syncer.
+func (c *samlWatcherController) Sync(ctx controllerlib.Context) error {
+	actualUpstreams, err := c.samlIdentityProviderInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list SAMLIdentityProviders: %w", err)
+	}
+
+	requeue := false
+	validatedUpstreams := make([]provider.UpstreamSAMLIdentityProviderI, 0, len(actualUpstreams))
+	for _, upstream := range actualUpstreams {
+		valid := c.validateUpstream(ctx.Context, upstream)
+		if valid == nil {
+			requeue = true
+		} else {
+			validatedUpstreams = append(validatedUpstreams, provider.UpstreamSAMLIdentityProviderI(valid))
+		}
+	}
+	c.cache.SetSAMLIdentityProviders(validatedUpstreams)
+	if requeue {
+		return controllerlib.ErrSyntheticRequeue
+	}
+	return nil
+}
+
+// validateUpstream validates the provided v1alpha1.SAMLIdentityProvider and returns the validated configuration as a
+// provider.UpstreamSAMLIdentityProviderI. As a side effect, it also updates the status of the v1alpha1.SAMLIdentityProvider.
+func (c *samlWatcherController) validateUpstream(ctx context.Context, upstream *v1alpha1.SAMLIdentityProvider) *upstreamsaml.ProviderConfig {
+	result := upstreamsaml.ProviderConfig{
+		Name:              upstream.Name,
+		ResourceUID:       upstream.UID,
+		UsernameAttribute: upstream.Spec.Claims.Username,
+		GroupsAttribute:   upstream.Spec.Claims.Groups,
+	}
+
+	tlsCondition, rootCAs := validateTLS(upstream)
+	conditions := []*v1alpha1.Condition{
+		tlsCondition,
+		c.validateMetadata(ctx, upstream, &result, tlsCondition, rootCAs),
+	}
+
+	c.updateStatus(ctx, upstream, conditions)
+
+	valid := true
+	log := c.log.WithValues("namespace", upstream.Namespace, "name", upstream.Name)
+	for _, condition := range conditions {
+		if condition.Status == v1alpha1.ConditionFalse {
+			valid = false
+			log.WithValues(
+				"type", condition.Type,
+				"reason", condition.Reason,
+				"message", condition.Message,
+			).Error(errSAMLFailureStatus, "found failing condition")
+		}
+	}
+	if valid {
+		return &result
+	}
+	return nil
+}
+
+// validateTLS validates the .spec.metadata.tls field and returns the appropriate TLSConfigurationValid condition.
+func validateTLS(upstream *v1alpha1.SAMLIdentityProvider) (*v1alpha1.Condition, *x509.CertPool) {
+	tlsSpec := upstream.Spec.Metadata.TLS
+	if tlsSpec == nil || tlsSpec.CertificateAuthorityData == "" {
+		return &v1alpha1.Condition{
+			Type:    typeTLSConfigurationValid,
+			Status:  v1alpha1.ConditionTrue,
+			Reason:  upstreamwatchers.ReasonSuccess,
+			Message: "spec.metadata.tls is valid: no TLS configuration provided",
+		}, nil
+	}
+
+	invalid := func(err error) (*v1alpha1.Condition, *x509.CertPool) {
+		return &v1alpha1.Condition{
+			Type:    typeTLSConfigurationValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  upstreamwatchers.ReasonInvalidTLSConfig,
+			Message: fmt.Sprintf("spec.metadata.tls.certificateAuthorityData is not valid: %s", err.Error()),
+		}, nil
+	}
+
+	bundle, err := base64.StdEncoding.DecodeString(tlsSpec.CertificateAuthorityData)
+	if err != nil {
+		return invalid(err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(bundle) {
+		return invalid(upstreamwatchers.ErrNoCertificates)
+	}
+
+	return &v1alpha1.Condition{
+		Type:    typeTLSConfigurationValid,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  upstreamwatchers.ReasonSuccess,
+		Message: "spec.metadata.tls is valid: loaded TLS configuration",
+	}, rootCAs
+}
+
+// validateMetadata loads the identity provider's metadata from the .spec.metadata field, either inline or by
+// fetching it from a URL, and returns the appropriate MetadataValid condition.
+func (c *samlWatcherController) validateMetadata(
+	ctx context.Context,
+	upstream *v1alpha1.SAMLIdentityProvider,
+	result *upstreamsaml.ProviderConfig,
+	tlsCondition *v1alpha1.Condition,
+	rootCAs *x509.CertPool,
+) *v1alpha1.Condition {
+	metadataSpec := upstream.Spec.Metadata
+
+	invalid := func(reason string, message string) *v1alpha1.Condition {
+		return &v1alpha1.Condition{
+			Type:    typeMetadataValid,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reason,
+			Message: message,
+		}
+	}
+
+	var rawMetadata []byte
+	var source string
+	switch {
+	case metadataSpec.URL != "" && metadataSpec.XML != "":
+		return invalid(reasonInvalid, "exactly one of spec.metadata.url or spec.metadata.xml must be specified, but both were specified")
+	case metadataSpec.XML != "":
+		rawMetadata = []byte(metadataSpec.XML)
+		source = "spec.metadata.xml"
+	case metadataSpec.URL != "":
+		source = fmt.Sprintf("spec.metadata.url (%q)", metadataSpec.URL)
+		if tlsCondition.Status != v1alpha1.ConditionTrue {
+			return &v1alpha1.Condition{
+				Type:    typeMetadataValid,
+				Status:  v1alpha1.ConditionUnknown,
+				Reason:  reasonUnableToFetchMetadata,
+				Message: "unable to fetch metadata; see other conditions for details",
+			}
+		}
+		cacheKey := struct{ url, caBundle string }{url: metadataSpec.URL}
+		if metadataSpec.TLS != nil {
+			cacheKey.caBundle = metadataSpec.TLS.CertificateAuthorityData
+		}
+		if cached, ok := c.metadataCache.Get(cacheKey); ok {
+			rawMetadata = cached.([]byte)
+		} else {
+			var err error
+			rawMetadata, err = fetchMetadata(ctx, rootCAs, metadataSpec.URL)
+			if err != nil {
+				return invalid(reasonUnableToFetchMetadata, fmt.Sprintf("failed to fetch metadata from %s: %s", source, err.Error()))
+			}
+			c.metadataCache.Set(cacheKey, rawMetadata, metadataCacheTTL)
+		}
+	default:
+		return invalid(reasonInvalid, "exactly one of spec.metadata.url or spec.metadata.xml must be specified, but neither was specified")
+	}
+
+	metadata, err := parseMetadata(rawMetadata)
+	if err != nil {
+		return invalid(reasonInvalid, fmt.Sprintf("metadata from %s is not valid: %s", source, err.Error()))
+	}
+
+	result.Metadata = metadata
+	return &v1alpha1.Condition{
+		Type:    typeMetadataValid,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  upstreamwatchers.ReasonSuccess,
+		Message: fmt.Sprintf("loaded metadata for entity %q from %s", metadata.EntityID, source),
+	}
+}
+
+func fetchMetadata(ctx context.Context, rootCAs *x509.CertPool, metadataURL string) ([]byte, error) {
+	httpClient := phttp.Default(rootCAs)
+	httpClient.Timeout = time.Minute
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", strings.TrimSpace(resp.Status))
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMetadataSize))
+}
+
+// parseMetadata parses a metadata document which contains either a single EntityDescriptor, or an EntitiesDescriptor
+// which contains exactly one EntityDescriptor of an identity provider.
+func parseMetadata(rawMetadata []byte) (*saml.EntityDescriptor, error) {
+	var entity saml.EntityDescriptor
+	if err := xml.Unmarshal(rawMetadata, &entity); err != nil {
+		var entities saml.EntitiesDescriptor
+		if xml.Unmarshal(rawMetadata, &entities) != nil {
+			return nil, fmt.Errorf("could not parse as an EntityDescriptor or an EntitiesDescriptor: %w", err)
+		}
+		var idpEntities []saml.EntityDescriptor
+		for _, e := range entities.EntityDescriptors {
+			if len(e.IDPSSODescriptors) > 0 {
+				idpEntities = append(idpEntities, e)
+			}
+		}
+		if len(idpEntities) != 1 {
+			return nil, fmt.Errorf("EntitiesDescriptor must contain exactly one identity provider, but found %d", len(idpEntities))
+		}
+		entity = idpEntities[0]
+	}
+
+	if entity.EntityID == "" {
+		return nil, errors.New("entityID is missing")
+	}
+	if len(entity.IDPSSODescriptors) == 0 {
+		return nil, errors.New("no IDPSSODescriptor found")
+	}
+
+	hasRedirectBinding := false
+	for _, idpSSODescriptor := range entity.IDPSSODescriptors {
+		for _, singleSignOnService := range idpSSODescriptor.SingleSignOnServices {
+			if singleSignOnService.Binding == saml.HTTPRedirectBinding && singleSignOnService.Location != "" {
+				hasRedirectBinding = true
+			}
+		}
+	}
+	if !hasRedirectBinding {
+		return nil, errors.New("no SingleSignOnService with the HTTP-Redirect binding found")
+	}
+
+	if err := validateSigningCertificates(&entity); err != nil {
+		return nil, err
+	}
+
+	return &entity, nil
+}
+
+var whitespaceRegexp = regexp.MustCompile(`\s+`)
+
+// validateSigningCertificates checks that the metadata includes at least one certificate which can be used to
+// validate the signatures of responses, using the same rules that will be used when validating responses.
+func validateSigningCertificates(entity *saml.EntityDescriptor) error {
+	found := false
+	for _, idpSSODescriptor := range entity.IDPSSODescriptors {
+		for _, keyDescriptor := range idpSSODescriptor.KeyDescriptors {
+			if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" {
+				continue
+			}
+			for _, certificate := range keyDescriptor.KeyInfo.X509Data.X509Certificates {
+				certBytes, err := base64.StdEncoding.DecodeString(whitespaceRegexp.ReplaceAllString(certificate.Data, ""))
+				if err != nil {
+					return fmt.Errorf("could not decode signing certificate: %w", err)
+				}
+				if _, err := x509.ParseCertificate(certBytes); err != nil {
+					return fmt.Errorf("could not parse signing certificate: %w", err)
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return errors.New("no signing certificate found")
+	}
+	return nil
+}
+
+func (c *samlWatcherController) updateStatus(ctx context.Context, upstream *v1alpha1.SAMLIdentityProvider, conditions []*v1alpha1.Condition) {
+	log := c.log.WithValues("namespace", upstream.Namespace, "name", upstream.Name)
+	updated := upstream.DeepCopy()
+
+	hadErrorCondition := conditionsutil.Merge(conditions, upstream.Generation, &updated.Status.Conditions, log)
+
+	updated.Status.Phase = v1alpha1.SAMLPhaseReady
+	if hadErrorCondition {
+		updated.Status.Phase = v1alpha1.SAMLPhaseError
+	}
+
+	if equality.Semantic.DeepEqual(upstream, updated) {
+		return
+	}
+
+	_, err := c.client.
+		IDPV1alpha1().
+		SAMLIdentityProviders(upstream.Namespace).
+		UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		log.Error(err, "failed to update status")
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package samlupstreamwatcher
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/certauthority"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/samltestutil"
+	"go.pinniped.dev/internal/testutil/testlogger"
+	"go.pinniped.dev/internal/upstreamsaml"
+)
+
+func TestSAMLUpstreamWatcherControllerSync(t *testing.T) {
+	t.Parallel()
+	now := metav1.NewTime(time.Now().UTC())
+
+	idp := samltestutil.NewIdentityProvider(t, "https://supervisor.example.com", "https://supervisor.example.com/callback/saml")
+	metadataXML := samltestutil.MetadataXML(t, idp)
+
+	fetched := 0
+	caBundle, serverURL := testutil.TLSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata":
+			fetched++
+			_, _ = w.Write([]byte(metadataXML))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	caBundleBase64 := base64.StdEncoding.EncodeToString([]byte(caBundle))
+
+	wrongCA, err := certauthority.New("foo", time.Hour)
+	require.NoError(t, err)
+	wrongCABase64 := base64.StdEncoding.EncodeToString(wrongCA.Bundle())
+
+	const (
+		testNamespace = "test-namespace"
+		testName      = "test-name"
+	)
+
+	validUpstream := &v1alpha1.SAMLIdentityProvider{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, UID: "test-uid", Generation: 1234},
+		Spec: v1alpha1.SAMLIdentityProviderSpec{
+			Metadata: v1alpha1.SAMLMetadataSpec{XML: metadataXML},
+			Claims:   v1alpha1.SAMLClaims{Username: "email", Groups: "groups"},
+		},
+	}
+
+	condition := func(typ string, status v1alpha1.ConditionStatus, reason, message string) v1alpha1.Condition {
+		return v1alpha1.Condition{
+			Type:               typ,
+			Status:             status,
+			ObservedGeneration: 1234,
+			LastTransitionTime: now,
+			Reason:             reason,
+			Message:            message,
+		}
+	}
+	happyInlineMetadata := condition("MetadataValid", "True", "Success", `loaded metadata for entity "`+samltestutil.EntityID+`" from spec.metadata.xml`)
+	happyNoTLS := condition("TLSConfigurationValid", "True", "Success", "spec.metadata.tls is valid: no TLS configuration provided")
+	happyTLS := condition("TLSConfigurationValid", "True", "Success", "spec.metadata.tls is valid: loaded TLS configuration")
+
+	tests := []struct {
+		name                 string
+		inputUpstream        *v1alpha1.SAMLIdentityProvider
+		wantErr              string
+		wantResultingCache   bool
+		wantPhase            v1alpha1.SAMLIdentityProviderPhase
+		wantStatusConditions []v1alpha1.Condition
+	}{
+		{
+			name:                 "valid upstream with inline metadata",
+			inputUpstream:        validUpstream,
+			wantResultingCache:   true,
+			wantPhase:            "Ready",
+			wantStatusConditions: []v1alpha1.Condition{happyInlineMetadata, happyNoTLS},
+		},
+		{
+			name: "valid upstream with metadata URL",
+			inputUpstream: func() *v1alpha1.SAMLIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Metadata = v1alpha1.SAMLMetadataSpec{
+					URL: serverURL + "/metadata",
+					TLS: &v1alpha1.TLSSpec{CertificateAuthorityData: caBundleBase64},
+				}
+				return u
+			}(),
+			wantResultingCache: true,
+			wantPhase:          "Ready",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("MetadataValid", "True", "Success", `loaded metadata for entity "`+samltestutil.EntityID+`" from spec.metadata.url ("`+serverURL+`/metadata")`),
+				happyTLS,
+			},
+		},
+		{
+			name: "both url and xml",
+			inputUpstream: func() *v1alpha1.SAMLIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Metadata.URL = serverURL + "/metadata"
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("MetadataValid", "False", "Invalid", "exactly one of spec.metadata.url or spec.metadata.xml must be specified, but both were specified"),
+				happyNoTLS,
+			},
+		},
+		{
+			name: "neither url nor xml",
+			inputUpstream: func() *v1alpha1.SAMLIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Metadata.XML = ""
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("MetadataValid", "False", "Invalid", "exactly one of spec.metadata.url or spec.metadata.xml must be specified, but neither was specified"),
+				happyNoTLS,
+			},
+		},
+		{
+			name: "invalid xml",
+			inputUpstream: func() *v1alpha1.SAMLIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Metadata.XML = "not xml"
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("MetadataValid", "False", "Invalid", "metadata from spec.metadata.xml is not valid: could not parse as an EntityDescriptor or an EntitiesDescriptor: EOF"),
+				happyNoTLS,
+			},
+		},
+		{
+			name: "metadata of a service provider",
+			inputUpstream: func() *v1alpha1.SAMLIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Metadata.XML = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com"><SPSSODescriptor/></EntityDescriptor>`
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("MetadataValid", "False", "Invalid", "metadata from spec.metadata.xml is not valid: no IDPSSODescriptor found"),
+				happyNoTLS,
+			},
+		},
+		{
+			name: "metadata URL not found",
+			inputUpstream: func() *v1alpha1.SAMLIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Metadata = v1alpha1.SAMLMetadataSpec{
+					URL: serverURL + "/not-found",
+					TLS: &v1alpha1.TLSSpec{CertificateAuthorityData: caBundleBase64},
+				}
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("MetadataValid", "False", "UnableToFetchMetadata", `failed to fetch metadata from spec.metadata.url ("`+serverURL+`/not-found"): unexpected response status: 404 Not Found`),
+				happyTLS,
+			},
+		},
+		{
+			name: "invalid CA bundle",
+			inputUpstream: func() *v1alpha1.SAMLIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Metadata = v1alpha1.SAMLMetadataSpec{
+					URL: serverURL + "/metadata",
+					TLS: &v1alpha1.TLSSpec{CertificateAuthorityData: base64.StdEncoding.EncodeToString([]byte("not a cert"))},
+				}
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("MetadataValid", "Unknown", "UnableToFetchMetadata", "unable to fetch metadata; see other conditions for details"),
+				condition("TLSConfigurationValid", "False", "InvalidTLSConfig", "spec.metadata.tls.certificateAuthorityData is not valid: no certificates found"),
+			},
+		},
+		{
+			name: "server is not trusted by the CA bundle",
+			inputUpstream: func() *v1alpha1.SAMLIdentityProvider {
+				u := validUpstream.DeepCopy()
+				u.Spec.Metadata = v1alpha1.SAMLMetadataSpec{
+					URL: serverURL + "/metadata",
+					TLS: &v1alpha1.TLSSpec{CertificateAuthorityData: wrongCABase64},
+				}
+				return u
+			}(),
+			wantErr:   controllerlib.ErrSyntheticRequeue.Error(),
+			wantPhase: "Error",
+			wantStatusConditions: []v1alpha1.Condition{
+				condition("MetadataValid", "False", "UnableToFetchMetadata", `failed to fetch metadata from spec.metadata.url ("`+serverURL+`/metadata"): Get "`+serverURL+`/metadata": tls: failed to verify certificate: x509: certificate signed by unknown authority`),
+				happyTLS,
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinnipedClient := pinnipedfake.NewSimpleClientset(tt.inputUpstream)
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(fakePinnipedClient, 0)
+			testLog := testlogger.New(t)
+			cache := provider.NewDynamicUpstreamIDPProvider()
+			cache.SetSAMLIdentityProviders([]provider.UpstreamSAMLIdentityProviderI{
+				&upstreamsaml.ProviderConfig{Name: "initial-entry"},
+			})
+
+			controller := New(
+				cache,
+				fakePinnipedClient,
+				pinnipedInformers.IDP().V1alpha1().SAMLIdentityProviders(),
+				testLog.Logger,
+				controllerlib.WithInformer,
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			pinnipedInformers.Start(ctx.Done())
+			controllerlib.TestRunSynchronously(t, controller)
+
+			syncCtx := controllerlib.Context{Context: ctx, Key: controllerlib.Key{}}
+
+			if err := controllerlib.TestSync(t, controller, syncCtx); tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			actualIDPList := cache.GetSAMLIdentityProviders()
+			if tt.wantResultingCache {
+				require.Len(t, actualIDPList, 1)
+				actualIDP := actualIDPList[0].(*upstreamsaml.ProviderConfig)
+				require.Equal(t, testName, actualIDP.GetName())
+				require.Equal(t, "test-uid", string(actualIDP.GetResourceUID()))
+				require.Equal(t, "email", actualIDP.UsernameAttribute)
+				require.Equal(t, "groups", actualIDP.GroupsAttribute)
+				require.Equal(t, samltestutil.EntityID, actualIDP.Metadata.EntityID)
+			} else {
+				require.Empty(t, actualIDPList)
+			}
+
+			actualUpstream, err := fakePinnipedClient.IDPV1alpha1().SAMLIdentityProviders(testNamespace).Get(ctx, testName, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantPhase, actualUpstream.Status.Phase)
+			for i := range actualUpstream.Status.Conditions {
+				if time.Since(actualUpstream.Status.Conditions[i].LastTransitionTime.Time) < 5*time.Second {
+					actualUpstream.Status.Conditions[i].LastTransitionTime = now
+				}
+			}
+			require.Equal(t, tt.wantStatusConditions, actualUpstream.Status.Conditions)
+		})
+	}
+
+	require.Greater(t, fetched, 0)
+}
+
+func TestParseMetadata(t *testing.T) {
+	idp := samltestutil.NewIdentityProvider(t, "https://supervisor.example.com", "https://supervisor.example.com/callback/saml")
+	metadataXML := samltestutil.MetadataXML(t, idp)
+
+	tests := []struct {
+		name        string
+		rawMetadata string
+		wantErr     string
+	}{
+		{
+			name:        "EntityDescriptor",
+			rawMetadata: metadataXML,
+		},
+		{
+			name: "EntitiesDescriptor with one identity provider",
+			rawMetadata: `<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata">` +
+				`<EntityDescriptor entityID="https://sp.example.com"><SPSSODescriptor/></EntityDescriptor>` +
+				metadataXML +
+				`</EntitiesDescriptor>`,
+		},
+		{
+			name: "EntitiesDescriptor with two identity providers",
+			rawMetadata: `<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata">` +
+				metadataXML + metadataXML +
+				`</EntitiesDescriptor>`,
+			wantErr: "EntitiesDescriptor must contain exactly one identity provider, but found 2",
+		},
+		{
+			name:        "missing entityID",
+			rawMetadata: `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata"><IDPSSODescriptor/></EntityDescriptor>`,
+			wantErr:     "entityID is missing",
+		},
+		{
+			name: "no redirect binding",
+			rawMetadata: `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">` +
+				`<IDPSSODescriptor><SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso"/></IDPSSODescriptor>` +
+				`</EntityDescriptor>`,
+			wantErr: "no SingleSignOnService with the HTTP-Redirect binding found",
+		},
+		{
+			name: "no signing certificate",
+			rawMetadata: `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">` +
+				`<IDPSSODescriptor><SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/></IDPSSODescriptor>` +
+				`</EntityDescriptor>`,
+			wantErr: "no signing certificate found",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			metadata, err := parseMetadata([]byte(tt.rawMetadata))
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, metadata)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, samltestutil.EntityID, metadata.EntityID)
+		})
+	}
+}
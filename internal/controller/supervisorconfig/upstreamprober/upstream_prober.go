@@ -0,0 +1,264 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstreamprober implements a controller which periodically checks whether the upstream identity providers
+// of the Supervisor can be reached, and publishes the results on the upstream health endpoint.
+package upstreamprober
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	configinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/config/v1alpha1"
+	idpinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/idp/v1alpha1"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/upstreamhealth"
+)
+
+const (
+	// probeInterval is how often an upstream which could be reached is probed again.
+	probeInterval = 30 * time.Second
+
+	// initialBackoff is how long after the first failed probe of an upstream it is probed again. The wait doubles
+	// after each consecutive failure, up to maxBackoff.
+	initialBackoff = 10 * time.Second
+	maxBackoff     = 2 * time.Minute
+
+	// probeTimeout is how long a single probe may take before the upstream is considered unreachable.
+	probeTimeout = 30 * time.Second
+)
+
+// connectionTester is implemented by the upstream identity providers which can be probed.
+type connectionTester interface {
+	GetName() string
+	GetResourceUID() types.UID
+	TestConnection(ctx context.Context) error
+}
+
+type upstreamKey struct {
+	upstreamType upstreamhealth.UpstreamType
+	name         string
+	uid          types.UID
+}
+
+type upstreamState struct {
+	ready               bool
+	lastProbeTime       time.Time
+	consecutiveFailures int
+	nextProbeTime       time.Time
+}
+
+type upstreamProberController struct {
+	upstreamIDPs             provider.DynamicUpstreamIDPProvider
+	healthCache              *upstreamhealth.Cache
+	federationDomainInformer configinformers.FederationDomainInformer
+	clock                    clock.Clock
+
+	// states is only used by Sync, which is never called concurrently since the controller has a single worker.
+	states map[upstreamKey]*upstreamState
+}
+
+// New returns a controller which probes the upstream identity providers of every type which are loaded into
+// upstreamIDPs, and stores their reachability and the readiness of the FederationDomains in healthCache.
+// Upstreams which failed validation are never loaded, so they are reported by the status of their resources instead.
+func New(
+	upstreamIDPs provider.DynamicUpstreamIDPProvider,
+	healthCache *upstreamhealth.Cache,
+	federationDomainInformer configinformers.FederationDomainInformer,
+	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer,
+	ldapIdentityProviderInformer idpinformers.LDAPIdentityProviderInformer,
+	activeDirectoryIdentityProviderInformer idpinformers.ActiveDirectoryIdentityProviderInformer,
+	gitHubIdentityProviderInformer idpinformers.GitHubIdentityProviderInformer,
+	samlIdentityProviderInformer idpinformers.SAMLIdentityProviderInformer,
+	certificateIdentityProviderInformer idpinformers.CertificateIdentityProviderInformer,
+	clock clock.Clock,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+	initialEventFunc pinnipedcontroller.WithInitialEventOptionFunc,
+) controllerlib.Controller {
+	filter := pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue())
+	return controllerlib.New(
+		controllerlib.Config{
+			Name: "upstream-prober-controller",
+			Syncer: &upstreamProberController{
+				upstreamIDPs:             upstreamIDPs,
+				healthCache:              healthCache,
+				federationDomainInformer: federationDomainInformer,
+				clock:                    clock,
+				states:                   map[upstreamKey]*upstreamState{},
+			},
+		},
+		withInformer(federationDomainInformer, filter, controllerlib.InformerOption{}),
+		withInformer(oidcIdentityProviderInformer, filter, controllerlib.InformerOption{}),
+		withInformer(ldapIdentityProviderInformer, filter, controllerlib.InformerOption{}),
+		withInformer(activeDirectoryIdentityProviderInformer, filter, controllerlib.InformerOption{}),
+		withInformer(gitHubIdentityProviderInformer, filter, controllerlib.InformerOption{}),
+		withInformer(samlIdentityProviderInformer, filter, controllerlib.InformerOption{}),
+		withInformer(certificateIdentityProviderInformer, filter, controllerlib.InformerOption{}),
+		// Probe the upstreams once at startup, even if there are no resources.
+		initialEventFunc(controllerlib.Key{}),
+	)
+}
+
+// Sync implements controllerlib.Syncer.
+func (c *upstreamProberController) Sync(ctx controllerlib.Context) error {
+	upstreams := c.upstreams()
+
+	// Forget the state of the upstreams which were removed.
+	seen := make(map[upstreamKey]bool, len(upstreams))
+	for key := range upstreams {
+		seen[key] = true
+	}
+	for key := range c.states {
+		if !seen[key] {
+			delete(c.states, key)
+		}
+	}
+
+	c.probeDueUpstreams(ctx.Context, upstreams)
+
+	federationDomains, err := c.federationDomainInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	federationDomainValidity := make(map[string]bool, len(federationDomains))
+	for _, federationDomain := range federationDomains {
+		federationDomainValidity[federationDomain.Spec.Issuer] = federationDomain.Status.Status == configv1alpha1.SuccessFederationDomainStatusCondition
+	}
+
+	upstreamStatuses := make([]upstreamhealth.UpstreamStatus, 0, len(upstreams))
+	var nextProbeTime time.Time
+	for key := range upstreams {
+		state := c.states[key]
+		lastProbeTime := state.lastProbeTime
+		upstreamStatuses = append(upstreamStatuses, upstreamhealth.UpstreamStatus{
+			Name:                key.name,
+			Type:                key.upstreamType,
+			Ready:               state.ready,
+			LastProbeTime:       &lastProbeTime,
+			ConsecutiveFailures: state.consecutiveFailures,
+		})
+		if nextProbeTime.IsZero() || state.nextProbeTime.Before(nextProbeTime) {
+			nextProbeTime = state.nextProbeTime
+		}
+	}
+	sort.Slice(upstreamStatuses, func(i, j int) bool {
+		if upstreamStatuses[i].Type != upstreamStatuses[j].Type {
+			return upstreamStatuses[i].Type < upstreamStatuses[j].Type
+		}
+		return upstreamStatuses[i].Name < upstreamStatuses[j].Name
+	})
+	c.healthCache.Set(upstreamhealth.NewStatus(upstreamStatuses, federationDomainValidity))
+
+	if !nextProbeTime.IsZero() {
+		ctx.Queue.AddAfter(ctx.Key, nextProbeTime.Sub(c.clock.Now()))
+	}
+	return nil
+}
+
+// upstreams returns the upstreams which can be probed, by their keys.
+func (c *upstreamProberController) upstreams() map[upstreamKey]connectionTester {
+	upstreams := map[upstreamKey]connectionTester{}
+	add := func(upstreamType upstreamhealth.UpstreamType, upstream interface{}) {
+		tester, ok := upstream.(connectionTester)
+		if !ok {
+			return
+		}
+		upstreams[upstreamKey{upstreamType: upstreamType, name: tester.GetName(), uid: tester.GetResourceUID()}] = tester
+	}
+	for _, upstream := range c.upstreamIDPs.GetOIDCIdentityProviders() {
+		add(upstreamhealth.UpstreamTypeOIDC, upstream)
+	}
+	for _, upstream := range c.upstreamIDPs.GetLDAPIdentityProviders() {
+		add(upstreamhealth.UpstreamTypeLDAP, upstream)
+	}
+	for _, upstream := range c.upstreamIDPs.GetActiveDirectoryIdentityProviders() {
+		add(upstreamhealth.UpstreamTypeActiveDirectory, upstream)
+	}
+	for _, upstream := range c.upstreamIDPs.GetGitHubIdentityProviders() {
+		add(upstreamhealth.UpstreamTypeGitHub, upstream)
+	}
+	for _, upstream := range c.upstreamIDPs.GetSAMLIdentityProviders() {
+		add(upstreamhealth.UpstreamTypeSAML, upstream)
+	}
+	for _, upstream := range c.upstreamIDPs.GetCertificateIdentityProviders() {
+		add(upstreamhealth.UpstreamTypeCertificate, upstream)
+	}
+	return upstreams
+}
+
+// probeDueUpstreams probes the upstreams which were never probed or whose next probe is due, all at the same time,
+// and updates their states.
+func (c *upstreamProberController) probeDueUpstreams(ctx context.Context, upstreams map[upstreamKey]connectionTester) {
+	now := c.clock.Now()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	results := map[upstreamKey]error{}
+	for key, upstream := range upstreams {
+		if state, ok := c.states[key]; ok && now.Before(state.nextProbeTime) {
+			continue
+		}
+		wg.Add(1)
+		go func(key upstreamKey, upstream connectionTester) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			err := upstream.TestConnection(probeCtx)
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[key] = err
+		}(key, upstream)
+	}
+	wg.Wait()
+
+	now = c.clock.Now()
+	for key, err := range results {
+		state, ok := c.states[key]
+		if !ok {
+			state = &upstreamState{}
+			c.states[key] = state
+		}
+		wasReady := state.ready
+		state.lastProbeTime = now
+		if err == nil {
+			state.ready = true
+			state.consecutiveFailures = 0
+			state.nextProbeTime = now.Add(probeInterval)
+			if !wasReady {
+				plog.Info("upstream identity provider is reachable", "type", key.upstreamType, "name", key.name)
+			}
+			continue
+		}
+		state.ready = false
+		state.consecutiveFailures++
+		state.nextProbeTime = now.Add(backoff(state.consecutiveFailures))
+		if wasReady || !ok {
+			plog.WarningErr("upstream identity provider is not reachable", err,
+				"type", key.upstreamType, "name", key.name)
+		} else {
+			plog.DebugErr("upstream identity provider is still not reachable", err,
+				"type", key.upstreamType, "name", key.name, "consecutiveFailures", state.consecutiveFailures)
+		}
+	}
+}
+
+// backoff returns how long to wait before probing an upstream again after the given number of consecutive failures.
+func backoff(consecutiveFailures int) time.Duration {
+	d := initialBackoff
+	for i := 1; i < consecutiveFailures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,227 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamprober
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+	"go.pinniped.dev/internal/upstreamhealth"
+)
+
+type testLDAPUpstream struct {
+	*oidctestutil.TestUpstreamLDAPIdentityProvider
+	err   error
+	calls int
+}
+
+func (u *testLDAPUpstream) TestConnection(ctx context.Context) error {
+	u.calls++
+	return u.err
+}
+
+type testOIDCUpstream struct {
+	*oidctestutil.TestUpstreamOIDCIdentityProvider
+	err   error
+	calls int
+}
+
+func (u *testOIDCUpstream) TestConnection(ctx context.Context) error {
+	u.calls++
+	return u.err
+}
+
+type testGitHubUpstream struct {
+	*oidctestutil.TestUpstreamGitHubIdentityProvider
+	err   error
+	calls int
+}
+
+func (u *testGitHubUpstream) TestConnection(ctx context.Context) error {
+	u.calls++
+	return u.err
+}
+
+type testSAMLUpstream struct {
+	*oidctestutil.TestUpstreamSAMLIdentityProvider
+	err   error
+	calls int
+}
+
+func (u *testSAMLUpstream) TestConnection(ctx context.Context) error {
+	u.calls++
+	return u.err
+}
+
+type testCertificateUpstream struct {
+	*oidctestutil.TestUpstreamCertificateIdentityProvider
+	err   error
+	calls int
+}
+
+func (u *testCertificateUpstream) TestConnection(ctx context.Context) error {
+	u.calls++
+	return u.err
+}
+
+func TestUpstreamProber(t *testing.T) {
+	start := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	ldapUpstream := &testLDAPUpstream{TestUpstreamLDAPIdentityProvider: &oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "my-ldap", ResourceUID: "ldap-uid"}}
+	adUpstream := &testLDAPUpstream{TestUpstreamLDAPIdentityProvider: &oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "my-ad", ResourceUID: "ad-uid"}}
+	oidcUpstream := &testOIDCUpstream{TestUpstreamOIDCIdentityProvider: oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().WithName("my-oidc").WithResourceUID("oidc-uid").Build()}
+	gitHubUpstream := &testGitHubUpstream{TestUpstreamGitHubIdentityProvider: &oidctestutil.TestUpstreamGitHubIdentityProvider{Name: "my-github", ResourceUID: "github-uid"}}
+	samlUpstream := &testSAMLUpstream{TestUpstreamSAMLIdentityProvider: &oidctestutil.TestUpstreamSAMLIdentityProvider{Name: "my-saml", ResourceUID: "saml-uid"}}
+	certificateUpstream := &testCertificateUpstream{TestUpstreamCertificateIdentityProvider: &oidctestutil.TestUpstreamCertificateIdentityProvider{Name: "my-certificate", ResourceUID: "certificate-uid"}}
+	// Upstreams which cannot be probed are left out.
+	unprobedUpstream := &oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "unprobed", ResourceUID: "unprobed-uid"}
+
+	upstreamIDPs := provider.NewDynamicUpstreamIDPProvider()
+	upstreamIDPs.SetOIDCIdentityProviders([]provider.UpstreamOIDCIdentityProviderI{oidcUpstream})
+	upstreamIDPs.SetLDAPIdentityProviders([]provider.UpstreamLDAPIdentityProviderI{ldapUpstream, unprobedUpstream})
+	upstreamIDPs.SetActiveDirectoryIdentityProviders([]provider.UpstreamLDAPIdentityProviderI{adUpstream})
+	upstreamIDPs.SetGitHubIdentityProviders([]provider.UpstreamGitHubIdentityProviderI{gitHubUpstream})
+	upstreamIDPs.SetSAMLIdentityProviders([]provider.UpstreamSAMLIdentityProviderI{samlUpstream})
+	upstreamIDPs.SetCertificateIdentityProviders([]provider.UpstreamCertificateIdentityProviderI{certificateUpstream})
+
+	informers := pinnipedinformers.NewSharedInformerFactoryWithOptions(nil, 0)
+	federationDomainInformer := informers.Config().V1alpha1().FederationDomains()
+	require.NoError(t, federationDomainInformer.Informer().GetIndexer().Add(&configv1alpha1.FederationDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: "valid", Namespace: "some-namespace"},
+		Spec:       configv1alpha1.FederationDomainSpec{Issuer: "https://valid.example.com/issuer"},
+		Status:     configv1alpha1.FederationDomainStatus{Status: configv1alpha1.SuccessFederationDomainStatusCondition},
+	}))
+	require.NoError(t, federationDomainInformer.Informer().GetIndexer().Add(&configv1alpha1.FederationDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: "invalid", Namespace: "some-namespace"},
+		Spec:       configv1alpha1.FederationDomainSpec{Issuer: "https://invalid.example.com/issuer"},
+		Status:     configv1alpha1.FederationDomainStatus{Status: configv1alpha1.DuplicateFederationDomainStatusCondition},
+	}))
+
+	healthCache := upstreamhealth.NewCache()
+	fakeClock := clocktesting.NewFakeClock(start)
+	subject := New(
+		upstreamIDPs,
+		healthCache,
+		federationDomainInformer,
+		informers.IDP().V1alpha1().OIDCIdentityProviders(),
+		informers.IDP().V1alpha1().LDAPIdentityProviders(),
+		informers.IDP().V1alpha1().ActiveDirectoryIdentityProviders(),
+		informers.IDP().V1alpha1().GitHubIdentityProviders(),
+		informers.IDP().V1alpha1().SAMLIdentityProviders(),
+		informers.IDP().V1alpha1().CertificateIdentityProviders(),
+		fakeClock,
+		controllerlib.WithInformer,
+		controllerlib.WithInitialEvent,
+	)
+
+	sync := func(t *testing.T) *testQueue {
+		t.Helper()
+		queue := &testQueue{t: t}
+		require.NoError(t, controllerlib.TestSync(t, subject, controllerlib.Context{Context: context.Background(), Queue: queue}))
+		return queue
+	}
+	upstreamStatus := func(name string, upstreamType upstreamhealth.UpstreamType, ready bool, lastProbeTime time.Time, failures int) upstreamhealth.UpstreamStatus {
+		return upstreamhealth.UpstreamStatus{Name: name, Type: upstreamType, Ready: ready, LastProbeTime: &lastProbeTime, ConsecutiveFailures: failures}
+	}
+
+	// The first sync probes all of the upstreams.
+	adUpstream.err = errors.New("some dial error")
+	queue := sync(t)
+	require.Equal(t, 1, ldapUpstream.calls)
+	require.Equal(t, 1, adUpstream.calls)
+	require.Equal(t, 1, oidcUpstream.calls)
+	require.Equal(t, 1, gitHubUpstream.calls)
+	require.Equal(t, 1, samlUpstream.calls)
+	require.Equal(t, 1, certificateUpstream.calls)
+	require.Equal(t, 10*time.Second, queue.duration)
+	require.Equal(t, &upstreamhealth.Status{
+		Ready: false,
+		UpstreamIdentityProviders: []upstreamhealth.UpstreamStatus{
+			upstreamStatus("my-ad", upstreamhealth.UpstreamTypeActiveDirectory, false, start, 1),
+			upstreamStatus("my-certificate", upstreamhealth.UpstreamTypeCertificate, true, start, 0),
+			upstreamStatus("my-github", upstreamhealth.UpstreamTypeGitHub, true, start, 0),
+			upstreamStatus("my-ldap", upstreamhealth.UpstreamTypeLDAP, true, start, 0),
+			upstreamStatus("my-oidc", upstreamhealth.UpstreamTypeOIDC, true, start, 0),
+			upstreamStatus("my-saml", upstreamhealth.UpstreamTypeSAML, true, start, 0),
+		},
+		FederationDomains: []upstreamhealth.FederationDomainStatus{
+			{Issuer: "https://invalid.example.com/issuer", Reason: upstreamhealth.ReasonFederationDomainNotValid},
+			{Issuer: "https://valid.example.com/issuer", Reason: upstreamhealth.ReasonUpstreamIdentityProvidersNotReady},
+		},
+	}, healthCache.Get())
+
+	// Only the failing upstream is due after its backoff, and its backoff doubles while it keeps failing.
+	fakeClock.Step(10 * time.Second)
+	queue = sync(t)
+	require.Equal(t, 1, ldapUpstream.calls)
+	require.Equal(t, 2, adUpstream.calls)
+	require.Equal(t, 1, oidcUpstream.calls)
+	require.Equal(t, 20*time.Second, queue.duration)
+	require.Equal(t, 2, healthCache.Get().UpstreamIdentityProviders[0].ConsecutiveFailures)
+
+	// Once it recovers, the upstreams are ready.
+	adUpstream.err = nil
+	fakeClock.Step(20 * time.Second)
+	queue = sync(t)
+	require.Equal(t, 2, ldapUpstream.calls)
+	require.Equal(t, 3, adUpstream.calls)
+	require.Equal(t, 2, oidcUpstream.calls)
+	require.Equal(t, 30*time.Second, queue.duration)
+	require.Equal(t, upstreamStatus("my-ad", upstreamhealth.UpstreamTypeActiveDirectory, true, start.Add(30*time.Second), 0),
+		healthCache.Get().UpstreamIdentityProviders[0])
+	require.False(t, healthCache.Get().Ready)
+	require.Equal(t, upstreamhealth.FederationDomainStatus{Issuer: "https://valid.example.com/issuer", Ready: true},
+		healthCache.Get().FederationDomains[1])
+
+	// Removed upstreams are forgotten.
+	upstreamIDPs.SetActiveDirectoryIdentityProviders(nil)
+	upstreamIDPs.SetLDAPIdentityProviders(nil)
+	upstreamIDPs.SetOIDCIdentityProviders(nil)
+	upstreamIDPs.SetGitHubIdentityProviders(nil)
+	upstreamIDPs.SetSAMLIdentityProviders(nil)
+	upstreamIDPs.SetCertificateIdentityProviders(nil)
+	queue = sync(t)
+	require.False(t, queue.called)
+	require.Empty(t, healthCache.Get().UpstreamIdentityProviders)
+	require.Equal(t, upstreamhealth.ReasonNoUpstreamIdentityProviders, healthCache.Get().FederationDomains[1].Reason)
+}
+
+func TestBackoff(t *testing.T) {
+	require.Equal(t, 10*time.Second, backoff(1))
+	require.Equal(t, 20*time.Second, backoff(2))
+	require.Equal(t, 80*time.Second, backoff(4))
+	require.Equal(t, 2*time.Minute, backoff(5))
+	require.Equal(t, 2*time.Minute, backoff(100))
+}
+
+type testQueue struct {
+	t *testing.T
+
+	called   bool
+	key      controllerlib.Key
+	duration time.Duration
+
+	controllerlib.Queue // panic if any other methods called
+}
+
+func (q *testQueue) AddAfter(key controllerlib.Key, duration time.Duration) {
+	q.t.Helper()
+
+	require.False(q.t, q.called, "AddAfter should only be called once")
+
+	q.called = true
+	q.key = key
+	q.duration = duration
+}
@@ -5,9 +5,11 @@ package upstreamwatchers
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -29,8 +31,9 @@ const (
 
 	ErrNoCertificates = constable.Error("no certificates found")
 
-	LDAPBindAccountSecretType = corev1.SecretTypeBasicAuth
-	probeLDAPTimeout          = 90 * time.Second
+	LDAPBindAccountSecretType            = corev1.SecretTypeBasicAuth
+	LDAPBindAccountCertificateSecretType = corev1.SecretTypeTLS
+	probeLDAPTimeout                     = 90 * time.Second
 
 	// Constants related to conditions.
 	typeBindSecretValid              = "BindSecretValid"
@@ -38,12 +41,16 @@ const (
 	typeLDAPConnectionValid          = "LDAPConnectionValid"
 	TypeSearchBaseFound              = "SearchBaseFound"
 	reasonLDAPConnectionError        = "LDAPConnectionError"
+	reasonSomeHostsUnreachable       = "SomeHostsUnreachable"
 	noTLSConfigurationMessage        = "no TLS configuration provided"
 	loadedTLSConfigurationMessage    = "loaded TLS configuration"
 	ReasonUsingConfigurationFromSpec = "UsingConfigurationFromSpec"
 	ReasonErrorFetchingSearchBase    = "ErrorFetchingSearchBase"
 )
 
+// LDAPBindAccountSecretTypes are the types of Secrets which may be used to provide the bind account credentials.
+var LDAPBindAccountSecretTypes = []corev1.SecretType{LDAPBindAccountSecretType, LDAPBindAccountCertificateSecretType}
+
 // ValidatedSettings is the struct which is cached by the ValidatedSettingsCacheI interface.
 type ValidatedSettings struct {
 	IDPSpecGeneration         int64  // which IDP spec was used during the validation
@@ -127,6 +134,7 @@ type UpstreamGenericLDAPGroupSearch interface {
 	Base() string
 	Filter() string
 	GroupNameAttribute() string
+	NestedGroupSearch() upstreamldap.NestedGroupSearchMode
 }
 
 type UpstreamGenericLDAPStatus interface {
@@ -162,6 +170,79 @@ func TestConnection(
 	config *upstreamldap.ProviderConfig,
 	currentSecretVersion string,
 ) *v1alpha1.Condition {
+	if len(config.FailoverHosts) == 0 {
+		err := testConnectionToHost(ctx, config)
+		if err != nil {
+			return &v1alpha1.Condition{
+				Type:   typeLDAPConnectionValid,
+				Status: v1alpha1.ConditionFalse,
+				Reason: reasonLDAPConnectionError,
+				Message: fmt.Sprintf(`could not successfully connect to "%s" and bind as user "%s": %s`,
+					config.Host, config.BindUsername, err.Error()),
+			}
+		}
+		return &v1alpha1.Condition{
+			Type:   typeLDAPConnectionValid,
+			Status: v1alpha1.ConditionTrue,
+			Reason: ReasonSuccess,
+			Message: fmt.Sprintf(`successfully able to connect to "%s" and bind as user "%s" [validated with Secret "%s" at version "%s"]`,
+				config.Host, config.BindUsername, bindSecretName, currentSecretVersion),
+		}
+	}
+
+	// Test each host separately so that the reachability of each host can be reported.
+	var firstReachableHost string
+	unreachableHostCount := 0
+	connectionProtocol := upstreamldap.TLS
+	hostResults := make([]string, 0, 1+len(config.FailoverHosts))
+	for _, host := range append([]string{config.Host}, config.FailoverHosts...) {
+		hostConfig := *config
+		hostConfig.Host = host
+		hostConfig.FailoverHosts = nil
+		err := testConnectionToHost(ctx, &hostConfig)
+		if err != nil {
+			hostResults = append(hostResults, fmt.Sprintf(`host "%s" is unreachable: %s`, host, err.Error()))
+			unreachableHostCount++
+			continue
+		}
+		hostResults = append(hostResults, fmt.Sprintf(`host "%s" is reachable`, host))
+		if firstReachableHost == "" {
+			// All hosts are expected to use the same protocol, so use the protocol of the first reachable host.
+			firstReachableHost = host
+			connectionProtocol = hostConfig.ConnectionProtocol
+		}
+	}
+	config.ConnectionProtocol = connectionProtocol
+	hostsMessage := strings.Join(hostResults, "; ")
+
+	if firstReachableHost == "" {
+		return &v1alpha1.Condition{
+			Type:   typeLDAPConnectionValid,
+			Status: v1alpha1.ConditionFalse,
+			Reason: reasonLDAPConnectionError,
+			Message: fmt.Sprintf(`could not successfully connect to any host and bind as user "%s": %s`,
+				config.BindUsername, hostsMessage),
+		}
+	}
+
+	// The provider can still be used when some hosts are unreachable, so this is not an error, but use a
+	// different reason so that these results are not cached and the unreachable hosts will be tested again.
+	reason := ReasonSuccess
+	if unreachableHostCount > 0 {
+		reason = reasonSomeHostsUnreachable
+	}
+	return &v1alpha1.Condition{
+		Type:   typeLDAPConnectionValid,
+		Status: v1alpha1.ConditionTrue,
+		Reason: reason,
+		Message: fmt.Sprintf(`successfully able to connect to "%s" and bind as user "%s" [validated with Secret "%s" at version "%s"]: %s`,
+			firstReachableHost, config.BindUsername, bindSecretName, currentSecretVersion, hostsMessage),
+	}
+}
+
+// testConnectionToHost tests the connection to the config's Host and sets the config's ConnectionProtocol to the
+// protocol which worked, or to TLS when neither protocol worked.
+func testConnectionToHost(ctx context.Context, config *upstreamldap.ProviderConfig) error {
 	// First try using TLS.
 	config.ConnectionProtocol = upstreamldap.TLS
 	tlsLDAPProvider := upstreamldap.New(*config)
@@ -176,32 +257,14 @@ func TestConnection(
 			plog.Info("testing LDAP connection using StartTLS succeeded", "host", config.Host)
 			// Successfully able to fall back to using StartTLS, so clear the original
 			// error and consider the connection test to be successful.
-			err = nil
-		} else {
-			plog.InfoErr("testing LDAP connection using StartTLS also failed", err, "host", config.Host)
-			// Falling back to StartTLS also failed, so put TLS back into the config
-			// and consider the connection test to be failed.
-			config.ConnectionProtocol = upstreamldap.TLS
-		}
-	}
-
-	if err != nil {
-		return &v1alpha1.Condition{
-			Type:   typeLDAPConnectionValid,
-			Status: v1alpha1.ConditionFalse,
-			Reason: reasonLDAPConnectionError,
-			Message: fmt.Sprintf(`could not successfully connect to "%s" and bind as user "%s": %s`,
-				config.Host, config.BindUsername, err.Error()),
+			return nil
 		}
+		plog.InfoErr("testing LDAP connection using StartTLS also failed", err, "host", config.Host)
+		// Falling back to StartTLS also failed, so put TLS back into the config
+		// and consider the connection test to be failed.
+		config.ConnectionProtocol = upstreamldap.TLS
 	}
-
-	return &v1alpha1.Condition{
-		Type:   typeLDAPConnectionValid,
-		Status: v1alpha1.ConditionTrue,
-		Reason: ReasonSuccess,
-		Message: fmt.Sprintf(`successfully able to connect to "%s" and bind as user "%s" [validated with Secret "%s" at version "%s"]`,
-			config.Host, config.BindUsername, bindSecretName, currentSecretVersion),
-	}
+	return err
 }
 
 func validTLSCondition(message string) *v1alpha1.Condition {
@@ -233,25 +296,58 @@ func ValidateSecret(secretInformer corev1informers.SecretInformer, secretName st
 		}, ""
 	}
 
-	if secret.Type != corev1.SecretTypeBasicAuth {
+	switch secret.Type {
+	case LDAPBindAccountSecretType:
+		config.BindUsername = string(secret.Data[corev1.BasicAuthUsernameKey])
+		config.BindPassword = string(secret.Data[corev1.BasicAuthPasswordKey])
+		if len(config.BindUsername) == 0 || len(config.BindPassword) == 0 {
+			return &v1alpha1.Condition{
+				Type:   typeBindSecretValid,
+				Status: v1alpha1.ConditionFalse,
+				Reason: ReasonMissingKeys,
+				Message: fmt.Sprintf("referenced Secret %q is missing required keys %q",
+					secretName, []string{corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey}),
+			}, secret.ResourceVersion
+		}
+	case LDAPBindAccountCertificateSecretType:
+		config.BindCertificate = secret.Data[corev1.TLSCertKey]
+		config.BindPrivateKey = secret.Data[corev1.TLSPrivateKeyKey]
+		if len(config.BindCertificate) == 0 || len(config.BindPrivateKey) == 0 {
+			return &v1alpha1.Condition{
+				Type:   typeBindSecretValid,
+				Status: v1alpha1.ConditionFalse,
+				Reason: ReasonMissingKeys,
+				Message: fmt.Sprintf("referenced Secret %q is missing required keys %q",
+					secretName, []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey}),
+			}, secret.ResourceVersion
+		}
+		clientCert, err := tls.X509KeyPair(config.BindCertificate, config.BindPrivateKey)
+		if err != nil {
+			return &v1alpha1.Condition{
+				Type:    typeBindSecretValid,
+				Status:  v1alpha1.ConditionFalse,
+				Reason:  ReasonInvalidTLSConfig,
+				Message: fmt.Sprintf("referenced Secret %q has an invalid client certificate: %s", secretName, err.Error()),
+			}, secret.ResourceVersion
+		}
+		leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+		if err != nil {
+			return &v1alpha1.Condition{
+				Type:    typeBindSecretValid,
+				Status:  v1alpha1.ConditionFalse,
+				Reason:  ReasonInvalidTLSConfig,
+				Message: fmt.Sprintf("referenced Secret %q has an invalid client certificate: %s", secretName, err.Error()),
+			}, secret.ResourceVersion
+		}
+		// The server determines the bind account from the certificate, so use its subject to describe the bind account.
+		config.BindUsername = leaf.Subject.String()
+	default:
 		return &v1alpha1.Condition{
 			Type:   typeBindSecretValid,
 			Status: v1alpha1.ConditionFalse,
 			Reason: ReasonWrongType,
-			Message: fmt.Sprintf("referenced Secret %q has wrong type %q (should be %q)",
-				secretName, secret.Type, corev1.SecretTypeBasicAuth),
-		}, secret.ResourceVersion
-	}
-
-	config.BindUsername = string(secret.Data[corev1.BasicAuthUsernameKey])
-	config.BindPassword = string(secret.Data[corev1.BasicAuthPasswordKey])
-	if len(config.BindUsername) == 0 || len(config.BindPassword) == 0 {
-		return &v1alpha1.Condition{
-			Type:   typeBindSecretValid,
-			Status: v1alpha1.ConditionFalse,
-			Reason: ReasonMissingKeys,
-			Message: fmt.Sprintf("referenced Secret %q is missing required keys %q",
-				secretName, []string{corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey}),
+			Message: fmt.Sprintf("referenced Secret %q has wrong type %q (should be one of %q)",
+				secretName, secret.Type, LDAPBindAccountSecretTypes),
 		}, secret.ResourceVersion
 	}
 
@@ -343,7 +439,7 @@ func validateAndSetLDAPServerConnectivityAndSearchBase(
 		// When there were no failures, write the newly validated settings to the cache.
 		// It's okay for the search base condition to be nil, since it's only used by Active Directory providers,
 		// but if it exists make sure it was not a failure.
-		if ldapConnectionValidCondition.Status == v1alpha1.ConditionTrue &&
+		if ldapConnectionValidCondition.Status == v1alpha1.ConditionTrue && ldapConnectionValidCondition.Reason == ReasonSuccess &&
 			(searchBaseFoundCondition == nil || (searchBaseFoundCondition.Status == v1alpha1.ConditionTrue)) {
 			// Remember (in-memory for this pod) that the controller has successfully validated the LDAP or AD provider
 			// using this version of the Secret. This is for performance reasons, to avoid attempting to connect to
@@ -19,6 +19,7 @@ import (
 	clocktesting "k8s.io/utils/clock/testing"
 	"k8s.io/utils/strings/slices"
 
+	"go.pinniped.dev/internal/acmecert"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/crud"
@@ -27,6 +28,10 @@ import (
 	"go.pinniped.dev/internal/fositestorage/openidconnect"
 	"go.pinniped.dev/internal/fositestorage/pkce"
 	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/loginlimit"
+	"go.pinniped.dev/internal/oidc/consent"
+	"go.pinniped.dev/internal/oidc/par"
+	"go.pinniped.dev/internal/oidc/pendinglogin"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/psession"
@@ -210,13 +215,18 @@ func (c *garbageCollectorController) maybeRevokeUpstreamOIDCToken(ctx context.Co
 		return c.tryRevokeUpstreamOIDCToken(ctx, pinnipedSession.Custom, secret)
 
 	case refreshtoken.TypeLabelValue:
-		// For refresh token storage, always revoke its upstream token. This refresh token storage could be
-		// the result of the initial downstream authcode exchange, or it could be the result of a downstream
-		// refresh. Either way, it always contains the latest upstream token when it exists.
+		// For refresh token storage, revoke its upstream token unless the downstream refresh token was already
+		// used. This refresh token storage could be the result of the initial downstream authcode exchange, or
+		// it could be the result of a downstream refresh. Either way, an unused one always contains the latest
+		// upstream token when it exists. A used one is only kept to detect reuse of the downstream refresh token,
+		// and its upstream token was already replaced by the one in the unused refresh token storage.
 		refreshTokenSession, err := refreshtoken.ReadFromSecret(secret)
 		if err != nil {
 			return err
 		}
+		if refreshTokenSession.Used {
+			return nil
+		}
 		return c.tryRevokeUpstreamOIDCToken(ctx, refreshTokenSession.Request.Session.(*psession.PinnipedSession).Custom, secret)
 
 	case pkce.TypeLabelValue:
@@ -232,6 +242,32 @@ func (c *garbageCollectorController) maybeRevokeUpstreamOIDCToken(ctx context.Co
 		// be revoked by one of the other cases above.
 		return nil
 
+	case loginlimit.TypeLabelValue:
+		// Counts of failed login attempts are not downstream sessions, so they do not hold any upstream tokens.
+		return nil
+
+	case par.TypeLabelValue:
+		// Pushed authorization requests only hold the parameters of authorize requests, so they do not hold any
+		// upstream tokens either.
+		return nil
+
+	case pendinglogin.TypeLabelValue:
+		// Pending logins are deleted when the user finishes their login, so one which expired was abandoned, or the
+		// user did not consent to the client, and nothing else holds its upstream tokens.
+		pendingLogin, err := pendinglogin.ReadFromSecret(secret)
+		if err != nil {
+			return err
+		}
+		return c.tryRevokeUpstreamOIDCToken(ctx, pendingLogin.CustomSessionData, secret)
+
+	case consent.TypeLabelValue:
+		// Consents of users to clients do not hold any upstream tokens either.
+		return nil
+
+	case acmecert.TypeLabelValue:
+		// Responses to ACME challenges are not related to users at all.
+		return nil
+
 	default:
 		// There are no other storage types, so this should never happen in practice.
 		return errors.New("garbage collector saw invalid label on Secret when trying to determine if upstream revocation was needed")
@@ -34,12 +34,21 @@ func SimpleFilter(match func(metav1.Object) bool, parentFunc controllerlib.Paren
 }
 
 func MatchAnySecretOfTypeFilter(secretType v1.SecretType, parentFunc controllerlib.ParentFunc) controllerlib.Filter {
+	return MatchAnySecretOfTypesFilter([]v1.SecretType{secretType}, parentFunc)
+}
+
+func MatchAnySecretOfTypesFilter(secretTypes []v1.SecretType, parentFunc controllerlib.ParentFunc) controllerlib.Filter {
 	isSecretOfType := func(obj metav1.Object) bool {
 		secret, ok := obj.(*v1.Secret)
 		if !ok {
 			return false
 		}
-		return secret.Type == secretType
+		for _, secretType := range secretTypes {
+			if secret.Type == secretType {
+				return true
+			}
+		}
+		return false
 	}
 	return SimpleFilter(isSecretOfType, parentFunc)
 }
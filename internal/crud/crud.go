@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package crud
@@ -42,13 +42,16 @@ const (
 type Storage interface {
 	Create(ctx context.Context, signature string, data JSON, additionalLabels map[string]string) (resourceVersion string, err error)
 	Get(ctx context.Context, signature string, data JSON) (resourceVersion string, err error)
-	Update(ctx context.Context, signature, resourceVersion string, data JSON) (newResourceVersion string, err error)
+	Update(ctx context.Context, signature, resourceVersion string, data JSON, additionalLabels map[string]string) (newResourceVersion string, err error)
 	Delete(ctx context.Context, signature string) error
 	DeleteByLabel(ctx context.Context, labelName string, labelValue string) error
+	ListByLabel(ctx context.Context, labelName string, labelValue string) ([]corev1.Secret, error)
 }
 
 type JSON interface{} // document that we need valid JSON types
 
+// New returns a Storage which stores data of the given resource type in Secrets. The Secrets will be garbage collected
+// after the lifetime has passed, unless the lifetime is zero, in which case they are never garbage collected.
 func New(resource string, secrets corev1client.SecretInterface, clock func() time.Time, lifetime time.Duration) Storage {
 	return &secretsStorage{
 		resource:   resource,
@@ -92,12 +95,12 @@ func (s *secretsStorage) Get(ctx context.Context, signature string, data JSON) (
 	return secret.ResourceVersion, nil
 }
 
-func (s *secretsStorage) Update(ctx context.Context, signature, resourceVersion string, data JSON) (string, error) {
+func (s *secretsStorage) Update(ctx context.Context, signature, resourceVersion string, data JSON, additionalLabels map[string]string) (string, error) {
 	// Note: There may be a small bug here in that toSecret will move the SecretLifetimeAnnotationKey date forward
 	// instead of keeping the storage resource's original SecretLifetimeAnnotationKey value. However, we only use
-	// this Update method in one place, and it doesn't matter in that place. Be aware that it might need improvement
-	// if we start using this Update method in more places.
-	secret, err := s.toSecret(signature, resourceVersion, data, nil)
+	// this Update method in a few places, and it doesn't matter in those places. Be aware that it might need
+	// improvement if we start using this Update method in more places.
+	secret, err := s.toSecret(signature, resourceVersion, data, additionalLabels)
 	if err != nil {
 		return "", err
 	}
@@ -138,6 +141,20 @@ func (s *secretsStorage) DeleteByLabel(ctx context.Context, labelName string, la
 	return nil
 }
 
+// ListByLabel returns the Secrets of the resource which have the label. Use FromSecret to read their data.
+func (s *secretsStorage) ListByLabel(ctx context.Context, labelName string, labelValue string) ([]corev1.Secret, error) {
+	list, err := s.secrets.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{
+			SecretLabelKey: s.resource,
+			labelName:      labelValue,
+		}.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf(`failed to list secrets for resource "%s" matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+	}
+	return list.Items, nil
+}
+
 // FromSecret is similar to Get, but for when you already have a Secret in hand, e.g. from an informer.
 // It validates and unmarshals the Secret. The data parameter is filled in as the result.
 func FromSecret(resource string, secret *corev1.Secret, data JSON) error {
@@ -172,11 +189,17 @@ func validateSecret(resource string, secret *corev1.Secret) error {
 var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
 
 func (s *secretsStorage) getName(signature string) string {
+	return SecretName(s.resource, signature)
+}
+
+// SecretName returns the name of the Secret in which a Storage for the given resource type keeps the data of the
+// given signature, e.g. to find that Secret in an informer cache.
+func SecretName(resource string, signature string) string {
 	// try to decode base64 signatures to prevent double encoding of binary data
 	signatureBytes := maybeBase64Decode(signature)
 	// lower case base32 encoding insures that our secret name is valid per ValidateSecretName in k/k
 	signatureAsValidName := strings.ToLower(b32.EncodeToString(signatureBytes))
-	return fmt.Sprintf(secretNameFormat, s.resource, signatureAsValidName)
+	return fmt.Sprintf(secretNameFormat, resource, signatureAsValidName)
 }
 
 func (s *secretsStorage) toSecret(signature, resourceVersion string, data JSON, additionalLabels map[string]string) (*corev1.Secret, error) {
@@ -192,14 +215,19 @@ func (s *secretsStorage) toSecret(signature, resourceVersion string, data JSON,
 		labelsToAdd[labelName] = labelValue
 	}
 
+	var annotations map[string]string
+	if s.lifetime != 0 {
+		annotations = map[string]string{
+			SecretLifetimeAnnotationKey: s.clock().Add(s.lifetime).UTC().Format(SecretLifetimeAnnotationDateFormat),
+		}
+	}
+
 	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            s.getName(signature),
 			ResourceVersion: resourceVersion,
 			Labels:          labelsToAdd,
-			Annotations: map[string]string{
-				SecretLifetimeAnnotationKey: s.clock().Add(s.lifetime).UTC().Format(SecretLifetimeAnnotationDateFormat),
-			},
+			Annotations:     annotations,
 			OwnerReferences: nil,
 		},
 		Data: map[string][]byte{
@@ -442,7 +442,7 @@ func TestStorage(t *testing.T) {
 				require.Equal(t, data, out)
 
 				newData := &testJSON{Data: "shirts"}
-				rv2, err := storage.Update(ctx, signature, rv1, newData)
+				rv2, err := storage.Update(ctx, signature, rv1, newData, map[string]string{"additionalLabel": "matching-value"})
 				require.Equal(t, "45", rv2) // mock sets to a higher value on update
 				require.NoError(t, err)
 
@@ -462,6 +462,7 @@ func TestStorage(t *testing.T) {
 						ResourceVersion: "35", // update at initial RV
 						Labels: map[string]string{
 							"storage.pinniped.dev/type": "stores",
+							"additionalLabel":           "matching-value",
 						},
 						Annotations: map[string]string{
 							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
@@ -483,6 +484,7 @@ func TestStorage(t *testing.T) {
 						ResourceVersion: "45", // final list at new RV
 						Labels: map[string]string{
 							"storage.pinniped.dev/type": "stores",
+							"additionalLabel":           "matching-value",
 						},
 						Annotations: map[string]string{
 							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
@@ -728,6 +730,94 @@ func TestStorage(t *testing.T) {
 			},
 			wantErr: `failed to delete secrets for resource "seals" matching label "additionalLabel=matching-value" with name pinniped-storage-seals-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq: some delete error`,
 		},
+		{
+			name:     "list existing by label",
+			resource: "seals",
+			mocks: func(t *testing.T, mock mocker) {
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"happy-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-12345wdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",              // same type as above
+							"additionalLabel":           "non-matching-value", // different value for the same label
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"sad-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+			},
+			run: func(t *testing.T, storage Storage, fakeClock *clocktesting.FakeClock) error {
+				secrets, err := storage.ListByLabel(ctx, "additionalLabel", "matching-value")
+				require.NoError(t, err)
+				require.Len(t, secrets, 1)
+
+				out := &testJSON{}
+				require.NoError(t, FromSecret("seals", &secrets[0], out))
+				require.Equal(t, &testJSON{Data: "happy-seal"}, out)
+				return nil
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=seals,additionalLabel=matching-value",
+				}),
+			},
+			wantSecrets: []corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-12345wdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "non-matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"sad-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"happy-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+			},
+			wantErr: "",
+		},
 		{
 			name:     "when there is an error listing secrets during a delete by label operation",
 			resource: "seals",
@@ -1041,6 +1131,36 @@ func TestStorage(t *testing.T) {
 	}
 }
 
+func TestStorageWithoutLifetime(t *testing.T) {
+	ctx := context.Background()
+
+	type testJSON struct {
+		Data string
+	}
+
+	client := fake.NewSimpleClientset()
+	secrets := client.CoreV1().Secrets("test-ns")
+	fakeClock := clocktesting.NewFakeClock(time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC))
+	storage := New("forever", secrets, fakeClock.Now, 0)
+
+	rv, err := storage.Create(ctx, "some-signature", &testJSON{Data: "first"}, nil)
+	require.NoError(t, err)
+	_, err = storage.Update(ctx, "some-signature", rv, &testJSON{Data: "second"}, nil)
+	require.NoError(t, err)
+
+	var data testJSON
+	_, err = storage.Get(ctx, "some-signature", &data)
+	require.NoError(t, err)
+	require.Equal(t, "second", data.Data)
+
+	// Data with a zero lifetime is never garbage collected, so the Secret has no lifetime annotation.
+	actualSecrets, err := secrets.List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, actualSecrets.Items, 1)
+	require.Empty(t, actualSecrets.Items[0].Annotations)
+	require.Equal(t, map[string]string{"storage.pinniped.dev/type": "forever"}, actualSecrets.Items[0].Labels)
+}
+
 func checkSecretActionNames(t *testing.T, actions []coretesting.Action) {
 	t.Helper()
 
@@ -0,0 +1,144 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"go.pinniped.dev/internal/constable"
+)
+
+const (
+	ErrHandleNotFound      = constable.Error("handle is unknown, expired, or was already deleted")
+	ErrHandleDataMalformed = constable.Error("handle storage data is not valid")
+)
+
+// HandleStorage stores data which is referred to by random handles, such as pushed authorization requests. Only the
+// hash of a handle is used to name its Secret, so the handles cannot be learned by reading the Secrets. The data
+// expires after its lifetime, even when its Secret was not garbage collected yet.
+type HandleStorage struct {
+	resource string
+	version  string
+	storage  Storage
+	clock    func() time.Time
+	rand     io.Reader
+	lifetime time.Duration
+}
+
+// handleData is the JSON of the Secrets of a HandleStorage.
+type handleData struct {
+	Data      json.RawMessage `json:"data"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Version   string          `json:"version"`
+}
+
+// NewHandleStorage returns a HandleStorage for the given resource type, whose data has the given version. Data of any
+// other version is rejected, so the version should change whenever the data changes incompatibly. The random handles
+// are read from rand.
+func NewHandleStorage(
+	resource string,
+	version string,
+	secrets corev1client.SecretInterface,
+	clock func() time.Time,
+	rand io.Reader,
+	lifetime time.Duration,
+) *HandleStorage {
+	return &HandleStorage{
+		resource: resource,
+		version:  version,
+		storage:  New(resource, secrets, clock, lifetime),
+		clock:    clock,
+		rand:     rand,
+		lifetime: lifetime,
+	}
+}
+
+// Create stores the data, and returns a new random handle which refers to it.
+func (s *HandleStorage) Create(ctx context.Context, data JSON) (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(s.rand, b); err != nil {
+		return "", fmt.Errorf("could not generate handle: %w", err)
+	}
+	handle := base64.RawURLEncoding.EncodeToString(b)
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %s: %w", s.resource, err)
+	}
+	if _, err := s.storage.Create(ctx, handleSignature(handle), &handleData{
+		Data:      encoded,
+		ExpiresAt: s.clock().Add(s.lifetime),
+		Version:   s.version,
+	}, nil); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
+
+// Get reads the data which the handle refers to into data. It returns ErrHandleNotFound when the handle does not refer
+// to unexpired data.
+func (s *HandleStorage) Get(ctx context.Context, handle string, data JSON) error {
+	if handle == "" {
+		return ErrHandleNotFound
+	}
+
+	var stored handleData
+	_, err := s.storage.Get(ctx, handleSignature(handle), &stored)
+	if k8serrors.IsNotFound(err) {
+		return ErrHandleNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// Secrets are only garbage collected periodically, so expired data may still be found.
+	if s.clock().After(stored.ExpiresAt) {
+		return ErrHandleNotFound
+	}
+	return decodeHandleData(s.resource, s.version, &stored, data)
+}
+
+// Delete deletes the data which the handle refers to. It returns ErrHandleNotFound when it was already deleted, so
+// that only one of many concurrent requests which use the same handle can succeed.
+func (s *HandleStorage) Delete(ctx context.Context, handle string) error {
+	err := s.storage.Delete(ctx, handleSignature(handle))
+	if k8serrors.IsNotFound(err) {
+		return ErrHandleNotFound
+	}
+	return err
+}
+
+// HandleDataFromSecret reads the data of a Secret of a HandleStorage for the given resource type and version into
+// data, regardless of whether the data has expired, e.g. for the garbage collector.
+func HandleDataFromSecret(resource string, version string, secret *corev1.Secret, data JSON) error {
+	var stored handleData
+	if err := FromSecret(resource, secret, &stored); err != nil {
+		return err
+	}
+	return decodeHandleData(resource, version, &stored, data)
+}
+
+func decodeHandleData(resource string, version string, stored *handleData, data JSON) error {
+	if stored.Version != version {
+		return fmt.Errorf("%w: %s version %q is not supported", ErrHandleDataMalformed, resource, stored.Version)
+	}
+	if err := json.Unmarshal(stored.Data, data); err != nil {
+		return fmt.Errorf("%w: failed to decode %s: %v", ErrHandleDataMalformed, resource, err)
+	}
+	return nil
+}
+
+func handleSignature(handle string) string {
+	sum := sha256.Sum256([]byte(handle))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+)
+
+func TestHandleStorage(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := 10 * time.Minute
+
+	type testData struct {
+		Value string `json:"value"`
+	}
+	data := &testData{Value: "some-value"}
+
+	newStorage := func(t *testing.T, version string) (*HandleStorage, *fake.Clientset) {
+		t.Helper()
+		kubeClient := fake.NewSimpleClientset()
+		return NewHandleStorage("some-resource", version, kubeClient.CoreV1().Secrets("some-namespace"), func() time.Time { return now },
+			bytes.NewReader(bytes.Repeat([]byte{'a'}, 64)), lifetime), kubeClient
+	}
+
+	t.Run("stored data can be read until it is deleted", func(t *testing.T) {
+		storage, kubeClient := newStorage(t, "1")
+		handle, err := storage.Create(ctx, data)
+		require.NoError(t, err)
+		require.Equal(t, "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE", handle)
+
+		// Only the hash of the handle is used to name the Secret.
+		secrets, err := kubeClient.CoreV1().Secrets("some-namespace").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, secrets.Items, 1)
+		require.Equal(t, "some-resource", secrets.Items[0].Labels[SecretLabelKey])
+		require.Equal(t, "2030-01-01T00:10:00Z", secrets.Items[0].Annotations[SecretLifetimeAnnotationKey])
+		require.Equal(t, SecretName("some-resource", handleSignature(handle)), secrets.Items[0].Name)
+		require.NotContains(t, string(secrets.Items[0].Data[secretDataKey]), handle)
+
+		var fromSecret testData
+		require.NoError(t, HandleDataFromSecret("some-resource", "1", &secrets.Items[0], &fromSecret))
+		require.Equal(t, data, &fromSecret)
+
+		var got testData
+		require.NoError(t, storage.Get(ctx, handle, &got))
+		require.Equal(t, data, &got)
+
+		require.NoError(t, storage.Delete(ctx, handle))
+		require.ErrorIs(t, storage.Get(ctx, handle, &got), ErrHandleNotFound)
+		require.ErrorIs(t, storage.Delete(ctx, handle), ErrHandleNotFound)
+	})
+
+	t.Run("unknown handles are not found", func(t *testing.T) {
+		storage, _ := newStorage(t, "1")
+		var got testData
+		require.ErrorIs(t, storage.Get(ctx, "some-unknown-handle", &got), ErrHandleNotFound)
+		require.ErrorIs(t, storage.Get(ctx, "", &got), ErrHandleNotFound)
+	})
+
+	t.Run("expired data is not found before it is garbage collected", func(t *testing.T) {
+		storage, _ := newStorage(t, "1")
+		handle, err := storage.Create(ctx, data)
+		require.NoError(t, err)
+
+		var got testData
+		storage.clock = func() time.Time { return now.Add(lifetime) }
+		require.NoError(t, storage.Get(ctx, handle, &got))
+		storage.clock = func() time.Time { return now.Add(lifetime + time.Second) }
+		require.ErrorIs(t, storage.Get(ctx, handle, &got), ErrHandleNotFound)
+	})
+
+	t.Run("data of another version is rejected", func(t *testing.T) {
+		storage, kubeClient := newStorage(t, "1")
+		handle, err := storage.Create(ctx, data)
+		require.NoError(t, err)
+
+		storage.version = "2"
+		var got testData
+		require.ErrorIs(t, storage.Get(ctx, handle, &got), ErrHandleDataMalformed)
+		require.EqualError(t, storage.Get(ctx, handle, &got), `handle storage data is not valid: some-resource version "1" is not supported`)
+
+		secrets, err := kubeClient.CoreV1().Secrets("some-namespace").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.ErrorIs(t, HandleDataFromSecret("some-resource", "2", &secrets.Items[0], &got), ErrHandleDataMalformed)
+	})
+
+	t.Run("errors of the Secrets client are returned", func(t *testing.T) {
+		storage, kubeClient := newStorage(t, "1")
+		handle, err := storage.Create(ctx, data)
+		require.NoError(t, err)
+		kubeClient.PrependReactor("*", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("some secrets error")
+		})
+
+		var got testData
+		require.ErrorContains(t, storage.Get(ctx, handle, &got), "some secrets error")
+		require.ErrorContains(t, storage.Delete(ctx, handle), "some secrets error")
+		_, err = storage.Create(ctx, data)
+		require.ErrorContains(t, err, "some secrets error")
+	})
+}
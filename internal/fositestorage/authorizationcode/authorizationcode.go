@@ -116,7 +116,7 @@ func (a *authorizeCodeStorage) InvalidateAuthorizeCodeSession(ctx context.Contex
 	}
 
 	session.Active = false
-	if _, err := a.storage.Update(ctx, signature, rv, session); err != nil {
+	if _, err := a.storage.Update(ctx, signature, rv, session, nil); err != nil {
 		if errors.IsConflict(err) {
 			return &errSerializationFailureWithCause{cause: err}
 		}
@@ -284,63 +284,71 @@ const ExpectedAuthorizeCodeSessionJSONFromFuzzing = `{
 				"Q7钎漡臧n栀,i"
 			],
 			"request_object_signing_alg": "廜+v,淬Ʋ4Dʧ呩锏緍场脋",
-			"token_endpoint_auth_signing_alg": "ưƓǴ罷ǹ~]ea胠Ĺĩv絹b垇I"
+			"token_endpoint_auth_signing_alg": "ưƓǴ罷ǹ~]ea胠Ĺĩv絹b垇I",
+			"username": "ıD凘ǳ[甿Ǌ櫗Pu4",
+			"groups": [
+				"涒聽ȑǕÄŮǻ并峸T",
+				"1",
+				"UFƼĮǡ鑻Z¥篚h°ʣ£ǖ"
+			],
+			"trusted": true
 		},
 		"scopes": [
-			"ĩǀŻQ'k頂箨J-a",
-			"ɓ啶#昏Q遐*\\髎bŸ1慂U"
+			"砬ʍ8挮9凚"
 		],
 		"grantedScopes": [
-			"ƼĮǡ鑻Z¥篚h°ʣ£ǖ%\"砬ʍ"
+			"妔MʑÚ鴊#碓ɎǛƍdÚ慂+槰蚪",
+			"ȿ/"
 		],
 		"form": {
-			"¡": [
-				"Ła卦牟懧¥ɂĵ",
-				"ɎǛƍdÚ慂+槰蚪i齥篗裢?霃谥vƘ:",
-				"/濔Aʉ\u003cS獾蔀OƭUǦ"
+			"?霃谥vƘ:ƿ/濔Aʉ\u003cS獾": [
+				"囀ǅ悷鵱民撲ʓeŘ嬀j¤囡莒汗狲N",
+				"ǆ霋Ɔ輡5ȏ樛ȧ.mĔ櫓Ǩ療",
+				"Ǉ/"
 			],
-			"民撲ʓeŘ嬀j¤囡莒汗狲N\u003cCq": [
-				"5ȏ樛ȧ.mĔ櫓Ǩ療騃Ǐ}ɟ",
-				"潠[ĝU噤'",
-				"ŁȗɉY妶ǵ!ȁ"
+			"ȲŻ麤ã桒嘞\\摗": [
+				"ȳńƩŴȭ;ɇ褗6巽ēđų蓼"
 			],
-			"褰ʎɰ癟VĎĢ婄磫绒u妔隤ʑƍš駎竪": [
-				"鱙翑ȲŻ麤ã桒嘞\\摗Ǘū稖咾鎅ǸÖ"
+			"ɟ8嗤ʓȞʂ櫩\"ŁȗɉY妶": [
+				"ùŶ褰ʎɰ癟VĎĢ婄",
+				"ļ攬林Ñz焁糳¿o\u003eQ",
+				"闏"
 			]
 		},
 		"session": {
 			"fosite": {
 				"Claims": {
-					"JTI": "褗6巽ēđų蓼tùZ蛆鬣a\"ÙǞ0觢",
-					"Issuer": "j¦鲶H股ƲLŋZ-{",
-					"Subject": "ehpƧ蓟",
+					"JTI": "48珎²Lcéã越",
+					"Issuer": "Û±¤ǟaȭ_Ǣ肟v\u0026đe",
+					"Subject": "踉4$5^驜Ŗ~ů崧軒q腟u尿",
 					"Audience": [
-						"驜Ŗ~ů崧軒q腟u尿宲!"
+						"粭ǎ^",
+						"缠蕖¤'+ʣȍ瓁U4鞀"
 					],
-					"Nonce": "ǎ^嫯R忑隯ƗƋ*L\u0026",
-					"ExpiresAt": "1989-06-02T14:40:29.613836765Z",
-					"IssuedAt": "2052-03-26T02:39:27.882495556Z",
-					"RequestedAt": "2038-04-06T10:46:24.698586972Z",
-					"AuthTime": "2003-01-05T11:30:18.206004879Z",
-					"AccessTokenHash": "ğǫ\\aȊ4ț髄Al",
-					"AuthenticationContextClassReference": "曓蓳n匟鯘磹*金爃鶴滱ůĮǐ_c3#",
+					"Nonce": "ʏÑęN\u003c_z",
+					"ExpiresAt": "2090-09-15T19:10:47.741739699Z",
+					"IssuedAt": "1984-09-28T23:58:37.080184362Z",
+					"RequestedAt": "2060-02-19T20:17:10.187093494Z",
+					"AuthTime": "2054-12-05T18:06:41.08812792Z",
+					"AccessTokenHash": "Ȓ曓蓳n匟鯘磹*金爃",
+					"AuthenticationContextClassReference": "鋈k蟵pAɂ",
 					"AuthenticationMethodsReferences": [
-						"装ƹýĸŴB岺Ð嫹Sx镯荫őł疂ư墫"
+						"#\u0026PƢ曰l騌蘙螤\\阏Đ镴Ƥm蔻ǭ\\鿞"
 					],
-					"CodeHash": "\u0026鶡",
+					"CodeHash": "墫ɓ騒濒鑳绪HrǓ\\B",
 					"Extra": {
-						"rǓ\\BRë_g\"ʎ啴SƇMǃļū": {
-							"4撎胬龯,t猟i\u0026\u0026Q@ǤǟǗ": [
-								1239190737
-							],
-							"飘ȱF?Ƈ畋": {
+						"nǔ鰙钻": 956541244,
+						"ɨəÅDČ{Ȩʦ4撎胬龯,": {
+							"Q@ǤǟǗǪ飘ȱF?Ƈ畋": {
 								"劰û橸ɽ銐ƭ?}HƟ玈鳚": null,
 								"骲v0H晦XŘO溪V蔓Ȍ+~ē埅Ȝ": {
 									"4Ǟ": false
 								}
-							}
-						},
-						"鑳绪": 2738428764
+							},
+							"猟i\u0026": [
+								3983396828
+							]
+						}
 					}
 				},
 				"Headers": {
@@ -393,17 +401,31 @@ const ExpectedAuthorizeCodeSessionJSONFromFuzzing = `{
 						" 皦pSǬŝ社Vƅȭǝ*擦28ǅ": "vư",
 						"艱iYn面@yȝƋ鬯犦獢9c5¤.岵": "浛a齙\\蹼偦歛"
 					}
+				},
+				"github": {
+					"upstreamAccessToken": "置b"
+				},
+				"saml": {
+					"nameID": "抰蛖a³2ʫ承",
+					"sessionExpiry": "2073-04-02T02:23:36.734976008Z"
+				},
+				"certificate": {
+					"peerCertificates": [
+						"tNk="
+					]
 				}
-			}
+			},
+			"dpopJKT": "Àqy_º$+溪ŸȢŒų崓ļ"
 		},
 		"requestedAudience": [
-			"置b",
-			"筫MN\u0026錝D肁Ŷɽ蔒PR}Ųʓl{"
+			"-蹐È_¸]fś",
+			"ɵʮGɃɫ囤1+,Ȳ",
+			"@ɍB鳛Nč"
 		],
 		"grantedAudience": [
-			"jÃ轘屔挝",
-			"Œų崓ļ憽-蹐È_¸]fś",
-			"ɵʮGɃɫ囤1+,Ȳ"
+			"ƔǴę鏶",
+			"ĩŦʀ宍D挟",
+			"q萮左/篣AÚƄŕ~čfVLPC諡}"
 		]
 	},
 	"version": "2"
@@ -45,10 +45,32 @@ type refreshTokenStorage struct {
 }
 
 type Session struct {
+	// Used is true when the refresh token was already used to get new tokens. Used refresh tokens are kept until they
+	// are garbage collected, so that using them again can be detected. They do not hold upstream tokens anymore.
+	Used    bool            `json:"used,omitempty"`
 	Request *fosite.Request `json:"request"`
 	Version string          `json:"version"`
 }
 
+// ReusedRefreshTokenError is returned when a refresh token which was already used to get new tokens is used again,
+// which means that it was probably stolen. Fosite treats it like fosite.ErrInactiveToken, so it revokes all access
+// and refresh tokens of the same authorization.
+type ReusedRefreshTokenError struct {
+	// Request is the request of the reused refresh token.
+	Request fosite.Requester
+	// Latest is the request of the newest refresh token of the same authorization, which holds the latest upstream
+	// tokens, or nil when there is none anymore. Fosite deletes it before this error reaches the token endpoint.
+	Latest fosite.Requester
+}
+
+func (e *ReusedRefreshTokenError) Error() string {
+	return fmt.Sprintf("refresh token session for request ID %s has already been used", e.Request.GetID())
+}
+
+func (e *ReusedRefreshTokenError) Unwrap() error {
+	return fosite.ErrInactiveToken
+}
+
 func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
 	return &refreshTokenStorage{storage: crud.New(TypeLabelValue, secrets, clock, sessionStorageLifetime)}
 }
@@ -74,9 +96,28 @@ func (a *refreshTokenStorage) RevokeRefreshToken(ctx context.Context, requestID
 	return a.storage.DeleteByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID)
 }
 
+// RevokeRefreshTokenMaybeGracePeriod is called by fosite after the refresh token was used to get new tokens. It marks
+// the refresh token as used instead of deleting it, so that using it again revokes all tokens of the authorization.
+// We don't support a grace period, so the refresh token cannot be used again even right away. The upstream tokens
+// were passed on to the new refresh token, so they are removed from the used one, which may be kept for a long time.
 func (a *refreshTokenStorage) RevokeRefreshTokenMaybeGracePeriod(ctx context.Context, requestID string, signature string) error {
-	// We don't support a grace period, so always call the regular RevokeRefreshToken().
-	return a.RevokeRefreshToken(ctx, requestID)
+	session, rv, err := a.getSession(ctx, signature)
+	if err != nil {
+		return err
+	}
+
+	session.Used = true
+	if pinnipedSession, ok := session.Request.Session.(*psession.PinnipedSession); ok {
+		removeUpstreamTokens(pinnipedSession.Custom)
+	}
+	if _, err := a.storage.Update(ctx, signature, rv, session, map[string]string{fositestorage.StorageRequestIDLabelName: requestID}); err != nil {
+		if errors.IsConflict(err) {
+			return fmt.Errorf("%w: %s", fosite.ErrSerializationFailure, err)
+		}
+		return err
+	}
+
+	return nil
 }
 
 func (a *refreshTokenStorage) CreateRefreshTokenSession(ctx context.Context, signature string, requester fosite.Requester) error {
@@ -97,7 +138,8 @@ func (a *refreshTokenStorage) CreateRefreshTokenSession(ctx context.Context, sig
 func (a *refreshTokenStorage) GetRefreshTokenSession(ctx context.Context, signature string, _ fosite.Session) (fosite.Requester, error) {
 	session, _, err := a.getSession(ctx, signature)
 
-	if err != nil {
+	// we need to always pass both the request and error back, so that fosite can revoke the tokens of reused ones
+	if session == nil {
 		return nil, err
 	}
 
@@ -129,9 +171,52 @@ func (a *refreshTokenStorage) getSession(ctx context.Context, signature string)
 		return nil, "", fmt.Errorf("malformed refresh token session for %s: %w", signature, ErrInvalidRefreshTokenRequestData)
 	}
 
+	// we must return the session in this case to allow fosite to revoke the associated tokens
+	if session.Used {
+		latest, err := a.latestRequest(ctx, session.Request.ID)
+		if err != nil {
+			return nil, "", err
+		}
+		return session, rv, &ReusedRefreshTokenError{Request: session.Request, Latest: latest}
+	}
+
 	return session, rv, nil
 }
 
+// latestRequest returns the request of the refresh token of the authorization which was not used yet, or nil when
+// there is none.
+func (a *refreshTokenStorage) latestRequest(ctx context.Context, requestID string) (fosite.Requester, error) {
+	secrets, err := a.storage.ListByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range secrets {
+		session, err := ReadFromSecret(&secrets[i])
+		if err != nil {
+			return nil, err
+		}
+		if !session.Used {
+			return session.Request, nil
+		}
+	}
+	return nil, nil
+}
+
+// removeUpstreamTokens removes the upstream tokens from the custom session data, and keeps everything else, such as
+// the name of the upstream, which is still needed to log the reuse of the refresh token.
+func removeUpstreamTokens(customSessionData *psession.CustomSessionData) {
+	if customSessionData == nil {
+		return
+	}
+	if customSessionData.OIDC != nil {
+		customSessionData.OIDC.UpstreamRefreshToken = ""
+		customSessionData.OIDC.UpstreamAccessToken = ""
+	}
+	if customSessionData.GitHub != nil {
+		customSessionData.GitHub.UpstreamAccessToken = ""
+	}
+}
+
 func newValidEmptyRefreshTokenSession() *Session {
 	return &Session{
 		Request: &fosite.Request{
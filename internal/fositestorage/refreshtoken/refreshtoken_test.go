@@ -6,6 +6,7 @@ package refreshtoken
 import (
 	"context"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -163,6 +164,7 @@ func TestRefreshTokenStorageRevocation(t *testing.T) {
 }
 
 func TestRefreshTokenStorageRevokeRefreshTokenMaybeGracePeriod(t *testing.T) {
+	secretData := `{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"fosite":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"custom":{"providerUID":"fake-provider-uid","providerName":"fake-provider-name","providerType":"fake-provider-type","warnings":null,"oidc":{"upstreamRefreshToken":"fake-upstream-refresh-token","upstreamAccessToken":"","upstreamSubject":"some-subject","upstreamIssuer":"some-issuer"}}},"requestedAudience":null,"grantedAudience":null},"version":"2"}`
 	wantActions := []coretesting.Action{
 		coretesting.NewCreateAction(secretsGVR, namespace, &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
@@ -177,15 +179,31 @@ func TestRefreshTokenStorageRevokeRefreshTokenMaybeGracePeriod(t *testing.T) {
 				},
 			},
 			Data: map[string][]byte{
-				"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"fosite":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"custom":{"providerUID":"fake-provider-uid","providerName":"fake-provider-name","providerType":"fake-provider-type","warnings":null,"oidc":{"upstreamRefreshToken":"fake-upstream-refresh-token","upstreamAccessToken":"","upstreamSubject":"some-subject","upstreamIssuer":"some-issuer"}}},"requestedAudience":null,"grantedAudience":null},"version":"2"}`),
+				"pinniped-storage-data":    []byte(secretData),
 				"pinniped-storage-version": []byte("1"),
 			},
 			Type: "storage.pinniped.dev/refresh-token",
 		}),
-		coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
-			LabelSelector: "storage.pinniped.dev/type=refresh-token,storage.pinniped.dev/request-id=abcd-1",
+		coretesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-refresh-token-pwu5zs7lekbhnln2w4"),
+		coretesting.NewUpdateAction(secretsGVR, namespace, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "pinniped-storage-refresh-token-pwu5zs7lekbhnln2w4",
+				ResourceVersion: "",
+				Labels: map[string]string{
+					"storage.pinniped.dev/type":       "refresh-token",
+					"storage.pinniped.dev/request-id": "abcd-1",
+				},
+				Annotations: map[string]string{
+					"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+				},
+			},
+			Data: map[string][]byte{
+				// The used refresh token does not hold the upstream refresh token anymore.
+				"pinniped-storage-data":    []byte(`{"used":true,` + strings.Replace(secretData[1:], `"upstreamRefreshToken":"fake-upstream-refresh-token"`, `"upstreamRefreshToken":""`, 1)),
+				"pinniped-storage-version": []byte("1"),
+			},
+			Type: "storage.pinniped.dev/refresh-token",
 		}),
-		coretesting.NewDeleteAction(secretsGVR, namespace, "pinniped-storage-refresh-token-pwu5zs7lekbhnln2w4"),
 	}
 
 	ctx, client, _, storage := makeTestSubject()
@@ -209,8 +227,7 @@ func TestRefreshTokenStorageRevokeRefreshTokenMaybeGracePeriod(t *testing.T) {
 	err := storage.CreateRefreshTokenSession(ctx, "fancy-signature", request)
 	require.NoError(t, err)
 
-	// Revoke the request ID of the session that we just created. We don't support grace periods, so this
-	// should work exactly like the regular RevokeRefreshToken() function.
+	// The refresh token was used to get new tokens, so it is marked as used instead of being deleted.
 	err = storage.RevokeRefreshTokenMaybeGracePeriod(ctx, "abcd-1", "fancy-signature")
 	require.NoError(t, err)
 
@@ -218,6 +235,51 @@ func TestRefreshTokenStorageRevokeRefreshTokenMaybeGracePeriod(t *testing.T) {
 	require.Equal(t, wantActions, client.Actions())
 }
 
+func TestRefreshTokenStorageReuse(t *testing.T) {
+	ctx, _, _, storage := makeTestSubject()
+
+	newRequest := func() *fosite.Request {
+		return &fosite.Request{
+			ID:      "abcd-1",
+			Client:  &clientregistry.Client{},
+			Form:    url.Values{"key": []string{"val"}},
+			Session: testutil.NewFakePinnipedSession(),
+		}
+	}
+
+	// The first refresh token was used to get the second refresh token of the same authorization.
+	require.NoError(t, storage.CreateRefreshTokenSession(ctx, "first-signature", newRequest()))
+	require.NoError(t, storage.RevokeRefreshTokenMaybeGracePeriod(ctx, "abcd-1", "first-signature"))
+	secondRequest := newRequest()
+	secondRequest.Session.(*psession.PinnipedSession).Custom.OIDC.UpstreamRefreshToken = "second-upstream-refresh-token"
+	require.NoError(t, storage.CreateRefreshTokenSession(ctx, "second-signature", secondRequest))
+
+	_, err := storage.GetRefreshTokenSession(ctx, "second-signature", nil)
+	require.NoError(t, err)
+
+	// Using the first refresh token again is reuse.
+	reusedRequest, err := storage.GetRefreshTokenSession(ctx, "first-signature", nil)
+	require.EqualError(t, err, "refresh token session for request ID abcd-1 has already been used")
+	require.True(t, errors.Is(err, fosite.ErrInactiveToken))
+	wantReusedRequest := newRequest()
+	wantReusedRequest.Session.(*psession.PinnipedSession).Custom.OIDC.UpstreamRefreshToken = ""
+	require.Equal(t, wantReusedRequest, reusedRequest)
+	var reusedErr *ReusedRefreshTokenError
+	require.True(t, errors.As(err, &reusedErr))
+	require.Equal(t, reusedRequest, reusedErr.Request)
+	require.Equal(t, secondRequest, reusedErr.Latest)
+
+	// A used refresh token cannot be used again even when fosite would allow a grace period.
+	err = storage.RevokeRefreshTokenMaybeGracePeriod(ctx, "abcd-1", "first-signature")
+	require.True(t, errors.Is(err, fosite.ErrInactiveToken))
+
+	// After fosite revoked all refresh tokens of the authorization, there is no latest refresh token anymore.
+	require.NoError(t, storage.DeleteRefreshTokenSession(ctx, "second-signature"))
+	_, err = storage.GetRefreshTokenSession(ctx, "first-signature", nil)
+	require.True(t, errors.As(err, &reusedErr))
+	require.Nil(t, reusedErr.Latest)
+}
+
 func TestGetNotFound(t *testing.T) {
 	ctx, _, _, storage := makeTestSubject()
 
@@ -0,0 +1,445 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package loginlimit protects the Supervisor's password logins from brute-force attacks. It counts the failed
+// login attempts of each username, and optionally of each client IP address, and makes the user or client wait
+// longer and longer before their next attempt. After many failures, the username or client IP address is locked out
+// for a while. The counts are stored in Secrets, so they are shared by all Supervisor pods. Each Secret holds the counts
+// of many keys, and there is a fixed number of them, so that failed logins cannot make the Supervisor create any
+// number of Secrets.
+package loginlimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// TypeLabelValue is the value of the storage.pinniped.dev/type label of the Secrets which hold failed login counts.
+	TypeLabelValue = "login-limit"
+
+	// KindUsername and KindClientIP are the kinds of keys whose failed login attempts are counted.
+	KindUsername Kind = "username"
+	KindClientIP Kind = "clientIP"
+
+	// resetAfter is how long a key must have no failed attempts before its count is forgotten. Secrets are garbage
+	// collected after this time, so it must be longer than the lockout duration of all policies.
+	resetAfter = time.Hour
+
+	// shardsPerKind is the number of Secrets which hold the counts of each kind of key, and maxRecordsPerShard is the
+	// number of keys whose counts each of them may hold. Together, they bound the storage used for failed logins.
+	shardsPerKind      = 32
+	maxRecordsPerShard = 1000
+
+	shardStorageVersion = "1"
+)
+
+// Kind is the kind of a Key.
+type Kind string
+
+// Key identifies whose failed login attempts are counted.
+type Key struct {
+	Kind  Kind
+	Value string
+}
+
+// UsernameKey returns the key of a username of an upstream identity provider. Usernames are compared
+// case-insensitively, since most upstreams do not care about the case of the username during login.
+func UsernameKey(upstreamName string, username string) Key {
+	return Key{Kind: KindUsername, Value: upstreamName + "/" + strings.ToLower(username)}
+}
+
+// ClientIPKey returns the key of the client IP address of the request. Note that this is the address of the peer
+// of the connection to the Supervisor, so when all clients connect through the same proxy, they share this key. That
+// is why client IP addresses are only limited when DefaultPolicies was asked to.
+func ClientIPKey(r *http.Request) Key {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return Key{Kind: KindClientIP, Value: host}
+}
+
+// Policy decides how long a key must wait after its failed login attempts.
+type Policy struct {
+	// FreeAttempts is the number of failed attempts which do not cause any wait.
+	FreeAttempts int
+	// BaseDelay is the wait after the first failed attempt which is not free. It doubles after each failed attempt.
+	BaseDelay time.Duration
+	// MaxDelay is the longest wait before the key is locked out.
+	MaxDelay time.Duration
+	// LockoutAttempts is the number of failed attempts after which the key is locked out.
+	LockoutAttempts int
+	// LockoutDuration is how long the key is locked out.
+	LockoutDuration time.Duration
+}
+
+// DefaultPolicies returns the policies used by the Supervisor. Client IP addresses only have a policy when
+// limitClientIPs is true, since all clients behind the same proxy or load balancer share its address, and one
+// attacker could lock all of them out. A client IP address may be shared by many users, so it is allowed many more
+// failed attempts than a single username.
+func DefaultPolicies(limitClientIPs bool) map[Kind]Policy {
+	policies := map[Kind]Policy{
+		KindUsername: {
+			FreeAttempts:    5,
+			BaseDelay:       time.Second,
+			MaxDelay:        time.Minute,
+			LockoutAttempts: 10,
+			LockoutDuration: 15 * time.Minute,
+		},
+	}
+	if limitClientIPs {
+		policies[KindClientIP] = Policy{
+			FreeAttempts:    20,
+			BaseDelay:       time.Second,
+			MaxDelay:        time.Minute,
+			LockoutAttempts: 100,
+			LockoutDuration: 15 * time.Minute,
+		}
+	}
+	return policies
+}
+
+// TooManyAttemptsError is returned by Limiter.Begin when a login attempt must not be made yet.
+type TooManyAttemptsError struct {
+	Kind       Kind
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("too many failed login attempts for this %s, try again in %s", e.Kind, e.RetryAfter)
+}
+
+// RetryAfterSeconds returns the value of a Retry-After header for the error.
+func (e *TooManyAttemptsError) RetryAfterSeconds() string {
+	return fmt.Sprintf("%d", int64(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+type record struct {
+	Failures     int       `json:"failures"`
+	LastFailure  time.Time `json:"lastFailure"`
+	BlockedUntil time.Time `json:"blockedUntil"`
+}
+
+// shard holds the records of the keys which are assigned to it by shardSignature, by their signature.
+type shard struct {
+	Records map[string]record `json:"records"`
+	Version string            `json:"version"`
+}
+
+// Limiter counts failed login attempts. It is safe to use from many Supervisor pods at the same time.
+type Limiter struct {
+	storage  crud.Storage
+	clock    func() time.Time
+	policies map[Kind]Policy
+}
+
+// New returns a Limiter which stores its counts in Secrets.
+func New(secrets corev1client.SecretInterface, clock func() time.Time, policies map[Kind]Policy) *Limiter {
+	return &Limiter{
+		storage:  crud.New(TypeLabelValue, secrets, clock, resetAfter),
+		clock:    clock,
+		policies: policies,
+	}
+}
+
+// Attempt is a login attempt which was started by Limiter.Begin. It must be finished with End.
+type Attempt struct {
+	limiter   *Limiter
+	counted   []countedFailure
+	failed    bool
+	succeeded bool
+}
+
+// countedFailure is a failure which was counted for a key when an attempt began.
+type countedFailure struct {
+	key Key
+	// failures is the number of failures of the key, including this one.
+	failures int
+	// at is the time of this failure, and previousLastFailure is the time of the failure before it.
+	at                  time.Time
+	previousLastFailure time.Time
+}
+
+// Begin starts a login attempt. It returns a *TooManyAttemptsError when any of the keys must wait before its next
+// login attempt. When more than one key must wait, the error is for the key which must wait the longest. Otherwise,
+// the attempt is counted as a failure of each key right away, in the same update which checks that the key does not
+// have to wait, so that concurrent attempts cannot get around the limits. End takes the failure back when the
+// attempt did not fail. Keys of kinds which have no policy are not limited, so callers may always pass all keys.
+func (l *Limiter) Begin(ctx context.Context, allKeys ...Key) (*Attempt, error) {
+	var keys []Key
+	for _, key := range allKeys {
+		if _, ok := l.policies[key.Kind]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	if err := l.check(ctx, keys...); err != nil {
+		return nil, err
+	}
+
+	attempt := &Attempt{limiter: l}
+	for _, key := range keys {
+		counted, err := l.countFailure(ctx, key)
+		if err != nil {
+			// Take back the failures of the keys which were already counted.
+			attempt.End(ctx)
+			return nil, err
+		}
+		attempt.counted = append(attempt.counted, *counted)
+	}
+	return attempt, nil
+}
+
+// Failed marks the attempt as failed because the user's credentials were not accepted.
+func (a *Attempt) Failed() {
+	if a != nil {
+		a.failed = true
+	}
+}
+
+// Succeeded marks the attempt as successful.
+func (a *Attempt) Succeeded() {
+	if a != nil {
+		a.succeeded = true
+	}
+}
+
+// End finishes the attempt. A failed attempt keeps counting as a failure. A successful attempt forgets all failures
+// of its username keys, and is taken back from its other keys, since one successful login from a client IP address
+// says nothing about its other attempts. Any other attempt, for example one which could not reach the upstream, is
+// taken back from all of its keys. Errors are only logged, since they must not change the outcome of the login.
+// End does nothing for a nil Attempt.
+func (a *Attempt) End(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	for _, counted := range a.counted {
+		var err error
+		switch {
+		case a.failed:
+			a.limiter.logFailure(counted.key, counted.failures)
+		case a.succeeded && counted.key.Kind == KindUsername:
+			err = a.limiter.update(ctx, counted.key, func(stored *record, _ time.Time) error {
+				*stored = record{}
+				return nil
+			})
+		default:
+			err = a.limiter.takeBackFailure(ctx, counted)
+		}
+		if err != nil {
+			plog.WarningErr("could not update failed login attempts", err, "kind", counted.key.Kind)
+		}
+	}
+	a.counted = nil
+}
+
+// check returns a *TooManyAttemptsError when any of the keys must wait before its next login attempt.
+func (l *Limiter) check(ctx context.Context, keys ...Key) error {
+	now := l.clock()
+	var tooManyAttemptsErr *TooManyAttemptsError
+	for _, key := range keys {
+		var stored shard
+		_, err := l.storage.Get(ctx, shardSignature(key), &stored)
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if retryAfter := stored.Records[signature(key)].BlockedUntil.Sub(now); retryAfter > 0 &&
+			(tooManyAttemptsErr == nil || retryAfter > tooManyAttemptsErr.RetryAfter) {
+			tooManyAttemptsErr = &TooManyAttemptsError{Kind: key.Kind, RetryAfter: retryAfter.Round(time.Second)}
+		}
+	}
+	if tooManyAttemptsErr != nil {
+		return tooManyAttemptsErr
+	}
+	return nil
+}
+
+// countFailure counts a failure of the key, unless the key must wait before its next login attempt.
+func (l *Limiter) countFailure(ctx context.Context, key Key) (*countedFailure, error) {
+	policy := l.policies[key.Kind]
+	counted := &countedFailure{key: key}
+	err := l.update(ctx, key, func(stored *record, now time.Time) error {
+		if retryAfter := stored.BlockedUntil.Sub(now); retryAfter > 0 {
+			return &TooManyAttemptsError{Kind: key.Kind, RetryAfter: retryAfter.Round(time.Second)}
+		}
+		counted.previousLastFailure = stored.LastFailure
+		counted.at = now
+		stored.Failures++
+		stored.LastFailure = now
+		stored.BlockedUntil = blockedUntil(policy, stored.Failures, now)
+		counted.failures = stored.Failures
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counted, nil
+}
+
+// takeBackFailure takes back a failure which was counted by countFailure. When no other failure was counted since,
+// the key is left as it was before.
+func (l *Limiter) takeBackFailure(ctx context.Context, counted countedFailure) error {
+	policy := l.policies[counted.key.Kind]
+	return l.update(ctx, counted.key, func(stored *record, _ time.Time) error {
+		if stored.Failures > 0 {
+			stored.Failures--
+		}
+		if stored.LastFailure.Equal(counted.at) {
+			stored.LastFailure = counted.previousLastFailure
+		}
+		stored.BlockedUntil = blockedUntil(policy, stored.Failures, stored.LastFailure)
+		return nil
+	})
+}
+
+// logFailure logs when a failure made the key wait or locked it out. The value of the key is chosen by whoever
+// attempts the login, so it is only logged at debug level. The other levels log its signature, which is also the name
+// of its record in the shard.
+func (l *Limiter) logFailure(key Key, failures int) {
+	policy := l.policies[key.Kind]
+	switch {
+	case failures == policy.LockoutAttempts:
+		plog.Warning("login attempts locked out after too many failures",
+			"kind", key.Kind, "keySignature", signature(key), "failures", failures, "lockoutDuration", policy.LockoutDuration)
+	case failures > policy.FreeAttempts && failures < policy.LockoutAttempts:
+		plog.Info("login attempts delayed after failures",
+			"kind", key.Kind, "keySignature", signature(key), "failures", failures, "delay", delay(policy, failures-policy.FreeAttempts))
+	default:
+		return
+	}
+	plog.Debug("login attempts limited for key", "kind", key.Kind, "keySignature", signature(key), "key", key.Value)
+}
+
+// update changes the record of the key. The record is removed when it has no failures left. Another Supervisor pod
+// may change the same shard at the same time, so update starts over when it did.
+func (l *Limiter) update(ctx context.Context, key Key, change func(stored *record, now time.Time) error) error {
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err)
+	}, func() error {
+		var stored shard
+		rv, err := l.storage.Get(ctx, shardSignature(key), &stored)
+		exists := err == nil
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+		if stored.Records == nil {
+			stored.Records = map[string]record{}
+		}
+
+		now := l.clock()
+		stored.prune(now, signature(key))
+		changed := stored.Records[signature(key)]
+		if err := change(&changed, now); err != nil {
+			return err
+		}
+		if changed.Failures > 0 {
+			stored.Records[signature(key)] = changed
+		} else {
+			delete(stored.Records, signature(key))
+		}
+		stored.Version = shardStorageVersion
+
+		// An empty shard is kept, since deleting it could lose a record which another pod added in the meantime.
+		// It is garbage collected when it stays unchanged.
+		switch {
+		case exists:
+			_, err = l.storage.Update(ctx, shardSignature(key), rv, &stored, nil)
+		case len(stored.Records) > 0:
+			_, err = l.storage.Create(ctx, shardSignature(key), &stored, nil)
+		}
+		return err
+	})
+}
+
+// prune removes the records which are older than resetAfter. When the shard still holds too many records, it also
+// removes those which matter least: first the records which do not make their key wait, and then the oldest. The
+// record with the signature to keep is never removed.
+func (s *shard) prune(now time.Time, keep string) {
+	for sig, r := range s.Records {
+		if now.Sub(r.LastFailure) > resetAfter {
+			delete(s.Records, sig)
+		}
+	}
+	excess := len(s.Records) - maxRecordsPerShard
+	if _, ok := s.Records[keep]; !ok {
+		// Make room for the record to keep, which is not in the shard yet.
+		excess++
+	}
+	if excess <= 0 {
+		return
+	}
+
+	sigs := make([]string, 0, len(s.Records))
+	for sig := range s.Records {
+		if sig != keep {
+			sigs = append(sigs, sig)
+		}
+	}
+	sort.Slice(sigs, func(i, j int) bool {
+		ri, rj := s.Records[sigs[i]], s.Records[sigs[j]]
+		if blockedI, blockedJ := ri.BlockedUntil.After(now), rj.BlockedUntil.After(now); blockedI != blockedJ {
+			return blockedJ
+		}
+		return ri.LastFailure.Before(rj.LastFailure)
+	})
+	for _, sig := range sigs[:excess] {
+		delete(s.Records, sig)
+	}
+}
+
+// blockedUntil returns until when a key with the given number of failures, the last of which was at the given time,
+// must wait before its next login attempt.
+func blockedUntil(policy Policy, failures int, lastFailure time.Time) time.Time {
+	switch {
+	case failures >= policy.LockoutAttempts:
+		return lastFailure.Add(policy.LockoutDuration)
+	case failures > policy.FreeAttempts:
+		return lastFailure.Add(delay(policy, failures-policy.FreeAttempts))
+	default:
+		return time.Time{}
+	}
+}
+
+// delay returns the wait after the nth failed attempt which is not free.
+func delay(policy Policy, n int) time.Duration {
+	d := policy.BaseDelay
+	for i := 1; i < n && d < policy.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > policy.MaxDelay {
+		d = policy.MaxDelay
+	}
+	return d
+}
+
+// signature returns a fixed length name for the key, since usernames may be long and contain any characters.
+func signature(key Key) string {
+	sum := sha256.Sum256([]byte(string(key.Kind) + ":" + key.Value))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// shardSignature returns the name of the shard which holds the record of the key.
+func shardSignature(key Key) string {
+	sum := sha256.Sum256([]byte(string(key.Kind) + ":" + key.Value))
+	return fmt.Sprintf("%s-%d", strings.ToLower(string(key.Kind)), binary.BigEndian.Uint32(sum[:4])%shardsPerKind)
+}
@@ -0,0 +1,334 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package loginlimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+
+	"go.pinniped.dev/internal/crud"
+)
+
+func TestKeys(t *testing.T) {
+	require.Equal(t, Key{Kind: KindUsername, Value: "my-ldap/pinny"}, UsernameKey("my-ldap", "Pinny"))
+
+	r := &http.Request{RemoteAddr: "10.1.2.3:45678"}
+	require.Equal(t, Key{Kind: KindClientIP, Value: "10.1.2.3"}, ClientIPKey(r))
+	r.RemoteAddr = "[fd00::1]:45678"
+	require.Equal(t, Key{Kind: KindClientIP, Value: "fd00::1"}, ClientIPKey(r))
+	r.RemoteAddr = "not-a-host-port"
+	require.Equal(t, Key{Kind: KindClientIP, Value: "not-a-host-port"}, ClientIPKey(r))
+}
+
+func TestLimiter(t *testing.T) {
+	const namespace = "test-ns"
+	ctx := context.Background()
+	start := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	user := UsernameKey("my-ldap", "pinny")
+	otherUser := UsernameKey("my-ldap", "other")
+	clientIP := Key{Kind: KindClientIP, Value: "10.1.2.3"}
+	policies := map[Kind]Policy{
+		KindUsername: {FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: 4 * time.Second, LockoutAttempts: 7, LockoutDuration: 10 * time.Minute},
+		KindClientIP: {FreeAttempts: 3, BaseDelay: 10 * time.Second, MaxDelay: time.Minute, LockoutAttempts: 20, LockoutDuration: 10 * time.Minute},
+	}
+
+	newLimiter := func(t *testing.T) (*Limiter, *time.Time, *fake.Clientset) {
+		t.Helper()
+		now := start
+		client := fake.NewSimpleClientset()
+		return New(client.CoreV1().Secrets(namespace), func() time.Time { return now }, policies), &now, client
+	}
+
+	requireRetryAfter := func(t *testing.T, err error, wantKind Kind, wantRetryAfter time.Duration) {
+		t.Helper()
+		var tooManyAttemptsErr *TooManyAttemptsError
+		require.True(t, errors.As(err, &tooManyAttemptsErr), "wanted a TooManyAttemptsError but got %v", err)
+		require.Equal(t, wantKind, tooManyAttemptsErr.Kind)
+		require.Equal(t, wantRetryAfter, tooManyAttemptsErr.RetryAfter)
+	}
+
+	// fail makes a login attempt which fails.
+	fail := func(t *testing.T, limiter *Limiter, keys ...Key) {
+		t.Helper()
+		attempt, err := limiter.Begin(ctx, keys...)
+		require.NoError(t, err)
+		attempt.Failed()
+		attempt.End(ctx)
+	}
+
+	// check begins a login attempt and ends it right away, which takes it back.
+	check := func(limiter *Limiter, keys ...Key) error {
+		attempt, err := limiter.Begin(ctx, keys...)
+		attempt.End(ctx)
+		return err
+	}
+
+	requireRecords := func(t *testing.T, client *fake.Clientset, want int) {
+		t.Helper()
+		secrets, err := client.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		records := 0
+		for i := range secrets.Items {
+			var stored shard
+			require.NoError(t, crud.FromSecret(TypeLabelValue, &secrets.Items[i], &stored))
+			records += len(stored.Records)
+		}
+		require.Equal(t, want, records)
+	}
+
+	t.Run("free attempts do not cause any wait", func(t *testing.T) {
+		limiter, _, _ := newLimiter(t)
+		require.NoError(t, check(limiter, user, clientIP))
+		fail(t, limiter, user, clientIP)
+		fail(t, limiter, user, clientIP)
+		require.NoError(t, check(limiter, user, clientIP))
+	})
+
+	t.Run("the wait doubles after each failure until the lockout", func(t *testing.T) {
+		limiter, now, _ := newLimiter(t)
+		for i := 0; i < 2; i++ {
+			fail(t, limiter, user)
+		}
+		for _, wantDelay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+			fail(t, limiter, user)
+			requireRetryAfter(t, check(limiter, user), KindUsername, wantDelay)
+			*now = now.Add(wantDelay)
+			require.NoError(t, check(limiter, user))
+		}
+
+		// The seventh failure locks out the user.
+		fail(t, limiter, user)
+		requireRetryAfter(t, check(limiter, user), KindUsername, 10*time.Minute)
+		*now = now.Add(9 * time.Minute)
+		requireRetryAfter(t, check(limiter, user), KindUsername, time.Minute)
+		*now = now.Add(time.Minute)
+		require.NoError(t, check(limiter, user))
+
+		// Other users are not affected.
+		require.NoError(t, check(limiter, otherUser))
+	})
+
+	t.Run("begin reports the key which must wait the longest", func(t *testing.T) {
+		limiter, now, _ := newLimiter(t)
+		for i := 0; i < 4; i++ {
+			*now = now.Add(time.Minute)
+			fail(t, limiter, user, clientIP)
+		}
+		requireRetryAfter(t, check(limiter, user, clientIP), KindClientIP, 10*time.Second)
+		requireRetryAfter(t, check(limiter, user), KindUsername, 2*time.Second)
+		require.Equal(t, "10", check(limiter, user, clientIP).(*TooManyAttemptsError).RetryAfterSeconds())
+	})
+
+	t.Run("an attempt which must wait is not counted for any key", func(t *testing.T) {
+		limiter, _, client := newLimiter(t)
+		for i := 0; i < 4; i++ {
+			fail(t, limiter, clientIP)
+		}
+		requireRetryAfter(t, check(limiter, user, clientIP), KindClientIP, 10*time.Second)
+		requireRecords(t, client, 1)
+	})
+
+	t.Run("concurrent attempts count against each other", func(t *testing.T) {
+		limiter, _, client := newLimiter(t)
+		for i := 0; i < 2; i++ {
+			fail(t, limiter, user)
+		}
+		attempt, err := limiter.Begin(ctx, user)
+		require.NoError(t, err)
+		requireRetryAfter(t, check(limiter, user), KindUsername, time.Second)
+
+		// When the first attempt ends without failing, it is taken back.
+		attempt.End(ctx)
+		require.NoError(t, check(limiter, user))
+		fail(t, limiter, user)
+		requireRetryAfter(t, check(limiter, user), KindUsername, time.Second)
+
+		// Attempts which are taken back leave no records behind.
+		require.NoError(t, check(limiter, otherUser, clientIP))
+		requireRecords(t, client, 1)
+	})
+
+	t.Run("failures are forgotten after an hour without failures", func(t *testing.T) {
+		limiter, now, _ := newLimiter(t)
+		for i := 0; i < 3; i++ {
+			fail(t, limiter, user)
+		}
+		requireRetryAfter(t, check(limiter, user), KindUsername, time.Second)
+		*now = now.Add(time.Hour + time.Second)
+		fail(t, limiter, user)
+		require.NoError(t, check(limiter, user))
+	})
+
+	t.Run("success forgets the failures of the username and is taken back from the client IP address", func(t *testing.T) {
+		limiter, now, client := newLimiter(t)
+		for i := 0; i < 3; i++ {
+			fail(t, limiter, user, clientIP)
+		}
+		*now = now.Add(time.Second)
+		attempt, err := limiter.Begin(ctx, user, clientIP)
+		require.NoError(t, err)
+		attempt.Succeeded()
+		attempt.End(ctx)
+		requireRecords(t, client, 1)
+
+		fail(t, limiter, user)
+		fail(t, limiter, user)
+		require.NoError(t, check(limiter, user))
+		fail(t, limiter, clientIP)
+		requireRetryAfter(t, check(limiter, clientIP), KindClientIP, 10*time.Second)
+	})
+
+	t.Run("a nil attempt does nothing", func(t *testing.T) {
+		var attempt *Attempt
+		attempt.Failed()
+		attempt.Succeeded()
+		attempt.End(ctx)
+	})
+
+	t.Run("failures are stored in secrets which are garbage collected", func(t *testing.T) {
+		limiter, _, client := newLimiter(t)
+		fail(t, limiter, user, clientIP)
+		secrets, err := client.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, secrets.Items, 2)
+		for _, secret := range secrets.Items {
+			require.Equal(t, TypeLabelValue, secret.Labels["storage.pinniped.dev/type"])
+			require.Equal(t, "2030-01-01T01:00:00Z", secret.Annotations["storage.pinniped.dev/garbage-collect-after"])
+		}
+	})
+
+	t.Run("failures of many keys share a fixed number of secrets", func(t *testing.T) {
+		limiter, _, client := newLimiter(t)
+		for i := 0; i < 10*shardsPerKind; i++ {
+			fail(t, limiter, UsernameKey("my-ldap", fmt.Sprintf("user-%d", i)))
+		}
+		secrets, err := client.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(secrets.Items), shardsPerKind)
+		requireRecords(t, client, 10*shardsPerKind)
+	})
+
+	t.Run("concurrent changes by another pod are retried", func(t *testing.T) {
+		limiter, _, client := newLimiter(t)
+		fail(t, limiter, user)
+		conflicts := 0
+		client.PrependReactor("update", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			if conflicts > 0 {
+				return false, nil, nil
+			}
+			conflicts++
+			return true, nil, k8serrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "some-secret", errors.New("some conflict"))
+		})
+		fail(t, limiter, user)
+		fail(t, limiter, user)
+		require.Equal(t, 1, conflicts)
+		requireRetryAfter(t, check(limiter, user), KindUsername, time.Second)
+	})
+
+	t.Run("storage errors are returned", func(t *testing.T) {
+		limiter, _, client := newLimiter(t)
+		client.PrependReactor("get", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("some get error")
+		})
+		require.EqualError(t, check(limiter, user), "failed to get login-limit for signature "+shardSignature(user)+": some get error")
+	})
+
+	t.Run("keys without a policy are not limited", func(t *testing.T) {
+		limiter, _, client := newLimiter(t)
+		other := Key{Kind: "other", Value: "x"}
+		for i := 0; i < 10; i++ {
+			someUser := UsernameKey("my-ldap", fmt.Sprintf("user-%d", i))
+			require.NoError(t, check(limiter, someUser, other))
+			fail(t, limiter, someUser, other)
+		}
+		requireRecords(t, client, 10)
+	})
+}
+
+func TestDefaultPolicies(t *testing.T) {
+	ctx := context.Background()
+	newLimiter := func(limitClientIPs bool) (*Limiter, *fake.Clientset) {
+		client := fake.NewSimpleClientset()
+		return New(client.CoreV1().Secrets("test-ns"), time.Now, DefaultPolicies(limitClientIPs)), client
+	}
+	// Many users log in through the same proxy, so all of their requests come from the same address.
+	r := &http.Request{RemoteAddr: "10.1.2.3:45678"}
+	// failForManyUsers makes a failed login attempt for each of many users, and returns the error of the first
+	// attempt which could not begin.
+	failForManyUsers := func(limiter *Limiter) error {
+		for i := 0; i < 200; i++ {
+			attempt, err := limiter.Begin(ctx, UsernameKey("my-ldap", fmt.Sprintf("user-%d", i)), ClientIPKey(r))
+			if err != nil {
+				return err
+			}
+			attempt.Failed()
+			attempt.End(ctx)
+		}
+		return nil
+	}
+
+	t.Run("client IP addresses are not limited by default, so users behind the same proxy do not lock each other out", func(t *testing.T) {
+		limiter, client := newLimiter(false)
+		require.NoError(t, failForManyUsers(limiter))
+
+		attempt, err := limiter.Begin(ctx, UsernameKey("my-ldap", "pinny"), ClientIPKey(r))
+		require.NoError(t, err)
+		attempt.End(ctx)
+
+		shards, err := client.CoreV1().Secrets("test-ns").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		for i := range shards.Items {
+			var stored shard
+			require.NoError(t, crud.FromSecret(TypeLabelValue, &shards.Items[i], &stored))
+			require.NotContains(t, stored.Records, signature(ClientIPKey(r)))
+		}
+	})
+
+	t.Run("client IP addresses are limited when asked to", func(t *testing.T) {
+		limiter, _ := newLimiter(true)
+		err := failForManyUsers(limiter)
+		var tooManyAttemptsErr *TooManyAttemptsError
+		require.True(t, errors.As(err, &tooManyAttemptsErr), "wanted a TooManyAttemptsError but got %v", err)
+		require.Equal(t, KindClientIP, tooManyAttemptsErr.Kind)
+	})
+}
+
+func TestShardPrune(t *testing.T) {
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	s := &shard{Records: map[string]record{
+		"expired": {Failures: 1, LastFailure: now.Add(-resetAfter - time.Second)},
+		"blocked": {Failures: 9, LastFailure: now.Add(-time.Minute), BlockedUntil: now.Add(time.Minute)},
+	}}
+	for i := 0; i < maxRecordsPerShard-1; i++ {
+		s.Records[fmt.Sprintf("unblocked-%d", i)] = record{Failures: 1, LastFailure: now.Add(time.Duration(i-maxRecordsPerShard) * time.Second)}
+	}
+
+	// Making room for a new record removes the expired record and then the oldest record which is not blocked.
+	s.prune(now, "new")
+	require.Len(t, s.Records, maxRecordsPerShard-1)
+	require.NotContains(t, s.Records, "expired")
+	require.NotContains(t, s.Records, "unblocked-0")
+	require.Contains(t, s.Records, "unblocked-1")
+	require.Contains(t, s.Records, "blocked")
+
+	// The record to keep is never removed, even when it is the oldest.
+	s.Records["new"] = record{Failures: 1, LastFailure: now.Add(-time.Hour)}
+	s.Records["another"] = record{Failures: 1, LastFailure: now}
+	s.prune(now, "new")
+	require.Len(t, s.Records, maxRecordsPerShard)
+	require.Contains(t, s.Records, "new")
+	require.NotContains(t, s.Records, "unblocked-1")
+}
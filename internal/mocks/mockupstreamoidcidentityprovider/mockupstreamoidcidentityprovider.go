@@ -15,6 +15,7 @@ import (
 
 	gomock "github.com/golang/mock/gomock"
 	provider "go.pinniped.dev/internal/oidc/provider"
+	totp "go.pinniped.dev/internal/totp"
 	nonce "go.pinniped.dev/pkg/oidcclient/nonce"
 	oidctypes "go.pinniped.dev/pkg/oidcclient/oidctypes"
 	pkce "go.pinniped.dev/pkg/oidcclient/pkce"
@@ -172,6 +173,20 @@ func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) GetScopes() *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetScopes", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).GetScopes))
 }
 
+// GetTOTPMode mocks base method.
+func (m *MockUpstreamOIDCIdentityProviderI) GetTOTPMode() totp.Mode {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTOTPMode")
+	ret0, _ := ret[0].(totp.Mode)
+	return ret0
+}
+
+// GetTOTPMode indicates an expected call of GetTOTPMode.
+func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) GetTOTPMode() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTOTPMode", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).GetTOTPMode))
+}
+
 // GetUsernameClaim mocks base method.
 func (m *MockUpstreamOIDCIdentityProviderI) GetUsernameClaim() string {
 	m.ctrl.T.Helper()
@@ -1,9 +1,10 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package phttp
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"net/http"
 	"time"
@@ -20,6 +21,16 @@ func Default(rootCAs *x509.CertPool) *http.Client {
 	return buildClient(ptls.Default, rootCAs)
 }
 
+// DefaultWithClientCertificate is like Default, but the returned client also presents the given certificate to
+// servers which request a client certificate during the TLS handshake.
+func DefaultWithClientCertificate(rootCAs *x509.CertPool, clientCert tls.Certificate) *http.Client {
+	return buildClient(func(rootCAs *x509.CertPool) *tls.Config {
+		c := ptls.Default(rootCAs)
+		c.Certificates = []tls.Certificate{clientCert}
+		return c
+	}, rootCAs)
+}
+
 func Secure(rootCAs *x509.CertPool) *http.Client {
 	return buildClient(ptls.Secure, rootCAs)
 }
@@ -1,4 +1,4 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package phttp
@@ -8,13 +8,16 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/client-go/util/cert"
 
+	"go.pinniped.dev/internal/certauthority"
 	"go.pinniped.dev/internal/crypto/ptls"
 	"go.pinniped.dev/internal/testutil/tlsserver"
 )
@@ -106,6 +109,41 @@ func TestClient(t *testing.T) {
 	}
 }
 
+func TestClientWithClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	ca, err := certauthority.New("some-client-ca", time.Hour)
+	require.NoError(t, err)
+	clientCert, err := ca.IssueClientCert("some-username", nil, time.Hour)
+	require.NoError(t, err)
+
+	var sawRequest bool
+	server := tlsserver.TLSTestServer(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		// use assert instead of require to not break the http.Handler with a panic
+		if assert.Len(t, r.TLS.PeerCertificates, 1) {
+			assert.Equal(t, "some-username", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		sawRequest = true
+	}), func(server *httptest.Server) {
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLS.ClientCAs = ca.Pool()
+	})
+
+	rootCAs, err := cert.NewPoolFromBytes(tlsserver.TLSTestServerCA(server))
+	require.NoError(t, err)
+
+	c := DefaultWithClientCertificate(rootCAs, *clientCert)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	require.True(t, sawRequest)
+}
+
 func assertUserAgent(t *testing.T, r *http.Request) {
 	t.Helper()
 
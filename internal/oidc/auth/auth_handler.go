@@ -5,8 +5,12 @@
 package auth
 
 import (
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
@@ -21,19 +25,25 @@ import (
 	"go.pinniped.dev/internal/authenticators"
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/loginlimit"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/downstreamsession"
+	"go.pinniped.dev/internal/oidc/par"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
 )
 
 const (
-	promptParamName = "prompt"
-	promptParamNone = "none"
+	promptParamName  = "prompt"
+	promptParamNone  = "none"
+	promptParamLogin = "login"
+	maxAgeParamName  = "max_age"
 )
 
 func NewHandler(
@@ -46,6 +56,9 @@ func NewHandler(
 	generateNonce func() (nonce.Nonce, error),
 	upstreamStateEncoder oidc.Encoder,
 	cookieCodec oidc.Codec,
+	totpVerifier *totp.Verifier,
+	loginLimiter *loginlimit.Limiter,
+	pushedAuthorizationRequests *par.Storage,
 ) http.Handler {
 	return securityheader.Wrap(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		if r.Method != http.MethodPost && r.Method != http.MethodGet {
@@ -55,87 +68,261 @@ func NewHandler(
 			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET or POST)", r.Method)
 		}
 
-		oidcUpstream, ldapUpstream, idpType, err := chooseUpstreamIDP(idpLister)
+		// When the client pushed the parameters of the request beforehand, only its request_uri is sent here.
+		if err := pushedAuthorizationRequests.ResolveAuthorizeRequest(r); err != nil {
+			return writeAuthorizeError(w, oauthHelperWithoutStorage, fosite.NewAuthorizeRequest(), err, false)
+		}
+
+		upstream, err := chooseUpstreamIDP(idpLister)
 		if err != nil {
 			plog.WarningErr("authorize upstream config", err)
 			return err
 		}
 
-		if idpType == psession.ProviderTypeOIDC {
+		switch upstream.idpType {
+		case psession.ProviderTypeOIDC:
 			if len(r.Header.Values(supervisoroidc.AuthorizeUsernameHeaderName)) > 0 {
 				// The client set a username header, so they are trying to log in with a username/password.
-				return handleAuthRequestForOIDCUpstreamPasswordGrant(r, w, oauthHelperWithStorage, oidcUpstream)
+				return handleAuthRequestForOIDCUpstreamPasswordGrant(r, w, oauthHelperWithStorage, upstream.oidc, totpVerifier, loginLimiter)
+			}
+			return handleAuthRequestForUpstreamAuthcodeGrant(r, w,
+				oauthHelperWithoutStorage,
+				generateCSRF, generateNonce, generatePKCE,
+				authcodeRedirectConfigForOIDCUpstream(upstream.oidc),
+				downstreamIssuer,
+				upstreamStateEncoder,
+				cookieCodec,
+			)
+		case psession.ProviderTypeGitHub:
+			return handleAuthRequestForUpstreamAuthcodeGrant(r, w,
+				oauthHelperWithoutStorage,
+				generateCSRF, generateNonce, generatePKCE,
+				authcodeRedirectConfigForGitHubUpstream(upstream.github),
+				downstreamIssuer,
+				upstreamStateEncoder,
+				cookieCodec,
+			)
+		case psession.ProviderTypeSAML:
+			return handleAuthRequestForSAMLUpstream(r, w,
+				oauthHelperWithoutStorage,
+				generateCSRF, generateNonce, generatePKCE,
+				upstream.saml,
+				downstreamIssuer,
+				upstreamStateEncoder,
+				cookieCodec,
+			)
+		case psession.ProviderTypeCertificate:
+			return handleAuthRequestForCertificateUpstream(r, w, oauthHelperWithStorage, upstream.certificate)
+		default:
+			if len(r.Header.Values(supervisoroidc.AuthorizeUsernameHeaderName)) > 0 ||
+				len(r.Header.Values(supervisoroidc.AuthorizePasswordHeaderName)) > 0 {
+				// The client set a username or password header, so they are trying to log in without a browser.
+				return handleAuthRequestForLDAPUpstreamCLIFlow(r, w,
+					oauthHelperWithStorage,
+					upstream.ldap,
+					upstream.idpType,
+					totpVerifier,
+					loginLimiter,
+				)
 			}
-			return handleAuthRequestForOIDCUpstreamAuthcodeGrant(r, w,
+			return handleAuthRequestForLDAPUpstreamBrowserFlow(r, w,
 				oauthHelperWithoutStorage,
 				generateCSRF, generateNonce, generatePKCE,
-				oidcUpstream,
+				upstream.ldap,
+				upstream.idpType,
 				downstreamIssuer,
 				upstreamStateEncoder,
 				cookieCodec,
 			)
 		}
-		return handleAuthRequestForLDAPUpstream(r, w,
-			oauthHelperWithStorage,
-			ldapUpstream,
-			idpType,
-		)
 	}))
 }
 
-func handleAuthRequestForLDAPUpstream(
+// chosenUpstreamIDP holds the single upstream IDP which should be used for an authorization request.
+// Only the field which corresponds to idpType will be set.
+type chosenUpstreamIDP struct {
+	idpType     psession.ProviderType
+	oidc        provider.UpstreamOIDCIdentityProviderI
+	ldap        provider.UpstreamLDAPIdentityProviderI
+	github      provider.UpstreamGitHubIdentityProviderI
+	saml        provider.UpstreamSAMLIdentityProviderI
+	certificate provider.UpstreamCertificateIdentityProviderI
+}
+
+// upstreamAuthcodeRedirectConfig holds the information needed to redirect the user's browser to the
+// authorization endpoint of an upstream which supports the authorization code flow.
+type upstreamAuthcodeRedirectConfig struct {
+	name             string
+	idpType          psession.ProviderType
+	clientID         string
+	authorizationURL *url.URL
+	scopes           []string
+	additionalParams map[string]string
+	// sendNonce should be true when the upstream will return an ID token which includes the nonce.
+	sendNonce bool
+	// forwardReauthentication should be true when the upstream understands the prompt=login and max_age params.
+	// Otherwise, requests which ask for fresh authentication are rejected, since the upstream might just reuse
+	// the session of the user.
+	forwardReauthentication bool
+}
+
+func authcodeRedirectConfigForOIDCUpstream(oidcUpstream provider.UpstreamOIDCIdentityProviderI) *upstreamAuthcodeRedirectConfig {
+	return &upstreamAuthcodeRedirectConfig{
+		name:             oidcUpstream.GetName(),
+		idpType:          psession.ProviderTypeOIDC,
+		clientID:         oidcUpstream.GetClientID(),
+		authorizationURL: oidcUpstream.GetAuthorizationURL(),
+		scopes:           oidcUpstream.GetScopes(),
+		additionalParams: oidcUpstream.GetAdditionalAuthcodeParams(),
+		sendNonce:        true,
+
+		forwardReauthentication: true,
+	}
+}
+
+func authcodeRedirectConfigForGitHubUpstream(githubUpstream provider.UpstreamGitHubIdentityProviderI) *upstreamAuthcodeRedirectConfig {
+	return &upstreamAuthcodeRedirectConfig{
+		name:             githubUpstream.GetName(),
+		idpType:          psession.ProviderTypeGitHub,
+		clientID:         githubUpstream.GetClientID(),
+		authorizationURL: githubUpstream.GetAuthorizationURL(),
+		scopes:           githubUpstream.GetScopes(),
+		// GitHub does not return ID tokens, so it has no use for a nonce.
+		sendNonce: false,
+	}
+}
+
+func handleAuthRequestForLDAPUpstreamCLIFlow(
 	r *http.Request,
 	w http.ResponseWriter,
 	oauthHelper fosite.OAuth2Provider,
 	ldapUpstream provider.UpstreamLDAPIdentityProviderI,
 	idpType psession.ProviderType,
+	totpVerifier *totp.Verifier,
+	loginLimiter *loginlimit.Limiter,
 ) error {
 	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, true)
 	if !created {
 		return nil
 	}
 
+	if !requireTrustedClient(w, oauthHelper, authorizeRequester) {
+		return nil
+	}
+
 	username, password, hadUsernamePasswordValues := requireNonEmptyUsernameAndPasswordHeaders(r, w, oauthHelper, authorizeRequester)
 	if !hadUsernamePasswordValues {
 		return nil
 	}
 
+	loginAttempt, err := beginLoginAttemptForCLIFlow(r, w, oauthHelper, authorizeRequester, loginLimiter,
+		loginlimit.UsernameKey(ldapUpstream.GetName(), username))
+	if loginAttempt == nil {
+		return err
+	}
+	defer loginAttempt.End(r.Context())
+
 	authenticateResponse, authenticated, err := ldapUpstream.AuthenticateUser(r.Context(), username, password)
+	var accountStateErr *authenticators.AccountStateError
+	if errors.As(err, &accountStateErr) {
+		plog.InfoErr("upstream LDAP authentication failed because of the state of the user's account", err,
+			"upstreamName", ldapUpstream.GetName(), "reason", accountStateErr.Reason)
+		// The description does not include any details from the upstream, so it is safe to return to the client.
+		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+			fosite.ErrAccessDenied.WithHintf("%s", accountStateErr.Description()), true)
+	}
 	if err != nil {
 		plog.WarningErr("unexpected error during upstream LDAP authentication", err, "upstreamName", ldapUpstream.GetName())
 		return httperr.New(http.StatusBadGateway, "unexpected error during upstream authentication")
 	}
 	if !authenticated {
+		loginAttempt.Failed()
 		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
 			fosite.ErrAccessDenied.WithHintf("Username/password not accepted by LDAP provider."), true)
 	}
 
-	subject := downstreamSubjectFromUpstreamLDAP(ldapUpstream, authenticateResponse)
+	subject := downstreamsession.DownstreamSubjectFromUpstreamLDAP(ldapUpstream, authenticateResponse)
 	username = authenticateResponse.User.GetName()
 	groups := authenticateResponse.User.GetGroups()
-	dn := authenticateResponse.DN
+	customSessionData := downstreamsession.MakeDownstreamLDAPOrADCustomSessionData(ldapUpstream, idpType, authenticateResponse)
 
-	customSessionData := &psession.CustomSessionData{
-		ProviderUID:  ldapUpstream.GetResourceUID(),
-		ProviderName: ldapUpstream.GetName(),
-		ProviderType: idpType,
+	if verified, err := verifyTOTPCodeForCLIFlow(r, w, oauthHelper, authorizeRequester, totpVerifier,
+		ldapUpstream.GetTOTPMode(), downstreamsession.TOTPUser(subject, username, ldapUpstream.GetName()),
+		loginAttempt); !verified {
+		return err
 	}
+	loginAttempt.Succeeded()
 
-	if idpType == psession.ProviderTypeLDAP {
-		customSessionData.LDAP = &psession.LDAPSessionData{
-			UserDN:                 dn,
-			ExtraRefreshAttributes: authenticateResponse.ExtraRefreshAttributes,
-		}
+	return makeDownstreamSessionAndReturnAuthcodeRedirect(r, w,
+		oauthHelper, authorizeRequester, subject, username, groups, customSessionData, nil)
+}
+
+// handleAuthRequestForLDAPUpstreamBrowserFlow redirects the user's browser to the Supervisor's own login page,
+// where they can enter their LDAP or Active Directory username and password.
+func handleAuthRequestForLDAPUpstreamBrowserFlow(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	generateCSRF func() (csrftoken.CSRFToken, error),
+	generateNonce func() (nonce.Nonce, error),
+	generatePKCE func() (pkce.Code, error),
+	ldapUpstream provider.UpstreamLDAPIdentityProviderI,
+	idpType psession.ProviderType,
+	downstreamIssuer string,
+	upstreamStateEncoder oidc.Encoder,
+	cookieCodec oidc.Codec,
+) error {
+	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, false)
+	if !created {
+		return nil
+	}
+
+	if err := performOIDCValidations(r, oauthHelper, authorizeRequester); err != nil {
+		return writeAuthorizeError(w, oauthHelper, authorizeRequester, err, false)
+	}
+
+	csrfValue, nonceValue, pkceValue, err := generateValues(generateCSRF, generateNonce, generatePKCE)
+	if err != nil {
+		plog.Error("authorize generate error", err)
+		return err
+	}
+	csrfFromCookie := readCSRFCookie(r, cookieCodec)
+	if csrfFromCookie != "" {
+		csrfValue = csrfFromCookie
+	}
+
+	encodedStateParamValue, err := upstreamStateParam(
+		authorizeRequester,
+		ldapUpstream.GetName(),
+		idpType,
+		nonceValue,
+		csrfValue,
+		pkceValue,
+		upstreamStateEncoder,
+	)
+	if err != nil {
+		plog.Error("authorize upstream state param error", err)
+		return err
 	}
-	if idpType == psession.ProviderTypeActiveDirectory {
-		customSessionData.ActiveDirectory = &psession.ActiveDirectorySessionData{
-			UserDN:                 dn,
-			ExtraRefreshAttributes: authenticateResponse.ExtraRefreshAttributes,
+
+	promptParam := r.Form.Get(promptParamName)
+	if promptParam == promptParamNone && oidc.ScopeWasRequested(authorizeRequester, coreosoidc.ScopeOpenID) {
+		return writeAuthorizeError(w, oauthHelper, authorizeRequester, fosite.ErrLoginRequired, false)
+	}
+
+	if csrfFromCookie == "" {
+		// We did not receive an incoming CSRF cookie, so write a new one.
+		err := addCSRFSetCookieHeader(w, csrfValue, cookieCodec)
+		if err != nil {
+			plog.Error("error setting CSRF cookie", err)
+			return err
 		}
 	}
 
-	return makeDownstreamSessionAndReturnAuthcodeRedirect(r, w,
-		oauthHelper, authorizeRequester, subject, username, groups, customSessionData)
+	loginURL := downstreamIssuer + oidc.LoginEndpointPath + "?" + url.Values{"state": []string{encodedStateParamValue}}.Encode()
+	http.Redirect(w, r, loginURL, http.StatusSeeOther)
+
+	return nil
 }
 
 func handleAuthRequestForOIDCUpstreamPasswordGrant(
@@ -143,12 +330,18 @@ func handleAuthRequestForOIDCUpstreamPasswordGrant(
 	w http.ResponseWriter,
 	oauthHelper fosite.OAuth2Provider,
 	oidcUpstream provider.UpstreamOIDCIdentityProviderI,
+	totpVerifier *totp.Verifier,
+	loginLimiter *loginlimit.Limiter,
 ) error {
 	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, true)
 	if !created {
 		return nil
 	}
 
+	if !requireTrustedClient(w, oauthHelper, authorizeRequester) {
+		return nil
+	}
+
 	username, password, hadUsernamePasswordValues := requireNonEmptyUsernameAndPasswordHeaders(r, w, oauthHelper, authorizeRequester)
 	if !hadUsernamePasswordValues {
 		return nil
@@ -161,6 +354,16 @@ func handleAuthRequestForOIDCUpstreamPasswordGrant(
 				"Resource owner password credentials grant is not allowed for this upstream provider according to its configuration."), true)
 	}
 
+	loginAttempt, err := beginLoginAttemptForCLIFlow(r, w, oauthHelper, authorizeRequester, loginLimiter,
+		loginlimit.UsernameKey(oidcUpstream.GetName(), username))
+	if loginAttempt == nil {
+		return err
+	}
+	defer loginAttempt.End(r.Context())
+
+	// The auth_time claim of the upstream ID token only has a precision of seconds. Truncate the time of the request
+	// to match, so that a user who was authenticated by the upstream just now does not look like a stale session.
+	requestedAt := time.Now().Truncate(time.Second)
 	token, err := oidcUpstream.PasswordCredentialsGrantAndValidateTokens(r.Context(), username, password)
 	if err != nil {
 		// Upstream password grant errors can be generic errors (e.g. a network failure) or can be oauth2.RetrieveError errors
@@ -170,6 +373,11 @@ func handleAuthRequestForOIDCUpstreamPasswordGrant(
 		// However, the exact response is undefined in the sense that there is no such thing as a password grant in
 		// the OIDC spec, so we don't try too hard to read the upstream errors in this case. (E.g. Dex departs from the
 		// spec and returns something other than an "invalid_grant" error for bad resource owner credentials.)
+		// Wrong credentials are still expected to cause a 400 or 401 response, so only those count as a failed login
+		// attempt. Other errors, e.g. when the upstream is down, say nothing about the user's credentials.
+		if isUpstreamCredentialsError(err) {
+			loginAttempt.Failed()
+		}
 		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
 			fosite.ErrAccessDenied.WithDebug(err.Error()), true) // WithDebug hides the error from the client
 	}
@@ -189,17 +397,104 @@ func handleAuthRequestForOIDCUpstreamPasswordGrant(
 		)
 	}
 
-	return makeDownstreamSessionAndReturnAuthcodeRedirect(r, w, oauthHelper, authorizeRequester, subject, username, groups, customSessionData)
+	if verified, err := verifyTOTPCodeForCLIFlow(r, w, oauthHelper, authorizeRequester, totpVerifier,
+		oidcUpstream.GetTOTPMode(), downstreamsession.TOTPUser(subject, username, oidcUpstream.GetName()),
+		loginAttempt); !verified {
+		return err
+	}
+	loginAttempt.Succeeded()
+
+	authn := downstreamsession.UpstreamAuthentication(token.IDToken.Claims)
+	authn.RequestedAt = requestedAt
+
+	return makeDownstreamSessionAndReturnAuthcodeRedirect(r, w, oauthHelper, authorizeRequester, subject, username, groups, customSessionData, authn)
+}
+
+// isUpstreamCredentialsError returns true when an upstream password grant error looks like it was caused by wrong
+// resource owner credentials.
+func isUpstreamCredentialsError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || retrieveErr.Response == nil {
+		return false
+	}
+	return retrieveErr.Response.StatusCode == http.StatusBadRequest || retrieveErr.Response.StatusCode == http.StatusUnauthorized
+}
+
+// verifyTOTPCodeForCLIFlow checks the TOTP code header after the user's password was accepted by the upstream.
+// It returns true when the login may continue. Otherwise, it has already written the response, and the caller
+// should return the error. When a code is needed, the response tells the CLI to ask the user for a code and to
+// try again. Users of an identity provider with an optional TOTP mode can only enroll using the login page.
+func verifyTOTPCodeForCLIFlow(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	authorizeRequester fosite.AuthorizeRequester,
+	totpVerifier *totp.Verifier,
+	mode totp.Mode,
+	user totp.User,
+	loginAttempt *loginlimit.Attempt,
+) (bool, error) {
+	code := r.Header.Get(supervisoroidc.AuthorizeTOTPCodeHeaderName)
+	err := totpVerifier.Verify(r.Context(), mode, user, code, false)
+	if err == nil {
+		return true, nil
+	}
+
+	var challenge *totp.ChallengeError
+	if !errors.As(err, &challenge) {
+		plog.WarningErr("unexpected error during TOTP verification", err)
+		return false, httperr.New(http.StatusInternalServerError, "unexpected error during TOTP verification")
+	}
+
+	w.Header().Set(supervisoroidc.AuthorizeTOTPRequiredHeaderName, string(challenge.Reason))
+	if challenge.Reason == totp.ChallengeEnrollmentRequired {
+		w.Header().Set(supervisoroidc.AuthorizeTOTPEnrollmentURIHeaderName, challenge.KeyURI)
+	}
+	hint := "A TOTP code is required."
+	if challenge.InvalidCode {
+		hint = "The TOTP code was not accepted."
+		loginAttempt.Failed()
+	}
+	return false, writeAuthorizeError(w, oauthHelper, authorizeRequester, fosite.ErrAccessDenied.WithHint(hint), true)
+}
+
+// beginLoginAttemptForCLIFlow begins a login attempt of the username from the client. When the username or the
+// client made too many failed login attempts recently, it returns a nil attempt after writing the response, and the
+// caller should return the error. The response tells the client how long to wait in its Retry-After header.
+func beginLoginAttemptForCLIFlow(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	authorizeRequester fosite.AuthorizeRequester,
+	loginLimiter *loginlimit.Limiter,
+	usernameKey loginlimit.Key,
+) (*loginlimit.Attempt, error) {
+	loginAttempt, err := loginLimiter.Begin(r.Context(), usernameKey, loginlimit.ClientIPKey(r))
+	if err == nil {
+		return loginAttempt, nil
+	}
+
+	var tooManyAttemptsErr *loginlimit.TooManyAttemptsError
+	if !errors.As(err, &tooManyAttemptsErr) {
+		plog.WarningErr("unexpected error while checking login limits", err)
+		return nil, httperr.New(http.StatusInternalServerError, "unexpected error while checking login limits")
+	}
+
+	plog.Info("login attempt rejected because of too many failed attempts",
+		"kind", tooManyAttemptsErr.Kind, "retryAfter", tooManyAttemptsErr.RetryAfter)
+	w.Header().Set("Retry-After", tooManyAttemptsErr.RetryAfterSeconds())
+	return nil, writeAuthorizeError(w, oauthHelper, authorizeRequester,
+		fosite.ErrAccessDenied.WithHintf("Too many failed login attempts. Try again in %s.", tooManyAttemptsErr.RetryAfter), true)
 }
 
-func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
+func handleAuthRequestForUpstreamAuthcodeGrant(
 	r *http.Request,
 	w http.ResponseWriter,
 	oauthHelper fosite.OAuth2Provider,
 	generateCSRF func() (csrftoken.CSRFToken, error),
 	generateNonce func() (nonce.Nonce, error),
 	generatePKCE func() (pkce.Code, error),
-	oidcUpstream provider.UpstreamOIDCIdentityProviderI,
+	upstream *upstreamAuthcodeRedirectConfig,
 	downstreamIssuer string,
 	upstreamStateEncoder oidc.Encoder,
 	cookieCodec oidc.Codec,
@@ -209,18 +504,7 @@ func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
 		return nil
 	}
 
-	now := time.Now()
-	_, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, &psession.PinnipedSession{
-		Fosite: &openid.DefaultSession{
-			Claims: &jwt.IDTokenClaims{
-				// Temporary claim values to allow `NewAuthorizeResponse` to perform other OIDC validations.
-				Subject:     "none",
-				AuthTime:    now,
-				RequestedAt: now,
-			},
-		},
-	})
-	if err != nil {
+	if err := performOIDCValidations(r, oauthHelper, authorizeRequester); err != nil {
 		return writeAuthorizeError(w, oauthHelper, authorizeRequester, err, false)
 	}
 
@@ -235,17 +519,18 @@ func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
 	}
 
 	upstreamOAuthConfig := oauth2.Config{
-		ClientID: oidcUpstream.GetClientID(),
+		ClientID: upstream.clientID,
 		Endpoint: oauth2.Endpoint{
-			AuthURL: oidcUpstream.GetAuthorizationURL().String(),
+			AuthURL: upstream.authorizationURL.String(),
 		},
 		RedirectURL: fmt.Sprintf("%s/callback", downstreamIssuer),
-		Scopes:      oidcUpstream.GetScopes(),
+		Scopes:      upstream.scopes,
 	}
 
 	encodedStateParamValue, err := upstreamStateParam(
 		authorizeRequester,
-		oidcUpstream.GetName(),
+		upstream.name,
+		upstream.idpType,
 		nonceValue,
 		csrfValue,
 		pkceValue,
@@ -257,17 +542,23 @@ func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
 	}
 
 	authCodeOptions := []oauth2.AuthCodeOption{
-		nonceValue.Param(),
 		pkceValue.Challenge(),
 		pkceValue.Method(),
 	}
+	if upstream.sendNonce {
+		authCodeOptions = append(authCodeOptions, nonceValue.Param())
+	}
 
 	promptParam := r.Form.Get(promptParamName)
 	if promptParam == promptParamNone && oidc.ScopeWasRequested(authorizeRequester, coreosoidc.ScopeOpenID) {
 		return writeAuthorizeError(w, oauthHelper, authorizeRequester, fosite.ErrLoginRequired, false)
 	}
+	if !upstream.forwardReauthentication && requestsFreshAuthentication(r) {
+		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+			fosite.ErrLoginRequired.WithHint("The upstream identity provider does not support prompt=login or max_age."), false)
+	}
 
-	for key, val := range oidcUpstream.GetAdditionalAuthcodeParams() {
+	for key, val := range upstreamAdditionalParams(r, upstream) {
 		authCodeOptions = append(authCodeOptions, oauth2.SetAuthURLParam(key, val))
 	}
 
@@ -291,6 +582,207 @@ func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
 	return nil
 }
 
+// upstreamAdditionalParams returns the params which are added to the upstream authorization request. When the
+// downstream request asks for fresh authentication with prompt=login or max_age, they are combined with the params
+// which the upstream was configured with, so that the upstream does not just reuse the session of the user.
+func upstreamAdditionalParams(r *http.Request, upstream *upstreamAuthcodeRedirectConfig) map[string]string {
+	if !upstream.forwardReauthentication {
+		return upstream.additionalParams
+	}
+
+	params := make(map[string]string, len(upstream.additionalParams)+2)
+	for key, val := range upstream.additionalParams {
+		params[key] = val
+	}
+
+	if promptValues := strings.Fields(r.Form.Get(promptParamName)); containsString(promptValues, promptParamLogin) {
+		upstreamPromptValues := strings.Fields(params[promptParamName])
+		if !containsString(upstreamPromptValues, promptParamLogin) {
+			params[promptParamName] = strings.Join(append(upstreamPromptValues, promptParamLogin), " ")
+		}
+	}
+
+	// Only make the configured max_age stricter, never looser.
+	if maxAge, err := strconv.ParseInt(r.Form.Get(maxAgeParamName), 10, 64); err == nil && maxAge >= 0 {
+		configuredMaxAge, err := strconv.ParseInt(params[maxAgeParamName], 10, 64)
+		if err != nil || maxAge < configuredMaxAge {
+			params[maxAgeParamName] = strconv.FormatInt(maxAge, 10)
+		}
+	}
+
+	return params
+}
+
+// requestsFreshAuthentication returns whether the downstream authorization request asks for fresh authentication
+// with prompt=login or max_age.
+func requestsFreshAuthentication(r *http.Request) bool {
+	if containsString(strings.Fields(r.Form.Get(promptParamName)), promptParamLogin) {
+		return true
+	}
+	maxAge, err := strconv.ParseInt(r.Form.Get(maxAgeParamName), 10, 64)
+	return err == nil && maxAge >= 0
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func handleAuthRequestForSAMLUpstream(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	generateCSRF func() (csrftoken.CSRFToken, error),
+	generateNonce func() (nonce.Nonce, error),
+	generatePKCE func() (pkce.Code, error),
+	samlUpstream provider.UpstreamSAMLIdentityProviderI,
+	downstreamIssuer string,
+	upstreamStateEncoder oidc.Encoder,
+	cookieCodec oidc.Codec,
+) error {
+	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, false)
+	if !created {
+		return nil
+	}
+
+	if err := performOIDCValidations(r, oauthHelper, authorizeRequester); err != nil {
+		return writeAuthorizeError(w, oauthHelper, authorizeRequester, err, false)
+	}
+
+	csrfValue, nonceValue, pkceValue, err := generateValues(generateCSRF, generateNonce, generatePKCE)
+	if err != nil {
+		plog.Error("authorize generate error", err)
+		return err
+	}
+	csrfFromCookie := readCSRFCookie(r, cookieCodec)
+	if csrfFromCookie != "" {
+		csrfValue = csrfFromCookie
+	}
+
+	encodedStateParamValue, err := upstreamStateParam(
+		authorizeRequester,
+		samlUpstream.GetName(),
+		psession.ProviderTypeSAML,
+		nonceValue,
+		csrfValue,
+		pkceValue,
+		upstreamStateEncoder,
+	)
+	if err != nil {
+		plog.Error("authorize upstream state param error", err)
+		return err
+	}
+
+	promptParam := r.Form.Get(promptParamName)
+	if promptParam == promptParamNone && oidc.ScopeWasRequested(authorizeRequester, coreosoidc.ScopeOpenID) {
+		return writeAuthorizeError(w, oauthHelper, authorizeRequester, fosite.ErrLoginRequired, false)
+	}
+	// SAML identity providers may reuse the session of the user, and do not say when the user authenticated.
+	if requestsFreshAuthentication(r) {
+		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+			fosite.ErrLoginRequired.WithHint("The upstream identity provider does not support prompt=login or max_age."), false)
+	}
+
+	sp, err := oidc.SAMLServiceProviderForIssuer(downstreamIssuer)
+	if err != nil {
+		return httperr.Wrap(http.StatusInternalServerError, "error building SAML service provider configuration", err)
+	}
+
+	// The state param is too long to be sent as the RelayState, so it is kept in a cookie and only its handle is
+	// sent. The nonce is used as the ID of the AuthnRequest, so that the ACS endpoint can check that the response
+	// is to this request.
+	redirectURL, err := samlUpstream.AuthnRequestURL(sp, oidc.SAMLRequestID(nonceValue), oidc.SAMLRelayState(encodedStateParamValue))
+	if err != nil {
+		plog.WarningErr("error creating SAML authentication request", err, "upstreamName", samlUpstream.GetName())
+		return httperr.Wrap(http.StatusInternalServerError, "error creating SAML authentication request", err)
+	}
+
+	if csrfFromCookie == "" {
+		// We did not receive an incoming CSRF cookie, so write a new one.
+		err := addCSRFSetCookieHeader(w, csrfValue, cookieCodec)
+		if err != nil {
+			plog.Error("error setting CSRF cookie", err)
+			return err
+		}
+	}
+	// Always write the SAML state cookie, because the response from the identity provider will arrive on a
+	// cross-site POST request, which will not include the usual CSRF cookie.
+	if err := addSAMLStateSetCookieHeader(w, encodedStateParamValue, cookieCodec); err != nil {
+		plog.Error("error setting SAML state cookie", err)
+		return err
+	}
+
+	http.Redirect(w, r, redirectURL.String(), http.StatusSeeOther)
+
+	return nil
+}
+
+// handleAuthRequestForCertificateUpstream authenticates the user by the client certificate which was presented during
+// the TLS handshake. Browsers and the CLI send the same request, so the authcode is returned immediately to both, and
+// only trusted clients may use this flow.
+func handleAuthRequestForCertificateUpstream(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	certificateUpstream provider.UpstreamCertificateIdentityProviderI,
+) error {
+	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, true)
+	if !created {
+		return nil
+	}
+
+	if !requireTrustedClient(w, oauthHelper, authorizeRequester) {
+		return nil
+	}
+
+	var peerCertificates []*x509.Certificate
+	if r.TLS != nil {
+		peerCertificates = r.TLS.PeerCertificates
+	}
+
+	user, err := certificateUpstream.AuthenticateCertificate(peerCertificates)
+	if err != nil {
+		plog.InfoErr("upstream client certificate authentication failed", err, "upstreamName", certificateUpstream.GetName())
+		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+			fosite.ErrAccessDenied.WithHintf("Client certificate not accepted."), true)
+	}
+
+	rawPeerCertificates := make([][]byte, 0, len(peerCertificates))
+	for _, cert := range peerCertificates {
+		rawPeerCertificates = append(rawPeerCertificates, cert.Raw)
+	}
+	customSessionData := &psession.CustomSessionData{
+		ProviderUID:  certificateUpstream.GetResourceUID(),
+		ProviderName: certificateUpstream.GetName(),
+		ProviderType: psession.ProviderTypeCertificate,
+		Certificate:  &psession.CertificateSessionData{PeerCertificates: rawPeerCertificates},
+	}
+
+	return makeDownstreamSessionAndReturnAuthcodeRedirect(r, w,
+		oauthHelper, authorizeRequester, user.DownstreamSubject, user.Username, user.Groups, customSessionData, nil)
+}
+
+// performOIDCValidations asks fosite to validate the authorization request using a temporary session, since the
+// real session can only be created after the user has logged in to the upstream IDP.
+func performOIDCValidations(r *http.Request, oauthHelper fosite.OAuth2Provider, authorizeRequester fosite.AuthorizeRequester) error {
+	now := time.Now()
+	_, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, &psession.PinnipedSession{
+		Fosite: &openid.DefaultSession{
+			Claims: &jwt.IDTokenClaims{
+				// Temporary claim values to allow `NewAuthorizeResponse` to perform other OIDC validations.
+				Subject:     "none",
+				AuthTime:    now,
+				RequestedAt: now,
+			},
+		},
+	})
+	return err
+}
+
 func writeAuthorizeError(w http.ResponseWriter, oauthHelper fosite.OAuth2Provider, authorizeRequester fosite.AuthorizeRequester, err error, isBrowserless bool) error {
 	if plog.Enabled(plog.LevelTrace) {
 		// When trace level logging is enabled, include the stack trace in the log message.
@@ -321,8 +813,9 @@ func makeDownstreamSessionAndReturnAuthcodeRedirect(
 	username string,
 	groups []string,
 	customSessionData *psession.CustomSessionData,
+	authn *downstreamsession.Authentication,
 ) error {
-	openIDSession := downstreamsession.MakeDownstreamSession(subject, username, groups, customSessionData)
+	openIDSession := downstreamsession.MakeDownstreamSession(subject, username, groups, customSessionData, authn)
 
 	authorizeResponder, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, openIDSession)
 	if err != nil {
@@ -369,6 +862,19 @@ func requireNonEmptyUsernameAndPasswordHeaders(r *http.Request, w http.ResponseW
 	return username, password, true
 }
 
+// requireTrustedClient writes an access_denied error unless the client of the request is trusted, such as the
+// Pinniped CLI. The browserless flows and the client certificate flow return an authcode without showing any page to
+// the user, so they cannot ask users whether they consent to other clients receiving their tokens. It returns whether
+// the request may continue.
+func requireTrustedClient(w http.ResponseWriter, oauthHelper fosite.OAuth2Provider, authorizeRequester fosite.AuthorizeRequester) bool {
+	if client, ok := authorizeRequester.GetClient().(*clientregistry.Client); ok && client.Trusted {
+		return true
+	}
+	_ = writeAuthorizeError(w, oauthHelper, authorizeRequester,
+		fosite.ErrAccessDenied.WithHint("Only trusted clients may use this login flow, because it cannot ask users for their consent."), true)
+	return false
+}
+
 func newAuthorizeRequest(r *http.Request, w http.ResponseWriter, oauthHelper fosite.OAuth2Provider, isBrowserless bool) (fosite.AuthorizeRequester, bool) {
 	authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), r)
 	if err != nil {
@@ -404,18 +910,40 @@ func readCSRFCookie(r *http.Request, codec oidc.Decoder) csrftoken.CSRFToken {
 	return csrfFromCookie
 }
 
-// Select either an OIDC, an LDAP or an AD IDP, or return an error.
-func chooseUpstreamIDP(idpLister oidc.UpstreamIdentityProvidersLister) (provider.UpstreamOIDCIdentityProviderI, provider.UpstreamLDAPIdentityProviderI, psession.ProviderType, error) {
+// CertificateUpstream returns the client certificate IDP which authenticates the users of the authorize endpoint,
+// or nil when another kind of IDP authenticates them, or when no single IDP is configured.
+func CertificateUpstream(idpLister oidc.UpstreamIdentityProvidersLister) provider.UpstreamCertificateIdentityProviderI {
+	certificateUpstreams := idpLister.GetCertificateIdentityProviders()
+	if len(certificateUpstreams) != 1 || countUpstreamIDPs(idpLister) != 1 {
+		return nil
+	}
+	return certificateUpstreams[0]
+}
+
+func countUpstreamIDPs(idpLister oidc.UpstreamIdentityProvidersLister) int {
+	return len(idpLister.GetOIDCIdentityProviders()) +
+		len(idpLister.GetLDAPIdentityProviders()) +
+		len(idpLister.GetActiveDirectoryIdentityProviders()) +
+		len(idpLister.GetGitHubIdentityProviders()) +
+		len(idpLister.GetSAMLIdentityProviders()) +
+		len(idpLister.GetCertificateIdentityProviders())
+}
+
+// Select either an OIDC, an LDAP, an AD, a GitHub, a SAML, or a client certificate IDP, or return an error.
+func chooseUpstreamIDP(idpLister oidc.UpstreamIdentityProvidersLister) (*chosenUpstreamIDP, error) {
 	oidcUpstreams := idpLister.GetOIDCIdentityProviders()
 	ldapUpstreams := idpLister.GetLDAPIdentityProviders()
 	adUpstreams := idpLister.GetActiveDirectoryIdentityProviders()
-	switch {
-	case len(oidcUpstreams)+len(ldapUpstreams)+len(adUpstreams) == 0:
-		return nil, nil, "", httperr.New(
+	githubUpstreams := idpLister.GetGitHubIdentityProviders()
+	samlUpstreams := idpLister.GetSAMLIdentityProviders()
+	certificateUpstreams := idpLister.GetCertificateIdentityProviders()
+	switch count := countUpstreamIDPs(idpLister); {
+	case count == 0:
+		return nil, httperr.New(
 			http.StatusUnprocessableEntity,
 			"No upstream providers are configured",
 		)
-	case len(oidcUpstreams)+len(ldapUpstreams)+len(adUpstreams) > 1:
+	case count > 1:
 		var upstreamIDPNames []string
 		for _, idp := range oidcUpstreams {
 			upstreamIDPNames = append(upstreamIDPNames, idp.GetName())
@@ -426,17 +954,32 @@ func chooseUpstreamIDP(idpLister oidc.UpstreamIdentityProvidersLister) (provider
 		for _, idp := range adUpstreams {
 			upstreamIDPNames = append(upstreamIDPNames, idp.GetName())
 		}
+		for _, idp := range githubUpstreams {
+			upstreamIDPNames = append(upstreamIDPNames, idp.GetName())
+		}
+		for _, idp := range samlUpstreams {
+			upstreamIDPNames = append(upstreamIDPNames, idp.GetName())
+		}
+		for _, idp := range certificateUpstreams {
+			upstreamIDPNames = append(upstreamIDPNames, idp.GetName())
+		}
 		plog.Warning("Too many upstream providers are configured (found: %s)", upstreamIDPNames)
-		return nil, nil, "", httperr.New(
+		return nil, httperr.New(
 			http.StatusUnprocessableEntity,
 			"Too many upstream providers are configured (support for multiple upstreams is not yet implemented)",
 		)
 	case len(oidcUpstreams) == 1:
-		return oidcUpstreams[0], nil, psession.ProviderTypeOIDC, nil
+		return &chosenUpstreamIDP{idpType: psession.ProviderTypeOIDC, oidc: oidcUpstreams[0]}, nil
+	case len(githubUpstreams) == 1:
+		return &chosenUpstreamIDP{idpType: psession.ProviderTypeGitHub, github: githubUpstreams[0]}, nil
+	case len(samlUpstreams) == 1:
+		return &chosenUpstreamIDP{idpType: psession.ProviderTypeSAML, saml: samlUpstreams[0]}, nil
+	case len(certificateUpstreams) == 1:
+		return &chosenUpstreamIDP{idpType: psession.ProviderTypeCertificate, certificate: certificateUpstreams[0]}, nil
 	case len(adUpstreams) == 1:
-		return nil, adUpstreams[0], psession.ProviderTypeActiveDirectory, nil
+		return &chosenUpstreamIDP{idpType: psession.ProviderTypeActiveDirectory, ldap: adUpstreams[0]}, nil
 	default:
-		return nil, ldapUpstreams[0], psession.ProviderTypeLDAP, nil
+		return &chosenUpstreamIDP{idpType: psession.ProviderTypeLDAP, ldap: ldapUpstreams[0]}, nil
 	}
 }
 
@@ -463,6 +1006,7 @@ func generateValues(
 func upstreamStateParam(
 	authorizeRequester fosite.AuthorizeRequester,
 	upstreamName string,
+	upstreamType psession.ProviderType,
 	nonceValue nonce.Nonce,
 	csrfValue csrftoken.CSRFToken,
 	pkceValue pkce.Code,
@@ -471,10 +1015,12 @@ func upstreamStateParam(
 	stateParamData := oidc.UpstreamStateParamData{
 		AuthParams:    authorizeRequester.GetRequestForm().Encode(),
 		UpstreamName:  upstreamName,
+		UpstreamType:  string(upstreamType),
 		Nonce:         nonceValue,
 		CSRFToken:     csrfValue,
 		PKCECode:      pkceValue,
 		FormatVersion: oidc.UpstreamStateParamFormatVersion,
+		RequestedAt:   time.Now().Unix(),
 	}
 	encodedStateParamValue, err := encoder.Encode(oidc.UpstreamStateParamEncodingName, stateParamData)
 	if err != nil {
@@ -501,7 +1047,20 @@ func addCSRFSetCookieHeader(w http.ResponseWriter, csrfValue csrftoken.CSRFToken
 	return nil
 }
 
-func downstreamSubjectFromUpstreamLDAP(ldapUpstream provider.UpstreamLDAPIdentityProviderI, authenticateResponse *authenticators.Response) string {
-	ldapURL := *ldapUpstream.GetURL()
-	return downstreamsession.DownstreamLDAPSubject(authenticateResponse.User.GetUID(), ldapURL)
+func addSAMLStateSetCookieHeader(w http.ResponseWriter, encodedStateParamValue string, codec oidc.Encoder) error {
+	encodedCookieValue, err := codec.Encode(oidc.SAMLStateCookieEncodingName, encodedStateParamValue)
+	if err != nil {
+		return httperr.Wrap(http.StatusInternalServerError, "error encoding SAML state cookie", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidc.SAMLStateCookieName,
+		Value:    encodedCookieValue,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+		Path:     "/",
+	})
+
+	return nil
 }
@@ -4,7 +4,11 @@
 package auth
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"html"
@@ -19,6 +23,7 @@ import (
 	"github.com/gorilla/securecookie"
 	"github.com/ory/fosite"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apiserver/pkg/authentication/user"
@@ -27,14 +32,19 @@ import (
 	"k8s.io/utils/pointer"
 
 	"go.pinniped.dev/internal/authenticators"
+	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/loginlimit"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/par"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/oidctestutil"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
 )
@@ -49,6 +59,12 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		ldapUpstreamResourceUID              = "ldap-resource-uid"
 		activeDirectoryUpstreamName          = "some-active-directory-idp"
 		activeDirectoryUpstreamResourceUID   = "active-directory-resource-uid"
+		githubUpstreamName                   = "some-github-idp"
+		githubUpstreamResourceUID            = "github-resource-uid"
+		samlUpstreamName                     = "some-saml-idp"
+		samlUpstreamResourceUID              = "saml-resource-uid"
+		certificateUpstreamName              = "some-certificate-idp"
+		certificateUpstreamResourceUID       = "certificate-resource-uid"
 
 		oidcUpstreamIssuer                    = "https://my-upstream-issuer.com"
 		oidcUpstreamSubject                   = "abc123-some guid" // has a space character which should get escaped in URL
@@ -84,6 +100,13 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			 }
 		`)
 
+		fositeUnknownRequestURIErrorBody = here.Doc(`
+			{
+				"error":             "invalid_request_uri",
+				"error_description": "The request_uri in the Authorization Request returns an error or contains invalid data. The request_uri is unknown, expired, or was already used."
+			}
+		`)
+
 		fositeInvalidRedirectURIErrorBody = here.Doc(`
 			{
 				"error":             "invalid_request",
@@ -151,6 +174,24 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			"state":             happyState,
 		}
 
+		fositeAccessDeniedWithBadClientCertificateHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. Client certificate not accepted.",
+			"state":             happyState,
+		}
+
+		fositeAccessDeniedWithPasswordExpiredHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. Your password has expired. Please change your password and try again.",
+			"state":             happyState,
+		}
+
+		fositeAccessDeniedWithAccountLockedHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. Your account is locked. Please contact your administrator.",
+			"state":             happyState,
+		}
+
 		fositeAccessDeniedWithMissingUsernamePasswordHintErrorQuery = map[string]string{
 			"error":             "access_denied",
 			"error_description": "The resource owner or authorization server denied the request. Missing or blank username or password.",
@@ -205,11 +246,47 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			"state":             happyState,
 		}
 
+		fositeAccessDeniedWithTOTPRequiredHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. A TOTP code is required.",
+			"state":             happyState,
+		}
+
+		fositeAccessDeniedWithTOTPNotAcceptedHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. The TOTP code was not accepted.",
+			"state":             happyState,
+		}
+
+		fositeAccessDeniedWithTooManyAttemptsForOneMinuteHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. Too many failed login attempts. Try again in 1m0s.",
+			"state":             happyState,
+		}
+
+		fositeAccessDeniedWithTooManyAttemptsForFifteenMinutesHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. Too many failed login attempts. Try again in 15m0s.",
+			"state":             happyState,
+		}
+
+		fositeAccessDeniedWithUntrustedClientHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. Only trusted clients may use this login flow, because it cannot ask users for their consent.",
+			"state":             happyState,
+		}
+
 		fositeLoginRequiredErrorQuery = map[string]string{
 			"error":             "login_required",
 			"error_description": "The Authorization Server requires End-User authentication.",
 			"state":             happyState,
 		}
+
+		fositeLoginRequiredWithFreshAuthenticationNotSupportedHintErrorQuery = map[string]string{
+			"error":             "login_required",
+			"error_description": "The Authorization Server requires End-User authentication. The upstream identity provider does not support prompt=login or max_age.",
+			"state":             happyState,
+		}
 	)
 
 	hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
@@ -221,12 +298,12 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		// Configure fosite the same way that the production code would when using Kube storage.
 		// Inject this into our test subject at the last second so we get a fresh storage for every test.
 		kubeOauthStore := oidc.NewKubeStorage(secretsClient, timeoutsConfiguration)
-		return oidc.FositeOauth2Helper(kubeOauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration), kubeOauthStore
+		return oidc.FositeOauth2Helper(kubeOauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration, nil), kubeOauthStore
 	}
 
 	// Configure fosite the same way that the production code would, using NullStorage to turn off storage.
-	nullOauthStore := oidc.NullStorage{}
-	oauthHelperWithNullStorage := oidc.FositeOauth2Helper(nullOauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration)
+	nullOauthStore := oidc.NewNullStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"))
+	oauthHelperWithNullStorage := oidc.FositeOauth2Helper(nullOauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration, nil)
 
 	upstreamAuthURL, err := url.Parse("https://some-upstream-idp:8443/auth")
 	require.NoError(t, err)
@@ -243,6 +320,43 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			WithPasswordGrantError(errors.New("should not have used password grant on this instance"))
 	}
 
+	githubAuthURL, err := url.Parse("https://github.example.com/login/oauth/authorize")
+	require.NoError(t, err)
+
+	upstreamGitHubIdentityProvider := oidctestutil.TestUpstreamGitHubIdentityProvider{
+		Name:             githubUpstreamName,
+		ResourceUID:      githubUpstreamResourceUID,
+		ClientID:         "some-github-client-id",
+		AuthorizationURL: *githubAuthURL,
+		Scopes:           []string{"read:user", "read:org"},
+	}
+
+	samlSSOURL, err := url.Parse("https://saml.example.com/sso")
+	require.NoError(t, err)
+
+	upstreamSAMLIdentityProvider := oidctestutil.TestUpstreamSAMLIdentityProvider{
+		Name:        samlUpstreamName,
+		ResourceUID: samlUpstreamResourceUID,
+		SSOURL:      *samlSSOURL,
+	}
+
+	happyClientCertificate := &x509.Certificate{Raw: []byte("some-client-certificate-der")}
+	happyIntermediateCertificate := &x509.Certificate{Raw: []byte("some-intermediate-certificate-der")}
+	upstreamCertificateIdentityProvider := oidctestutil.TestUpstreamCertificateIdentityProvider{
+		Name:        certificateUpstreamName,
+		ResourceUID: certificateUpstreamResourceUID,
+		AuthenticateCertificateFunc: func(peerCertificates []*x509.Certificate) (*provider.CertificateUser, error) {
+			if len(peerCertificates) == 0 || peerCertificates[0] != happyClientCertificate {
+				return nil, errors.New("some certificate error")
+			}
+			return &provider.CertificateUser{
+				Username:          "some-certificate-username",
+				Groups:            []string{"some-certificate-group"},
+				DownstreamSubject: "x509:CN%3Dsome-ca?sub=CN%3Dsome-certificate-username",
+			}, nil
+		},
+	}
+
 	passwordGrantUpstreamOIDCIdentityProviderBuilder := func() *oidctestutil.TestUpstreamOIDCIdentityProviderBuilder {
 		return oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
 			WithName(oidcPasswordGrantUpstreamName).
@@ -318,6 +432,28 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		AuthenticateFunc: ldapAuthenticateFunc,
 	}
 
+	upstreamLDAPIdentityProviderWithTOTPMode := func(mode totp.Mode) *oidctestutil.TestUpstreamLDAPIdentityProvider {
+		idp := upstreamLDAPIdentityProvider
+		idp.TOTPMode = mode
+		return &idp
+	}
+
+	upstreamActiveDirectoryIdentityProviderWithTOTPMode := func(mode totp.Mode) *oidctestutil.TestUpstreamLDAPIdentityProvider {
+		idp := upstreamActiveDirectoryIdentityProvider
+		idp.TOTPMode = mode
+		return &idp
+	}
+
+	// TOTP codes are verified at a fixed time, and new TOTP secrets are generated from a fixed source of randomness.
+	totpNow := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	happyLDAPLoginLimitKey := loginlimit.UsernameKey(ldapUpstreamName, happyLDAPUsername)
+	happyClientIPLoginLimitKey := loginlimit.Key{Kind: loginlimit.KindClientIP, Value: "192.0.2.1"} // the address of all httptest requests
+	happyTOTPSecret := []byte("some-totp-secret-123")
+	newTOTPSecret := bytes.Repeat([]byte{0x42}, 20)
+	happyLDAPTOTPUserKey := upstreamLDAPURL + "&sub=" + happyLDAPUID
+	happyLDAPTOTPAccountName := happyLDAPUsernameFromAuthenticator + " (" + ldapUpstreamName + ")"
+
 	erroringUpstreamLDAPIdentityProvider := oidctestutil.TestUpstreamLDAPIdentityProvider{
 		Name:        ldapUpstreamName,
 		ResourceUID: ldapUpstreamResourceUID,
@@ -326,6 +462,16 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		},
 	}
 
+	accountStateUpstreamLDAPIdentityProvider := func(reason authenticators.AccountStateReason) *oidctestutil.TestUpstreamLDAPIdentityProvider {
+		return &oidctestutil.TestUpstreamLDAPIdentityProvider{
+			Name:        ldapUpstreamName,
+			ResourceUID: ldapUpstreamResourceUID,
+			AuthenticateFunc: func(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
+				return nil, false, &authenticators.AccountStateError{Reason: reason, Err: fmt.Errorf("some upstream details which must not be shown")}
+			},
+		}
+	}
+
 	happyCSRF := "test-csrf"
 	happyPKCE := "test-pkce"
 	happyNonce := "test-nonce"
@@ -422,6 +568,55 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			oidctestutil.ExpectedUpstreamStateParamFormat{
 				P: encodeQuery(modifiedHappyGetRequestQueryMap(queryOverrides)),
 				U: upstreamName,
+				T: "oidc",
+				N: happyNonce,
+				C: csrf,
+				K: happyPKCE,
+				V: "1",
+			},
+		)
+		require.NoError(t, err)
+		return encoded
+	}
+
+	expectedGitHubUpstreamStateParam := func() string {
+		encoded, err := happyStateEncoder.Encode("s",
+			oidctestutil.ExpectedUpstreamStateParamFormat{
+				P: encodeQuery(modifiedHappyGetRequestQueryMap(nil)),
+				U: githubUpstreamName,
+				T: "github",
+				N: happyNonce,
+				C: happyCSRF,
+				K: happyPKCE,
+				V: "1",
+			},
+		)
+		require.NoError(t, err)
+		return encoded
+	}
+
+	expectedSAMLUpstreamStateParam := func(csrf string) string {
+		encoded, err := happyStateEncoder.Encode("s",
+			oidctestutil.ExpectedUpstreamStateParamFormat{
+				P: encodeQuery(modifiedHappyGetRequestQueryMap(nil)),
+				U: samlUpstreamName,
+				T: "saml",
+				N: happyNonce,
+				C: csrf,
+				K: happyPKCE,
+				V: "1",
+			},
+		)
+		require.NoError(t, err)
+		return encoded
+	}
+
+	expectedLDAPUpstreamStateParam := func(upstreamName string, upstreamType string, csrf string) string {
+		encoded, err := happyStateEncoder.Encode("s",
+			oidctestutil.ExpectedUpstreamStateParamFormat{
+				P: encodeQuery(modifiedHappyGetRequestQueryMap(nil)),
+				U: upstreamName,
+				T: upstreamType,
 				N: happyNonce,
 				C: csrf,
 				K: happyPKCE,
@@ -432,6 +627,11 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		return encoded
 	}
 
+	// Browser-based logins with LDAP and AD upstreams are redirected to the Supervisor's own login page.
+	expectedRedirectLocationForLoginPage := func(expectedUpstreamState string) string {
+		return urlWithQuery(downstreamIssuer+"/login", map[string]string{"state": expectedUpstreamState})
+	}
+
 	expectedRedirectLocationForUpstreamOIDC := func(expectedUpstreamState string, expectedAdditionalParams map[string]string) string {
 		query := map[string]string{
 			"response_type":         "code",
@@ -449,6 +649,29 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		return urlWithQuery(upstreamAuthURL.String(), query)
 	}
 
+	// GitHub does not issue ID tokens, so no nonce should be sent to GitHub.
+	expectedRedirectLocationForUpstreamGitHub := func(expectedUpstreamState string) string {
+		return urlWithQuery(githubAuthURL.String(), map[string]string{
+			"response_type":         "code",
+			"scope":                 "read:user read:org",
+			"client_id":             "some-github-client-id",
+			"state":                 expectedUpstreamState,
+			"code_challenge":        expectedUpstreamCodeChallenge,
+			"code_challenge_method": downstreamPKCEChallengeMethod,
+			"redirect_uri":          downstreamIssuer + "/callback",
+		})
+	}
+
+	// SAML upstreams receive a handle for the state param as the RelayState, and the nonce is used to make the request ID.
+	expectedRedirectLocationForUpstreamSAML := func(expectedUpstreamState string) string {
+		return urlWithQuery(samlSSOURL.String(), map[string]string{
+			"entityID":   downstreamIssuer,
+			"acsURL":     downstreamIssuer + "/callback/saml",
+			"requestID":  "id-" + happyNonce,
+			"RelayState": oidc.SAMLRelayState(expectedUpstreamState),
+		})
+	}
+
 	expectedHappyActiveDirectoryUpstreamCustomSession := &psession.CustomSessionData{
 		ProviderUID:  activeDirectoryUpstreamResourceUID,
 		ProviderName: activeDirectoryUpstreamName,
@@ -495,6 +718,15 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		},
 	}
 
+	expectedHappyCertificateUpstreamCustomSession := &psession.CustomSessionData{
+		ProviderUID:  certificateUpstreamResourceUID,
+		ProviderName: certificateUpstreamName,
+		ProviderType: psession.ProviderTypeCertificate,
+		Certificate: &psession.CertificateSessionData{
+			PeerCertificates: [][]byte{happyClientCertificate.Raw, happyIntermediateCertificate.Raw},
+		},
+	}
+
 	// Note that fosite puts the granted scopes as a param in the redirect URI even though the spec doesn't seem to require it
 	happyAuthcodeDownstreamRedirectLocationRegexp := downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyState
 
@@ -516,20 +748,28 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		contentType          string
 		body                 string
 		csrfCookie           string
-		customUsernameHeader *string // nil means do not send header, empty means send header with empty value
-		customPasswordHeader *string // nil means do not send header, empty means send header with empty value
+		customUsernameHeader *string             // nil means do not send header, empty means send header with empty value
+		customPasswordHeader *string             // nil means do not send header, empty means send header with empty value
+		customTOTPCodeHeader *string             // nil means do not send header
+		clientCertificates   []*x509.Certificate // when set, the request is made over TLS with these peer certificates
+		totpEnrolledUserKey  string              // when set, the user with this key has a confirmed enrollment of happyTOTPSecret
+		totpKeyIsMissing     bool
+		priorLoginFailures   []loginlimit.Key // each key has one failed login attempt before the request
 
 		wantStatus                             int
 		wantContentType                        string
 		wantBodyString                         string
 		wantBodyJSON                           string
 		wantCSRFValueInCookieHeader            string
+		wantSAMLStateInCookieHeader            string
 		wantBodyStringWithLocationInHref       bool
 		wantLocationHeader                     string
 		wantUpstreamStateParamInLocationHeader bool
+		wantTOTPRequiredHeader                 string
+		wantTOTPEnrollmentURIHeader            string
 
 		// Assertions for when an authcode should be returned, i.e. the request was authenticated by an
-		// upstream LDAP provider or an upstream OIDC password grant flow.
+		// upstream LDAP provider, an upstream OIDC password grant flow, or a client certificate upstream.
 		wantRedirectLocationRegexp        string
 		wantDownstreamRedirectURI         string
 		wantDownstreamGrantedScopes       []string
@@ -541,6 +781,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		wantDownstreamPKCEChallengeMethod string
 		wantDownstreamNonce               string
 		wantUnnecessaryStoredRecords      int
+		wantLoginLimitRecords             int
+		wantRetryAfterHeader              string
 		wantPasswordGrantCall             *expectedPasswordGrant
 		wantDownstreamCustomSessionData   *psession.CustomSessionData
 	}
@@ -562,6 +804,140 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantUpstreamStateParamInLocationHeader: true,
 			wantBodyStringWithLocationInHref:       true,
 		},
+		{
+			name:                                   "GitHub upstream browser flow happy path using GET without a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(&upstreamGitHubIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationForUpstreamGitHub(expectedGitHubUpstreamStateParam()),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:                                   "SAML upstream browser flow happy path using GET without a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(&upstreamSAMLIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantSAMLStateInCookieHeader:            expectedSAMLUpstreamStateParam(happyCSRF),
+			wantLocationHeader:                     expectedRedirectLocationForUpstreamSAML(expectedSAMLUpstreamStateParam(happyCSRF)),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:                                   "SAML upstream browser flow happy path using GET with a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(&upstreamSAMLIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			csrfCookie:                             "__Host-pinniped-csrf=" + encodedIncomingCookieCSRFValue,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantSAMLStateInCookieHeader:            expectedSAMLUpstreamStateParam(incomingCookieCSRFValue),
+			wantLocationHeader:                     expectedRedirectLocationForUpstreamSAML(expectedSAMLUpstreamStateParam(incomingCookieCSRFValue)),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:               "SAML upstream browser flow with prompt param none throws an error",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(&upstreamSAMLIdentityProvider),
+			generateCSRF:       happyCSRFGenerator,
+			generatePKCE:       happyPKCEGenerator,
+			generateNonce:      happyNonceGenerator,
+			stateEncoder:       happyStateEncoder,
+			cookieEncoder:      happyCookieEncoder,
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"prompt": "none"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeLoginRequiredErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:                                   "LDAP upstream browser flow happy path using GET without a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationForLoginPage(expectedLDAPUpstreamStateParam(ldapUpstreamName, "ldap", happyCSRF)),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:                                   "LDAP upstream browser flow happy path using GET with a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			csrfCookie:                             "__Host-pinniped-csrf=" + encodedIncomingCookieCSRFValue,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantLocationHeader:                     expectedRedirectLocationForLoginPage(expectedLDAPUpstreamStateParam(ldapUpstreamName, "ldap", incomingCookieCSRFValue)),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:                                   "Active Directory upstream browser flow happy path using GET without a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationForLoginPage(expectedLDAPUpstreamStateParam(activeDirectoryUpstreamName, "activedirectory", happyCSRF)),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:               "LDAP upstream browser flow with prompt param none throws an error",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:       happyCSRFGenerator,
+			generatePKCE:       happyPKCEGenerator,
+			generateNonce:      happyNonceGenerator,
+			stateEncoder:       happyStateEncoder,
+			cookieEncoder:      happyCookieEncoder,
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"prompt": "none"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeLoginRequiredErrorQuery),
+			wantBodyString:     "",
+		},
 		{
 			name:                              "OIDC upstream password grant happy path using GET",
 			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(passwordGrantUpstreamOIDCIdentityProviderBuilder().Build()),
@@ -605,6 +981,26 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
 			wantDownstreamCustomSessionData:   expectedHappyLDAPUpstreamCustomSession,
 		},
+		{
+			name:                              "client certificate upstream happy path using GET",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(&upstreamCertificateIdentityProvider),
+			method:                            http.MethodGet,
+			path:                              happyGetRequestPath,
+			clientCertificates:                []*x509.Certificate{happyClientCertificate, happyIntermediateCertificate},
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      "x509:CN%3Dsome-ca?sub=CN%3Dsome-certificate-username",
+			wantDownstreamIDTokenUsername:     "some-certificate-username",
+			wantDownstreamIDTokenGroups:       []string{"some-certificate-group"},
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyCertificateUpstreamCustomSession,
+		},
 		{
 			name:                              "ActiveDirectory upstream happy path using GET",
 			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
@@ -626,6 +1022,230 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
 			wantDownstreamCustomSessionData:   expectedHappyActiveDirectoryUpstreamCustomSession,
 		},
+		{
+			name:                        "LDAP upstream with required TOTP asks users who have not enrolled to enroll",
+			idps:                        oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(upstreamLDAPIdentityProviderWithTOTPMode(totp.ModeRequired)),
+			method:                      http.MethodGet,
+			path:                        happyGetRequestPath,
+			customUsernameHeader:        pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:        pointer.StringPtr(happyLDAPPassword),
+			wantStatus:                  http.StatusFound,
+			wantContentType:             "application/json; charset=utf-8",
+			wantLocationHeader:          urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithTOTPRequiredHintErrorQuery),
+			wantBodyString:              "",
+			wantTOTPRequiredHeader:      "enroll",
+			wantTOTPEnrollmentURIHeader: totp.KeyURI("Pinniped", happyLDAPTOTPAccountName, newTOTPSecret),
+		},
+		{
+			name:                   "LDAP upstream with required TOTP asks enrolled users for a code",
+			idps:                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(upstreamLDAPIdentityProviderWithTOTPMode(totp.ModeRequired)),
+			method:                 http.MethodGet,
+			path:                   happyGetRequestPath,
+			customUsernameHeader:   pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:   pointer.StringPtr(happyLDAPPassword),
+			totpEnrolledUserKey:    happyLDAPTOTPUserKey,
+			wantStatus:             http.StatusFound,
+			wantContentType:        "application/json; charset=utf-8",
+			wantLocationHeader:     urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithTOTPRequiredHintErrorQuery),
+			wantBodyString:         "",
+			wantTOTPRequiredHeader: "code",
+		},
+		{
+			name:                   "LDAP upstream with required TOTP rejects a bad code",
+			wantLoginLimitRecords:  2,
+			idps:                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(upstreamLDAPIdentityProviderWithTOTPMode(totp.ModeRequired)),
+			method:                 http.MethodGet,
+			path:                   happyGetRequestPath,
+			customUsernameHeader:   pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:   pointer.StringPtr(happyLDAPPassword),
+			customTOTPCodeHeader:   pointer.StringPtr("000000"),
+			totpEnrolledUserKey:    happyLDAPTOTPUserKey,
+			wantStatus:             http.StatusFound,
+			wantContentType:        "application/json; charset=utf-8",
+			wantLocationHeader:     urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithTOTPNotAcceptedHintErrorQuery),
+			wantBodyString:         "",
+			wantTOTPRequiredHeader: "code",
+		},
+		{
+			name:                              "LDAP upstream with required TOTP happy path",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(upstreamLDAPIdentityProviderWithTOTPMode(totp.ModeRequired)),
+			method:                            http.MethodGet,
+			path:                              happyGetRequestPath,
+			customUsernameHeader:              pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:              pointer.StringPtr(happyLDAPPassword),
+			customTOTPCodeHeader:              pointer.StringPtr(totp.Code(happyTOTPSecret, totpNow)),
+			totpEnrolledUserKey:               happyLDAPTOTPUserKey,
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername:     happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:       happyLDAPGroups,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyLDAPUpstreamCustomSession,
+		},
+		{
+			name:                              "LDAP upstream with optional TOTP does not ask users who have not enrolled",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(upstreamLDAPIdentityProviderWithTOTPMode(totp.ModeOptional)),
+			method:                            http.MethodGet,
+			path:                              happyGetRequestPath,
+			customUsernameHeader:              pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:              pointer.StringPtr(happyLDAPPassword),
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername:     happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:       happyLDAPGroups,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyLDAPUpstreamCustomSession,
+		},
+		{
+			name:                   "Active Directory upstream with optional TOTP asks enrolled users for a code",
+			idps:                   oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(upstreamActiveDirectoryIdentityProviderWithTOTPMode(totp.ModeOptional)),
+			method:                 http.MethodGet,
+			path:                   happyGetRequestPath,
+			customUsernameHeader:   pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:   pointer.StringPtr(happyLDAPPassword),
+			totpEnrolledUserKey:    happyLDAPTOTPUserKey,
+			wantStatus:             http.StatusFound,
+			wantContentType:        "application/json; charset=utf-8",
+			wantLocationHeader:     urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithTOTPRequiredHintErrorQuery),
+			wantBodyString:         "",
+			wantTOTPRequiredHeader: "code",
+		},
+		{
+			name:                 "LDAP upstream with required TOTP when the TOTP encryption key is not available",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(upstreamLDAPIdentityProviderWithTOTPMode(totp.ModeRequired)),
+			method:               http.MethodGet,
+			path:                 happyGetRequestPath,
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			totpKeyIsMissing:     true,
+			wantStatus:           http.StatusInternalServerError,
+			wantContentType:      "text/plain; charset=utf-8",
+			wantBodyString:       "Internal Server Error: unexpected error during TOTP verification\n",
+		},
+		{
+			name:                              "OIDC upstream password grant with required TOTP happy path",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(passwordGrantUpstreamOIDCIdentityProviderBuilder().WithTOTPMode(totp.ModeRequired).Build()),
+			method:                            http.MethodGet,
+			path:                              happyGetRequestPath,
+			customUsernameHeader:              pointer.StringPtr(oidcUpstreamUsername),
+			customPasswordHeader:              pointer.StringPtr(oidcUpstreamPassword),
+			customTOTPCodeHeader:              pointer.StringPtr(totp.Code(happyTOTPSecret, totpNow)),
+			totpEnrolledUserKey:               oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantPasswordGrantCall:             happyUpstreamPasswordGrantMockExpectation,
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+		},
+		{
+			name:                   "OIDC upstream password grant with required TOTP asks enrolled users for a code",
+			idps:                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(passwordGrantUpstreamOIDCIdentityProviderBuilder().WithTOTPMode(totp.ModeRequired).Build()),
+			method:                 http.MethodGet,
+			path:                   happyGetRequestPath,
+			customUsernameHeader:   pointer.StringPtr(oidcUpstreamUsername),
+			customPasswordHeader:   pointer.StringPtr(oidcUpstreamPassword),
+			totpEnrolledUserKey:    oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantPasswordGrantCall:  happyUpstreamPasswordGrantMockExpectation,
+			wantStatus:             http.StatusFound,
+			wantContentType:        "application/json; charset=utf-8",
+			wantLocationHeader:     urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithTOTPRequiredHintErrorQuery),
+			wantBodyString:         "",
+			wantTOTPRequiredHeader: "code",
+		},
+		{
+			name:                  "LDAP upstream rejects logins after too many failed login attempts of the username",
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:                http.MethodGet,
+			path:                  happyGetRequestPath,
+			customUsernameHeader:  pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:  pointer.StringPtr(happyLDAPPassword),
+			priorLoginFailures:    []loginlimit.Key{happyLDAPLoginLimitKey, happyLDAPLoginLimitKey},
+			wantStatus:            http.StatusFound,
+			wantContentType:       "application/json; charset=utf-8",
+			wantLocationHeader:    urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithTooManyAttemptsForOneMinuteHintErrorQuery),
+			wantBodyString:        "",
+			wantRetryAfterHeader:  "60",
+			wantLoginLimitRecords: 1,
+		},
+		{
+			name:                  "Active Directory upstream rejects logins after the client IP was locked out",
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:                http.MethodGet,
+			path:                  happyGetRequestPath,
+			customUsernameHeader:  pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:  pointer.StringPtr(happyLDAPPassword),
+			priorLoginFailures:    []loginlimit.Key{happyClientIPLoginLimitKey, happyClientIPLoginLimitKey, happyClientIPLoginLimitKey},
+			wantStatus:            http.StatusFound,
+			wantContentType:       "application/json; charset=utf-8",
+			wantLocationHeader:    urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithTooManyAttemptsForFifteenMinutesHintErrorQuery),
+			wantBodyString:        "",
+			wantRetryAfterHeader:  "900",
+			wantLoginLimitRecords: 1,
+		},
+		{
+			name:                              "LDAP upstream happy path forgets earlier failed login attempts of the username",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:                            http.MethodGet,
+			path:                              happyGetRequestPath,
+			customUsernameHeader:              pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:              pointer.StringPtr(happyLDAPPassword),
+			priorLoginFailures:                []loginlimit.Key{happyLDAPLoginLimitKey, happyClientIPLoginLimitKey},
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername:     happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:       happyLDAPGroups,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyLDAPUpstreamCustomSession,
+			wantLoginLimitRecords:             1, // the client IP's failure is not forgotten
+		},
+		{
+			name:                 "OIDC upstream password grant rejects logins after too many failed login attempts of the username",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(passwordGrantUpstreamOIDCIdentityProviderBuilder().Build()),
+			method:               http.MethodGet,
+			path:                 happyGetRequestPath,
+			customUsernameHeader: pointer.StringPtr(oidcUpstreamUsername),
+			customPasswordHeader: pointer.StringPtr(oidcUpstreamPassword),
+			priorLoginFailures: []loginlimit.Key{
+				loginlimit.UsernameKey(oidcPasswordGrantUpstreamName, oidcUpstreamUsername),
+				loginlimit.UsernameKey(oidcPasswordGrantUpstreamName, oidcUpstreamUsername),
+			},
+			wantStatus:            http.StatusFound,
+			wantContentType:       "application/json; charset=utf-8",
+			wantLocationHeader:    urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithTooManyAttemptsForOneMinuteHintErrorQuery),
+			wantBodyString:        "",
+			wantRetryAfterHeader:  "60",
+			wantLoginLimitRecords: 1,
+		},
 		{
 			name:                                   "OIDC upstream browser flow happy path using GET with a CSRF cookie",
 			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
@@ -733,7 +1353,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamCustomSessionData:   expectedHappyActiveDirectoryUpstreamCustomSession,
 		},
 		{
-			name:                                   "OIDC upstream browser flow happy path with prompt param other than none that gets ignored",
+			name:                                   "OIDC upstream browser flow happy path with prompt param login which is passed on to the upstream",
 			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
 			generateCSRF:                           happyCSRFGenerator,
 			generatePKCE:                           happyPKCEGenerator,
@@ -748,9 +1368,103 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantContentType:                        htmlContentType,
 			wantBodyStringWithLocationInHref:       true,
 			wantCSRFValueInCookieHeader:            happyCSRF,
-			wantLocationHeader:                     expectedRedirectLocationForUpstreamOIDC(expectedUpstreamStateParam(map[string]string{"prompt": "login"}, "", ""), nil),
+			wantLocationHeader:                     expectedRedirectLocationForUpstreamOIDC(expectedUpstreamStateParam(map[string]string{"prompt": "login"}, "", ""), map[string]string{"prompt": "login"}),
 			wantUpstreamStateParamInLocationHeader: true,
 		},
+		{
+			name:                                   "OIDC upstream browser flow happy path with max_age param which is passed on to the upstream",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   modifiedHappyGetRequestPath(map[string]string{"max_age": "60"}),
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantBodyStringWithLocationInHref:       true,
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationForUpstreamOIDC(expectedUpstreamStateParam(map[string]string{"max_age": "60"}, "", ""), map[string]string{"max_age": "60"}),
+			wantUpstreamStateParamInLocationHeader: true,
+		},
+		{
+			name:                                   "OIDC upstream browser flow happy path with max_age param which does not loosen the max_age of the upstream",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().WithAdditionalAuthcodeParams(map[string]string{"max_age": "300"}).Build()),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   modifiedHappyGetRequestPath(map[string]string{"max_age": "3600"}),
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantBodyStringWithLocationInHref:       true,
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationForUpstreamOIDC(expectedUpstreamStateParam(map[string]string{"max_age": "3600"}, "", ""), map[string]string{"max_age": "300"}),
+			wantUpstreamStateParamInLocationHeader: true,
+		},
+		{
+			name:               "GitHub upstream browser flow with prompt param login throws an error because GitHub does not understand it",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(&upstreamGitHubIdentityProvider),
+			generateCSRF:       happyCSRFGenerator,
+			generatePKCE:       happyPKCEGenerator,
+			generateNonce:      happyNonceGenerator,
+			stateEncoder:       happyStateEncoder,
+			cookieEncoder:      happyCookieEncoder,
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"prompt": "login"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeLoginRequiredWithFreshAuthenticationNotSupportedHintErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:               "GitHub upstream browser flow with max_age param throws an error because GitHub does not understand it",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(&upstreamGitHubIdentityProvider),
+			generateCSRF:       happyCSRFGenerator,
+			generatePKCE:       happyPKCEGenerator,
+			generateNonce:      happyNonceGenerator,
+			stateEncoder:       happyStateEncoder,
+			cookieEncoder:      happyCookieEncoder,
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"max_age": "60"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeLoginRequiredWithFreshAuthenticationNotSupportedHintErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:               "SAML upstream browser flow with prompt param login throws an error",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(&upstreamSAMLIdentityProvider),
+			generateCSRF:       happyCSRFGenerator,
+			generatePKCE:       happyPKCEGenerator,
+			generateNonce:      happyNonceGenerator,
+			stateEncoder:       happyStateEncoder,
+			cookieEncoder:      happyCookieEncoder,
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"prompt": "login"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeLoginRequiredWithFreshAuthenticationNotSupportedHintErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:               "SAML upstream browser flow with max_age param throws an error",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(&upstreamSAMLIdentityProvider),
+			generateCSRF:       happyCSRFGenerator,
+			generatePKCE:       happyPKCEGenerator,
+			generateNonce:      happyNonceGenerator,
+			stateEncoder:       happyStateEncoder,
+			cookieEncoder:      happyCookieEncoder,
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"max_age": "0"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeLoginRequiredWithFreshAuthenticationNotSupportedHintErrorQuery),
+			wantBodyString:     "",
+		},
 		{
 			name:                                   "OIDC upstream browser flow happy path with extra params that get passed through",
 			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().WithAdditionalAuthcodeParams(map[string]string{"prompt": "consent", "abc": "123", "def": "456"}).Build()),
@@ -767,7 +1481,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantContentType:                        htmlContentType,
 			wantBodyStringWithLocationInHref:       true,
 			wantCSRFValueInCookieHeader:            happyCSRF,
-			wantLocationHeader:                     expectedRedirectLocationForUpstreamOIDC(expectedUpstreamStateParam(map[string]string{"prompt": "login"}, "", ""), map[string]string{"prompt": "consent", "abc": "123", "def": "456"}),
+			wantLocationHeader:                     expectedRedirectLocationForUpstreamOIDC(expectedUpstreamStateParam(map[string]string{"prompt": "login"}, "", ""), map[string]string{"prompt": "consent login", "abc": "123", "def": "456"}),
 			wantUpstreamStateParamInLocationHeader: true,
 		},
 		{
@@ -992,11 +1706,36 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantBodyString:       "Bad Gateway: unexpected error during upstream authentication\n",
 		},
 		{
-			name: "wrong upstream credentials for OIDC password grant authentication",
+			name:                 "upstream LDAP authentication fails because the user's password has expired",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(accountStateUpstreamLDAPIdentityProvider(authenticators.AccountStatePasswordExpired)),
+			method:               http.MethodGet,
+			path:                 happyGetRequestPath,
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithPasswordExpiredHintErrorQuery),
+			wantBodyString:       "",
+		},
+		{
+			name:                 "upstream Active Directory authentication fails because the user's account is locked",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(accountStateUpstreamLDAPIdentityProvider(authenticators.AccountStateAccountLocked)),
+			method:               http.MethodGet,
+			path:                 happyGetRequestPath,
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithAccountLockedHintErrorQuery),
+			wantBodyString:       "",
+		},
+		{
+			name:                  "wrong upstream credentials for OIDC password grant authentication",
+			wantLoginLimitRecords: 2,
 			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
 				passwordGrantUpstreamOIDCIdentityProviderBuilder().
 					// This is similar to the error that would be returned by the underlying call to oauth2.PasswordCredentialsToken()
-					WithPasswordGrantError(&oauth2.RetrieveError{Response: &http.Response{Status: "fake status"}, Body: []byte("fake body")}).
+					WithPasswordGrantError(&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}, Body: []byte("fake body")}).
 					Build(),
 			),
 			method:               http.MethodGet,
@@ -1015,52 +1754,100 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantBodyString:     "",
 		},
 		{
-			name:                 "wrong upstream password for LDAP authentication",
-			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			name:                  "upstream OIDC password grant fails for a reason other than the user's credentials",
+			wantLoginLimitRecords: 0,
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				passwordGrantUpstreamOIDCIdentityProviderBuilder().
+					WithPasswordGrantError(&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}, Body: []byte("fake body")}).
+					Build(),
+			),
 			method:               http.MethodGet,
 			path:                 happyGetRequestPath,
-			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
-			customPasswordHeader: pointer.StringPtr("wrong-password"),
-			wantStatus:           http.StatusFound,
-			wantContentType:      "application/json; charset=utf-8",
-			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadUsernamePasswordHintErrorQuery),
-			wantBodyString:       "",
+			customUsernameHeader: pointer.StringPtr(oidcUpstreamUsername),
+			customPasswordHeader: pointer.StringPtr(oidcUpstreamPassword),
+			wantPasswordGrantCall: &expectedPasswordGrant{
+				performedByUpstreamName: oidcPasswordGrantUpstreamName,
+				args: &oidctestutil.PasswordCredentialsGrantAndValidateTokensArgs{
+					Username: oidcUpstreamUsername,
+					Password: oidcUpstreamPassword,
+				}},
+			wantStatus:         http.StatusFound,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeAccessDeniedErrorQuery),
+			wantBodyString:     "",
 		},
 		{
-			name:                 "wrong upstream password for Active Directory authentication",
-			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
-			method:               http.MethodGet,
-			path:                 happyGetRequestPath,
-			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
-			customPasswordHeader: pointer.StringPtr("wrong-password"),
-			wantStatus:           http.StatusFound,
-			wantContentType:      "application/json; charset=utf-8",
-			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadUsernamePasswordHintErrorQuery),
-			wantBodyString:       "",
+			name:                  "wrong upstream password for LDAP authentication",
+			wantLoginLimitRecords: 2,
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:                http.MethodGet,
+			path:                  happyGetRequestPath,
+			customUsernameHeader:  pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:  pointer.StringPtr("wrong-password"),
+			wantStatus:            http.StatusFound,
+			wantContentType:       "application/json; charset=utf-8",
+			wantLocationHeader:    urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadUsernamePasswordHintErrorQuery),
+			wantBodyString:        "",
 		},
 		{
-			name:                 "wrong upstream username for LDAP authentication",
-			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
-			method:               http.MethodGet,
-			path:                 happyGetRequestPath,
-			customUsernameHeader: pointer.StringPtr("wrong-username"),
-			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
-			wantStatus:           http.StatusFound,
-			wantContentType:      "application/json; charset=utf-8",
-			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadUsernamePasswordHintErrorQuery),
-			wantBodyString:       "",
+			name:               "client certificate not accepted by the certificate upstream",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(&upstreamCertificateIdentityProvider),
+			method:             http.MethodGet,
+			path:               happyGetRequestPath,
+			clientCertificates: []*x509.Certificate{happyIntermediateCertificate},
+			wantStatus:         http.StatusFound,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadClientCertificateHintErrorQuery),
+			wantBodyString:     "",
 		},
 		{
-			name:                 "wrong upstream username for Active Directory authentication",
-			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
-			method:               http.MethodGet,
-			path:                 happyGetRequestPath,
-			customUsernameHeader: pointer.StringPtr("wrong-username"),
-			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
-			wantStatus:           http.StatusFound,
-			wantContentType:      "application/json; charset=utf-8",
-			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadUsernamePasswordHintErrorQuery),
-			wantBodyString:       "",
+			name:               "no client certificate for the certificate upstream",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(&upstreamCertificateIdentityProvider),
+			method:             http.MethodGet,
+			path:               happyGetRequestPath,
+			wantStatus:         http.StatusFound,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadClientCertificateHintErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:                  "wrong upstream password for Active Directory authentication",
+			wantLoginLimitRecords: 2,
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:                http.MethodGet,
+			path:                  happyGetRequestPath,
+			customUsernameHeader:  pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:  pointer.StringPtr("wrong-password"),
+			wantStatus:            http.StatusFound,
+			wantContentType:       "application/json; charset=utf-8",
+			wantLocationHeader:    urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadUsernamePasswordHintErrorQuery),
+			wantBodyString:        "",
+		},
+		{
+			name:                  "wrong upstream username for LDAP authentication",
+			wantLoginLimitRecords: 2,
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:                http.MethodGet,
+			path:                  happyGetRequestPath,
+			customUsernameHeader:  pointer.StringPtr("wrong-username"),
+			customPasswordHeader:  pointer.StringPtr(happyLDAPPassword),
+			wantStatus:            http.StatusFound,
+			wantContentType:       "application/json; charset=utf-8",
+			wantLocationHeader:    urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadUsernamePasswordHintErrorQuery),
+			wantBodyString:        "",
+		},
+		{
+			name:                  "wrong upstream username for Active Directory authentication",
+			wantLoginLimitRecords: 2,
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:                http.MethodGet,
+			path:                  happyGetRequestPath,
+			customUsernameHeader:  pointer.StringPtr("wrong-username"),
+			customPasswordHeader:  pointer.StringPtr(happyLDAPPassword),
+			wantStatus:            http.StatusFound,
+			wantContentType:       "application/json; charset=utf-8",
+			wantLocationHeader:    urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithBadUsernamePasswordHintErrorQuery),
+			wantBodyString:        "",
 		},
 		{
 			name:                 "missing upstream username on request for LDAP authentication",
@@ -1212,6 +1999,15 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithPasswordGrantDisallowedHintErrorQuery),
 			wantBodyString:       "",
 		},
+		{
+			name:            "request_uri does not refer to a pushed authorization request",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			method:          http.MethodGet,
+			path:            pathWithQuery("/some/path", map[string]string{"client_id": downstreamClientID, "request_uri": par.RequestURIPrefix + "unknown"}),
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    fositeUnknownRequestURIErrorBody,
+		},
 		{
 			name:          "downstream redirect uri does not match what is configured for client when using OIDC upstream browser flow",
 			idps:          oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
@@ -1338,24 +2134,28 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantBodyString:       "",
 		},
 		{
-			name:               "response type is unsupported when using LDAP upstream",
-			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
-			method:             http.MethodGet,
-			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
-			wantStatus:         http.StatusFound,
-			wantContentType:    "application/json; charset=utf-8",
-			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
-			wantBodyString:     "",
+			name:                 "response type is unsupported when using LDAP upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:               http.MethodGet,
+			path:                 modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
+			wantBodyString:       "",
 		},
 		{
-			name:               "response type is unsupported when using active directory upstream",
-			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
-			method:             http.MethodGet,
-			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
-			wantStatus:         http.StatusFound,
-			wantContentType:    "application/json; charset=utf-8",
-			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
-			wantBodyString:     "",
+			name:                 "response type is unsupported when using active directory upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:               http.MethodGet,
+			path:                 modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
+			wantBodyString:       "",
 		},
 		{
 			name:               "downstream scopes do not match what is configured for client using OIDC upstream browser flow",
@@ -1436,24 +2236,28 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantBodyString:       "",
 		},
 		{
-			name:               "missing response type in request using LDAP upstream",
-			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
-			method:             http.MethodGet,
-			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": ""}),
-			wantStatus:         http.StatusFound,
-			wantContentType:    "application/json; charset=utf-8",
-			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeMissingResponseTypeErrorQuery),
-			wantBodyString:     "",
+			name:                 "missing response type in request using LDAP upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:               http.MethodGet,
+			path:                 modifiedHappyGetRequestPath(map[string]string{"response_type": ""}),
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeMissingResponseTypeErrorQuery),
+			wantBodyString:       "",
 		},
 		{
-			name:               "missing response type in request using Active Directory upstream",
-			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
-			method:             http.MethodGet,
-			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": ""}),
-			wantStatus:         http.StatusFound,
-			wantContentType:    "application/json; charset=utf-8",
-			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeMissingResponseTypeErrorQuery),
-			wantBodyString:     "",
+			name:                 "missing response type in request using Active Directory upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:               http.MethodGet,
+			path:                 modifiedHappyGetRequestPath(map[string]string{"response_type": ""}),
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeMissingResponseTypeErrorQuery),
+			wantBodyString:       "",
 		},
 		{
 			name:            "missing client id in request using OIDC upstream browser flow",
@@ -1721,7 +2525,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantCSRFValueInCookieHeader: happyCSRF,
 			wantLocationHeader: expectedRedirectLocationForUpstreamOIDC(expectedUpstreamStateParam(
 				map[string]string{"prompt": "none login", "scope": "email"}, "", "",
-			), nil),
+			), map[string]string{"prompt": "login"}),
 			wantUpstreamStateParamInLocationHeader: true,
 			wantBodyStringWithLocationInHref:       true,
 		},
@@ -2352,6 +3156,33 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantContentType: "text/plain; charset=utf-8",
 			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
 		},
+		{
+			name:            "too many upstream providers are configured: both OIDC and GitHub",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithGitHub(&upstreamGitHubIdentityProvider), // more than one not allowed
+			method:          http.MethodGet,
+			path:            happyGetRequestPath,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+		},
+		{
+			name:            "too many upstream providers are configured: both GitHub and SAML",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(&upstreamGitHubIdentityProvider).WithSAML(&upstreamSAMLIdentityProvider), // more than one not allowed
+			method:          http.MethodGet,
+			path:            happyGetRequestPath,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+		},
+		{
+			name:            "too many upstream providers are configured: both SAML and client certificate",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(&upstreamSAMLIdentityProvider).WithCertificate(&upstreamCertificateIdentityProvider), // more than one not allowed
+			method:          http.MethodGet,
+			path:            happyGetRequestPath,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+		},
 		{
 			name:            "PUT is a bad method",
 			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
@@ -2381,7 +3212,42 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		},
 	}
 
-	runOneTestCase := func(t *testing.T, test testCase, subject http.Handler, kubeOauthStore *oidc.KubeStorage, kubeClient *fake.Clientset, secretsClient v1.SecretInterface) {
+	// TOTP enrollments are stored using their own client, so they are not counted as stored records of the login.
+	newTOTPVerifier := func(t *testing.T, test testCase) *totp.Verifier {
+		t.Helper()
+		totpKey := []byte("some-totp-key")
+		if test.totpKeyIsMissing {
+			totpKey = nil
+		}
+		totpClock := func() time.Time { return totpNow }
+		totpStorage := totp.NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), totpClock, func() []byte { return totpKey }, rand.Reader)
+		if test.totpEnrolledUserKey != "" {
+			require.NoError(t, totpStorage.Save(context.Background(), test.totpEnrolledUserKey, &totp.Enrollment{Secret: happyTOTPSecret, Confirmed: true}))
+		}
+		return totp.NewVerifier(totpStorage, totpClock, bytes.NewReader(newTOTPSecret))
+	}
+
+	// Failed login attempts are also stored using their own client. The first failure of each key is free, the second
+	// causes a wait of one minute, and the third causes a lockout. The prior failures are two minutes apart, so that
+	// none of them has to wait, and the last one is at the time of the request.
+	newLoginLimiter := func(t *testing.T, test testCase) (*loginlimit.Limiter, *fake.Clientset) {
+		t.Helper()
+		policy := loginlimit.Policy{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Minute, LockoutAttempts: 3, LockoutDuration: 15 * time.Minute}
+		client := fake.NewSimpleClientset()
+		loginLimitNow := totpNow.Add(-time.Duration(len(test.priorLoginFailures)) * 2 * time.Minute)
+		loginLimiter := loginlimit.New(client.CoreV1().Secrets("some-namespace"), func() time.Time { return loginLimitNow },
+			map[loginlimit.Kind]loginlimit.Policy{loginlimit.KindUsername: policy, loginlimit.KindClientIP: policy})
+		for _, key := range test.priorLoginFailures {
+			loginLimitNow = loginLimitNow.Add(2 * time.Minute)
+			loginAttempt, err := loginLimiter.Begin(context.Background(), key)
+			require.NoError(t, err)
+			loginAttempt.Failed()
+			loginAttempt.End(context.Background())
+		}
+		return loginLimiter, client
+	}
+
+	runOneTestCase := func(t *testing.T, test testCase, subject http.Handler, kubeOauthStore *oidc.KubeStorage, kubeClient *fake.Clientset, secretsClient v1.SecretInterface, loginLimitClient *fake.Clientset) {
 		reqContext := context.WithValue(context.Background(), struct{ name string }{name: "test"}, "request-context")
 		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)).WithContext(reqContext)
 		req.Header.Set("Content-Type", test.contentType)
@@ -2394,6 +3260,12 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		if test.customPasswordHeader != nil {
 			req.Header.Set("Pinniped-Password", *test.customPasswordHeader)
 		}
+		if test.customTOTPCodeHeader != nil {
+			req.Header.Set("Pinniped-TOTP-Code", *test.customTOTPCodeHeader)
+		}
+		if test.clientCertificates != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: test.clientCertificates}
+		}
 		rsp := httptest.NewRecorder()
 		subject.ServeHTTP(rsp, req)
 		t.Logf("response: %#v", rsp)
@@ -2402,6 +3274,11 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		require.Equal(t, test.wantStatus, rsp.Code)
 		testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), test.wantContentType)
 		testutil.RequireSecurityHeaders(t, rsp)
+		require.Equal(t, test.wantTOTPRequiredHeader, rsp.Header().Get("Pinniped-TOTP-Required"))
+		require.Equal(t, test.wantTOTPEnrollmentURIHeader, rsp.Header().Get("Pinniped-TOTP-Enrollment-URI"))
+		require.Equal(t, test.wantRetryAfterHeader, rsp.Header().Get("Retry-After"))
+
+		require.Equal(t, test.wantLoginLimitRecords, countLoginLimitRecords(t, loginLimitClient))
 
 		if test.wantPasswordGrantCall != nil {
 			test.wantPasswordGrantCall.args.Ctx = reqContext
@@ -2415,7 +3292,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		actualLocation := rsp.Header().Get("Location")
 		switch {
 		case test.wantLocationHeader != "":
-			if test.wantUpstreamStateParamInLocationHeader {
+			if test.wantUpstreamStateParamInLocationHeader && test.wantSAMLStateInCookieHeader == "" {
 				requireEqualDecodedStateParams(t, actualLocation, test.wantLocationHeader, test.stateEncoder)
 			}
 			// The upstream state param is encoded using a timestamp at the beginning so we don't want to
@@ -2472,20 +3349,21 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			require.Equal(t, test.wantBodyString, rsp.Body.String())
 		}
 
+		wantCookies := 0
 		if test.wantCSRFValueInCookieHeader != "" {
-			require.Len(t, rsp.Header().Values("Set-Cookie"), 1)
-			actualCookie := rsp.Header().Get("Set-Cookie")
-			regex := regexp.MustCompile("__Host-pinniped-csrf=([^;]+); Path=/; HttpOnly; Secure; SameSite=Lax")
-			submatches := regex.FindStringSubmatch(actualCookie)
-			require.Len(t, submatches, 2)
-			captured := submatches[1]
-			var decodedCSRFCookieValue string
-			err := test.cookieEncoder.Decode("csrf", captured, &decodedCSRFCookieValue)
+			wantCookies++
+			requireCSRFCookie(t, rsp, test.wantCSRFValueInCookieHeader, test.cookieEncoder)
+		}
+		if test.wantSAMLStateInCookieHeader != "" {
+			wantCookies++
+			actualState := requireSAMLStateCookie(t, rsp, test.cookieEncoder)
+			requireEqualDecodedStates(t, actualState, test.wantSAMLStateInCookieHeader, test.stateEncoder)
+			// SAML upstreams receive only a handle for the state param, which was kept in the cookie.
+			actualLocationURL, err := url.Parse(rsp.Header().Get("Location"))
 			require.NoError(t, err)
-			require.Equal(t, test.wantCSRFValueInCookieHeader, decodedCSRFCookieValue)
-		} else {
-			require.Empty(t, rsp.Header().Values("Set-Cookie"))
+			require.Equal(t, oidc.SAMLRelayState(actualState), actualLocationURL.Query().Get("RelayState"))
 		}
+		require.Len(t, rsp.Header().Values("Set-Cookie"), wantCookies)
 	}
 
 	for _, test := range tests {
@@ -2494,14 +3372,18 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			kubeClient := fake.NewSimpleClientset()
 			secretsClient := kubeClient.CoreV1().Secrets("some-namespace")
 			oauthHelperWithRealStorage, kubeOauthStore := createOauthHelperWithRealStorage(secretsClient)
+			loginLimiter, loginLimitClient := newLoginLimiter(t, test)
 			subject := NewHandler(
 				downstreamIssuer,
 				test.idps.Build(),
 				oauthHelperWithNullStorage, oauthHelperWithRealStorage,
 				test.generateCSRF, test.generatePKCE, test.generateNonce,
 				test.stateEncoder, test.cookieEncoder,
+				newTOTPVerifier(t, test),
+				loginLimiter,
+				par.NewStorage(secretsClient, time.Now, rand.Reader),
 			)
-			runOneTestCase(t, test, subject, kubeOauthStore, kubeClient, secretsClient)
+			runOneTestCase(t, test, subject, kubeOauthStore, kubeClient, secretsClient, loginLimitClient)
 		})
 	}
 
@@ -2514,15 +3396,19 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		secretsClient := kubeClient.CoreV1().Secrets("some-namespace")
 		oauthHelperWithRealStorage, kubeOauthStore := createOauthHelperWithRealStorage(secretsClient)
 		idpLister := test.idps.Build()
+		loginLimiter, loginLimitClient := newLoginLimiter(t, test)
 		subject := NewHandler(
 			downstreamIssuer,
 			idpLister,
 			oauthHelperWithNullStorage, oauthHelperWithRealStorage,
 			test.generateCSRF, test.generatePKCE, test.generateNonce,
 			test.stateEncoder, test.cookieEncoder,
+			newTOTPVerifier(t, test),
+			loginLimiter,
+			par.NewStorage(secretsClient, time.Now, rand.Reader),
 		)
 
-		runOneTestCase(t, test, subject, kubeOauthStore, kubeClient, secretsClient)
+		runOneTestCase(t, test, subject, kubeOauthStore, kubeClient, secretsClient, loginLimitClient)
 
 		// Call the idpLister's setter to change the upstream IDP settings.
 		newProviderSettings := oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
@@ -2560,7 +3446,116 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		// modified expectations. This should ensure that the implementation is using the in-memory cache
 		// of upstream IDP settings appropriately in terms of always getting the values from the cache
 		// on every request.
-		runOneTestCase(t, test, subject, kubeOauthStore, kubeClient, secretsClient)
+		runOneTestCase(t, test, subject, kubeOauthStore, kubeClient, secretsClient, loginLimitClient)
+	})
+	t.Run("uses the parameters of pushed authorization requests", func(t *testing.T) {
+		test := tests[0]
+		// Double-check that we are re-using the happy path test case here as we intend.
+		require.Equal(t, "OIDC upstream browser flow happy path using GET without a CSRF cookie", test.name)
+
+		kubeClient := fake.NewSimpleClientset()
+		secretsClient := kubeClient.CoreV1().Secrets("some-namespace")
+		oauthHelperWithRealStorage, kubeOauthStore := createOauthHelperWithRealStorage(secretsClient)
+		loginLimiter, loginLimitClient := newLoginLimiter(t, test)
+		// Keep the pushed requests apart, since the test case expects the authorize request to store nothing.
+		pushedAuthorizationRequests := par.NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), time.Now, rand.Reader)
+		subject := NewHandler(
+			downstreamIssuer,
+			test.idps.Build(),
+			oauthHelperWithNullStorage, oauthHelperWithRealStorage,
+			test.generateCSRF, test.generatePKCE, test.generateNonce,
+			test.stateEncoder, test.cookieEncoder,
+			newTOTPVerifier(t, test),
+			loginLimiter,
+			pushedAuthorizationRequests,
+		)
+
+		pushedParams := url.Values{}
+		for k, v := range happyGetRequestQueryMap {
+			pushedParams.Set(k, v)
+		}
+		requestURI, err := pushedAuthorizationRequests.Create(context.Background(), downstreamClientID, pushedParams)
+		require.NoError(t, err)
+
+		// Only the client_id and request_uri travel through the browser.
+		test.path = pathWithQuery("/some/path", map[string]string{"client_id": downstreamClientID, "request_uri": requestURI})
+		runOneTestCase(t, test, subject, kubeOauthStore, kubeClient, secretsClient, loginLimitClient)
+
+		// The pushed authorization request may only be used once.
+		rsp := httptest.NewRecorder()
+		subject.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, test.path, nil))
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), "application/json; charset=utf-8")
+		require.JSONEq(t, fositeUnknownRequestURIErrorBody, rsp.Body.String())
+	})
+	t.Run("rejects clients which are not trusted in the flows which cannot ask for consent", func(t *testing.T) {
+		const registeredClientID = "client.oauth.pinniped.dev-some-registered-client"
+		registeredClientPath := modifiedHappyGetRequestPath(map[string]string{"client_id": registeredClientID})
+
+		for _, test := range []testCase{
+			{
+				name:                 "LDAP upstream",
+				idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+				customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+				customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			},
+			{
+				name:                 "OIDC upstream password grant",
+				idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(passwordGrantUpstreamOIDCIdentityProviderBuilder().Build()),
+				customUsernameHeader: pointer.StringPtr(oidcUpstreamUsername),
+				customPasswordHeader: pointer.StringPtr(oidcUpstreamPassword),
+			},
+			{
+				name:               "client certificate upstream",
+				idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(&upstreamCertificateIdentityProvider),
+				clientCertificates: []*x509.Certificate{happyClientCertificate, happyIntermediateCertificate},
+			},
+		} {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				// The registered client may use the authorization code flow, but it is not trusted.
+				secretHash, err := bcrypt.GenerateFromPassword([]byte("some-client-secret"), bcrypt.MinCost)
+				require.NoError(t, err)
+				registeredClient := clientregistry.RegisteredClientSecret(registeredClientID, secretHash,
+					[]string{downstreamRedirectURI}, nil, time.Now().Add(time.Hour))
+				registeredClient.Namespace = "some-namespace"
+				kubeClient := fake.NewSimpleClientset(registeredClient)
+				secretsClient := kubeClient.CoreV1().Secrets("some-namespace")
+				oauthHelperWithRealStorage, _ := createOauthHelperWithRealStorage(secretsClient)
+				loginLimiter, loginLimitClient := newLoginLimiter(t, test)
+				subject := NewHandler(
+					downstreamIssuer,
+					test.idps.Build(),
+					oauthHelperWithNullStorage, oauthHelperWithRealStorage,
+					happyCSRFGenerator, happyPKCEGenerator, happyNonceGenerator,
+					happyStateEncoder, happyCookieEncoder,
+					newTOTPVerifier(t, test),
+					loginLimiter,
+					par.NewStorage(secretsClient, time.Now, rand.Reader),
+				)
+
+				req := httptest.NewRequest(http.MethodGet, registeredClientPath, nil)
+				if test.customUsernameHeader != nil {
+					req.Header.Set("Pinniped-Username", *test.customUsernameHeader)
+					req.Header.Set("Pinniped-Password", *test.customPasswordHeader)
+				}
+				if test.clientCertificates != nil {
+					req.TLS = &tls.ConnectionState{PeerCertificates: test.clientCertificates}
+				}
+				rsp := httptest.NewRecorder()
+				subject.ServeHTTP(rsp, req)
+
+				require.Equal(t, http.StatusFound, rsp.Code)
+				requireEqualURLs(t, rsp.Header().Get("Location"), urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithUntrustedClientHintErrorQuery), false)
+				test.idps.RequireExactlyZeroCallsToPasswordCredentialsGrantAndValidateTokens(t)
+				require.Zero(t, countLoginLimitRecords(t, loginLimitClient))
+
+				// Nothing was stored besides the registered client.
+				secrets, err := secretsClient.List(context.Background(), metav1.ListOptions{})
+				require.NoError(t, err)
+				require.Len(t, secrets.Items, 1)
+			})
+		}
 	})
 }
 
@@ -2577,6 +3572,58 @@ type expectedPasswordGrant struct {
 	args                    *oidctestutil.PasswordCredentialsGrantAndValidateTokensArgs
 }
 
+// countLoginLimitRecords returns the number of keys which have failed login attempts. Each Secret holds the failed
+// login attempts of many keys.
+func countLoginLimitRecords(t *testing.T, loginLimitClient *fake.Clientset) int {
+	t.Helper()
+	secrets, err := loginLimitClient.CoreV1().Secrets("some-namespace").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	count := 0
+	for i := range secrets.Items {
+		var shard struct {
+			Records map[string]interface{} `json:"records"`
+		}
+		require.NoError(t, crud.FromSecret(loginlimit.TypeLabelValue, &secrets.Items[i], &shard))
+		count += len(shard.Records)
+	}
+	return count
+}
+
+// requireSAMLStateCookie returns the upstream state param which was kept in the SAML state cookie.
+func requireSAMLStateCookie(t *testing.T, rsp *httptest.ResponseRecorder, cookieDecoder oidc.Codec) string {
+	t.Helper()
+	regex := regexp.MustCompile("^__Host-pinniped-saml-state=([^;]+); Path=/; HttpOnly; Secure; SameSite=None$")
+	for _, actualCookie := range rsp.Header().Values("Set-Cookie") {
+		submatches := regex.FindStringSubmatch(actualCookie)
+		if submatches == nil {
+			continue
+		}
+		var decodedStateParam string
+		err := cookieDecoder.Decode("samlstate", submatches[1], &decodedStateParam)
+		require.NoError(t, err)
+		return decodedStateParam
+	}
+	require.Failf(t, "SAML state cookie not found", "expected a SAML state cookie in %v", rsp.Header().Values("Set-Cookie"))
+	return ""
+}
+
+func requireCSRFCookie(t *testing.T, rsp *httptest.ResponseRecorder, wantCSRFValue string, cookieDecoder oidc.Codec) {
+	t.Helper()
+	regex := regexp.MustCompile("^__Host-pinniped-csrf=([^;]+); Path=/; HttpOnly; Secure; SameSite=Lax$")
+	for _, actualCookie := range rsp.Header().Values("Set-Cookie") {
+		submatches := regex.FindStringSubmatch(actualCookie)
+		if submatches == nil {
+			continue
+		}
+		var decodedCSRFCookieValue string
+		err := cookieDecoder.Decode("csrf", submatches[1], &decodedCSRFCookieValue)
+		require.NoError(t, err)
+		require.Equal(t, wantCSRFValue, decodedCSRFCookieValue)
+		return
+	}
+	require.Failf(t, "CSRF cookie not found", "expected a CSRF cookie in %v", rsp.Header().Values("Set-Cookie"))
+}
+
 func requireEqualDecodedStateParams(t *testing.T, actualURL string, expectedURL string, stateParamDecoder oidc.Codec) {
 	t.Helper()
 	actualLocationURL, err := url.Parse(actualURL)
@@ -2584,18 +3631,25 @@ func requireEqualDecodedStateParams(t *testing.T, actualURL string, expectedURL
 	expectedLocationURL, err := url.Parse(expectedURL)
 	require.NoError(t, err)
 
-	expectedQueryStateParam := expectedLocationURL.Query().Get("state")
-	require.NotEmpty(t, expectedQueryStateParam)
+	requireEqualDecodedStates(t, actualLocationURL.Query().Get("state"), expectedLocationURL.Query().Get("state"), stateParamDecoder)
+}
+
+func requireEqualDecodedStates(t *testing.T, actualStateParam string, expectedStateParam string, stateParamDecoder oidc.Codec) {
+	t.Helper()
+	require.NotEmpty(t, expectedStateParam)
 	var expectedDecodedStateParam oidctestutil.ExpectedUpstreamStateParamFormat
-	err = stateParamDecoder.Decode("s", expectedQueryStateParam, &expectedDecodedStateParam)
+	err := stateParamDecoder.Decode("s", expectedStateParam, &expectedDecodedStateParam)
 	require.NoError(t, err)
 
-	actualQueryStateParam := actualLocationURL.Query().Get("state")
-	require.NotEmpty(t, actualQueryStateParam)
+	require.NotEmpty(t, actualStateParam)
 	var actualDecodedStateParam oidctestutil.ExpectedUpstreamStateParamFormat
-	err = stateParamDecoder.Decode("s", actualQueryStateParam, &actualDecodedStateParam)
+	err = stateParamDecoder.Decode("s", actualStateParam, &actualDecodedStateParam)
 	require.NoError(t, err)
 
+	// The state param remembers when the downstream authorization request was made.
+	testutil.RequireTimeInDelta(t, time.Now(), time.Unix(actualDecodedStateParam.R, 0), time.Minute)
+	actualDecodedStateParam.R = expectedDecodedStateParam.R
+
 	require.Equal(t, expectedDecodedStateParam, actualDecodedStateParam)
 }
 
@@ -2627,6 +3681,8 @@ func requireEqualURLs(t *testing.T, actualURL string, expectedURL string, ignore
 	if ignoreState {
 		expectedLocationQuery.Del("state")
 		actualLocationQuery.Del("state")
+		expectedLocationQuery.Del("RelayState")
+		actualLocationQuery.Del("RelayState")
 	}
 	require.Equal(t, expectedLocationQuery, actualLocationQuery)
 }
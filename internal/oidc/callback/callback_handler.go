@@ -6,8 +6,10 @@ package callback
 
 import (
 	"crypto/subtle"
+	"errors"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/ory/fosite"
 
@@ -17,15 +19,17 @@ import (
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/downstreamsession"
 	"go.pinniped.dev/internal/oidc/provider"
-	"go.pinniped.dev/internal/oidc/provider/formposthtml"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
 )
 
 func NewHandler(
-	upstreamIDPs oidc.UpstreamOIDCIdentityProvidersLister,
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
 	oauthHelper fosite.OAuth2Provider,
 	stateDecoder, cookieDecoder oidc.Decoder,
 	redirectURI string,
+	consentPrompt *ConsentPrompt,
+	pages *provider.Pages,
 ) http.Handler {
 	handler := httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		state, err := validateRequest(r, stateDecoder, cookieDecoder)
@@ -33,64 +37,199 @@ func NewHandler(
 			return err
 		}
 
-		upstreamIDPConfig := findUpstreamIDPConfig(state.UpstreamName, upstreamIDPs)
-		if upstreamIDPConfig == nil {
+		upstreamLogin := findUpstreamIDPLogin(state, upstreamIDPs)
+		if upstreamLogin == nil {
 			plog.Warning("upstream provider not found")
 			return httperr.New(http.StatusUnprocessableEntity, "upstream provider not found")
 		}
 
-		downstreamAuthParams, err := url.ParseQuery(state.AuthParams)
+		authorizeRequester, err := newDownstreamAuthorizeRequest(r, oauthHelper, state)
 		if err != nil {
-			plog.Error("error reading state downstream auth params", err)
-			return httperr.New(http.StatusBadRequest, "error reading state downstream auth params")
+			return err
 		}
 
-		// Recreate enough of the original authorize request so we can pass it to NewAuthorizeRequest().
-		reconstitutedAuthRequest := &http.Request{Form: downstreamAuthParams}
-		authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), reconstitutedAuthRequest)
+		identity, err := upstreamLogin(r, state, redirectURI)
 		if err != nil {
-			plog.Error("error using state downstream auth params", err)
-			return httperr.New(http.StatusBadRequest, "error using state downstream auth params")
+			return err
 		}
 
-		// Automatically grant the openid, offline_access, and pinniped:request-audience scopes, but only if they were requested.
-		downstreamsession.GrantScopesIfRequested(authorizeRequester)
+		return writeDownstreamAuthorizeResponse(w, r, oauthHelper, consentPrompt, authorizeRequester, state, identity)
+	})
+	return securityheader.WrapWithCustomCSP(handler, pages.FormPost.ContentSecurityPolicy())
+}
 
-		token, err := upstreamIDPConfig.ExchangeAuthcodeAndValidateTokens(
-			r.Context(),
-			authcode(r),
-			state.PKCECode,
-			state.Nonce,
-			redirectURI,
-		)
-		if err != nil {
-			plog.WarningErr("error exchanging and validating upstream tokens", err, "upstreamName", upstreamIDPConfig.GetName())
-			return httperr.New(http.StatusBadGateway, "error exchanging and validating upstream tokens")
-		}
+// newDownstreamAuthorizeRequest recreates the original downstream authorize request from the state param.
+func newDownstreamAuthorizeRequest(r *http.Request, oauthHelper fosite.OAuth2Provider, state *oidc.UpstreamStateParamData) (fosite.AuthorizeRequester, error) {
+	downstreamAuthParams, err := url.ParseQuery(state.AuthParams)
+	if err != nil {
+		plog.Error("error reading state downstream auth params", err)
+		return nil, httperr.New(http.StatusBadRequest, "error reading state downstream auth params")
+	}
 
-		subject, username, groups, err := downstreamsession.GetDownstreamIdentityFromUpstreamIDToken(upstreamIDPConfig, token.IDToken.Claims)
-		if err != nil {
-			return httperr.Wrap(http.StatusUnprocessableEntity, err.Error(), err)
-		}
+	// Recreate enough of the original authorize request so we can pass it to NewAuthorizeRequest().
+	reconstitutedAuthRequest := &http.Request{Form: downstreamAuthParams}
+	authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), reconstitutedAuthRequest)
+	if err != nil {
+		plog.Error("error using state downstream auth params", err)
+		return nil, httperr.New(http.StatusBadRequest, "error using state downstream auth params")
+	}
 
-		customSessionData, err := downstreamsession.MakeDownstreamOIDCCustomSessionData(upstreamIDPConfig, token)
-		if err != nil {
-			return httperr.Wrap(http.StatusUnprocessableEntity, err.Error(), err)
-		}
+	// Automatically grant the openid, offline_access, and pinniped:request-audience scopes, but only if they were requested.
+	downstreamsession.GrantScopesIfRequested(authorizeRequester)
 
-		openIDSession := downstreamsession.MakeDownstreamSession(subject, username, groups, customSessionData)
+	return authorizeRequester, nil
+}
 
-		authorizeResponder, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, openIDSession)
-		if err != nil {
-			plog.WarningErr("error while generating and saving authcode", err, "upstreamName", upstreamIDPConfig.GetName())
-			return httperr.Wrap(http.StatusInternalServerError, "error while generating and saving authcode", err)
-		}
+// writeDownstreamAuthorizeResponse creates the downstream session for the identity and redirects the browser back
+// to the downstream client with an authcode. When the user must first consent to the client, it redirects the
+// browser to the consent page instead. A nil consentPrompt skips the consent.
+func writeDownstreamAuthorizeResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	oauthHelper fosite.OAuth2Provider,
+	consentPrompt *ConsentPrompt,
+	authorizeRequester fosite.AuthorizeRequester,
+	state *oidc.UpstreamStateParamData,
+	identity *downstreamIdentity,
+) error {
+	authn := &downstreamsession.Authentication{}
+	if identity.authentication != nil {
+		*authn = *identity.authentication
+	}
+	if state.RequestedAt != 0 {
+		authn.RequestedAt = time.Unix(state.RequestedAt, 0)
+	}
+	if err := downstreamsession.RequireFreshAuthentication(authorizeRequester, authn); err != nil {
+		plog.Info("upstream authentication is not fresh enough for the downstream request", "upstreamName", state.UpstreamName)
+		oauthHelper.WriteAuthorizeError(w, authorizeRequester, err)
+		return nil
+	}
+
+	if redirected, err := consentPrompt.redirectIfRequired(w, r, authorizeRequester, state, identity); err != nil || redirected {
+		return err
+	}
+
+	openIDSession := downstreamsession.MakeDownstreamSession(identity.subject, identity.username, identity.groups, identity.customSessionData, authn)
+
+	authorizeResponder, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, openIDSession)
+	if err != nil {
+		plog.WarningErr("error while generating and saving authcode", err, "upstreamName", state.UpstreamName)
+		return httperr.Wrap(http.StatusInternalServerError, "error while generating and saving authcode", err)
+	}
+
+	oauthHelper.WriteAuthorizeResponse(w, authorizeRequester, authorizeResponder)
 
-		oauthHelper.WriteAuthorizeResponse(w, authorizeRequester, authorizeResponder)
+	return nil
+}
 
+// downstreamIdentity is the result of completing a login with an upstream IDP.
+type downstreamIdentity struct {
+	subject           string
+	username          string
+	groups            []string
+	customSessionData *psession.CustomSessionData
+	// authentication says when and how the upstream authenticated the user, or nil when it was just now.
+	authentication *downstreamsession.Authentication
+}
+
+// upstreamLoginFunc completes the login for one particular upstream IDP using the upstream authcode from the request.
+type upstreamLoginFunc func(r *http.Request, state *oidc.UpstreamStateParamData, redirectURI string) (*downstreamIdentity, error)
+
+func findUpstreamIDPLogin(state *oidc.UpstreamStateParamData, upstreamIDPs oidc.UpstreamIdentityProvidersLister) upstreamLoginFunc {
+	switch psession.ProviderType(state.UpstreamType) {
+	case psession.ProviderTypeGitHub:
+		upstreamIDPConfig := findGitHubUpstreamIDPConfig(state.UpstreamName, upstreamIDPs)
+		if upstreamIDPConfig == nil {
+			return nil
+		}
+		return func(r *http.Request, state *oidc.UpstreamStateParamData, redirectURI string) (*downstreamIdentity, error) {
+			return loginWithGitHubUpstream(r, state, redirectURI, upstreamIDPConfig)
+		}
+	case psession.ProviderTypeOIDC, "": // state params created by older versions of the Supervisor had no type
+		upstreamIDPConfig := findOIDCUpstreamIDPConfig(state.UpstreamName, upstreamIDPs)
+		if upstreamIDPConfig == nil {
+			return nil
+		}
+		return func(r *http.Request, state *oidc.UpstreamStateParamData, redirectURI string) (*downstreamIdentity, error) {
+			return loginWithOIDCUpstream(r, state, redirectURI, upstreamIDPConfig)
+		}
+	default:
 		return nil
-	})
-	return securityheader.WrapWithCustomCSP(handler, formposthtml.ContentSecurityPolicy())
+	}
+}
+
+func loginWithOIDCUpstream(
+	r *http.Request,
+	state *oidc.UpstreamStateParamData,
+	redirectURI string,
+	upstreamIDPConfig provider.UpstreamOIDCIdentityProviderI,
+) (*downstreamIdentity, error) {
+	token, err := upstreamIDPConfig.ExchangeAuthcodeAndValidateTokens(
+		r.Context(),
+		authcode(r),
+		state.PKCECode,
+		state.Nonce,
+		redirectURI,
+	)
+	if err != nil {
+		plog.WarningErr("error exchanging and validating upstream tokens", err, "upstreamName", upstreamIDPConfig.GetName())
+		return nil, httperr.New(http.StatusBadGateway, "error exchanging and validating upstream tokens")
+	}
+
+	subject, username, groups, err := downstreamsession.GetDownstreamIdentityFromUpstreamIDToken(upstreamIDPConfig, token.IDToken.Claims)
+	if err != nil {
+		return nil, httperr.Wrap(http.StatusUnprocessableEntity, err.Error(), err)
+	}
+
+	customSessionData, err := downstreamsession.MakeDownstreamOIDCCustomSessionData(upstreamIDPConfig, token)
+	if err != nil {
+		return nil, httperr.Wrap(http.StatusUnprocessableEntity, err.Error(), err)
+	}
+
+	return &downstreamIdentity{
+		subject:           subject,
+		username:          username,
+		groups:            groups,
+		customSessionData: customSessionData,
+		authentication:    downstreamsession.UpstreamAuthentication(token.IDToken.Claims),
+	}, nil
+}
+
+func loginWithGitHubUpstream(
+	r *http.Request,
+	state *oidc.UpstreamStateParamData,
+	redirectURI string,
+	upstreamIDPConfig provider.UpstreamGitHubIdentityProviderI,
+) (*downstreamIdentity, error) {
+	accessToken, err := upstreamIDPConfig.ExchangeAuthcode(r.Context(), authcode(r), state.PKCECode, redirectURI)
+	if err != nil {
+		plog.WarningErr("error exchanging upstream authcode", err, "upstreamName", upstreamIDPConfig.GetName())
+		return nil, httperr.New(http.StatusBadGateway, "error exchanging upstream authcode")
+	}
+
+	user, err := upstreamIDPConfig.GetUser(r.Context(), accessToken)
+	if err != nil {
+		if errors.Is(err, provider.ErrGitHubUserNotAllowed) {
+			plog.InfoErr("upstream user is not allowed to log in", err, "upstreamName", upstreamIDPConfig.GetName())
+			return nil, httperr.Wrap(http.StatusForbidden, "user is not allowed to log in by the configuration of the upstream provider", err)
+		}
+		plog.WarningErr("error fetching user from upstream provider", err, "upstreamName", upstreamIDPConfig.GetName())
+		return nil, httperr.New(http.StatusBadGateway, "error fetching user from upstream provider")
+	}
+
+	return &downstreamIdentity{
+		subject:  user.DownstreamSubject,
+		username: user.Username,
+		groups:   user.Groups,
+		customSessionData: &psession.CustomSessionData{
+			ProviderUID:  upstreamIDPConfig.GetResourceUID(),
+			ProviderName: upstreamIDPConfig.GetName(),
+			ProviderType: psession.ProviderTypeGitHub,
+			GitHub: &psession.GitHubSessionData{
+				UpstreamAccessToken: accessToken,
+			},
+		},
+	}, nil
 }
 
 func authcode(r *http.Request) string {
@@ -118,7 +257,7 @@ func validateRequest(r *http.Request, stateDecoder, cookieDecoder oidc.Decoder)
 		return nil, httperr.New(http.StatusBadRequest, "state param not found")
 	}
 
-	state, err := readState(r, stateDecoder)
+	state, err := readState(r.FormValue("state"), stateDecoder)
 	if err != nil {
 		plog.InfoErr("error reading state", err)
 		return nil, err
@@ -132,7 +271,7 @@ func validateRequest(r *http.Request, stateDecoder, cookieDecoder oidc.Decoder)
 	return state, nil
 }
 
-func findUpstreamIDPConfig(upstreamName string, upstreamIDPs oidc.UpstreamOIDCIdentityProvidersLister) provider.UpstreamOIDCIdentityProviderI {
+func findOIDCUpstreamIDPConfig(upstreamName string, upstreamIDPs oidc.UpstreamOIDCIdentityProvidersLister) provider.UpstreamOIDCIdentityProviderI {
 	for _, p := range upstreamIDPs.GetOIDCIdentityProviders() {
 		if p.GetName() == upstreamName {
 			return p
@@ -141,6 +280,15 @@ func findUpstreamIDPConfig(upstreamName string, upstreamIDPs oidc.UpstreamOIDCId
 	return nil
 }
 
+func findGitHubUpstreamIDPConfig(upstreamName string, upstreamIDPs oidc.UpstreamGitHubIdentityProvidersLister) provider.UpstreamGitHubIdentityProviderI {
+	for _, p := range upstreamIDPs.GetGitHubIdentityProviders() {
+		if p.GetName() == upstreamName {
+			return p
+		}
+	}
+	return nil
+}
+
 func readCSRFCookie(r *http.Request, cookieDecoder oidc.Decoder) (csrftoken.CSRFToken, error) {
 	receivedCSRFCookie, err := r.Cookie(oidc.CSRFCookieName)
 	if err != nil {
@@ -157,11 +305,11 @@ func readCSRFCookie(r *http.Request, cookieDecoder oidc.Decoder) (csrftoken.CSRF
 	return csrfFromCookie, nil
 }
 
-func readState(r *http.Request, stateDecoder oidc.Decoder) (*oidc.UpstreamStateParamData, error) {
+func readState(encodedState string, stateDecoder oidc.Decoder) (*oidc.UpstreamStateParamData, error) {
 	var state oidc.UpstreamStateParamData
 	if err := stateDecoder.Decode(
 		oidc.UpstreamStateParamEncodingName,
-		r.FormValue("state"),
+		encodedState,
 		&state,
 	); err != nil {
 		return nil, httperr.New(http.StatusBadRequest, "error reading state")
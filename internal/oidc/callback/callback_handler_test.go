@@ -4,8 +4,13 @@
 package callback
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -19,7 +24,10 @@ import (
 	"k8s.io/client-go/kubernetes/fake"
 
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/consent"
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/pendinglogin"
+	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/oidctestutil"
@@ -38,6 +46,10 @@ const (
 	oidcUpstreamSubjectQueryEscaped = "abc123-some+guid"
 	oidcUpstreamUsername            = "test-pinniped-username"
 
+	githubUpstreamAccessToken       = "test-github-access-token"
+	githubUpstreamUsername          = "some-github-login:1234"
+	githubUpstreamDownstreamSubject = "https://api.github.com?idpName=upstream-idp-name&sub=1234"
+
 	oidcUpstreamUsernameClaim = "the-user-claim"
 	oidcUpstreamGroupsClaim   = "the-groups-claim"
 
@@ -62,6 +74,7 @@ const (
 
 var (
 	oidcUpstreamGroupMembership    = []string{"test-pinniped-group-0", "test-pinniped-group-1"}
+	githubUpstreamGroupMembership  = []string{"some-org/team-1", "some-org/team-2"}
 	happyDownstreamScopesRequested = []string{"openid"}
 	happyDownstreamScopesGranted   = []string{"openid"}
 
@@ -132,6 +145,39 @@ func TestCallbackEndpoint(t *testing.T) {
 		RedirectURI:          happyUpstreamRedirectURI,
 	}
 
+	happyGitHubUpstream := func() *oidctestutil.TestUpstreamGitHubIdentityProvider {
+		return &oidctestutil.TestUpstreamGitHubIdentityProvider{
+			Name:        happyUpstreamIDPName,
+			ResourceUID: happyUpstreamIDPResourceUID,
+			ClientID:    "some-github-client-id",
+			ExchangeAuthcodeFunc: func(ctx context.Context, authcode string) (string, error) {
+				return githubUpstreamAccessToken, nil
+			},
+			GetUserFunc: func(ctx context.Context, accessToken string) (*provider.GitHubUser, error) {
+				return &provider.GitHubUser{
+					Username:          githubUpstreamUsername,
+					Groups:            githubUpstreamGroupMembership,
+					DownstreamSubject: githubUpstreamDownstreamSubject,
+				}, nil
+			},
+		}
+	}
+	happyGitHubState := happyUpstreamStateParam().WithUpstreamType("github").Build(t, happyStateCodec)
+
+	githubHappyUpstream := happyGitHubUpstream()
+	githubExchangeErrorUpstream := happyGitHubUpstream()
+	githubExchangeErrorUpstream.ExchangeAuthcodeFunc = func(ctx context.Context, authcode string) (string, error) {
+		return "", errors.New("some exchange error")
+	}
+	githubUserNotAllowedUpstream := happyGitHubUpstream()
+	githubUserNotAllowedUpstream.GetUserFunc = func(ctx context.Context, accessToken string) (*provider.GitHubUser, error) {
+		return nil, fmt.Errorf("%w: user %q", provider.ErrGitHubUserNotAllowed, "some-github-login")
+	}
+	githubGetUserErrorUpstream := happyGitHubUpstream()
+	githubGetUserErrorUpstream.GetUserFunc = func(ctx context.Context, accessToken string) (*provider.GitHubUser, error) {
+		return nil, errors.New("some API error")
+	}
+
 	// Note that fosite puts the granted scopes as a param in the redirect URI even though the spec doesn't seem to require it
 	happyDownstreamRedirectLocationRegexp := downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState
 
@@ -147,6 +193,7 @@ func TestCallbackEndpoint(t *testing.T) {
 		wantContentType                   string
 		wantBody                          string
 		wantRedirectLocationRegexp        string
+		wantRedirectLocationString        string
 		wantBodyFormResponseRegexp        string
 		wantDownstreamGrantedScopes       []string
 		wantDownstreamIDTokenSubject      string
@@ -159,6 +206,10 @@ func TestCallbackEndpoint(t *testing.T) {
 		wantDownstreamCustomSessionData   *psession.CustomSessionData
 
 		wantAuthcodeExchangeCall *expectedAuthcodeExchange
+
+		// For GitHub upstreams, the upstream which should have been called, and whether GetUser should have been called.
+		wantGitHubUpstreamCalled *oidctestutil.TestUpstreamGitHubIdentityProvider
+		wantGitHubGetUserCall    bool
 	}{
 		{
 			name:   "GET with good state and cookie and successful upstream token exchange with response_mode=form_post returns 200 with HTML+JS form",
@@ -990,6 +1041,112 @@ func TestCallbackEndpoint(t *testing.T) {
 				args:                    happyExchangeAndValidateTokensArgs,
 			},
 		},
+		{
+			name:                              "GitHub upstream: GET with good state and cookie and successful upstream login returns 303 to downstream client callback with its state and code",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(githubHappyUpstream),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyGitHubState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      githubUpstreamDownstreamSubject,
+			wantDownstreamIDTokenUsername:     githubUpstreamUsername,
+			wantDownstreamIDTokenGroups:       githubUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData: &psession.CustomSessionData{
+				ProviderUID:  happyUpstreamIDPResourceUID,
+				ProviderName: happyUpstreamIDPName,
+				ProviderType: psession.ProviderTypeGitHub,
+				GitHub: &psession.GitHubSessionData{
+					UpstreamAccessToken: githubUpstreamAccessToken,
+				},
+			},
+			wantGitHubUpstreamCalled: githubHappyUpstream,
+			wantGitHubGetUserCall:    true,
+		},
+		{
+			name:                     "GitHub upstream: upstream authcode exchange fails",
+			idps:                     oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(githubExchangeErrorUpstream),
+			method:                   http.MethodGet,
+			path:                     newRequestPath().WithState(happyGitHubState).String(),
+			csrfCookie:               happyCSRFCookie,
+			wantStatus:               http.StatusBadGateway,
+			wantContentType:          htmlContentType,
+			wantBody:                 "Bad Gateway: error exchanging upstream authcode\n",
+			wantGitHubUpstreamCalled: githubExchangeErrorUpstream,
+		},
+		{
+			name:                     "GitHub upstream: user is not a member of any allowed organization",
+			idps:                     oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(githubUserNotAllowedUpstream),
+			method:                   http.MethodGet,
+			path:                     newRequestPath().WithState(happyGitHubState).String(),
+			csrfCookie:               happyCSRFCookie,
+			wantStatus:               http.StatusForbidden,
+			wantContentType:          htmlContentType,
+			wantBody:                 "Forbidden: user is not allowed to log in by the configuration of the upstream provider\n",
+			wantGitHubUpstreamCalled: githubUserNotAllowedUpstream,
+			wantGitHubGetUserCall:    true,
+		},
+		{
+			name:                     "GitHub upstream: error fetching user",
+			idps:                     oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(githubGetUserErrorUpstream),
+			method:                   http.MethodGet,
+			path:                     newRequestPath().WithState(happyGitHubState).String(),
+			csrfCookie:               happyCSRFCookie,
+			wantStatus:               http.StatusBadGateway,
+			wantContentType:          htmlContentType,
+			wantBody:                 "Bad Gateway: error fetching user from upstream provider\n",
+			wantGitHubUpstreamCalled: githubGetUserErrorUpstream,
+			wantGitHubGetUserCall:    true,
+		},
+		{
+			name:            "state param names an OIDC upstream but only a GitHub upstream of the same name exists",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(happyGitHubUpstream()),
+			method:          http.MethodGet,
+			path:            newRequestPath().WithState(happyState).String(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: htmlContentType,
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
+		{
+			name:                              "state param without an upstream type is treated as an OIDC upstream for backwards compatibility",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyUpstreamStateParam().WithUpstreamType("").Build(t, happyStateCodec)).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name:            "state param has an unknown upstream type",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			method:          http.MethodGet,
+			path:            newRequestPath().WithState(happyUpstreamStateParam().WithUpstreamType("ldap").Build(t, happyStateCodec)).String(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: htmlContentType,
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
 		{
 			name: "upstream ID token contains groups claim with invalid null type",
 			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
@@ -1006,6 +1163,132 @@ func TestCallbackEndpoint(t *testing.T) {
 				args:                    happyExchangeAndValidateTokensArgs,
 			},
 		},
+		{
+			name: "prompt=login when the upstream IDP authenticated the user again after the downstream authorization request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				happyUpstream().WithIDTokenClaim("auth_time", float64(time.Now().Unix())).Build(),
+			),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().
+					WithAuthorizeRequestParams(shallowCopyAndModifyQuery(happyDownstreamRequestParamsQuery, map[string]string{"prompt": "login"}).Encode()).
+					WithRequestedAt(time.Now().Add(-5*time.Second)).
+					Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name: "prompt=login when the clock of the upstream IDP is slightly behind",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				happyUpstream().WithIDTokenClaim("auth_time", float64(time.Now().Add(-30*time.Second).Unix())).Build(),
+			),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().
+					WithAuthorizeRequestParams(shallowCopyAndModifyQuery(happyDownstreamRequestParamsQuery, map[string]string{"prompt": "login"}).Encode()).
+					WithRequestedAt(time.Now().Add(-5*time.Second)).
+					Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name: "max_age when the clock of the upstream IDP is slightly behind",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				happyUpstream().WithIDTokenClaim("auth_time", float64(time.Now().Add(-40*time.Second).Unix())).Build(),
+			),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().
+					WithAuthorizeRequestParams(shallowCopyAndModifyQuery(happyDownstreamRequestParamsQuery, map[string]string{"max_age": "10"}).Encode()).
+					WithRequestedAt(time.Now().Add(-5*time.Second)).
+					Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name: "prompt=login when the upstream IDP did not authenticate the user again returns login_required to the downstream client",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				happyUpstream().WithIDTokenClaim("auth_time", float64(time.Now().Add(-time.Hour).Unix())).Build(),
+			),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().
+					WithAuthorizeRequestParams(shallowCopyAndModifyQuery(happyDownstreamRequestParamsQuery, map[string]string{"prompt": "login"}).Encode()).
+					WithRequestedAt(time.Now().Add(-5*time.Second)).
+					Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:                 happyCSRFCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantRedirectLocationString: downstreamRedirectURI + "?error=login_required&error_description=The+Authorization+Server+requires+End-User+authentication.+The+upstream+identity+provider+did+not+authenticate+the+user+again%2C+although+prompt%3Dlogin+was+requested.&state=" + happyDownstreamState,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name: "max_age when the user authenticated with the upstream IDP too long ago returns login_required to the downstream client",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				happyUpstream().WithIDTokenClaim("auth_time", float64(time.Now().Add(-time.Hour).Unix())).Build(),
+			),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().
+					WithAuthorizeRequestParams(shallowCopyAndModifyQuery(happyDownstreamRequestParamsQuery, map[string]string{"max_age": "60"}).Encode()).
+					Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:                 happyCSRFCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantRedirectLocationString: downstreamRedirectURI + "?error=login_required&error_description=The+Authorization+Server+requires+End-User+authentication.+The+user+authenticated+with+the+upstream+identity+provider+longer+ago+than+max_age+allows.&state=" + happyDownstreamState,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
 	}
 	for _, test := range tests {
 		test := test
@@ -1021,9 +1304,10 @@ func TestCallbackEndpoint(t *testing.T) {
 			hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
 			require.GreaterOrEqual(t, len(hmacSecretFunc()), 32, "fosite requires that hmac secrets have at least 32 bytes")
 			jwksProviderIsUnused := jwks.NewDynamicJWKSProvider()
-			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration)
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration, nil)
 
-			subject := NewHandler(test.idps.Build(), oauthHelper, happyStateCodec, happyCookieCodec, happyUpstreamRedirectURI)
+			consentPrompt := NewConsentPrompt(consent.NewStorage(secrets, time.Now), newPendingLoginStorage(), downstreamIssuer)
+			subject := NewHandler(test.idps.Build(), oauthHelper, happyStateCodec, happyCookieCodec, happyUpstreamRedirectURI, consentPrompt, provider.DefaultPages())
 			reqContext := context.WithValue(context.Background(), struct{ name string }{name: "test"}, "request-context")
 			req := httptest.NewRequest(test.method, test.path, nil).WithContext(reqContext)
 			if test.csrfCookie != "" {
@@ -1045,6 +1329,25 @@ func TestCallbackEndpoint(t *testing.T) {
 				test.idps.RequireExactlyZeroCallsToExchangeAuthcodeAndValidateTokens(t)
 			}
 
+			if test.wantGitHubUpstreamCalled != nil {
+				require.Equal(t, 1, test.wantGitHubUpstreamCalled.ExchangeAuthcodeCallCount())
+				require.Equal(t, &oidctestutil.ExchangeAuthcodeArgs{
+					Ctx:              reqContext,
+					Authcode:         happyUpstreamAuthcode,
+					PKCECodeVerifier: oidcpkce.Code(happyDownstreamPKCE),
+					RedirectURI:      happyUpstreamRedirectURI,
+				}, test.wantGitHubUpstreamCalled.ExchangeAuthcodeArgs(0))
+				if test.wantGitHubGetUserCall {
+					require.Equal(t, 1, test.wantGitHubUpstreamCalled.GetUserCallCount())
+					require.Equal(t, &oidctestutil.GetUserArgs{
+						Ctx:         reqContext,
+						AccessToken: githubUpstreamAccessToken,
+					}, test.wantGitHubUpstreamCalled.GetUserArgs(0))
+				} else {
+					require.Zero(t, test.wantGitHubUpstreamCalled.GetUserCallCount())
+				}
+			}
+
 			require.Equal(t, test.wantStatus, rsp.Code)
 			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), test.wantContentType)
 
@@ -1102,6 +1405,10 @@ func TestCallbackEndpoint(t *testing.T) {
 					test.wantDownstreamCustomSessionData,
 				)
 			}
+
+			if test.wantRedirectLocationString != "" {
+				require.Equal(t, []string{test.wantRedirectLocationString}, rsp.Header().Values("Location"))
+			}
 		})
 	}
 }
@@ -1161,6 +1468,7 @@ type upstreamStateParamBuilder oidctestutil.ExpectedUpstreamStateParamFormat
 func happyUpstreamStateParam() *upstreamStateParamBuilder {
 	return &upstreamStateParamBuilder{
 		U: happyUpstreamIDPName,
+		T: "oidc",
 		P: happyDownstreamRequestParams,
 		N: happyDownstreamNonce,
 		C: happyDownstreamCSRF,
@@ -1180,6 +1488,11 @@ func (b *upstreamStateParamBuilder) WithAuthorizeRequestParams(params string) *u
 	return b
 }
 
+func (b *upstreamStateParamBuilder) WithUpstreamType(upstreamType string) *upstreamStateParamBuilder {
+	b.T = upstreamType
+	return b
+}
+
 func (b *upstreamStateParamBuilder) WithNonce(nonce string) *upstreamStateParamBuilder {
 	b.N = nonce
 	return b
@@ -1195,11 +1508,37 @@ func (b *upstreamStateParamBuilder) WithPKCVE(pkce string) *upstreamStateParamBu
 	return b
 }
 
+func (b *upstreamStateParamBuilder) WithRequestedAt(requestedAt time.Time) *upstreamStateParamBuilder {
+	b.R = requestedAt.Unix()
+	return b
+}
+
 func (b *upstreamStateParamBuilder) WithStateVersion(version string) *upstreamStateParamBuilder {
 	b.V = version
 	return b
 }
 
+// newPendingLoginStorage returns a storage for pending logins, which uses its own client, so that pending logins are
+// not counted as stored records of the login.
+func newPendingLoginStorage() *pendinglogin.Storage {
+	return pendinglogin.NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), time.Now, rand.Reader)
+}
+
+// pendingLoginHandles returns a source of randomness which makes pendingLoginHandle(b) for each of the bytes, in order,
+// so that tests can refer to the pending logins which they store.
+func pendingLoginHandles(bs ...byte) io.Reader {
+	var handles []byte
+	for _, b := range bs {
+		handles = append(handles, bytes.Repeat([]byte{b}, 32)...)
+	}
+	return bytes.NewReader(handles)
+}
+
+// pendingLoginHandle returns the handle of a pending login which was stored with the randomness of pendingLoginHandles.
+func pendingLoginHandle(b byte) string {
+	return base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
 func happyUpstream() *oidctestutil.TestUpstreamOIDCIdentityProviderBuilder {
 	return oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
 		WithName(happyUpstreamIDPName).
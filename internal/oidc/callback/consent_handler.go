@@ -0,0 +1,257 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package callback
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/consent"
+	"go.pinniped.dev/internal/oidc/pendinglogin"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/provider/consenthtml"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	consentParamName         = "consent"
+	consentDecisionParamName = "decision"
+	consentDecisionAllow     = "allow"
+)
+
+// ConsentPrompt asks users whether a client which is not trusted may receive their tokens, unless they already
+// consented to the client receiving the requested scopes.
+type ConsentPrompt struct {
+	storage       *consent.Storage
+	pendingLogins *pendinglogin.Storage
+	consentURL    string
+}
+
+// NewConsentPrompt returns a ConsentPrompt which sends users to the consent page of the downstream issuer. The result
+// of the login is kept in pendingLogins until the user decides, and only its handle is sent to the browser, so the
+// user does not need to log in again.
+func NewConsentPrompt(storage *consent.Storage, pendingLogins *pendinglogin.Storage, downstreamIssuer string) *ConsentPrompt {
+	return &ConsentPrompt{
+		storage:       storage,
+		pendingLogins: pendingLogins,
+		consentURL:    downstreamIssuer + oidc.ConsentEndpointPath,
+	}
+}
+
+// redirectIfRequired sends the browser to the consent page when the user must consent before the client receives an
+// authcode. It returns whether it did.
+func (p *ConsentPrompt) redirectIfRequired(
+	w http.ResponseWriter,
+	r *http.Request,
+	authorizeRequester fosite.AuthorizeRequester,
+	state *oidc.UpstreamStateParamData,
+	identity *downstreamIdentity,
+) (bool, error) {
+	if p == nil {
+		return false, nil
+	}
+	if client, ok := authorizeRequester.GetClient().(*clientregistry.Client); ok && client.Trusted {
+		return false, nil
+	}
+
+	clientID := authorizeRequester.GetClient().GetID()
+	hasConsent, err := p.storage.HasConsent(r.Context(), identity.subject, clientID, authorizeRequester.GetRequestedScopes())
+	if err != nil {
+		plog.WarningErr("error reading consent", err, "clientID", clientID)
+		return false, httperr.Wrap(http.StatusInternalServerError, "error reading consent", err)
+	}
+	if hasConsent {
+		return false, nil
+	}
+
+	pendingHandle, err := p.pendingLogins.Create(r.Context(), &pendinglogin.Login{
+		Kind:              pendinglogin.KindConsent,
+		CSRFToken:         state.CSRFToken,
+		AuthParams:        state.AuthParams,
+		UpstreamName:      state.UpstreamName,
+		RequestedAt:       state.RequestedAt,
+		Subject:           identity.subject,
+		Username:          identity.username,
+		Groups:            identity.groups,
+		CustomSessionData: identity.customSessionData,
+		Authentication:    identity.authentication,
+	})
+	if err != nil {
+		plog.WarningErr("error storing pending consent", err, "clientID", clientID)
+		return false, httperr.Wrap(http.StatusInternalServerError, "error storing pending consent", err)
+	}
+
+	http.Redirect(w, r, p.consentURL+"?"+url.Values{consentParamName: []string{pendingHandle}}.Encode(), http.StatusSeeOther)
+	return true, nil
+}
+
+// NewConsentHandler returns an http.Handler that serves the Supervisor's consent page. A GET request renders the
+// page, which shows the client and the scopes which it requested, and a POST request of the page either remembers
+// the consent of the user and redirects back to the client with an authcode, or redirects back to the client with
+// an access_denied error. The pending consents are read from pendingLogins.
+func NewConsentHandler(
+	oauthHelper fosite.OAuth2Provider,
+	cookieDecoder oidc.Decoder,
+	downstreamIssuer string,
+	consentStorage *consent.Storage,
+	pendingLogins *pendinglogin.Storage,
+	pages *provider.Pages,
+) http.Handler {
+	consentURL := downstreamIssuer + oidc.ConsentEndpointPath
+
+	getHandler := securityheader.WrapWithCustomCSP(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		pendingHandle := r.FormValue(consentParamName)
+		pending, err := validateConsentRequest(r, pendingHandle, pendingLogins, cookieDecoder)
+		if err != nil {
+			return err
+		}
+
+		authParams, err := url.ParseQuery(pending.AuthParams)
+		if err != nil {
+			plog.Error("error reading pending consent downstream auth params", err)
+			return httperr.New(http.StatusBadRequest, "error reading pending consent downstream auth params")
+		}
+		var scopes []consenthtml.Scope
+		for _, scope := range strings.Fields(authParams.Get("scope")) {
+			scopes = append(scopes, consenthtml.Scope{Name: scope, Description: scopeDescription(scope)})
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		return pages.Consent.Template().Execute(w, &consenthtml.PageData{
+			ClientID:       authParams.Get("client_id"),
+			Username:       pending.Username,
+			Scopes:         scopes,
+			PendingConsent: pendingHandle,
+			PostPath:       consentURL,
+		})
+	}), pages.Consent.ContentSecurityPolicy())
+
+	// The decision may render the response_mode=form_post page, so the POST response uses its CSP.
+	postHandler := securityheader.WrapWithCustomCSP(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		pendingHandle := r.PostFormValue(consentParamName)
+		pending, err := validateConsentRequest(r, pendingHandle, pendingLogins, cookieDecoder)
+		if err != nil {
+			return err
+		}
+
+		state := &oidc.UpstreamStateParamData{
+			AuthParams:   pending.AuthParams,
+			UpstreamName: pending.UpstreamName,
+			CSRFToken:    pending.CSRFToken,
+			RequestedAt:  pending.RequestedAt,
+		}
+		authorizeRequester, err := newDownstreamAuthorizeRequest(r, oauthHelper, state)
+		if err != nil {
+			return err
+		}
+		clientID := authorizeRequester.GetClient().GetID()
+
+		if r.PostFormValue(consentDecisionParamName) != consentDecisionAllow {
+			// The pending consent is left to expire, so that the garbage collector revokes the upstream tokens which
+			// the client will not receive.
+			plog.Info("user did not consent to the client", "clientID", clientID)
+			oauthHelper.WriteAuthorizeError(w, authorizeRequester, fosite.ErrAccessDenied.WithHint("The user did not consent to the client receiving their tokens."))
+			return nil
+		}
+
+		// Only one request may finish the login, even when the page was submitted more than once.
+		err = pendingLogins.Delete(r.Context(), pendingHandle)
+		if errors.Is(err, pendinglogin.ErrNotFound) {
+			plog.Info("pending consent was already used")
+			return httperr.New(http.StatusUnprocessableEntity, "pending consent has expired, please log in again")
+		}
+		if err != nil {
+			plog.WarningErr("error deleting pending consent", err, "clientID", clientID)
+			return httperr.Wrap(http.StatusInternalServerError, "error deleting pending consent", err)
+		}
+
+		if err := consentStorage.Grant(r.Context(), pending.Subject, clientID, authorizeRequester.GetRequestedScopes()); err != nil {
+			plog.WarningErr("error storing consent", err, "clientID", clientID)
+			return httperr.Wrap(http.StatusInternalServerError, "error storing consent", err)
+		}
+
+		// The user has just consented, so there is no need to ask again.
+		return writeDownstreamAuthorizeResponse(w, r, oauthHelper, nil, authorizeRequester, state, &downstreamIdentity{
+			subject:           pending.Subject,
+			username:          pending.Username,
+			groups:            pending.Groups,
+			customSessionData: pending.CustomSessionData,
+			authentication:    pending.Authentication,
+		})
+	}), pages.FormPost.ContentSecurityPolicy())
+
+	methodNotAllowedHandler := securityheader.Wrap(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET or POST)", r.Method)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getHandler.ServeHTTP(w, r)
+		case http.MethodPost:
+			postHandler.ServeHTTP(w, r)
+		default:
+			methodNotAllowedHandler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// validateConsentRequest reads the pending consent and checks that it belongs to the same browser and has not
+// expired.
+func validateConsentRequest(r *http.Request, pendingHandle string, pendingLogins *pendinglogin.Storage, cookieDecoder oidc.Decoder) (*pendinglogin.Login, error) {
+	csrfValue, err := readCSRFCookie(r, cookieDecoder)
+	if err != nil {
+		plog.InfoErr("error reading CSRF cookie", err)
+		return nil, err
+	}
+
+	if pendingHandle == "" {
+		plog.Info("consent param not found")
+		return nil, httperr.New(http.StatusBadRequest, "consent param not found")
+	}
+
+	pending, err := pendingLogins.Get(r.Context(), pendinglogin.KindConsent, pendingHandle)
+	if errors.Is(err, pendinglogin.ErrNotFound) {
+		plog.Info("pending consent is unknown or has expired")
+		return nil, httperr.New(http.StatusUnprocessableEntity, "pending consent has expired, please log in again")
+	}
+	if err != nil {
+		plog.WarningErr("error reading pending consent", err)
+		return nil, httperr.Wrap(http.StatusInternalServerError, "error reading pending consent", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(pending.CSRFToken), []byte(csrfValue)) != 1 {
+		plog.Info("CSRF value does not match")
+		return nil, httperr.New(http.StatusForbidden, "CSRF value does not match")
+	}
+
+	return pending, nil
+}
+
+// scopeDescription returns what a client may do with the scope, as shown on the consent page.
+func scopeDescription(scope string) string {
+	switch scope {
+	case "openid":
+		return "Know your username and groups"
+	case "offline_access":
+		return "Keep access to your account while you are not using it"
+	case "profile":
+		return "See your profile"
+	case "email":
+		return "See your email address"
+	case "pinniped:request-audience":
+		return "Access Kubernetes clusters as you"
+	default:
+		return "Use this scope"
+	}
+}
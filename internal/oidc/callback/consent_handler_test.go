@@ -0,0 +1,386 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package callback
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/consent"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/pendinglogin"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/provider/consenthtml"
+	"go.pinniped.dev/internal/oidc/provider/formposthtml"
+	"go.pinniped.dev/internal/testutil"
+)
+
+const (
+	thirdPartyClientID    = "client.oauth.pinniped.dev-some-app"
+	thirdPartyRedirectURI = "https://app.example.com/callback"
+	thirdPartyUsername    = "some-user"
+	thirdPartySubject     = "https://my-upstream-issuer.com?sub=some-user"
+)
+
+var thirdPartyRequestParams = url.Values{
+	"response_type":         []string{"code"},
+	"scope":                 []string{"openid offline_access"},
+	"client_id":             []string{thirdPartyClientID},
+	"state":                 []string{happyDownstreamState},
+	"nonce":                 []string{downstreamNonce},
+	"code_challenge":        []string{downstreamPKCEChallenge},
+	"code_challenge_method": []string{downstreamPKCEChallengeMethod},
+	"redirect_uri":          []string{thirdPartyRedirectURI},
+}.Encode()
+
+func createThirdPartyClient(t *testing.T, secrets corev1client.SecretInterface) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("some-secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	_, err = secrets.Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: thirdPartyClientID},
+		Type:       clientregistry.ConfidentialClientSecretType,
+		Data: map[string][]byte{
+			"clientSecretHashes": hash,
+			"redirectURIs":       []byte(thirdPartyRedirectURI),
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+}
+
+func TestConsentPrompt(t *testing.T) {
+	state := &oidc.UpstreamStateParamData{
+		AuthParams:   thirdPartyRequestParams,
+		UpstreamName: happyUpstreamIDPName,
+		CSRFToken:    happyDownstreamCSRF,
+	}
+	identity := &downstreamIdentity{
+		subject:           thirdPartySubject,
+		username:          thirdPartyUsername,
+		groups:            []string{"some-group"},
+		customSessionData: happyDownstreamCustomSessionData,
+	}
+	newAuthorizeRequester := func(client fosite.Client) fosite.AuthorizeRequester {
+		authorizeRequester := fosite.NewAuthorizeRequest()
+		authorizeRequester.Client = client
+		authorizeRequester.RequestedScope = fosite.Arguments{"openid", "offline_access"}
+		return authorizeRequester
+	}
+	thirdPartyClient := &clientregistry.Client{
+		DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+			DefaultClient: &fosite.DefaultClient{ID: thirdPartyClientID},
+		},
+	}
+
+	t.Run("a nil prompt never asks for consent", func(t *testing.T) {
+		var prompt *ConsentPrompt
+		rsp := httptest.NewRecorder()
+		redirected, err := prompt.redirectIfRequired(rsp, httptest.NewRequest(http.MethodGet, "/", nil), newAuthorizeRequester(thirdPartyClient), state, identity)
+		require.NoError(t, err)
+		require.False(t, redirected)
+	})
+
+	t.Run("trusted clients do not need consent", func(t *testing.T) {
+		prompt := NewConsentPrompt(consent.NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), time.Now), newPendingLoginStorage(), downstreamIssuer)
+		rsp := httptest.NewRecorder()
+		redirected, err := prompt.redirectIfRequired(rsp, httptest.NewRequest(http.MethodGet, "/", nil), newAuthorizeRequester(clientregistry.PinnipedCLI()), state, identity)
+		require.NoError(t, err)
+		require.False(t, redirected)
+	})
+
+	t.Run("other clients redirect to the consent page until the user consents to all requested scopes", func(t *testing.T) {
+		storage := consent.NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), time.Now)
+		pendingLogins := newPendingLoginStorage()
+		prompt := NewConsentPrompt(storage, pendingLogins, downstreamIssuer)
+
+		rsp := httptest.NewRecorder()
+		redirected, err := prompt.redirectIfRequired(rsp, httptest.NewRequest(http.MethodGet, "/", nil), newAuthorizeRequester(thirdPartyClient), state, identity)
+		require.NoError(t, err)
+		require.True(t, redirected)
+		require.Equal(t, http.StatusSeeOther, rsp.Code)
+
+		location, err := url.Parse(rsp.Header().Get("Location"))
+		require.NoError(t, err)
+		require.Equal(t, downstreamIssuer+oidc.ConsentEndpointPath, location.Scheme+"://"+location.Host+location.Path)
+		// Only the handle of the pending consent is sent to the browser.
+		pending, err := pendingLogins.Get(context.Background(), pendinglogin.KindConsent, location.Query().Get(consentParamName))
+		require.NoError(t, err)
+		require.Equal(t, state.AuthParams, pending.AuthParams)
+		require.Equal(t, state.UpstreamName, pending.UpstreamName)
+		require.Equal(t, state.CSRFToken, pending.CSRFToken)
+		require.Equal(t, identity.subject, pending.Subject)
+		require.Equal(t, identity.username, pending.Username)
+		require.Equal(t, identity.groups, pending.Groups)
+		require.Equal(t, identity.customSessionData, pending.CustomSessionData)
+
+		require.NoError(t, storage.Grant(context.Background(), thirdPartySubject, thirdPartyClientID, []string{"openid"}))
+		redirected, err = prompt.redirectIfRequired(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), newAuthorizeRequester(thirdPartyClient), state, identity)
+		require.NoError(t, err)
+		require.True(t, redirected)
+
+		require.NoError(t, storage.Grant(context.Background(), thirdPartySubject, thirdPartyClientID, []string{"offline_access"}))
+		redirected, err = prompt.redirectIfRequired(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), newAuthorizeRequester(thirdPartyClient), state, identity)
+		require.NoError(t, err)
+		require.False(t, redirected)
+	})
+}
+
+func TestConsentEndpoint(t *testing.T) {
+	cookieCodec := securecookie.New([]byte("fake-hash-secret2"), []byte("0123456789ABCDE2"))
+	cookieCodec.SetSerializer(securecookie.JSONEncoder{})
+
+	encodedCSRFValue, err := cookieCodec.Encode("csrf", happyDownstreamCSRF)
+	require.NoError(t, err)
+	happyCSRFCookie := "__Host-pinniped-csrf=" + encodedCSRFValue
+
+	happyPendingConsent := func() *pendinglogin.Login {
+		return &pendinglogin.Login{
+			Kind:              pendinglogin.KindConsent,
+			CSRFToken:         happyDownstreamCSRF,
+			AuthParams:        thirdPartyRequestParams,
+			UpstreamName:      happyUpstreamIDPName,
+			Subject:           thirdPartySubject,
+			Username:          thirdPartyUsername,
+			Groups:            []string{"some-group"},
+			CustomSessionData: happyDownstreamCustomSessionData,
+		}
+	}
+	// Pending consents are stored before each test. Their handles are made from fixed sources of randomness, so that
+	// the test cases can refer to them.
+	happyPending := pendingLoginHandle('a')
+	otherCSRFPending := pendingLoginHandle('b')
+	pendingTOTPLogin := pendingLoginHandle('c')
+	expiredPending := pendingLoginHandle('d')
+
+	tests := []struct {
+		name        string
+		method      string
+		pending     string
+		decision    string
+		csrfCookie  string
+		wantStatus  int
+		wantCSP     string
+		wantBody    string
+		wantBodyHas []string
+		// wantRedirectPrefix is the expected prefix of the Location header, when the request is redirected.
+		wantRedirectPrefix string
+		wantRedirectHas    string
+		wantConsent        bool
+		// wantPendingUsed is true when the happy pending consent must have been deleted.
+		wantPendingUsed bool
+	}{
+		{
+			name:       "GET renders the consent page",
+			method:     http.MethodGet,
+			pending:    happyPending,
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusOK,
+			wantCSP:    consenthtml.ContentSecurityPolicy(),
+			wantBodyHas: []string{
+				"<h1>Allow " + thirdPartyClientID + " to access your account?</h1>",
+				"<strong>" + thirdPartyUsername + "</strong>",
+				`<li>Know your username and groups <span class="scope">openid</span></li>`,
+				`<li>Keep access to your account while you are not using it <span class="scope">offline_access</span></li>`,
+				`action="` + downstreamIssuer + oidc.ConsentEndpointPath + `"`,
+				`value="` + happyPending + `"`,
+			},
+		},
+		{
+			name:               "POST with allow stores the consent and redirects to the client with an authcode",
+			method:             http.MethodPost,
+			pending:            happyPending,
+			decision:           "allow",
+			csrfCookie:         happyCSRFCookie,
+			wantStatus:         http.StatusSeeOther,
+			wantCSP:            formposthtml.ContentSecurityPolicy(),
+			wantRedirectPrefix: thirdPartyRedirectURI + "?code=",
+			wantRedirectHas:    "state=" + happyDownstreamState,
+			wantConsent:        true,
+			wantPendingUsed:    true,
+		},
+		{
+			name:               "POST with deny redirects to the client with an error",
+			method:             http.MethodPost,
+			pending:            happyPending,
+			decision:           "deny",
+			csrfCookie:         happyCSRFCookie,
+			wantStatus:         http.StatusSeeOther,
+			wantCSP:            formposthtml.ContentSecurityPolicy(),
+			wantRedirectPrefix: thirdPartyRedirectURI + "?error=access_denied",
+			wantRedirectHas:    "state=" + happyDownstreamState,
+		},
+		{
+			name:       "PUT is not allowed",
+			method:     http.MethodPut,
+			pending:    happyPending,
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCSP:    "default-src 'none'",
+			wantBody:   "Method Not Allowed: PUT (try GET or POST)\n",
+		},
+		{
+			name:       "CSRF cookie is missing",
+			method:     http.MethodGet,
+			pending:    happyPending,
+			wantStatus: http.StatusForbidden,
+			wantCSP:    consenthtml.ContentSecurityPolicy(),
+			wantBody:   "Forbidden: CSRF cookie is missing\n",
+		},
+		{
+			name:       "consent param is missing",
+			method:     http.MethodPost,
+			decision:   "allow",
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusBadRequest,
+			wantCSP:    formposthtml.ContentSecurityPolicy(),
+			wantBody:   "Bad Request: consent param not found\n",
+		},
+		{
+			name:       "consent param is unknown or was already used",
+			method:     http.MethodGet,
+			pending:    pendingLoginHandle('z'),
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCSP:    consenthtml.ContentSecurityPolicy(),
+			wantBody:   "Unprocessable Entity: pending consent has expired, please log in again\n",
+		},
+		{
+			name:       "consent param is the handle of a pending login which still needs a TOTP code",
+			method:     http.MethodPost,
+			pending:    pendingTOTPLogin,
+			decision:   "allow",
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCSP:    formposthtml.ContentSecurityPolicy(),
+			wantBody:   "Unprocessable Entity: pending consent has expired, please log in again\n",
+		},
+		{
+			name:       "CSRF value of the pending consent does not match the cookie",
+			method:     http.MethodPost,
+			pending:    otherCSRFPending,
+			decision:   "allow",
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusForbidden,
+			wantCSP:    formposthtml.ContentSecurityPolicy(),
+			wantBody:   "Forbidden: CSRF value does not match\n",
+		},
+		{
+			name:       "pending consent has expired",
+			method:     http.MethodPost,
+			pending:    expiredPending,
+			decision:   "allow",
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCSP:    formposthtml.ContentSecurityPolicy(),
+			wantBody:   "Unprocessable Entity: pending consent has expired, please log in again\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			createThirdPartyClient(t, secrets)
+
+			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
+			oauthStore := oidc.NewKubeStorage(secrets, timeoutsConfiguration)
+			hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwks.NewDynamicJWKSProvider(), timeoutsConfiguration, nil)
+			consentStorage := consent.NewStorage(secrets, time.Now)
+
+			pendingLoginSecrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			pendingLogins := pendinglogin.NewStorage(pendingLoginSecrets, time.Now, pendingLoginHandles('a', 'b', 'c'))
+			for _, edit := range []func(*pendinglogin.Login){
+				nil,
+				func(p *pendinglogin.Login) { p.CSRFToken = "other-csrf" },
+				func(p *pendinglogin.Login) { p.Kind = pendinglogin.KindTOTP },
+			} {
+				pending := happyPendingConsent()
+				if edit != nil {
+					edit(pending)
+				}
+				_, err := pendingLogins.Create(context.Background(), pending)
+				require.NoError(t, err)
+			}
+			expiredPendingLogins := pendinglogin.NewStorage(pendingLoginSecrets, func() time.Time { return time.Now().Add(-pendinglogin.Lifetime - time.Minute) },
+				pendingLoginHandles('d'))
+			_, err := expiredPendingLogins.Create(context.Background(), happyPendingConsent())
+			require.NoError(t, err)
+
+			subject := NewConsentHandler(oauthHelper, cookieCodec, downstreamIssuer, consentStorage, pendingLogins, provider.DefaultPages())
+
+			form := url.Values{}
+			if test.pending != "" {
+				form.Set(consentParamName, test.pending)
+			}
+			if test.decision != "" {
+				form.Set(consentDecisionParamName, test.decision)
+			}
+			var req *http.Request
+			if test.method == http.MethodGet {
+				req = httptest.NewRequest(test.method, oidc.ConsentEndpointPath+"?"+form.Encode(), nil)
+			} else {
+				req = httptest.NewRequest(test.method, oidc.ConsentEndpointPath, strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if test.csrfCookie != "" {
+				req.Header.Set("Cookie", test.csrfCookie)
+			}
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response: %#v", rsp)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			testutil.RequireSecurityHeaders(t, rsp)
+			require.Equal(t, test.wantStatus, rsp.Code)
+			require.Contains(t, rsp.Header().Get("Content-Security-Policy"), test.wantCSP)
+
+			if test.wantBody != "" {
+				require.Equal(t, test.wantBody, rsp.Body.String())
+			}
+			for _, want := range test.wantBodyHas {
+				require.Contains(t, rsp.Body.String(), want)
+			}
+			if test.wantRedirectPrefix != "" {
+				require.True(t, strings.HasPrefix(rsp.Header().Get("Location"), test.wantRedirectPrefix), rsp.Header().Get("Location"))
+				require.Contains(t, rsp.Header().Get("Location"), test.wantRedirectHas)
+			} else {
+				require.Empty(t, rsp.Header().Get("Location"))
+			}
+
+			hasConsent, err := consentStorage.HasConsent(context.Background(), thirdPartySubject, thirdPartyClientID, []string{"openid", "offline_access"})
+			require.NoError(t, err)
+			require.Equal(t, test.wantConsent, hasConsent)
+
+			_, err = pendingLogins.Get(context.Background(), pendinglogin.KindConsent, happyPending)
+			if test.wantPendingUsed {
+				require.ErrorIs(t, err, pendinglogin.ErrNotFound)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestScopeDescription(t *testing.T) {
+	require.Equal(t, "Know your username and groups", scopeDescription("openid"))
+	require.Equal(t, "Access Kubernetes clusters as you", scopeDescription("pinniped:request-audience"))
+	require.Equal(t, "Use this scope", scopeDescription("some-other-scope"))
+}
@@ -0,0 +1,470 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package callback
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/authenticators"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/loginlimit"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/downstreamsession"
+	"go.pinniped.dev/internal/oidc/pendinglogin"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/provider/loginhtml"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/totp"
+)
+
+const (
+	loginStateParamName    = "state"
+	loginUsernameParamName = "username"
+	loginPasswordParamName = "password"
+	loginErrorParamName    = "err"
+	loginEnrollTOTPParam   = "enroll_totp"
+	loginTOTPParamName     = "totp"
+	loginTOTPCodeParamName = "totp_code"
+
+	// loginErrorBadUsernameOrPassword, loginErrorInternal, loginErrorBadTOTPCode, loginErrorTOTPTimeout and
+	// loginErrorTooManyAttempts are values of the err param. The other possible values are the
+	// authenticators.AccountStateReason values.
+	loginErrorBadUsernameOrPassword = "login_error"
+	loginErrorInternal              = "internal_error"
+	loginErrorBadTOTPCode           = "totp_error"
+	loginErrorTOTPTimeout           = "totp_timeout"
+	loginErrorTooManyAttempts       = "too_many_attempts"
+)
+
+// NewLoginHandler returns an http.Handler that serves the Supervisor's login page, which is used by browser-based
+// logins with LDAP and Active Directory upstreams. A GET request renders the login form, and a POST request of the
+// form authenticates the user with the upstream. It is the LDAP equivalent of the callback endpoint, so it uses the
+// same state param and CSRF cookie. When the upstream requires a TOTP code, the login page has a second step which
+// asks for the code after the password was accepted. The result of the password step is kept in pendingLogins, and
+// only its handle is sent to the browser, so the user does not need to provide their password again.
+func NewLoginHandler(
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
+	oauthHelper fosite.OAuth2Provider,
+	stateCodec oidc.Codec,
+	cookieDecoder oidc.Decoder,
+	downstreamIssuer string,
+	pendingLogins *pendinglogin.Storage,
+	totpVerifier *totp.Verifier,
+	loginLimiter *loginlimit.Limiter,
+	consentPrompt *ConsentPrompt,
+	pages *provider.Pages,
+) http.Handler {
+	loginURL := downstreamIssuer + oidc.LoginEndpointPath
+
+	getHandler := securityheader.WrapWithCustomCSP(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		encodedState := r.FormValue(loginStateParamName)
+		state, upstreamIDPConfig, err := validateLoginRequest(r, encodedState, upstreamIDPs, stateCodec, cookieDecoder)
+		if err != nil {
+			return err
+		}
+
+		pageData := &loginhtml.PageData{
+			IDPName:      upstreamIDPConfig.GetName(),
+			State:        encodedState,
+			PostPath:     loginURL,
+			AlertMessage: loginErrorMessage(r.FormValue(loginErrorParamName)),
+			TOTPOptional: upstreamIDPConfig.GetTOTPMode() == totp.ModeOptional,
+		}
+		if pendingHandle := r.FormValue(loginTOTPParamName); pendingHandle != "" {
+			addTOTPStepToPageData(r, pageData, pendingHandle, state, upstreamIDPConfig, pendingLogins, totpVerifier)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		return pages.Login.Template().Execute(w, pageData)
+	}), pages.Login.ContentSecurityPolicy())
+
+	// A successful login may render the response_mode=form_post page, so the POST response uses its CSP.
+	postHandler := securityheader.WrapWithCustomCSP(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		encodedState := r.PostFormValue(loginStateParamName)
+		state, upstreamIDPConfig, err := validateLoginRequest(r, encodedState, upstreamIDPs, stateCodec, cookieDecoder)
+		if err != nil {
+			return err
+		}
+
+		authorizeRequester, err := newDownstreamAuthorizeRequest(r, oauthHelper, state)
+		if err != nil {
+			return err
+		}
+
+		if pendingHandle := r.PostFormValue(loginTOTPParamName); pendingHandle != "" {
+			identity, loginErr := continueLoginWithTOTPCode(r, pendingHandle, state, upstreamIDPConfig, pendingLogins, totpVerifier, loginLimiter)
+			switch loginErr {
+			case "":
+				return writeDownstreamAuthorizeResponse(w, r, oauthHelper, consentPrompt, authorizeRequester, state, identity)
+			case loginErrorBadTOTPCode:
+				// Stay on the second step of the login page, so the user can try another code.
+				redirectToLoginPage(w, r, loginURL, encodedState, pendingHandle, loginErr)
+			default:
+				redirectToLoginPage(w, r, loginURL, encodedState, "", loginErr)
+			}
+			return nil
+		}
+
+		identity, loginAttempt, loginErr := loginWithLDAPUpstream(r, state, upstreamIDPConfig, loginLimiter)
+		defer loginAttempt.End(r.Context())
+		if loginErr != "" {
+			redirectToLoginPage(w, r, loginURL, encodedState, "", loginErr)
+			return nil
+		}
+
+		pendingHandle, loginErr := requireTOTPCode(r, identity, state, upstreamIDPConfig, pendingLogins, totpVerifier)
+		if loginErr != "" {
+			redirectToLoginPage(w, r, loginURL, encodedState, "", loginErr)
+			return nil
+		}
+		if pendingHandle != "" {
+			// The attempt is not over yet, so it is neither a failure nor a success. Wrong codes are counted by the
+			// second step of the login page.
+			redirectToLoginPage(w, r, loginURL, encodedState, pendingHandle, "")
+			return nil
+		}
+
+		loginAttempt.Succeeded()
+		return writeDownstreamAuthorizeResponse(w, r, oauthHelper, consentPrompt, authorizeRequester, state, identity)
+	}), pages.FormPost.ContentSecurityPolicy())
+
+	methodNotAllowedHandler := securityheader.Wrap(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET or POST)", r.Method)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getHandler.ServeHTTP(w, r)
+		case http.MethodPost:
+			postHandler.ServeHTTP(w, r)
+		default:
+			methodNotAllowedHandler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// loginWithLDAPUpstream authenticates the username and password from the login form. It also returns the login
+// attempt, which the caller must end. When the user could not be authenticated, it returns the value of the err
+// param which should be shown on the login page instead.
+func loginWithLDAPUpstream(
+	r *http.Request,
+	state *oidc.UpstreamStateParamData,
+	upstreamIDPConfig provider.UpstreamLDAPIdentityProviderI,
+	loginLimiter *loginlimit.Limiter,
+) (*downstreamIdentity, *loginlimit.Attempt, string) {
+	username := r.PostFormValue(loginUsernameParamName)
+	password := r.PostFormValue(loginPasswordParamName)
+	if username == "" || password == "" {
+		return nil, nil, loginErrorBadUsernameOrPassword
+	}
+
+	loginAttempt, loginErr := beginLoginAttempt(r, loginLimiter, upstreamIDPConfig.GetName(), username)
+	if loginErr != "" {
+		return nil, nil, loginErr
+	}
+
+	authenticateResponse, authenticated, err := upstreamIDPConfig.AuthenticateUser(r.Context(), username, password)
+	var accountStateErr *authenticators.AccountStateError
+	if errors.As(err, &accountStateErr) {
+		plog.InfoErr("upstream LDAP authentication failed because of the state of the user's account", err,
+			"upstreamName", upstreamIDPConfig.GetName(), "reason", accountStateErr.Reason)
+		return nil, loginAttempt, string(accountStateErr.Reason)
+	}
+	if err != nil {
+		plog.WarningErr("unexpected error during upstream LDAP authentication", err, "upstreamName", upstreamIDPConfig.GetName())
+		return nil, loginAttempt, loginErrorInternal
+	}
+	if !authenticated {
+		loginAttempt.Failed()
+		return nil, loginAttempt, loginErrorBadUsernameOrPassword
+	}
+
+	idpType := psession.ProviderType(state.UpstreamType)
+	return &downstreamIdentity{
+		subject:           downstreamsession.DownstreamSubjectFromUpstreamLDAP(upstreamIDPConfig, authenticateResponse),
+		username:          authenticateResponse.User.GetName(),
+		groups:            authenticateResponse.User.GetGroups(),
+		customSessionData: downstreamsession.MakeDownstreamLDAPOrADCustomSessionData(upstreamIDPConfig, idpType, authenticateResponse),
+	}, loginAttempt, ""
+}
+
+// requireTOTPCode checks whether the user must provide a TOTP code after their password was accepted. When they
+// must, it stores a pending login and returns its handle for the second step of the login page. When the user could
+// not be verified, it returns the value of the err param which should be shown on the login page instead.
+func requireTOTPCode(
+	r *http.Request,
+	identity *downstreamIdentity,
+	state *oidc.UpstreamStateParamData,
+	upstreamIDPConfig provider.UpstreamLDAPIdentityProviderI,
+	pendingLogins *pendinglogin.Storage,
+	totpVerifier *totp.Verifier,
+) (string, string) {
+	wantsToEnroll := r.PostFormValue(loginEnrollTOTPParam) != ""
+	user := downstreamsession.TOTPUser(identity.subject, identity.username, upstreamIDPConfig.GetName())
+	err := totpVerifier.Verify(r.Context(), upstreamIDPConfig.GetTOTPMode(), user, "", wantsToEnroll)
+	if err == nil {
+		return "", ""
+	}
+
+	var challenge *totp.ChallengeError
+	if !errors.As(err, &challenge) {
+		plog.WarningErr("unexpected error during TOTP verification", err, "upstreamName", upstreamIDPConfig.GetName())
+		return "", loginErrorInternal
+	}
+
+	pendingHandle, err := pendingLogins.Create(r.Context(), &pendinglogin.Login{
+		Kind:              pendinglogin.KindTOTP,
+		CSRFToken:         state.CSRFToken,
+		UpstreamName:      upstreamIDPConfig.GetName(),
+		LoginUsername:     r.PostFormValue(loginUsernameParamName),
+		Subject:           identity.subject,
+		Username:          identity.username,
+		Groups:            identity.groups,
+		CustomSessionData: identity.customSessionData,
+	})
+	if err != nil {
+		plog.WarningErr("error storing pending TOTP login", err, "upstreamName", upstreamIDPConfig.GetName())
+		return "", loginErrorInternal
+	}
+	return pendingHandle, ""
+}
+
+// continueLoginWithTOTPCode verifies the TOTP code from the second step of the login page. When the user could not
+// be verified, it returns the value of the err param which should be shown on the login page instead. The pending
+// login is deleted once the code was accepted, so it cannot be used again.
+func continueLoginWithTOTPCode(
+	r *http.Request,
+	pendingHandle string,
+	state *oidc.UpstreamStateParamData,
+	upstreamIDPConfig provider.UpstreamLDAPIdentityProviderI,
+	pendingLogins *pendinglogin.Storage,
+	totpVerifier *totp.Verifier,
+	loginLimiter *loginlimit.Limiter,
+) (*downstreamIdentity, string) {
+	pending, loginErr := readPendingTOTPLogin(r, pendingHandle, state, upstreamIDPConfig, pendingLogins)
+	if loginErr != "" {
+		return nil, loginErr
+	}
+
+	// Wrong codes count as failed login attempts of the username which was used in the password step.
+	loginAttempt, loginErr := beginLoginAttempt(r, loginLimiter, upstreamIDPConfig.GetName(), pending.LoginUsername)
+	if loginErr != "" {
+		return nil, loginErr
+	}
+	defer loginAttempt.End(r.Context())
+
+	// Users who reached the second step have either enrolled or chosen to enroll.
+	user := downstreamsession.TOTPUser(pending.Subject, pending.Username, upstreamIDPConfig.GetName())
+	err := totpVerifier.Verify(r.Context(), upstreamIDPConfig.GetTOTPMode(), user, r.PostFormValue(loginTOTPCodeParamName), true)
+	var challenge *totp.ChallengeError
+	if errors.As(err, &challenge) {
+		loginAttempt.Failed()
+		return nil, loginErrorBadTOTPCode
+	}
+	if err != nil {
+		plog.WarningErr("unexpected error during TOTP verification", err, "upstreamName", upstreamIDPConfig.GetName())
+		return nil, loginErrorInternal
+	}
+
+	// Only one request may finish the login, even when the same code was sent more than once.
+	err = pendingLogins.Delete(r.Context(), pendingHandle)
+	if errors.Is(err, pendinglogin.ErrNotFound) {
+		plog.Info("pending TOTP login was already used")
+		return nil, loginErrorTOTPTimeout
+	}
+	if err != nil {
+		plog.WarningErr("error deleting pending TOTP login", err, "upstreamName", upstreamIDPConfig.GetName())
+		return nil, loginErrorInternal
+	}
+	loginAttempt.Succeeded()
+
+	return &downstreamIdentity{
+		subject:           pending.Subject,
+		username:          pending.Username,
+		groups:            pending.Groups,
+		customSessionData: pending.CustomSessionData,
+	}, ""
+}
+
+// beginLoginAttempt begins a login attempt of the username from the client. When the username or the client made
+// too many failed login attempts recently, it returns the value of the err param which should be shown on the login
+// page instead.
+func beginLoginAttempt(r *http.Request, loginLimiter *loginlimit.Limiter, upstreamName string, username string) (*loginlimit.Attempt, string) {
+	loginAttempt, err := loginLimiter.Begin(r.Context(), loginlimit.UsernameKey(upstreamName, username), loginlimit.ClientIPKey(r))
+	var tooManyAttemptsErr *loginlimit.TooManyAttemptsError
+	switch {
+	case err == nil:
+		return loginAttempt, ""
+	case errors.As(err, &tooManyAttemptsErr):
+		plog.Info("login attempt rejected because of too many failed attempts",
+			"kind", tooManyAttemptsErr.Kind, "retryAfter", tooManyAttemptsErr.RetryAfter)
+		return nil, loginErrorTooManyAttempts
+	default:
+		plog.WarningErr("unexpected error while checking login limits", err)
+		return nil, loginErrorInternal
+	}
+}
+
+// addTOTPStepToPageData changes the login page to its second step, which asks for a TOTP code. When the user must
+// enroll, the page also shows their new secret. When the pending login is no longer valid, the page stays on the
+// first step and shows an error instead.
+func addTOTPStepToPageData(
+	r *http.Request,
+	pageData *loginhtml.PageData,
+	pendingHandle string,
+	state *oidc.UpstreamStateParamData,
+	upstreamIDPConfig provider.UpstreamLDAPIdentityProviderI,
+	pendingLogins *pendinglogin.Storage,
+	totpVerifier *totp.Verifier,
+) {
+	pending, loginErr := readPendingTOTPLogin(r, pendingHandle, state, upstreamIDPConfig, pendingLogins)
+	if loginErr != "" {
+		pageData.AlertMessage = loginErrorMessage(loginErr)
+		return
+	}
+
+	// Asking again without a code returns the same challenge, including the same secret for unconfirmed enrollments.
+	user := downstreamsession.TOTPUser(pending.Subject, pending.Username, upstreamIDPConfig.GetName())
+	err := totpVerifier.Verify(r.Context(), upstreamIDPConfig.GetTOTPMode(), user, "", true)
+	var challenge *totp.ChallengeError
+	if err != nil && !errors.As(err, &challenge) {
+		plog.WarningErr("unexpected error during TOTP verification", err, "upstreamName", upstreamIDPConfig.GetName())
+		pageData.AlertMessage = loginErrorMessage(loginErrorInternal)
+		return
+	}
+
+	pageData.PendingTOTPLogin = pendingHandle
+	if challenge != nil && challenge.Reason == totp.ChallengeEnrollmentRequired {
+		pageData.TOTPEnrollmentSecret = challenge.EncodedSecret
+		// The otpauth:// URI was generated by the Supervisor, so it is safe to use as a link.
+		pageData.TOTPEnrollmentURI = template.URL(challenge.KeyURI) //nolint:gosec // see above
+	}
+}
+
+// readPendingTOTPLogin reads the pending login and checks that it belongs to the same login attempt. When it does
+// not, it returns the value of the err param which should be shown on the login page instead.
+func readPendingTOTPLogin(
+	r *http.Request,
+	pendingHandle string,
+	state *oidc.UpstreamStateParamData,
+	upstreamIDPConfig provider.UpstreamLDAPIdentityProviderI,
+	pendingLogins *pendinglogin.Storage,
+) (*pendinglogin.Login, string) {
+	pending, err := pendingLogins.Get(r.Context(), pendinglogin.KindTOTP, pendingHandle)
+	if errors.Is(err, pendinglogin.ErrNotFound) {
+		plog.Info("pending TOTP login is unknown or has expired")
+		return nil, loginErrorTOTPTimeout
+	}
+	if err != nil {
+		plog.WarningErr("error reading pending TOTP login", err, "upstreamName", upstreamIDPConfig.GetName())
+		return nil, loginErrorInternal
+	}
+	if subtle.ConstantTimeCompare([]byte(pending.CSRFToken), []byte(state.CSRFToken)) != 1 ||
+		pending.UpstreamName != upstreamIDPConfig.GetName() {
+		plog.Info("pending TOTP login does not match the state param")
+		return nil, loginErrorTOTPTimeout
+	}
+	return pending, ""
+}
+
+// redirectToLoginPage sends the browser back to the login page, which will show the error to the user. When the
+// handle of a pending TOTP login is not empty, the login page shows its second step, which asks for a TOTP code.
+func redirectToLoginPage(w http.ResponseWriter, r *http.Request, loginURL string, encodedState string, pendingHandle string, loginErr string) {
+	query := url.Values{loginStateParamName: []string{encodedState}}
+	if pendingHandle != "" {
+		query.Set(loginTOTPParamName, pendingHandle)
+	}
+	if loginErr != "" {
+		query.Set(loginErrorParamName, loginErr)
+	}
+	http.Redirect(w, r, loginURL+"?"+query.Encode(), http.StatusSeeOther)
+}
+
+// loginErrorMessage returns the message to show on the login page for the value of the err param.
+func loginErrorMessage(loginErr string) string {
+	switch loginErr {
+	case "":
+		return ""
+	case loginErrorBadUsernameOrPassword:
+		return "Incorrect username or password."
+	case loginErrorInternal:
+		return "An internal error occurred. Please contact your administrator for help."
+	case loginErrorBadTOTPCode:
+		return "Incorrect authentication code."
+	case loginErrorTOTPTimeout:
+		return "Your login has timed out. Please log in again."
+	case loginErrorTooManyAttempts:
+		return "Too many failed login attempts. Please wait a few minutes before trying again."
+	default:
+		if description, ok := authenticators.AccountStateDescription(authenticators.AccountStateReason(loginErr)); ok {
+			return description
+		}
+		// Ignore unknown values, since the param could have been changed by anyone.
+		return ""
+	}
+}
+
+func validateLoginRequest(
+	r *http.Request,
+	encodedState string,
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
+	stateDecoder, cookieDecoder oidc.Decoder,
+) (*oidc.UpstreamStateParamData, provider.UpstreamLDAPIdentityProviderI, error) {
+	csrfValue, err := readCSRFCookie(r, cookieDecoder)
+	if err != nil {
+		plog.InfoErr("error reading CSRF cookie", err)
+		return nil, nil, err
+	}
+
+	if encodedState == "" {
+		plog.Info("state param not found")
+		return nil, nil, httperr.New(http.StatusBadRequest, "state param not found")
+	}
+
+	state, err := readState(encodedState, stateDecoder)
+	if err != nil {
+		plog.InfoErr("error reading state", err)
+		return nil, nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(state.CSRFToken), []byte(csrfValue)) != 1 {
+		plog.InfoErr("CSRF value does not match", err)
+		return nil, nil, httperr.Wrap(http.StatusForbidden, "CSRF value does not match", err)
+	}
+
+	upstreamIDPConfig := findLDAPUpstreamIDPConfig(state, upstreamIDPs)
+	if upstreamIDPConfig == nil {
+		plog.Warning("upstream provider not found")
+		return nil, nil, httperr.New(http.StatusUnprocessableEntity, "upstream provider not found")
+	}
+
+	return state, upstreamIDPConfig, nil
+}
+
+func findLDAPUpstreamIDPConfig(state *oidc.UpstreamStateParamData, upstreamIDPs oidc.UpstreamIdentityProvidersLister) provider.UpstreamLDAPIdentityProviderI {
+	var candidates []provider.UpstreamLDAPIdentityProviderI
+	switch psession.ProviderType(state.UpstreamType) {
+	case psession.ProviderTypeLDAP:
+		candidates = upstreamIDPs.GetLDAPIdentityProviders()
+	case psession.ProviderTypeActiveDirectory:
+		candidates = upstreamIDPs.GetActiveDirectoryIdentityProviders()
+	default:
+		return nil
+	}
+	for _, p := range candidates {
+		if p.GetName() == state.UpstreamName {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,855 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package callback
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/authenticators"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/loginlimit"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/consent"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/pendinglogin"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/provider/formposthtml"
+	"go.pinniped.dev/internal/oidc/provider/loginhtml"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+	"go.pinniped.dev/internal/totp"
+)
+
+const (
+	ldapUpstreamUsername          = "some-ldap-user"
+	ldapUpstreamPassword          = "some-ldap-password"
+	ldapUpstreamMappedUsername    = "some-mapped-ldap-username"
+	ldapUpstreamUID               = "some-ldap-uid"
+	ldapUpstreamDN                = "cn=some-ldap-user,ou=users,dc=example,dc=com"
+	ldapUpstreamDownstreamSubject = "ldaps://some-ldap-host:8443?base=ou%3Dusers&sub=some-ldap-uid"
+)
+
+var ldapUpstreamGroupMembership = []string{"ldap-group-1", "ldap-group-2"}
+
+func TestLoginEndpoint(t *testing.T) {
+	var stateCodec = securecookie.New([]byte("fake-hash-secret"), []byte("0123456789ABCDEF"))
+	stateCodec.SetSerializer(securecookie.JSONEncoder{})
+	var cookieCodec = securecookie.New([]byte("fake-hash-secret2"), []byte("0123456789ABCDE2"))
+	cookieCodec.SetSerializer(securecookie.JSONEncoder{})
+
+	happyLDAPState := happyUpstreamStateParam().WithUpstreamType("ldap").Build(t, stateCodec)
+	happyADState := happyUpstreamStateParam().WithUpstreamType("activedirectory").Build(t, stateCodec)
+	happyOIDCState := happyUpstreamStateParam().Build(t, stateCodec)
+
+	encodedCSRF, err := cookieCodec.Encode("csrf", happyDownstreamCSRF)
+	require.NoError(t, err)
+	happyCSRFCookie := "__Host-pinniped-csrf=" + encodedCSRF
+	encodedOtherCSRF, err := cookieCodec.Encode("csrf", "some-other-csrf")
+	require.NoError(t, err)
+
+	ldapURL, err := url.Parse("ldaps://some-ldap-host:8443?base=ou%3Dusers")
+	require.NoError(t, err)
+
+	happyLDAPUpstream := func(authenticate func(ctx context.Context, username, password string) (*authenticators.Response, bool, error)) *oidctestutil.TestUpstreamLDAPIdentityProvider {
+		return &oidctestutil.TestUpstreamLDAPIdentityProvider{
+			Name:             happyUpstreamIDPName,
+			ResourceUID:      happyUpstreamIDPResourceUID,
+			URL:              ldapURL,
+			AuthenticateFunc: authenticate,
+		}
+	}
+	authenticateCalls := 0
+	happyAuthenticate := func(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
+		authenticateCalls++
+		if username != ldapUpstreamUsername || password != ldapUpstreamPassword {
+			return nil, false, nil
+		}
+		return &authenticators.Response{
+			User: &user.DefaultInfo{
+				Name:   ldapUpstreamMappedUsername,
+				UID:    ldapUpstreamUID,
+				Groups: ldapUpstreamGroupMembership,
+			},
+			DN:                     ldapUpstreamDN,
+			ExtraRefreshAttributes: map[string]string{"some-attribute": "some-value"},
+		}, true, nil
+	}
+	accountLockedAuthenticate := func(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
+		authenticateCalls++
+		return nil, false, &authenticators.AccountStateError{
+			Reason: authenticators.AccountStateAccountLocked,
+			Err:    errors.New("some upstream details"),
+		}
+	}
+	erroringAuthenticate := func(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
+		authenticateCalls++
+		return nil, false, errors.New("some upstream error")
+	}
+
+	happyLDAPUpstreamWithTOTPMode := func(mode totp.Mode) *oidctestutil.TestUpstreamLDAPIdentityProvider {
+		idp := happyLDAPUpstream(happyAuthenticate)
+		idp.TOTPMode = mode
+		return idp
+	}
+
+	// TOTP codes are verified at a fixed time, and new TOTP secrets are generated from a fixed source of randomness.
+	totpNow := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	happyTOTPSecret := []byte("some-totp-secret-123")
+	newTOTPSecret := bytes.Repeat([]byte{0x42}, 20)
+	happyPendingTOTPLogin := func() *pendinglogin.Login {
+		return &pendinglogin.Login{
+			Kind:          pendinglogin.KindTOTP,
+			CSRFToken:     happyDownstreamCSRF,
+			UpstreamName:  happyUpstreamIDPName,
+			LoginUsername: ldapUpstreamUsername,
+			Subject:       ldapUpstreamDownstreamSubject,
+			Username:      ldapUpstreamMappedUsername,
+			Groups:        ldapUpstreamGroupMembership,
+			CustomSessionData: &psession.CustomSessionData{
+				ProviderUID:  happyUpstreamIDPResourceUID,
+				ProviderName: happyUpstreamIDPName,
+				ProviderType: psession.ProviderTypeLDAP,
+				LDAP: &psession.LDAPSessionData{
+					UserDN:                 ldapUpstreamDN,
+					ExtraRefreshAttributes: map[string]string{"some-attribute": "some-value"},
+				},
+			},
+		}
+	}
+	// Pending TOTP logins are stored before each test using their own client. Their handles are made from fixed
+	// sources of randomness, so that the test cases can refer to them.
+	happyPendingTOTPLoginHandle := pendingLoginHandle('a')
+	otherCSRFPendingTOTPLoginHandle := pendingLoginHandle('b')
+	expiredPendingTOTPLoginHandle := pendingLoginHandle('c')
+	happyLoginLimitKey := loginlimit.UsernameKey(happyUpstreamIDPName, ldapUpstreamUsername)
+	happyClientIPLoginLimitKey := loginlimit.Key{Kind: loginlimit.KindClientIP, Value: "192.0.2.1"} // the address of all httptest requests
+
+	totpLoginPageLocation := func(state string, pendingHandle string, loginErr string) string {
+		return downstreamIssuer + "/login?" + url.Values{"state": {state}, "totp": {pendingHandle}, "err": {loginErr}}.Encode()
+	}
+
+	happyForm := func(state string) url.Values {
+		return url.Values{"state": {state}, "username": {ldapUpstreamUsername}, "password": {ldapUpstreamPassword}}
+	}
+	loginPageLocation := func(state string, loginErr string) string {
+		return downstreamIssuer + "/login?" + url.Values{"state": {state}, "err": {loginErr}}.Encode()
+	}
+
+	tests := []struct {
+		name string
+
+		idps       *oidctestutil.UpstreamIDPListerBuilder
+		method     string
+		query      url.Values
+		form       url.Values
+		csrfCookie string
+
+		wantStatus                      int
+		wantContentType                 string
+		wantCSP                         string
+		wantBody                        string
+		wantBodyContains                []string
+		wantBodyNotContains             []string
+		wantRedirectLocation            string
+		wantRedirectLocationRegexp      string
+		wantDownstreamCustomSessionData *psession.CustomSessionData
+		wantAuthenticateCalls           int
+
+		totpEnrolled             bool // when true, the user has a confirmed enrollment of happyTOTPSecret
+		totpKeyIsMissing         bool
+		wantRedirectToTOTPStep   bool
+		wantPendingTOTPLoginUsed bool // when true, the happy pending TOTP login must have been deleted
+
+		priorLoginFailures    []loginlimit.Key // each key has one failed login attempt before the request
+		wantLoginLimitRecords int
+	}{
+		{
+			name:            "GET with good state and cookie renders the login form",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodGet,
+			query:           url.Values{"state": {happyLDAPState}},
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusOK,
+			wantContentType: htmlContentType,
+			wantCSP:         loginhtml.ContentSecurityPolicy(),
+			wantBodyContains: []string{
+				"<h1>Log in to " + happyUpstreamIDPName + "</h1>",
+				`<form action="` + downstreamIssuer + `/login" method="post"`,
+				`<input type="hidden" name="state" value="` + happyLDAPState + `"/>`,
+			},
+			wantBodyNotContains: []string{`class="alert"`},
+		},
+		{
+			name:             "GET for an Active Directory upstream renders the login form",
+			idps:             oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(happyLDAPUpstream(happyAuthenticate)),
+			method:           http.MethodGet,
+			query:            url.Values{"state": {happyADState}},
+			csrfCookie:       happyCSRFCookie,
+			wantStatus:       http.StatusOK,
+			wantContentType:  htmlContentType,
+			wantCSP:          loginhtml.ContentSecurityPolicy(),
+			wantBodyContains: []string{"<h1>Log in to " + happyUpstreamIDPName + "</h1>"},
+		},
+		{
+			name:             "GET after a bad username or password shows an error message",
+			idps:             oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:           http.MethodGet,
+			query:            url.Values{"state": {happyLDAPState}, "err": {"login_error"}},
+			csrfCookie:       happyCSRFCookie,
+			wantStatus:       http.StatusOK,
+			wantContentType:  htmlContentType,
+			wantCSP:          loginhtml.ContentSecurityPolicy(),
+			wantBodyContains: []string{`<div class="alert" role="alert">Incorrect username or password.</div>`},
+		},
+		{
+			name:             "GET after an internal error shows an error message",
+			idps:             oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:           http.MethodGet,
+			query:            url.Values{"state": {happyLDAPState}, "err": {"internal_error"}},
+			csrfCookie:       happyCSRFCookie,
+			wantStatus:       http.StatusOK,
+			wantContentType:  htmlContentType,
+			wantCSP:          loginhtml.ContentSecurityPolicy(),
+			wantBodyContains: []string{`<div class="alert" role="alert">An internal error occurred. Please contact your administrator for help.</div>`},
+		},
+		{
+			name:             "GET after an account state error shows the description of the account state",
+			idps:             oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:           http.MethodGet,
+			query:            url.Values{"state": {happyLDAPState}, "err": {"PasswordExpired"}},
+			csrfCookie:       happyCSRFCookie,
+			wantStatus:       http.StatusOK,
+			wantContentType:  htmlContentType,
+			wantCSP:          loginhtml.ContentSecurityPolicy(),
+			wantBodyContains: []string{`<div class="alert" role="alert">Your password has expired. Please change your password and try again.</div>`},
+		},
+		{
+			name:                "GET with an unknown err param does not show an error message",
+			idps:                oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:              http.MethodGet,
+			query:               url.Values{"state": {happyLDAPState}, "err": {"<script>alert(1)</script>"}},
+			csrfCookie:          happyCSRFCookie,
+			wantStatus:          http.StatusOK,
+			wantContentType:     htmlContentType,
+			wantCSP:             loginhtml.ContentSecurityPolicy(),
+			wantBodyNotContains: []string{`class="alert"`, "script"},
+		},
+		{
+			name:                       "POST with good state, cookie, username, and password returns 303 to downstream client callback with its state and code",
+			idps:                       oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:                     http.MethodPost,
+			form:                       happyForm(happyLDAPState),
+			csrfCookie:                 happyCSRFCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantCSP:                    formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp: downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState,
+			wantDownstreamCustomSessionData: &psession.CustomSessionData{
+				ProviderUID:  happyUpstreamIDPResourceUID,
+				ProviderName: happyUpstreamIDPName,
+				ProviderType: psession.ProviderTypeLDAP,
+				LDAP: &psession.LDAPSessionData{
+					UserDN:                 ldapUpstreamDN,
+					ExtraRefreshAttributes: map[string]string{"some-attribute": "some-value"},
+				},
+			},
+			wantAuthenticateCalls: 1,
+		},
+		{
+			name:                       "POST for an Active Directory upstream returns 303 to downstream client callback with its state and code",
+			idps:                       oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(happyLDAPUpstream(happyAuthenticate)),
+			method:                     http.MethodPost,
+			form:                       happyForm(happyADState),
+			csrfCookie:                 happyCSRFCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantCSP:                    formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp: downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState,
+			wantDownstreamCustomSessionData: &psession.CustomSessionData{
+				ProviderUID:  happyUpstreamIDPResourceUID,
+				ProviderName: happyUpstreamIDPName,
+				ProviderType: psession.ProviderTypeActiveDirectory,
+				ActiveDirectory: &psession.ActiveDirectorySessionData{
+					UserDN:                 ldapUpstreamDN,
+					ExtraRefreshAttributes: map[string]string{"some-attribute": "some-value"},
+				},
+			},
+			wantAuthenticateCalls: 1,
+		},
+		{
+			name:                  "POST with a bad password redirects back to the login page with an error",
+			wantLoginLimitRecords: 2,
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:                http.MethodPost,
+			form:                  url.Values{"state": {happyLDAPState}, "username": {ldapUpstreamUsername}, "password": {"wrong-password"}},
+			csrfCookie:            happyCSRFCookie,
+			wantStatus:            http.StatusSeeOther,
+			wantCSP:               formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation:  loginPageLocation(happyLDAPState, "login_error"),
+			wantAuthenticateCalls: 1,
+		},
+		{
+			name:                 "POST without a password redirects back to the login page with an error without calling the upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:               http.MethodPost,
+			form:                 url.Values{"state": {happyLDAPState}, "username": {ldapUpstreamUsername}},
+			csrfCookie:           happyCSRFCookie,
+			wantStatus:           http.StatusSeeOther,
+			wantCSP:              formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation: loginPageLocation(happyLDAPState, "login_error"),
+		},
+		{
+			name:                  "POST for a locked account redirects back to the login page with the account state",
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(accountLockedAuthenticate)),
+			method:                http.MethodPost,
+			form:                  happyForm(happyLDAPState),
+			csrfCookie:            happyCSRFCookie,
+			wantStatus:            http.StatusSeeOther,
+			wantCSP:               formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation:  loginPageLocation(happyLDAPState, "AccountLocked"),
+			wantAuthenticateCalls: 1,
+		},
+		{
+			name:                  "POST when the upstream returns an unexpected error redirects back to the login page with an error",
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(erroringAuthenticate)),
+			method:                http.MethodPost,
+			form:                  happyForm(happyLDAPState),
+			csrfCookie:            happyCSRFCookie,
+			wantStatus:            http.StatusSeeOther,
+			wantCSP:               formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation:  loginPageLocation(happyLDAPState, "internal_error"),
+			wantAuthenticateCalls: 1,
+		},
+		{
+			name:             "GET for an upstream with optional TOTP offers to enroll",
+			idps:             oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeOptional)),
+			method:           http.MethodGet,
+			query:            url.Values{"state": {happyLDAPState}},
+			csrfCookie:       happyCSRFCookie,
+			wantStatus:       http.StatusOK,
+			wantContentType:  htmlContentType,
+			wantCSP:          loginhtml.ContentSecurityPolicy(),
+			wantBodyContains: []string{`name="enroll_totp"`, `name="password"`},
+		},
+		{
+			name:            "GET for the TOTP step of a user who must enroll shows their new secret",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:          http.MethodGet,
+			query:           url.Values{"state": {happyLDAPState}, "totp": {happyPendingTOTPLoginHandle}},
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusOK,
+			wantContentType: htmlContentType,
+			wantCSP:         loginhtml.ContentSecurityPolicy(),
+			wantBodyContains: []string{
+				`<input type="hidden" name="totp" value="` + happyPendingTOTPLoginHandle + `"/>`,
+				`<p class="secret">` + totp.EncodeSecret(newTOTPSecret) + `</p>`,
+				`name="totp_code"`,
+			},
+			wantBodyNotContains: []string{`name="password"`, `class="alert"`},
+		},
+		{
+			name:                "GET for the TOTP step of an enrolled user asks for a code",
+			idps:                oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:              http.MethodGet,
+			query:               url.Values{"state": {happyLDAPState}, "totp": {happyPendingTOTPLoginHandle}, "err": {"totp_error"}},
+			csrfCookie:          happyCSRFCookie,
+			totpEnrolled:        true,
+			wantStatus:          http.StatusOK,
+			wantContentType:     htmlContentType,
+			wantCSP:             loginhtml.ContentSecurityPolicy(),
+			wantBodyContains:    []string{`name="totp_code"`, `<div class="alert" role="alert">Incorrect authentication code.</div>`},
+			wantBodyNotContains: []string{`name="password"`, `class="secret"`},
+		},
+		{
+			name:                "GET for the TOTP step with an expired pending login shows the first step with an error",
+			idps:                oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:              http.MethodGet,
+			query:               url.Values{"state": {happyLDAPState}, "totp": {expiredPendingTOTPLoginHandle}},
+			csrfCookie:          happyCSRFCookie,
+			wantStatus:          http.StatusOK,
+			wantContentType:     htmlContentType,
+			wantCSP:             loginhtml.ContentSecurityPolicy(),
+			wantBodyContains:    []string{`name="password"`, `<div class="alert" role="alert">Your login has timed out. Please log in again.</div>`},
+			wantBodyNotContains: []string{`name="totp_code"`},
+		},
+		{
+			name:                "GET for the TOTP step with a pending login from another login attempt shows the first step with an error",
+			idps:                oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:              http.MethodGet,
+			query:               url.Values{"state": {happyLDAPState}, "totp": {otherCSRFPendingTOTPLoginHandle}},
+			csrfCookie:          happyCSRFCookie,
+			wantStatus:          http.StatusOK,
+			wantContentType:     htmlContentType,
+			wantCSP:             loginhtml.ContentSecurityPolicy(),
+			wantBodyContains:    []string{`<div class="alert" role="alert">Your login has timed out. Please log in again.</div>`},
+			wantBodyNotContains: []string{`name="totp_code"`},
+		},
+		{
+			name:                   "POST with a good password for an upstream with required TOTP redirects to the TOTP step",
+			idps:                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:                 http.MethodPost,
+			form:                   happyForm(happyLDAPState),
+			csrfCookie:             happyCSRFCookie,
+			wantStatus:             http.StatusSeeOther,
+			wantCSP:                formposthtml.ContentSecurityPolicy(),
+			wantRedirectToTOTPStep: true,
+			wantAuthenticateCalls:  1,
+		},
+		{
+			name:                   "POST with a good password for an upstream with optional TOTP redirects to the TOTP step when the user chose to enroll",
+			idps:                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeOptional)),
+			method:                 http.MethodPost,
+			form:                   url.Values{"state": {happyLDAPState}, "username": {ldapUpstreamUsername}, "password": {ldapUpstreamPassword}, "enroll_totp": {"true"}},
+			csrfCookie:             happyCSRFCookie,
+			wantStatus:             http.StatusSeeOther,
+			wantCSP:                formposthtml.ContentSecurityPolicy(),
+			wantRedirectToTOTPStep: true,
+			wantAuthenticateCalls:  1,
+		},
+		{
+			name:                            "POST with a good password for an upstream with optional TOTP logs in users who have not enrolled",
+			idps:                            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeOptional)),
+			method:                          http.MethodPost,
+			form:                            happyForm(happyLDAPState),
+			csrfCookie:                      happyCSRFCookie,
+			wantStatus:                      http.StatusSeeOther,
+			wantCSP:                         formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp:      downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState,
+			wantDownstreamCustomSessionData: happyPendingTOTPLogin().CustomSessionData,
+			wantAuthenticateCalls:           1,
+		},
+		{
+			name:                  "POST with a good password when the TOTP encryption key is not available redirects back to the login page with an error",
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:                http.MethodPost,
+			form:                  happyForm(happyLDAPState),
+			csrfCookie:            happyCSRFCookie,
+			totpKeyIsMissing:      true,
+			wantStatus:            http.StatusSeeOther,
+			wantCSP:               formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation:  loginPageLocation(happyLDAPState, "internal_error"),
+			wantAuthenticateCalls: 1,
+		},
+		{
+			name:                            "POST of the TOTP step with a good code returns 303 to downstream client callback with its state and code",
+			idps:                            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:                          http.MethodPost,
+			form:                            url.Values{"state": {happyLDAPState}, "totp": {happyPendingTOTPLoginHandle}, "totp_code": {totp.Code(happyTOTPSecret, totpNow)}},
+			csrfCookie:                      happyCSRFCookie,
+			totpEnrolled:                    true,
+			wantStatus:                      http.StatusSeeOther,
+			wantCSP:                         formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp:      downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState,
+			wantDownstreamCustomSessionData: happyPendingTOTPLogin().CustomSessionData,
+			wantPendingTOTPLoginUsed:        true,
+		},
+		{
+			name:                  "POST of the TOTP step with a bad code redirects back to the TOTP step with an error",
+			wantLoginLimitRecords: 2,
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:                http.MethodPost,
+			form:                  url.Values{"state": {happyLDAPState}, "totp": {happyPendingTOTPLoginHandle}, "totp_code": {"000000"}},
+			csrfCookie:            happyCSRFCookie,
+			totpEnrolled:          true,
+			wantStatus:            http.StatusSeeOther,
+			wantCSP:               formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation:  totpLoginPageLocation(happyLDAPState, happyPendingTOTPLoginHandle, "totp_error"),
+		},
+		{
+			name:                 "POST of the TOTP step with an expired pending login redirects back to the first step with an error",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:               http.MethodPost,
+			form:                 url.Values{"state": {happyLDAPState}, "totp": {expiredPendingTOTPLoginHandle}, "totp_code": {totp.Code(happyTOTPSecret, totpNow)}},
+			csrfCookie:           happyCSRFCookie,
+			totpEnrolled:         true,
+			wantStatus:           http.StatusSeeOther,
+			wantCSP:              formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation: loginPageLocation(happyLDAPState, "totp_timeout"),
+		},
+		{
+			name:                 "POST of the TOTP step with an unknown or already used pending login redirects back to the first step with an error",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:               http.MethodPost,
+			form:                 url.Values{"state": {happyLDAPState}, "totp": {pendingLoginHandle('z')}, "totp_code": {totp.Code(happyTOTPSecret, totpNow)}},
+			csrfCookie:           happyCSRFCookie,
+			totpEnrolled:         true,
+			wantStatus:           http.StatusSeeOther,
+			wantCSP:              formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation: loginPageLocation(happyLDAPState, "totp_timeout"),
+		},
+		{
+			name:                 "POST of the TOTP step when the TOTP encryption key is not available redirects back to the first step with an error",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:               http.MethodPost,
+			form:                 url.Values{"state": {happyLDAPState}, "totp": {happyPendingTOTPLoginHandle}, "totp_code": {totp.Code(happyTOTPSecret, totpNow)}},
+			csrfCookie:           happyCSRFCookie,
+			totpKeyIsMissing:     true,
+			wantStatus:           http.StatusSeeOther,
+			wantCSP:              formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation: loginPageLocation(happyLDAPState, "internal_error"),
+		},
+		{
+			name:                  "POST after too many failed login attempts of the username redirects back to the login page with an error",
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:                http.MethodPost,
+			form:                  happyForm(happyLDAPState),
+			csrfCookie:            happyCSRFCookie,
+			priorLoginFailures:    []loginlimit.Key{happyLoginLimitKey, happyLoginLimitKey},
+			wantStatus:            http.StatusSeeOther,
+			wantCSP:               formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation:  loginPageLocation(happyLDAPState, "too_many_attempts"),
+			wantLoginLimitRecords: 1,
+		},
+		{
+			name:                  "POST after the client IP was locked out redirects back to the login page with an error",
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:                http.MethodPost,
+			form:                  happyForm(happyLDAPState),
+			csrfCookie:            happyCSRFCookie,
+			priorLoginFailures:    []loginlimit.Key{happyClientIPLoginLimitKey, happyClientIPLoginLimitKey, happyClientIPLoginLimitKey},
+			wantStatus:            http.StatusSeeOther,
+			wantCSP:               formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation:  loginPageLocation(happyLDAPState, "too_many_attempts"),
+			wantLoginLimitRecords: 1,
+		},
+		{
+			name:                            "POST with a good password forgets earlier failed login attempts of the username",
+			idps:                            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeOptional)),
+			method:                          http.MethodPost,
+			form:                            happyForm(happyLDAPState),
+			csrfCookie:                      happyCSRFCookie,
+			priorLoginFailures:              []loginlimit.Key{happyLoginLimitKey, happyClientIPLoginLimitKey},
+			wantStatus:                      http.StatusSeeOther,
+			wantCSP:                         formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp:      downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState,
+			wantDownstreamCustomSessionData: happyPendingTOTPLogin().CustomSessionData,
+			wantAuthenticateCalls:           1,
+			wantLoginLimitRecords:           1, // the client IP's failure is not forgotten
+		},
+		{
+			name:                   "POST with a good password does not forget earlier failed login attempts before the TOTP step",
+			idps:                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:                 http.MethodPost,
+			form:                   happyForm(happyLDAPState),
+			csrfCookie:             happyCSRFCookie,
+			priorLoginFailures:     []loginlimit.Key{happyLoginLimitKey},
+			wantStatus:             http.StatusSeeOther,
+			wantCSP:                formposthtml.ContentSecurityPolicy(),
+			wantRedirectToTOTPStep: true,
+			wantAuthenticateCalls:  1,
+			wantLoginLimitRecords:  1,
+		},
+		{
+			name:                  "POST of the TOTP step after too many failed login attempts of the username redirects back to the first step with an error",
+			idps:                  oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:                http.MethodPost,
+			form:                  url.Values{"state": {happyLDAPState}, "totp": {happyPendingTOTPLoginHandle}, "totp_code": {totp.Code(happyTOTPSecret, totpNow)}},
+			csrfCookie:            happyCSRFCookie,
+			totpEnrolled:          true,
+			priorLoginFailures:    []loginlimit.Key{happyLoginLimitKey, happyLoginLimitKey},
+			wantStatus:            http.StatusSeeOther,
+			wantCSP:               formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocation:  loginPageLocation(happyLDAPState, "too_many_attempts"),
+			wantLoginLimitRecords: 1,
+		},
+		{
+			name:                            "POST of the TOTP step with a good code forgets earlier failed login attempts of the username",
+			idps:                            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstreamWithTOTPMode(totp.ModeRequired)),
+			method:                          http.MethodPost,
+			form:                            url.Values{"state": {happyLDAPState}, "totp": {happyPendingTOTPLoginHandle}, "totp_code": {totp.Code(happyTOTPSecret, totpNow)}},
+			csrfCookie:                      happyCSRFCookie,
+			totpEnrolled:                    true,
+			priorLoginFailures:              []loginlimit.Key{happyLoginLimitKey},
+			wantStatus:                      http.StatusSeeOther,
+			wantCSP:                         formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp:      downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState,
+			wantDownstreamCustomSessionData: happyPendingTOTPLogin().CustomSessionData,
+			wantPendingTOTPLoginUsed:        true,
+		},
+		{
+			name:             "GET with the too many attempts error shows the error",
+			idps:             oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:           http.MethodGet,
+			query:            url.Values{"state": {happyLDAPState}, "err": {"too_many_attempts"}},
+			csrfCookie:       happyCSRFCookie,
+			wantStatus:       http.StatusOK,
+			wantContentType:  htmlContentType,
+			wantCSP:          loginhtml.ContentSecurityPolicy(),
+			wantBodyContains: []string{`<div class="alert" role="alert">Too many failed login attempts. Please wait a few minutes before trying again.</div>`},
+		},
+		{
+			name:            "PUT is not allowed",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodPut,
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: htmlContentType,
+			wantBody:        "Method Not Allowed: PUT (try GET or POST)\n",
+		},
+		{
+			name:            "missing CSRF cookie",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodPost,
+			form:            happyForm(happyLDAPState),
+			wantStatus:      http.StatusForbidden,
+			wantContentType: htmlContentType,
+			wantBody:        "Forbidden: CSRF cookie is missing\n",
+		},
+		{
+			name:            "CSRF cookie cannot be decoded",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodGet,
+			query:           url.Values{"state": {happyLDAPState}},
+			csrfCookie:      "__Host-pinniped-csrf=this-value-was-not-signed-by-pinniped",
+			wantStatus:      http.StatusForbidden,
+			wantContentType: htmlContentType,
+			wantBody:        "Forbidden: error reading CSRF cookie\n",
+		},
+		{
+			name:            "missing state",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodPost,
+			form:            url.Values{"username": {ldapUpstreamUsername}, "password": {ldapUpstreamPassword}},
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: htmlContentType,
+			wantBody:        "Bad Request: state param not found\n",
+		},
+		{
+			name:            "POST ignores the state in the query",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodPost,
+			query:           url.Values{"state": {happyLDAPState}},
+			form:            url.Values{"username": {ldapUpstreamUsername}, "password": {ldapUpstreamPassword}},
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: htmlContentType,
+			wantBody:        "Bad Request: state param not found\n",
+		},
+		{
+			name:            "state cannot be decoded",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodPost,
+			form:            happyForm("this-value-was-not-signed-by-pinniped"),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: htmlContentType,
+			wantBody:        "Bad Request: error reading state\n",
+		},
+		{
+			name:            "CSRF value in state does not match the cookie",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodPost,
+			form:            happyForm(happyLDAPState),
+			csrfCookie:      "__Host-pinniped-csrf=" + encodedOtherCSRF,
+			wantStatus:      http.StatusForbidden,
+			wantContentType: htmlContentType,
+			wantBody:        "Forbidden: CSRF value does not match\n",
+		},
+		{
+			name:            "state names an OIDC upstream",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodGet,
+			query:           url.Values{"state": {happyOIDCState}},
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: htmlContentType,
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
+		{
+			name:            "state names an LDAP upstream but only an Active Directory upstream with the same name exists",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(happyLDAPUpstream(happyAuthenticate)),
+			method:          http.MethodPost,
+			form:            happyForm(happyLDAPState),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: htmlContentType,
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
+		{
+			name:            "upstream is not found",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder(),
+			method:          http.MethodPost,
+			form:            happyForm(happyLDAPState),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: htmlContentType,
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			authenticateCalls = 0
+
+			client := fake.NewSimpleClientset()
+			secrets := client.CoreV1().Secrets("some-namespace")
+
+			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
+			oauthStore := oidc.NewKubeStorage(secrets, timeoutsConfiguration)
+			hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+			jwksProviderIsUnused := jwks.NewDynamicJWKSProvider()
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration, nil)
+
+			// TOTP enrollments are stored using their own client, so they are not counted as stored records of the login.
+			totpKey := []byte("some-totp-key")
+			if test.totpKeyIsMissing {
+				totpKey = nil
+			}
+			totpClock := func() time.Time { return totpNow }
+			totpStorage := totp.NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), totpClock, func() []byte { return totpKey }, rand.Reader)
+			if test.totpEnrolled {
+				require.NoError(t, totpStorage.Save(context.Background(), ldapUpstreamDownstreamSubject, &totp.Enrollment{Secret: happyTOTPSecret, Confirmed: true}))
+			}
+			totpVerifier := totp.NewVerifier(totpStorage, totpClock, bytes.NewReader(newTOTPSecret))
+
+			// Failed login attempts are also stored using their own client. The first failure of each key is free, the
+			// second causes a wait of one minute, and the third causes a lockout. The prior failures are two minutes
+			// apart, so that none of them has to wait, and the last one is at the time of the request.
+			loginLimitPolicy := loginlimit.Policy{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Minute, LockoutAttempts: 3, LockoutDuration: 15 * time.Minute}
+			loginLimitClient := fake.NewSimpleClientset()
+			loginLimitNow := time.Now().Add(-time.Duration(len(test.priorLoginFailures)) * 2 * time.Minute)
+			loginLimiter := loginlimit.New(loginLimitClient.CoreV1().Secrets("some-namespace"), func() time.Time { return loginLimitNow },
+				map[loginlimit.Kind]loginlimit.Policy{loginlimit.KindUsername: loginLimitPolicy, loginlimit.KindClientIP: loginLimitPolicy})
+			for _, key := range test.priorLoginFailures {
+				loginLimitNow = loginLimitNow.Add(2 * time.Minute)
+				loginAttempt, err := loginLimiter.Begin(context.Background(), key)
+				require.NoError(t, err)
+				loginAttempt.Failed()
+				loginAttempt.End(context.Background())
+			}
+
+			pendingLoginSecrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			pendingLogins := pendinglogin.NewStorage(pendingLoginSecrets, time.Now, pendingLoginHandles('a', 'b', 'd'))
+			happyHandle, err := pendingLogins.Create(context.Background(), happyPendingTOTPLogin())
+			require.NoError(t, err)
+			require.Equal(t, happyPendingTOTPLoginHandle, happyHandle)
+			otherCSRFPendingTOTPLogin := happyPendingTOTPLogin()
+			otherCSRFPendingTOTPLogin.CSRFToken = "some-other-csrf"
+			otherCSRFHandle, err := pendingLogins.Create(context.Background(), otherCSRFPendingTOTPLogin)
+			require.NoError(t, err)
+			require.Equal(t, otherCSRFPendingTOTPLoginHandle, otherCSRFHandle)
+			expiredPendingLogins := pendinglogin.NewStorage(pendingLoginSecrets, func() time.Time { return time.Now().Add(-pendinglogin.Lifetime - time.Minute) },
+				pendingLoginHandles('c'))
+			expiredHandle, err := expiredPendingLogins.Create(context.Background(), happyPendingTOTPLogin())
+			require.NoError(t, err)
+			require.Equal(t, expiredPendingTOTPLoginHandle, expiredHandle)
+
+			consentPrompt := NewConsentPrompt(consent.NewStorage(secrets, time.Now), pendingLogins, downstreamIssuer)
+			subject := NewLoginHandler(test.idps.Build(), oauthHelper, stateCodec, cookieCodec, downstreamIssuer, pendingLogins, totpVerifier, loginLimiter, consentPrompt, provider.DefaultPages())
+			path := "/downstream-provider-name/login"
+			if test.query != nil {
+				path += "?" + test.query.Encode()
+			}
+			req := httptest.NewRequest(test.method, path, strings.NewReader(test.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.csrfCookie != "" {
+				req.Header.Set("Cookie", test.csrfCookie)
+			}
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response: %#v", rsp)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			testutil.RequireSecurityHeaders(t, rsp)
+			if test.wantCSP != "" {
+				require.Equal(t, test.wantCSP, rsp.Header().Get("Content-Security-Policy"))
+			}
+
+			require.Equal(t, test.wantAuthenticateCalls, authenticateCalls)
+			require.Equal(t, test.wantStatus, rsp.Code)
+
+			require.Equal(t, test.wantLoginLimitRecords, countLoginLimitRecords(t, loginLimitClient))
+			if test.wantContentType != "" {
+				testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), test.wantContentType)
+			}
+
+			switch {
+			case test.wantRedirectLocation != "":
+				require.Equal(t, test.wantRedirectLocation, rsp.Header().Get("Location"))
+			case test.wantRedirectToTOTPStep:
+				location, err := url.Parse(rsp.Header().Get("Location"))
+				require.NoError(t, err)
+				require.Equal(t, downstreamIssuer+"/login", location.Scheme+"://"+location.Host+location.Path)
+				require.Equal(t, happyLDAPState, location.Query().Get("state"))
+				require.Empty(t, location.Query().Get("err"))
+				// Only the handle of the pending login is sent to the browser.
+				require.Equal(t, pendingLoginHandle('d'), location.Query().Get("totp"))
+				pending, err := pendingLogins.Get(context.Background(), pendinglogin.KindTOTP, location.Query().Get("totp"))
+				require.NoError(t, err)
+				require.Equal(t, happyPendingTOTPLogin(), pending)
+			case test.wantRedirectLocationRegexp != "":
+				require.Empty(t, rsp.Body.String())
+				require.Len(t, rsp.Header().Values("Location"), 1)
+				oidctestutil.RequireAuthCodeRegexpMatch(
+					t,
+					rsp.Header().Get("Location"),
+					test.wantRedirectLocationRegexp,
+					client,
+					secrets,
+					oauthStore,
+					happyDownstreamScopesGranted,
+					ldapUpstreamDownstreamSubject,
+					ldapUpstreamMappedUsername,
+					ldapUpstreamGroupMembership,
+					happyDownstreamScopesRequested,
+					downstreamPKCEChallenge,
+					downstreamPKCEChallengeMethod,
+					downstreamNonce,
+					downstreamClientID,
+					downstreamRedirectURI,
+					test.wantDownstreamCustomSessionData,
+				)
+			case test.wantBodyContains != nil || test.wantBodyNotContains != nil:
+				for _, want := range test.wantBodyContains {
+					require.Contains(t, rsp.Body.String(), want)
+				}
+				for _, notWant := range test.wantBodyNotContains {
+					require.NotContains(t, rsp.Body.String(), notWant)
+				}
+			default:
+				require.Equal(t, test.wantBody, rsp.Body.String())
+			}
+
+			_, err = pendingLogins.Get(context.Background(), pendinglogin.KindTOTP, happyPendingTOTPLoginHandle)
+			if test.wantPendingTOTPLoginUsed {
+				require.ErrorIs(t, err, pendinglogin.ErrNotFound)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// countLoginLimitRecords returns the number of keys which have failed login attempts. Each Secret holds the failed
+// login attempts of many keys.
+func countLoginLimitRecords(t *testing.T, loginLimitClient *fake.Clientset) int {
+	t.Helper()
+	secrets, err := loginLimitClient.CoreV1().Secrets("some-namespace").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	count := 0
+	for i := range secrets.Items {
+		var shard struct {
+			Records map[string]interface{} `json:"records"`
+		}
+		require.NoError(t, crud.FromSecret(loginlimit.TypeLabelValue, &secrets.Items[i], &shard))
+		count += len(shard.Records)
+	}
+	return count
+}
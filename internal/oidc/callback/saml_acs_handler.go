@@ -0,0 +1,158 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package callback
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+const (
+	samlResponseParamName = "SAMLResponse"
+	relayStateParamName   = "RelayState"
+)
+
+// NewSAMLACSHandler returns an http.Handler that serves the SAML assertion consumer service (ACS) endpoint, which
+// receives the responses of SAML upstreams using the HTTP-POST binding. It is the SAML equivalent of the callback
+// endpoint. The same state param that is used for OIDC upstreams is kept in a cookie, and the RelayState holds its handle.
+func NewSAMLACSHandler(
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
+	oauthHelper fosite.OAuth2Provider,
+	stateDecoder, cookieDecoder oidc.Decoder,
+	downstreamIssuer string,
+	consentPrompt *ConsentPrompt,
+	pages *provider.Pages,
+) http.Handler {
+	handler := httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		state, err := validateSAMLRequest(r, stateDecoder, cookieDecoder)
+		if err != nil {
+			return err
+		}
+
+		upstreamIDPConfig := findSAMLUpstreamIDPConfig(state, upstreamIDPs)
+		if upstreamIDPConfig == nil {
+			plog.Warning("upstream provider not found")
+			return httperr.New(http.StatusUnprocessableEntity, "upstream provider not found")
+		}
+
+		authorizeRequester, err := newDownstreamAuthorizeRequest(r, oauthHelper, state)
+		if err != nil {
+			return err
+		}
+
+		identity, err := loginWithSAMLUpstream(r, state, downstreamIssuer, upstreamIDPConfig)
+		if err != nil {
+			return err
+		}
+
+		return writeDownstreamAuthorizeResponse(w, r, oauthHelper, consentPrompt, authorizeRequester, state, identity)
+	})
+	return securityheader.WrapWithCustomCSP(handler, pages.FormPost.ContentSecurityPolicy())
+}
+
+func loginWithSAMLUpstream(
+	r *http.Request,
+	state *oidc.UpstreamStateParamData,
+	downstreamIssuer string,
+	upstreamIDPConfig provider.UpstreamSAMLIdentityProviderI,
+) (*downstreamIdentity, error) {
+	sp, err := oidc.SAMLServiceProviderForIssuer(downstreamIssuer)
+	if err != nil {
+		return nil, httperr.Wrap(http.StatusInternalServerError, "error building SAML service provider configuration", err)
+	}
+
+	user, err := upstreamIDPConfig.ParseResponse(sp, oidc.SAMLRequestID(state.Nonce), r.PostFormValue(samlResponseParamName))
+	if err != nil {
+		plog.WarningErr("error validating SAML response", err, "upstreamName", upstreamIDPConfig.GetName())
+		return nil, httperr.New(http.StatusUnprocessableEntity, "error validating SAML response")
+	}
+
+	return &downstreamIdentity{
+		subject:  user.DownstreamSubject,
+		username: user.Username,
+		groups:   user.Groups,
+		customSessionData: &psession.CustomSessionData{
+			ProviderUID:  upstreamIDPConfig.GetResourceUID(),
+			ProviderName: upstreamIDPConfig.GetName(),
+			ProviderType: psession.ProviderTypeSAML,
+			SAML: &psession.SAMLSessionData{
+				NameID:        user.NameID,
+				SessionExpiry: user.SessionExpiry,
+			},
+		},
+	}, nil
+}
+
+func validateSAMLRequest(r *http.Request, stateDecoder, cookieDecoder oidc.Decoder) (*oidc.UpstreamStateParamData, error) {
+	if r.Method != http.MethodPost {
+		return nil, httperr.Newf(http.StatusMethodNotAllowed, "%s (try POST)", r.Method)
+	}
+
+	encodedState, err := readSAMLStateCookie(r, cookieDecoder)
+	if err != nil {
+		plog.InfoErr("error reading SAML state cookie", err)
+		return nil, err
+	}
+
+	if r.PostFormValue(samlResponseParamName) == "" {
+		plog.Info("SAMLResponse param not found")
+		return nil, httperr.New(http.StatusBadRequest, "SAMLResponse param not found")
+	}
+
+	relayState := r.PostFormValue(relayStateParamName)
+	if relayState == "" {
+		plog.Info("RelayState param not found")
+		return nil, httperr.New(http.StatusBadRequest, "RelayState param not found")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(relayState), []byte(oidc.SAMLRelayState(encodedState))) != 1 {
+		plog.Info("RelayState does not match the SAML state cookie")
+		return nil, httperr.New(http.StatusForbidden, "RelayState does not match the SAML state cookie")
+	}
+
+	state, err := readState(encodedState, stateDecoder)
+	if err != nil {
+		plog.InfoErr("error reading state", err)
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func readSAMLStateCookie(r *http.Request, cookieDecoder oidc.Decoder) (string, error) {
+	receivedCookie, err := r.Cookie(oidc.SAMLStateCookieName)
+	if err != nil {
+		// Error means that the cookie was not found
+		return "", httperr.Wrap(http.StatusForbidden, "SAML state cookie is missing", err)
+	}
+
+	var encodedState string
+	err = cookieDecoder.Decode(oidc.SAMLStateCookieEncodingName, receivedCookie.Value, &encodedState)
+	if err != nil {
+		return "", httperr.Wrap(http.StatusForbidden, "error reading SAML state cookie", err)
+	}
+
+	return encodedState, nil
+}
+
+func findSAMLUpstreamIDPConfig(state *oidc.UpstreamStateParamData, upstreamIDPs oidc.UpstreamSAMLIdentityProvidersLister) provider.UpstreamSAMLIdentityProviderI {
+	if psession.ProviderType(state.UpstreamType) != psession.ProviderTypeSAML {
+		return nil
+	}
+	for _, p := range upstreamIDPs.GetSAMLIdentityProviders() {
+		if p.GetName() == state.UpstreamName {
+			return p
+		}
+	}
+	return nil
+}
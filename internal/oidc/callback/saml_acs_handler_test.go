@@ -0,0 +1,294 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package callback
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/consent"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+const (
+	samlUpstreamResponse          = "some-base64-saml-response"
+	samlUpstreamNameID            = "some-name-id"
+	samlUpstreamUsername          = "some-saml-user@example.com"
+	samlUpstreamDownstreamSubject = "https://idp.example.com/metadata?sub=some-name-id"
+)
+
+var samlUpstreamGroupMembership = []string{"saml-group-1", "saml-group-2"}
+
+func TestSAMLACSEndpoint(t *testing.T) {
+	var stateCodec = securecookie.New([]byte("fake-hash-secret"), []byte("0123456789ABCDEF"))
+	stateCodec.SetSerializer(securecookie.JSONEncoder{})
+	var cookieCodec = securecookie.New([]byte("fake-hash-secret2"), []byte("0123456789ABCDE2"))
+	cookieCodec.SetSerializer(securecookie.JSONEncoder{})
+
+	happySAMLState := happyUpstreamStateParam().WithUpstreamType("saml").Build(t, stateCodec)
+	happyOIDCState := happyUpstreamStateParam().Build(t, stateCodec)
+
+	samlStateCookie := func(encodedState string) string {
+		encodedCookieValue, err := cookieCodec.Encode("samlstate", encodedState)
+		require.NoError(t, err)
+		return "__Host-pinniped-saml-state=" + encodedCookieValue
+	}
+	happySAMLStateCookie := samlStateCookie(happySAMLState)
+	happyRelayState := oidc.SAMLRelayState(happySAMLState)
+	encodedCSRF, err := cookieCodec.Encode("csrf", happyDownstreamCSRF)
+	require.NoError(t, err)
+
+	sessionExpiry := time.Now().Add(8 * time.Hour).UTC().Truncate(time.Second)
+
+	happySAMLUpstream := func() *oidctestutil.TestUpstreamSAMLIdentityProvider {
+		return &oidctestutil.TestUpstreamSAMLIdentityProvider{
+			Name:        happyUpstreamIDPName,
+			ResourceUID: happyUpstreamIDPResourceUID,
+			ParseResponseFunc: func(samlResponse string) (*provider.SAMLUser, error) {
+				return &provider.SAMLUser{
+					Username:          samlUpstreamUsername,
+					Groups:            samlUpstreamGroupMembership,
+					DownstreamSubject: samlUpstreamDownstreamSubject,
+					NameID:            samlUpstreamNameID,
+					SessionExpiry:     sessionExpiry,
+				}, nil
+			},
+		}
+	}
+	samlHappyUpstream := happySAMLUpstream()
+	samlInvalidResponseUpstream := happySAMLUpstream()
+	samlInvalidResponseUpstream.ParseResponseFunc = func(samlResponse string) (*provider.SAMLUser, error) {
+		return nil, errors.New("invalid SAML response: some validation error")
+	}
+
+	happyForm := func() url.Values {
+		return url.Values{"SAMLResponse": {samlUpstreamResponse}, "RelayState": {happyRelayState}}
+	}
+	formWith := func(key, value string) url.Values {
+		form := happyForm()
+		if value == "" {
+			form.Del(key)
+		} else {
+			form.Set(key, value)
+		}
+		return form
+	}
+
+	tests := []struct {
+		name string
+
+		idps   *oidctestutil.UpstreamIDPListerBuilder
+		method string
+		form   url.Values
+		cookie string
+
+		wantStatus                      int
+		wantContentType                 string
+		wantBody                        string
+		wantRedirectLocationRegexp      string
+		wantDownstreamCustomSessionData *psession.CustomSessionData
+		wantParseResponseCalled         *oidctestutil.TestUpstreamSAMLIdentityProvider
+	}{
+		{
+			name:                       "POST with good RelayState, cookie, and response returns 303 to downstream client callback with its state and code",
+			idps:                       oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(samlHappyUpstream),
+			method:                     http.MethodPost,
+			form:                       happyForm(),
+			cookie:                     happySAMLStateCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantRedirectLocationRegexp: downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState,
+			wantDownstreamCustomSessionData: &psession.CustomSessionData{
+				ProviderUID:  happyUpstreamIDPResourceUID,
+				ProviderName: happyUpstreamIDPName,
+				ProviderType: psession.ProviderTypeSAML,
+				SAML: &psession.SAMLSessionData{
+					NameID:        samlUpstreamNameID,
+					SessionExpiry: sessionExpiry,
+				},
+			},
+			wantParseResponseCalled: samlHappyUpstream,
+		},
+		{
+			name:            "GET is not allowed",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(happySAMLUpstream()),
+			method:          http.MethodGet,
+			cookie:          happySAMLStateCookie,
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: htmlContentType,
+			wantBody:        "Method Not Allowed: GET (try POST)\n",
+		},
+		{
+			name:            "missing SAML state cookie",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(happySAMLUpstream()),
+			method:          http.MethodPost,
+			form:            happyForm(),
+			cookie:          "__Host-pinniped-csrf=" + encodedCSRF,
+			wantStatus:      http.StatusForbidden,
+			wantContentType: htmlContentType,
+			wantBody:        "Forbidden: SAML state cookie is missing\n",
+		},
+		{
+			name:            "SAML state cookie cannot be decoded",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(happySAMLUpstream()),
+			method:          http.MethodPost,
+			form:            happyForm(),
+			cookie:          "__Host-pinniped-saml-state=this-value-was-not-signed-by-pinniped",
+			wantStatus:      http.StatusForbidden,
+			wantContentType: htmlContentType,
+			wantBody:        "Forbidden: error reading SAML state cookie\n",
+		},
+		{
+			name:            "missing SAMLResponse",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(happySAMLUpstream()),
+			method:          http.MethodPost,
+			form:            formWith("SAMLResponse", ""),
+			cookie:          happySAMLStateCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: htmlContentType,
+			wantBody:        "Bad Request: SAMLResponse param not found\n",
+		},
+		{
+			name:            "missing RelayState",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(happySAMLUpstream()),
+			method:          http.MethodPost,
+			form:            formWith("RelayState", ""),
+			cookie:          happySAMLStateCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: htmlContentType,
+			wantBody:        "Bad Request: RelayState param not found\n",
+		},
+		{
+			name:            "RelayState does not match the SAML state cookie",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(happySAMLUpstream()),
+			method:          http.MethodPost,
+			form:            formWith("RelayState", oidc.SAMLRelayState(happyOIDCState)),
+			cookie:          happySAMLStateCookie,
+			wantStatus:      http.StatusForbidden,
+			wantContentType: htmlContentType,
+			wantBody:        "Forbidden: RelayState does not match the SAML state cookie\n",
+		},
+		{
+			name:            "state in the SAML state cookie cannot be decoded",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(happySAMLUpstream()),
+			method:          http.MethodPost,
+			form:            formWith("RelayState", oidc.SAMLRelayState("this-value-was-not-signed-by-pinniped")),
+			cookie:          samlStateCookie("this-value-was-not-signed-by-pinniped"),
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: htmlContentType,
+			wantBody:        "Bad Request: error reading state\n",
+		},
+		{
+			name:            "state in the SAML state cookie names an OIDC upstream",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(happySAMLUpstream()),
+			method:          http.MethodPost,
+			form:            formWith("RelayState", oidc.SAMLRelayState(happyOIDCState)),
+			cookie:          samlStateCookie(happyOIDCState),
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: htmlContentType,
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
+		{
+			name:            "upstream is not found",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder(),
+			method:          http.MethodPost,
+			form:            happyForm(),
+			cookie:          happySAMLStateCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: htmlContentType,
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
+		{
+			name:                    "SAML response is not valid",
+			idps:                    oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(samlInvalidResponseUpstream),
+			method:                  http.MethodPost,
+			form:                    happyForm(),
+			cookie:                  happySAMLStateCookie,
+			wantStatus:              http.StatusUnprocessableEntity,
+			wantContentType:         htmlContentType,
+			wantBody:                "Unprocessable Entity: error validating SAML response\n",
+			wantParseResponseCalled: samlInvalidResponseUpstream,
+		},
+	}
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			secrets := client.CoreV1().Secrets("some-namespace")
+
+			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
+			oauthStore := oidc.NewKubeStorage(secrets, timeoutsConfiguration)
+			hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+			jwksProviderIsUnused := jwks.NewDynamicJWKSProvider()
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration, nil)
+
+			consentPrompt := NewConsentPrompt(consent.NewStorage(secrets, time.Now), newPendingLoginStorage(), downstreamIssuer)
+			subject := NewSAMLACSHandler(test.idps.Build(), oauthHelper, stateCodec, cookieCodec, downstreamIssuer, consentPrompt, provider.DefaultPages())
+			req := httptest.NewRequest(test.method, "/downstream-provider-name/callback/saml", strings.NewReader(test.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.cookie != "" {
+				req.Header.Set("Cookie", test.cookie)
+			}
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response: %#v", rsp)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			testutil.RequireSecurityHeaders(t, rsp)
+
+			if test.wantParseResponseCalled != nil {
+				require.Equal(t, 1, test.wantParseResponseCalled.ParseResponseCallCount())
+				args := test.wantParseResponseCalled.ParseResponseArgs(0)
+				require.Equal(t, downstreamIssuer, args.SP.EntityID)
+				require.Equal(t, downstreamIssuer+"/callback/saml", args.SP.AssertionConsumerServiceURL.String())
+				require.Equal(t, "id-"+happyDownstreamNonce, args.RequestID)
+				require.Equal(t, samlUpstreamResponse, args.SAMLResponse)
+			}
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), test.wantContentType)
+
+			if test.wantRedirectLocationRegexp == "" {
+				require.Equal(t, test.wantBody, rsp.Body.String())
+				return
+			}
+
+			require.Empty(t, rsp.Body.String())
+			require.Len(t, rsp.Header().Values("Location"), 1)
+			oidctestutil.RequireAuthCodeRegexpMatch(
+				t,
+				rsp.Header().Get("Location"),
+				test.wantRedirectLocationRegexp,
+				client,
+				secrets,
+				oauthStore,
+				happyDownstreamScopesGranted,
+				samlUpstreamDownstreamSubject,
+				samlUpstreamUsername,
+				samlUpstreamGroupMembership,
+				happyDownstreamScopesRequested,
+				downstreamPKCEChallenge,
+				downstreamPKCEChallengeMethod,
+				downstreamNonce,
+				downstreamClientID,
+				downstreamRedirectURI,
+				test.wantDownstreamCustomSessionData,
+			)
+		})
+	}
+}
@@ -1,21 +1,65 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package clientregistry defines Pinniped's OAuth2/OIDC clients.
 package clientregistry
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// ConfidentialClientIDPrefix is the prefix of the IDs of all confidential clients. Each confidential client is
+	// configured by a Secret in the namespace of the Supervisor whose name is the ID of the client.
+	ConfidentialClientIDPrefix = "client.oauth.pinniped.dev-"
+
+	// ConfidentialClientSecretType is the type of the Secrets which configure confidential clients.
+	ConfidentialClientSecretType corev1.SecretType = "secrets.pinniped.dev/supervisor-client"
+
+	// The keys of the data of the Secrets which configure confidential clients.
+	clientSecretHashesDataKey = "clientSecretHashes"
+	usernameDataKey           = "username"
+	groupsDataKey             = "groups"
+	redirectURIsDataKey       = "redirectURIs"
+	requireDPoPDataKey        = "requireDPoP"
+	grantTypesDataKey         = "grantTypes"
 )
 
 // Client represents a Pinniped OAuth/OIDC client.
 type Client struct {
 	fosite.DefaultOpenIDConnectClient
+
+	// Username and Groups are the identity of a confidential client when it uses the client_credentials grant.
+	Username string   `json:"username,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+
+	// Trusted clients are first-party clients, such as the Pinniped CLI, which do not need the consent of users to
+	// receive their tokens.
+	Trusted bool `json:"trusted,omitempty"`
+
+	// RequireDPoP rejects token requests of the client without a DPoP proof (RFC 9449), so that all of its access
+	// and refresh tokens are bound to a key of the client. Tokens of other clients are only bound to a key when the
+	// client sends a DPoP proof.
+	RequireDPoP bool `json:"requireDPoP,omitempty"`
 }
 
 func (c Client) GetResponseModes() []fosite.ResponseModeType {
@@ -28,6 +72,8 @@ var (
 	_ fosite.Client              = (*Client)(nil)
 	_ fosite.OpenIDConnectClient = (*Client)(nil)
 	_ fosite.ResponseModeClient  = (*Client)(nil)
+
+	_ fosite.ClientWithSecretRotation = (*Client)(nil)
 )
 
 // StaticClientManager is a fosite.ClientManager with statically-defined clients.
@@ -65,6 +111,199 @@ func (StaticClientManager) SetClientAssertionJWT(ctx context.Context, jti string
 	return fmt.Errorf("not implemented")
 }
 
+// KubeClientManager is a fosite.ClientManager which returns the same statically-defined clients as the
+// StaticClientManager, along with the confidential clients which are configured by Secrets.
+type KubeClientManager struct {
+	StaticClientManager
+	secrets corev1client.SecretInterface
+	clock   func() time.Time
+}
+
+var _ fosite.ClientManager = (*KubeClientManager)(nil)
+
+// NewKubeClientManager returns a KubeClientManager which reads the Secrets of confidential clients using the
+// given client, which should be scoped to the namespace of the Supervisor.
+func NewKubeClientManager(secrets corev1client.SecretInterface) *KubeClientManager {
+	return &KubeClientManager{secrets: secrets, clock: time.Now}
+}
+
+// GetClient returns either a static client or a confidential client specified by the given ID.
+//
+// It returns a fosite.ErrNotFound if an unknown client is specified.
+func (m *KubeClientManager) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	if !strings.HasPrefix(id, ConfidentialClientIDPrefix) {
+		return m.StaticClientManager.GetClient(ctx, id)
+	}
+
+	// The ID comes from the request, so do not try to get a Secret which could never exist.
+	if len(validation.IsDNS1123Subdomain(id)) > 0 {
+		return nil, fosite.ErrNotFound.WithDescription("no such client")
+	}
+
+	secret, err := m.secrets.Get(ctx, id, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fosite.ErrNotFound.WithDescription("no such client")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client secret: %w", err)
+	}
+	if secret.Type != ConfidentialClientSecretType {
+		plog.Warning("ignoring client secret with wrong type",
+			"secretName", secret.Name, "secretType", secret.Type, "expectedType", ConfidentialClientSecretType)
+		return nil, fosite.ErrNotFound.WithDescription("no such client")
+	}
+
+	// Clients which registered themselves expire, and their Secrets are only garbage collected periodically.
+	if expiresAt, ok := secret.Annotations[crud.SecretLifetimeAnnotationKey]; ok {
+		expiry, err := time.Parse(crud.SecretLifetimeAnnotationDateFormat, expiresAt)
+		if err != nil || !m.clock().Before(expiry) {
+			return nil, fosite.ErrNotFound.WithDescription("no such client")
+		}
+	}
+
+	client, err := confidentialClient(id, secret)
+	if err != nil {
+		plog.WarningErr("ignoring invalid client secret", err, "secretName", secret.Name)
+		return nil, fosite.ErrNotFound.WithDescription("no such client")
+	}
+	return client, nil
+}
+
+// confidentialClient returns the Client configured by the given Secret.
+func confidentialClient(id string, secret *corev1.Secret) (*Client, error) {
+	var hashes [][]byte
+	for _, line := range bytes.Split(secret.Data[clientSecretHashesDataKey], []byte("\n")) {
+		hash := bytes.TrimSpace(line)
+		if len(hash) == 0 {
+			continue
+		}
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("%s must contain only bcrypt hashes: %w", clientSecretHashesDataKey, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("%s must contain at least one bcrypt hash", clientSecretHashesDataKey)
+	}
+
+	username := strings.TrimSpace(string(secret.Data[usernameDataKey]))
+	if username == "" {
+		username = id
+	}
+
+	groups := []string{}
+	if groupsData := secret.Data[groupsDataKey]; len(bytes.TrimSpace(groupsData)) > 0 {
+		var err error
+		groups, err = csv.NewReader(bytes.NewReader(groupsData)).Read()
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", groupsDataKey, err)
+		}
+		for i := range groups {
+			groups[i] = strings.TrimSpace(groups[i])
+		}
+	}
+
+	requireDPoP := false
+	if requireDPoPData := strings.TrimSpace(string(secret.Data[requireDPoPDataKey])); requireDPoPData != "" {
+		var err error
+		requireDPoP, err = strconv.ParseBool(requireDPoPData)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false: %w", requireDPoPDataKey, err)
+		}
+	}
+
+	grantTypes := fosite.Arguments{
+		"client_credentials",
+		"urn:ietf:params:oauth:grant-type:token-exchange",
+	}
+	scopes := fosite.Arguments{
+		oidc.ScopeOpenID,
+		"pinniped:request-audience",
+	}
+	var responseTypes []string
+
+	// Clients with redirect URIs may also log in users with the authorization code flow, like the Pinniped CLI.
+	// They are not trusted, so users must consent before they receive their tokens.
+	var redirectURIs []string
+	for _, line := range strings.Split(string(secret.Data[redirectURIsDataKey]), "\n") {
+		redirectURI := strings.TrimSpace(line)
+		if redirectURI == "" {
+			continue
+		}
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return nil, fmt.Errorf("%s must contain only absolute URLs without fragments: %q", redirectURIsDataKey, redirectURI)
+		}
+		redirectURIs = append(redirectURIs, redirectURI)
+	}
+	if len(redirectURIs) > 0 {
+		grantTypes = append(grantTypes, "authorization_code", "refresh_token")
+		scopes = append(scopes, oidc.ScopeOfflineAccess, "profile", "email")
+		responseTypes = []string{"code"}
+	}
+
+	// The grant types of a client may be restricted to some of the grant types which it would support otherwise.
+	if grantTypesData := strings.TrimSpace(string(secret.Data[grantTypesDataKey])); grantTypesData != "" {
+		var allowedGrantTypes fosite.Arguments
+		for _, grantType := range strings.Split(grantTypesData, ",") {
+			grantType = strings.TrimSpace(grantType)
+			if !grantTypes.Has(grantType) {
+				return nil, fmt.Errorf("%s must contain only grant types which the client supports: %q", grantTypesDataKey, grantType)
+			}
+			allowedGrantTypes = append(allowedGrantTypes, grantType)
+		}
+		grantTypes = allowedGrantTypes
+		if !grantTypes.Has("authorization_code") {
+			responseTypes = nil
+		}
+	}
+
+	return &Client{
+		DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+			DefaultClient: &fosite.DefaultClient{
+				ID:             id,
+				Secret:         hashes[0],
+				RotatedSecrets: hashes[1:],
+				RedirectURIs:   redirectURIs,
+				GrantTypes:     grantTypes,
+				ResponseTypes:  responseTypes,
+				Scopes:         scopes,
+				Audience:       nil,
+				Public:         false,
+			},
+			RequestURIs:                       nil,
+			JSONWebKeys:                       nil,
+			JSONWebKeysURI:                    "",
+			RequestObjectSigningAlgorithm:     "",
+			TokenEndpointAuthSigningAlgorithm: oidc.RS256,
+			TokenEndpointAuthMethod:           "client_secret_basic",
+		},
+		Username:    username,
+		Groups:      groups,
+		RequireDPoP: requireDPoP,
+	}, nil
+}
+
+// RegisteredClientSecret returns the Secret which configures a confidential client that registered itself with the
+// client registration endpoint. The client may only use the given grant types, and it expires at expiresAt, after
+// which its Secret is garbage collected.
+func RegisteredClientSecret(id string, secretHash []byte, redirectURIs []string, grantTypes []string, expiresAt time.Time) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: id,
+			Annotations: map[string]string{
+				crud.SecretLifetimeAnnotationKey: expiresAt.UTC().Format(crud.SecretLifetimeAnnotationDateFormat),
+			},
+		},
+		Type: ConfidentialClientSecretType,
+		Data: map[string][]byte{
+			clientSecretHashesDataKey: secretHash,
+			redirectURIsDataKey:       []byte(strings.Join(redirectURIs, "\n")),
+			grantTypesDataKey:         []byte(strings.Join(grantTypes, ",")),
+		},
+	}
+}
+
 // PinnipedCLI returns the static Client corresponding to the Pinniped CLI.
 func PinnipedCLI() *Client {
 	return &Client{
@@ -96,5 +335,6 @@ func PinnipedCLI() *Client {
 			TokenEndpointAuthSigningAlgorithm: oidc.RS256,
 			TokenEndpointAuthMethod:           "none",
 		},
+		Trusted: true,
 	}
 }
@@ -1,4 +1,4 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package clientregistry
@@ -6,12 +6,19 @@ package clientregistry
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
 )
 
 func TestStaticRegistry(t *testing.T) {
@@ -52,6 +59,7 @@ func TestPinnipedCLI(t *testing.T) {
 	require.Equal(t, fosite.Arguments{"code"}, c.GetResponseTypes())
 	require.Equal(t, fosite.Arguments{oidc.ScopeOpenID, oidc.ScopeOfflineAccess, "profile", "email", "pinniped:request-audience"}, c.GetScopes())
 	require.True(t, c.IsPublic())
+	require.True(t, c.Trusted)
 	require.Nil(t, c.GetAudience())
 	require.Nil(t, c.GetRequestURIs())
 	require.Nil(t, c.GetJSONWebKeys())
@@ -91,6 +99,326 @@ func TestPinnipedCLI(t *testing.T) {
 		  "token_endpoint_auth_method": "none",
 		  "request_uris": null,
 		  "request_object_signing_alg": "",
-		  "token_endpoint_auth_signing_alg": "RS256"
+		  "token_endpoint_auth_signing_alg": "RS256",
+		  "trusted": true
 		}`, string(marshaled))
 }
+
+func TestKubeClientManager(t *testing.T) {
+	const clientID = "client.oauth.pinniped.dev-some-client"
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	hash1, err := bcrypt.GenerateFromPassword([]byte("some-secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	hash2, err := bcrypt.GenerateFromPassword([]byte("some-other-secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	clientSecret := func(data map[string][]byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: clientID, Namespace: "some-namespace"},
+			Type:       ConfidentialClientSecretType,
+			Data:       data,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		id         string
+		secret     *corev1.Secret
+		getErr     error
+		wantClient *Client
+		wantErr    string
+		wantCode   int
+	}{
+		{
+			name:       "pinniped CLI",
+			id:         "pinniped-cli",
+			wantClient: PinnipedCLI(),
+		},
+		{
+			name:     "unknown static client",
+			id:       "does-not-exist",
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name: "confidential client",
+			id:   clientID,
+			secret: clientSecret(map[string][]byte{
+				"clientSecretHashes": []byte(string(hash1) + "\n\n" + string(hash2) + "\n"),
+				"username":           []byte(" some-robot "),
+				"groups":             []byte("group1, group2"),
+			}),
+			wantClient: &Client{
+				DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{
+						ID:             clientID,
+						Secret:         hash1,
+						RotatedSecrets: [][]byte{hash2},
+						GrantTypes:     fosite.Arguments{"client_credentials", "urn:ietf:params:oauth:grant-type:token-exchange"},
+						Scopes:         fosite.Arguments{oidc.ScopeOpenID, "pinniped:request-audience"},
+					},
+					TokenEndpointAuthSigningAlgorithm: oidc.RS256,
+					TokenEndpointAuthMethod:           "client_secret_basic",
+				},
+				Username: "some-robot",
+				Groups:   []string{"group1", "group2"},
+			},
+		},
+		{
+			name:   "confidential client without username or groups",
+			id:     clientID,
+			secret: clientSecret(map[string][]byte{"clientSecretHashes": hash1}),
+			wantClient: &Client{
+				DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{
+						ID:             clientID,
+						Secret:         hash1,
+						RotatedSecrets: [][]byte{},
+						GrantTypes:     fosite.Arguments{"client_credentials", "urn:ietf:params:oauth:grant-type:token-exchange"},
+						Scopes:         fosite.Arguments{oidc.ScopeOpenID, "pinniped:request-audience"},
+					},
+					TokenEndpointAuthSigningAlgorithm: oidc.RS256,
+					TokenEndpointAuthMethod:           "client_secret_basic",
+				},
+				Username: clientID,
+				Groups:   []string{},
+			},
+		},
+		{
+			name: "confidential client with redirect URIs",
+			id:   clientID,
+			secret: clientSecret(map[string][]byte{
+				"clientSecretHashes": hash1,
+				"redirectURIs":       []byte("https://app.example.com/callback\n\n http://127.0.0.1/callback \n"),
+			}),
+			wantClient: &Client{
+				DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{
+						ID:             clientID,
+						Secret:         hash1,
+						RotatedSecrets: [][]byte{},
+						RedirectURIs:   []string{"https://app.example.com/callback", "http://127.0.0.1/callback"},
+						GrantTypes: fosite.Arguments{
+							"client_credentials", "urn:ietf:params:oauth:grant-type:token-exchange", "authorization_code", "refresh_token",
+						},
+						ResponseTypes: []string{"code"},
+						Scopes: fosite.Arguments{
+							oidc.ScopeOpenID, "pinniped:request-audience", oidc.ScopeOfflineAccess, "profile", "email",
+						},
+					},
+					TokenEndpointAuthSigningAlgorithm: oidc.RS256,
+					TokenEndpointAuthMethod:           "client_secret_basic",
+				},
+				Username: clientID,
+				Groups:   []string{},
+			},
+		},
+		{
+			name: "confidential client which requires DPoP",
+			id:   clientID,
+			secret: clientSecret(map[string][]byte{
+				"clientSecretHashes": hash1,
+				"requireDPoP":        []byte(" true\n"),
+			}),
+			wantClient: &Client{
+				DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{
+						ID:             clientID,
+						Secret:         hash1,
+						RotatedSecrets: [][]byte{},
+						GrantTypes:     fosite.Arguments{"client_credentials", "urn:ietf:params:oauth:grant-type:token-exchange"},
+						Scopes:         fosite.Arguments{oidc.ScopeOpenID, "pinniped:request-audience"},
+					},
+					TokenEndpointAuthSigningAlgorithm: oidc.RS256,
+					TokenEndpointAuthMethod:           "client_secret_basic",
+				},
+				Username:    clientID,
+				Groups:      []string{},
+				RequireDPoP: true,
+			},
+		},
+		{
+			name: "confidential client secret with an invalid requireDPoP value",
+			id:   clientID,
+			secret: clientSecret(map[string][]byte{
+				"clientSecretHashes": hash1,
+				"requireDPoP":        []byte("sometimes"),
+			}),
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name: "confidential client with restricted grant types",
+			id:   clientID,
+			secret: clientSecret(map[string][]byte{
+				"clientSecretHashes": hash1,
+				"redirectURIs":       []byte("https://app.example.com/callback"),
+				"grantTypes":         []byte("authorization_code, refresh_token\n"),
+			}),
+			wantClient: &Client{
+				DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{
+						ID:             clientID,
+						Secret:         hash1,
+						RotatedSecrets: [][]byte{},
+						RedirectURIs:   []string{"https://app.example.com/callback"},
+						GrantTypes:     fosite.Arguments{"authorization_code", "refresh_token"},
+						ResponseTypes:  []string{"code"},
+						Scopes: fosite.Arguments{
+							oidc.ScopeOpenID, "pinniped:request-audience", oidc.ScopeOfflineAccess, "profile", "email",
+						},
+					},
+					TokenEndpointAuthSigningAlgorithm: oidc.RS256,
+					TokenEndpointAuthMethod:           "client_secret_basic",
+				},
+				Username: clientID,
+				Groups:   []string{},
+			},
+		},
+		{
+			name: "confidential client secret with a grant type which needs redirect URIs",
+			id:   clientID,
+			secret: clientSecret(map[string][]byte{
+				"clientSecretHashes": hash1,
+				"grantTypes":         []byte("client_credentials,authorization_code"),
+			}),
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name: "registered client which has not expired yet",
+			id:   clientID,
+			secret: func() *corev1.Secret {
+				s := RegisteredClientSecret(clientID, hash1, []string{"https://app.example.com/callback"}, []string{"authorization_code"}, now.Add(time.Minute))
+				s.Namespace = "some-namespace"
+				return s
+			}(),
+			wantClient: &Client{
+				DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{
+						ID:             clientID,
+						Secret:         hash1,
+						RotatedSecrets: [][]byte{},
+						RedirectURIs:   []string{"https://app.example.com/callback"},
+						GrantTypes:     fosite.Arguments{"authorization_code"},
+						ResponseTypes:  []string{"code"},
+						Scopes: fosite.Arguments{
+							oidc.ScopeOpenID, "pinniped:request-audience", oidc.ScopeOfflineAccess, "profile", "email",
+						},
+					},
+					TokenEndpointAuthSigningAlgorithm: oidc.RS256,
+					TokenEndpointAuthMethod:           "client_secret_basic",
+				},
+				Username: clientID,
+				Groups:   []string{},
+			},
+		},
+		{
+			name: "registered client which has expired",
+			id:   clientID,
+			secret: func() *corev1.Secret {
+				s := RegisteredClientSecret(clientID, hash1, []string{"https://app.example.com/callback"}, []string{"authorization_code"}, now)
+				s.Namespace = "some-namespace"
+				return s
+			}(),
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name: "confidential client secret with a relative redirect URI",
+			id:   clientID,
+			secret: clientSecret(map[string][]byte{
+				"clientSecretHashes": hash1,
+				"redirectURIs":       []byte("/callback"),
+			}),
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name:     "confidential client with invalid name",
+			id:       ConfidentialClientIDPrefix + "Not/Valid",
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name:     "confidential client without a secret",
+			id:       clientID,
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name: "confidential client secret with the wrong type",
+			id:   clientID,
+			secret: func() *corev1.Secret {
+				s := clientSecret(map[string][]byte{"clientSecretHashes": hash1})
+				s.Type = corev1.SecretTypeOpaque
+				return s
+			}(),
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name:     "confidential client secret without hashes",
+			id:       clientID,
+			secret:   clientSecret(map[string][]byte{"username": []byte("some-robot")}),
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name:     "confidential client secret with a value which is not a bcrypt hash",
+			id:       clientID,
+			secret:   clientSecret(map[string][]byte{"clientSecretHashes": []byte("some-plaintext-secret")}),
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name: "confidential client secret with invalid groups",
+			id:   clientID,
+			secret: clientSecret(map[string][]byte{
+				"clientSecretHashes": hash1,
+				"groups":             []byte(`"group1`),
+			}),
+			wantErr:  "no such client",
+			wantCode: 404,
+		},
+		{
+			name:    "error getting the confidential client secret",
+			id:      clientID,
+			getErr:  errors.New("some get error"),
+			wantErr: "failed to get client secret: some get error",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			if tt.secret != nil {
+				require.NoError(t, kubeClient.Tracker().Add(tt.secret))
+			}
+			if tt.getErr != nil {
+				kubeClient.PrependReactor("get", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.getErr
+				})
+			}
+
+			registry := NewKubeClientManager(kubeClient.CoreV1().Secrets("some-namespace"))
+			registry.clock = func() time.Time { return now }
+			got, err := registry.GetClient(context.Background(), tt.id)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Nil(t, got)
+				if tt.wantCode != 0 {
+					rfcErr := fosite.ErrorToRFC6749Error(err)
+					require.Equal(t, tt.wantCode, rfcErr.CodeField)
+					require.Equal(t, tt.wantErr, rfcErr.GetDescription())
+				} else {
+					require.EqualError(t, err, tt.wantErr)
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantClient, got)
+		})
+	}
+}
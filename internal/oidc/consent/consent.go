@@ -0,0 +1,199 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package consent stores the consent of users to clients which are not trusted, so that users are only asked again
+// when the client requests more scopes, or when their consent has expired or was revoked.
+package consent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ory/fosite"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+const (
+	// TypeLabelValue is the value of the storage.pinniped.dev/type label of the Secrets which hold consents.
+	TypeLabelValue = "consent"
+
+	// Lifetime is how long a consent is remembered. Secrets are garbage collected after this time.
+	Lifetime = 90 * 24 * time.Hour
+
+	consentStorageVersion = "1"
+)
+
+type storedConsent struct {
+	Subject   string    `json:"subject"`
+	ClientID  string    `json:"clientID"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Version   string    `json:"version"`
+}
+
+// Storage stores the consents of users in Secrets. It is safe to use from many Supervisor pods at the same time.
+type Storage struct {
+	storage crud.Storage
+	clock   func() time.Time
+}
+
+// NewStorage returns a Storage.
+func NewStorage(secrets corev1client.SecretInterface, clock func() time.Time) *Storage {
+	return &Storage{
+		storage: crud.New(TypeLabelValue, secrets, clock, Lifetime),
+		clock:   clock,
+	}
+}
+
+// HasConsent returns whether the user of the downstream subject has consented to the client receiving all the
+// scopes, and the consent has not expired.
+func (s *Storage) HasConsent(ctx context.Context, subject, clientID string, scopes []string) (bool, error) {
+	stored, _, _, err := s.get(ctx, subject, clientID)
+	if err != nil || stored == nil {
+		return false, err
+	}
+	for _, scope := range scopes {
+		if !contains(stored.Scopes, scope) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Grant remembers that the user of the downstream subject has consented to the client receiving the scopes, in
+// addition to the scopes of their unexpired previous consent. It restarts the expiry of the consent.
+func (s *Storage) Grant(ctx context.Context, subject, clientID string, scopes []string) error {
+	// Another Supervisor pod may grant the same consent at the same time, so start over when it did.
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err)
+	}, func() error {
+		stored, rv, exists, err := s.get(ctx, subject, clientID)
+		if err != nil {
+			return err
+		}
+
+		grantedScopes := []string{}
+		if stored != nil {
+			grantedScopes = append(grantedScopes, stored.Scopes...)
+		}
+		for _, scope := range scopes {
+			if !contains(grantedScopes, scope) {
+				grantedScopes = append(grantedScopes, scope)
+			}
+		}
+		newConsent := &storedConsent{
+			Subject:   subject,
+			ClientID:  clientID,
+			Scopes:    grantedScopes,
+			ExpiresAt: s.clock().Add(Lifetime),
+			Version:   consentStorageVersion,
+		}
+
+		if exists {
+			_, err = s.storage.Update(ctx, signature(subject, clientID), rv, newConsent, nil)
+		} else {
+			_, err = s.storage.Create(ctx, signature(subject, clientID), newConsent, nil)
+		}
+		return err
+	})
+}
+
+// Revoke forgets the consent of the user of the downstream subject to the client. It is not an error when there is
+// no such consent.
+func (s *Storage) Revoke(ctx context.Context, subject, clientID string) error {
+	err := s.storage.Delete(ctx, signature(subject, clientID))
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// NewRevocationHandler returns an http.Handler that revokes the consent of a user to the client of the client_id
+// param. The user is authenticated by an access token which the Supervisor issued to them for any client, which is
+// sent as a bearer token.
+func NewRevocationHandler(oauthHelper fosite.OAuth2Provider, storage *Storage) http.Handler {
+	return securityheader.Wrap(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try POST)", r.Method)
+		}
+
+		accessToken := fosite.AccessTokenFromRequest(r)
+		if accessToken == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return httperr.New(http.StatusUnauthorized, "access token not found")
+		}
+		_, accessRequester, err := oauthHelper.IntrospectToken(r.Context(), accessToken, fosite.AccessToken, psession.NewPinnipedSession())
+		if err != nil {
+			plog.Info("consent revocation error", oidc.FositeErrorForLog(err)...)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return httperr.New(http.StatusUnauthorized, "access token is not valid")
+		}
+
+		clientID := r.PostFormValue("client_id")
+		if clientID == "" {
+			return httperr.New(http.StatusBadRequest, "client_id param not found")
+		}
+
+		session, ok := accessRequester.GetSession().(*psession.PinnipedSession)
+		if !ok || session.Fosite.Claims.Subject == "" {
+			plog.Warning("access token does not have a downstream subject")
+			return httperr.New(http.StatusUnauthorized, "access token is not valid")
+		}
+		if err := storage.Revoke(r.Context(), session.Fosite.Claims.Subject, clientID); err != nil {
+			plog.WarningErr("error revoking consent", err, "clientID", clientID)
+			return httperr.Wrap(http.StatusInternalServerError, "error revoking consent", err)
+		}
+		plog.Info("consent revoked", "clientID", clientID)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+}
+
+// get returns the consent, its resource version, and whether its Secret exists. The consent is nil when it does not
+// exist or has expired, but the Secret of an expired consent still exists and can be updated.
+func (s *Storage) get(ctx context.Context, subject, clientID string) (*storedConsent, string, bool, error) {
+	var stored storedConsent
+	rv, err := s.storage.Get(ctx, signature(subject, clientID), &stored)
+	if k8serrors.IsNotFound(err) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	// Secrets are only garbage collected periodically, so expired consents may still be found. Consents which were
+	// stored by an unknown version are treated like expired consents, so the user is asked again.
+	if stored.Version != consentStorageVersion || s.clock().After(stored.ExpiresAt) {
+		return nil, rv, true, nil
+	}
+	return &stored, rv, true, nil
+}
+
+// signature returns a fixed length name for the consent, since subjects may be long and contain any characters.
+func signature(subject, clientID string) string {
+	// Encode both values as JSON so that no two pairs of values have the same input.
+	input, _ := json.Marshal([]string{subject, clientID})
+	sum := sha256.Sum256(input)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func contains(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
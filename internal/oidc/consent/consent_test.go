@@ -0,0 +1,213 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package consent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+)
+
+func TestStorage(t *testing.T) {
+	const (
+		subject  = "https://upstream.example.com?sub=some-user"
+		clientID = "client.oauth.pinniped.dev-some-app"
+	)
+	ctx := context.Background()
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	newStorage := func(t *testing.T) (*Storage, *fake.Clientset) {
+		t.Helper()
+		kubeClient := fake.NewSimpleClientset()
+		return NewStorage(kubeClient.CoreV1().Secrets("some-namespace"), func() time.Time { return now }), kubeClient
+	}
+	requireConsent := func(t *testing.T, storage *Storage, subject, clientID string, scopes []string, want bool) {
+		t.Helper()
+		got, err := storage.HasConsent(ctx, subject, clientID, scopes)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	t.Run("consent covers the granted scopes of the subject and client", func(t *testing.T) {
+		storage, _ := newStorage(t)
+		requireConsent(t, storage, subject, clientID, []string{"openid"}, false)
+
+		require.NoError(t, storage.Grant(ctx, subject, clientID, []string{"openid", "profile"}))
+		requireConsent(t, storage, subject, clientID, []string{"openid"}, true)
+		requireConsent(t, storage, subject, clientID, []string{"openid", "profile"}, true)
+		requireConsent(t, storage, subject, clientID, []string{"openid", "offline_access"}, false)
+		requireConsent(t, storage, subject, "client.oauth.pinniped.dev-other-app", []string{"openid"}, false)
+		requireConsent(t, storage, "https://upstream.example.com?sub=other-user", clientID, []string{"openid"}, false)
+
+		// Granting more scopes keeps the previously granted scopes.
+		require.NoError(t, storage.Grant(ctx, subject, clientID, []string{"offline_access"}))
+		requireConsent(t, storage, subject, clientID, []string{"openid", "profile", "offline_access"}, true)
+	})
+
+	t.Run("consent expires", func(t *testing.T) {
+		storage, _ := newStorage(t)
+		require.NoError(t, storage.Grant(ctx, subject, clientID, []string{"openid", "profile"}))
+
+		storage.clock = func() time.Time { return now.Add(Lifetime + time.Second) }
+		requireConsent(t, storage, subject, clientID, []string{"openid"}, false)
+
+		// Granting again replaces the expired consent, including its scopes.
+		require.NoError(t, storage.Grant(ctx, subject, clientID, []string{"openid"}))
+		requireConsent(t, storage, subject, clientID, []string{"openid"}, true)
+		requireConsent(t, storage, subject, clientID, []string{"profile"}, false)
+	})
+
+	t.Run("consent can be revoked", func(t *testing.T) {
+		storage, _ := newStorage(t)
+		require.NoError(t, storage.Grant(ctx, subject, clientID, []string{"openid"}))
+		require.NoError(t, storage.Revoke(ctx, subject, clientID))
+		requireConsent(t, storage, subject, clientID, []string{"openid"}, false)
+
+		// Revoking a consent which does not exist is not an error.
+		require.NoError(t, storage.Revoke(ctx, subject, clientID))
+	})
+
+	t.Run("errors reading consent", func(t *testing.T) {
+		storage, kubeClient := newStorage(t)
+		kubeClient.PrependReactor("get", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("some get error")
+		})
+		_, err := storage.HasConsent(ctx, subject, clientID, []string{"openid"})
+		require.ErrorContains(t, err, "some get error")
+		require.ErrorContains(t, storage.Grant(ctx, subject, clientID, []string{"openid"}), "some get error")
+	})
+}
+
+func TestRevocationHandler(t *testing.T) {
+	const (
+		tokenClientID   = "client.oauth.pinniped.dev-some-client"
+		revokedClientID = "client.oauth.pinniped.dev-some-app"
+	)
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		clientID      string
+		wantStatus    int
+		wantBody      string
+		wantRevoked   bool
+	}{
+		{
+			name:          "revokes the consent of the subject of the access token",
+			method:        http.MethodPost,
+			authorization: "Bearer {token}",
+			clientID:      revokedClientID,
+			wantStatus:    http.StatusNoContent,
+			wantRevoked:   true,
+		},
+		{
+			name:          "GET is not allowed",
+			method:        http.MethodGet,
+			authorization: "Bearer {token}",
+			clientID:      revokedClientID,
+			wantStatus:    http.StatusMethodNotAllowed,
+			wantBody:      "Method Not Allowed: GET (try POST)\n",
+		},
+		{
+			name:       "access token is missing",
+			method:     http.MethodPost,
+			clientID:   revokedClientID,
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "Unauthorized: access token not found\n",
+		},
+		{
+			name:          "access token is not valid",
+			method:        http.MethodPost,
+			authorization: "Bearer some-invalid-token",
+			clientID:      revokedClientID,
+			wantStatus:    http.StatusUnauthorized,
+			wantBody:      "Unauthorized: access token is not valid\n",
+		},
+		{
+			name:          "client_id is missing",
+			method:        http.MethodPost,
+			authorization: "Bearer {token}",
+			wantStatus:    http.StatusBadRequest,
+			wantBody:      "Bad Request: client_id param not found\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			hash, err := bcrypt.GenerateFromPassword([]byte("some-secret"), bcrypt.MinCost)
+			require.NoError(t, err)
+			_, err = secrets.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: tokenClientID},
+				Type:       clientregistry.ConfidentialClientSecretType,
+				Data:       map[string][]byte{"clientSecretHashes": hash},
+			}, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
+			hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+			oauthHelper := oidc.FositeOauth2Helper(oidc.NewKubeStorage(secrets, timeoutsConfiguration),
+				"https://issuer.example.com", hmacSecretFunc, jwks.NewDynamicJWKSProvider(), timeoutsConfiguration, nil)
+
+			// Get an access token with the client credentials grant, whose downstream subject is the client.
+			tokenRequest := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+			tokenRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			tokenRequest.SetBasicAuth(tokenClientID, "some-secret")
+			session := psession.NewPinnipedSession()
+			accessRequest, err := oauthHelper.NewAccessRequest(ctx, tokenRequest, session)
+			require.NoError(t, err)
+			session.Fosite.Claims.Subject = tokenClientID
+			accessResponse, err := oauthHelper.NewAccessResponse(ctx, accessRequest)
+			require.NoError(t, err)
+
+			storage := NewStorage(secrets, time.Now)
+			require.NoError(t, storage.Grant(ctx, tokenClientID, revokedClientID, []string{"openid"}))
+
+			form := url.Values{}
+			if test.clientID != "" {
+				form.Set("client_id", test.clientID)
+			}
+			req := httptest.NewRequest(test.method, "/consent/revoke", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.authorization != "" {
+				req.Header.Set("Authorization", strings.ReplaceAll(test.authorization, "{token}", accessResponse.GetAccessToken()))
+			}
+			rsp := httptest.NewRecorder()
+			NewRevocationHandler(oauthHelper, storage).ServeHTTP(rsp, req)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			testutil.RequireSecurityHeaders(t, rsp)
+			require.Equal(t, test.wantStatus, rsp.Code)
+			require.Equal(t, test.wantBody, rsp.Body.String())
+			if test.wantStatus == http.StatusUnauthorized {
+				require.Equal(t, "Bearer", rsp.Header().Get("WWW-Authenticate"))
+			}
+
+			hasConsent, err := storage.HasConsent(ctx, tokenClientID, revokedClientID, []string{"openid"})
+			require.NoError(t, err)
+			require.Equal(t, !test.wantRevoked, hasConsent)
+		})
+	}
+}
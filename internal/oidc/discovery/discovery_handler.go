@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package discovery provides a handler for the OIDC discovery endpoint.
@@ -11,6 +11,7 @@ import (
 
 	"go.pinniped.dev/generated/latest/apis/supervisor/idpdiscovery/v1alpha1"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/dpop"
 )
 
 // Metadata holds all fields (that we care about) from the OpenID Provider Metadata section in the
@@ -37,6 +38,13 @@ type Metadata struct {
 	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
 	ScopesSupported                   []string `json:"scopes_supported"`
 	ClaimsSupported                   []string `json:"claims_supported"`
+	RegistrationEndpoint              string   `json:"registration_endpoint"`
+
+	// PushedAuthorizationRequestEndpoint is defined by RFC 9126.
+	PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint"`
+
+	// DPoPSigningAlgValuesSupported is defined by RFC 9449.
+	DPoPSigningAlgValuesSupported []string `json:"dpop_signing_alg_values_supported"`
 
 	// ^^^ Optional ^^^
 
@@ -47,13 +55,18 @@ type Metadata struct {
 	// ^^^ Custom ^^^
 }
 
-// NewHandler returns an http.Handler that serves an OIDC discovery endpoint.
+// NewHandler returns an http.Handler that serves an OIDC discovery endpoint. The same metadata is also valid
+// OAuth 2.0 Authorization Server Metadata (RFC 8414), so the handler serves that endpoint too.
 func NewHandler(issuerURL string) http.Handler {
 	oidcConfig := Metadata{
 		Issuer:                issuerURL,
 		AuthorizationEndpoint: issuerURL + oidc.AuthorizationEndpointPath,
 		TokenEndpoint:         issuerURL + oidc.TokenEndpointPath,
 		JWKSURI:               issuerURL + oidc.JWKSEndpointPath,
+		RegistrationEndpoint:  issuerURL + oidc.RegistrationEndpointPath,
+
+		PushedAuthorizationRequestEndpoint: issuerURL + oidc.PushedAuthorizationRequestEndpointPath,
+
 		OIDCDiscoveryResponse: v1alpha1.OIDCDiscoveryResponse{
 			SupervisorDiscovery: v1alpha1.OIDCDiscoveryResponseIDPEndpoint{
 				PinnipedIDPsEndpoint: issuerURL + oidc.PinnipedIDPsPathV1Alpha1,
@@ -65,7 +78,8 @@ func NewHandler(issuerURL string) http.Handler {
 		IDTokenSigningAlgValuesSupported:  []string{"ES256"},
 		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
 		ScopesSupported:                   []string{"openid", "offline"},
-		ClaimsSupported:                   []string{"groups"},
+		ClaimsSupported:                   []string{"groups", "auth_time", "acr", "amr"},
+		DPoPSigningAlgValuesSupported:     dpop.SigningAlgorithms,
 	}
 
 	var b bytes.Buffer
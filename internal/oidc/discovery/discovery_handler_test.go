@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package discovery
@@ -40,13 +40,16 @@ func TestDiscovery(t *testing.T) {
 				"authorization_endpoint": "https://some-issuer.com/some/path/oauth2/authorize",
 				"token_endpoint": "https://some-issuer.com/some/path/oauth2/token",
 				"jwks_uri": "https://some-issuer.com/some/path/jwks.json",
+				"registration_endpoint": "https://some-issuer.com/some/path/oauth2/register",
+				"pushed_authorization_request_endpoint": "https://some-issuer.com/some/path/oauth2/par",
+				"dpop_signing_alg_values_supported": ["ES256", "ES384", "ES512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"],
 				"response_types_supported": ["code"],
 				"response_modes_supported": ["query", "form_post"],
 				"subject_types_supported": ["public"],
 				"id_token_signing_alg_values_supported": ["ES256"],
 				"token_endpoint_auth_methods_supported": ["client_secret_basic"],
 				"scopes_supported": ["openid", "offline"],
-				"claims_supported": ["groups"],
+				"claims_supported": ["groups", "auth_time", "acr", "amr"],
 				"discovery.supervisor.pinniped.dev/v1alpha1": {
 					"pinniped_identity_providers_endpoint": "https://some-issuer.com/some/path/v1alpha1/pinniped_identity_providers"
 				}
@@ -8,6 +8,8 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
@@ -16,11 +18,13 @@ import (
 	"github.com/ory/fosite/token/jwt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"go.pinniped.dev/internal/authenticators"
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 )
 
@@ -31,6 +35,23 @@ const (
 	// The name of the email_verified claim from https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
 	emailVerifiedClaimName = "email_verified"
 
+	// The names of the claims which say when and how the user authenticated, from
+	// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+	authTimeClaimName = "auth_time"
+	acrClaimName      = "acr"
+	amrClaimName      = "amr"
+
+	// The downstream authorization request params which ask for fresh authentication, from
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	promptParamName = "prompt"
+	promptLogin     = "login"
+	maxAgeParamName = "max_age"
+
+	// maxClockSkew is how far the clock of the upstream IDP may be behind the Supervisor's clock when checking
+	// whether the user authenticated recently enough. This also covers the auth_time claim having only a precision
+	// of seconds.
+	maxClockSkew = time.Minute
+
 	requiredClaimMissingErr            = constable.Error("required claim in upstream ID token missing")
 	requiredClaimInvalidFormatErr      = constable.Error("required claim in upstream ID token has invalid format")
 	requiredClaimEmptyErr              = constable.Error("required claim in upstream ID token is empty")
@@ -38,8 +59,84 @@ const (
 	emailVerifiedClaimFalseErr         = constable.Error("email_verified claim in upstream ID token has false value")
 )
 
-// MakeDownstreamSession creates a downstream OIDC session.
-func MakeDownstreamSession(subject string, username string, groups []string, custom *psession.CustomSessionData) *psession.PinnipedSession {
+// Authentication describes when and how the user authenticated for a downstream authorization request.
+type Authentication struct {
+	// RequestedAt is when the downstream authorization request was made, or zero when it is unknown.
+	RequestedAt time.Time `json:"r,omitempty"`
+	// AuthTime is when the user authenticated with the upstream IDP, or zero when they authenticated just now.
+	AuthTime time.Time `json:"t,omitempty"`
+	// ACR and AMR are the authentication context class and methods of the upstream ID token, when it had them.
+	ACR string   `json:"acr,omitempty"`
+	AMR []string `json:"amr,omitempty"`
+}
+
+// UpstreamAuthentication returns when and how the user authenticated according to the auth_time, acr, and amr
+// claims of the upstream ID token. Claims which are missing or have an invalid format are ignored.
+func UpstreamAuthentication(idTokenClaims map[string]interface{}) *Authentication {
+	authn := &Authentication{}
+	switch authTime := idTokenClaims[authTimeClaimName].(type) {
+	case float64:
+		authn.AuthTime = time.Unix(int64(authTime), 0).UTC()
+	case int64:
+		authn.AuthTime = time.Unix(authTime, 0).UTC()
+	}
+	if acr, ok := idTokenClaims[acrClaimName].(string); ok {
+		authn.ACR = acr
+	}
+	if amr, ok := idTokenClaims[amrClaimName].([]interface{}); ok {
+		for _, method := range amr {
+			if methodAsString, ok := method.(string); ok {
+				authn.AMR = append(authn.AMR, methodAsString)
+			}
+		}
+	}
+	return authn
+}
+
+// RequireFreshAuthentication returns a login_required error when the downstream authorization request asked for
+// prompt=login or max_age, but the user authenticated with the upstream IDP before the request or too long ago.
+// A nil Authentication means that the user authenticated just now. Since the clock of the upstream IDP may be behind
+// the Supervisor's clock, an AuthTime which misses the requirements by up to maxClockSkew is accepted, and is moved
+// forward to just meet them, because fosite checks the auth_time of the downstream ID token without any tolerance.
+func RequireFreshAuthentication(authorizeRequester fosite.AuthorizeRequester, authn *Authentication) error {
+	if authn == nil || authn.AuthTime.IsZero() {
+		return nil
+	}
+	form := authorizeRequester.GetRequestForm()
+	if !authn.RequestedAt.IsZero() && authn.AuthTime.Before(authn.RequestedAt) {
+		for _, prompt := range strings.Fields(form.Get(promptParamName)) {
+			if prompt != promptLogin {
+				continue
+			}
+			if authn.AuthTime.Add(maxClockSkew).Before(authn.RequestedAt) {
+				return fosite.ErrLoginRequired.WithHint(
+					"The upstream identity provider did not authenticate the user again, although prompt=login was requested.")
+			}
+			authn.AuthTime = authn.RequestedAt
+		}
+	}
+	if maxAge, err := strconv.ParseInt(form.Get(maxAgeParamName), 10, 64); err == nil && maxAge > 0 {
+		notBefore := time.Now().Add(-time.Duration(maxAge) * time.Second)
+		if authn.AuthTime.Before(notBefore) {
+			if authn.AuthTime.Add(maxClockSkew).Before(notBefore) {
+				return fosite.ErrLoginRequired.WithHint(
+					"The user authenticated with the upstream identity provider longer ago than max_age allows.")
+			}
+			authn.AuthTime = notBefore
+		}
+	}
+	return nil
+}
+
+// MakeDownstreamSession creates a downstream OIDC session. A nil Authentication means that the user authenticated
+// just now, and that the upstream IDP did not say how.
+func MakeDownstreamSession(
+	subject string,
+	username string,
+	groups []string,
+	custom *psession.CustomSessionData,
+	authn *Authentication,
+) *psession.PinnipedSession {
 	now := time.Now().UTC()
 	openIDSession := &psession.PinnipedSession{
 		Fosite: &openid.DefaultSession{
@@ -51,6 +148,18 @@ func MakeDownstreamSession(subject string, username string, groups []string, cus
 		},
 		Custom: custom,
 	}
+	if authn != nil {
+		claims := openIDSession.IDTokenClaims()
+		if !authn.RequestedAt.IsZero() {
+			claims.RequestedAt = authn.RequestedAt.UTC()
+		}
+		// Never claim that the user authenticated in the future, even when the clock of the upstream IDP is ahead.
+		if !authn.AuthTime.IsZero() && authn.AuthTime.Before(now) {
+			claims.AuthTime = authn.AuthTime.UTC()
+		}
+		claims.AuthenticationContextClassReference = authn.ACR
+		claims.AuthenticationMethodsReferences = authn.AMR
+	}
 	if groups == nil {
 		groups = []string{}
 	}
@@ -228,6 +337,42 @@ func ExtractStringClaimValue(claimName string, upstreamIDPName string, idTokenCl
 	return valueAsString, nil
 }
 
+// MakeDownstreamLDAPOrADCustomSessionData returns the custom session data for a user who was authenticated by an
+// LDAP or Active Directory upstream.
+func MakeDownstreamLDAPOrADCustomSessionData(
+	ldapUpstream provider.UpstreamLDAPIdentityProviderI,
+	idpType psession.ProviderType,
+	authenticateResponse *authenticators.Response,
+) *psession.CustomSessionData {
+	customSessionData := &psession.CustomSessionData{
+		ProviderUID:  ldapUpstream.GetResourceUID(),
+		ProviderName: ldapUpstream.GetName(),
+		ProviderType: idpType,
+	}
+
+	if idpType == psession.ProviderTypeLDAP {
+		customSessionData.LDAP = &psession.LDAPSessionData{
+			UserDN:                 authenticateResponse.DN,
+			ExtraRefreshAttributes: authenticateResponse.ExtraRefreshAttributes,
+		}
+	}
+	if idpType == psession.ProviderTypeActiveDirectory {
+		customSessionData.ActiveDirectory = &psession.ActiveDirectorySessionData{
+			UserDN:                 authenticateResponse.DN,
+			ExtraRefreshAttributes: authenticateResponse.ExtraRefreshAttributes,
+		}
+	}
+
+	return customSessionData
+}
+
+// DownstreamSubjectFromUpstreamLDAP returns the downstream subject for a user who was authenticated by an
+// LDAP or Active Directory upstream.
+func DownstreamSubjectFromUpstreamLDAP(ldapUpstream provider.UpstreamLDAPIdentityProviderI, authenticateResponse *authenticators.Response) string {
+	ldapURL := *ldapUpstream.GetURL()
+	return DownstreamLDAPSubject(authenticateResponse.User.GetUID(), ldapURL)
+}
+
 func DownstreamLDAPSubject(uid string, ldapURL url.URL) string {
 	q := ldapURL.Query()
 	q.Set(oidc.IDTokenSubjectClaim, uid)
@@ -235,6 +380,15 @@ func DownstreamLDAPSubject(uid string, ldapURL url.URL) string {
 	return ldapURL.String()
 }
 
+// TOTPUser returns the user whose TOTP codes are verified after they logged in to an upstream. The downstream subject
+// identifies the user, because it is unique across all upstreams.
+func TOTPUser(subject string, username string, upstreamName string) totp.User {
+	return totp.User{
+		Key:         subject,
+		AccountName: fmt.Sprintf("%s (%s)", username, upstreamName),
+	}
+}
+
 func downstreamSubjectFromUpstreamOIDC(upstreamIssuerAsString string, upstreamSubject string) string {
 	return fmt.Sprintf("%s?%s=%s", upstreamIssuerAsString, oidc.IDTokenSubjectClaim, url.QueryEscape(upstreamSubject))
 }
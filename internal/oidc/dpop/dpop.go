@@ -0,0 +1,248 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dpop verifies the proofs of OAuth 2.0 Demonstrating Proof of Possession (DPoP), as defined by RFC 9449.
+// Clients which send DPoP proofs to the token endpoint get tokens which are bound to the key of the proofs, so that
+// the tokens are useless without the key.
+package dpop
+
+import (
+	"container/list"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ory/fosite"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// HeaderName is the name of the HTTP header which contains the DPoP proof of a request.
+	HeaderName = "DPoP"
+
+	// TokenType is the token_type of the access tokens which are bound to the key of a DPoP proof.
+	TokenType = "DPoP"
+
+	// proofType is the typ header of DPoP proofs.
+	proofType = "dpop+jwt"
+
+	// maxProofAge is how long after it was issued a proof is still accepted. Proofs are created right before each
+	// request, so this only needs to allow for slow requests.
+	maxProofAge = 5 * time.Minute
+
+	// maxClockSkew is how far in the future the issued at time of a proof may be, since the clocks of clients are
+	// not perfectly in sync with the clock of the server.
+	maxClockSkew = time.Minute
+
+	// DefaultReplayCacheSize is how many proofs a ReplayCache remembers at most. It is far more than the number of
+	// token requests which a Supervisor pod gets within maxProofAge.
+	DefaultReplayCacheSize = 100000
+)
+
+// SigningAlgorithms are the signing algorithms of the DPoP proofs which are accepted. Only asymmetric algorithms make
+// sense, since the server must not know the private key.
+var SigningAlgorithms = []string{ //nolint:gochecknoglobals
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+	string(jose.RS256), string(jose.RS384), string(jose.RS512),
+	string(jose.PS256), string(jose.PS384), string(jose.PS512),
+	string(jose.EdDSA),
+}
+
+// ErrInvalidProof is the error of requests with an invalid DPoP proof, as defined by RFC 9449.
+var ErrInvalidProof = &fosite.RFC6749Error{ //nolint:gochecknoglobals
+	ErrorField:       "invalid_dpop_proof",
+	DescriptionField: "The DPoP proof is invalid.",
+	CodeField:        http.StatusBadRequest,
+}
+
+type proofClaims struct {
+	JTI string               `json:"jti"`
+	HTM string               `json:"htm"`
+	HTU string               `json:"htu"`
+	IAT *josejwt.NumericDate `json:"iat"`
+}
+
+// VerifyProof verifies the DPoP proof of the request, which must be a request to the endpoint with the given URL,
+// and returns the JWK SHA-256 thumbprint of its key (RFC 7638). It returns an empty thumbprint when the request does
+// not have a DPoP proof.
+//
+// The unique ID of the proof is remembered in the replayCache, so that a proof which is sent again is rejected. The
+// Supervisor may have many pods which each have their own cache, so only proofs which were issued very recently are
+// accepted too, and a proof which is replayed to another pod could only be sent together with the tokens for which
+// it was created anyway.
+func VerifyProof(r *http.Request, endpointURL string, now time.Time, replayCache *ReplayCache) (string, error) {
+	values := r.Header.Values(HeaderName)
+	switch len(values) {
+	case 0:
+		return "", nil
+	case 1:
+	default:
+		return "", ErrInvalidProof.WithHintf("The request must not have more than one %s header.", HeaderName)
+	}
+
+	// Only the compact serialization is allowed, even though the parser also accepts the JSON serialization.
+	if strings.Count(values[0], ".") != 2 {
+		return "", ErrInvalidProof.WithHint("The proof must be a JWT.")
+	}
+	parsed, err := josejwt.ParseSigned(values[0])
+	if err != nil {
+		return "", ErrInvalidProof.WithHint("The proof must be a JWT.").WithWrap(err).WithDebug(err.Error())
+	}
+	if len(parsed.Headers) != 1 {
+		return "", ErrInvalidProof.WithHint("The proof must have exactly one signature.")
+	}
+	header := parsed.Headers[0]
+	if header.ExtraHeaders[jose.HeaderType] != proofType {
+		return "", ErrInvalidProof.WithHintf("The typ header of the proof must be %q.", proofType)
+	}
+	if !stringSliceContains(SigningAlgorithms, header.Algorithm) {
+		return "", ErrInvalidProof.WithHintf("The signing algorithm %q of the proof is not supported.", header.Algorithm)
+	}
+	key := header.JSONWebKey
+	if key == nil || !key.Valid() || !key.IsPublic() {
+		return "", ErrInvalidProof.WithHint("The jwk header of the proof must be a valid public key.")
+	}
+
+	var claims proofClaims
+	if err := parsed.Claims(key.Key, &claims); err != nil {
+		return "", ErrInvalidProof.WithHint("The signature of the proof is invalid.").WithWrap(err).WithDebug(err.Error())
+	}
+	if claims.JTI == "" {
+		return "", ErrInvalidProof.WithHint("The proof must have a jti claim.")
+	}
+	if claims.HTM != r.Method {
+		return "", ErrInvalidProof.WithHintf("The htm claim of the proof must be %q.", r.Method)
+	}
+	if !htuMatches(claims.HTU, endpointURL) {
+		return "", ErrInvalidProof.WithHintf("The htu claim of the proof must be %q.", endpointURL)
+	}
+	if claims.IAT == nil {
+		return "", ErrInvalidProof.WithHint("The proof must have an iat claim.")
+	}
+	issuedAt := claims.IAT.Time()
+	if issuedAt.Before(now.Add(-maxProofAge)) || issuedAt.After(now.Add(maxClockSkew)) {
+		return "", ErrInvalidProof.WithHint("The proof was not issued recently.")
+	}
+
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", ErrInvalidProof.WithHint("Could not compute the thumbprint of the key of the proof.").WithWrap(err).WithDebug(err.Error())
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	// The proof is only remembered once it is known to be valid, so that invalid proofs cannot fill the cache. The
+	// jti only needs to be unique per key, so it is remembered together with the thumbprint.
+	if !replayCache.add(jkt, claims.JTI, issuedAt.Add(maxProofAge), now) {
+		return "", ErrInvalidProof.WithHint("The proof was already used.")
+	}
+	return jkt, nil
+}
+
+// ReplayCache remembers the proofs which were accepted by VerifyProof until they are too old to be accepted anyway,
+// so that each proof can only be used once. It is safe for concurrent use.
+type ReplayCache struct {
+	maxSize int
+
+	mutex sync.Mutex
+	// seen is the expiry of each remembered proof, by thumbprint and jti. order has the same proofs in the order in
+	// which they were added, which is about the order in which they expire, to find the proofs which can be forgotten.
+	seen  map[replayCacheKey]time.Time
+	order *list.List
+}
+
+type replayCacheKey struct {
+	jkt string
+	jti string
+}
+
+// NewReplayCache returns a ReplayCache which remembers at most maxSize proofs. When it is full, the oldest proofs are
+// forgotten even when they have not expired yet, so that the memory which it uses is bounded.
+func NewReplayCache(maxSize int) *ReplayCache {
+	return &ReplayCache{
+		maxSize: maxSize,
+		seen:    make(map[replayCacheKey]time.Time),
+		order:   list.New(),
+	}
+}
+
+// add remembers the proof until it expires, and returns false when the proof was already remembered.
+func (c *ReplayCache) add(jkt string, jti string, expiresAt time.Time, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Forget the proofs which expired, and the oldest proofs when there are too many.
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		key := front.Value.(replayCacheKey)
+		if c.order.Len() < c.maxSize && now.Before(c.seen[key]) {
+			break
+		}
+		delete(c.seen, key)
+		c.order.Remove(front)
+	}
+
+	key := replayCacheKey{jkt: jkt, jti: jti}
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = expiresAt
+	c.order.PushBack(key)
+	return true
+}
+
+// htuMatches returns whether the htu claim of a proof is the URL of the endpoint, ignoring its query and fragment.
+func htuMatches(htu string, endpointURL string) bool {
+	parsed, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	return parsed.String() == endpointURL
+}
+
+func stringSliceContains(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type thumbprintContextKey struct{}
+
+// WithThumbprint returns a context which carries the thumbprint of the key of the DPoP proof of the current request,
+// so that the handlers of fosite can check it.
+func WithThumbprint(ctx context.Context, thumbprint string) context.Context {
+	return context.WithValue(ctx, thumbprintContextKey{}, thumbprint)
+}
+
+// ThumbprintFromContext returns the thumbprint which was added by WithThumbprint, or an empty string when there is
+// none.
+func ThumbprintFromContext(ctx context.Context) string {
+	thumbprint, _ := ctx.Value(thumbprintContextKey{}).(string)
+	return thumbprint
+}
+
+// CheckBinding returns an error when tokens which are bound to the key with the boundThumbprint are used without
+// a DPoP proof of that key. Tokens which are not bound to a key may be used with or without a proof.
+func CheckBinding(boundThumbprint string, proofThumbprint string) error {
+	if boundThumbprint == "" {
+		return nil
+	}
+	if proofThumbprint == "" {
+		return ErrInvalidProof.WithHintf("The token is bound to a key, so the request must have a %s header.", HeaderName)
+	}
+	if proofThumbprint != boundThumbprint {
+		return ErrInvalidProof.WithHint("The token is bound to a different key than the key of the proof.")
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dpop
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+const endpointURL = "https://issuer.example.com/some/path/oauth2/token"
+
+func TestVerifyProof(t *testing.T) {
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	publicJWK := &jose.JSONWebKey{Key: privateKey.Public()}
+	thumbprintBytes, err := publicJWK.Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	thumbprint := base64.RawURLEncoding.EncodeToString(thumbprintBytes)
+
+	happyClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"jti": "some-unique-id",
+			"htm": http.MethodPost,
+			"htu": endpointURL,
+			"iat": josejwt.NewNumericDate(now),
+		}
+	}
+	sign := func(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, opts *jose.SignerOptions, claims map[string]interface{}) string {
+		t.Helper()
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+		require.NoError(t, err)
+		proof, err := josejwt.Signed(signer).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return proof
+	}
+	happyProof := func(t *testing.T, modifyClaims func(map[string]interface{})) string {
+		t.Helper()
+		claims := happyClaims()
+		if modifyClaims != nil {
+			modifyClaims(claims)
+		}
+		return sign(t, jose.ES256, privateKey, (&jose.SignerOptions{EmbedJWK: true}).WithType("dpop+jwt"), claims)
+	}
+
+	tests := []struct {
+		name           string
+		headers        func(t *testing.T) []string
+		wantThumbprint string
+		wantHint       string
+	}{
+		{
+			name:    "no DPoP header",
+			headers: func(t *testing.T) []string { return nil },
+		},
+		{
+			name:           "valid proof",
+			headers:        func(t *testing.T) []string { return []string{happyProof(t, nil)} },
+			wantThumbprint: thumbprint,
+		},
+		{
+			name: "valid proof with a query and different case in htu",
+			headers: func(t *testing.T) []string {
+				return []string{happyProof(t, func(claims map[string]interface{}) {
+					claims["htu"] = "HTTPS://Issuer.Example.com/some/path/oauth2/token?some=query"
+				})}
+			},
+			wantThumbprint: thumbprint,
+		},
+		{
+			name: "valid proof which was issued a little in the future",
+			headers: func(t *testing.T) []string {
+				return []string{happyProof(t, func(claims map[string]interface{}) {
+					claims["iat"] = josejwt.NewNumericDate(now.Add(30 * time.Second))
+				})}
+			},
+			wantThumbprint: thumbprint,
+		},
+		{
+			name:     "two DPoP headers",
+			headers:  func(t *testing.T) []string { return []string{happyProof(t, nil), happyProof(t, nil)} },
+			wantHint: "The request must not have more than one DPoP header.",
+		},
+		{
+			name:     "not a JWT",
+			headers:  func(t *testing.T) []string { return []string{"not-a-jwt"} },
+			wantHint: "The proof must be a JWT.",
+		},
+		{
+			name: "wrong typ header",
+			headers: func(t *testing.T) []string {
+				return []string{sign(t, jose.ES256, privateKey, (&jose.SignerOptions{EmbedJWK: true}).WithType("JWT"), happyClaims())}
+			},
+			wantHint: `The typ header of the proof must be "dpop+jwt".`,
+		},
+		{
+			name: "symmetric signing algorithm",
+			headers: func(t *testing.T) []string {
+				return []string{sign(t, jose.HS256, []byte("some-shared-secret-which-is-long-enough"), (&jose.SignerOptions{}).WithType("dpop+jwt"), happyClaims())}
+			},
+			wantHint: `The signing algorithm "HS256" of the proof is not supported.`,
+		},
+		{
+			name: "no jwk header",
+			headers: func(t *testing.T) []string {
+				return []string{sign(t, jose.ES256, privateKey, (&jose.SignerOptions{}).WithType("dpop+jwt"), happyClaims())}
+			},
+			wantHint: "The jwk header of the proof must be a valid public key.",
+		},
+		{
+			name: "signed by a different key than the key of the jwk header",
+			headers: func(t *testing.T) []string {
+				otherPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				require.NoError(t, err)
+				opts := (&jose.SignerOptions{}).WithType("dpop+jwt").WithHeader("jwk", publicJWK)
+				return []string{sign(t, jose.ES256, otherPrivateKey, opts, happyClaims())}
+			},
+			wantHint: "The signature of the proof is invalid.",
+		},
+		{
+			name: "no jti claim",
+			headers: func(t *testing.T) []string {
+				return []string{happyProof(t, func(claims map[string]interface{}) { delete(claims, "jti") })}
+			},
+			wantHint: "The proof must have a jti claim.",
+		},
+		{
+			name: "wrong htm claim",
+			headers: func(t *testing.T) []string {
+				return []string{happyProof(t, func(claims map[string]interface{}) { claims["htm"] = http.MethodGet })}
+			},
+			wantHint: `The htm claim of the proof must be "POST".`,
+		},
+		{
+			name: "wrong htu claim",
+			headers: func(t *testing.T) []string {
+				return []string{happyProof(t, func(claims map[string]interface{}) {
+					claims["htu"] = "https://issuer.example.com/some/other/path/oauth2/token"
+				})}
+			},
+			wantHint: `The htu claim of the proof must be "https://issuer.example.com/some/path/oauth2/token".`,
+		},
+		{
+			name: "no iat claim",
+			headers: func(t *testing.T) []string {
+				return []string{happyProof(t, func(claims map[string]interface{}) { delete(claims, "iat") })}
+			},
+			wantHint: "The proof must have an iat claim.",
+		},
+		{
+			name: "old proof",
+			headers: func(t *testing.T) []string {
+				return []string{happyProof(t, func(claims map[string]interface{}) {
+					claims["iat"] = josejwt.NewNumericDate(now.Add(-10 * time.Minute))
+				})}
+			},
+			wantHint: "The proof was not issued recently.",
+		},
+		{
+			name: "proof which was issued too far in the future",
+			headers: func(t *testing.T) []string {
+				return []string{happyProof(t, func(claims map[string]interface{}) {
+					claims["iat"] = josejwt.NewNumericDate(now.Add(10 * time.Minute))
+				})}
+			},
+			wantHint: "The proof was not issued recently.",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/path/shouldn't/matter", nil)
+			for _, header := range test.headers(t) {
+				req.Header.Add("DPoP", header)
+			}
+
+			gotThumbprint, err := VerifyProof(req, endpointURL, now, NewReplayCache(DefaultReplayCacheSize))
+
+			if test.wantHint != "" {
+				var rfc6749Error *fosite.RFC6749Error
+				require.ErrorAs(t, err, &rfc6749Error)
+				require.Equal(t, "invalid_dpop_proof", rfc6749Error.ErrorField)
+				require.Equal(t, http.StatusBadRequest, rfc6749Error.CodeField)
+				require.Equal(t, test.wantHint, rfc6749Error.HintField)
+				require.Empty(t, gotThumbprint)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantThumbprint, gotThumbprint)
+		})
+	}
+
+	verify := func(t *testing.T, replayCache *ReplayCache, proof string, now time.Time) error {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/path/shouldn't/matter", nil)
+		req.Header.Set("DPoP", proof)
+		_, err := VerifyProof(req, endpointURL, now, replayCache)
+		return err
+	}
+	requireReplayed := func(t *testing.T, err error) {
+		t.Helper()
+		var rfc6749Error *fosite.RFC6749Error
+		require.ErrorAs(t, err, &rfc6749Error)
+		require.Equal(t, "invalid_dpop_proof", rfc6749Error.ErrorField)
+		require.Equal(t, "The proof was already used.", rfc6749Error.HintField)
+	}
+
+	t.Run("a proof cannot be used twice", func(t *testing.T) {
+		replayCache := NewReplayCache(DefaultReplayCacheSize)
+		proof := happyProof(t, nil)
+		require.NoError(t, verify(t, replayCache, proof, now))
+		requireReplayed(t, verify(t, replayCache, proof, now.Add(time.Second)))
+
+		// Another proof with the same jti is rejected too, since the jti must be unique for the key.
+		requireReplayed(t, verify(t, replayCache, happyProof(t, func(claims map[string]interface{}) {
+			claims["iat"] = josejwt.NewNumericDate(now.Add(time.Second))
+		}), now.Add(time.Second)))
+	})
+
+	t.Run("the same jti may be used with another key", func(t *testing.T) {
+		replayCache := NewReplayCache(DefaultReplayCacheSize)
+		otherPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		require.NoError(t, verify(t, replayCache, happyProof(t, nil), now))
+		require.NoError(t, verify(t, replayCache, sign(t, jose.ES256, otherPrivateKey, (&jose.SignerOptions{EmbedJWK: true}).WithType("dpop+jwt"), happyClaims()), now))
+	})
+
+	t.Run("invalid proofs are not remembered", func(t *testing.T) {
+		replayCache := NewReplayCache(DefaultReplayCacheSize)
+		tooOld := happyProof(t, func(claims map[string]interface{}) {
+			claims["iat"] = josejwt.NewNumericDate(now.Add(-10 * time.Minute))
+		})
+		require.Error(t, verify(t, replayCache, tooOld, now))
+		require.Empty(t, replayCache.seen)
+	})
+
+	t.Run("proofs are forgotten once they expired or when there are too many", func(t *testing.T) {
+		replayCache := NewReplayCache(2)
+		withJTI := func(jti string) string {
+			return happyProof(t, func(claims map[string]interface{}) { claims["jti"] = jti })
+		}
+		require.NoError(t, verify(t, replayCache, withJTI("jti-1"), now))
+		require.NoError(t, verify(t, replayCache, withJTI("jti-2"), now))
+		require.NoError(t, verify(t, replayCache, withJTI("jti-3"), now))
+		require.Len(t, replayCache.seen, 2)
+		requireReplayed(t, verify(t, replayCache, withJTI("jti-3"), now))
+
+		// Once the remembered proofs expired, they would be rejected for their age anyway.
+		require.NoError(t, verify(t, replayCache, happyProof(t, func(claims map[string]interface{}) {
+			claims["jti"] = "jti-4"
+			claims["iat"] = josejwt.NewNumericDate(now.Add(maxProofAge))
+		}), now.Add(maxProofAge)))
+		require.Len(t, replayCache.seen, 1)
+	})
+}
+
+func TestCheckBinding(t *testing.T) {
+	require.NoError(t, CheckBinding("", ""))
+	require.NoError(t, CheckBinding("", "some-thumbprint"))
+	require.NoError(t, CheckBinding("some-thumbprint", "some-thumbprint"))
+	require.EqualError(t, CheckBinding("some-thumbprint", ""), "invalid_dpop_proof")
+	require.EqualError(t, CheckBinding("some-thumbprint", "other-thumbprint"), "invalid_dpop_proof")
+}
+
+func TestThumbprintFromContext(t *testing.T) {
+	require.Empty(t, ThumbprintFromContext(context.Background()))
+	require.Equal(t, "some-thumbprint", ThumbprintFromContext(WithThumbprint(context.Background(), "some-thumbprint")))
+}
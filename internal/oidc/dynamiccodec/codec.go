@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package dynamiccodec provides a type that can encode information using a just-in-time signing and
@@ -6,6 +6,7 @@
 package dynamiccodec
 
 import (
+	"bytes"
 	"time"
 
 	"github.com/gorilla/securecookie"
@@ -18,12 +19,17 @@ var _ oidc.Codec = &Codec{}
 // KeyFunc returns a single key: a symmetric key.
 type KeyFunc func() []byte
 
+// KeysFunc returns the symmetric keys which were used before the current key, most recent first.
+type KeysFunc func() [][]byte
+
 // Codec can dynamically encode and decode information by using a KeyFunc to get its keys
 // just-in-time.
 type Codec struct {
-	lifespan          time.Duration
-	signingKeyFunc    KeyFunc
-	encryptionKeyFunc KeyFunc
+	lifespan                   time.Duration
+	signingKeyFunc             KeyFunc
+	encryptionKeyFunc          KeyFunc
+	previousSigningKeysFunc    KeysFunc
+	previousEncryptionKeysFunc KeysFunc
 }
 
 // New creates a new Codec that will use the provided keyFuncs for its key source, and
@@ -40,18 +46,59 @@ func New(lifespan time.Duration, signingKeyFunc, encryptionKeyFunc KeyFunc) *Cod
 	}
 }
 
+// NewWithPreviousKeys is like New, but the returned Codec can also decode the values which were encoded before
+// the keys were rotated, by trying the previous keys when the current keys do not work. Values are always
+// encoded with the current keys. Either of the previousKeysFuncs may be nil when that key is not rotated.
+func NewWithPreviousKeys(
+	lifespan time.Duration,
+	signingKeyFunc, encryptionKeyFunc KeyFunc,
+	previousSigningKeysFunc, previousEncryptionKeysFunc KeysFunc,
+) *Codec {
+	c := New(lifespan, signingKeyFunc, encryptionKeyFunc)
+	c.previousSigningKeysFunc = previousSigningKeysFunc
+	c.previousEncryptionKeysFunc = previousEncryptionKeysFunc
+	return c
+}
+
 // Encode implements oidc.Encode().
 func (c *Codec) Encode(name string, value interface{}) (string, error) {
-	return c.delegate().Encode(name, value)
+	return c.delegate(c.signingKeyFunc(), c.encryptionKeyFunc()).Encode(name, value)
 }
 
 // Decode implements oidc.Decode().
 func (c *Codec) Decode(name string, value string, into interface{}) error {
-	return c.delegate().Decode(name, value, into)
+	signingKey, encryptionKey := c.signingKeyFunc(), c.encryptionKeyFunc()
+	err := c.delegate(signingKey, encryptionKey).Decode(name, value, into)
+	if err == nil {
+		return nil
+	}
+
+	// The signing key and the encryption key are rotated independently, so the value may have been encoded with
+	// any combination of the current and previous keys. When none of them work, report why the current keys did
+	// not work.
+	for _, previousSigningKey := range withPreviousKeys(signingKey, c.previousSigningKeysFunc) {
+		for _, previousEncryptionKey := range withPreviousKeys(encryptionKey, c.previousEncryptionKeysFunc) {
+			if bytes.Equal(previousSigningKey, signingKey) && bytes.Equal(previousEncryptionKey, encryptionKey) {
+				continue // already tried above
+			}
+			if c.delegate(previousSigningKey, previousEncryptionKey).Decode(name, value, into) == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+func withPreviousKeys(currentKey []byte, previousKeysFunc KeysFunc) [][]byte {
+	keys := [][]byte{currentKey}
+	if previousKeysFunc != nil {
+		keys = append(keys, previousKeysFunc()...)
+	}
+	return keys
 }
 
-func (c *Codec) delegate() *securecookie.SecureCookie {
-	codec := securecookie.New(c.signingKeyFunc(), c.encryptionKeyFunc())
+func (c *Codec) delegate(signingKey, encryptionKey []byte) *securecookie.SecureCookie {
+	codec := securecookie.New(signingKey, encryptionKey)
 	codec.MaxAge(int(c.lifespan.Seconds()))
 	codec.SetSerializer(securecookie.JSONEncoder{})
 	return codec
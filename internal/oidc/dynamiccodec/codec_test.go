@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package dynamiccodec
@@ -125,3 +125,98 @@ func TestCodec(t *testing.T) {
 		})
 	}
 }
+
+func TestCodecWithPreviousKeys(t *testing.T) {
+	var (
+		oldSigningKey        = []byte("old-signing-key")
+		oldEncryptionKey     = []byte("16-byte-old-encr")
+		currentSigningKey    = []byte("current-signing-key")
+		currentEncryptionKey = []byte("16-byte-cur-encr")
+		unknownSigningKey    = []byte("unknown-signing-key")
+	)
+
+	encode := func(t *testing.T, signingKey, encryptionKey []byte) string {
+		t.Helper()
+		encoded, err := New(time.Hour, func() []byte { return signingKey }, func() []byte { return encryptionKey }).
+			Encode("some-name", "some-message")
+		require.NoError(t, err)
+		return encoded
+	}
+
+	tests := []struct {
+		name                   string
+		encoded                string
+		previousSigningKeys    [][]byte
+		previousEncryptionKeys [][]byte
+		wantDecoderError       string
+	}{
+		{
+			name:    "encoded with the current keys",
+			encoded: encode(t, currentSigningKey, currentEncryptionKey),
+		},
+		{
+			name:                   "encoded with the previous keys",
+			encoded:                encode(t, oldSigningKey, oldEncryptionKey),
+			previousSigningKeys:    [][]byte{unknownSigningKey, oldSigningKey},
+			previousEncryptionKeys: [][]byte{oldEncryptionKey},
+		},
+		{
+			name:                   "encoded with a previous signing key and the current encryption key",
+			encoded:                encode(t, oldSigningKey, currentEncryptionKey),
+			previousSigningKeys:    [][]byte{oldSigningKey},
+			previousEncryptionKeys: [][]byte{oldEncryptionKey},
+		},
+		{
+			name:                "encoded with the current signing key and a previous encryption key",
+			encoded:             encode(t, currentSigningKey, oldEncryptionKey),
+			previousSigningKeys: [][]byte{oldSigningKey},
+			wantDecoderError:    "securecookie: error - caused by: securecookie: error - caused by: ",
+		},
+		{
+			name:             "encoded with keys which are not known",
+			encoded:          encode(t, unknownSigningKey, currentEncryptionKey),
+			wantDecoderError: "securecookie: the value is not valid",
+		},
+		{
+			name:                "encoded with keys which were rotated away",
+			encoded:             encode(t, oldSigningKey, currentEncryptionKey),
+			previousSigningKeys: [][]byte{unknownSigningKey},
+			wantDecoderError:    "securecookie: the value is not valid",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var previousSigningKeysFunc, previousEncryptionKeysFunc KeysFunc
+			if test.previousSigningKeys != nil {
+				previousSigningKeysFunc = func() [][]byte { return test.previousSigningKeys }
+			}
+			if test.previousEncryptionKeys != nil {
+				previousEncryptionKeysFunc = func() [][]byte { return test.previousEncryptionKeys }
+			}
+			decoder := NewWithPreviousKeys(time.Hour,
+				func() []byte { return currentSigningKey },
+				func() []byte { return currentEncryptionKey },
+				previousSigningKeysFunc,
+				previousEncryptionKeysFunc,
+			)
+
+			var decoded string
+			err := decoder.Decode("some-name", test.encoded, &decoded)
+			if test.wantDecoderError != "" {
+				require.Error(t, err)
+				require.True(t, strings.HasPrefix(err.Error(), test.wantDecoderError), "expected %q to start with %q", err.Error(), test.wantDecoderError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "some-message", decoded)
+
+			// Values are always encoded with the current keys.
+			encoded, err := decoder.Encode("some-name", "some-other-message")
+			require.NoError(t, err)
+			require.NoError(t, New(time.Hour, func() []byte { return currentSigningKey }, func() []byte { return currentEncryptionKey }).
+				Decode("some-name", encoded, &decoded))
+			require.Equal(t, "some-other-message", decoded)
+		})
+	}
+}
@@ -44,14 +44,35 @@ func responseAsJSON(upstreamIDPs oidc.UpstreamIdentityProvidersLister) ([]byte,
 		r.PinnipedIDPs = append(r.PinnipedIDPs, v1alpha1.PinnipedIDP{
 			Name:  provider.GetName(),
 			Type:  v1alpha1.IDPTypeLDAP,
-			Flows: []v1alpha1.IDPFlow{v1alpha1.IDPFlowCLIPassword},
+			Flows: []v1alpha1.IDPFlow{v1alpha1.IDPFlowCLIPassword, v1alpha1.IDPFlowBrowserAuthcode},
 		})
 	}
 	for _, provider := range upstreamIDPs.GetActiveDirectoryIdentityProviders() {
 		r.PinnipedIDPs = append(r.PinnipedIDPs, v1alpha1.PinnipedIDP{
 			Name:  provider.GetName(),
 			Type:  v1alpha1.IDPTypeActiveDirectory,
-			Flows: []v1alpha1.IDPFlow{v1alpha1.IDPFlowCLIPassword},
+			Flows: []v1alpha1.IDPFlow{v1alpha1.IDPFlowCLIPassword, v1alpha1.IDPFlowBrowserAuthcode},
+		})
+	}
+	for _, provider := range upstreamIDPs.GetGitHubIdentityProviders() {
+		r.PinnipedIDPs = append(r.PinnipedIDPs, v1alpha1.PinnipedIDP{
+			Name:  provider.GetName(),
+			Type:  v1alpha1.IDPTypeGitHub,
+			Flows: []v1alpha1.IDPFlow{v1alpha1.IDPFlowBrowserAuthcode},
+		})
+	}
+	for _, provider := range upstreamIDPs.GetSAMLIdentityProviders() {
+		r.PinnipedIDPs = append(r.PinnipedIDPs, v1alpha1.PinnipedIDP{
+			Name:  provider.GetName(),
+			Type:  v1alpha1.IDPTypeSAML,
+			Flows: []v1alpha1.IDPFlow{v1alpha1.IDPFlowBrowserAuthcode},
+		})
+	}
+	for _, provider := range upstreamIDPs.GetCertificateIdentityProviders() {
+		r.PinnipedIDPs = append(r.PinnipedIDPs, v1alpha1.PinnipedIDP{
+			Name:  provider.GetName(),
+			Type:  v1alpha1.IDPTypeCertificate,
+			Flows: []v1alpha1.IDPFlow{v1alpha1.IDPFlowCLICertificate, v1alpha1.IDPFlowBrowserAuthcode},
 		})
 	}
 	for _, provider := range upstreamIDPs.GetOIDCIdentityProviders() {
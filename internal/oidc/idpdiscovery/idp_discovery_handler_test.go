@@ -37,24 +37,33 @@ func TestIDPDiscovery(t *testing.T) {
 			wantContentType: "application/json",
 			wantFirstResponseBodyJSON: here.Doc(`{
 				"pinniped_identity_providers": [
-					{"name": "a-some-ldap-idp", "type": "ldap",            "flows": ["cli_password"]},
+					{"name": "a-some-ldap-idp", "type": "ldap",            "flows": ["cli_password", "browser_authcode"]},
 					{"name": "a-some-oidc-idp", "type": "oidc",            "flows": ["browser_authcode"]},
-					{"name": "x-some-idp",      "type": "ldap",            "flows": ["cli_password"]},
+					{"name": "c-some-certificate-idp", "type": "certificate", "flows": ["cli_certificate", "browser_authcode"]},
+					{"name": "g-some-github-idp", "type": "github",          "flows": ["browser_authcode"]},
+					{"name": "s-some-saml-idp", "type": "saml",            "flows": ["browser_authcode"]},
+					{"name": "x-some-idp",      "type": "ldap",            "flows": ["cli_password", "browser_authcode"]},
+					{"name": "x-some-idp",      "type": "github",          "flows": ["browser_authcode"]},
+					{"name": "x-some-idp",      "type": "saml",            "flows": ["browser_authcode"]},
+					{"name": "x-some-idp",      "type": "certificate",     "flows": ["cli_certificate", "browser_authcode"]},
 					{"name": "x-some-idp",      "type": "oidc",            "flows": ["browser_authcode"]},
-					{"name": "y-some-ad-idp",   "type": "activedirectory", "flows": ["cli_password"]},
-					{"name": "z-some-ad-idp",   "type": "activedirectory", "flows": ["cli_password"]},
-					{"name": "z-some-ldap-idp", "type": "ldap",            "flows": ["cli_password"]},
+					{"name": "y-some-ad-idp",   "type": "activedirectory", "flows": ["cli_password", "browser_authcode"]},
+					{"name": "z-some-ad-idp",   "type": "activedirectory", "flows": ["cli_password", "browser_authcode"]},
+					{"name": "z-some-ldap-idp", "type": "ldap",            "flows": ["cli_password", "browser_authcode"]},
 					{"name": "z-some-oidc-idp", "type": "oidc",            "flows": ["browser_authcode", "cli_password"]}
 				]
 			}`),
 			wantSecondResponseBodyJSON: here.Doc(`{
 				"pinniped_identity_providers": [
-					{"name": "some-other-ad-idp-1",   "type": "activedirectory", "flows": ["cli_password"]},
-					{"name": "some-other-ad-idp-2",   "type": "activedirectory", "flows": ["cli_password"]},
-					{"name": "some-other-ldap-idp-1", "type": "ldap",            "flows": ["cli_password"]},
-					{"name": "some-other-ldap-idp-2", "type": "ldap",            "flows": ["cli_password"]},
+					{"name": "some-other-ad-idp-1",   "type": "activedirectory", "flows": ["cli_password", "browser_authcode"]},
+					{"name": "some-other-ad-idp-2",   "type": "activedirectory", "flows": ["cli_password", "browser_authcode"]},
+					{"name": "some-other-certificate-idp", "type": "certificate", "flows": ["cli_certificate", "browser_authcode"]},
+					{"name": "some-other-github-idp", "type": "github",          "flows": ["browser_authcode"]},
+					{"name": "some-other-ldap-idp-1", "type": "ldap",            "flows": ["cli_password", "browser_authcode"]},
+					{"name": "some-other-ldap-idp-2", "type": "ldap",            "flows": ["cli_password", "browser_authcode"]},
 					{"name": "some-other-oidc-idp-1", "type": "oidc",            "flows": ["browser_authcode", "cli_password"]},
-					{"name": "some-other-oidc-idp-2", "type": "oidc",            "flows": ["browser_authcode"]}
+					{"name": "some-other-oidc-idp-2", "type": "oidc",            "flows": ["browser_authcode"]},
+					{"name": "some-other-saml-idp",   "type": "saml",            "flows": ["browser_authcode"]}
 				]
 			}`),
 		},
@@ -79,6 +88,12 @@ func TestIDPDiscovery(t *testing.T) {
 				WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "x-some-idp"}).
 				WithActiveDirectory(&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "z-some-ad-idp"}).
 				WithActiveDirectory(&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "y-some-ad-idp"}).
+				WithGitHub(&oidctestutil.TestUpstreamGitHubIdentityProvider{Name: "x-some-idp"}).
+				WithGitHub(&oidctestutil.TestUpstreamGitHubIdentityProvider{Name: "g-some-github-idp"}).
+				WithSAML(&oidctestutil.TestUpstreamSAMLIdentityProvider{Name: "x-some-idp"}).
+				WithSAML(&oidctestutil.TestUpstreamSAMLIdentityProvider{Name: "s-some-saml-idp"}).
+				WithCertificate(&oidctestutil.TestUpstreamCertificateIdentityProvider{Name: "x-some-idp"}).
+				WithCertificate(&oidctestutil.TestUpstreamCertificateIdentityProvider{Name: "c-some-certificate-idp"}).
 				Build()
 
 			handler := NewHandler(idpLister)
@@ -113,6 +128,18 @@ func TestIDPDiscovery(t *testing.T) {
 				&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "some-other-ad-idp-1"},
 			})
 
+			idpLister.SetGitHubIdentityProviders([]provider.UpstreamGitHubIdentityProviderI{
+				&oidctestutil.TestUpstreamGitHubIdentityProvider{Name: "some-other-github-idp"},
+			})
+
+			idpLister.SetSAMLIdentityProviders([]provider.UpstreamSAMLIdentityProviderI{
+				&oidctestutil.TestUpstreamSAMLIdentityProvider{Name: "some-other-saml-idp"},
+			})
+
+			idpLister.SetCertificateIdentityProviders([]provider.UpstreamCertificateIdentityProviderI{
+				&oidctestutil.TestUpstreamCertificateIdentityProvider{Name: "some-other-certificate-idp"},
+			})
+
 			// Make the same request to the same handler instance again, and expect different results.
 			rsp = httptest.NewRecorder()
 			handler.ServeHTTP(rsp, req)
@@ -7,6 +7,7 @@ import (
 	"context"
 
 	"github.com/ory/fosite"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/fositestoragei"
@@ -15,8 +16,15 @@ import (
 
 const errNullStorageNotImplemented = constable.Error("NullStorage does not implement this method. It should not have been called.")
 
+// NullStorage does not store anything. It still returns the clients of the Supervisor, since the authorize endpoint
+// must validate them.
 type NullStorage struct {
-	clientregistry.StaticClientManager
+	*clientregistry.KubeClientManager
+}
+
+// NewNullStorage returns a NullStorage which reads the Secrets of confidential clients using the given client.
+func NewNullStorage(secrets corev1client.SecretInterface) NullStorage {
+	return NullStorage{KubeClientManager: clientregistry.NewKubeClientManager(secrets)}
 }
 
 var _ fositestoragei.AllFositeStorage = &NullStorage{}
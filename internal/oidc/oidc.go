@@ -1,10 +1,13 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package oidc contains common OIDC functionality needed by Pinniped.
 package oidc
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
 	"time"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
@@ -20,12 +23,19 @@ import (
 )
 
 const (
-	WellKnownEndpointPath     = "/.well-known/openid-configuration"
-	AuthorizationEndpointPath = "/oauth2/authorize"
-	TokenEndpointPath         = "/oauth2/token" //nolint:gosec // ignore lint warning that this is a credential
-	CallbackEndpointPath      = "/callback"
-	JWKSEndpointPath          = "/jwks.json"
-	PinnipedIDPsPathV1Alpha1  = "/v1alpha1/pinniped_identity_providers"
+	WellKnownEndpointPath                  = "/.well-known/openid-configuration"
+	AuthorizationServerMetadataPath        = "/.well-known/oauth-authorization-server"
+	AuthorizationEndpointPath              = "/oauth2/authorize"
+	PushedAuthorizationRequestEndpointPath = "/oauth2/par"
+	TokenEndpointPath                      = "/oauth2/token" //nolint:gosec // ignore lint warning that this is a credential
+	RegistrationEndpointPath               = "/oauth2/register"
+	CallbackEndpointPath                   = "/callback"
+	SAMLACSEndpointPath                    = "/callback/saml"
+	LoginEndpointPath                      = "/login"
+	ConsentEndpointPath                    = "/consent"
+	ConsentRevocationEndpointPath          = "/consent/revoke"
+	JWKSEndpointPath                       = "/jwks.json"
+	PinnipedIDPsPathV1Alpha1               = "/v1alpha1/pinniped_identity_providers"
 )
 
 const (
@@ -43,6 +53,17 @@ const (
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Cookies#Cookie_prefixes.
 	CSRFCookieName = "__Host-pinniped-csrf"
 
+	// SAMLStateCookieName is the name of the browser cookie which shall hold the upstream state param during
+	// logins with SAML upstreams. The SAML spec limits the RelayState to 80 bytes, so SAML identity providers
+	// only receive a short handle for the state, which is returned to the Supervisor along with the response.
+	// SAML identity providers return their responses using a cross-site form POST, on which browsers will not
+	// send SameSite=Lax cookies, so this cookie must be SameSite=None instead.
+	SAMLStateCookieName = "__Host-pinniped-saml-state"
+
+	// SAMLStateCookieEncodingName is the `name` passed to the encoder for encoding and decoding the SAML state
+	// cookie contents.
+	SAMLStateCookieEncodingName = "samlstate"
+
 	// CSRFCookieEncodingName is the `name` passed to the encoder for encoding and decoding the CSRF
 	// cookie contents.
 	CSRFCookieEncodingName = "csrf"
@@ -93,10 +114,14 @@ type Codec interface {
 type UpstreamStateParamData struct {
 	AuthParams    string              `json:"p"`
 	UpstreamName  string              `json:"u"`
+	UpstreamType  string              `json:"t"`
 	Nonce         nonce.Nonce         `json:"n"`
 	CSRFToken     csrftoken.CSRFToken `json:"c"`
 	PKCECode      pkce.Code           `json:"k"`
 	FormatVersion string              `json:"v"`
+	// RequestedAt is when the downstream authorization request was made, in Unix seconds. State params created by
+	// older versions of the Supervisor do not have it.
+	RequestedAt int64 `json:"r,omitempty"`
 }
 
 type TimeoutsConfiguration struct {
@@ -193,6 +218,7 @@ func FositeOauth2Helper(
 	hmacSecretOfLengthAtLeast32Func func() []byte,
 	jwksProvider jwks.DynamicJWKSProvider,
 	timeoutsConfiguration TimeoutsConfiguration,
+	tokenExchangePolicy *provider.TokenExchangePolicy,
 ) fosite.OAuth2Provider {
 	oauthConfig := &compose.Config{
 		IDTokenIssuer: issuer,
@@ -230,7 +256,9 @@ func FositeOauth2Helper(
 		compose.OpenIDConnectExplicitFactory,
 		compose.OpenIDConnectRefreshFactory,
 		compose.OAuth2PKCEFactory,
-		TokenExchangeFactory, // handle the "urn:ietf:params:oauth:grant-type:token-exchange" grant type
+		compose.OAuth2ClientCredentialsGrantFactory, // handle the "client_credentials" grant type for confidential clients
+		TokenExchangeFactory(tokenExchangePolicy),   // handle the "urn:ietf:params:oauth:grant-type:token-exchange" grant type
+		compose.OAuth2TokenIntrospectionFactory,     // validate the access tokens which users send to revoke their consents
 	)
 	provider.(*fosite.Fosite).FormPostHTMLTemplate = formposthtml.Template()
 	return provider
@@ -275,10 +303,49 @@ type UpstreamActiveDirectoryIdentityProviderLister interface {
 	GetActiveDirectoryIdentityProviders() []provider.UpstreamLDAPIdentityProviderI
 }
 
+type UpstreamGitHubIdentityProvidersLister interface {
+	GetGitHubIdentityProviders() []provider.UpstreamGitHubIdentityProviderI
+}
+
+type UpstreamSAMLIdentityProvidersLister interface {
+	GetSAMLIdentityProviders() []provider.UpstreamSAMLIdentityProviderI
+}
+
+type UpstreamCertificateIdentityProvidersLister interface {
+	GetCertificateIdentityProviders() []provider.UpstreamCertificateIdentityProviderI
+}
+
 type UpstreamIdentityProvidersLister interface {
 	UpstreamOIDCIdentityProvidersLister
 	UpstreamLDAPIdentityProvidersLister
 	UpstreamActiveDirectoryIdentityProviderLister
+	UpstreamGitHubIdentityProvidersLister
+	UpstreamSAMLIdentityProvidersLister
+	UpstreamCertificateIdentityProvidersLister
+}
+
+// SAMLRequestID returns the ID of the SAML AuthnRequest which corresponds to the given nonce. The prefix is needed
+// because SAML IDs may not start with a digit.
+func SAMLRequestID(n nonce.Nonce) string {
+	return "id-" + string(n)
+}
+
+// SAMLRelayState returns the RelayState which is sent to SAML upstreams as the handle for the given encoded
+// upstream state param. It is derived from the state param, which includes random values, so that it cannot be
+// guessed, and it is short enough to fit in the 80 bytes which the SAML spec allows.
+func SAMLRelayState(encodedState string) string {
+	hash := sha256.Sum256([]byte(encodedState))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// SAMLServiceProviderForIssuer returns the identity of the Supervisor as a SAML service provider for the
+// FederationDomain with the given issuer. The issuer itself is used as the entity ID.
+func SAMLServiceProviderForIssuer(issuer string) (provider.SAMLServiceProvider, error) {
+	acsURL, err := url.Parse(issuer + SAMLACSEndpointPath)
+	if err != nil {
+		return provider.SAMLServiceProvider{}, err
+	}
+	return provider.SAMLServiceProvider{EntityID: issuer, AssertionConsumerServiceURL: acsURL}, nil
 }
 
 func GrantScopeIfRequested(authorizeRequester fosite.AuthorizeRequester, scopeName string) {
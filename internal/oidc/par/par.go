@@ -0,0 +1,299 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package par implements Pushed Authorization Requests (RFC 9126), which allow clients to send the parameters of
+// their authorization requests directly to the Supervisor, so that only a short request_uri travels through the
+// browser.
+package par
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ory/fosite"
+	"golang.org/x/time/rate"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// TypeLabelValue is the value of the storage.pinniped.dev/type label of the Secrets which hold pushed
+	// authorization requests.
+	TypeLabelValue = "par"
+
+	// RequestURIPrefix is the prefix of the request_uri values which refer to pushed authorization requests.
+	RequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+	// RequestLifetime is how long a pushed authorization request may be used. It only needs to be long enough for
+	// the browser to be opened, but that may take a while when the user has to copy the URL to another machine.
+	RequestLifetime = 10 * time.Minute
+
+	// Public clients cannot authenticate, so anyone may push requests for them. Their requests are rate limited
+	// per client IP address to bound the number of Secrets which can be created in the namespace of the Supervisor
+	// this way, without letting one client use up the requests of everyone else.
+	publicClientRequestsPerSecond = 5
+	publicClientRequestsBurst     = 50
+
+	// maxLimitedClientIPs is how many client IP addresses are rate limited at the same time, to bound the memory
+	// which the limits use.
+	maxLimitedClientIPs = 10000
+
+	// requestURIParamName is the name of the authorize parameter which refers to a pushed authorization request.
+	requestURIParamName = "request_uri"
+
+	requestStorageVersion = "1"
+)
+
+// errTooManyRequests is the error of requests by public clients when too many requests were pushed recently.
+var errTooManyRequests = &fosite.RFC6749Error{ //nolint:gochecknoglobals
+	ErrorField:       "temporarily_unavailable",
+	DescriptionField: "The authorization server is temporarily unable to handle the request.",
+	HintField:        "Too many authorization requests were pushed recently. Try again later.",
+	CodeField:        http.StatusTooManyRequests,
+}
+
+type storedRequest struct {
+	ClientID string     `json:"clientID"`
+	Params   url.Values `json:"params"`
+}
+
+// Storage stores pushed authorization requests in Secrets, which are garbage collected after RequestLifetime.
+type Storage struct {
+	storage *crud.HandleStorage
+	clock   func() time.Time
+
+	// publicClientRequests limits the requests of public clients per client IP address, which is shared by all
+	// FederationDomains.
+	publicClientRequests *clientIPLimiter
+}
+
+// NewStorage returns a Storage. The random request_uri values are read from rand.
+func NewStorage(secrets corev1client.SecretInterface, clock func() time.Time, rand io.Reader) *Storage {
+	return &Storage{
+		storage:              crud.NewHandleStorage(TypeLabelValue, requestStorageVersion, secrets, clock, rand, RequestLifetime),
+		clock:                clock,
+		publicClientRequests: newClientIPLimiter(publicClientRequestsPerSecond, publicClientRequestsBurst, maxLimitedClientIPs),
+	}
+}
+
+// Create stores the parameters of an authorization request of the client, and returns the request_uri which
+// refers to them.
+func (s *Storage) Create(ctx context.Context, clientID string, params url.Values) (string, error) {
+	handle, err := s.storage.Create(ctx, &storedRequest{ClientID: clientID, Params: params})
+	if err != nil {
+		return "", err
+	}
+	return RequestURIPrefix + handle, nil
+}
+
+// Consume returns the parameters of the authorization request of the client which the request_uri refers to, and
+// deletes it so that it cannot be used again. It returns fosite.ErrInvalidRequestURI when the request_uri does not
+// refer to an unexpired request of the client.
+func (s *Storage) Consume(ctx context.Context, clientID string, requestURI string) (url.Values, error) {
+	if !strings.HasPrefix(requestURI, RequestURIPrefix) {
+		return nil, fosite.ErrInvalidRequestURI.WithHint("The request_uri was not returned by the pushed authorization request endpoint.")
+	}
+	handle := strings.TrimPrefix(requestURI, RequestURIPrefix)
+
+	var stored storedRequest
+	if err := s.storage.Get(ctx, handle, &stored); err != nil {
+		return nil, consumeError(err)
+	}
+
+	// Requests of other clients are left alone, so that a request_uri which was seen by someone else cannot be
+	// spent before the client which pushed it uses it.
+	if stored.ClientID != clientID {
+		return nil, fosite.ErrInvalidRequestURI.WithHint("The request_uri was pushed by a different client.")
+	}
+
+	// A request may only be used once. When two authorize requests race to use it, only one can delete it.
+	if err := s.storage.Delete(ctx, handle); err != nil {
+		return nil, consumeError(err)
+	}
+	return stored.Params, nil
+}
+
+func consumeError(err error) error {
+	if errors.Is(err, crud.ErrHandleNotFound) {
+		return fosite.ErrInvalidRequestURI.WithHint("The request_uri is unknown, expired, or was already used.")
+	}
+	return fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+}
+
+// ResolveAuthorizeRequest replaces the parameters of an authorize request which refers to a pushed authorization
+// request by the parameters which were pushed. Authorize requests without a request_uri are not changed.
+func (s *Storage) ResolveAuthorizeRequest(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return fosite.ErrInvalidRequest.WithHint("Unable to parse HTTP body, make sure to send a properly formatted form request body.").WithWrap(err).WithDebug(err.Error())
+	}
+	requestURI := r.Form.Get(requestURIParamName)
+	if requestURI == "" {
+		return nil
+	}
+	params, err := s.Consume(r.Context(), r.Form.Get("client_id"), requestURI)
+	if err != nil {
+		return err
+	}
+	// Only the pushed parameters may be used, as required by RFC 9126.
+	r.Form = params
+	r.PostForm = url.Values{}
+	r.URL.RawQuery = params.Encode()
+	return nil
+}
+
+type pushedAuthorizationResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// NewHandler returns an http.Handler that serves the pushed authorization request endpoint. Confidential clients must
+// authenticate in the same way as at the token endpoint, and the requests of public clients are rate limited. The
+// pushed parameters are validated by oauthHelper in the same way as the parameters of authorize requests, before
+// they are stored.
+func NewHandler(oauthHelper fosite.OAuth2Provider, storage *Storage) http.Handler {
+	// Client authentication is not part of fosite.OAuth2Provider, but the Supervisor's provider is a fosite.Fosite.
+	clientAuthenticator := oauthHelper.(*fosite.Fosite)
+	return securityheader.Wrap(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try POST)", r.Method)
+		}
+		if err := r.ParseForm(); err != nil {
+			return httperr.Wrap(http.StatusBadRequest, "could not parse request body", err)
+		}
+
+		// The pushed parameters must be in the body, and a pushed request may not refer to another one.
+		r.Form = r.PostForm
+		if r.PostForm.Get(requestURIParamName) != "" {
+			return writeError(w, oauthHelper, fosite.ErrInvalidRequest.WithHint("The request_uri parameter may not be pushed."))
+		}
+		client, err := clientAuthenticator.AuthenticateClient(r.Context(), r, r.PostForm)
+		if err != nil {
+			return writeError(w, oauthHelper, err)
+		}
+		if client.IsPublic() && !storage.publicClientRequests.allow(r, storage.clock()) {
+			return writeError(w, oauthHelper, errTooManyRequests)
+		}
+
+		authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), r)
+		if err != nil {
+			return writeError(w, oauthHelper, err)
+		}
+		if authorizeRequester.GetClient().GetID() != client.GetID() {
+			return writeError(w, oauthHelper, fosite.ErrInvalidRequest.WithHint("The client_id parameter does not match the authenticated client."))
+		}
+
+		requestURI, err := storage.Create(r.Context(), authorizeRequester.GetClient().GetID(), r.PostForm)
+		if err != nil {
+			plog.WarningErr("could not store pushed authorization request", err)
+			return writeError(w, oauthHelper, fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		w.WriteHeader(http.StatusCreated)
+		return json.NewEncoder(w).Encode(&pushedAuthorizationResponse{
+			RequestURI: requestURI,
+			ExpiresIn:  int(RequestLifetime.Seconds()),
+		})
+	}))
+}
+
+func writeError(w http.ResponseWriter, oauthHelper fosite.OAuth2Provider, err error) error {
+	plog.Info("pushed authorization request error", oidc.FositeErrorForLog(err)...)
+	oauthHelper.WriteAccessError(w, nil, err)
+	return nil
+}
+
+// clientIPLimiter rate limits requests per client IP address. Like the limits of failed logins, it uses the address of
+// the peer of the connection to the Supervisor, and IPv6 addresses are limited per /64 network, since a single client
+// usually has a whole /64 network.
+type clientIPLimiter struct {
+	limit  rate.Limit
+	burst  int
+	maxIPs int
+	// idle is how long a client IP address must be idle for its whole burst to be allowed again, after which its
+	// limit would not reject anything anymore, so it can be forgotten.
+	idle time.Duration
+
+	mutex    sync.Mutex
+	limiters map[string]*clientIPLimit
+}
+
+type clientIPLimit struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientIPLimiter(limit rate.Limit, burst int, maxIPs int) *clientIPLimiter {
+	l := &clientIPLimiter{
+		limit:    limit,
+		burst:    burst,
+		maxIPs:   maxIPs,
+		limiters: make(map[string]*clientIPLimit),
+	}
+	if limit > 0 {
+		l.idle = time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+	}
+	return l
+}
+
+// allow returns whether the client IP address of the request may make another request now.
+func (l *clientIPLimiter) allow(r *http.Request, now time.Time) bool {
+	key := clientIPKey(r)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limit, ok := l.limiters[key]
+	if !ok {
+		if len(l.limiters) >= l.maxIPs {
+			l.forgetIdle(now)
+		}
+		// When there are still too many client IP addresses, new ones are rejected, rather than forgetting the limits
+		// of the ones which are busy.
+		if len(l.limiters) >= l.maxIPs {
+			return false
+		}
+		limit = &clientIPLimit{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = limit
+	}
+	limit.lastSeen = now
+	return limit.limiter.AllowN(now, 1)
+}
+
+// forgetIdle forgets the client IP addresses which were idle for long enough.
+func (l *clientIPLimiter) forgetIdle(now time.Time) {
+	if l.limit <= 0 {
+		return
+	}
+	for key, limit := range l.limiters {
+		if now.Sub(limit.lastSeen) >= l.idle {
+			delete(l.limiters, key)
+		}
+	}
+}
+
+func clientIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
@@ -0,0 +1,268 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package par
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/jwks"
+)
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	params := url.Values{"scope": {"openid"}, "state": {"some-state"}}
+	storage := NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), time.Now, rand.Reader)
+	requireInvalidRequestURI := func(t *testing.T, err error, wantHint string) {
+		t.Helper()
+		require.ErrorIs(t, err, fosite.ErrInvalidRequestURI)
+		require.Equal(t, wantHint, fosite.ErrorToRFC6749Error(err).HintField)
+	}
+
+	requestURI, err := storage.Create(ctx, "some-client", params)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(requestURI, RequestURIPrefix))
+
+	_, err = storage.Consume(ctx, "some-client", strings.TrimPrefix(requestURI, RequestURIPrefix))
+	requireInvalidRequestURI(t, err, "The request_uri was not returned by the pushed authorization request endpoint.")
+	_, err = storage.Consume(ctx, "some-client", RequestURIPrefix+"some-unknown-request")
+	requireInvalidRequestURI(t, err, "The request_uri is unknown, expired, or was already used.")
+
+	// A request pushed by another client is rejected, but can still be used by the client which pushed it.
+	_, err = storage.Consume(ctx, "other-client", requestURI)
+	requireInvalidRequestURI(t, err, "The request_uri was pushed by a different client.")
+	got, err := storage.Consume(ctx, "some-client", requestURI)
+	require.NoError(t, err)
+	require.Equal(t, params, got)
+
+	// A request can only be used once.
+	_, err = storage.Consume(ctx, "some-client", requestURI)
+	requireInvalidRequestURI(t, err, "The request_uri is unknown, expired, or was already used.")
+}
+
+func TestHandler(t *testing.T) {
+	const (
+		issuer                 = "https://some-issuer.com"
+		confidentialClientID   = "client.oauth.pinniped.dev-some-client"
+		confidentialClientPass = "some-client-secret"
+	)
+	secretHash, err := bcrypt.GenerateFromPassword([]byte(confidentialClientPass), bcrypt.MinCost)
+	require.NoError(t, err)
+	clientSecrets := fake.NewSimpleClientset(clientregistry.RegisteredClientSecret(
+		confidentialClientID, secretHash, []string{"http://127.0.0.1/callback"}, []string{"authorization_code"}, time.Now().Add(time.Hour),
+	)).CoreV1().Secrets("")
+	hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+	oauthHelper := oidc.FositeOauth2Helper(oidc.NewNullStorage(clientSecrets), issuer, hmacSecretFunc, jwks.NewDynamicJWKSProvider(), oidc.DefaultOIDCTimeoutsConfiguration(), nil)
+
+	happyParams := url.Values{
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"client_id":             {"pinniped-cli"},
+		"state":                 {"some-state-value-with-enough-bytes-to-exceed-min-allowed"},
+		"nonce":                 {"some-nonce-value-with-enough-bytes-to-exceed-min-allowed"},
+		"code_challenge":        {"ks-IUeFcCqAPSXvzSQ-bWgMPCyfjZR0pJR7BJpEEUBo"},
+		"code_challenge_method": {"S256"},
+		"redirect_uri":          {"http://127.0.0.1/callback"},
+	}
+	modifiedParams := func(key, value string) url.Values {
+		params := url.Values{}
+		for k, v := range happyParams {
+			params[k] = v
+		}
+		params.Set(key, value)
+		return params
+	}
+
+	tests := []struct {
+		name                          string
+		method                        string
+		body                          url.Values
+		basicAuthUsername             string
+		basicAuthPassword             string
+		publicClientRequestsExhausted bool
+		wantStatus                    int
+		wantContentType               string
+		wantBodyJSON                  string
+		wantBodyString                string
+	}{
+		{
+			name:            "happy path",
+			method:          http.MethodPost,
+			body:            happyParams,
+			wantStatus:      http.StatusCreated,
+			wantContentType: "application/json",
+		},
+		{
+			name:                          "happy path for a confidential client, which is not rate limited",
+			method:                        http.MethodPost,
+			body:                          modifiedParams("client_id", confidentialClientID),
+			basicAuthUsername:             confidentialClientID,
+			basicAuthPassword:             confidentialClientPass,
+			publicClientRequestsExhausted: true,
+			wantStatus:                    http.StatusCreated,
+			wantContentType:               "application/json",
+		},
+		{
+			name:                          "too many requests by public clients",
+			method:                        http.MethodPost,
+			body:                          happyParams,
+			publicClientRequestsExhausted: true,
+			wantStatus:                    http.StatusTooManyRequests,
+			wantContentType:               "application/json;charset=UTF-8",
+			wantBodyJSON:                  `{"error":"temporarily_unavailable","error_description":"The authorization server is temporarily unable to handle the request. Too many authorization requests were pushed recently. Try again later."}`,
+		},
+		{
+			name:            "confidential client without client authentication",
+			method:          http.MethodPost,
+			body:            modifiedParams("client_id", confidentialClientID),
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_client","error_description":"Client authentication failed (e.g., unknown client, no client authentication included, or unsupported authentication method)."}`,
+		},
+		{
+			name:              "confidential client with the wrong client secret",
+			method:            http.MethodPost,
+			body:              modifiedParams("client_id", confidentialClientID),
+			basicAuthUsername: confidentialClientID,
+			basicAuthPassword: "wrong-client-secret",
+			wantStatus:        http.StatusUnauthorized,
+			wantContentType:   "application/json;charset=UTF-8",
+			wantBodyJSON:      `{"error":"invalid_client","error_description":"Client authentication failed (e.g., unknown client, no client authentication included, or unsupported authentication method)."}`,
+		},
+		{
+			name:              "client_id does not match the authenticated client",
+			method:            http.MethodPost,
+			body:              happyParams,
+			basicAuthUsername: confidentialClientID,
+			basicAuthPassword: confidentialClientPass,
+			wantStatus:        http.StatusBadRequest,
+			wantContentType:   "application/json;charset=UTF-8",
+			wantBodyJSON:      `{"error":"invalid_request","error_description":"The request is missing a required parameter, includes an invalid parameter value, includes a parameter more than once, or is otherwise malformed. The client_id parameter does not match the authenticated client."}`,
+		},
+		{
+			name:            "wrong method",
+			method:          http.MethodGet,
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Method Not Allowed: GET (try POST)\n",
+		},
+		{
+			name:            "unknown client",
+			method:          http.MethodPost,
+			body:            modifiedParams("client_id", "some-other-client"),
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_client","error_description":"Client authentication failed (e.g., unknown client, no client authentication included, or unsupported authentication method)."}`,
+		},
+		{
+			name:            "redirect_uri is not registered",
+			method:          http.MethodPost,
+			body:            modifiedParams("redirect_uri", "http://127.0.0.1/does-not-match"),
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_request","error_description":"The request is missing a required parameter, includes an invalid parameter value, includes a parameter more than once, or is otherwise malformed. The 'redirect_uri' parameter does not match any of the OAuth 2.0 Client's pre-registered redirect urls."}`,
+		},
+		{
+			name:            "request_uri is pushed",
+			method:          http.MethodPost,
+			body:            modifiedParams("request_uri", RequestURIPrefix+"some-request"),
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_request","error_description":"The request is missing a required parameter, includes an invalid parameter value, includes a parameter more than once, or is otherwise malformed. The request_uri parameter may not be pushed."}`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), time.Now, rand.Reader)
+			if tt.publicClientRequestsExhausted {
+				storage.publicClientRequests = newClientIPLimiter(0, 0, maxLimitedClientIPs)
+			}
+			req := httptest.NewRequest(tt.method, "/some/path", strings.NewReader(tt.body.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.basicAuthUsername != "" {
+				req.SetBasicAuth(tt.basicAuthUsername, tt.basicAuthPassword)
+			}
+			rsp := httptest.NewRecorder()
+			NewHandler(oauthHelper, storage).ServeHTTP(rsp, req)
+
+			require.Equal(t, tt.wantStatus, rsp.Code)
+			require.Equal(t, tt.wantContentType, rsp.Header().Get("Content-Type"))
+			switch {
+			case tt.wantBodyJSON != "":
+				require.JSONEq(t, tt.wantBodyJSON, rsp.Body.String())
+			case tt.wantBodyString != "":
+				require.Equal(t, tt.wantBodyString, rsp.Body.String())
+			default:
+				require.Equal(t, "no-cache, no-store", rsp.Header().Get("Cache-Control"))
+				var response pushedAuthorizationResponse
+				require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &response))
+				require.Equal(t, int(RequestLifetime.Seconds()), response.ExpiresIn)
+
+				// The pushed parameters can be used by the same client.
+				params, err := storage.Consume(context.Background(), tt.body.Get("client_id"), response.RequestURI)
+				require.NoError(t, err)
+				require.Equal(t, tt.body, params)
+			}
+		})
+	}
+}
+
+func TestClientIPLimiter(t *testing.T) {
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	requestFrom := func(remoteAddr string) *http.Request {
+		return &http.Request{RemoteAddr: remoteAddr}
+	}
+
+	t.Run("each client IP address has its own limit", func(t *testing.T) {
+		limiter := newClientIPLimiter(1, 2, 10)
+		require.True(t, limiter.allow(requestFrom("10.1.2.3:1234"), now))
+		require.True(t, limiter.allow(requestFrom("10.1.2.3:5678"), now))
+		require.False(t, limiter.allow(requestFrom("10.1.2.3:1234"), now))
+
+		// Another client is not affected by the requests of the first one.
+		require.True(t, limiter.allow(requestFrom("10.4.5.6:1234"), now))
+
+		// The first client may make another request once its limit allows it.
+		require.True(t, limiter.allow(requestFrom("10.1.2.3:1234"), now.Add(time.Second)))
+	})
+
+	t.Run("IPv6 addresses are limited per /64 network", func(t *testing.T) {
+		limiter := newClientIPLimiter(1, 1, 10)
+		require.True(t, limiter.allow(requestFrom("[fd00::1]:1234"), now))
+		require.False(t, limiter.allow(requestFrom("[fd00::2]:1234"), now))
+		require.True(t, limiter.allow(requestFrom("[fd00:0:0:1::1]:1234"), now))
+	})
+
+	t.Run("idle client IP addresses are forgotten when there are too many", func(t *testing.T) {
+		limiter := newClientIPLimiter(1, 2, 2)
+		require.True(t, limiter.allow(requestFrom("10.0.0.1:1234"), now))
+		require.True(t, limiter.allow(requestFrom("10.0.0.2:1234"), now))
+
+		// While the known client IP addresses are busy, new ones are rejected.
+		require.False(t, limiter.allow(requestFrom("10.0.0.3:1234"), now.Add(time.Second)))
+		require.Len(t, limiter.limiters, 2)
+
+		// Once they were idle for long enough to be allowed their whole burst again, they are forgotten.
+		require.True(t, limiter.allow(requestFrom("10.0.0.2:1234"), now.Add(time.Second)))
+		require.True(t, limiter.allow(requestFrom("10.0.0.3:1234"), now.Add(2*time.Second)))
+		require.Len(t, limiter.limiters, 2)
+		require.Contains(t, limiter.limiters, "10.0.0.2")
+		require.Contains(t, limiter.limiters, "10.0.0.3")
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package pendinglogin stores logins with upstreams which are not finished yet, because the user still needs to
+// provide a TOTP code or to consent to the client. They hold the downstream identity of the user and their upstream
+// tokens, so they are kept on the Supervisor, and only a random handle for them is sent to the browser.
+package pendinglogin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/oidc/csrftoken"
+	"go.pinniped.dev/internal/oidc/downstreamsession"
+	"go.pinniped.dev/internal/psession"
+)
+
+const (
+	// TypeLabelValue is the value of the storage.pinniped.dev/type label of the Secrets which hold pending logins.
+	TypeLabelValue = "pendinglogin"
+
+	// Lifetime is how long a user has to finish their login. It is long enough to allow the user to set up their
+	// authenticator app when they enroll.
+	Lifetime = 10 * time.Minute
+
+	// KindTOTP is a login which still needs a TOTP code, and KindConsent is a login which still needs the consent of
+	// the user. A handle of one kind cannot be used to finish a login of the other.
+	KindTOTP    Kind = "totp"
+	KindConsent Kind = "consent"
+
+	ErrNotFound = constable.Error("pending login is unknown, expired, or was already used")
+
+	ErrInvalidPendingLoginData = constable.Error("pending login data is not valid")
+
+	pendingLoginStorageVersion = "1"
+)
+
+// Kind is the step which is missing to finish a pending login.
+type Kind string
+
+// Login is a login with an upstream which is not finished yet.
+type Login struct {
+	Kind Kind `json:"kind"`
+
+	// CSRFToken and UpstreamName bind the pending login to the state param of the login.
+	CSRFToken    csrftoken.CSRFToken `json:"csrfToken"`
+	UpstreamName string              `json:"upstreamName"`
+
+	// LoginUsername is the username which the user typed into the login page, for logins which need a TOTP code.
+	LoginUsername string `json:"loginUsername,omitempty"`
+
+	// AuthParams and RequestedAt are the rest of the state param, for logins which need consent, so that the
+	// downstream authorize request can be finished once the user consented.
+	AuthParams  string `json:"authParams,omitempty"`
+	RequestedAt int64  `json:"requestedAt,omitempty"`
+
+	Subject           string                      `json:"subject"`
+	Username          string                      `json:"username"`
+	Groups            []string                    `json:"groups"`
+	CustomSessionData *psession.CustomSessionData `json:"customSessionData"`
+	// Authentication is omitted when the upstream authenticated the user just now.
+	Authentication *downstreamsession.Authentication `json:"authentication,omitempty"`
+}
+
+// Storage stores pending logins in Secrets, which are garbage collected after Lifetime.
+type Storage struct {
+	storage *crud.HandleStorage
+}
+
+// NewStorage returns a Storage. The random handles are read from rand.
+func NewStorage(secrets corev1client.SecretInterface, clock func() time.Time, rand io.Reader) *Storage {
+	return &Storage{storage: crud.NewHandleStorage(TypeLabelValue, pendingLoginStorageVersion, secrets, clock, rand, Lifetime)}
+}
+
+// Create stores the pending login, which expires after Lifetime, and returns the handle which refers to it.
+func (s *Storage) Create(ctx context.Context, login *Login) (string, error) {
+	return s.storage.Create(ctx, login)
+}
+
+// Get returns the pending login which the handle refers to. It returns ErrNotFound when the handle does not refer to
+// an unexpired pending login of the kind.
+func (s *Storage) Get(ctx context.Context, kind Kind, handle string) (*Login, error) {
+	var login Login
+	if err := s.storage.Get(ctx, handle, &login); err != nil {
+		if errors.Is(err, crud.ErrHandleNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if login.Kind != kind {
+		return nil, ErrNotFound
+	}
+	return &login, nil
+}
+
+// Delete deletes the pending login which the handle refers to, so that it cannot be used again. It returns
+// ErrNotFound when it was already deleted, for example by another request which finished the same login.
+func (s *Storage) Delete(ctx context.Context, handle string) error {
+	if err := s.storage.Delete(ctx, handle); err != nil {
+		if errors.Is(err, crud.ErrHandleNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// ReadFromSecret reads the pending login of a Secret, so that the garbage collector can revoke its upstream tokens.
+func ReadFromSecret(secret *corev1.Secret) (*Login, error) {
+	var login Login
+	if err := crud.HandleDataFromSecret(TypeLabelValue, pendingLoginStorageVersion, secret, &login); err != nil {
+		return nil, err
+	}
+	if login.CustomSessionData == nil {
+		return nil, fmt.Errorf("%w: custom session data is missing", ErrInvalidPendingLoginData)
+	}
+	return &login, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package pendinglogin
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/psession"
+)
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	login := &Login{
+		Kind:          KindTOTP,
+		CSRFToken:     "some-csrf-token",
+		UpstreamName:  "some-upstream",
+		LoginUsername: "some-login-username",
+		Subject:       "some-subject",
+		Username:      "some-username",
+		Groups:        []string{"some-group"},
+		CustomSessionData: &psession.CustomSessionData{
+			ProviderName: "some-upstream",
+			ProviderType: psession.ProviderTypeLDAP,
+			LDAP:         &psession.LDAPSessionData{UserDN: "some-dn"},
+		},
+	}
+	kubeClient := fake.NewSimpleClientset()
+	storage := NewStorage(kubeClient.CoreV1().Secrets("some-namespace"), time.Now, rand.Reader)
+
+	handle, err := storage.Create(ctx, login)
+	require.NoError(t, err)
+
+	// A pending login can only be used to finish a login of its kind, so that the TOTP code cannot be skipped by
+	// sending the handle of a pending TOTP login to the consent page.
+	got, err := storage.Get(ctx, KindTOTP, handle)
+	require.NoError(t, err)
+	require.Equal(t, login, got)
+	_, err = storage.Get(ctx, KindConsent, handle)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// The garbage collector can read the upstream tokens of the pending login.
+	secrets, err := kubeClient.CoreV1().Secrets("some-namespace").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, secrets.Items, 1)
+	require.Equal(t, TypeLabelValue, secrets.Items[0].Labels["storage.pinniped.dev/type"])
+	fromSecret, err := ReadFromSecret(&secrets.Items[0])
+	require.NoError(t, err)
+	require.Equal(t, login, fromSecret)
+
+	require.NoError(t, storage.Delete(ctx, handle))
+	_, err = storage.Get(ctx, KindTOTP, handle)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, storage.Delete(ctx, handle), ErrNotFound)
+
+	// Pending logins without custom session data cannot be garbage collected.
+	_, err = storage.Create(ctx, &Login{Kind: KindTOTP})
+	require.NoError(t, err)
+	secrets, err = kubeClient.CoreV1().Secrets("some-namespace").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	_, err = ReadFromSecret(&secrets.Items[0])
+	require.ErrorIs(t, err, ErrInvalidPendingLoginData)
+}
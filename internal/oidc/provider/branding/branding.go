@@ -0,0 +1,206 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package branding customizes the HTML pages which the Supervisor serves for a FederationDomain with a logo, colors,
+// a display name, and optional template overrides from a ConfigMap.
+package branding
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// The keys of the ConfigMap which configures the branding of a FederationDomain.
+	displayNameKey     = "displayName"
+	logoKey            = "logo"
+	primaryColorKey    = "primaryColor"
+	backgroundColorKey = "backgroundColor"
+
+	// templateOverrideKeySuffix is the suffix of the keys whose values replace the template of the page of the
+	// same name, e.g. "login.gohtml".
+	templateOverrideKeySuffix = ".gohtml"
+
+	// defaultDisplayName is the display name of FederationDomains without branding.
+	defaultDisplayName = "Pinniped"
+
+	// maxLogoSize limits the size of the logo, which is inlined into every page as a data URI.
+	maxLogoSize = 64 * 1024
+)
+
+//nolint:gochecknoglobals
+var (
+	colorRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+	// SVG logos are not allowed, since http.DetectContentType cannot recognize them.
+	allowedLogoContentTypes = map[string]bool{
+		"image/png":  true,
+		"image/jpeg": true,
+		"image/gif":  true,
+		"image/webp": true,
+	}
+)
+
+// Branding is the validated branding of a FederationDomain. A nil Branding is the default branding.
+type Branding struct {
+	// DisplayName is shown to users instead of "Pinniped", e.g. in the title of the pages.
+	DisplayName string
+	// Logo is the data URI of the logo, or empty when there is no logo.
+	Logo template.URL
+	// PrimaryColor is the CSS color of headings and links, or empty for the default color.
+	PrimaryColor string
+	// BackgroundColor is the CSS color of the background of the pages, or empty for the default color.
+	BackgroundColor string
+	// TemplateOverrides maps the names of pages, e.g. "login", to Go templates which replace their default templates.
+	TemplateOverrides map[string]string
+}
+
+// FromConfigMap returns the Branding which is configured by the ConfigMap. It returns an error when any value of
+// the ConfigMap is invalid, or when it has an unknown key. It does not validate the template overrides, which
+// happens when they are used to build a Page.
+func FromConfigMap(configMap *corev1.ConfigMap) (*Branding, error) {
+	b := &Branding{}
+
+	keys := make([]string, 0, len(configMap.Data)+len(configMap.BinaryData))
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	for key := range configMap.BinaryData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := configMap.Data[key]
+		switch {
+		case key == displayNameKey:
+			b.DisplayName = strings.TrimSpace(value)
+		case key == logoKey:
+			logo, err := logoDataURI(configMap)
+			if err != nil {
+				return nil, err
+			}
+			b.Logo = logo
+		case key == primaryColorKey, key == backgroundColorKey:
+			color := strings.TrimSpace(value)
+			if !colorRegexp.MatchString(color) {
+				return nil, fmt.Errorf("%s must be a hex color such as #1b3951: %q", key, color)
+			}
+			if key == primaryColorKey {
+				b.PrimaryColor = color
+			} else {
+				b.BackgroundColor = color
+			}
+		case strings.HasSuffix(key, templateOverrideKeySuffix):
+			if b.TemplateOverrides == nil {
+				b.TemplateOverrides = map[string]string{}
+			}
+			b.TemplateOverrides[strings.TrimSuffix(key, templateOverrideKeySuffix)] = value
+		default:
+			return nil, fmt.Errorf("unknown key %s", key)
+		}
+	}
+
+	return b, nil
+}
+
+// logoDataURI returns the data URI of the logo, which may be binary data or base64 encoded text data.
+func logoDataURI(configMap *corev1.ConfigMap) (template.URL, error) {
+	logo, ok := configMap.BinaryData[logoKey]
+	if !ok {
+		var err error
+		logo, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(strings.TrimSpace(configMap.Data[logoKey]))))
+		if err != nil {
+			return "", fmt.Errorf("%s must be binary data or base64 encoded: %w", logoKey, err)
+		}
+	}
+	if len(logo) > maxLogoSize {
+		return "", fmt.Errorf("%s must not be larger than %d bytes", logoKey, maxLogoSize)
+	}
+	contentType := http.DetectContentType(logo)
+	if !allowedLogoContentTypes[contentType] {
+		return "", fmt.Errorf("%s must be a PNG, JPEG, GIF or WebP image, but it is %s", logoKey, contentType)
+	}
+	//nolint:gosec // The content type was checked above, and images in img elements cannot run scripts.
+	return template.URL("data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(logo)), nil
+}
+
+// css returns the CSS which applies the branding to a page, which is added to the CSS of the page.
+func (b *Branding) css() string {
+	if b == nil {
+		return ""
+	}
+	var css bytes.Buffer
+	if b.BackgroundColor != "" {
+		css.WriteString("body{background-color:" + b.BackgroundColor + "}")
+	}
+	if b.PrimaryColor != "" {
+		css.WriteString("h1,a{color:" + b.PrimaryColor + "}")
+	}
+	if b.Logo != "" {
+		css.WriteString(".logo{position:absolute;top:24px;left:24px;max-width:200px;max-height:48px}")
+	}
+	return css.String()
+}
+
+func (b *Branding) displayName() string {
+	if b == nil || b.DisplayName == "" {
+		return defaultDisplayName
+	}
+	return b.DisplayName
+}
+
+func (b *Branding) logo() template.URL {
+	if b == nil {
+		return ""
+	}
+	return b.Logo
+}
+
+func (b *Branding) templateOverride(name string) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	override, ok := b.TemplateOverrides[name]
+	return override, ok
+}
+
+// ValidateTemplateOverrides returns an error when the branding overrides the template of a page which is not one of
+// the named pages.
+func (b *Branding) ValidateTemplateOverrides(pageNames ...string) error {
+	if b == nil {
+		return nil
+	}
+	known := make(map[string]bool, len(pageNames))
+	for _, name := range pageNames {
+		known[name] = true
+	}
+	names := make([]string, 0, len(b.TemplateOverrides))
+	for name := range b.TemplateOverrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("%s%s does not override any page, the pages are %s",
+				name, templateOverrideKeySuffix, strings.Join(pageNames, ", "))
+		}
+	}
+	return nil
+}
+
+// CSPHash returns the Content-Security-Policy source which allows an inline style or script.
+func CSPHash(s string) string {
+	hashBytes := sha256.Sum256([]byte(s))
+	return "sha256-" + base64.StdEncoding.EncodeToString(hashBytes[:])
+}
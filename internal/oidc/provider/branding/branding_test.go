@@ -0,0 +1,127 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package branding
+
+import (
+	"encoding/base64"
+	"html/template"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testPNG = "\x89PNG\r\n\x1a\n some png data"
+
+func TestFromConfigMap(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         map[string]string
+		binaryData   map[string][]byte
+		wantBranding *Branding
+		wantErr      string
+	}{
+		{
+			name:         "empty",
+			wantBranding: &Branding{},
+		},
+		{
+			name: "all keys",
+			data: map[string]string{
+				"displayName":     "  ACME Corp  ",
+				"primaryColor":    "#1b3951",
+				"backgroundColor": "#FFF",
+				"login.gohtml":    "<p>{{ displayName }}</p>",
+			},
+			binaryData: map[string][]byte{"logo": []byte(testPNG)},
+			wantBranding: &Branding{
+				DisplayName:       "ACME Corp",
+				Logo:              template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte(testPNG))),
+				PrimaryColor:      "#1b3951",
+				BackgroundColor:   "#FFF",
+				TemplateOverrides: map[string]string{"login": "<p>{{ displayName }}</p>"},
+			},
+		},
+		{
+			name:         "base64 encoded logo",
+			data:         map[string]string{"logo": base64.StdEncoding.EncodeToString([]byte(testPNG)) + "\n"},
+			wantBranding: &Branding{Logo: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte(testPNG)))},
+		},
+		{
+			name:    "logo is not base64 encoded",
+			data:    map[string]string{"logo": "not base64!"},
+			wantErr: "logo must be binary data or base64 encoded: illegal base64 data at input byte 3",
+		},
+		{
+			name:       "logo is not an allowed image",
+			binaryData: map[string][]byte{"logo": []byte("<svg></svg>")},
+			wantErr:    "logo must be a PNG, JPEG, GIF or WebP image, but it is text/plain; charset=utf-8",
+		},
+		{
+			name:       "logo is too large",
+			binaryData: map[string][]byte{"logo": []byte(testPNG + strings.Repeat("x", maxLogoSize))},
+			wantErr:    "logo must not be larger than 65536 bytes",
+		},
+		{
+			name:    "invalid color",
+			data:    map[string]string{"backgroundColor": "red"},
+			wantErr: `backgroundColor must be a hex color such as #1b3951: "red"`,
+		},
+		{
+			name:    "color with CSS injection",
+			data:    map[string]string{"primaryColor": "#fff}body{display:none"},
+			wantErr: `primaryColor must be a hex color such as #1b3951: "#fff}body{display:none"`,
+		},
+		{
+			name:    "unknown key",
+			data:    map[string]string{"displayName": "ACME Corp", "favicon": "something"},
+			wantErr: "unknown key favicon",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			b, err := FromConfigMap(&corev1.ConfigMap{Data: test.data, BinaryData: test.binaryData})
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Nil(t, b)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantBranding, b)
+		})
+	}
+}
+
+func TestBrandingDefaults(t *testing.T) {
+	var b *Branding
+	require.Equal(t, "", b.css())
+	require.Equal(t, "Pinniped", b.displayName())
+	require.Equal(t, "", string(b.logo()))
+	_, overridden := b.templateOverride("login")
+	require.False(t, overridden)
+	require.NoError(t, b.ValidateTemplateOverrides("login"))
+
+	require.Equal(t, "Pinniped", (&Branding{}).displayName())
+}
+
+func TestCSS(t *testing.T) {
+	require.Equal(t,
+		"body{background-color:#fff}h1,a{color:#1b3951}.logo{position:absolute;top:24px;left:24px;max-width:200px;max-height:48px}",
+		(&Branding{BackgroundColor: "#fff", PrimaryColor: "#1b3951", Logo: "data:image/png;base64,abc"}).css(),
+	)
+	require.Equal(t, "h1,a{color:#1b3951}", (&Branding{PrimaryColor: "#1b3951"}).css())
+}
+
+func TestValidateTemplateOverrides(t *testing.T) {
+	b := &Branding{TemplateOverrides: map[string]string{"login": "", "logn": "", "consnet": ""}}
+	require.EqualError(t, b.ValidateTemplateOverrides("login", "consent"),
+		"consnet.gohtml does not override any page, the pages are login, consent")
+	require.NoError(t, (&Branding{TemplateOverrides: map[string]string{"login": ""}}).ValidateTemplateOverrides("login", "consent"))
+}
+
+func TestCSPHash(t *testing.T) {
+	require.Equal(t, "sha256-RFWPLDbv2BY+rCkDzsE+0fr8ylGr2R2faWMhq4lfEQc=", CSPHash("doSomething();"))
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package branding
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"strings"
+)
+
+// PageSource is the default template and the assets of an HTML page, which is rendered with the branding of a
+// FederationDomain.
+type PageSource struct {
+	// Name is the name of the page, e.g. "login". The template of the page is overridden by the key Name+".gohtml"
+	// of the branding ConfigMap.
+	Name string
+	// HTMLTemplate is the default Go template of the page.
+	HTMLTemplate string
+	// MinifiedCSS and MinifiedJS are the inline style and script of the page. MinifiedJS may be empty.
+	MinifiedCSS string
+	MinifiedJS  string
+	// ExtraCSPDirectives are added to the Content-Security-Policy of the page, e.g. "connect-src *".
+	ExtraCSPDirectives []string
+	// SampleData is executed with template overrides to validate that they only use the data of the page.
+	SampleData interface{}
+}
+
+// Page is an HTML page with the branding of a FederationDomain. Its Content-Security-Policy only allows its own
+// inline style and script, so template overrides cannot add others.
+type Page struct {
+	template *template.Template
+	csp      string
+}
+
+// NewPage returns the page with the branding, which may be nil for the default branding. It returns an error when
+// the branding overrides the template of the page with an invalid template.
+//
+// Templates may call the functions minifiedCSS, minifiedJS, displayName, and logo.
+func NewPage(source PageSource, b *Branding) (*Page, error) {
+	css := source.MinifiedCSS + b.css()
+	js := source.MinifiedJS
+
+	htmlTemplate := source.HTMLTemplate
+	override, overridden := b.templateOverride(source.Name)
+	if overridden {
+		htmlTemplate = override
+	}
+
+	parsed, err := template.New(source.Name + templateOverrideKeySuffix).Funcs(template.FuncMap{
+		"minifiedCSS": func() template.CSS { return template.CSS(css) },
+		"minifiedJS":  func() template.JS { return template.JS(js) }, //nolint:gosec // This is 100% static input, not attacker-controlled.
+		"displayName": b.displayName,
+		"logo":        b.logo,
+	}).Parse(htmlTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("%s%s is not a valid template: %w", source.Name, templateOverrideKeySuffix, err)
+	}
+
+	if overridden {
+		// Catch references to data which the page does not have now, rather than when users see the page.
+		if err := parsed.Execute(ioutil.Discard, source.SampleData); err != nil {
+			return nil, fmt.Errorf("%s%s is not a valid template: %w", source.Name, templateOverrideKeySuffix, err)
+		}
+	}
+
+	directives := []string{`default-src 'none'`}
+	if js != "" {
+		directives = append(directives, `script-src '`+CSPHash(js)+`'`)
+	}
+	directives = append(directives, `style-src '`+CSPHash(css)+`'`)
+	if js != "" || b.logo() != "" {
+		// The script of a page sets its favicon with a data URI, and the logo is inlined as a data URI.
+		directives = append(directives, `img-src data:`)
+	}
+	directives = append(directives, source.ExtraCSPDirectives...)
+	directives = append(directives, `frame-ancestors 'none'`)
+
+	return &Page{template: parsed, csp: strings.Join(directives, "; ")}, nil
+}
+
+// Template returns the html/template.Template for rendering the page.
+func (p *Page) Template() *template.Template { return p.template }
+
+// ContentSecurityPolicy returns the Content-Security-Policy header value to make the Template() operate correctly.
+func (p *Page) ContentSecurityPolicy() string { return p.csp }
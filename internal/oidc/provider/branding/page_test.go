@@ -0,0 +1,100 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package branding
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPageData struct {
+	Message string
+}
+
+func testPageSource() PageSource {
+	return PageSource{
+		Name:               "test",
+		HTMLTemplate:       `<title>{{ displayName }}</title><style>{{ minifiedCSS }}</style><p>{{ .Message }}</p>`,
+		MinifiedCSS:        "p{color:red}",
+		ExtraCSPDirectives: []string{"connect-src *"},
+		SampleData:         &testPageData{},
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   func(*PageSource)
+		branding *Branding
+		wantHTML string
+		wantCSP  string
+		wantErr  string
+	}{
+		{
+			name:     "default branding",
+			wantHTML: `<title>Pinniped</title><style>p{color:red}</style><p>hello</p>`,
+			wantCSP:  `default-src 'none'; style-src '` + CSPHash("p{color:red}") + `'; connect-src *; frame-ancestors 'none'`,
+		},
+		{
+			name: "with script",
+			source: func(s *PageSource) {
+				s.HTMLTemplate += `<script>{{ minifiedJS }}</script>`
+				s.MinifiedJS = "doSomething();"
+			},
+			wantHTML: `<title>Pinniped</title><style>p{color:red}</style><p>hello</p><script>doSomething();</script>`,
+			wantCSP: `default-src 'none'; script-src 'sha256-RFWPLDbv2BY+rCkDzsE+0fr8ylGr2R2faWMhq4lfEQc='; ` +
+				`style-src '` + CSPHash("p{color:red}") + `'; img-src data:; connect-src *; frame-ancestors 'none'`,
+		},
+		{
+			name:     "with branding",
+			branding: &Branding{DisplayName: "ACME Corp", PrimaryColor: "#1b3951", Logo: "data:image/png;base64,abc"},
+			wantHTML: `<title>ACME Corp</title><style>p{color:red}h1,a{color:#1b3951}.logo{position:absolute;top:24px;left:24px;max-width:200px;max-height:48px}</style><p>hello</p>`,
+			wantCSP: `default-src 'none'; ` +
+				`style-src '` + CSPHash("p{color:red}h1,a{color:#1b3951}.logo{position:absolute;top:24px;left:24px;max-width:200px;max-height:48px}") + `'; ` +
+				`img-src data:; connect-src *; frame-ancestors 'none'`,
+		},
+		{
+			name:     "with template override",
+			branding: &Branding{TemplateOverrides: map[string]string{"test": `<h1>{{ displayName }}</h1><p>{{ .Message }}</p><script>alert(1)</script>`}},
+			wantHTML: `<h1>Pinniped</h1><p>hello</p><script>alert(1)</script>`,
+			// The script of the override is not allowed by the CSP.
+			wantCSP: `default-src 'none'; style-src '` + CSPHash("p{color:red}") + `'; connect-src *; frame-ancestors 'none'`,
+		},
+		{
+			name:     "template override which does not parse",
+			branding: &Branding{TemplateOverrides: map[string]string{"test": `{{ .Message `}},
+			wantErr:  `test.gohtml is not a valid template: template: test.gohtml:1: unclosed action`,
+		},
+		{
+			name:     "template override which uses data which the page does not have",
+			branding: &Branding{TemplateOverrides: map[string]string{"test": `<p>{{ .Username }}</p>`}},
+			wantErr: `test.gohtml is not a valid template: template: test.gohtml:1:6: executing "test.gohtml" at <.Username>: ` +
+				`can't evaluate field Username in type *branding.testPageData`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			source := testPageSource()
+			if test.source != nil {
+				test.source(&source)
+			}
+
+			page, err := NewPage(source, test.branding)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Nil(t, page)
+				return
+			}
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			require.NoError(t, page.Template().Execute(&buf, &testPageData{Message: "hello"}))
+			require.Equal(t, test.wantHTML, buf.String())
+			require.Equal(t, test.wantCSP, page.ContentSecurityPolicy())
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package consenthtml defines the HTML template of the Supervisor's consent page, which asks users whether a client
+// which is not trusted may receive their tokens.
+//nolint: gochecknoglobals // This package uses globals to ensure that all parsing and minifying happens at init.
+package consenthtml
+
+import (
+	_ "embed" // Needed to trigger //go:embed directives below.
+	"html/template"
+
+	"github.com/tdewolff/minify/v2/minify"
+
+	"go.pinniped.dev/internal/oidc/provider/branding"
+)
+
+// PageName is the name of the consent page, whose template is overridden by the key "consent.gohtml" of the
+// branding ConfigMap of a FederationDomain.
+const PageName = "consent"
+
+var (
+	//go:embed consent_form.css
+	rawCSS      string
+	minifiedCSS = mustMinify(minify.CSS(rawCSS))
+
+	//go:embed consent_form.gohtml
+	rawHTMLTemplate string
+)
+
+// The page is parsed with the minified inline CSS, along with the branding of a FederationDomain.
+var pageSource = branding.PageSource{
+	Name:         PageName,
+	HTMLTemplate: rawHTMLTemplate,
+	MinifiedCSS:  minifiedCSS,
+	SampleData:   &PageData{Scopes: []Scope{{}}},
+}
+
+// Parse the default page and generate its CSP header value once since it's effectively constant. The page has no
+// scripts. Note that form-action is deliberately not restricted, because the decision redirects to the downstream
+// client.
+var defaultPage = mustPage(branding.NewPage(pageSource, nil))
+
+// Scope is a scope which the client requested.
+type Scope struct {
+	// Name is the name of the scope, e.g. offline_access.
+	Name string
+	// Description says what the client may do with the scope.
+	Description string
+}
+
+// PageData is the data used to render the consent page.
+type PageData struct {
+	// ClientID is the ID of the client which is asking for consent.
+	ClientID string
+	// Username is the downstream username of the user.
+	Username string
+	// Scopes are the scopes which the client requested.
+	Scopes []Scope
+	// PendingConsent is the handle of the login which is waiting for the decision of the user. It is posted back
+	// with the form.
+	PendingConsent string
+	// PostPath is where the form will be posted.
+	PostPath string
+}
+
+func mustMinify(s string, err error) string {
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func mustPage(p *branding.Page, err error) *branding.Page {
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// ContentSecurityPolicy returns the Content-Security-Policy header value to make the Template() operate correctly.
+func ContentSecurityPolicy() string { return defaultPage.ContentSecurityPolicy() }
+
+// Template returns the html/template.Template for rendering the consent page using PageData.
+func Template() *template.Template { return defaultPage.Template() }
+
+// BrandedPage returns the consent page with the branding of a FederationDomain. It returns an error when the branding
+// overrides its template with an invalid template.
+func BrandedPage(b *branding.Branding) (*branding.Page, error) {
+	return branding.NewPage(pageSource, b)
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package consenthtml
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/here"
+)
+
+var (
+	testExpectedConsentPageOutput = here.Doc(`
+        <!DOCTYPE html>
+        <html lang="en">
+        <head>
+            <meta charset="UTF-8">
+            <title>Pinniped</title>
+            <style>body{font-family:metropolis-light,Helvetica,sans-serif}h1{font-size:20px}.box{position:absolute;top:100px;left:50%;width:400px;margin-left:-200px;font-size:14px;line-height:24px}ul{margin-bottom:16px;padding-left:20px}.scope{font-family:monospace;color:#565656}button{padding:8px 16px;font-size:14px;cursor:pointer}button.secondary{margin-left:8px}</style>
+        </head>
+        <body>
+        <div class="box">
+            <h1>Allow client.oauth.pinniped.dev-some-app to access your account?</h1>
+            <p>You are logged in as <strong>pinny</strong>. If you allow it, client.oauth.pinniped.dev-some-app will be able to:</p>
+            <ul>
+                <li>Know who you are <span class="scope">openid</span></li>
+                <li>Stay logged in <span class="scope">offline_access</span></li>
+            </ul>
+            <form action="https://example.com/issuer/consent" method="post">
+                <input type="hidden" name="consent" value="some-pending-consent-handle"/>
+                <button type="submit" name="decision" id="allow" value="allow">Allow</button>
+                <button type="submit" name="decision" id="deny" value="deny" class="secondary">Deny</button>
+            </form>
+        </div>
+        </body>
+        </html>
+		`)
+
+	// It's okay if this changes in the future, but this gives us a chance to eyeball the formatting.
+	// Our browser-based integration tests should find any incompatibilities.
+	testExpectedCSP = `default-src 'none'; ` +
+		`style-src 'sha256-KUIQDJDETzIQGFUdIP/rlvCe7QUw9PC8GJqcYuLMIzo='; ` +
+		`frame-ancestors 'none'`
+)
+
+func TestTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Template().Execute(&buf, &PageData{
+		ClientID: "client.oauth.pinniped.dev-some-app",
+		Username: "pinny",
+		Scopes: []Scope{
+			{Name: "openid", Description: "Know who you are"},
+			{Name: "offline_access", Description: "Stay logged in"},
+		},
+		PendingConsent: "some-pending-consent-handle",
+		PostPath:       "https://example.com/issuer/consent",
+	}))
+
+	// t.Logf("actual value:\n%s", buf.String()) // useful when updating minify library causes new output
+	require.Equal(t, testExpectedConsentPageOutput, buf.String())
+}
+
+func TestTemplateEscapesClientID(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Template().Execute(&buf, &PageData{
+		ClientID: "<script>",
+		Username: "pinny",
+		PostPath: "https://example.com/issuer/consent",
+	}))
+
+	require.Contains(t, buf.String(), "<h1>Allow &lt;script&gt; to access your account?</h1>")
+	require.NotContains(t, buf.String(), "<script>")
+}
+
+func TestContentSecurityPolicyHashes(t *testing.T) {
+	require.Equal(t, testExpectedCSP, ContentSecurityPolicy())
+}
+
+func TestHelpers(t *testing.T) {
+	require.Equal(t, "test", mustMinify("test", nil))
+	require.PanicsWithError(t, "some error", func() { mustMinify("", fmt.Errorf("some error")) })
+	require.PanicsWithError(t, "some error", func() { mustPage(nil, fmt.Errorf("some error")) })
+}
@@ -5,14 +5,18 @@ package provider
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/url"
 	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 	"k8s.io/apimachinery/pkg/types"
 
 	"go.pinniped.dev/internal/authenticators"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
@@ -61,6 +65,10 @@ type UpstreamOIDCIdentityProviderI interface {
 	// GetAdditionalAuthcodeParams returns additional params to be sent on authcode requests.
 	GetAdditionalAuthcodeParams() map[string]string
 
+	// GetTOTPMode returns whether users who log in with the resource owner password credentials grant must also
+	// provide a TOTP code.
+	GetTOTPMode() totp.Mode
+
 	// PasswordCredentialsGrantAndValidateTokens performs upstream OIDC resource owner password credentials grant and
 	// token validation. Returns the validated raw tokens as well as the parsed claims of the ID token.
 	PasswordCredentialsGrantAndValidateTokens(ctx context.Context, username, password string) (*oidctypes.Token, error)
@@ -107,8 +115,130 @@ type UpstreamLDAPIdentityProviderI interface {
 	// UserAuthenticator adds an interface method for performing user authentication against the upstream LDAP provider.
 	authenticators.UserAuthenticator
 
-	// PerformRefresh performs a refresh against the upstream LDAP identity provider
-	PerformRefresh(ctx context.Context, storedRefreshAttributes StoredRefreshAttributes) error
+	// GetTOTPMode returns whether users must also provide a TOTP code after their password.
+	GetTOTPMode() totp.Mode
+
+	// PerformRefresh performs a refresh against the upstream LDAP identity provider, and returns the user's
+	// current group memberships.
+	PerformRefresh(ctx context.Context, storedRefreshAttributes StoredRefreshAttributes) ([]string, error)
+}
+
+// GitHubUser is the identity of a GitHub user as determined by an UpstreamGitHubIdentityProviderI.
+type GitHubUser struct {
+	// Username is the downstream username, formatted as configured on the GitHubIdentityProvider.
+	Username string
+
+	// Groups are the downstream group names, each of the form "org/team".
+	Groups []string
+
+	// DownstreamSubject is a globally unique identifier for the user, which will not change even
+	// when the user changes their GitHub login name.
+	DownstreamSubject string
+}
+
+type UpstreamGitHubIdentityProviderI interface {
+	// GetName returns a name for this upstream provider, which will be used as a component of the path for the
+	// callback endpoint hosted by the Supervisor.
+	GetName() string
+
+	// GetResourceUID returns the Kubernetes resource ID
+	GetResourceUID() types.UID
+
+	// GetClientID returns the OAuth client ID registered with GitHub to be used in the authorization code flow.
+	GetClientID() string
+
+	// GetAuthorizationURL returns the GitHub OAuth authorization endpoint.
+	GetAuthorizationURL() *url.URL
+
+	// GetScopes returns the scopes to request in the authorization code flow.
+	GetScopes() []string
+
+	// ExchangeAuthcode performs an upstream authorization code exchange and returns the resulting access token.
+	ExchangeAuthcode(ctx context.Context, authcode string, pkceCodeVerifier pkce.Code, redirectURI string) (string, error)
+
+	// GetUser uses the given access token to look up the user and their team memberships using the GitHub API.
+	// It returns an error wrapping ErrGitHubUserNotAllowed when the user is not a member of any allowed organization.
+	GetUser(ctx context.Context, accessToken string) (*GitHubUser, error)
+}
+
+// ErrGitHubUserNotAllowed is returned by UpstreamGitHubIdentityProviderI.GetUser when the user is not allowed to
+// log in because of the organization restrictions of the identity provider.
+var ErrGitHubUserNotAllowed = errors.New("user is not a member of any allowed GitHub organization")
+
+// SAMLUser is the identity of a user as asserted by an UpstreamSAMLIdentityProviderI.
+type SAMLUser struct {
+	// Username is the downstream username, taken from the configured assertion attribute or from the NameID.
+	Username string
+
+	// Groups are the downstream group names, taken from the configured assertion attribute.
+	Groups []string
+
+	// DownstreamSubject is a globally unique identifier for the user, based on the NameID of the assertion.
+	DownstreamSubject string
+
+	// NameID is the NameID of the subject of the assertion.
+	NameID string
+
+	// SessionExpiry is the time after which the upstream identity provider no longer vouches for the user's session,
+	// or the zero time when the upstream identity provider did not limit the session.
+	SessionExpiry time.Time
+}
+
+// SAMLServiceProvider identifies the Supervisor as a SAML service provider for a particular FederationDomain.
+type SAMLServiceProvider struct {
+	// EntityID is the unique name of the service provider.
+	EntityID string
+
+	// AssertionConsumerServiceURL is the endpoint to which the identity provider should POST its responses.
+	AssertionConsumerServiceURL *url.URL
+}
+
+type UpstreamSAMLIdentityProviderI interface {
+	// GetName returns a name for this upstream provider.
+	GetName() string
+
+	// GetResourceUID returns the Kubernetes resource ID
+	GetResourceUID() types.UID
+
+	// AuthnRequestURL returns the URL to which the user's browser should be redirected to start an
+	// SP-initiated login using the HTTP-Redirect binding. The requestID should be unpredictable, since it will
+	// be used to correlate the response to this request. The relayState will be returned unchanged by the
+	// identity provider along with its response.
+	AuthnRequestURL(sp SAMLServiceProvider, requestID string, relayState string) (*url.URL, error)
+
+	// ParseResponse validates a base64-encoded SAMLResponse which was delivered using the HTTP-POST binding
+	// in response to the request with the given requestID, and returns the identity that it asserts.
+	ParseResponse(sp SAMLServiceProvider, requestID string, samlResponse string) (*SAMLUser, error)
+}
+
+// CertificateUser is the identity of a user as determined by an UpstreamCertificateIdentityProviderI.
+type CertificateUser struct {
+	// Username is the downstream username, taken from the configured field of the client certificate.
+	Username string
+
+	// Groups are the downstream group names, taken from the configured field of the client certificate's subject.
+	Groups []string
+
+	// DownstreamSubject is a globally unique identifier for the user, based on the subject and issuer of the
+	// client certificate.
+	DownstreamSubject string
+}
+
+type UpstreamCertificateIdentityProviderI interface {
+	// GetName returns a name for this upstream provider.
+	GetName() string
+
+	// GetResourceUID returns the Kubernetes resource ID
+	GetResourceUID() types.UID
+
+	// GetCertificateAuthorities returns the CA certificates which issue the client certificates of users.
+	// During the TLS handshake, the Supervisor asks clients for a certificate issued by one of them.
+	GetCertificateAuthorities() []*x509.Certificate
+
+	// AuthenticateCertificate verifies the certificate chain which the client presented during the TLS handshake,
+	// starting with the client's own certificate, checks that none of its certificates have been revoked, and
+	// returns the identity of the user.
+	AuthenticateCertificate(peerCertificates []*x509.Certificate) (*CertificateUser, error)
 }
 
 type StoredRefreshAttributes struct {
@@ -125,12 +255,21 @@ type DynamicUpstreamIDPProvider interface {
 	GetLDAPIdentityProviders() []UpstreamLDAPIdentityProviderI
 	SetActiveDirectoryIdentityProviders(adIDPs []UpstreamLDAPIdentityProviderI)
 	GetActiveDirectoryIdentityProviders() []UpstreamLDAPIdentityProviderI
+	SetGitHubIdentityProviders(gitHubIDPs []UpstreamGitHubIdentityProviderI)
+	GetGitHubIdentityProviders() []UpstreamGitHubIdentityProviderI
+	SetSAMLIdentityProviders(samlIDPs []UpstreamSAMLIdentityProviderI)
+	GetSAMLIdentityProviders() []UpstreamSAMLIdentityProviderI
+	SetCertificateIdentityProviders(certificateIDPs []UpstreamCertificateIdentityProviderI)
+	GetCertificateIdentityProviders() []UpstreamCertificateIdentityProviderI
 }
 
 type dynamicUpstreamIDPProvider struct {
 	oidcUpstreams            []UpstreamOIDCIdentityProviderI
 	ldapUpstreams            []UpstreamLDAPIdentityProviderI
 	activeDirectoryUpstreams []UpstreamLDAPIdentityProviderI
+	gitHubUpstreams          []UpstreamGitHubIdentityProviderI
+	samlUpstreams            []UpstreamSAMLIdentityProviderI
+	certificateUpstreams     []UpstreamCertificateIdentityProviderI
 	mutex                    sync.RWMutex
 }
 
@@ -139,6 +278,9 @@ func NewDynamicUpstreamIDPProvider() DynamicUpstreamIDPProvider {
 		oidcUpstreams:            []UpstreamOIDCIdentityProviderI{},
 		ldapUpstreams:            []UpstreamLDAPIdentityProviderI{},
 		activeDirectoryUpstreams: []UpstreamLDAPIdentityProviderI{},
+		gitHubUpstreams:          []UpstreamGitHubIdentityProviderI{},
+		samlUpstreams:            []UpstreamSAMLIdentityProviderI{},
+		certificateUpstreams:     []UpstreamCertificateIdentityProviderI{},
 	}
 }
 
@@ -178,6 +320,42 @@ func (p *dynamicUpstreamIDPProvider) GetActiveDirectoryIdentityProviders() []Ups
 	return p.activeDirectoryUpstreams
 }
 
+func (p *dynamicUpstreamIDPProvider) SetGitHubIdentityProviders(gitHubIDPs []UpstreamGitHubIdentityProviderI) {
+	p.mutex.Lock() // acquire a write lock
+	defer p.mutex.Unlock()
+	p.gitHubUpstreams = gitHubIDPs
+}
+
+func (p *dynamicUpstreamIDPProvider) GetGitHubIdentityProviders() []UpstreamGitHubIdentityProviderI {
+	p.mutex.RLock() // acquire a read lock
+	defer p.mutex.RUnlock()
+	return p.gitHubUpstreams
+}
+
+func (p *dynamicUpstreamIDPProvider) SetSAMLIdentityProviders(samlIDPs []UpstreamSAMLIdentityProviderI) {
+	p.mutex.Lock() // acquire a write lock
+	defer p.mutex.Unlock()
+	p.samlUpstreams = samlIDPs
+}
+
+func (p *dynamicUpstreamIDPProvider) GetSAMLIdentityProviders() []UpstreamSAMLIdentityProviderI {
+	p.mutex.RLock() // acquire a read lock
+	defer p.mutex.RUnlock()
+	return p.samlUpstreams
+}
+
+func (p *dynamicUpstreamIDPProvider) SetCertificateIdentityProviders(certificateIDPs []UpstreamCertificateIdentityProviderI) {
+	p.mutex.Lock() // acquire a write lock
+	defer p.mutex.Unlock()
+	p.certificateUpstreams = certificateIDPs
+}
+
+func (p *dynamicUpstreamIDPProvider) GetCertificateIdentityProviders() []UpstreamCertificateIdentityProviderI {
+	p.mutex.RLock() // acquire a read lock
+	defer p.mutex.RUnlock()
+	return p.certificateUpstreams
+}
+
 type RetryableRevocationError struct {
 	wrapped error
 }
@@ -1,9 +1,10 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package provider
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -14,13 +15,87 @@ import (
 // FederationDomainIssuer represents all of the settings and state for a downstream OIDC provider
 // as defined by a FederationDomain.
 type FederationDomainIssuer struct {
-	issuer     string
-	issuerHost string
-	issuerPath string
+	issuer              string
+	issuerHost          string
+	issuerPath          string
+	tokenExchangePolicy *TokenExchangePolicy
+	pages               *Pages
 }
 
-func NewFederationDomainIssuer(issuer string) (*FederationDomainIssuer, error) {
-	p := FederationDomainIssuer{issuer: issuer}
+// TokenExchangePolicy decides which tokens may be requested from a FederationDomain using RFC 8693 token exchange.
+type TokenExchangePolicy struct {
+	// AllowedAudiences maps each audience which may be requested to the groups whose members may request it.
+	// An audience without any groups may be requested by any user. When there are no audiences, any audience
+	// may be requested by any user.
+	AllowedAudiences map[string][]string
+
+	// TrustedServiceAccountIssuers maps the issuers of the ServiceAccount tokens of other clusters which may be
+	// exchanged to the verifiers of their tokens.
+	TrustedServiceAccountIssuers map[string]TrustedTokenVerifier
+
+	// TrustedOIDCIssuers maps the OIDC issuers, such as CI platforms, whose ID tokens may be exchanged to the
+	// verifiers of their ID tokens.
+	TrustedOIDCIssuers map[string]TrustedTokenVerifier
+}
+
+// TrustedIdentity is the downstream identity of a token which was verified by a TrustedTokenVerifier.
+type TrustedIdentity struct {
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+// TrustedTokenVerifier verifies the tokens of an issuer which is trusted to identify workloads, and maps them to
+// downstream identities.
+type TrustedTokenVerifier interface {
+	VerifyToken(ctx context.Context, token string) (*TrustedIdentity, error)
+}
+
+// TrustedServiceAccountIssuer returns the verifier of the ServiceAccount tokens of the issuer, or nil when the
+// ServiceAccount tokens of the issuer may not be exchanged. A nil policy does not trust any issuer.
+func (p *TokenExchangePolicy) TrustedServiceAccountIssuer(issuer string) TrustedTokenVerifier {
+	if p == nil {
+		return nil
+	}
+	return p.TrustedServiceAccountIssuers[issuer]
+}
+
+// TrustedOIDCIssuer returns the verifier of the ID tokens of the issuer, or nil when the ID tokens of the issuer may
+// not be exchanged. A nil policy does not trust any issuer.
+func (p *TokenExchangePolicy) TrustedOIDCIssuer(issuer string) TrustedTokenVerifier {
+	if p == nil {
+		return nil
+	}
+	return p.TrustedOIDCIssuers[issuer]
+}
+
+// IsAudienceAllowed returns whether a user who is a member of the given groups may request a token for the audience.
+// A nil policy allows any audience.
+func (p *TokenExchangePolicy) IsAudienceAllowed(audience string, groups []string) bool {
+	if p == nil || len(p.AllowedAudiences) == 0 {
+		return true
+	}
+	allowedGroups, ok := p.AllowedAudiences[audience]
+	if !ok {
+		return false
+	}
+	if len(allowedGroups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		for _, allowedGroup := range allowedGroups {
+			if group == allowedGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewFederationDomainIssuer returns a validated FederationDomainIssuer. The tokenExchangePolicy may be nil when
+// the FederationDomain does not restrict token exchange, and the pages may be nil when it has no branding.
+func NewFederationDomainIssuer(issuer string, tokenExchangePolicy *TokenExchangePolicy, pages *Pages) (*FederationDomainIssuer, error) {
+	p := FederationDomainIssuer{issuer: issuer, tokenExchangePolicy: tokenExchangePolicy, pages: pages}
 	err := p.validate()
 	if err != nil {
 		return nil, err
@@ -75,3 +150,15 @@ func (p *FederationDomainIssuer) IssuerHost() string {
 func (p *FederationDomainIssuer) IssuerPath() string {
 	return p.issuerPath
 }
+
+func (p *FederationDomainIssuer) TokenExchangePolicy() *TokenExchangePolicy {
+	return p.tokenExchangePolicy
+}
+
+// Pages returns the HTML pages of the FederationDomain, which are the default pages when it has no branding.
+func (p *FederationDomainIssuer) Pages() *Pages {
+	if p.pages == nil {
+		return DefaultPages()
+	}
+	return p.pages
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package provider
@@ -72,7 +72,7 @@ func TestFederationDomainIssuerValidations(t *testing.T) {
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := NewFederationDomainIssuer(tt.issuer)
+			_, err := NewFederationDomainIssuer(tt.issuer, nil, nil)
 			if tt.wantError != "" {
 				require.EqualError(t, err, tt.wantError)
 			} else {
@@ -81,3 +81,23 @@ func TestFederationDomainIssuerValidations(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenExchangePolicy(t *testing.T) {
+	var nilPolicy *TokenExchangePolicy
+	require.True(t, nilPolicy.IsAudienceAllowed("any-audience", nil))
+	require.True(t, (&TokenExchangePolicy{}).IsAudienceAllowed("any-audience", nil))
+
+	policy := &TokenExchangePolicy{AllowedAudiences: map[string][]string{
+		"any-user":    nil,
+		"some-groups": {"group1", "group2"},
+	}}
+	require.True(t, policy.IsAudienceAllowed("any-user", nil))
+	require.True(t, policy.IsAudienceAllowed("some-groups", []string{"group0", "group2"}))
+	require.False(t, policy.IsAudienceAllowed("some-groups", []string{"group0"}))
+	require.False(t, policy.IsAudienceAllowed("some-groups", nil))
+	require.False(t, policy.IsAudienceAllowed("other-audience", []string{"group1"}))
+
+	issuer, err := NewFederationDomainIssuer("https://example.com", policy, nil)
+	require.NoError(t, err)
+	require.Same(t, policy, issuer.TokenExchangePolicy())
+}
@@ -1,4 +1,4 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package formposthtml defines HTML templates used by the Supervisor.
@@ -6,15 +6,19 @@
 package formposthtml
 
 import (
-	"crypto/sha256"
 	_ "embed" // Needed to trigger //go:embed directives below.
-	"encoding/base64"
 	"html/template"
-	"strings"
+	"net/url"
 
 	"github.com/tdewolff/minify/v2/minify"
+
+	"go.pinniped.dev/internal/oidc/provider/branding"
 )
 
+// PageName is the name of the response_type=form_post response page, whose template is overridden by the key
+// "formPost.gohtml" of the branding ConfigMap of a FederationDomain.
+const PageName = "formPost"
+
 var (
 	//go:embed form_post.css
 	rawCSS      string
@@ -28,21 +32,22 @@ var (
 	rawHTMLTemplate string
 )
 
-// Parse the Go templated HTML and inject functions providing the minified inline CSS and JS.
-var parsedHTMLTemplate = template.Must(template.New("form_post.gohtml").Funcs(template.FuncMap{
-	"minifiedCSS": func() template.CSS { return template.CSS(minifiedCSS) },
-	"minifiedJS":  func() template.JS { return template.JS(minifiedJS) }, //nolint:gosec // This is 100% static input, not attacker-controlled.
-}).Parse(rawHTMLTemplate))
+// The page is parsed with the minified inline CSS and JS, along with the branding of a FederationDomain.
+var pageSource = branding.PageSource{
+	Name:               PageName,
+	HTMLTemplate:       rawHTMLTemplate,
+	MinifiedCSS:        minifiedCSS,
+	MinifiedJS:         minifiedJS,
+	ExtraCSPDirectives: []string{`connect-src *`},
+	// This is the data which Fosite renders the template with.
+	SampleData: struct {
+		RedirURL   string
+		Parameters url.Values
+	}{},
+}
 
-// Generate the CSP header value once since it's effectively constant:
-var cspValue = strings.Join([]string{
-	`default-src 'none'`,
-	`script-src '` + cspHash(minifiedJS) + `'`,
-	`style-src '` + cspHash(minifiedCSS) + `'`,
-	`img-src data:`,
-	`connect-src *`,
-	`frame-ancestors 'none'`,
-}, "; ")
+// Parse the default page and generate its CSP header value once since it's effectively constant.
+var defaultPage = mustPage(branding.NewPage(pageSource, nil))
 
 func mustMinify(s string, err error) string {
 	if err != nil {
@@ -51,15 +56,23 @@ func mustMinify(s string, err error) string {
 	return s
 }
 
-func cspHash(s string) string {
-	hashBytes := sha256.Sum256([]byte(s))
-	return "sha256-" + base64.StdEncoding.EncodeToString(hashBytes[:])
+func mustPage(p *branding.Page, err error) *branding.Page {
+	if err != nil {
+		panic(err)
+	}
+	return p
 }
 
 // ContentSecurityPolicy returns the Content-Security-Policy header value to make the Template() operate correctly.
 //
 // See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Security-Policy/default-src#:~:text=%27%3Chash-algorithm%3E-%3Cbase64-value%3E%27.
-func ContentSecurityPolicy() string { return cspValue }
+func ContentSecurityPolicy() string { return defaultPage.ContentSecurityPolicy() }
 
 // Template returns the html/template.Template for rendering the response_type=form_post response page.
-func Template() *template.Template { return parsedHTMLTemplate }
+func Template() *template.Template { return defaultPage.Template() }
+
+// BrandedPage returns the response_type=form_post response page with the branding of a FederationDomain. It returns
+// an error when the branding overrides its template with an invalid template.
+func BrandedPage(b *branding.Branding) (*branding.Page, error) {
+	return branding.NewPage(pageSource, b)
+}
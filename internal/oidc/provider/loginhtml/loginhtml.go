@@ -0,0 +1,89 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package loginhtml defines the HTML template of the Supervisor's login page, which is used by browser-based logins
+// with LDAP and Active Directory upstreams.
+//nolint: gochecknoglobals // This package uses globals to ensure that all parsing and minifying happens at init.
+package loginhtml
+
+import (
+	_ "embed" // Needed to trigger //go:embed directives below.
+	"html/template"
+
+	"github.com/tdewolff/minify/v2/minify"
+
+	"go.pinniped.dev/internal/oidc/provider/branding"
+)
+
+// PageName is the name of the login page, whose template is overridden by the key "login.gohtml" of the
+// branding ConfigMap of a FederationDomain.
+const PageName = "login"
+
+var (
+	//go:embed login_form.css
+	rawCSS      string
+	minifiedCSS = mustMinify(minify.CSS(rawCSS))
+
+	//go:embed login_form.gohtml
+	rawHTMLTemplate string
+)
+
+// The page is parsed with the minified inline CSS, along with the branding of a FederationDomain.
+var pageSource = branding.PageSource{
+	Name:         PageName,
+	HTMLTemplate: rawHTMLTemplate,
+	MinifiedCSS:  minifiedCSS,
+	SampleData:   &PageData{},
+}
+
+// Parse the default page and generate its CSP header value once since it's effectively constant. The page has no
+// scripts. Note that form-action is deliberately not restricted, because a successful login redirects to the
+// downstream client.
+var defaultPage = mustPage(branding.NewPage(pageSource, nil))
+
+// PageData is the data used to render the login page.
+type PageData struct {
+	// IDPName is the name of the upstream identity provider.
+	IDPName string
+	// State is the encoded upstream state param, which is posted back with the form.
+	State string
+	// PostPath is where the form will be posted.
+	PostPath string
+	// AlertMessage is an optional error message from a previous attempt to log in.
+	AlertMessage string
+	// TOTPOptional shows an option to enroll for TOTP codes on the first step of the login.
+	TOTPOptional bool
+	// PendingTOTPLogin is set for the second step of the login, which asks for a TOTP code. It is the handle of
+	// the pending login, which is posted back with the form.
+	PendingTOTPLogin string
+	// TOTPEnrollmentSecret and TOTPEnrollmentURI are set when the user must add their new TOTP secret to their
+	// authenticator app during the second step of the login.
+	TOTPEnrollmentSecret string
+	TOTPEnrollmentURI    template.URL
+}
+
+func mustMinify(s string, err error) string {
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func mustPage(p *branding.Page, err error) *branding.Page {
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// ContentSecurityPolicy returns the Content-Security-Policy header value to make the Template() operate correctly.
+func ContentSecurityPolicy() string { return defaultPage.ContentSecurityPolicy() }
+
+// Template returns the html/template.Template for rendering the login page using PageData.
+func Template() *template.Template { return defaultPage.Template() }
+
+// BrandedPage returns the login page with the branding of a FederationDomain. It returns an error when the branding
+// overrides its template with an invalid template.
+func BrandedPage(b *branding.Branding) (*branding.Page, error) {
+	return branding.NewPage(pageSource, b)
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package loginhtml
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/here"
+)
+
+var (
+	testExpectedLoginPageOutput = here.Doc(`
+        <!DOCTYPE html>
+        <html lang="en">
+        <head>
+            <meta charset="UTF-8">
+            <title>Pinniped</title>
+            <style>body{font-family:metropolis-light,Helvetica,sans-serif}h1{font-size:20px}.box{position:absolute;top:100px;left:50%;width:400px;margin-left:-200px;font-size:14px;line-height:24px}.form-field{margin-bottom:16px}label{display:block}label.inline{display:inline}.secret{font-family:monospace;font-size:16px;word-break:break-all}input[type=text],input[type=password]{box-sizing:border-box;width:100%;padding:8px;font-size:14px}button{padding:8px 16px;font-size:14px;cursor:pointer}.alert{margin-bottom:16px;padding:8px;color:#a32100;background-color:#f5dbd9}</style>
+        </head>
+        <body>
+        <div class="box">
+            <h1>Log in to some-ldap-idp</h1>
+            <div class="alert" role="alert">Incorrect username or password.</div>
+            <form action="https://example.com/issuer/login" method="post">
+                <input type="hidden" name="state" value="some-encoded-state"/>
+                <div class="form-field">
+                    <label for="username">Username</label>
+                    <input type="text" name="username" id="username" autocomplete="username" required autofocus/>
+                </div>
+                <div class="form-field">
+                    <label for="password">Password</label>
+                    <input type="password" name="password" id="password" autocomplete="current-password" required/>
+                </div>
+                <button type="submit" name="submit" id="submit">Log in</button>
+            </form>
+        </div>
+        </body>
+        </html>
+		`)
+
+	// It's okay if this changes in the future, but this gives us a chance to eyeball the formatting.
+	// Our browser-based integration tests should find any incompatibilities.
+	testExpectedCSP = `default-src 'none'; ` +
+		`style-src 'sha256-8eqpSWgsc1tM03gjGLS7IasT2SbjyfDAJ/zsicK9Ckc='; ` +
+		`frame-ancestors 'none'`
+)
+
+func TestTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Template().Execute(&buf, &PageData{
+		IDPName:      "some-ldap-idp",
+		State:        "some-encoded-state",
+		PostPath:     "https://example.com/issuer/login",
+		AlertMessage: "Incorrect username or password.",
+	}))
+
+	// t.Logf("actual value:\n%s", buf.String()) // useful when updating minify library causes new output
+	require.Equal(t, testExpectedLoginPageOutput, buf.String())
+}
+
+func TestTemplateWithoutAlertMessage(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Template().Execute(&buf, &PageData{
+		IDPName:  "some-ldap-idp",
+		State:    "some-encoded-state",
+		PostPath: "https://example.com/issuer/login",
+	}))
+
+	require.NotContains(t, buf.String(), `class="alert"`)
+	require.Contains(t, buf.String(), "<h1>Log in to some-ldap-idp</h1>\n    <form ")
+}
+
+func TestTemplateWithOptionalTOTP(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Template().Execute(&buf, &PageData{
+		IDPName:      "some-ldap-idp",
+		State:        "some-encoded-state",
+		PostPath:     "https://example.com/issuer/login",
+		TOTPOptional: true,
+	}))
+
+	require.Contains(t, buf.String(), `<input type="checkbox" name="enroll_totp" id="enroll_totp" value="true"/>`)
+	require.Contains(t, buf.String(), `<input type="password" name="password"`)
+}
+
+func TestTemplateWithTOTPStep(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Template().Execute(&buf, &PageData{
+		IDPName:          "some-ldap-idp",
+		State:            "some-encoded-state",
+		PostPath:         "https://example.com/issuer/login",
+		PendingTOTPLogin: "some-pending-login-handle",
+	}))
+
+	require.Contains(t, buf.String(), `<input type="hidden" name="totp" value="some-pending-login-handle"/>`)
+	require.Contains(t, buf.String(), `<input type="text" name="totp_code" id="totp_code" autocomplete="one-time-code" inputmode="numeric" pattern="[0-9]*" required autofocus/>`)
+	require.Contains(t, buf.String(), `<button type="submit" name="submit" id="submit">Verify</button>`)
+	require.NotContains(t, buf.String(), `name="password"`)
+	require.NotContains(t, buf.String(), `class="secret"`)
+}
+
+func TestTemplateWithTOTPEnrollment(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Template().Execute(&buf, &PageData{
+		IDPName:              "some-ldap-idp",
+		State:                "some-encoded-state",
+		PostPath:             "https://example.com/issuer/login",
+		PendingTOTPLogin:     "some-pending-login-handle",
+		TOTPEnrollmentSecret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		TOTPEnrollmentURI:    "otpauth://totp/Pinniped:pinny?issuer=Pinniped&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+	}))
+
+	require.Contains(t, buf.String(), `<a href="otpauth://totp/Pinniped:pinny?issuer=Pinniped&amp;secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ">`)
+	require.Contains(t, buf.String(), `<p class="secret">GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ</p>`)
+	require.Contains(t, buf.String(), `name="totp_code"`)
+}
+
+func TestContentSecurityPolicyHashes(t *testing.T) {
+	require.Equal(t, testExpectedCSP, ContentSecurityPolicy())
+}
+
+func TestHelpers(t *testing.T) {
+	require.Equal(t, "test", mustMinify("test", nil))
+	require.PanicsWithError(t, "some error", func() { mustMinify("", fmt.Errorf("some error")) })
+	require.PanicsWithError(t, "some error", func() { mustPage(nil, fmt.Errorf("some error")) })
+}
@@ -1,27 +1,40 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package manager
 
 import (
+	"crypto/rand"
+	"crypto/x509"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/ory/fosite"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
+	"go.pinniped.dev/internal/loginlimit"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/auth"
 	"go.pinniped.dev/internal/oidc/callback"
+	"go.pinniped.dev/internal/oidc/consent"
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/discovery"
+	"go.pinniped.dev/internal/oidc/dpop"
 	"go.pinniped.dev/internal/oidc/dynamiccodec"
 	"go.pinniped.dev/internal/oidc/idpdiscovery"
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/par"
+	"go.pinniped.dev/internal/oidc/pendinglogin"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/registration"
 	"go.pinniped.dev/internal/oidc/token"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/secret"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
 )
@@ -30,26 +43,31 @@ import (
 //
 // It is thread-safe.
 type Manager struct {
-	mu                  sync.RWMutex
-	providers           []*provider.FederationDomainIssuer
-	providerHandlers    map[string]http.Handler              // map of all routes for all providers
-	nextHandler         http.Handler                         // the next handler in a chain, called when this manager didn't know how to handle a request
-	dynamicJWKSProvider jwks.DynamicJWKSProvider             // in-memory cache of per-issuer JWKS data
-	upstreamIDPs        oidc.UpstreamIdentityProvidersLister // in-memory cache of upstream IDPs
-	secretCache         *secret.Cache                        // in-memory cache of cryptographic material
-	secretsClient       corev1client.SecretInterface
+	mu                          sync.RWMutex
+	providers                   []*provider.FederationDomainIssuer
+	providerHandlers            map[string]http.Handler              // map of all routes for all providers
+	nextHandler                 http.Handler                         // the next handler in a chain, called when this manager didn't know how to handle a request
+	dynamicJWKSProvider         jwks.DynamicJWKSProvider             // in-memory cache of per-issuer JWKS data
+	upstreamIDPs                oidc.UpstreamIdentityProvidersLister // in-memory cache of upstream IDPs
+	secretCache                 *secret.Cache                        // in-memory cache of cryptographic material
+	secretsClient               corev1client.SecretInterface
+	loginLimitPolicies          map[loginlimit.Kind]loginlimit.Policy // policies of the limits of failed password logins
+	dpopReplayCache             *dpop.ReplayCache                     // DPoP proofs which were already used at the token endpoints
+	pushedAuthorizationRequests *par.Storage                          // shared by all providers, and kept when they change so that its in-memory rate limits are not reset
 }
 
 // NewManager returns an empty Manager.
 // nextHandler will be invoked for any requests that could not be handled by this manager's providers.
 // dynamicJWKSProvider will be used as an in-memory cache for per-issuer JWKS data.
 // upstreamIDPs will be used as an in-memory cache of currently configured upstream IDPs.
+// loginLimitPolicies will be used to limit the failed password logins of the providers.
 func NewManager(
 	nextHandler http.Handler,
 	dynamicJWKSProvider jwks.DynamicJWKSProvider,
 	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
 	secretCache *secret.Cache,
 	secretsClient corev1client.SecretInterface,
+	loginLimitPolicies map[loginlimit.Kind]loginlimit.Policy,
 ) *Manager {
 	return &Manager{
 		providerHandlers:    make(map[string]http.Handler),
@@ -58,6 +76,11 @@ func NewManager(
 		upstreamIDPs:        upstreamIDPs,
 		secretCache:         secretCache,
 		secretsClient:       secretsClient,
+		loginLimitPolicies:  loginLimitPolicies,
+		dpopReplayCache:     dpop.NewReplayCache(dpop.DefaultReplayCacheSize),
+		// A request_uri is random and only usable by the client which pushed it, so pushed authorization requests
+		// can be shared by all FederationDomains.
+		pushedAuthorizationRequests: par.NewStorage(secretsClient, time.Now, rand.Reader),
 	}
 }
 
@@ -76,12 +99,31 @@ func (m *Manager) SetProviders(federationDomains ...*provider.FederationDomainIs
 	m.providers = federationDomains
 	m.providerHandlers = make(map[string]http.Handler)
 
-	var csrfCookieEncoder = dynamiccodec.New(
+	// The keys of the codecs are rotated, so they also try the previous keys to decode values which were encoded
+	// before the most recent rotation.
+	var csrfCookieEncoder = dynamiccodec.NewWithPreviousKeys(
 		oidc.CSRFCookieLifespan,
 		m.secretCache.GetCSRFCookieEncoderHashKey,
 		func() []byte { return nil },
+		m.secretCache.GetPreviousCSRFCookieEncoderHashKeys,
+		nil,
 	)
 
+	// TOTP enrollments belong to users rather than to FederationDomains, so their encryption key is derived from
+	// a dedicated Supervisor-wide key, which is never rotated since enrollments never expire.
+	totpVerifier := totp.NewVerifier(
+		totp.NewStorage(m.secretsClient, time.Now, m.secretCache.GetTOTPEncryptionKey, rand.Reader),
+		time.Now,
+		rand.Reader,
+	)
+	// Failed login attempts are counted across all FederationDomains, since they may share upstreams.
+	loginLimiter := loginlimit.New(m.secretsClient, time.Now, m.loginLimitPolicies)
+	// Consents belong to users and clients, which are the same for all FederationDomains.
+	consentStorage := consent.NewStorage(m.secretsClient, time.Now)
+	// The handles of pending logins are random and bound to the CSRF cookie of the browser, so pending logins can be
+	// shared by all FederationDomains as well.
+	pendingLogins := pendinglogin.NewStorage(m.secretsClient, time.Now, rand.Reader)
+
 	for _, incomingProvider := range federationDomains {
 		issuer := incomingProvider.Issuer()
 		issuerHostWithPath := strings.ToLower(incomingProvider.IssuerHost()) + "/" + incomingProvider.IssuerPath()
@@ -92,18 +134,32 @@ func (m *Manager) SetProviders(federationDomains ...*provider.FederationDomainIs
 
 		// Use NullStorage for the authorize endpoint because we do not actually want to store anything until
 		// the upstream callback endpoint is called later.
-		oauthHelperWithNullStorage := oidc.FositeOauth2Helper(oidc.NullStorage{}, issuer, tokenHMACKeyGetter, nil, timeoutsConfiguration)
+		oauthHelperWithNullStorage := oidc.FositeOauth2Helper(oidc.NewNullStorage(m.secretsClient), issuer, tokenHMACKeyGetter, nil, timeoutsConfiguration, nil)
 
 		// For all the other endpoints, make another oauth helper with exactly the same settings except use real storage.
-		oauthHelperWithKubeStorage := oidc.FositeOauth2Helper(oidc.NewKubeStorage(m.secretsClient, timeoutsConfiguration), issuer, tokenHMACKeyGetter, m.dynamicJWKSProvider, timeoutsConfiguration)
+		oauthHelperWithKubeStorage := oidc.FositeOauth2Helper(oidc.NewKubeStorage(m.secretsClient, timeoutsConfiguration), issuer, tokenHMACKeyGetter, m.dynamicJWKSProvider, timeoutsConfiguration, incomingProvider.TokenExchangePolicy())
+
+		// Render the response_mode=form_post page with the branding of the FederationDomain.
+		pages := incomingProvider.Pages()
+		oauthHelperWithNullStorage.(*fosite.Fosite).FormPostHTMLTemplate = pages.FormPost.Template()
+		oauthHelperWithKubeStorage.(*fosite.Fosite).FormPostHTMLTemplate = pages.FormPost.Template()
 
-		var upstreamStateEncoder = dynamiccodec.New(
+		var upstreamStateEncoder = dynamiccodec.NewWithPreviousKeys(
 			timeoutsConfiguration.UpstreamStateParamLifespan,
 			wrapGetter(incomingProvider.Issuer(), m.secretCache.GetStateEncoderHashKey),
 			wrapGetter(incomingProvider.Issuer(), m.secretCache.GetStateEncoderBlockKey),
+			wrapKeysGetter(incomingProvider.Issuer(), m.secretCache.GetPreviousStateEncoderHashKeys),
+			wrapKeysGetter(incomingProvider.Issuer(), m.secretCache.GetPreviousStateEncoderBlockKeys),
 		)
 
-		m.providerHandlers[(issuerHostWithPath + oidc.WellKnownEndpointPath)] = discovery.NewHandler(issuer)
+		consentPrompt := callback.NewConsentPrompt(consentStorage, pendingLogins, issuer)
+
+		discoveryHandler := discovery.NewHandler(issuer)
+		m.providerHandlers[(issuerHostWithPath + oidc.WellKnownEndpointPath)] = discoveryHandler
+		// RFC 8414 inserts the well-known path between the host and the path of the issuer, but many clients append
+		// it to the issuer like OIDC discovery does, so serve both. They are the same when the issuer has no path.
+		m.providerHandlers[(strings.ToLower(incomingProvider.IssuerHost()) + "/" + oidc.AuthorizationServerMetadataPath + incomingProvider.IssuerPath())] = discoveryHandler
+		m.providerHandlers[(issuerHostWithPath + oidc.AuthorizationServerMetadataPath)] = discoveryHandler
 
 		m.providerHandlers[(issuerHostWithPath + oidc.JWKSEndpointPath)] = jwks.NewHandler(issuer, m.dynamicJWKSProvider)
 
@@ -119,6 +175,14 @@ func (m *Manager) SetProviders(federationDomains ...*provider.FederationDomainIs
 			nonce.Generate,
 			upstreamStateEncoder,
 			csrfCookieEncoder,
+			totpVerifier,
+			loginLimiter,
+			m.pushedAuthorizationRequests,
+		)
+
+		m.providerHandlers[(issuerHostWithPath + oidc.PushedAuthorizationRequestEndpointPath)] = par.NewHandler(
+			oauthHelperWithNullStorage,
+			m.pushedAuthorizationRequests,
 		)
 
 		m.providerHandlers[(issuerHostWithPath + oidc.CallbackEndpointPath)] = callback.NewHandler(
@@ -127,11 +191,60 @@ func (m *Manager) SetProviders(federationDomains ...*provider.FederationDomainIs
 			upstreamStateEncoder,
 			csrfCookieEncoder,
 			issuer+oidc.CallbackEndpointPath,
+			consentPrompt,
+			pages,
+		)
+
+		m.providerHandlers[(issuerHostWithPath + oidc.SAMLACSEndpointPath)] = callback.NewSAMLACSHandler(
+			m.upstreamIDPs,
+			oauthHelperWithKubeStorage,
+			upstreamStateEncoder,
+			csrfCookieEncoder,
+			issuer,
+			consentPrompt,
+			pages,
+		)
+
+		m.providerHandlers[(issuerHostWithPath + oidc.LoginEndpointPath)] = callback.NewLoginHandler(
+			m.upstreamIDPs,
+			oauthHelperWithKubeStorage,
+			upstreamStateEncoder,
+			csrfCookieEncoder,
+			issuer,
+			pendingLogins,
+			totpVerifier,
+			loginLimiter,
+			consentPrompt,
+			pages,
+		)
+
+		m.providerHandlers[(issuerHostWithPath + oidc.ConsentEndpointPath)] = callback.NewConsentHandler(
+			oauthHelperWithKubeStorage,
+			csrfCookieEncoder,
+			issuer,
+			consentStorage,
+			pendingLogins,
+			pages,
+		)
+
+		m.providerHandlers[(issuerHostWithPath + oidc.ConsentRevocationEndpointPath)] = consent.NewRevocationHandler(
+			oauthHelperWithKubeStorage,
+			consentStorage,
 		)
 
 		m.providerHandlers[(issuerHostWithPath + oidc.TokenEndpointPath)] = token.NewHandler(
 			m.upstreamIDPs,
 			oauthHelperWithKubeStorage,
+			consentStorage,
+			issuer+oidc.TokenEndpointPath,
+			m.dpopReplayCache,
+		)
+
+		m.providerHandlers[(issuerHostWithPath + oidc.RegistrationEndpointPath)] = registration.NewHandler(
+			oauthHelperWithKubeStorage,
+			m.secretsClient,
+			time.Now,
+			rand.Reader,
 		)
 
 		plog.Debug("oidc provider manager added or updated issuer", "issuer", issuer)
@@ -156,6 +269,27 @@ func (m *Manager) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	requestHandler.ServeHTTP(resp, req)
 }
 
+// ClientCertificateAuthorities returns the certificate authorities of the client certificate identity provider which
+// authenticates the users of the FederationDomain with the hostname. It returns nil when no FederationDomain has the
+// hostname, or when its users are authenticated by another kind of identity provider. The hostname is compared
+// case-insensitively and without the port of the issuer. Clients do not send a hostname during the TLS handshake
+// when they connect to an IP address, so an empty hostname matches the issuers which have IP addresses.
+func (m *Manager) ClientCertificateAuthorities(hostname string) []*x509.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, federationDomain := range m.providers {
+		issuerHostname := (&url.URL{Host: federationDomain.IssuerHost()}).Hostname()
+		if (hostname == "" && net.ParseIP(issuerHostname) != nil) || strings.EqualFold(hostname, issuerHostname) {
+			if certificateUpstream := auth.CertificateUpstream(m.upstreamIDPs); certificateUpstream != nil {
+				return certificateUpstream.GetCertificateAuthorities()
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
 func (m *Manager) findHandler(req *http.Request) http.Handler {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -168,3 +302,9 @@ func wrapGetter(issuer string, getter func(string) []byte) func() []byte {
 		return getter(issuer)
 	}
 }
+
+func wrapKeysGetter(issuer string, getter func(string) [][]byte) func() [][]byte {
+	return func() [][]byte {
+		return getter(issuer)
+	}
+}
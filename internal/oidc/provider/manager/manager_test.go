@@ -6,7 +6,9 @@ package manager
 import (
 	"context"
 	"crypto/ecdsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -14,6 +16,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"go.pinniped.dev/internal/secret"
 
@@ -22,7 +25,9 @@ import (
 	"gopkg.in/square/go-jose.v2"
 	"k8s.io/client-go/kubernetes/fake"
 
+	"go.pinniped.dev/internal/certauthority"
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/loginlimit"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/discovery"
 	"go.pinniped.dev/internal/oidc/jwks"
@@ -42,6 +47,7 @@ func TestManager(t *testing.T) {
 			nextHandler              http.HandlerFunc
 			fallbackHandlerWasCalled bool
 			dynamicJWKSProvider      jwks.DynamicJWKSProvider
+			idpLister                provider.DynamicUpstreamIDPProvider
 			kubeClient               *fake.Clientset
 		)
 
@@ -93,6 +99,33 @@ func TestManager(t *testing.T) {
 			r.Equal(parsedDiscoveryResult.SupervisorDiscovery.PinnipedIDPsEndpoint, expectedIssuer+oidc.PinnipedIDPsPathV1Alpha1)
 		}
 
+		requireAuthorizationServerMetadataRequestToBeHandled := func(requestURL, expectedIssuer string) {
+			recorder := httptest.NewRecorder()
+
+			subject.ServeHTTP(recorder, newGetRequest(requestURL))
+
+			r.False(fallbackHandlerWasCalled)
+
+			// Minimal check to ensure that the right metadata endpoint was called
+			r.Equal(http.StatusOK, recorder.Code)
+			parsedMetadata := discovery.Metadata{}
+			r.NoError(json.Unmarshal(recorder.Body.Bytes(), &parsedMetadata))
+			r.Equal(expectedIssuer, parsedMetadata.Issuer)
+			r.Equal(expectedIssuer+oidc.RegistrationEndpointPath, parsedMetadata.RegistrationEndpoint)
+		}
+
+		requireRegistrationRequestToBeHandled := func(requestIssuer string) {
+			recorder := httptest.NewRecorder()
+
+			subject.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, requestIssuer+oidc.RegistrationEndpointPath, strings.NewReader("{}")))
+
+			r.False(fallbackHandlerWasCalled)
+
+			// Minimal check to ensure that the registration endpoint was called, which needs an initial access token
+			r.Equal(http.StatusUnauthorized, recorder.Code)
+			r.Contains(recorder.Body.String(), `"error":"invalid_token"`)
+		}
+
 		requirePinnipedIDPsDiscoveryRequestToBeHandled := func(requestIssuer, requestURLSuffix, expectedIDPName, expectedIDPType string, expectedFlows []string) {
 			recorder := httptest.NewRecorder()
 
@@ -249,7 +282,7 @@ func TestManager(t *testing.T) {
 
 			parsedUpstreamIDPAuthorizationURL, err := url.Parse(upstreamIDPAuthorizationURL)
 			r.NoError(err)
-			idpLister := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{
+			idpLister = oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{
 				Name:             upstreamIDPName,
 				ClientID:         "test-client-id",
 				AuthorizationURL: *parsedUpstreamIDPAuthorizationURL,
@@ -274,6 +307,7 @@ func TestManager(t *testing.T) {
 
 			cache := secret.Cache{}
 			cache.SetCSRFCookieEncoderHashKey([]byte("fake-csrf-hash-secret"))
+			cache.SetTOTPEncryptionKey([]byte("fake-totp-encryption-key"))
 
 			cache.SetTokenHMACKey(issuer1, []byte("some secret 1 - must have at least 32 bytes"))
 			cache.SetStateEncoderHashKey(issuer1, []byte("some-state-encoder-hash-key-1"))
@@ -283,7 +317,7 @@ func TestManager(t *testing.T) {
 			cache.SetStateEncoderHashKey(issuer2, []byte("some-state-encoder-hash-key-2"))
 			cache.SetStateEncoderBlockKey(issuer2, []byte("16-bytes-STATE02"))
 
-			subject = NewManager(nextHandler, dynamicJWKSProvider, idpLister, &cache, secretsClient)
+			subject = NewManager(nextHandler, dynamicJWKSProvider, idpLister, &cache, secretsClient, loginlimit.DefaultPolicies(false))
 		})
 
 		when("given no providers via SetProviders()", func() {
@@ -322,6 +356,15 @@ func TestManager(t *testing.T) {
 			requireDiscoveryRequestToBeHandled(issuer2DifferentCaseHostname, "", issuer2)
 			requireDiscoveryRequestToBeHandled(issuer2DifferentCaseHostname, "?some=query", issuer2)
 
+			// RFC 8414 metadata is served both at the location defined by RFC 8414 and appended to the issuer.
+			requireAuthorizationServerMetadataRequestToBeHandled("https://example.com"+oidc.AuthorizationServerMetadataPath+"/some/path", issuer1)
+			requireAuthorizationServerMetadataRequestToBeHandled("https://example.com"+oidc.AuthorizationServerMetadataPath+"/some/path/more/deeply/nested/path", issuer2)
+			requireAuthorizationServerMetadataRequestToBeHandled(issuer1+oidc.AuthorizationServerMetadataPath, issuer1)
+			requireAuthorizationServerMetadataRequestToBeHandled(issuer2DifferentCaseHostname+oidc.AuthorizationServerMetadataPath, issuer2)
+
+			requireRegistrationRequestToBeHandled(issuer1)
+			requireRegistrationRequestToBeHandled(issuer2DifferentCaseHostname)
+
 			requirePinnipedIDPsDiscoveryRequestToBeHandled(issuer1, "", upstreamIDPName, upstreamIDPType, upstreamIDPFlows)
 			requirePinnipedIDPsDiscoveryRequestToBeHandled(issuer2, "", upstreamIDPName, upstreamIDPType, upstreamIDPFlows)
 			requirePinnipedIDPsDiscoveryRequestToBeHandled(issuer2, "?some=query", upstreamIDPName, upstreamIDPType, upstreamIDPFlows)
@@ -386,9 +429,9 @@ func TestManager(t *testing.T) {
 
 		when("given some valid providers via SetProviders()", func() {
 			it.Before(func() {
-				p1, err := provider.NewFederationDomainIssuer(issuer1)
+				p1, err := provider.NewFederationDomainIssuer(issuer1, nil, nil)
 				r.NoError(err)
-				p2, err := provider.NewFederationDomainIssuer(issuer2)
+				p2, err := provider.NewFederationDomainIssuer(issuer2, nil, nil)
 				r.NoError(err)
 				subject.SetProviders(p1, p2)
 
@@ -425,13 +468,45 @@ func TestManager(t *testing.T) {
 			it("routes matching requests to the appropriate provider", func() {
 				requireRoutesMatchingRequestsToAppropriateProvider()
 			})
+
+			it("asks for client certificates only on the hostnames of the issuers which use a client certificate upstream", func() {
+				// The upstream of the issuers is an OIDC provider.
+				r.Nil(subject.ClientCertificateAuthorities("example.com"))
+
+				ca, err := certauthority.New("some-ca", time.Hour)
+				r.NoError(err)
+				caPEM, _ := pem.Decode(ca.Bundle())
+				caCert, err := x509.ParseCertificate(caPEM.Bytes)
+				r.NoError(err)
+				certificateUpstreams := []provider.UpstreamCertificateIdentityProviderI{&oidctestutil.TestUpstreamCertificateIdentityProvider{
+					Name:                   "some-certificate-idp",
+					CertificateAuthorities: []*x509.Certificate{caCert},
+				}}
+				idpLister.SetCertificateIdentityProviders(certificateUpstreams)
+
+				// The authorize endpoint cannot choose between more than one upstream.
+				r.Nil(subject.ClientCertificateAuthorities("example.com"))
+
+				idpLister.SetOIDCIdentityProviders(nil)
+				r.Equal([]*x509.Certificate{caCert}, subject.ClientCertificateAuthorities("example.com"))
+				r.Equal([]*x509.Certificate{caCert}, subject.ClientCertificateAuthorities("eXamPle.coM"))
+				r.Nil(subject.ClientCertificateAuthorities("wrong-host.com"))
+				r.Nil(subject.ClientCertificateAuthorities(""))
+
+				p3, err := provider.NewFederationDomainIssuer("https://127.0.0.1:8443/some/path", nil, nil)
+				r.NoError(err)
+				subject.SetProviders(p3)
+				r.Equal([]*x509.Certificate{caCert}, subject.ClientCertificateAuthorities("127.0.0.1"))
+				r.Equal([]*x509.Certificate{caCert}, subject.ClientCertificateAuthorities(""))
+				r.Nil(subject.ClientCertificateAuthorities("example.com"))
+			})
 		})
 
 		when("given the same valid providers as arguments to SetProviders() in reverse order", func() {
 			it.Before(func() {
-				p1, err := provider.NewFederationDomainIssuer(issuer1)
+				p1, err := provider.NewFederationDomainIssuer(issuer1, nil, nil)
 				r.NoError(err)
-				p2, err := provider.NewFederationDomainIssuer(issuer2)
+				p2, err := provider.NewFederationDomainIssuer(issuer2, nil, nil)
 				r.NoError(err)
 				subject.SetProviders(p2, p1)
 
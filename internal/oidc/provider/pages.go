@@ -0,0 +1,55 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"go.pinniped.dev/internal/oidc/provider/branding"
+	"go.pinniped.dev/internal/oidc/provider/consenthtml"
+	"go.pinniped.dev/internal/oidc/provider/formposthtml"
+	"go.pinniped.dev/internal/oidc/provider/loginhtml"
+)
+
+// Pages are the HTML pages which a FederationDomain serves to users.
+type Pages struct {
+	// FormPost is the response_type=form_post response page.
+	FormPost *branding.Page
+	// Login is the login page of LDAP and Active Directory upstreams.
+	Login *branding.Page
+	// Consent is the consent page of clients which are not trusted.
+	Consent *branding.Page
+}
+
+//nolint:gochecknoglobals // Parse the default pages only once.
+var defaultPages = mustPages(NewPages(nil))
+
+// DefaultPages returns the pages of FederationDomains without branding.
+func DefaultPages() *Pages { return defaultPages }
+
+// NewPages returns the pages with the branding, which may be nil for the default branding. It returns an error when
+// the branding overrides any template with an invalid template, or overrides a page which does not exist.
+func NewPages(b *branding.Branding) (*Pages, error) {
+	if err := b.ValidateTemplateOverrides(formposthtml.PageName, loginhtml.PageName, consenthtml.PageName); err != nil {
+		return nil, err
+	}
+	formPost, err := formposthtml.BrandedPage(b)
+	if err != nil {
+		return nil, err
+	}
+	login, err := loginhtml.BrandedPage(b)
+	if err != nil {
+		return nil, err
+	}
+	consent, err := consenthtml.BrandedPage(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Pages{FormPost: formPost, Login: login, Consent: consent}, nil
+}
+
+func mustPages(p *Pages, err error) *Pages {
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
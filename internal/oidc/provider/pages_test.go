@@ -0,0 +1,37 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/oidc/provider/branding"
+	"go.pinniped.dev/internal/oidc/provider/consenthtml"
+	"go.pinniped.dev/internal/oidc/provider/formposthtml"
+	"go.pinniped.dev/internal/oidc/provider/loginhtml"
+)
+
+func TestDefaultPages(t *testing.T) {
+	pages := DefaultPages()
+	require.Equal(t, formposthtml.ContentSecurityPolicy(), pages.FormPost.ContentSecurityPolicy())
+	require.Equal(t, loginhtml.ContentSecurityPolicy(), pages.Login.ContentSecurityPolicy())
+	require.Equal(t, consenthtml.ContentSecurityPolicy(), pages.Consent.ContentSecurityPolicy())
+}
+
+func TestNewPages(t *testing.T) {
+	pages, err := NewPages(&branding.Branding{DisplayName: "ACME Corp", PrimaryColor: "#1b3951"})
+	require.NoError(t, err)
+	require.NotEqual(t, loginhtml.ContentSecurityPolicy(), pages.Login.ContentSecurityPolicy())
+
+	pages, err = NewPages(&branding.Branding{TemplateOverrides: map[string]string{"logout": "<p>bye</p>"}})
+	require.EqualError(t, err, "logout.gohtml does not override any page, the pages are formPost, login, consent")
+	require.Nil(t, pages)
+
+	pages, err = NewPages(&branding.Branding{TemplateOverrides: map[string]string{"login": "<p>{{ .NotAField }}</p>"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "login.gohtml is not a valid template")
+	require.Nil(t, pages)
+}
@@ -0,0 +1,274 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package registration implements OAuth 2.0 Dynamic Client Registration (RFC 7591), which allows clients to register
+// themselves with the Supervisor instead of being configured by an admin. Only the holders of an initial access token
+// may register clients, and the registered clients expire after a while.
+package registration
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// InitialAccessTokenSecretType is the type of the Secrets which configure initial access tokens. Each of them
+	// is a Secret in the namespace of the Supervisor.
+	InitialAccessTokenSecretType corev1.SecretType = "secrets.pinniped.dev/supervisor-initial-access-token" //nolint:gosec // this is not a credential
+
+	// InitialAccessTokenSecretNamePrefix is the prefix of the names of the Secrets which configure initial access
+	// tokens. The rest of the name is the hex-encoded SHA-256 hash of the token, so that the Secret of a token can be
+	// read directly instead of searching all Secrets for it.
+	InitialAccessTokenSecretNamePrefix = "pinniped-initial-access-token-" //nolint:gosec // this is not a credential
+
+	// DefaultClientLifetime is how long registered clients may be used, unless the initial access token which was
+	// used to register them configures another lifetime.
+	DefaultClientLifetime = 24 * time.Hour
+
+	// The key of the data of the Secrets which configure initial access tokens.
+	clientLifetimeDataKey = "clientLifetime"
+
+	// maxRequestBodySize is much larger than the metadata of any reasonable client.
+	maxRequestBodySize = 64 * 1024
+
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange" //nolint:gosec // this is not a credential
+)
+
+var (
+	// errInvalidToken is the error of requests without a valid initial access token, as defined by RFC 6750.
+	errInvalidToken = &fosite.RFC6749Error{ //nolint:gochecknoglobals
+		ErrorField:       "invalid_token",
+		DescriptionField: "The initial access token is missing, invalid, or expired.",
+		CodeField:        http.StatusUnauthorized,
+	}
+
+	// errInvalidRedirectURI and errInvalidClientMetadata are the errors of invalid registration requests, as defined
+	// by RFC 7591.
+	errInvalidRedirectURI = &fosite.RFC6749Error{ //nolint:gochecknoglobals
+		ErrorField:       "invalid_redirect_uri",
+		DescriptionField: "The value of one or more redirect_uris is invalid.",
+		CodeField:        http.StatusBadRequest,
+	}
+	errInvalidClientMetadata = &fosite.RFC6749Error{ //nolint:gochecknoglobals
+		ErrorField:       "invalid_client_metadata",
+		DescriptionField: "The value of one of the client metadata fields is invalid.",
+		CodeField:        http.StatusBadRequest,
+	}
+)
+
+// clientMetadata holds the fields of the client metadata (RFC 7591 section 2) which the Supervisor supports. Other
+// fields are ignored, as allowed by RFC 7591.
+type clientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+}
+
+// clientInformation is the response to a successful registration (RFC 7591 section 3.2.1).
+type clientInformation struct {
+	ClientID              string `json:"client_id"`
+	ClientSecret          string `json:"client_secret"`
+	ClientIDIssuedAt      int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+	clientMetadata
+}
+
+// NewHandler returns an http.Handler that serves the client registration endpoint. Registered clients are stored as
+// the Secrets of confidential clients using the given client, which should be scoped to the namespace of the
+// Supervisor. The random IDs and secrets of the clients are read from rand.
+func NewHandler(oauthHelper fosite.OAuth2Provider, secrets corev1client.SecretInterface, clock func() time.Time, rand io.Reader) http.Handler {
+	return securityheader.Wrap(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try POST)", r.Method)
+		}
+
+		now := clock()
+		tokenSecretName, clientLifetime, err := authenticate(r, secrets, now)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			return writeError(w, oauthHelper, err)
+		}
+
+		var metadata clientMetadata
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize)).Decode(&metadata); err != nil {
+			return writeError(w, oauthHelper, errInvalidClientMetadata.WithHint("The request body must be a JSON object.").WithWrap(err).WithDebug(err.Error()))
+		}
+		if err := validate(&metadata); err != nil {
+			return writeError(w, oauthHelper, err)
+		}
+
+		clientID, clientSecret, err := generateCredentials(rand)
+		if err != nil {
+			return writeError(w, oauthHelper, fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+		secretHash, err := bcrypt.GenerateFromPassword([]byte(clientSecret), bcrypt.DefaultCost)
+		if err != nil {
+			return writeError(w, oauthHelper, fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+		expiresAt := now.Add(clientLifetime)
+		clientSecretObj := clientregistry.RegisteredClientSecret(clientID, secretHash, metadata.RedirectURIs, metadata.GrantTypes, expiresAt)
+		if _, err := secrets.Create(r.Context(), clientSecretObj, metav1.CreateOptions{}); err != nil {
+			plog.WarningErr("could not store registered client", err, "clientID", clientID)
+			return writeError(w, oauthHelper, fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+		plog.Info("registered client", "clientID", clientID, "initialAccessToken", tokenSecretName, "expiresAt", expiresAt)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		w.WriteHeader(http.StatusCreated)
+		return json.NewEncoder(w).Encode(&clientInformation{
+			ClientID:              clientID,
+			ClientSecret:          clientSecret,
+			ClientIDIssuedAt:      now.Unix(),
+			ClientSecretExpiresAt: expiresAt.Unix(),
+			clientMetadata:        metadata,
+		})
+	}))
+}
+
+// authenticate returns the name of the Secret of the initial access token of the request, and the lifetime of the
+// clients which it may register.
+func authenticate(r *http.Request, secrets corev1client.SecretInterface, now time.Time) (string, time.Duration, error) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) <= len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return "", 0, errInvalidToken.WithHint("The request must have a bearer token in the Authorization header.")
+	}
+	tokenHash := sha256.Sum256([]byte(authorization[len("Bearer "):]))
+
+	tokenSecret, err := secrets.Get(r.Context(), InitialAccessTokenSecretNamePrefix+hex.EncodeToString(tokenHash[:]), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", 0, errInvalidToken.WithHint("The initial access token is unknown.")
+	}
+	if err != nil {
+		return "", 0, fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+	}
+	if tokenSecret.Type != InitialAccessTokenSecretType {
+		return "", 0, errInvalidToken.WithHint("The initial access token is unknown.")
+	}
+
+	// Initial access tokens may expire in the same way as the other Secrets of the Supervisor.
+	if expiresAt, ok := tokenSecret.Annotations[crud.SecretLifetimeAnnotationKey]; ok {
+		expiry, err := time.Parse(crud.SecretLifetimeAnnotationDateFormat, expiresAt)
+		if err != nil || !now.Before(expiry) {
+			return "", 0, errInvalidToken.WithHint("The initial access token has expired.")
+		}
+	}
+
+	clientLifetime := DefaultClientLifetime
+	if clientLifetimeData := strings.TrimSpace(string(tokenSecret.Data[clientLifetimeDataKey])); clientLifetimeData != "" {
+		clientLifetime, err = time.ParseDuration(clientLifetimeData)
+		if err != nil || clientLifetime <= 0 {
+			plog.Warning("ignoring initial access token secret with invalid client lifetime", "secretName", tokenSecret.Name)
+			return "", 0, errInvalidToken.WithHint("The initial access token is not configured correctly.")
+		}
+	}
+	return tokenSecret.Name, clientLifetime, nil
+}
+
+// validate checks the metadata of a client and fills in the defaults of RFC 7591 for missing fields.
+func validate(metadata *clientMetadata) error {
+	switch metadata.TokenEndpointAuthMethod {
+	case "":
+		metadata.TokenEndpointAuthMethod = "client_secret_basic"
+	case "client_secret_basic":
+	default:
+		return errInvalidClientMetadata.WithHint("The token_endpoint_auth_method must be client_secret_basic.")
+	}
+
+	if len(metadata.GrantTypes) == 0 {
+		metadata.GrantTypes = []string{"authorization_code"}
+	}
+	hasAuthorizationCode := false
+	for _, grantType := range metadata.GrantTypes {
+		switch grantType {
+		case "authorization_code":
+			hasAuthorizationCode = true
+		case "refresh_token", tokenExchangeGrantType:
+		default:
+			return errInvalidClientMetadata.WithHintf("The grant type %q is not supported for registered clients.", grantType)
+		}
+	}
+	// Registered clients do not get an identity of their own, so they must log in users to get any tokens.
+	if !hasAuthorizationCode {
+		return errInvalidClientMetadata.WithHint("The grant_types must include authorization_code.")
+	}
+
+	if len(metadata.ResponseTypes) == 0 {
+		metadata.ResponseTypes = []string{"code"}
+	}
+	if len(metadata.ResponseTypes) != 1 || metadata.ResponseTypes[0] != "code" {
+		return errInvalidClientMetadata.WithHint("The response_types must be code.")
+	}
+
+	if len(metadata.RedirectURIs) == 0 {
+		return errInvalidRedirectURI.WithHint("At least one redirect URI is required.")
+	}
+	for _, redirectURI := range metadata.RedirectURIs {
+		if err := validateRedirectURI(redirectURI); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRedirectURI only allows HTTPS redirect URIs, except for loopback redirect URIs of native applications.
+func validateRedirectURI(redirectURI string) error {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || strings.ContainsAny(redirectURI, " \t\r\n") {
+		return errInvalidRedirectURI.WithHintf("The redirect URI %q must be an absolute URL without a fragment.", redirectURI)
+	}
+	switch parsed.Scheme {
+	case "https":
+		return nil
+	case "http":
+		hostname := parsed.Hostname()
+		if ip := net.ParseIP(hostname); hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+	}
+	return errInvalidRedirectURI.WithHintf("The redirect URI %q must use https, or http with a loopback address.", redirectURI)
+}
+
+// generateCredentials returns the random ID and secret of a new client.
+func generateCredentials(rand io.Reader) (string, string, error) {
+	var id [16]byte
+	if _, err := io.ReadFull(rand, id[:]); err != nil {
+		return "", "", fmt.Errorf("could not generate client ID: %w", err)
+	}
+	var secret [32]byte
+	if _, err := io.ReadFull(rand, secret[:]); err != nil {
+		return "", "", fmt.Errorf("could not generate client secret: %w", err)
+	}
+	return clientregistry.ConfidentialClientIDPrefix + hex.EncodeToString(id[:]), base64.RawURLEncoding.EncodeToString(secret[:]), nil
+}
+
+func writeError(w http.ResponseWriter, oauthHelper fosite.OAuth2Provider, err error) error {
+	plog.Info("client registration error", oidc.FositeErrorForLog(err)...)
+	oauthHelper.WriteAccessError(w, nil, err)
+	return nil
+}
@@ -0,0 +1,357 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registration
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/jwks"
+)
+
+func TestHandler(t *testing.T) {
+	const (
+		issuer       = "https://some-issuer.com"
+		namespace    = "some-namespace"
+		token        = "some-initial-access-token"
+		wantClientID = "client.oauth.pinniped.dev-61616161616161616161616161616161"
+		wantSecret   = "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE"
+	)
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+	oauthHelper := oidc.FositeOauth2Helper(oidc.NewNullStorage(fake.NewSimpleClientset().CoreV1().Secrets(namespace)), issuer, hmacSecretFunc, jwks.NewDynamicJWKSProvider(), oidc.DefaultOIDCTimeoutsConfiguration(), nil)
+
+	tokenHash := sha256.Sum256([]byte(token))
+	tokenSecret := func(data map[string][]byte, annotations map[string]string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pinniped-initial-access-token-" + hex.EncodeToString(tokenHash[:]),
+				Namespace:   namespace,
+				Annotations: annotations,
+			},
+			Type: InitialAccessTokenSecretType,
+			Data: data,
+		}
+	}
+	otherTokenSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "pinniped-initial-access-token-some-other-hash", Namespace: namespace},
+		Type:       InitialAccessTokenSecretType,
+	}
+
+	tests := []struct {
+		name            string
+		method          string
+		authorization   string
+		body            string
+		secrets         []*corev1.Secret
+		getErr          error
+		createErr       error
+		rand            io.Reader
+		wantStatus      int
+		wantContentType string
+		wantBodyJSON    string
+		wantBodyString  string
+		wantLifetime    time.Duration
+	}{
+		{
+			name:            "happy path with defaults",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["https://app.example.com/callback"], "client_name": "ignored"}`,
+			secrets:         []*corev1.Secret{otherTokenSecret, tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusCreated,
+			wantContentType: "application/json",
+			wantBodyJSON: `{
+				"client_id": "` + wantClientID + `",
+				"client_secret": "` + wantSecret + `",
+				"client_id_issued_at": 1893456000,
+				"client_secret_expires_at": 1893542400,
+				"redirect_uris": ["https://app.example.com/callback"],
+				"token_endpoint_auth_method": "client_secret_basic",
+				"grant_types": ["authorization_code"],
+				"response_types": ["code"]
+			}`,
+			wantLifetime: DefaultClientLifetime,
+		},
+		{
+			name:          "happy path with all fields and a configured client lifetime",
+			method:        http.MethodPost,
+			authorization: "bearer " + token,
+			body: `{
+				"redirect_uris": ["https://app.example.com/callback", "http://127.0.0.1/callback", "http://[::1]:1234/callback"],
+				"token_endpoint_auth_method": "client_secret_basic",
+				"grant_types": ["authorization_code", "refresh_token", "urn:ietf:params:oauth:grant-type:token-exchange"],
+				"response_types": ["code"]
+			}`,
+			secrets: []*corev1.Secret{tokenSecret(
+				map[string][]byte{"clientLifetime": []byte(" 2h ")},
+				map[string]string{"storage.pinniped.dev/garbage-collect-after": "2030-01-02T00:00:00Z"},
+			)},
+			wantStatus:      http.StatusCreated,
+			wantContentType: "application/json",
+			wantBodyJSON: `{
+				"client_id": "` + wantClientID + `",
+				"client_secret": "` + wantSecret + `",
+				"client_id_issued_at": 1893456000,
+				"client_secret_expires_at": 1893463200,
+				"redirect_uris": ["https://app.example.com/callback", "http://127.0.0.1/callback", "http://[::1]:1234/callback"],
+				"token_endpoint_auth_method": "client_secret_basic",
+				"grant_types": ["authorization_code", "refresh_token", "urn:ietf:params:oauth:grant-type:token-exchange"],
+				"response_types": ["code"]
+			}`,
+			wantLifetime: 2 * time.Hour,
+		},
+		{
+			name:            "wrong method",
+			method:          http.MethodGet,
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Method Not Allowed: GET (try POST)\n",
+		},
+		{
+			name:            "no initial access token",
+			method:          http.MethodPost,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_token","error_description":"The initial access token is missing, invalid, or expired. The request must have a bearer token in the Authorization header."}`,
+		},
+		{
+			name:            "unknown initial access token",
+			method:          http.MethodPost,
+			authorization:   "Bearer some-other-token",
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_token","error_description":"The initial access token is missing, invalid, or expired. The initial access token is unknown."}`,
+		},
+		{
+			name:          "initial access token in a Secret of the wrong type",
+			method:        http.MethodPost,
+			authorization: "Bearer " + token,
+			secrets: func() []*corev1.Secret {
+				s := tokenSecret(map[string][]byte{}, nil)
+				s.Type = corev1.SecretTypeOpaque
+				return []*corev1.Secret{s}
+			}(),
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_token","error_description":"The initial access token is missing, invalid, or expired. The initial access token is unknown."}`,
+		},
+		{
+			name:          "expired initial access token",
+			method:        http.MethodPost,
+			authorization: "Bearer " + token,
+			secrets: []*corev1.Secret{tokenSecret(
+				map[string][]byte{},
+				map[string]string{"storage.pinniped.dev/garbage-collect-after": "2030-01-01T00:00:00Z"},
+			)},
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_token","error_description":"The initial access token is missing, invalid, or expired. The initial access token has expired."}`,
+		},
+		{
+			name:            "initial access token with an invalid client lifetime",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{"clientLifetime": []byte("-1h")}, nil)},
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_token","error_description":"The initial access token is missing, invalid, or expired. The initial access token is not configured correctly."}`,
+		},
+		{
+			name:            "error getting the initial access token",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			getErr:          errors.New("some get error"),
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"server_error","error_description":"The authorization server encountered an unexpected condition that prevented it from fulfilling the request."}`,
+		},
+		{
+			name:            "body is not JSON",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `redirect_uris=https://app.example.com/callback`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_client_metadata","error_description":"The value of one of the client metadata fields is invalid. The request body must be a JSON object."}`,
+		},
+		{
+			name:            "unsupported token endpoint auth method",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["https://app.example.com/callback"], "token_endpoint_auth_method": "none"}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_client_metadata","error_description":"The value of one of the client metadata fields is invalid. The token_endpoint_auth_method must be client_secret_basic."}`,
+		},
+		{
+			name:            "client credentials grant",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["https://app.example.com/callback"], "grant_types": ["authorization_code", "client_credentials"]}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_client_metadata","error_description":"The value of one of the client metadata fields is invalid. The grant type 'client_credentials' is not supported for registered clients."}`,
+		},
+		{
+			name:            "no authorization code grant",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["https://app.example.com/callback"], "grant_types": ["refresh_token"]}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_client_metadata","error_description":"The value of one of the client metadata fields is invalid. The grant_types must include authorization_code."}`,
+		},
+		{
+			name:            "unsupported response type",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["https://app.example.com/callback"], "response_types": ["code", "id_token"]}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_client_metadata","error_description":"The value of one of the client metadata fields is invalid. The response_types must be code."}`,
+		},
+		{
+			name:            "no redirect URIs",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_redirect_uri","error_description":"The value of one or more redirect_uris is invalid. At least one redirect URI is required."}`,
+		},
+		{
+			name:            "relative redirect URI",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["/callback"]}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_redirect_uri","error_description":"The value of one or more redirect_uris is invalid. The redirect URI '/callback' must be an absolute URL without a fragment."}`,
+		},
+		{
+			name:            "http redirect URI which is not a loopback address",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["https://app.example.com/callback", "http://app.example.com/callback"]}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"invalid_redirect_uri","error_description":"The value of one or more redirect_uris is invalid. The redirect URI 'http://app.example.com/callback' must use https, or http with a loopback address."}`,
+		},
+		{
+			name:            "error generating credentials",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["https://app.example.com/callback"]}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			rand:            &bytes.Buffer{},
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"server_error","error_description":"The authorization server encountered an unexpected condition that prevented it from fulfilling the request."}`,
+		},
+		{
+			name:            "error creating the client Secret",
+			method:          http.MethodPost,
+			authorization:   "Bearer " + token,
+			body:            `{"redirect_uris": ["https://app.example.com/callback"]}`,
+			secrets:         []*corev1.Secret{tokenSecret(map[string][]byte{}, nil)},
+			createErr:       errors.New("some create error"),
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON:    `{"error":"server_error","error_description":"The authorization server encountered an unexpected condition that prevented it from fulfilling the request."}`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			for _, secret := range tt.secrets {
+				require.NoError(t, kubeClient.Tracker().Add(secret))
+			}
+			if tt.getErr != nil {
+				kubeClient.PrependReactor("get", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.getErr
+				})
+			}
+			if tt.createErr != nil {
+				kubeClient.PrependReactor("create", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.createErr
+				})
+			}
+			secrets := kubeClient.CoreV1().Secrets(namespace)
+			rand := tt.rand
+			if rand == nil {
+				rand = bytes.NewReader(bytes.Repeat([]byte{'a'}, 64))
+			}
+
+			req := httptest.NewRequest(tt.method, "/some/path", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rsp := httptest.NewRecorder()
+			NewHandler(oauthHelper, secrets, func() time.Time { return now }, rand).ServeHTTP(rsp, req)
+
+			require.Equal(t, tt.wantStatus, rsp.Code)
+			require.Equal(t, tt.wantContentType, rsp.Header().Get("Content-Type"))
+			if tt.wantBodyString != "" {
+				require.Equal(t, tt.wantBodyString, rsp.Body.String())
+				return
+			}
+			require.JSONEq(t, tt.wantBodyJSON, rsp.Body.String())
+			require.Equal(t, "no-store", rsp.Header().Get("Cache-Control"))
+
+			if tt.wantStatus == http.StatusUnauthorized {
+				require.Equal(t, `Bearer error="invalid_token"`, rsp.Header().Get("WWW-Authenticate"))
+			}
+			if tt.wantStatus != http.StatusCreated {
+				_, err := secrets.Get(context.Background(), wantClientID, metav1.GetOptions{})
+				require.Error(t, err)
+				return
+			}
+
+			// The registered client is a confidential client which expires after the lifetime.
+			clientSecret, err := secrets.Get(context.Background(), wantClientID, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, clientregistry.ConfidentialClientSecretType, clientSecret.Type)
+			require.Equal(t, now.Add(tt.wantLifetime).Format(time.RFC3339), clientSecret.Annotations["storage.pinniped.dev/garbage-collect-after"])
+			require.NoError(t, bcrypt.CompareHashAndPassword(clientSecret.Data["clientSecretHashes"], []byte(wantSecret)))
+
+			client, err := clientregistry.NewKubeClientManager(secrets).GetClient(context.Background(), wantClientID)
+			require.NoError(t, err)
+			require.NotContains(t, client.GetGrantTypes(), "client_credentials")
+			require.Equal(t, fosite.Arguments{"code"}, client.GetResponseTypes())
+		})
+	}
+}
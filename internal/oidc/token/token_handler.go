@@ -6,17 +6,24 @@ package token
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/ory/fosite"
 	"github.com/ory/x/errorsx"
 	"golang.org/x/oauth2"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apiserver/pkg/warning"
 
+	"go.pinniped.dev/internal/fositestorage/refreshtoken"
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/consent"
 	"go.pinniped.dev/internal/oidc/downstreamsession"
+	"go.pinniped.dev/internal/oidc/dpop"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/psession"
@@ -40,22 +47,49 @@ var (
 func NewHandler(
 	idpLister oidc.UpstreamIdentityProvidersLister,
 	oauthHelper fosite.OAuth2Provider,
+	consentStorage *consent.Storage,
+	tokenEndpointURL string,
+	dpopReplayCache *dpop.ReplayCache,
 ) http.Handler {
 	return httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		session := psession.NewPinnipedSession()
 		accessRequest, err := oauthHelper.NewAccessRequest(r.Context(), r, session)
+		var reusedRefreshTokenErr *refreshtoken.ReusedRefreshTokenError
+		if errors.As(err, &reusedRefreshTokenErr) {
+			// Fosite has already revoked all downstream tokens of the session.
+			revokeSessionAfterRefreshTokenReuse(r.Context(), reusedRefreshTokenErr, idpLister)
+			err = errorsx.WithStack(fosite.ErrInvalidGrant.WithHint(
+				"The refresh token was already used, so all tokens of the session were revoked.",
+			).WithWrap(err).WithDebug(err.Error()))
+		}
 		if err != nil {
 			plog.Info("token request error", oidc.FositeErrorForLog(err)...)
 			oauthHelper.WriteAccessError(w, accessRequest, err)
 			return nil
 		}
 
+		// Verify the DPoP proof of the request before any tokens are issued. The fosite handlers which need to know
+		// the key of the proof, like the token exchange handler, get it from the context.
+		dpopThumbprint, err := checkDPoP(r, accessRequest, tokenEndpointURL, dpopReplayCache)
+		if err != nil {
+			plog.Info("DPoP proof error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteAccessError(w, accessRequest, err)
+			return nil
+		}
+		ctx := dpop.WithThumbprint(r.Context(), dpopThumbprint)
+
 		// Check if we are performing a refresh grant.
 		if accessRequest.GetGrantTypes().ExactOne("refresh_token") {
 			// The above call to NewAccessRequest has loaded the session from storage into the accessRequest variable.
 			// The session, requested scopes, and requested audience from the original authorize request was retrieved
 			// from the Kube storage layer and added to the accessRequest. Additionally, the audience and scopes may
 			// have already been granted on the accessRequest.
+			err = checkConsent(r.Context(), accessRequest, consentStorage)
+			if err != nil {
+				plog.Info("consent check error", oidc.FositeErrorForLog(err)...)
+				oauthHelper.WriteAccessError(w, accessRequest, err)
+				return nil
+			}
 			err = upstreamRefresh(r.Context(), accessRequest, idpLister)
 			if err != nil {
 				plog.Info("upstream refresh error", oidc.FositeErrorForLog(err)...)
@@ -64,6 +98,19 @@ func NewHandler(
 			}
 		}
 
+		// Check if we are performing a client credentials grant.
+		if accessRequest.GetGrantTypes().ExactOne("client_credentials") {
+			// The above call to NewAccessRequest has authenticated the confidential client and validated the requested
+			// scopes, but the session is still empty, since there is no user involved. The identity of the session is
+			// the identity of the client instead.
+			err = clientCredentialsSession(accessRequest)
+			if err != nil {
+				plog.Info("client credentials error", oidc.FositeErrorForLog(err)...)
+				oauthHelper.WriteAccessError(w, accessRequest, err)
+				return nil
+			}
+		}
+
 		// When we are in the authorization code flow, check if we have any warnings that previous handlers want us
 		// to send to the client to be printed on the CLI.
 		if accessRequest.GetGrantTypes().ExactOne("authorization_code") {
@@ -76,19 +123,150 @@ func NewHandler(
 			}
 		}
 
-		accessResponse, err := oauthHelper.NewAccessResponse(r.Context(), accessRequest)
+		accessResponse, err := oauthHelper.NewAccessResponse(ctx, accessRequest)
 		if err != nil {
 			plog.Info("token response error", oidc.FositeErrorForLog(err)...)
 			oauthHelper.WriteAccessError(w, accessRequest, err)
 			return nil
 		}
 
+		// The token exchange issues a JWT for a cluster, which is not bound to the key, but the other grants issue
+		// access tokens which are bound to the key.
+		if dpopThumbprint != "" && !accessRequest.GetGrantTypes().ExactOne("urn:ietf:params:oauth:grant-type:token-exchange") {
+			accessResponse.SetTokenType(dpop.TokenType)
+		}
+
 		oauthHelper.WriteAccessResponse(w, accessRequest, accessResponse)
 
 		return nil
 	})
 }
 
+// checkConsent rejects refreshes by clients which are not trusted when the user has revoked their consent to the
+// client, or their consent has expired.
+func checkConsent(ctx context.Context, accessRequest fosite.AccessRequester, consentStorage *consent.Storage) error {
+	if client, ok := accessRequest.GetClient().(*clientregistry.Client); ok && client.Trusted {
+		return nil
+	}
+
+	session := accessRequest.GetSession().(*psession.PinnipedSession)
+	hasConsent, err := consentStorage.HasConsent(ctx, session.Fosite.Claims.Subject, accessRequest.GetClient().GetID(), accessRequest.GetGrantedScopes())
+	if err != nil {
+		return errorsx.WithStack(fosite.ErrServerError.WithHint("Could not read the consent of the user.").WithWrap(err).WithDebug(err.Error()))
+	}
+	if !hasConsent {
+		return errorsx.WithStack(fosite.ErrAccessDenied.WithHint("The user has revoked their consent to the client, or it has expired."))
+	}
+	return nil
+}
+
+// revokeSessionAfterRefreshTokenReuse logs the reuse of a refresh token, which was probably stolen, and revokes the
+// latest upstream tokens of the session, since the user will have to log in again anyway.
+func revokeSessionAfterRefreshTokenReuse(
+	ctx context.Context,
+	reusedErr *refreshtoken.ReusedRefreshTokenError,
+	idpLister oidc.UpstreamIdentityProvidersLister,
+) {
+	request := reusedErr.Request
+	if reusedErr.Latest != nil {
+		request = reusedErr.Latest
+	}
+	session := request.GetSession().(*psession.PinnipedSession)
+
+	keysAndValues := []interface{}{
+		"clientID", request.GetClient().GetID(),
+		"requestID", request.GetID(),
+		"subject", session.Fosite.Claims.Subject,
+		"username", session.Fosite.Claims.Extra[oidc.DownstreamUsernameClaim],
+	}
+	if session.Custom != nil {
+		keysAndValues = append(keysAndValues,
+			"providerName", session.Custom.ProviderName, "providerType", session.Custom.ProviderType)
+	}
+	plog.Error("refresh token reuse detected, revoked all tokens of the session since the refresh token was probably stolen",
+		reusedErr, keysAndValues...)
+
+	if err := revokeUpstreamOIDCTokens(ctx, session.Custom, idpLister); err != nil {
+		plog.WarningErr("could not revoke upstream OIDC tokens after refresh token reuse", err, keysAndValues...)
+	}
+}
+
+// revokeUpstreamOIDCTokens revokes the upstream tokens of the session when the upstream is an OIDC provider. Other
+// types of upstreams do not give us tokens which can be revoked.
+func revokeUpstreamOIDCTokens(ctx context.Context, s *psession.CustomSessionData, idpLister oidc.UpstreamIdentityProvidersLister) error {
+	if s == nil || s.ProviderType != psession.ProviderTypeOIDC || s.OIDC == nil {
+		return nil
+	}
+
+	found, err := findProviderByNameAndValidateUID(s, idpLister)
+	if err != nil {
+		return err
+	}
+	p := found.(provider.UpstreamOIDCIdentityProviderI)
+
+	if s.OIDC.UpstreamRefreshToken != "" {
+		if err := p.RevokeToken(ctx, s.OIDC.UpstreamRefreshToken, provider.RefreshTokenType); err != nil {
+			return err
+		}
+	}
+	if s.OIDC.UpstreamAccessToken != "" {
+		if err := p.RevokeToken(ctx, s.OIDC.UpstreamAccessToken, provider.AccessTokenType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDPoP verifies the DPoP proof of the request, if any, and binds the tokens which are issued by the request to
+// the key of the proof. It returns the thumbprint of the key, or an empty string when the request has no proof.
+func checkDPoP(r *http.Request, accessRequest fosite.AccessRequester, tokenEndpointURL string, replayCache *dpop.ReplayCache) (string, error) {
+	thumbprint, err := dpop.VerifyProof(r, tokenEndpointURL, time.Now(), replayCache)
+	if err != nil {
+		return "", err
+	}
+
+	if client, ok := accessRequest.GetClient().(*clientregistry.Client); ok && client.RequireDPoP && thumbprint == "" {
+		return "", dpop.ErrInvalidProof.WithHintf("The client requires a %s header.", dpop.HeaderName)
+	}
+
+	// During a refresh grant, the session was loaded from the storage of the refresh token, so the refresh token
+	// may only be used with a proof of the key which it is bound to. The new tokens are bound to the same key.
+	session := accessRequest.GetSession().(*psession.PinnipedSession)
+	if err := dpop.CheckBinding(session.DPoPJKT, thumbprint); err != nil {
+		return "", err
+	}
+	if thumbprint != "" {
+		session.DPoPJKT = thumbprint
+	}
+	return thumbprint, nil
+}
+
+func clientCredentialsSession(accessRequest fosite.AccessRequester) error {
+	client, ok := accessRequest.GetClient().(*clientregistry.Client)
+	if !ok {
+		return errorsx.WithStack(fosite.ErrServerError.WithHint("Unexpected type of client."))
+	}
+
+	for _, scope := range accessRequest.GetRequestedScopes() {
+		accessRequest.GrantScope(scope)
+	}
+
+	groups := client.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	now := time.Now().UTC()
+	session := accessRequest.GetSession().(*psession.PinnipedSession)
+	session.Fosite.Claims.Subject = client.GetID()
+	session.Fosite.Claims.RequestedAt = now
+	session.Fosite.Claims.AuthTime = now
+	session.Fosite.Claims.Extra = map[string]interface{}{
+		oidc.DownstreamUsernameClaim: client.Username,
+		oidc.DownstreamGroupsClaim:   groups,
+	}
+	return nil
+}
+
 func upstreamRefresh(ctx context.Context, accessRequest fosite.AccessRequester, providerCache oidc.UpstreamIdentityProvidersLister) error {
 	session := accessRequest.GetSession().(*psession.PinnipedSession)
 
@@ -109,6 +287,12 @@ func upstreamRefresh(ctx context.Context, accessRequest fosite.AccessRequester,
 		return upstreamLDAPRefresh(ctx, providerCache, session)
 	case psession.ProviderTypeActiveDirectory:
 		return upstreamLDAPRefresh(ctx, providerCache, session)
+	case psession.ProviderTypeGitHub:
+		return upstreamGitHubRefresh(ctx, session, providerCache)
+	case psession.ProviderTypeSAML:
+		return upstreamSAMLRefresh(session, providerCache)
+	case psession.ProviderTypeCertificate:
+		return upstreamCertificateRefresh(session, providerCache)
 	default:
 		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
 	}
@@ -128,10 +312,11 @@ func upstreamOIDCRefresh(ctx context.Context, session *psession.PinnipedSession,
 		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
 	}
 
-	p, err := findOIDCProviderByNameAndValidateUID(s, providerCache)
+	found, err := findProviderByNameAndValidateUID(s, providerCache)
 	if err != nil {
 		return err
 	}
+	p := found.(provider.UpstreamOIDCIdentityProviderI)
 
 	plog.Debug("attempting upstream refresh request",
 		"providerName", s.ProviderName, "providerType", s.ProviderType, "providerUID", s.ProviderUID)
@@ -251,15 +436,52 @@ func getString(m map[string]interface{}, key string) (string, bool) {
 	return val, ok
 }
 
-func findOIDCProviderByNameAndValidateUID(
+// upstreamProvider is the part of the interfaces of all types of upstream providers which identifies the provider.
+type upstreamProvider interface {
+	GetName() string
+	GetResourceUID() types.UID
+}
+
+// findProviderByNameAndValidateUID returns the upstream provider of the session, which may be asserted to be the
+// interface for the type of provider in the session.
+func findProviderByNameAndValidateUID(
 	s *psession.CustomSessionData,
 	providerCache oidc.UpstreamIdentityProvidersLister,
-) (provider.UpstreamOIDCIdentityProviderI, error) {
-	for _, p := range providerCache.GetOIDCIdentityProviders() {
+) (upstreamProvider, error) {
+	var providers []upstreamProvider
+	switch s.ProviderType {
+	case psession.ProviderTypeOIDC:
+		for _, p := range providerCache.GetOIDCIdentityProviders() {
+			providers = append(providers, p)
+		}
+	case psession.ProviderTypeLDAP:
+		for _, p := range providerCache.GetLDAPIdentityProviders() {
+			providers = append(providers, p)
+		}
+	case psession.ProviderTypeActiveDirectory:
+		for _, p := range providerCache.GetActiveDirectoryIdentityProviders() {
+			providers = append(providers, p)
+		}
+	case psession.ProviderTypeGitHub:
+		for _, p := range providerCache.GetGitHubIdentityProviders() {
+			providers = append(providers, p)
+		}
+	case psession.ProviderTypeSAML:
+		for _, p := range providerCache.GetSAMLIdentityProviders() {
+			providers = append(providers, p)
+		}
+	case psession.ProviderTypeCertificate:
+		for _, p := range providerCache.GetCertificateIdentityProviders() {
+			providers = append(providers, p)
+		}
+	}
+
+	for _, p := range providers {
 		if p.GetName() == s.ProviderName {
 			if p.GetResourceUID() != s.ProviderUID {
 				return nil, errorsx.WithStack(errUpstreamRefreshError.WithHint(
-					"Provider from upstream session data has changed its resource UID since authentication."))
+					"Provider from upstream session data has changed its resource UID since authentication.").
+					WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
 			}
 			return p, nil
 		}
@@ -286,22 +508,26 @@ func upstreamLDAPRefresh(ctx context.Context, providerCache oidc.UpstreamIdentit
 	}
 
 	var additionalAttributes map[string]string
+	var dn string
 	if s.ProviderType == psession.ProviderTypeLDAP {
 		additionalAttributes = s.LDAP.ExtraRefreshAttributes
+		dn = s.LDAP.UserDN
 	} else {
 		additionalAttributes = s.ActiveDirectory.ExtraRefreshAttributes
+		dn = s.ActiveDirectory.UserDN
 	}
 
 	// get ldap/ad provider out of cache
-	p, dn, err := findLDAPProviderByNameAndValidateUID(s, providerCache)
+	found, err := findProviderByNameAndValidateUID(s, providerCache)
 	if err != nil {
 		return err
 	}
+	p := found.(provider.UpstreamLDAPIdentityProviderI)
 	if session.IDTokenClaims().AuthTime.IsZero() {
 		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
 	}
 	// run PerformRefresh
-	err = p.PerformRefresh(ctx, provider.StoredRefreshAttributes{
+	refreshedGroups, err := p.PerformRefresh(ctx, provider.StoredRefreshAttributes{
 		Username:             username,
 		Subject:              subject,
 		DN:                   dn,
@@ -313,37 +539,135 @@ func upstreamLDAPRefresh(ctx context.Context, providerCache oidc.UpstreamIdentit
 			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
 	}
 
+	// The group search during refresh is the same as during login, so its result is the complete list of the
+	// user's current group memberships, even when the user no longer belongs to any groups.
+	if refreshedGroups == nil {
+		refreshedGroups = []string{}
+	}
+	session.Fosite.Claims.Extra[oidc.DownstreamGroupsClaim] = refreshedGroups
+
 	return nil
 }
 
-func findLDAPProviderByNameAndValidateUID(
-	s *psession.CustomSessionData,
-	providerCache oidc.UpstreamIdentityProvidersLister,
-) (provider.UpstreamLDAPIdentityProviderI, string, error) {
-	var providers []provider.UpstreamLDAPIdentityProviderI
-	var dn string
-	if s.ProviderType == psession.ProviderTypeLDAP {
-		providers = providerCache.GetLDAPIdentityProviders()
-		dn = s.LDAP.UserDN
-	} else if s.ProviderType == psession.ProviderTypeActiveDirectory {
-		providers = providerCache.GetActiveDirectoryIdentityProviders()
-		dn = s.ActiveDirectory.UserDN
+func upstreamGitHubRefresh(ctx context.Context, session *psession.PinnipedSession, providerCache oidc.UpstreamIdentityProvidersLister) error {
+	s := session.Custom
+	if s.GitHub == nil || s.GitHub.UpstreamAccessToken == "" {
+		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
 	}
 
-	for _, p := range providers {
-		if p.GetName() == s.ProviderName {
-			if p.GetResourceUID() != s.ProviderUID {
-				return nil, "", errorsx.WithStack(errUpstreamRefreshError.WithHint(
-					"Provider from upstream session data has changed its resource UID since authentication.").
-					WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
-			}
-			return p, dn, nil
+	oldUsername, err := getDownstreamUsernameFromPinnipedSession(session)
+	if err != nil {
+		return err
+	}
+
+	found, err := findProviderByNameAndValidateUID(s, providerCache)
+	if err != nil {
+		return err
+	}
+	p := found.(provider.UpstreamGitHubIdentityProviderI)
+
+	plog.Debug("attempting upstream refresh request",
+		"providerName", s.ProviderName, "providerType", s.ProviderType, "providerUID", s.ProviderUID)
+
+	// GitHub does not issue refresh tokens to OAuth apps, so instead use the stored access token to look up the user
+	// again. This fails when the user has revoked the authorization, and also re-checks the allowed organizations.
+	user, err := p.GetUser(ctx, s.GitHub.UpstreamAccessToken)
+	if err != nil {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHint(
+			"Upstream refresh failed.").WithWrap(err).
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+
+	if user.DownstreamSubject != session.Fosite.Claims.Subject {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHint(
+			"Upstream refresh failed.").WithWrap(errors.New("user ID in upstream refresh does not match previous value")).
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+	if user.Username != oldUsername {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHint(
+			"Upstream refresh failed.").WithWrap(errors.New("username in upstream refresh does not match previous value")).
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+
+	// Update the user's group memberships, since they may have joined or left teams since their initial login.
+	session.Fosite.Claims.Extra[oidc.DownstreamGroupsClaim] = user.Groups
+
+	return nil
+}
+
+func upstreamSAMLRefresh(session *psession.PinnipedSession, providerCache oidc.UpstreamIdentityProvidersLister) error {
+	s := session.Custom
+	if s.SAML == nil {
+		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
+	}
+
+	if _, err := findProviderByNameAndValidateUID(s, providerCache); err != nil {
+		return err
+	}
+
+	// SAML has no way to ask the identity provider whether the user's session is still valid without involving
+	// the user's browser, so instead allow refreshes only for as long as the identity provider vouched for the session.
+	// When the identity provider did not limit the session, the usual lifetime of the downstream session applies.
+	if !s.SAML.SessionExpiry.IsZero() && !time.Now().Before(s.SAML.SessionExpiry) {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHint(
+			"Upstream session has expired.").
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+
+	return nil
+}
+
+func upstreamCertificateRefresh(session *psession.PinnipedSession, providerCache oidc.UpstreamIdentityProvidersLister) error {
+	s := session.Custom
+	if s.Certificate == nil || len(s.Certificate.PeerCertificates) == 0 {
+		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
+	}
+
+	oldUsername, err := getDownstreamUsernameFromPinnipedSession(session)
+	if err != nil {
+		return err
+	}
+
+	found, err := findProviderByNameAndValidateUID(s, providerCache)
+	if err != nil {
+		return err
+	}
+	p := found.(provider.UpstreamCertificateIdentityProviderI)
+
+	peerCertificates := make([]*x509.Certificate, 0, len(s.Certificate.PeerCertificates))
+	for _, der := range s.Certificate.PeerCertificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errorsx.WithStack(errMissingUpstreamSessionInternalError)
 		}
+		peerCertificates = append(peerCertificates, cert)
 	}
 
-	return nil, "", errorsx.WithStack(errUpstreamRefreshError.
-		WithHint("Provider from upstream session data was not found.").
-		WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	// The client certificate is not presented again on refresh, so instead verify the certificate which was presented
+	// during the initial login again. This fails once it has expired or been revoked, or when the identity provider
+	// no longer trusts its issuer.
+	user, err := p.AuthenticateCertificate(peerCertificates)
+	if err != nil {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHint(
+			"Upstream refresh failed.").WithWrap(err).
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+
+	if user.DownstreamSubject != session.Fosite.Claims.Subject {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHint(
+			"Upstream refresh failed.").WithWrap(errors.New("subject in upstream refresh does not match previous value")).
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+	if user.Username != oldUsername {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHint(
+			"Upstream refresh failed.").WithWrap(errors.New("username in upstream refresh does not match previous value")).
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+
+	// The certificate cannot change, but the identity provider's configuration of the groups field may have.
+	session.Fosite.Claims.Extra[oidc.DownstreamGroupsClaim] = user.Groups
+
+	return nil
 }
 
 func getDownstreamUsernameFromPinnipedSession(session *psession.PinnipedSession) (string, error) {
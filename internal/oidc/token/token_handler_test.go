@@ -4,11 +4,13 @@
 package token
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base32"
 	"encoding/base64"
 	"encoding/json"
@@ -29,14 +31,17 @@ import (
 	"github.com/ory/fosite/token/jwt"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2"
 	josejwt "gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes/fake"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 
+	"go.pinniped.dev/internal/certauthority"
 	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage/accesstoken"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
@@ -47,11 +52,15 @@ import (
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/consent"
+	supervisordpop "go.pinniped.dev/internal/oidc/dpop"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/oidctestutil"
+	"go.pinniped.dev/pkg/oidcclient/dpop"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 )
 
@@ -234,6 +243,11 @@ type expectedUpstreamValidateTokens struct {
 	args                    *oidctestutil.ValidateTokenAndMergeWithUserInfoArgs
 }
 
+type expectedUpstreamGetUser struct {
+	performedByUpstreamName string
+	args                    *oidctestutil.GetUserArgs
+}
+
 type tokenEndpointResponseExpectedValues struct {
 	wantStatus                        int
 	wantSuccessBodyFields             []string
@@ -243,6 +257,7 @@ type tokenEndpointResponseExpectedValues struct {
 	wantGroups                        []string
 	wantUpstreamRefreshCall           *expectedUpstreamRefresh
 	wantUpstreamOIDCValidateTokenCall *expectedUpstreamValidateTokens
+	wantUpstreamGitHubGetUserCall     *expectedUpstreamGetUser
 	wantCustomSessionDataStored       *psession.CustomSessionData
 }
 
@@ -626,6 +641,191 @@ func TestTokenEndpointWhenAuthcodeIsUsedTwice(t *testing.T) {
 	}
 }
 
+func TestRefreshGrantWhenRefreshTokenIsUsedTwice(t *testing.T) {
+	const (
+		oidcUpstreamName                  = "some-oidc-idp"
+		oidcUpstreamResourceUID           = "oidc-resource-uid"
+		oidcUpstreamRefreshedRefreshToken = "fake-refreshed-refresh-token"
+	)
+
+	idps := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+		oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+			WithName(oidcUpstreamName).
+			WithResourceUID(oidcUpstreamResourceUID).
+			WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+				IDToken: &oidctypes.IDToken{Claims: map[string]interface{}{"sub": goodUpstreamSubject}},
+			}).
+			WithRefreshedTokens(&oauth2.Token{AccessToken: "fake-refreshed-access-token", RefreshToken: oidcUpstreamRefreshedRefreshToken}).
+			Build(),
+	)
+	customSessionData := &psession.CustomSessionData{
+		ProviderName: oidcUpstreamName,
+		ProviderUID:  oidcUpstreamResourceUID,
+		ProviderType: psession.ProviderTypeOIDC,
+		OIDC: &psession.OIDCSessionData{
+			UpstreamRefreshToken: "initial-upstream-refresh-token",
+			UpstreamSubject:      goodUpstreamSubject,
+			UpstreamIssuer:       goodIssuer,
+		},
+	}
+
+	subject, rsp, _, _, secrets, _ := exchangeAuthcodeForTokens(t, authcodeExchangeInputs{
+		customSessionData: customSessionData,
+		modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+		want: tokenEndpointResponseExpectedValues{
+			wantStatus:                  http.StatusOK,
+			wantSuccessBodyFields:       []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
+			wantRequestedScopes:         []string{"openid", "offline_access"},
+			wantGrantedScopes:           []string{"openid", "offline_access"},
+			wantCustomSessionDataStored: customSessionData,
+			wantGroups:                  goodGroups,
+		},
+	}, idps.Build())
+	var authcodeExchangeResponseBody map[string]interface{}
+	require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &authcodeExchangeResponseBody))
+
+	reqContext := context.WithValue(context.Background(), struct{ name string }{name: "test"}, "request-context")
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/path/shouldn't/matter",
+			happyRefreshRequestBody(refreshToken).ReadCloser()).WithContext(reqContext)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		refreshResponse := httptest.NewRecorder()
+		subject.ServeHTTP(refreshResponse, req)
+		return refreshResponse
+	}
+
+	// The client uses its first refresh token to get new tokens, which replaces the first refresh token.
+	firstRefreshToken := authcodeExchangeResponseBody["refresh_token"].(string)
+	refreshResponse := refresh(firstRefreshToken)
+	require.Equal(t, http.StatusOK, refreshResponse.Code)
+	var refreshResponseBody map[string]interface{}
+	require.NoError(t, json.Unmarshal(refreshResponse.Body.Bytes(), &refreshResponseBody))
+	secondRefreshToken := refreshResponseBody["refresh_token"].(string)
+	idps.RequireExactlyZeroCallsToRevokeToken(t)
+
+	// Someone else uses the first refresh token again, so it was probably stolen.
+	reusedRefreshTokenResponse := refresh(firstRefreshToken)
+	require.Equal(t, http.StatusBadRequest, reusedRefreshTokenResponse.Code)
+	testutil.RequireEqualContentType(t, reusedRefreshTokenResponse.Header().Get("Content-Type"), "application/json")
+	require.JSONEq(t, here.Doc(`
+		{
+			"error":             "invalid_grant",
+			"error_description": "The provided authorization grant (e.g., authorization code, resource owner credentials) or refresh token is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client. The refresh token was already used, so all tokens of the session were revoked."
+		}
+	`), reusedRefreshTokenResponse.Body.String())
+
+	// All access and refresh tokens of the session were revoked, and so was the latest upstream refresh token.
+	testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 0)
+	testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue}, 0)
+	idps.RequireExactlyOneCallToRevokeToken(t, oidcUpstreamName, &oidctestutil.RevokeTokenArgs{
+		Ctx:       reqContext,
+		Token:     oidcUpstreamRefreshedRefreshToken,
+		TokenType: provider.RefreshTokenType,
+	})
+
+	// So the client cannot use its second refresh token anymore either.
+	require.Equal(t, http.StatusBadRequest, refresh(secondRefreshToken).Code)
+	idps.RequireExactlyOneCallToPerformRefresh(t, oidcUpstreamName, &oidctestutil.PerformRefreshArgs{
+		Ctx:          reqContext,
+		RefreshToken: "initial-upstream-refresh-token",
+	})
+}
+
+func TestTokenEndpointWithDPoP(t *testing.T) {
+	const oidcUpstreamName = "some-oidc-idp"
+
+	idps := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+		oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+			WithName(oidcUpstreamName).
+			WithResourceUID("oidc-resource-uid").
+			WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+				IDToken: &oidctypes.IDToken{Claims: map[string]interface{}{"sub": goodUpstreamSubject}},
+			}).
+			WithRefreshedTokens(&oauth2.Token{AccessToken: "fake-refreshed-access-token", RefreshToken: "fake-refreshed-refresh-token"}).
+			Build(),
+	)
+	customSessionData := &psession.CustomSessionData{
+		ProviderName: oidcUpstreamName,
+		ProviderUID:  "oidc-resource-uid",
+		ProviderType: psession.ProviderTypeOIDC,
+		OIDC: &psession.OIDCSessionData{
+			UpstreamRefreshToken: "initial-upstream-refresh-token",
+			UpstreamSubject:      goodUpstreamSubject,
+			UpstreamIssuer:       goodIssuer,
+		},
+	}
+
+	dpopKey, err := dpop.Generate()
+	require.NoError(t, err)
+	otherDPoPKey, err := dpop.Generate()
+	require.NoError(t, err)
+
+	// The authcode exchange with a DPoP proof binds the tokens to the key of the proof.
+	subject, rsp, _, _, _, _ := exchangeAuthcodeForTokens(t, authcodeExchangeInputs{
+		customSessionData:  customSessionData,
+		modifyAuthRequest:  func(r *http.Request) { r.Form.Set("scope", "openid offline_access pinniped:request-audience") },
+		modifyTokenRequest: func(r *http.Request, _ string) { addDPoPProof(t, r, dpopKey) },
+		want: tokenEndpointResponseExpectedValues{
+			wantStatus:                  http.StatusOK,
+			wantSuccessBodyFields:       []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
+			wantRequestedScopes:         []string{"openid", "offline_access", "pinniped:request-audience"},
+			wantGrantedScopes:           []string{"openid", "offline_access", "pinniped:request-audience"},
+			wantCustomSessionDataStored: customSessionData,
+			wantGroups:                  goodGroups,
+		},
+	}, idps.Build())
+	var authcodeExchangeResponseBody map[string]interface{}
+	require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &authcodeExchangeResponseBody))
+	require.Equal(t, "DPoP", authcodeExchangeResponseBody["token_type"])
+
+	send := func(req *http.Request, key *dpop.Key) *httptest.ResponseRecorder {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		addDPoPProof(t, req, key)
+		rsp := httptest.NewRecorder()
+		subject.ServeHTTP(rsp, req)
+		t.Logf("response body: %q", rsp.Body.String())
+		return rsp
+	}
+	refreshRequest := func() *http.Request {
+		return httptest.NewRequest("POST", "/path/shouldn't/matter",
+			happyRefreshRequestBody(authcodeExchangeResponseBody["refresh_token"].(string)).ReadCloser())
+	}
+	tokenExchangeRequest := func() *http.Request {
+		form := happyTokenExchangeRequest("some-workload-cluster", authcodeExchangeResponseBody["access_token"].(string)).Form
+		return httptest.NewRequest("POST", "/path/shouldn't/matter", body(form).ReadCloser())
+	}
+
+	// The bound tokens cannot be used without a proof of the same key.
+	for _, key := range []*dpop.Key{nil, otherDPoPKey} {
+		refreshResponse := send(refreshRequest(), key)
+		require.Equal(t, http.StatusBadRequest, refreshResponse.Code)
+		require.Contains(t, refreshResponse.Body.String(), `"error":"invalid_dpop_proof"`)
+
+		tokenExchangeResponse := send(tokenExchangeRequest(), key)
+		require.Equal(t, http.StatusBadRequest, tokenExchangeResponse.Code)
+		require.Contains(t, tokenExchangeResponse.Body.String(), `"error":"invalid_dpop_proof"`)
+	}
+	idps.RequireExactlyZeroCallsToPerformRefresh(t)
+
+	// With a proof of the same key, they can be used, and the refreshed tokens are bound to the same key.
+	tokenExchangeResponse := send(tokenExchangeRequest(), dpopKey)
+	require.Equal(t, http.StatusOK, tokenExchangeResponse.Code)
+	var tokenExchangeResponseBody map[string]interface{}
+	require.NoError(t, json.Unmarshal(tokenExchangeResponse.Body.Bytes(), &tokenExchangeResponseBody))
+	require.Equal(t, "N_A", tokenExchangeResponseBody["token_type"])
+
+	refreshResponse := send(refreshRequest(), dpopKey)
+	require.Equal(t, http.StatusOK, refreshResponse.Code)
+	var refreshResponseBody map[string]interface{}
+	require.NoError(t, json.Unmarshal(refreshResponse.Body.Bytes(), &refreshResponseBody))
+	require.Equal(t, "DPoP", refreshResponseBody["token_type"])
+
+	refreshResponse = send(httptest.NewRequest("POST", "/path/shouldn't/matter",
+		happyRefreshRequestBody(refreshResponseBody["refresh_token"].(string)).ReadCloser()), nil)
+	require.Equal(t, http.StatusBadRequest, refreshResponse.Code)
+	require.Contains(t, refreshResponse.Body.String(), `"error":"invalid_dpop_proof"`)
+}
+
 func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn:ietf:params:oauth:grant-type:token-exchange"
 	successfulAuthCodeExchange := tokenEndpointResponseExpectedValues{
 		wantStatus:            http.StatusOK,
@@ -652,6 +852,8 @@ func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn
 
 		wantStatus               int
 		wantResponseBodyContains string
+		wantResponseScope        string
+		wantExtraClaims          map[string]interface{}
 	}{
 		{
 			name:              "happy path",
@@ -659,6 +861,123 @@ func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn
 			requestedAudience: "some-workload-cluster",
 			wantStatus:        http.StatusOK,
 		},
+		{
+			name: "audience is allowed by the policy",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: doValidAuthCodeExchange.modifyAuthRequest,
+				makeOathHelper: makeOauthHelperWithTokenExchangePolicy(&provider.TokenExchangePolicy{AllowedAudiences: map[string][]string{
+					"some-workload-cluster":  nil,
+					"other-workload-cluster": {"some-other-group"},
+				}}),
+				want: successfulAuthCodeExchange,
+			},
+			requestedAudience: "some-workload-cluster",
+			wantStatus:        http.StatusOK,
+		},
+		{
+			name: "audience is allowed by the policy for a group of the user",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: doValidAuthCodeExchange.modifyAuthRequest,
+				makeOathHelper: makeOauthHelperWithTokenExchangePolicy(&provider.TokenExchangePolicy{AllowedAudiences: map[string][]string{
+					"some-workload-cluster": {"some-other-group", goodGroups[1]},
+				}}),
+				want: successfulAuthCodeExchange,
+			},
+			requestedAudience: "some-workload-cluster",
+			wantStatus:        http.StatusOK,
+		},
+		{
+			name: "audience is not allowed by the policy",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: doValidAuthCodeExchange.modifyAuthRequest,
+				makeOathHelper: makeOauthHelperWithTokenExchangePolicy(&provider.TokenExchangePolicy{AllowedAudiences: map[string][]string{
+					"other-workload-cluster": nil,
+				}}),
+				want: successfulAuthCodeExchange,
+			},
+			requestedAudience:        "some-workload-cluster",
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `"error":"invalid_target"`,
+		},
+		{
+			name: "audience is not allowed by the policy for the groups of the user",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: doValidAuthCodeExchange.modifyAuthRequest,
+				makeOathHelper: makeOauthHelperWithTokenExchangePolicy(&provider.TokenExchangePolicy{AllowedAudiences: map[string][]string{
+					"some-workload-cluster": {"some-other-group"},
+				}}),
+				want: successfulAuthCodeExchange,
+			},
+			requestedAudience:        "some-workload-cluster",
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `the audience 'some-workload-cluster' is not allowed`,
+		},
+		{
+			name:              "narrower scopes",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("scope", "openid")
+			},
+			wantStatus:        http.StatusOK,
+			wantResponseScope: "openid",
+			wantExtraClaims:   map[string]interface{}{"scope": "openid"},
+		},
+		{
+			name:              "scopes which were not granted",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("scope", "openid offline_access")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `the scope 'offline_access' was not granted to the subject_token`,
+		},
+		{
+			name:              "actor token",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("actor_token", params.Get("subject_token"))
+				params.Set("actor_token_type", "urn:ietf:params:oauth:token-type:access_token")
+			},
+			wantStatus: http.StatusOK,
+			wantExtraClaims: map[string]interface{}{
+				"act": map[string]interface{}{"sub": goodSubject, "username": goodUsername},
+			},
+		},
+		{
+			name:              "bogus actor token",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("actor_token", "some-bogus-value")
+				params.Set("actor_token_type", "urn:ietf:params:oauth:token-type:access_token")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `Invalid token format`,
+		},
+		{
+			name:              "wrong actor_token_type",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("actor_token", params.Get("subject_token"))
+				params.Set("actor_token_type", "invalid")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `unsupported actor_token_type parameter value`,
+		},
+		{
+			name:              "actor_token_type without actor_token",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("actor_token_type", "urn:ietf:params:oauth:token-type:access_token")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `actor_token_type parameter must not be sent without the actor_token parameter`,
+		},
 		{
 			name:                     "missing audience",
 			authcodeExchange:         doValidAuthCodeExchange,
@@ -837,6 +1156,11 @@ func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn
 			require.Contains(t, responseBody, "access_token")
 			require.Equal(t, "N_A", responseBody["token_type"])
 			require.Equal(t, "urn:ietf:params:oauth:token-type:jwt", responseBody["issued_token_type"])
+			if test.wantResponseScope != "" {
+				require.Equal(t, test.wantResponseScope, responseBody["scope"])
+			} else {
+				require.NotContains(t, responseBody, "scope")
+			}
 
 			// Parse the returned token.
 			parsedJWT, err := jose.ParseSigned(responseBody["access_token"].(string))
@@ -846,6 +1170,10 @@ func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn
 
 			// Make sure that these are the only fields in the token.
 			idTokenFields := []string{"sub", "aud", "iss", "jti", "auth_time", "exp", "iat", "rat", "groups", "username"}
+			for claim, value := range test.wantExtraClaims {
+				idTokenFields = append(idTokenFields, claim)
+				require.Equal(t, value, tokenClaims[claim])
+			}
 			require.ElementsMatch(t, idTokenFields, getMapKeys(tokenClaims))
 
 			// Assert that the returned token has expected claims values.
@@ -883,203 +1211,1080 @@ func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn
 	}
 }
 
-type refreshRequestInputs struct {
-	modifyTokenRequest func(tokenRequest *http.Request, refreshToken string, accessToken string)
-	want               tokenEndpointResponseExpectedValues
+type fakeTrustedTokenVerifier struct {
+	identity *provider.TrustedIdentity
+	err      error
 }
 
-func TestRefreshGrant(t *testing.T) {
-	const (
-		oidcUpstreamName                  = "some-oidc-idp"
-		oidcUpstreamResourceUID           = "oidc-resource-uid"
-		oidcUpstreamType                  = "oidc"
-		oidcUpstreamInitialRefreshToken   = "initial-upstream-refresh-token"
-		oidcUpstreamRefreshedIDToken      = "fake-refreshed-id-token"
-		oidcUpstreamRefreshedRefreshToken = "fake-refreshed-refresh-token"
-		oidcUpstreamAccessToken           = "fake-upstream-access-token" //nolint:gosec
-
-		ldapUpstreamName        = "some-ldap-idp"
-		ldapUpstreamResourceUID = "ldap-resource-uid"
-		ldapUpstreamType        = "ldap"
-		ldapUpstreamDN          = "some-ldap-user-dn"
+func (v *fakeTrustedTokenVerifier) VerifyToken(_ context.Context, _ string) (*provider.TrustedIdentity, error) {
+	return v.identity, v.err
+}
 
-		activeDirectoryUpstreamName        = "some-ad-idp"
-		activeDirectoryUpstreamResourceUID = "ad-resource-uid"
-		activeDirectoryUpstreamType        = "activedirectory"
-		activeDirectoryUpstreamDN          = "some-ad-user-dn"
+func TestTokenEndpointTokenExchangeWithTrustedJWT(t *testing.T) { // tests for subject_token_type "urn:ietf:params:oauth:token-type:jwt" and "urn:ietf:params:oauth:token-type:id_token"
+	const (
+		trustedIssuer     = "https://some-cluster.example.com"
+		trustedOIDCIssuer = "https://ci.example.com"
+		tokenTypeIDToken  = "urn:ietf:params:oauth:token-type:id_token"
 	)
 
-	ldapUpstreamURL, _ := url.Parse("some-url")
-
-	// The below values are funcs so every test can have its own copy of the objects, to avoid data races
-	// in these parallel tests.
-
-	upstreamOIDCIdentityProviderBuilder := func() *oidctestutil.TestUpstreamOIDCIdentityProviderBuilder {
-		return oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
-			WithName(oidcUpstreamName).
-			WithResourceUID(oidcUpstreamResourceUID)
+	serviceAccountIdentity := &provider.TrustedIdentity{
+		Subject:  trustedIssuer + "?sub=system%3Aserviceaccount%3Asome-namespace%3Asome-name",
+		Username: "some-cluster:system:serviceaccount:some-namespace:some-name",
+		Groups:   []string{"some-cluster:system:serviceaccounts", "some-cluster:system:serviceaccounts:some-namespace"},
 	}
-
-	initialUpstreamOIDCRefreshTokenCustomSessionData := func() *psession.CustomSessionData {
-		return &psession.CustomSessionData{
-			ProviderName: oidcUpstreamName,
-			ProviderUID:  oidcUpstreamResourceUID,
-			ProviderType: oidcUpstreamType,
-			OIDC: &psession.OIDCSessionData{
-				UpstreamRefreshToken: oidcUpstreamInitialRefreshToken,
-				UpstreamSubject:      goodUpstreamSubject,
-				UpstreamIssuer:       goodIssuer,
-			},
-		}
+	ciIdentity := &provider.TrustedIdentity{
+		Subject:  trustedOIDCIssuer + "?sub=repo%3Asome-org%2Fsome-repo%3Aref%3Arefs%2Fheads%2Fmain",
+		Username: "ci:some-org/some-repo:refs/heads/main",
+		Groups:   []string{"ci:some-org"},
 	}
 
-	initialUpstreamOIDCAccessTokenCustomSessionData := func() *psession.CustomSessionData {
-		return &psession.CustomSessionData{
-			ProviderName: oidcUpstreamName,
-			ProviderUID:  oidcUpstreamResourceUID,
-			ProviderType: oidcUpstreamType,
-			OIDC: &psession.OIDCSessionData{
-				UpstreamAccessToken: oidcUpstreamAccessToken,
-				UpstreamSubject:     goodUpstreamSubject,
-				UpstreamIssuer:      goodIssuer,
-			},
-		}
+	makeSubjectToken := func(t *testing.T, issuer string) string {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+		require.NoError(t, err)
+		token, err := josejwt.Signed(signer).Claims(josejwt.Claims{Issuer: issuer, Subject: "some-subject"}).CompactSerialize()
+		require.NoError(t, err)
+		return token
 	}
 
-	upstreamOIDCCustomSessionDataWithNewRefreshToken := func(newRefreshToken string) *psession.CustomSessionData {
-		sessionData := initialUpstreamOIDCRefreshTokenCustomSessionData()
-		sessionData.OIDC.UpstreamRefreshToken = newRefreshToken
-		return sessionData
-	}
+	tests := []struct {
+		name string
 
-	happyOIDCUpstreamRefreshCall := func() *expectedUpstreamRefresh {
-		return &expectedUpstreamRefresh{
-			performedByUpstreamName: oidcUpstreamName,
-			args: &oidctestutil.PerformRefreshArgs{
-				Ctx:          nil, // this will be filled in with the actual request context by the test below
-				RefreshToken: oidcUpstreamInitialRefreshToken,
-			},
-		}
-	}
+		verifier            *fakeTrustedTokenVerifier
+		allowedAudiences    map[string][]string
+		subjectToken        func(t *testing.T) string
+		subjectTokenType    string
+		modifyRequestParams func(params url.Values)
 
-	happyLDAPUpstreamRefreshCall := func() *expectedUpstreamRefresh {
-		return &expectedUpstreamRefresh{
-			performedByUpstreamName: ldapUpstreamName,
-			args: &oidctestutil.PerformRefreshArgs{
-				Ctx:              nil,
-				DN:               ldapUpstreamDN,
-				ExpectedSubject:  goodSubject,
-				ExpectedUsername: goodUsername,
+		wantStatus               int
+		wantResponseBodyContains string
+		wantResponseScope        string
+	}{
+		{
+			name:       "happy path",
+			verifier:   &fakeTrustedTokenVerifier{identity: serviceAccountIdentity},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:             "audience is allowed by the policy for a group of the ServiceAccount",
+			verifier:         &fakeTrustedTokenVerifier{identity: serviceAccountIdentity},
+			allowedAudiences: map[string][]string{"some-workload-cluster": {"some-cluster:system:serviceaccounts:some-namespace"}},
+			wantStatus:       http.StatusOK,
+		},
+		{
+			name:                     "audience is not allowed by the policy for the groups of the ServiceAccount",
+			verifier:                 &fakeTrustedTokenVerifier{identity: serviceAccountIdentity},
+			allowedAudiences:         map[string][]string{"some-workload-cluster": {"some-cluster:system:serviceaccounts:other-namespace"}},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `the audience 'some-workload-cluster' is not allowed`,
+		},
+		{
+			name:     "narrower scopes",
+			verifier: &fakeTrustedTokenVerifier{identity: serviceAccountIdentity},
+			modifyRequestParams: func(params url.Values) {
+				params.Set("scope", "openid")
 			},
-		}
+			wantStatus:        http.StatusOK,
+			wantResponseScope: "openid",
+		},
+		{
+			name:                     "token of an issuer which is not trusted",
+			verifier:                 &fakeTrustedTokenVerifier{identity: serviceAccountIdentity},
+			subjectToken:             func(t *testing.T) string { return makeSubjectToken(t, "https://other-cluster.example.com") },
+			wantStatus:               http.StatusUnauthorized,
+			wantResponseBodyContains: `the issuer 'https://other-cluster.example.com' of the subject_token is not trusted`,
+		},
+		{
+			name:             "ID token of a trusted OIDC issuer",
+			verifier:         &fakeTrustedTokenVerifier{identity: ciIdentity},
+			subjectToken:     func(t *testing.T) string { return makeSubjectToken(t, trustedOIDCIssuer) },
+			subjectTokenType: tokenTypeIDToken,
+			wantStatus:       http.StatusOK,
+		},
+		{
+			name:                     "ID token of an issuer which is only trusted for ServiceAccount tokens",
+			verifier:                 &fakeTrustedTokenVerifier{identity: serviceAccountIdentity},
+			subjectTokenType:         tokenTypeIDToken,
+			wantStatus:               http.StatusUnauthorized,
+			wantResponseBodyContains: `the issuer 'https://some-cluster.example.com' of the subject_token is not trusted`,
+		},
+		{
+			name:                     "ServiceAccount token of an issuer which is only trusted for ID tokens",
+			verifier:                 &fakeTrustedTokenVerifier{identity: ciIdentity},
+			subjectToken:             func(t *testing.T) string { return makeSubjectToken(t, trustedOIDCIssuer) },
+			wantStatus:               http.StatusUnauthorized,
+			wantResponseBodyContains: `the issuer 'https://ci.example.com' of the subject_token is not trusted`,
+		},
+		{
+			name:                     "token which is not a JWT",
+			verifier:                 &fakeTrustedTokenVerifier{identity: serviceAccountIdentity},
+			subjectToken:             func(t *testing.T) string { return "some-bogus-value" },
+			wantStatus:               http.StatusUnauthorized,
+			wantResponseBodyContains: `invalid subject_token`,
+		},
+		{
+			name:                     "token which cannot be verified",
+			verifier:                 &fakeTrustedTokenVerifier{err: errors.New("some verification error")},
+			wantStatus:               http.StatusUnauthorized,
+			wantResponseBodyContains: `invalid subject_token`,
+		},
 	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
 
-	happyActiveDirectoryUpstreamRefreshCall := func() *expectedUpstreamRefresh {
-		return &expectedUpstreamRefresh{
-			performedByUpstreamName: activeDirectoryUpstreamName,
-			args: &oidctestutil.PerformRefreshArgs{
-				Ctx:              nil,
-				DN:               activeDirectoryUpstreamDN,
-				ExpectedSubject:  goodSubject,
-				ExpectedUsername: goodUsername,
-			},
-		}
-	}
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			_, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+			policy := &provider.TokenExchangePolicy{
+				AllowedAudiences:             test.allowedAudiences,
+				TrustedServiceAccountIssuers: map[string]provider.TrustedTokenVerifier{trustedIssuer: test.verifier},
+				TrustedOIDCIssuers:           map[string]provider.TrustedTokenVerifier{trustedOIDCIssuer: test.verifier},
+			}
+			oauthHelper := oidc.FositeOauth2Helper(oidc.NewKubeStorage(secrets, oidc.DefaultOIDCTimeoutsConfiguration()),
+				goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration(), policy)
+			subject := NewHandler(oidctestutil.NewUpstreamIDPListerBuilder().Build(), oauthHelper, consent.NewStorage(secrets, time.Now), goodIssuer+oidc.TokenEndpointPath, supervisordpop.NewReplayCache(supervisordpop.DefaultReplayCacheSize))
 
-	happyUpstreamValidateTokenCall := func(expectedTokens *oauth2.Token, requireIDToken bool) *expectedUpstreamValidateTokens {
-		return &expectedUpstreamValidateTokens{
-			performedByUpstreamName: oidcUpstreamName,
-			args: &oidctestutil.ValidateTokenAndMergeWithUserInfoArgs{
-				Ctx:                  nil, // this will be filled in with the actual request context by the test below
-				Tok:                  expectedTokens,
-				ExpectedIDTokenNonce: "", // always expect empty string
+			subjectToken := makeSubjectToken(t, trustedIssuer)
+			if test.subjectToken != nil {
+				subjectToken = test.subjectToken(t)
+			}
+			request := happyTokenExchangeRequest("some-workload-cluster", subjectToken)
+			request.Form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:jwt")
+			if test.subjectTokenType != "" {
+				request.Form.Set("subject_token_type", test.subjectTokenType)
+			}
+			if test.modifyRequestParams != nil {
+				test.modifyRequestParams(request.Form)
+			}
+
+			req := httptest.NewRequest("POST", "/path/shouldn't/matter", body(request.Form).ReadCloser())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), "application/json")
+			if test.wantResponseBodyContains != "" {
+				require.Contains(t, rsp.Body.String(), test.wantResponseBodyContains)
+			}
+
+			// Nothing is ever stored for a token exchange.
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 0)
+
+			// The remaining assertions apply only to the happy path.
+			if rsp.Code != http.StatusOK {
+				return
+			}
+
+			var responseBody map[string]interface{}
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
+			require.Equal(t, "N_A", responseBody["token_type"])
+			require.Equal(t, "urn:ietf:params:oauth:token-type:jwt", responseBody["issued_token_type"])
+			if test.wantResponseScope != "" {
+				require.Equal(t, test.wantResponseScope, responseBody["scope"])
+			} else {
+				require.NotContains(t, responseBody, "scope")
+			}
+
+			parsedJWT, err := jose.ParseSigned(responseBody["access_token"].(string))
+			require.NoError(t, err)
+			var tokenClaims map[string]interface{}
+			require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &tokenClaims))
+			require.Equal(t, []interface{}{"some-workload-cluster"}, tokenClaims["aud"])
+			require.Equal(t, goodIssuer, tokenClaims["iss"])
+			require.Equal(t, test.verifier.identity.Subject, tokenClaims["sub"])
+			require.Equal(t, test.verifier.identity.Username, tokenClaims["username"])
+			require.Equal(t, toSliceOfInterface(test.verifier.identity.Groups), tokenClaims["groups"])
+			require.NotEmpty(t, tokenClaims["auth_time"])
+			require.NotEmpty(t, tokenClaims["exp"])
+		})
+	}
+}
+
+func TestTokenEndpointClientCredentials(t *testing.T) { // tests for grant_type "client_credentials"
+	const (
+		clientID          = "client.oauth.pinniped.dev-some-client"
+		clientSecret      = "some-client-secret"
+		otherClientSecret = "some-other-client-secret"
+	)
+
+	hashSecret := func(t *testing.T, secret string) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+		require.NoError(t, err)
+		return string(hash)
+	}
+	clientSecretData := func(t *testing.T, username string, groups string, secrets ...string) map[string][]byte {
+		hashes := make([]string, 0, len(secrets))
+		for _, secret := range secrets {
+			hashes = append(hashes, hashSecret(t, secret))
+		}
+		data := map[string][]byte{"clientSecretHashes": []byte(strings.Join(hashes, "\n"))}
+		if username != "" {
+			data["username"] = []byte(username)
+		}
+		if groups != "" {
+			data["groups"] = []byte(groups)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name string
+
+		secretData         func(t *testing.T) map[string][]byte
+		modifyTokenRequest func(r *http.Request)
+		scope              string
+		withDPoPProof      bool
+
+		wantStatus               int
+		wantResponseBodyContains string
+		wantUsername             string
+		wantGroups               []string
+	}{
+		{
+			name: "happy path",
+			secretData: func(t *testing.T) map[string][]byte {
+				return clientSecretData(t, "some-robot", "group1, group2", clientSecret)
+			},
+			scope:        "openid pinniped:request-audience",
+			wantStatus:   http.StatusOK,
+			wantUsername: "some-robot",
+			wantGroups:   []string{"group1", "group2"},
+		},
+		{
+			name:         "username defaults to the client ID and groups default to none",
+			secretData:   func(t *testing.T) map[string][]byte { return clientSecretData(t, "", "", clientSecret) },
+			scope:        "openid pinniped:request-audience",
+			wantStatus:   http.StatusOK,
+			wantUsername: clientID,
+			wantGroups:   []string{},
+		},
+		{
+			name: "rotated client secret",
+			secretData: func(t *testing.T) map[string][]byte {
+				return clientSecretData(t, "some-robot", "", otherClientSecret, clientSecret)
+			},
+			scope:        "openid pinniped:request-audience",
+			wantStatus:   http.StatusOK,
+			wantUsername: "some-robot",
+			wantGroups:   []string{},
+		},
+		{
+			name:                     "wrong client secret",
+			secretData:               func(t *testing.T) map[string][]byte { return clientSecretData(t, "", "", otherClientSecret) },
+			scope:                    "openid pinniped:request-audience",
+			wantStatus:               http.StatusUnauthorized,
+			wantResponseBodyContains: `"error":"invalid_client"`,
+		},
+		{
+			name:       "unknown client",
+			secretData: func(t *testing.T) map[string][]byte { return clientSecretData(t, "", "", clientSecret) },
+			modifyTokenRequest: func(r *http.Request) {
+				r.SetBasicAuth("client.oauth.pinniped.dev-other-client", clientSecret)
+			},
+			scope:                    "openid pinniped:request-audience",
+			wantStatus:               http.StatusUnauthorized,
+			wantResponseBodyContains: `"error":"invalid_client"`,
+		},
+		{
+			name:       "public client",
+			secretData: func(t *testing.T) map[string][]byte { return clientSecretData(t, "", "", clientSecret) },
+			modifyTokenRequest: func(r *http.Request) {
+				r.Header.Del("Authorization")
+				r.Body = body(url.Values{"grant_type": {"client_credentials"}, "client_id": {goodClient}}).ReadCloser()
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `"error":"invalid_grant"`,
+		},
+		{
+			name: "client which requires DPoP with a DPoP proof",
+			secretData: func(t *testing.T) map[string][]byte {
+				data := clientSecretData(t, "some-robot", "", clientSecret)
+				data["requireDPoP"] = []byte("true")
+				return data
+			},
+			scope:         "openid pinniped:request-audience",
+			withDPoPProof: true,
+			wantStatus:    http.StatusOK,
+			wantUsername:  "some-robot",
+			wantGroups:    []string{},
+		},
+		{
+			name: "client which requires DPoP without a DPoP proof",
+			secretData: func(t *testing.T) map[string][]byte {
+				data := clientSecretData(t, "some-robot", "", clientSecret)
+				data["requireDPoP"] = []byte("true")
+				return data
+			},
+			scope:                    "openid pinniped:request-audience",
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `"error":"invalid_dpop_proof"`,
+		},
+		{
+			name:                     "scope which is not allowed for the client",
+			secretData:               func(t *testing.T) map[string][]byte { return clientSecretData(t, "", "", clientSecret) },
+			scope:                    "openid offline_access",
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `"error":"invalid_scope"`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			_, err := secrets.Create(context.Background(), &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: clientID},
+				Type:       clientregistry.ConfidentialClientSecretType,
+				Data:       test.secretData(t),
+			}, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			_, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+			oauthHelper := oidc.FositeOauth2Helper(oidc.NewKubeStorage(secrets, oidc.DefaultOIDCTimeoutsConfiguration()),
+				goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration(), nil)
+			subject := NewHandler(oidctestutil.NewUpstreamIDPListerBuilder().Build(), oauthHelper, consent.NewStorage(secrets, time.Now), goodIssuer+oidc.TokenEndpointPath, supervisordpop.NewReplayCache(supervisordpop.DefaultReplayCacheSize))
+
+			wantTokenType := "bearer"
+			var dpopKey *dpop.Key
+			if test.withDPoPProof {
+				wantTokenType = "DPoP"
+				dpopKey, err = dpop.Generate()
+				require.NoError(t, err)
+			}
+
+			form := url.Values{"grant_type": {"client_credentials"}}
+			if test.scope != "" {
+				form.Set("scope", test.scope)
+			}
+			req := httptest.NewRequest("POST", "/path/shouldn't/matter", body(form).ReadCloser())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(clientID, clientSecret)
+			addDPoPProof(t, req, dpopKey)
+			if test.modifyTokenRequest != nil {
+				test.modifyTokenRequest(req)
+			}
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response: %#v", rsp)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), "application/json")
+			if test.wantResponseBodyContains != "" {
+				require.Contains(t, rsp.Body.String(), test.wantResponseBodyContains)
+			}
+
+			// The remaining assertions apply only to the happy path.
+			if rsp.Code != http.StatusOK {
+				testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 0)
+				return
+			}
+
+			// Only an access token is issued, since there is no user to refresh or to identify to the client.
+			var responseBody map[string]interface{}
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
+			require.ElementsMatch(t, []string{"access_token", "token_type", "expires_in", "scope"}, getMapKeys(responseBody))
+			require.Equal(t, wantTokenType, responseBody["token_type"])
+			require.Equal(t, test.scope, responseBody["scope"])
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 1)
+
+			// The access token can be exchanged for a cluster-scoped token for the identity of the client.
+			exchangeForm := happyTokenExchangeRequest("some-workload-cluster", responseBody["access_token"].(string)).Form
+			exchangeForm.Del("client_id")
+			req = httptest.NewRequest("POST", "/path/shouldn't/matter", body(exchangeForm).ReadCloser())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(clientID, clientSecret)
+			addDPoPProof(t, req, dpopKey)
+			rsp = httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("token exchange response body: %q", rsp.Body.String())
+			require.Equal(t, http.StatusOK, rsp.Code)
+
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
+			parsedJWT, err := jose.ParseSigned(responseBody["access_token"].(string))
+			require.NoError(t, err)
+			var tokenClaims map[string]interface{}
+			require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &tokenClaims))
+			require.Equal(t, []interface{}{"some-workload-cluster"}, tokenClaims["aud"])
+			require.Equal(t, clientID, tokenClaims["sub"])
+			require.Equal(t, goodIssuer, tokenClaims["iss"])
+			require.Equal(t, test.wantUsername, tokenClaims["username"])
+			require.Equal(t, toSliceOfInterface(test.wantGroups), tokenClaims["groups"])
+		})
+	}
+}
+
+// addDPoPProof adds a DPoP proof of the key to a request to the token endpoint, unless the key is nil.
+func addDPoPProof(t *testing.T, req *http.Request, key *dpop.Key) {
+	t.Helper()
+	if key == nil {
+		return
+	}
+	proof, err := key.Proof(http.MethodPost, goodIssuer+oidc.TokenEndpointPath, time.Now())
+	require.NoError(t, err)
+	req.Header.Set("DPoP", proof)
+}
+
+type refreshRequestInputs struct {
+	modifyTokenRequest func(tokenRequest *http.Request, refreshToken string, accessToken string)
+	want               tokenEndpointResponseExpectedValues
+}
+
+func TestCheckConsent(t *testing.T) {
+	const (
+		subject  = "https://issuer?sub=some-user"
+		clientID = "client.oauth.pinniped.dev-some-app"
+	)
+	ctx := context.Background()
+
+	newAccessRequest := func(client fosite.Client) fosite.AccessRequester {
+		session := psession.NewPinnipedSession()
+		session.Fosite.Claims.Subject = subject
+		accessRequest := fosite.NewAccessRequest(session)
+		accessRequest.Client = client
+		accessRequest.GrantedScope = fosite.Arguments{"openid", "offline_access"}
+		return accessRequest
+	}
+	thirdPartyClient := &clientregistry.Client{
+		DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+			DefaultClient: &fosite.DefaultClient{ID: clientID},
+		},
+	}
+
+	consentStorage := consent.NewStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), time.Now)
+
+	// Trusted clients do not need consent.
+	require.NoError(t, checkConsent(ctx, newAccessRequest(clientregistry.PinnipedCLI()), consentStorage))
+
+	err := checkConsent(ctx, newAccessRequest(thirdPartyClient), consentStorage)
+	require.EqualError(t, err, "access_denied")
+	require.Equal(t, "The user has revoked their consent to the client, or it has expired.", fosite.ErrorToRFC6749Error(err).HintField)
+
+	require.NoError(t, consentStorage.Grant(ctx, subject, clientID, []string{"openid", "offline_access"}))
+	require.NoError(t, checkConsent(ctx, newAccessRequest(thirdPartyClient), consentStorage))
+
+	require.NoError(t, consentStorage.Revoke(ctx, subject, clientID))
+	require.Error(t, checkConsent(ctx, newAccessRequest(thirdPartyClient), consentStorage))
+}
+
+func TestRefreshGrant(t *testing.T) {
+	const (
+		oidcUpstreamName                  = "some-oidc-idp"
+		oidcUpstreamResourceUID           = "oidc-resource-uid"
+		oidcUpstreamType                  = "oidc"
+		oidcUpstreamInitialRefreshToken   = "initial-upstream-refresh-token"
+		oidcUpstreamRefreshedIDToken      = "fake-refreshed-id-token"
+		oidcUpstreamRefreshedRefreshToken = "fake-refreshed-refresh-token"
+		oidcUpstreamAccessToken           = "fake-upstream-access-token" //nolint:gosec
+
+		ldapUpstreamName        = "some-ldap-idp"
+		ldapUpstreamResourceUID = "ldap-resource-uid"
+		ldapUpstreamType        = "ldap"
+		ldapUpstreamDN          = "some-ldap-user-dn"
+
+		activeDirectoryUpstreamName        = "some-ad-idp"
+		activeDirectoryUpstreamResourceUID = "ad-resource-uid"
+		activeDirectoryUpstreamType        = "activedirectory"
+		activeDirectoryUpstreamDN          = "some-ad-user-dn"
+
+		githubUpstreamName        = "some-github-idp"
+		githubUpstreamResourceUID = "github-resource-uid"
+		githubUpstreamType        = "github"
+		githubUpstreamAccessToken = "some-github-access-token" //nolint:gosec
+
+		samlUpstreamName        = "some-saml-idp"
+		samlUpstreamResourceUID = "saml-resource-uid"
+		samlUpstreamType        = "saml"
+		samlUpstreamNameID      = "some-name-id"
+
+		certificateUpstreamName        = "some-certificate-idp"
+		certificateUpstreamResourceUID = "certificate-resource-uid"
+		certificateUpstreamType        = "certificate"
+	)
+
+	ldapUpstreamURL, _ := url.Parse("some-url")
+
+	// The below values are funcs so every test can have its own copy of the objects, to avoid data races
+	// in these parallel tests.
+
+	upstreamOIDCIdentityProviderBuilder := func() *oidctestutil.TestUpstreamOIDCIdentityProviderBuilder {
+		return oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+			WithName(oidcUpstreamName).
+			WithResourceUID(oidcUpstreamResourceUID)
+	}
+
+	initialUpstreamOIDCRefreshTokenCustomSessionData := func() *psession.CustomSessionData {
+		return &psession.CustomSessionData{
+			ProviderName: oidcUpstreamName,
+			ProviderUID:  oidcUpstreamResourceUID,
+			ProviderType: oidcUpstreamType,
+			OIDC: &psession.OIDCSessionData{
+				UpstreamRefreshToken: oidcUpstreamInitialRefreshToken,
+				UpstreamSubject:      goodUpstreamSubject,
+				UpstreamIssuer:       goodIssuer,
+			},
+		}
+	}
+
+	initialUpstreamOIDCAccessTokenCustomSessionData := func() *psession.CustomSessionData {
+		return &psession.CustomSessionData{
+			ProviderName: oidcUpstreamName,
+			ProviderUID:  oidcUpstreamResourceUID,
+			ProviderType: oidcUpstreamType,
+			OIDC: &psession.OIDCSessionData{
+				UpstreamAccessToken: oidcUpstreamAccessToken,
+				UpstreamSubject:     goodUpstreamSubject,
+				UpstreamIssuer:      goodIssuer,
+			},
+		}
+	}
+
+	upstreamOIDCCustomSessionDataWithNewRefreshToken := func(newRefreshToken string) *psession.CustomSessionData {
+		sessionData := initialUpstreamOIDCRefreshTokenCustomSessionData()
+		sessionData.OIDC.UpstreamRefreshToken = newRefreshToken
+		return sessionData
+	}
+
+	happyOIDCUpstreamRefreshCall := func() *expectedUpstreamRefresh {
+		return &expectedUpstreamRefresh{
+			performedByUpstreamName: oidcUpstreamName,
+			args: &oidctestutil.PerformRefreshArgs{
+				Ctx:          nil, // this will be filled in with the actual request context by the test below
+				RefreshToken: oidcUpstreamInitialRefreshToken,
+			},
+		}
+	}
+
+	happyLDAPUpstreamRefreshCall := func() *expectedUpstreamRefresh {
+		return &expectedUpstreamRefresh{
+			performedByUpstreamName: ldapUpstreamName,
+			args: &oidctestutil.PerformRefreshArgs{
+				Ctx:              nil,
+				DN:               ldapUpstreamDN,
+				ExpectedSubject:  goodSubject,
+				ExpectedUsername: goodUsername,
+			},
+		}
+	}
+
+	happyActiveDirectoryUpstreamRefreshCall := func() *expectedUpstreamRefresh {
+		return &expectedUpstreamRefresh{
+			performedByUpstreamName: activeDirectoryUpstreamName,
+			args: &oidctestutil.PerformRefreshArgs{
+				Ctx:              nil,
+				DN:               activeDirectoryUpstreamDN,
+				ExpectedSubject:  goodSubject,
+				ExpectedUsername: goodUsername,
+			},
+		}
+	}
+
+	happyUpstreamValidateTokenCall := func(expectedTokens *oauth2.Token, requireIDToken bool) *expectedUpstreamValidateTokens {
+		return &expectedUpstreamValidateTokens{
+			performedByUpstreamName: oidcUpstreamName,
+			args: &oidctestutil.ValidateTokenAndMergeWithUserInfoArgs{
+				Ctx:                  nil, // this will be filled in with the actual request context by the test below
+				Tok:                  expectedTokens,
+				ExpectedIDTokenNonce: "", // always expect empty string
 				RequireUserInfo:      false,
 				RequireIDToken:       requireIDToken,
 			},
-		}
-	}
-
-	happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess := func(wantCustomSessionDataStored *psession.CustomSessionData) tokenEndpointResponseExpectedValues {
-		want := tokenEndpointResponseExpectedValues{
-			wantStatus:                  http.StatusOK,
-			wantSuccessBodyFields:       []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
-			wantRequestedScopes:         []string{"openid", "offline_access"},
-			wantGrantedScopes:           []string{"openid", "offline_access"},
-			wantCustomSessionDataStored: wantCustomSessionDataStored,
-			wantGroups:                  goodGroups,
-		}
-		return want
-	}
-
-	happyRefreshTokenResponseForOpenIDAndOfflineAccess := func(wantCustomSessionDataStored *psession.CustomSessionData, expectToValidateToken *oauth2.Token) tokenEndpointResponseExpectedValues {
-		// Should always have some custom session data stored. The other expectations happens to be the
-		// same as the same values as the authcode exchange case.
-		want := happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(wantCustomSessionDataStored)
-		// Should always try to perform an upstream refresh.
-		want.wantUpstreamRefreshCall = happyOIDCUpstreamRefreshCall()
-		if expectToValidateToken != nil {
-			want.wantUpstreamOIDCValidateTokenCall = happyUpstreamValidateTokenCall(expectToValidateToken, true)
-		}
-		return want
-	}
-
-	happyRefreshTokenResponseForLDAP := func(wantCustomSessionDataStored *psession.CustomSessionData) tokenEndpointResponseExpectedValues {
-		want := happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(wantCustomSessionDataStored)
-		want.wantUpstreamRefreshCall = happyLDAPUpstreamRefreshCall()
-		return want
-	}
-
-	happyRefreshTokenResponseForActiveDirectory := func(wantCustomSessionDataStored *psession.CustomSessionData) tokenEndpointResponseExpectedValues {
-		want := happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(wantCustomSessionDataStored)
-		want.wantUpstreamRefreshCall = happyActiveDirectoryUpstreamRefreshCall()
-		return want
-	}
-
-	refreshedUpstreamTokensWithRefreshTokenWithoutIDToken := func() *oauth2.Token {
-		return &oauth2.Token{
-			AccessToken:  "fake-refreshed-access-token",
-			TokenType:    "Bearer",
-			RefreshToken: oidcUpstreamRefreshedRefreshToken,
-			Expiry:       time.Date(2050, 1, 1, 1, 1, 1, 1, time.UTC),
-		}
-	}
-
-	refreshedUpstreamTokensWithIDAndRefreshTokens := func() *oauth2.Token {
-		return refreshedUpstreamTokensWithRefreshTokenWithoutIDToken().
-			WithExtra(map[string]interface{}{"id_token": oidcUpstreamRefreshedIDToken})
-	}
-
-	refreshedUpstreamTokensWithIDTokenWithoutRefreshToken := func() *oauth2.Token {
-		tokens := refreshedUpstreamTokensWithIDAndRefreshTokens()
-		tokens.RefreshToken = "" // remove the refresh token
-		return tokens
-	}
-
-	happyActiveDirectoryCustomSessionData := &psession.CustomSessionData{
-		ProviderUID:  activeDirectoryUpstreamResourceUID,
-		ProviderName: activeDirectoryUpstreamName,
-		ProviderType: activeDirectoryUpstreamType,
-		ActiveDirectory: &psession.ActiveDirectorySessionData{
-			UserDN: activeDirectoryUpstreamDN,
+		}
+	}
+
+	happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess := func(wantCustomSessionDataStored *psession.CustomSessionData) tokenEndpointResponseExpectedValues {
+		want := tokenEndpointResponseExpectedValues{
+			wantStatus:                  http.StatusOK,
+			wantSuccessBodyFields:       []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
+			wantRequestedScopes:         []string{"openid", "offline_access"},
+			wantGrantedScopes:           []string{"openid", "offline_access"},
+			wantCustomSessionDataStored: wantCustomSessionDataStored,
+			wantGroups:                  goodGroups,
+		}
+		return want
+	}
+
+	happyRefreshTokenResponseForOpenIDAndOfflineAccess := func(wantCustomSessionDataStored *psession.CustomSessionData, expectToValidateToken *oauth2.Token) tokenEndpointResponseExpectedValues {
+		// Should always have some custom session data stored. The other expectations happens to be the
+		// same as the same values as the authcode exchange case.
+		want := happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(wantCustomSessionDataStored)
+		// Should always try to perform an upstream refresh.
+		want.wantUpstreamRefreshCall = happyOIDCUpstreamRefreshCall()
+		if expectToValidateToken != nil {
+			want.wantUpstreamOIDCValidateTokenCall = happyUpstreamValidateTokenCall(expectToValidateToken, true)
+		}
+		return want
+	}
+
+	refreshedLDAPGroups := []string{"group1", "some-new-group"}
+
+	happyRefreshTokenResponseForLDAP := func(wantCustomSessionDataStored *psession.CustomSessionData) tokenEndpointResponseExpectedValues {
+		want := happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(wantCustomSessionDataStored)
+		want.wantUpstreamRefreshCall = happyLDAPUpstreamRefreshCall()
+		want.wantGroups = refreshedLDAPGroups
+		return want
+	}
+
+	happyRefreshTokenResponseForActiveDirectory := func(wantCustomSessionDataStored *psession.CustomSessionData) tokenEndpointResponseExpectedValues {
+		want := happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(wantCustomSessionDataStored)
+		want.wantUpstreamRefreshCall = happyActiveDirectoryUpstreamRefreshCall()
+		want.wantGroups = refreshedLDAPGroups
+		return want
+	}
+
+	refreshedUpstreamTokensWithRefreshTokenWithoutIDToken := func() *oauth2.Token {
+		return &oauth2.Token{
+			AccessToken:  "fake-refreshed-access-token",
+			TokenType:    "Bearer",
+			RefreshToken: oidcUpstreamRefreshedRefreshToken,
+			Expiry:       time.Date(2050, 1, 1, 1, 1, 1, 1, time.UTC),
+		}
+	}
+
+	refreshedUpstreamTokensWithIDAndRefreshTokens := func() *oauth2.Token {
+		return refreshedUpstreamTokensWithRefreshTokenWithoutIDToken().
+			WithExtra(map[string]interface{}{"id_token": oidcUpstreamRefreshedIDToken})
+	}
+
+	refreshedUpstreamTokensWithIDTokenWithoutRefreshToken := func() *oauth2.Token {
+		tokens := refreshedUpstreamTokensWithIDAndRefreshTokens()
+		tokens.RefreshToken = "" // remove the refresh token
+		return tokens
+	}
+
+	happyActiveDirectoryCustomSessionData := &psession.CustomSessionData{
+		ProviderUID:  activeDirectoryUpstreamResourceUID,
+		ProviderName: activeDirectoryUpstreamName,
+		ProviderType: activeDirectoryUpstreamType,
+		ActiveDirectory: &psession.ActiveDirectorySessionData{
+			UserDN: activeDirectoryUpstreamDN,
+		},
+	}
+	happyLDAPCustomSessionData := &psession.CustomSessionData{
+		ProviderUID:  ldapUpstreamResourceUID,
+		ProviderName: ldapUpstreamName,
+		ProviderType: ldapUpstreamType,
+		LDAP: &psession.LDAPSessionData{
+			UserDN: ldapUpstreamDN,
+		},
+	}
+	happyGitHubCustomSessionData := &psession.CustomSessionData{
+		ProviderUID:  githubUpstreamResourceUID,
+		ProviderName: githubUpstreamName,
+		ProviderType: githubUpstreamType,
+		GitHub: &psession.GitHubSessionData{
+			UpstreamAccessToken: githubUpstreamAccessToken,
+		},
+	}
+	refreshedGitHubGroups := []string{"some-org/some-team", "some-org/some-new-team"}
+	upstreamGitHubIdentityProvider := func(user *provider.GitHubUser, err error) *oidctestutil.TestUpstreamGitHubIdentityProvider {
+		return &oidctestutil.TestUpstreamGitHubIdentityProvider{
+			Name:        githubUpstreamName,
+			ResourceUID: githubUpstreamResourceUID,
+			GetUserFunc: func(ctx context.Context, accessToken string) (*provider.GitHubUser, error) {
+				return user, err
+			},
+		}
+	}
+	happyGitHubUpstreamGetUserCall := func() *expectedUpstreamGetUser {
+		return &expectedUpstreamGetUser{
+			performedByUpstreamName: githubUpstreamName,
+			args: &oidctestutil.GetUserArgs{
+				Ctx:         nil, // this will be filled in with the actual request context by the test below
+				AccessToken: githubUpstreamAccessToken,
+			},
+		}
+	}
+	githubRefreshFailedResponse := func() tokenEndpointResponseExpectedValues {
+		return tokenEndpointResponseExpectedValues{
+			wantUpstreamGitHubGetUserCall: happyGitHubUpstreamGetUserCall(),
+			wantStatus:                    http.StatusUnauthorized,
+			wantErrorResponseBody: here.Doc(`
+				{
+					"error":             "error",
+					"error_description": "Error during upstream refresh. Upstream refresh failed."
+				}
+			`),
+		}
+	}
+
+	samlCustomSessionData := func(sessionExpiry time.Time) *psession.CustomSessionData {
+		return &psession.CustomSessionData{
+			ProviderUID:  samlUpstreamResourceUID,
+			ProviderName: samlUpstreamName,
+			ProviderType: samlUpstreamType,
+			SAML: &psession.SAMLSessionData{
+				NameID:        samlUpstreamNameID,
+				SessionExpiry: sessionExpiry,
+			},
+		}
+	}
+	happySAMLCustomSessionData := samlCustomSessionData(time.Now().Add(time.Hour).UTC().Truncate(time.Second))
+	expiredSAMLCustomSessionData := samlCustomSessionData(time.Now().Add(-time.Minute).UTC().Truncate(time.Second))
+	unlimitedSAMLCustomSessionData := samlCustomSessionData(time.Time{})
+	upstreamSAMLIdentityProvider := &oidctestutil.TestUpstreamSAMLIdentityProvider{
+		Name:        samlUpstreamName,
+		ResourceUID: samlUpstreamResourceUID,
+	}
+
+	clientCA, err := certauthority.New("some-client-ca", time.Hour)
+	require.NoError(t, err)
+	clientCert, err := clientCA.IssueClientCert("some-certificate-user", nil, time.Hour)
+	require.NoError(t, err)
+	happyCertificateCustomSessionData := &psession.CustomSessionData{
+		ProviderUID:  certificateUpstreamResourceUID,
+		ProviderName: certificateUpstreamName,
+		ProviderType: certificateUpstreamType,
+		Certificate: &psession.CertificateSessionData{
+			PeerCertificates: clientCert.Certificate,
+		},
+	}
+	refreshedCertificateGroups := []string{"some-certificate-group"}
+	upstreamCertificateIdentityProvider := func(user *provider.CertificateUser, err error) *oidctestutil.TestUpstreamCertificateIdentityProvider {
+		return &oidctestutil.TestUpstreamCertificateIdentityProvider{
+			Name:        certificateUpstreamName,
+			ResourceUID: certificateUpstreamResourceUID,
+			AuthenticateCertificateFunc: func(peerCertificates []*x509.Certificate) (*provider.CertificateUser, error) {
+				if len(peerCertificates) != 1 || !bytes.Equal(peerCertificates[0].Raw, clientCert.Certificate[0]) {
+					return nil, errors.New("unexpected peer certificates")
+				}
+				return user, err
+			},
+		}
+	}
+	certificateRefreshFailedResponse := tokenEndpointResponseExpectedValues{
+		wantStatus: http.StatusUnauthorized,
+		wantErrorResponseBody: here.Doc(`
+			{
+				"error":             "error",
+				"error_description": "Error during upstream refresh. Upstream refresh failed."
+			}
+		`),
+	}
+
+	tests := []struct {
+		name                      string
+		idps                      *oidctestutil.UpstreamIDPListerBuilder
+		authcodeExchange          authcodeExchangeInputs
+		refreshRequest            refreshRequestInputs
+		modifyRefreshTokenStorage func(t *testing.T, oauthStore *oidc.KubeStorage, refreshToken string)
+	}{
+		{
+			name: "happy path refresh grant with openid scope granted (id token returned)",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub": goodUpstreamSubject,
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
+					upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					refreshedUpstreamTokensWithIDAndRefreshTokens(),
+				),
+			},
+		},
+		{
+			name: "refresh grant with unchanged username claim",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithUsernameClaim("username-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"some-claim":     "some-value",
+							"sub":            goodUpstreamSubject,
+							"username-claim": goodUsername,
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
+					upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					refreshedUpstreamTokensWithIDAndRefreshTokens(),
+				),
+			},
+		},
+		{
+			name: "refresh grant when the customsessiondata has a stored access token and no stored refresh token",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithUsernameClaim("username-claim").
+					WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+						IDToken: &oidctypes.IDToken{
+							Claims: map[string]interface{}{
+								"some-claim":     "some-value",
+								"sub":            goodUpstreamSubject,
+								"username-claim": goodUsername,
+							},
+						},
+						AccessToken: &oidctypes.AccessToken{
+							Token: oidcUpstreamAccessToken,
+						},
+					}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCAccessTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCAccessTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusOK,
+					wantSuccessBodyFields: []string{"refresh_token", "id_token", "access_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:   []string{"openid", "offline_access"},
+					wantGrantedScopes:     []string{"openid", "offline_access"},
+					wantGroups:            goodGroups,
+					wantUpstreamOIDCValidateTokenCall: &expectedUpstreamValidateTokens{
+						oidcUpstreamName,
+						&oidctestutil.ValidateTokenAndMergeWithUserInfoArgs{
+							Ctx:                  nil,                                                 // this will be filled in with the actual request context by the test below
+							Tok:                  &oauth2.Token{AccessToken: oidcUpstreamAccessToken}, // only the old access token
+							ExpectedIDTokenNonce: "",                                                  // always expect empty string
+							RequireIDToken:       false,
+							RequireUserInfo:      true,
+						},
+					},
+					wantCustomSessionDataStored: initialUpstreamOIDCAccessTokenCustomSessionData(), // doesn't change when we refresh
+				},
+			},
+		},
+		{
+			name: "happy path refresh grant without openid scope granted (no id token returned)",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithRefreshTokenWithoutIDToken()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "offline_access") },
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                  http.StatusOK,
+					wantSuccessBodyFields:       []string{"refresh_token", "access_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:         []string{"offline_access"},
+					wantGrantedScopes:           []string{"offline_access"},
+					wantCustomSessionDataStored: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				},
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusOK,
+					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:               []string{"offline_access"},
+					wantGrantedScopes:                 []string{"offline_access"},
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithRefreshTokenWithoutIDToken(), false),
+					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+				},
+			},
+		},
+		{
+			name: "happy path refresh grant when the upstream refresh does not return a new ID token",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithRefreshTokenWithoutIDToken()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusOK,
+					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:               []string{"openid", "offline_access"},
+					wantGrantedScopes:                 []string{"openid", "offline_access"},
+					wantGroups:                        goodGroups,
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithRefreshTokenWithoutIDToken(), false),
+					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+				},
+			},
+		},
+		{
+			name: "happy path refresh grant when the upstream refresh returns new group memberships (as strings) from the merged ID token and userinfo results, it updates groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub":             goodUpstreamSubject,
+							"my-groups-claim": []string{"new-group1", "new-group2", "new-group3"}, // refreshed claims includes updated groups
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusOK,
+					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:               []string{"openid", "offline_access"},
+					wantGrantedScopes:                 []string{"openid", "offline_access"},
+					wantGroups:                        []string{"new-group1", "new-group2", "new-group3"},
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+				},
+			},
+		},
+		{
+			name: "happy path refresh grant when the upstream refresh returns new group memberships (as interface{} types) from the merged ID token and userinfo results, it updates groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub":             goodUpstreamSubject,
+							"my-groups-claim": []interface{}{"new-group1", "new-group2", "new-group3"}, // refreshed claims includes updated groups
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusOK,
+					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:               []string{"openid", "offline_access"},
+					wantGrantedScopes:                 []string{"openid", "offline_access"},
+					wantGroups:                        []string{"new-group1", "new-group2", "new-group3"},
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+				},
+			},
 		},
-	}
-	happyLDAPCustomSessionData := &psession.CustomSessionData{
-		ProviderUID:  ldapUpstreamResourceUID,
-		ProviderName: ldapUpstreamName,
-		ProviderType: ldapUpstreamType,
-		LDAP: &psession.LDAPSessionData{
-			UserDN: ldapUpstreamDN,
+		{
+			name: "happy path refresh grant when the upstream refresh returns new group memberships as an empty list from the merged ID token and userinfo results, it updates groups to be empty",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub":             goodUpstreamSubject,
+							"my-groups-claim": []string{}, // refreshed groups claims is updated to be an empty list
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusOK,
+					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:               []string{"openid", "offline_access"},
+					wantGrantedScopes:                 []string{"openid", "offline_access"},
+					wantGroups:                        []string{}, // the user no longer belongs to any groups
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+				},
+			},
 		},
-	}
-	tests := []struct {
-		name                      string
-		idps                      *oidctestutil.UpstreamIDPListerBuilder
-		authcodeExchange          authcodeExchangeInputs
-		refreshRequest            refreshRequestInputs
-		modifyRefreshTokenStorage func(t *testing.T, oauthStore *oidc.KubeStorage, refreshToken string)
-	}{
 		{
-			name: "happy path refresh grant with openid scope granted (id token returned)",
+			name: "happy path refresh grant when the upstream refresh does not return new group memberships from the merged ID token and userinfo results by omitting claim, it keeps groups from initial login",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub": goodUpstreamSubject,
+							// "my-groups-claim" is omitted from the refreshed claims
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusOK,
+					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:               []string{"openid", "offline_access"},
+					wantGrantedScopes:                 []string{"openid", "offline_access"},
+					wantGroups:                        goodGroups, // the same groups as from the initial login
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+				},
+			},
+		},
+		{
+			name: "error from refresh grant when the upstream refresh does not return new group memberships from the merged ID token and userinfo results by returning group claim with illegal nil value",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub":             goodUpstreamSubject,
+							"my-groups-claim": nil,
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusUnauthorized,
+					wantErrorResponseBody:             fositeUpstreamGroupClaimErrorBody,
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+				},
+			},
+		},
+		{
+			name: "happy path refresh grant when the upstream refresh does not return a new refresh token",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub": goodUpstreamSubject,
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDTokenWithoutRefreshToken()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
+					initialUpstreamOIDCRefreshTokenCustomSessionData(), // still has the initial refresh token stored
+					refreshedUpstreamTokensWithIDTokenWithoutRefreshToken(),
+				),
+			},
+		},
+		{
+			name: "when the refresh request adds a new scope to the list of requested scopes then it is ignored",
 			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
 				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
 					IDToken: &oidctypes.IDToken{
@@ -1094,6 +2299,9 @@ func TestRefreshGrant(t *testing.T) {
 				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
 			},
 			refreshRequest: refreshRequestInputs{
+				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
+					r.Body = happyRefreshRequestBody(refreshToken).WithScope("openid some-other-scope-not-from-auth-request").ReadCloser()
+				},
 				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
 					upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
 					refreshedUpstreamTokensWithIDAndRefreshTokens(),
@@ -1101,14 +2309,50 @@ func TestRefreshGrant(t *testing.T) {
 			},
 		},
 		{
-			name: "refresh grant with unchanged username claim",
+			name: "when the refresh request removes a scope which was originally granted from the list of requested scopes then it is granted anyway",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub": goodUpstreamSubject,
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access pinniped:request-audience") },
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                  http.StatusOK,
+					wantSuccessBodyFields:       []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:         []string{"openid", "offline_access", "pinniped:request-audience"},
+					wantGrantedScopes:           []string{"openid", "offline_access", "pinniped:request-audience"},
+					wantGroups:                  goodGroups,
+					wantCustomSessionDataStored: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				},
+			},
+			refreshRequest: refreshRequestInputs{
+				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
+					r.Body = happyRefreshRequestBody(refreshToken).WithScope("openid").ReadCloser() // do not ask for "pinniped:request-audience" again
+				},
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusOK,
+					wantSuccessBodyFields:             []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:               []string{"openid", "offline_access", "pinniped:request-audience"},
+					wantGrantedScopes:                 []string{"openid", "offline_access", "pinniped:request-audience"},
+					wantGroups:                        goodGroups,
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+				},
+			},
+		},
+		{
+			name: "when the refresh request does not include a scope param then it gets all the same scopes as the original authorization request",
 			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithUsernameClaim("username-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
 					IDToken: &oidctypes.IDToken{
 						Claims: map[string]interface{}{
-							"some-claim":     "some-value",
-							"sub":            goodUpstreamSubject,
-							"username-claim": goodUsername,
+							"sub": goodUpstreamSubject,
 						},
 					},
 				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
@@ -1118,6 +2362,9 @@ func TestRefreshGrant(t *testing.T) {
 				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
 			},
 			refreshRequest: refreshRequestInputs{
+				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
+					r.Body = happyRefreshRequestBody(refreshToken).WithScope("").ReadCloser()
+				},
 				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
 					upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
 					refreshedUpstreamTokensWithIDAndRefreshTokens(),
@@ -1125,55 +2372,32 @@ func TestRefreshGrant(t *testing.T) {
 			},
 		},
 		{
-			name: "refresh grant when the customsessiondata has a stored access token and no stored refresh token",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithUsernameClaim("username-claim").
-					WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-						IDToken: &oidctypes.IDToken{
-							Claims: map[string]interface{}{
-								"some-claim":     "some-value",
-								"sub":            goodUpstreamSubject,
-								"username-claim": goodUsername,
-							},
-						},
-						AccessToken: &oidctypes.AccessToken{
-							Token: oidcUpstreamAccessToken,
-						},
-					}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			name: "when a bad refresh token is sent in the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCAccessTokenCustomSessionData(),
-				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCAccessTokenCustomSessionData()),
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "offline_access") },
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                  http.StatusOK,
+					wantSuccessBodyFields:       []string{"refresh_token", "access_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:         []string{"offline_access"},
+					wantGrantedScopes:           []string{"offline_access"},
+					wantCustomSessionDataStored: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				},
 			},
 			refreshRequest: refreshRequestInputs{
+				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
+					r.Body = happyRefreshRequestBody(refreshToken).WithRefreshToken("bad refresh token").ReadCloser()
+				},
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusOK,
-					wantSuccessBodyFields: []string{"refresh_token", "id_token", "access_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:   []string{"openid", "offline_access"},
-					wantGrantedScopes:     []string{"openid", "offline_access"},
-					wantGroups:            goodGroups,
-					wantUpstreamOIDCValidateTokenCall: &expectedUpstreamValidateTokens{
-						oidcUpstreamName,
-						&oidctestutil.ValidateTokenAndMergeWithUserInfoArgs{
-							Ctx:                  nil,                                                 // this will be filled in with the actual request context by the test below
-							Tok:                  &oauth2.Token{AccessToken: oidcUpstreamAccessToken}, // only the old access token
-							ExpectedIDTokenNonce: "",                                                  // always expect empty string
-							RequireIDToken:       false,
-							RequireUserInfo:      true,
-						},
-					},
-					wantCustomSessionDataStored: initialUpstreamOIDCAccessTokenCustomSessionData(), // doesn't change when we refresh
+					wantStatus:            http.StatusBadRequest,
+					wantErrorResponseBody: fositeInvalidAuthCodeErrorBody,
 				},
 			},
 		},
 		{
-			name: "happy path refresh grant without openid scope granted (no id token returned)",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithRefreshTokenWithoutIDToken()).Build()),
+			name: "when the access token is sent as if it were a refresh token",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
 			authcodeExchange: authcodeExchangeInputs{
 				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "offline_access") },
@@ -1186,170 +2410,290 @@ func TestRefreshGrant(t *testing.T) {
 				},
 			},
 			refreshRequest: refreshRequestInputs{
+				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
+					r.Body = happyRefreshRequestBody(refreshToken).WithRefreshToken(accessToken).ReadCloser()
+				},
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                        http.StatusOK,
-					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:               []string{"offline_access"},
-					wantGrantedScopes:                 []string{"offline_access"},
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithRefreshTokenWithoutIDToken(), false),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantStatus:            http.StatusBadRequest,
+					wantErrorResponseBody: fositeInvalidAuthCodeErrorBody,
 				},
 			},
 		},
 		{
-			name: "happy path refresh grant when the upstream refresh does not return a new ID token",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithRefreshTokenWithoutIDToken()).Build()),
+			name: "when the wrong client ID is included in the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
 			authcodeExchange: authcodeExchangeInputs{
 				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "offline_access") },
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                  http.StatusOK,
+					wantSuccessBodyFields:       []string{"refresh_token", "access_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:         []string{"offline_access"},
+					wantGrantedScopes:           []string{"offline_access"},
+					wantCustomSessionDataStored: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				},
+			},
+			refreshRequest: refreshRequestInputs{
+				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
+					r.Body = happyRefreshRequestBody(refreshToken).WithClientID("wrong-client-id").ReadCloser()
+				},
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusUnauthorized,
+					wantErrorResponseBody: fositeInvalidClientErrorBody,
+				},
+			},
+		},
+		{
+			name: "when there is no custom session data found in the session storage during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: nil, // this should not happen in practice
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(nil),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                        http.StatusOK,
-					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:               []string{"openid", "offline_access"},
-					wantGrantedScopes:                 []string{"openid", "offline_access"},
-					wantGroups:                        goodGroups,
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithRefreshTokenWithoutIDToken(), false),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantStatus:            http.StatusInternalServerError,
+					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
 				},
 			},
 		},
 		{
-			name: "happy path refresh grant when the upstream refresh returns new group memberships (as strings) from the merged ID token and userinfo results, it updates groups",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"sub":             goodUpstreamSubject,
-							"my-groups-claim": []string{"new-group1", "new-group2", "new-group3"}, // refreshed claims includes updated groups
-						},
+			name: "when there is no provider name in custom session data found in the session storage during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: &psession.CustomSessionData{
+					ProviderName: "", // this should not happen in practice
+					ProviderUID:  oidcUpstreamResourceUID,
+					ProviderType: oidcUpstreamType,
+					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+				},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
+						ProviderName: "", // this should not happen in practice
+						ProviderUID:  oidcUpstreamResourceUID,
+						ProviderType: oidcUpstreamType,
+						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
 					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusInternalServerError,
+					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
+				},
+			},
+		},
+		{
+			name: "when there is no provider UID in custom session data found in the session storage during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				customSessionData: &psession.CustomSessionData{
+					ProviderName: oidcUpstreamName,
+					ProviderUID:  "", // this should not happen in practice
+					ProviderType: oidcUpstreamType,
+					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
+						ProviderName: oidcUpstreamName,
+						ProviderUID:  "", // this should not happen in practice
+						ProviderType: oidcUpstreamType,
+						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+					},
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusInternalServerError,
+					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
+				},
+			},
+		},
+		{
+			name: "when there is no provider type in custom session data found in the session storage during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: &psession.CustomSessionData{
+					ProviderName: oidcUpstreamName,
+					ProviderUID:  oidcUpstreamResourceUID,
+					ProviderType: "", // this should not happen in practice
+					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+				},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
+						ProviderName: oidcUpstreamName,
+						ProviderUID:  oidcUpstreamResourceUID,
+						ProviderType: "", // this should not happen in practice
+						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+					},
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusInternalServerError,
+					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
+				},
+			},
+		},
+		{
+			name: "when there is an illegal provider type in custom session data found in the session storage during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: &psession.CustomSessionData{
+					ProviderName: oidcUpstreamName,
+					ProviderUID:  oidcUpstreamResourceUID,
+					ProviderType: "not-an-allowed-provider-type", // this should not happen in practice
+					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+				},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
+						ProviderName: oidcUpstreamName,
+						ProviderUID:  oidcUpstreamResourceUID,
+						ProviderType: "not-an-allowed-provider-type", // this should not happen in practice
+						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+					},
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusInternalServerError,
+					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
+				},
+			},
+		},
+		{
+			name: "when there is no OIDC-specific data in custom session data found in the session storage during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: &psession.CustomSessionData{
+					ProviderName: oidcUpstreamName,
+					ProviderUID:  oidcUpstreamResourceUID,
+					ProviderType: oidcUpstreamType,
+					OIDC:         nil, // this should not happen in practice
+				},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
+						ProviderName: oidcUpstreamName,
+						ProviderUID:  oidcUpstreamResourceUID,
+						ProviderType: oidcUpstreamType,
+						OIDC:         nil, // this should not happen in practice
+					},
+				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                        http.StatusOK,
-					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:               []string{"openid", "offline_access"},
-					wantGrantedScopes:                 []string{"openid", "offline_access"},
-					wantGroups:                        []string{"new-group1", "new-group2", "new-group3"},
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantStatus:            http.StatusInternalServerError,
+					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
 				},
 			},
 		},
 		{
-			name: "happy path refresh grant when the upstream refresh returns new group memberships (as interface{} types) from the merged ID token and userinfo results, it updates groups",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"sub":             goodUpstreamSubject,
-							"my-groups-claim": []interface{}{"new-group1", "new-group2", "new-group3"}, // refreshed claims includes updated groups
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			name: "when there is no OIDC refresh token nor access token in custom session data found in the session storage during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				customSessionData: &psession.CustomSessionData{
+					ProviderName: oidcUpstreamName,
+					ProviderUID:  oidcUpstreamResourceUID,
+					ProviderType: oidcUpstreamType,
+					OIDC: &psession.OIDCSessionData{
+						UpstreamRefreshToken: "", // this should not happen in practice. we should always have exactly one of these.
+						UpstreamAccessToken:  "",
+					},
+				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
+						ProviderName: oidcUpstreamName,
+						ProviderUID:  oidcUpstreamResourceUID,
+						ProviderType: oidcUpstreamType,
+						OIDC: &psession.OIDCSessionData{
+							UpstreamRefreshToken: "", // this should not happen in practice
+							UpstreamAccessToken:  "",
+						},
+					},
+				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                        http.StatusOK,
-					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:               []string{"openid", "offline_access"},
-					wantGrantedScopes:                 []string{"openid", "offline_access"},
-					wantGroups:                        []string{"new-group1", "new-group2", "new-group3"},
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantStatus:            http.StatusInternalServerError,
+					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
 				},
 			},
 		},
 		{
-			name: "happy path refresh grant when the upstream refresh returns new group memberships as an empty list from the merged ID token and userinfo results, it updates groups to be empty",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"sub":             goodUpstreamSubject,
-							"my-groups-claim": []string{}, // refreshed groups claims is updated to be an empty list
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			name: "when the provider in the session storage is not found due to its name during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				customSessionData: &psession.CustomSessionData{
+					ProviderName: "this-name-will-not-be-found", // this could happen if the OIDCIdentityProvider was deleted since original login
+					ProviderUID:  oidcUpstreamResourceUID,
+					ProviderType: oidcUpstreamType,
+					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
+						ProviderName: "this-name-will-not-be-found", // this could happen if the OIDCIdentityProvider was deleted since original login
+						ProviderUID:  oidcUpstreamResourceUID,
+						ProviderType: oidcUpstreamType,
+						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+					},
+				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                        http.StatusOK,
-					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:               []string{"openid", "offline_access"},
-					wantGrantedScopes:                 []string{"openid", "offline_access"},
-					wantGroups:                        []string{}, // the user no longer belongs to any groups
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantStatus: http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Provider from upstream session data was not found."
+						}
+					`),
 				},
 			},
 		},
 		{
-			name: "happy path refresh grant when the upstream refresh does not return new group memberships from the merged ID token and userinfo results by omitting claim, it keeps groups from initial login",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"sub": goodUpstreamSubject,
-							// "my-groups-claim" is omitted from the refreshed claims
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			name: "when the provider in the session storage is found but has the wrong resource UID during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				customSessionData: &psession.CustomSessionData{
+					ProviderName: oidcUpstreamName,
+					ProviderUID:  "this is the wrong uid", // this could happen if the OIDCIdentityProvider was deleted and recreated at the same name since original login
+					ProviderType: oidcUpstreamType,
+					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
+						ProviderName: oidcUpstreamName,
+						ProviderUID:  "this is the wrong uid", // this could happen if the OIDCIdentityProvider was deleted and recreated at the same name since original login
+						ProviderType: oidcUpstreamType,
+						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+					},
+				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                        http.StatusOK,
-					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:               []string{"openid", "offline_access"},
-					wantGrantedScopes:                 []string{"openid", "offline_access"},
-					wantGroups:                        goodGroups, // the same groups as from the initial login
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantStatus: http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Provider from upstream session data has changed its resource UID since authentication."
+						}
+					`),
 				},
 			},
 		},
 		{
-			name: "error from refresh grant when the upstream refresh does not return new group memberships from the merged ID token and userinfo results by returning group claim with illegal nil value",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"sub":             goodUpstreamSubject,
-							"my-groups-claim": nil,
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			name: "when the upstream refresh fails during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().
+				WithPerformRefreshError(errors.New("some upstream refresh error")).Build()),
 			authcodeExchange: authcodeExchangeInputs{
 				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
@@ -1357,105 +2701,82 @@ func TestRefreshGrant(t *testing.T) {
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                        http.StatusUnauthorized,
-					wantErrorResponseBody:             fositeUpstreamGroupClaimErrorBody,
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantUpstreamRefreshCall: happyOIDCUpstreamRefreshCall(),
+					wantStatus:              http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Upstream refresh failed."
+						}
+					`),
 				},
 			},
 		},
 		{
-			name: "happy path refresh grant when the upstream refresh does not return a new refresh token",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"sub": goodUpstreamSubject,
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDTokenWithoutRefreshToken()).Build()),
+			name: "when the upstream refresh returns an invalid ID token during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().
+				WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).
+				// This is the current format of the errors returned by the production code version of ValidateTokenAndMergeWithUserInfo, see ValidateTokenAndMergeWithUserInfo in upstreamoidc.go
+				WithValidateTokenAndMergeWithUserInfoError(httperr.Wrap(http.StatusBadRequest, "some validate error", errors.New("some validate cause"))).
+				Build()),
 			authcodeExchange: authcodeExchangeInputs{
 				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
 				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
-					initialUpstreamOIDCRefreshTokenCustomSessionData(), // still has the initial refresh token stored
-					refreshedUpstreamTokensWithIDTokenWithoutRefreshToken(),
-				),
+				want: tokenEndpointResponseExpectedValues{
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantStatus:                        http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Upstream refresh returned an invalid ID token or UserInfo response."
+						}
+					`),
+				},
 			},
 		},
 		{
-			name: "when the refresh request adds a new scope to the list of requested scopes then it is ignored",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+			name: "when the upstream refresh returns an ID token with a different subject than the original",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().
+				WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).
+				// This is the current format of the errors returned by the production code version of ValidateTokenAndMergeWithUserInfo, see ValidateTokenAndMergeWithUserInfo in upstreamoidc.go
+				WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
 					IDToken: &oidctypes.IDToken{
 						Claims: map[string]interface{}{
-							"sub": goodUpstreamSubject,
+							"sub": "something-different",
 						},
 					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+				}).
+				Build()),
 			authcodeExchange: authcodeExchangeInputs{
 				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
 				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
 			},
 			refreshRequest: refreshRequestInputs{
-				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
-					r.Body = happyRefreshRequestBody(refreshToken).WithScope("openid some-other-scope-not-from-auth-request").ReadCloser()
-				},
-				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
-					upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
-					refreshedUpstreamTokensWithIDAndRefreshTokens(),
-				),
-			},
-		},
-		{
-			name: "when the refresh request removes a scope which was originally granted from the list of requested scopes then it is granted anyway",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"sub": goodUpstreamSubject,
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
-			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
-				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access pinniped:request-audience") },
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                  http.StatusOK,
-					wantSuccessBodyFields:       []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:         []string{"openid", "offline_access", "pinniped:request-audience"},
-					wantGrantedScopes:           []string{"openid", "offline_access", "pinniped:request-audience"},
-					wantGroups:                  goodGroups,
-					wantCustomSessionDataStored: initialUpstreamOIDCRefreshTokenCustomSessionData(),
-				},
-			},
-			refreshRequest: refreshRequestInputs{
-				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
-					r.Body = happyRefreshRequestBody(refreshToken).WithScope("openid").ReadCloser() // do not ask for "pinniped:request-audience" again
-				},
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                        http.StatusOK,
-					wantSuccessBodyFields:             []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:               []string{"openid", "offline_access", "pinniped:request-audience"},
-					wantGrantedScopes:                 []string{"openid", "offline_access", "pinniped:request-audience"},
-					wantGroups:                        goodGroups,
 					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
 					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantStatus:                        http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Upstream refresh failed."
+						}
+					`),
 				},
 			},
 		},
 		{
-			name: "when the refresh request does not include a scope param then it gets all the same scopes as the original authorization request",
+			name: "refresh grant with claims but not the subject claim",
 			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
 				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
 					IDToken: &oidctypes.IDToken{
 						Claims: map[string]interface{}{
-							"sub": goodUpstreamSubject,
+							"some-claim": "some-value",
 						},
 					},
 				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
@@ -1465,288 +2786,256 @@ func TestRefreshGrant(t *testing.T) {
 				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
 			},
 			refreshRequest: refreshRequestInputs{
-				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
-					r.Body = happyRefreshRequestBody(refreshToken).WithScope("").ReadCloser()
+				want: tokenEndpointResponseExpectedValues{
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantStatus:                        http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Upstream refresh failed."
+						}
+					`),
 				},
-				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
-					upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
-					refreshedUpstreamTokensWithIDAndRefreshTokens(),
-				),
 			},
 		},
 		{
-			name: "when a bad refresh token is sent in the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "refresh grant with changed username claim",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithUsernameClaim("username-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"some-claim":     "some-value",
+							"sub":            goodUpstreamSubject,
+							"username-claim": "some-changed-username",
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
 			authcodeExchange: authcodeExchangeInputs{
 				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
-				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "offline_access") },
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                  http.StatusOK,
-					wantSuccessBodyFields:       []string{"refresh_token", "access_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:         []string{"offline_access"},
-					wantGrantedScopes:           []string{"offline_access"},
-					wantCustomSessionDataStored: initialUpstreamOIDCRefreshTokenCustomSessionData(),
-				},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
 			},
 			refreshRequest: refreshRequestInputs{
-				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
-					r.Body = happyRefreshRequestBody(refreshToken).WithRefreshToken("bad refresh token").ReadCloser()
-				},
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusBadRequest,
-					wantErrorResponseBody: fositeInvalidAuthCodeErrorBody,
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantStatus:                        http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Upstream refresh failed."
+						}
+					`),
 				},
 			},
 		},
 		{
-			name: "when the access token is sent as if it were a refresh token",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "refresh grant with changed issuer claim",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithUsernameClaim("username-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"some-claim": "some-value",
+							"sub":        goodUpstreamSubject,
+							"iss":        "some-changed-issuer",
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
 			authcodeExchange: authcodeExchangeInputs{
 				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
-				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "offline_access") },
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                  http.StatusOK,
-					wantSuccessBodyFields:       []string{"refresh_token", "access_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:         []string{"offline_access"},
-					wantGrantedScopes:           []string{"offline_access"},
-					wantCustomSessionDataStored: initialUpstreamOIDCRefreshTokenCustomSessionData(),
-				},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
 			},
 			refreshRequest: refreshRequestInputs{
-				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
-					r.Body = happyRefreshRequestBody(refreshToken).WithRefreshToken(accessToken).ReadCloser()
-				},
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusBadRequest,
-					wantErrorResponseBody: fositeInvalidAuthCodeErrorBody,
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantStatus:                        http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Upstream refresh failed."
+						}
+					`),
 				},
 			},
 		},
 		{
-			name: "when the wrong client ID is included in the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "upstream ldap refresh happy path updates the groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:                 ldapUpstreamName,
+				ResourceUID:          ldapUpstreamResourceUID,
+				URL:                  ldapUpstreamURL,
+				PerformRefreshGroups: refreshedLDAPGroups,
+			}),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
-				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "offline_access") },
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:                  http.StatusOK,
-					wantSuccessBodyFields:       []string{"refresh_token", "access_token", "token_type", "expires_in", "scope"},
-					wantRequestedScopes:         []string{"offline_access"},
-					wantGrantedScopes:           []string{"offline_access"},
-					wantCustomSessionDataStored: initialUpstreamOIDCRefreshTokenCustomSessionData(),
-				},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyLDAPCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happyLDAPCustomSessionData,
+				),
 			},
 			refreshRequest: refreshRequestInputs{
-				modifyTokenRequest: func(r *http.Request, refreshToken string, accessToken string) {
-					r.Body = happyRefreshRequestBody(refreshToken).WithClientID("wrong-client-id").ReadCloser()
-				},
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusUnauthorized,
-					wantErrorResponseBody: fositeInvalidClientErrorBody,
-				},
+				want: happyRefreshTokenResponseForLDAP(
+					happyLDAPCustomSessionData,
+				),
 			},
 		},
 		{
-			name: "when there is no custom session data found in the session storage during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "upstream active directory refresh happy path updates the groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:                 activeDirectoryUpstreamName,
+				ResourceUID:          activeDirectoryUpstreamResourceUID,
+				URL:                  ldapUpstreamURL,
+				PerformRefreshGroups: refreshedLDAPGroups,
+			}),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: nil, // this should not happen in practice
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(nil),
+				customSessionData: happyActiveDirectoryCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happyActiveDirectoryCustomSessionData,
+				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusInternalServerError,
-					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
-				},
+				want: happyRefreshTokenResponseForActiveDirectory(
+					happyActiveDirectoryCustomSessionData,
+				),
 			},
 		},
 		{
-			name: "when there is no provider name in custom session data found in the session storage during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "upstream ldap refresh happy path when the user no longer belongs to any groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:        ldapUpstreamName,
+				ResourceUID: ldapUpstreamResourceUID,
+				URL:         ldapUpstreamURL,
+			}),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: &psession.CustomSessionData{
-					ProviderName: "", // this should not happen in practice
-					ProviderUID:  oidcUpstreamResourceUID,
-					ProviderType: oidcUpstreamType,
-					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyLDAPCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
-						ProviderName: "", // this should not happen in practice
-						ProviderUID:  oidcUpstreamResourceUID,
-						ProviderType: oidcUpstreamType,
-						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-					},
+					happyLDAPCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusInternalServerError,
-					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
-				},
+				want: func() tokenEndpointResponseExpectedValues {
+					want := happyRefreshTokenResponseForLDAP(happyLDAPCustomSessionData)
+					want.wantGroups = []string{}
+					return want
+				}(),
 			},
 		},
 		{
-			name: "when there is no provider UID in custom session data found in the session storage during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "upstream github refresh happy path updates the groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(upstreamGitHubIdentityProvider(&provider.GitHubUser{
+				Username:          goodUsername,
+				Groups:            refreshedGitHubGroups,
+				DownstreamSubject: goodSubject,
+			}, nil)),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: &psession.CustomSessionData{
-					ProviderName: oidcUpstreamName,
-					ProviderUID:  "", // this should not happen in practice
-					ProviderType: oidcUpstreamType,
-					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyGitHubCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
-						ProviderName: oidcUpstreamName,
-						ProviderUID:  "", // this should not happen in practice
-						ProviderType: oidcUpstreamType,
-						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-					},
+					happyGitHubCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusInternalServerError,
-					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
-				},
+				want: func() tokenEndpointResponseExpectedValues {
+					want := happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(happyGitHubCustomSessionData)
+					want.wantUpstreamGitHubGetUserCall = happyGitHubUpstreamGetUserCall()
+					want.wantGroups = refreshedGitHubGroups
+					return want
+				}(),
 			},
 		},
 		{
-			name: "when there is no provider type in custom session data found in the session storage during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "upstream github refresh when the GitHub session data is nil",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(upstreamGitHubIdentityProvider(nil, errors.New("should not be called"))),
 			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
 				customSessionData: &psession.CustomSessionData{
-					ProviderName: oidcUpstreamName,
-					ProviderUID:  oidcUpstreamResourceUID,
-					ProviderType: "", // this should not happen in practice
-					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+					ProviderUID:  githubUpstreamResourceUID,
+					ProviderName: githubUpstreamName,
+					ProviderType: githubUpstreamType,
 				},
-				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
-						ProviderName: oidcUpstreamName,
-						ProviderUID:  oidcUpstreamResourceUID,
-						ProviderType: "", // this should not happen in practice
-						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
+					&psession.CustomSessionData{
+						ProviderUID:  githubUpstreamResourceUID,
+						ProviderName: githubUpstreamName,
+						ProviderType: githubUpstreamType,
 					},
 				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusInternalServerError,
-					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
+					wantStatus: http.StatusInternalServerError,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "There was an internal server error. Required upstream data not found in session."
+						}
+					`),
 				},
 			},
 		},
 		{
-			name: "when there is an illegal provider type in custom session data found in the session storage during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "upstream github refresh when the user can no longer be fetched, e.g. because they revoked the authorization or left the allowed organizations",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(upstreamGitHubIdentityProvider(nil, provider.ErrGitHubUserNotAllowed)),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: &psession.CustomSessionData{
-					ProviderName: oidcUpstreamName,
-					ProviderUID:  oidcUpstreamResourceUID,
-					ProviderType: "not-an-allowed-provider-type", // this should not happen in practice
-					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyGitHubCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
-						ProviderName: oidcUpstreamName,
-						ProviderUID:  oidcUpstreamResourceUID,
-						ProviderType: "not-an-allowed-provider-type", // this should not happen in practice
-						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-					},
+					happyGitHubCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusInternalServerError,
-					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
-				},
+				want: githubRefreshFailedResponse(),
 			},
 		},
 		{
-			name: "when there is no OIDC-specific data in custom session data found in the session storage during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "upstream github refresh when the user's ID has changed",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(upstreamGitHubIdentityProvider(&provider.GitHubUser{
+				Username:          goodUsername,
+				Groups:            refreshedGitHubGroups,
+				DownstreamSubject: "https://api.github.com?idpName=some-github-idp&sub=5678",
+			}, nil)),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: &psession.CustomSessionData{
-					ProviderName: oidcUpstreamName,
-					ProviderUID:  oidcUpstreamResourceUID,
-					ProviderType: oidcUpstreamType,
-					OIDC:         nil, // this should not happen in practice
-				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyGitHubCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
-						ProviderName: oidcUpstreamName,
-						ProviderUID:  oidcUpstreamResourceUID,
-						ProviderType: oidcUpstreamType,
-						OIDC:         nil, // this should not happen in practice
-					},
+					happyGitHubCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusInternalServerError,
-					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
-				},
+				want: githubRefreshFailedResponse(),
 			},
 		},
 		{
-			name: "when there is no OIDC refresh token nor access token in custom session data found in the session storage during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
-			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: &psession.CustomSessionData{
-					ProviderName: oidcUpstreamName,
-					ProviderUID:  oidcUpstreamResourceUID,
-					ProviderType: oidcUpstreamType,
-					OIDC: &psession.OIDCSessionData{
-						UpstreamRefreshToken: "", // this should not happen in practice. we should always have exactly one of these.
-						UpstreamAccessToken:  "",
-					},
-				},
+			name: "upstream github refresh when the username has changed",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(upstreamGitHubIdentityProvider(&provider.GitHubUser{
+				Username:          "some-new-username",
+				Groups:            refreshedGitHubGroups,
+				DownstreamSubject: goodSubject,
+			}, nil)),
+			authcodeExchange: authcodeExchangeInputs{
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyGitHubCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
-						ProviderName: oidcUpstreamName,
-						ProviderUID:  oidcUpstreamResourceUID,
-						ProviderType: oidcUpstreamType,
-						OIDC: &psession.OIDCSessionData{
-							UpstreamRefreshToken: "", // this should not happen in practice
-							UpstreamAccessToken:  "",
-						},
-					},
+					happyGitHubCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: tokenEndpointResponseExpectedValues{
-					wantStatus:            http.StatusInternalServerError,
-					wantErrorResponseBody: pinnipedUpstreamSessionDataNotFoundErrorBody,
-				},
+				want: githubRefreshFailedResponse(),
 			},
 		},
 		{
-			name: "when the provider in the session storage is not found due to its name during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "upstream github idp not found",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder(),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: &psession.CustomSessionData{
-					ProviderName: "this-name-will-not-be-found", // this could happen if the OIDCIdentityProvider was deleted since original login
-					ProviderUID:  oidcUpstreamResourceUID,
-					ProviderType: oidcUpstreamType,
-					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyGitHubCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
-						ProviderName: "this-name-will-not-be-found", // this could happen if the OIDCIdentityProvider was deleted since original login
-						ProviderUID:  oidcUpstreamResourceUID,
-						ProviderType: oidcUpstreamType,
-						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-					},
+					happyGitHubCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
@@ -1762,23 +3051,16 @@ func TestRefreshGrant(t *testing.T) {
 			},
 		},
 		{
-			name: "when the provider in the session storage is found but has the wrong resource UID during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			name: "when the github provider in the session storage is found but has the wrong resource UID during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithGitHub(&oidctestutil.TestUpstreamGitHubIdentityProvider{
+				Name:        githubUpstreamName,
+				ResourceUID: "the-wrong-uid",
+			}),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: &psession.CustomSessionData{
-					ProviderName: oidcUpstreamName,
-					ProviderUID:  "this is the wrong uid", // this could happen if the OIDCIdentityProvider was deleted and recreated at the same name since original login
-					ProviderType: oidcUpstreamType,
-					OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-				},
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyGitHubCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					&psession.CustomSessionData{ // want the initial customSessionData to be unmodified
-						ProviderName: oidcUpstreamName,
-						ProviderUID:  "this is the wrong uid", // this could happen if the OIDCIdentityProvider was deleted and recreated at the same name since original login
-						ProviderType: oidcUpstreamType,
-						OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: oidcUpstreamInitialRefreshToken},
-					},
+					happyGitHubCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
@@ -1794,215 +3076,253 @@ func TestRefreshGrant(t *testing.T) {
 			},
 		},
 		{
-			name: "when the upstream refresh fails during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().
-				WithPerformRefreshError(errors.New("some upstream refresh error")).Build()),
+			name: "upstream saml refresh happy path while the upstream session is still valid",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(upstreamSAMLIdentityProvider),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				customSessionData: happySAMLCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happySAMLCustomSessionData,
+				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: tokenEndpointResponseExpectedValues{
-					wantUpstreamRefreshCall: happyOIDCUpstreamRefreshCall(),
-					wantStatus:              http.StatusUnauthorized,
-					wantErrorResponseBody: here.Doc(`
-						{
-							"error":             "error",
-							"error_description": "Error during upstream refresh. Upstream refresh failed."
-						}
-					`),
-				},
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(happySAMLCustomSessionData),
 			},
 		},
 		{
-			name: "when the upstream refresh returns an invalid ID token during the refresh request",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().
-				WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).
-				// This is the current format of the errors returned by the production code version of ValidateTokenAndMergeWithUserInfo, see ValidateTokenAndMergeWithUserInfo in upstreamoidc.go
-				WithValidateTokenAndMergeWithUserInfoError(httperr.Wrap(http.StatusBadRequest, "some validate error", errors.New("some validate cause"))).
-				Build()),
+			name: "upstream saml refresh happy path when the upstream did not limit the session",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(upstreamSAMLIdentityProvider),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				customSessionData: unlimitedSAMLCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					unlimitedSAMLCustomSessionData,
+				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: tokenEndpointResponseExpectedValues{
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantStatus:                        http.StatusUnauthorized,
-					wantErrorResponseBody: here.Doc(`
-						{
-							"error":             "error",
-							"error_description": "Error during upstream refresh. Upstream refresh returned an invalid ID token or UserInfo response."
-						}
-					`),
-				},
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(unlimitedSAMLCustomSessionData),
 			},
 		},
 		{
-			name: "when the upstream refresh returns an ID token with a different subject than the original",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().
-				WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).
-				// This is the current format of the errors returned by the production code version of ValidateTokenAndMergeWithUserInfo, see ValidateTokenAndMergeWithUserInfo in upstreamoidc.go
-				WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"sub": "something-different",
-						},
-					},
-				}).
-				Build()),
+			name: "upstream saml refresh when the upstream session has expired",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(upstreamSAMLIdentityProvider),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				customSessionData: expiredSAMLCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					expiredSAMLCustomSessionData,
+				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantStatus:                        http.StatusUnauthorized,
+					wantStatus: http.StatusUnauthorized,
 					wantErrorResponseBody: here.Doc(`
 						{
 							"error":             "error",
-							"error_description": "Error during upstream refresh. Upstream refresh failed."
+							"error_description": "Error during upstream refresh. Upstream session has expired."
 						}
 					`),
 				},
 			},
 		},
 		{
-			name: "refresh grant with claims but not the subject claim",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"some-claim": "some-value",
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			name: "upstream saml refresh when the SAML session data is nil",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(upstreamSAMLIdentityProvider),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				customSessionData: &psession.CustomSessionData{
+					ProviderUID:  samlUpstreamResourceUID,
+					ProviderName: samlUpstreamName,
+					ProviderType: samlUpstreamType,
+				},
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{
+						ProviderUID:  samlUpstreamResourceUID,
+						ProviderName: samlUpstreamName,
+						ProviderType: samlUpstreamType,
+					},
+				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantStatus:                        http.StatusUnauthorized,
+					wantStatus: http.StatusInternalServerError,
 					wantErrorResponseBody: here.Doc(`
 						{
 							"error":             "error",
-							"error_description": "Error during upstream refresh. Upstream refresh failed."
+							"error_description": "There was an internal server error. Required upstream data not found in session."
 						}
 					`),
 				},
 			},
 		},
 		{
-			name: "refresh grant with changed username claim",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithUsernameClaim("username-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"some-claim":     "some-value",
-							"sub":            goodUpstreamSubject,
-							"username-claim": "some-changed-username",
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			name: "upstream saml idp not found",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder(),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				customSessionData: happySAMLCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happySAMLCustomSessionData,
+				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantStatus:                        http.StatusUnauthorized,
+					wantStatus: http.StatusUnauthorized,
 					wantErrorResponseBody: here.Doc(`
 						{
 							"error":             "error",
-							"error_description": "Error during upstream refresh. Upstream refresh failed."
+							"error_description": "Error during upstream refresh. Provider from upstream session data was not found."
 						}
 					`),
 				},
 			},
 		},
 		{
-			name: "refresh grant with changed issuer claim",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
-				upstreamOIDCIdentityProviderBuilder().WithUsernameClaim("username-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
-					IDToken: &oidctypes.IDToken{
-						Claims: map[string]interface{}{
-							"some-claim": "some-value",
-							"sub":        goodUpstreamSubject,
-							"iss":        "some-changed-issuer",
-						},
-					},
-				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			name: "when the saml provider in the session storage is found but has the wrong resource UID during the refresh request",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithSAML(&oidctestutil.TestUpstreamSAMLIdentityProvider{
+				Name:        samlUpstreamName,
+				ResourceUID: "the-wrong-uid",
+			}),
 			authcodeExchange: authcodeExchangeInputs{
-				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+				customSessionData: happySAMLCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happySAMLCustomSessionData,
+				),
 			},
 			refreshRequest: refreshRequestInputs{
 				want: tokenEndpointResponseExpectedValues{
-					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
-					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantStatus:                        http.StatusUnauthorized,
+					wantStatus: http.StatusUnauthorized,
 					wantErrorResponseBody: here.Doc(`
 						{
 							"error":             "error",
-							"error_description": "Error during upstream refresh. Upstream refresh failed."
+							"error_description": "Error during upstream refresh. Provider from upstream session data has changed its resource UID since authentication."
 						}
 					`),
 				},
 			},
 		},
 		{
-			name: "upstream ldap refresh happy path",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
-				Name:        ldapUpstreamName,
-				ResourceUID: ldapUpstreamResourceUID,
-				URL:         ldapUpstreamURL,
-			}),
+			name: "upstream certificate refresh happy path updates the groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(upstreamCertificateIdentityProvider(&provider.CertificateUser{
+				Username:          goodUsername,
+				Groups:            refreshedCertificateGroups,
+				DownstreamSubject: goodSubject,
+			}, nil)),
 			authcodeExchange: authcodeExchangeInputs{
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				customSessionData: happyLDAPCustomSessionData,
+				customSessionData: happyCertificateCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					happyLDAPCustomSessionData,
+					happyCertificateCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: happyRefreshTokenResponseForLDAP(
-					happyLDAPCustomSessionData,
+				want: func() tokenEndpointResponseExpectedValues {
+					want := happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(happyCertificateCustomSessionData)
+					want.wantGroups = refreshedCertificateGroups
+					return want
+				}(),
+			},
+		},
+		{
+			name: "upstream certificate refresh when the certificate is no longer accepted, e.g. because it expired or was revoked",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(upstreamCertificateIdentityProvider(nil, errors.New("certificate has been revoked"))),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyCertificateCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happyCertificateCustomSessionData,
 				),
 			},
+			refreshRequest: refreshRequestInputs{
+				want: certificateRefreshFailedResponse,
+			},
 		},
 		{
-			name: "upstream active directory refresh happy path",
-			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&oidctestutil.TestUpstreamLDAPIdentityProvider{
-				Name:        activeDirectoryUpstreamName,
-				ResourceUID: activeDirectoryUpstreamResourceUID,
-				URL:         ldapUpstreamURL,
-			}),
+			name: "upstream certificate refresh when the subject has changed",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(upstreamCertificateIdentityProvider(&provider.CertificateUser{
+				Username:          goodUsername,
+				DownstreamSubject: "x509:CN%3Dsome-other-ca?sub=CN%3Dsome-certificate-user",
+			}, nil)),
 			authcodeExchange: authcodeExchangeInputs{
 				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
-				customSessionData: happyActiveDirectoryCustomSessionData,
+				customSessionData: happyCertificateCustomSessionData,
 				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
-					happyActiveDirectoryCustomSessionData,
+					happyCertificateCustomSessionData,
 				),
 			},
 			refreshRequest: refreshRequestInputs{
-				want: happyRefreshTokenResponseForActiveDirectory(
-					happyActiveDirectoryCustomSessionData,
+				want: certificateRefreshFailedResponse,
+			},
+		},
+		{
+			name: "upstream certificate refresh when the username has changed, e.g. because the username field was reconfigured",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(upstreamCertificateIdentityProvider(&provider.CertificateUser{
+				Username:          "some-new-username",
+				DownstreamSubject: goodSubject,
+			}, nil)),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyCertificateCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happyCertificateCustomSessionData,
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: certificateRefreshFailedResponse,
+			},
+		},
+		{
+			name: "upstream certificate refresh when the certificate session data is nil",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithCertificate(upstreamCertificateIdentityProvider(nil, errors.New("should not be called"))),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: &psession.CustomSessionData{
+					ProviderUID:  certificateUpstreamResourceUID,
+					ProviderName: certificateUpstreamName,
+					ProviderType: certificateUpstreamType,
+				},
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					&psession.CustomSessionData{
+						ProviderUID:  certificateUpstreamResourceUID,
+						ProviderName: certificateUpstreamName,
+						ProviderType: certificateUpstreamType,
+					},
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus: http.StatusInternalServerError,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "There was an internal server error. Required upstream data not found in session."
+						}
+					`),
+				},
+			},
+		},
+		{
+			name: "upstream certificate idp not found",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder(),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyCertificateCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happyCertificateCustomSessionData,
 				),
 			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus: http.StatusUnauthorized,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "error",
+							"error_description": "Error during upstream refresh. Provider from upstream session data was not found."
+						}
+					`),
+				},
+			},
 		},
 		{
 			name: "upstream ldap refresh when the LDAP session data is nil",
@@ -2739,6 +4059,17 @@ func TestRefreshGrant(t *testing.T) {
 				test.idps.RequireExactlyZeroCallsToPerformRefresh(t)
 			}
 
+			// Test that we did or did not make a call to the upstream GitHub provider interface to look up the user again.
+			if test.refreshRequest.want.wantUpstreamGitHubGetUserCall != nil {
+				test.refreshRequest.want.wantUpstreamGitHubGetUserCall.args.Ctx = reqContext
+				test.idps.RequireExactlyOneCallToGetUser(t,
+					test.refreshRequest.want.wantUpstreamGitHubGetUserCall.performedByUpstreamName,
+					test.refreshRequest.want.wantUpstreamGitHubGetUserCall.args,
+				)
+			} else {
+				test.idps.RequireExactlyZeroCallsToGetUser(t)
+			}
+
 			// Test that we did or did not make a call to the upstream OIDC provider interface to validate the
 			// new ID token that was returned by the upstream refresh.
 			if test.refreshRequest.want.wantUpstreamOIDCValidateTokenCall != nil {
@@ -2767,6 +4098,7 @@ func TestRefreshGrant(t *testing.T) {
 				oauthStore,
 				jwtSigningKey,
 				secrets,
+				1, // a successful refresh marks the first refresh token as used, but keeps it to detect its reuse
 			)
 
 			if test.refreshRequest.want.wantStatus == http.StatusOK {
@@ -2857,7 +4189,7 @@ func exchangeAuthcodeForTokens(t *testing.T, test authcodeExchangeInputs, idps p
 		test.modifyStorage(t, oauthStore, authCode)
 	}
 
-	subject = NewHandler(idps, oauthHelper)
+	subject = NewHandler(idps, oauthHelper, consent.NewStorage(secrets, time.Now), goodIssuer+oidc.TokenEndpointPath, supervisordpop.NewReplayCache(supervisordpop.DefaultReplayCacheSize))
 
 	authorizeEndpointGrantedOpenIDScope := strings.Contains(authRequest.Form.Get("scope"), "openid")
 	expectedNumberOfIDSessionsStored := 0
@@ -2895,6 +4227,7 @@ func exchangeAuthcodeForTokens(t *testing.T, test authcodeExchangeInputs, idps p
 		oauthStore,
 		jwtSigningKey,
 		secrets,
+		0,
 	)
 
 	return subject, rsp, authCode, jwtSigningKey, secrets, oauthStore
@@ -2912,6 +4245,7 @@ func requireTokenEndpointBehavior(
 	oauthStore *oidc.KubeStorage,
 	jwtSigningKey *ecdsa.PrivateKey,
 	secrets v1.SecretInterface,
+	wantUsedRefreshTokenSessions int,
 ) {
 	testutil.RequireEqualContentType(t, tokenEndpointResponse.Header().Get("Content-Type"), "application/json")
 	require.Equal(t, test.wantStatus, tokenEndpointResponse.Code)
@@ -2934,7 +4268,7 @@ func requireTokenEndpointBehavior(
 
 		expectedNumberOfRefreshTokenSessionsStored := 0
 		if wantRefreshToken {
-			expectedNumberOfRefreshTokenSessionsStored = 1
+			expectedNumberOfRefreshTokenSessionsStored = 1 + wantUsedRefreshTokenSessions
 		}
 		expectedNumberOfIDSessionsStored := 0
 		if wantIDToken {
@@ -3055,11 +4389,27 @@ func makeHappyOauthHelper(
 	t.Helper()
 
 	jwtSigningKey, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
-	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration(), nil)
 	authResponder := simulateAuthEndpointHavingAlreadyRun(t, authRequest, oauthHelper, initialCustomSessionData)
 	return oauthHelper, authResponder.GetCode(), jwtSigningKey
 }
 
+func makeOauthHelperWithTokenExchangePolicy(policy *provider.TokenExchangePolicy) OauthHelperFactoryFunc {
+	return func(
+		t *testing.T,
+		authRequest *http.Request,
+		store fositestoragei.AllFositeStorage,
+		initialCustomSessionData *psession.CustomSessionData,
+	) (fosite.OAuth2Provider, string, *ecdsa.PrivateKey) {
+		t.Helper()
+
+		jwtSigningKey, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+		oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration(), policy)
+		authResponder := simulateAuthEndpointHavingAlreadyRun(t, authRequest, oauthHelper, initialCustomSessionData)
+		return oauthHelper, authResponder.GetCode(), jwtSigningKey
+	}
+}
+
 type singleUseJWKProvider struct {
 	jwks.DynamicJWKSProvider
 	calls int
@@ -3082,7 +4432,7 @@ func makeOauthHelperWithJWTKeyThatWorksOnlyOnce(
 	t.Helper()
 
 	jwtSigningKey, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
-	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, &singleUseJWKProvider{DynamicJWKSProvider: jwkProvider}, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, &singleUseJWKProvider{DynamicJWKSProvider: jwkProvider}, oidc.DefaultOIDCTimeoutsConfiguration(), nil)
 	authResponder := simulateAuthEndpointHavingAlreadyRun(t, authRequest, oauthHelper, initialCustomSessionData)
 	return oauthHelper, authResponder.GetCode(), jwtSigningKey
 }
@@ -3096,7 +4446,7 @@ func makeOauthHelperWithNilPrivateJWTSigningKey(
 	t.Helper()
 
 	jwkProvider := jwks.NewDynamicJWKSProvider() // empty provider which contains no signing key for this issuer
-	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration(), nil)
 	authResponder := simulateAuthEndpointHavingAlreadyRun(t, authRequest, oauthHelper, initialCustomSessionData)
 	return oauthHelper, authResponder.GetCode(), nil
 }
@@ -3236,7 +4586,11 @@ func requireValidAccessTokenStorage(
 	require.True(t, ok)
 	tokenTypeString, ok := tokenType.(string)
 	require.Truef(t, ok, "wanted token_type to be a string, but got %T", tokenType)
-	require.Equal(t, "bearer", tokenTypeString)
+	wantTokenType := "bearer"
+	if storedRequest.GetSession().(*psession.PinnipedSession).DPoPJKT != "" {
+		wantTokenType = "DPoP" // the access token is bound to the key of the DPoP proof of the request
+	}
+	require.Equal(t, wantTokenType, tokenTypeString)
 
 	expiresIn, ok := body["expires_in"]
 	require.True(t, ok)
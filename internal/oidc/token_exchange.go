@@ -1,11 +1,14 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
 
 import (
 	"context"
+	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
@@ -13,24 +16,53 @@ import (
 	"github.com/ory/fosite/handler/oauth2"
 	"github.com/ory/fosite/handler/openid"
 	"github.com/pkg/errors"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+
+	"go.pinniped.dev/internal/oidc/dpop"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
 )
 
 const (
 	tokenTypeAccessToken       = "urn:ietf:params:oauth:token-type:access_token" //nolint: gosec
 	tokenTypeJWT               = "urn:ietf:params:oauth:token-type:jwt"          //nolint: gosec
+	tokenTypeIDToken           = "urn:ietf:params:oauth:token-type:id_token"     //nolint: gosec
 	pinnipedTokenExchangeScope = "pinniped:request-audience"                     //nolint: gosec
+
+	// actClaim is the claim which identifies the actor when a token is requested on behalf of another user,
+	// as defined by RFC8693.
+	actClaim = "act"
+
+	// scopeClaim is the claim which lists the scopes of a token which was requested with narrower scopes,
+	// as defined by RFC8693.
+	scopeClaim = "scope"
 )
 
+// errInvalidTarget is returned when the requested audience may not be requested, as defined by RFC8693.
+var errInvalidTarget = &fosite.RFC6749Error{
+	ErrorField:       "invalid_target",
+	DescriptionField: "The requested audience is invalid, unknown, or not allowed.",
+	CodeField:        http.StatusBadRequest,
+}
+
 type stsParams struct {
-	subjectAccessToken string
-	requestedAudience  string
+	subjectToken      string
+	subjectTokenType  string
+	requestedAudience string
+	requestedScopes   fosite.Arguments
+	actorAccessToken  string
 }
 
-func TokenExchangeFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
-	return &TokenExchangeHandler{
-		idTokenStrategy:     strategy.(openid.OpenIDConnectTokenStrategy),
-		accessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
-		accessTokenStorage:  storage.(oauth2.AccessTokenStorage),
+// TokenExchangeFactory returns a factory for the token exchange handler which only allows the tokens which are
+// allowed by the policy. A nil policy allows tokens for any audience.
+func TokenExchangeFactory(policy *provider.TokenExchangePolicy) compose.Factory {
+	return func(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+		return &TokenExchangeHandler{
+			idTokenStrategy:     strategy.(openid.OpenIDConnectTokenStrategy),
+			accessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
+			accessTokenStorage:  storage.(oauth2.AccessTokenStorage),
+			policy:              policy,
+		}
 	}
 }
 
@@ -38,6 +70,7 @@ type TokenExchangeHandler struct {
 	idTokenStrategy     openid.OpenIDConnectTokenStrategy
 	accessTokenStrategy oauth2.AccessTokenStrategy
 	accessTokenStorage  oauth2.AccessTokenStorage
+	policy              *provider.TokenExchangePolicy
 }
 
 var _ fosite.TokenEndpointHandler = (*TokenExchangeHandler)(nil)
@@ -61,8 +94,17 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 		return errors.WithStack(err)
 	}
 
-	// Validate the incoming access token and lookup the information about the original authorize request.
-	originalRequester, err := t.validateAccessToken(ctx, requester, params.subjectAccessToken)
+	// Validate the incoming access token and lookup the information about the original authorize request, or
+	// validate the incoming JWT or ID token of a trusted issuer and lookup the identity of its workload.
+	var originalRequester fosite.Requester
+	switch params.subjectTokenType {
+	case tokenTypeJWT:
+		originalRequester, err = t.validateTrustedJWT(ctx, requester, params.subjectToken, t.policy.TrustedServiceAccountIssuer)
+	case tokenTypeIDToken:
+		originalRequester, err = t.validateTrustedJWT(ctx, requester, params.subjectToken, t.policy.TrustedOIDCIssuer)
+	default:
+		originalRequester, err = t.validateAccessToken(ctx, requester, params.subjectToken)
+	}
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -75,8 +117,32 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 		return errors.WithStack(fosite.ErrAccessDenied.WithHintf("missing the %q scope", oidc.ScopeOpenID))
 	}
 
+	// Require that the user may request a token for the audience.
+	if !t.policy.IsAudienceAllowed(params.requestedAudience, sessionGroups(originalRequester.GetSession())) {
+		return errors.WithStack(errInvalidTarget.WithHintf("the audience %q is not allowed", params.requestedAudience))
+	}
+
+	// Require that the requested scopes were granted to the incoming access token, since they may only be narrowed.
+	for _, scope := range params.requestedScopes {
+		if !originalRequester.GetGrantedScopes().Has(scope) {
+			return errors.WithStack(fosite.ErrInvalidScope.WithHintf("the scope %q was not granted to the subject_token", scope))
+		}
+	}
+
+	// When the token is requested on behalf of the user by another user, validate the actor's access token too.
+	var actorRequester fosite.Requester
+	if params.actorAccessToken != "" {
+		actorRequester, err = t.validateAccessToken(ctx, requester, params.actorAccessToken)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !actorRequester.GetGrantedScopes().Has(pinnipedTokenExchangeScope) {
+			return errors.WithStack(fosite.ErrAccessDenied.WithHintf("actor_token is missing the %q scope", pinnipedTokenExchangeScope))
+		}
+	}
+
 	// Use the original authorize request information, along with the requested audience, to mint a new JWT.
-	responseToken, err := t.mintJWT(ctx, originalRequester, params.requestedAudience)
+	responseToken, err := t.mintJWT(ctx, originalRequester, actorRequester, params)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -85,15 +151,56 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 	responder.SetAccessToken(responseToken)
 	responder.SetTokenType("N_A")
 	responder.SetExtra("issued_token_type", tokenTypeJWT)
+	if len(params.requestedScopes) > 0 {
+		responder.SetScopes(params.requestedScopes)
+	}
 	return nil
 }
 
-func (t *TokenExchangeHandler) mintJWT(ctx context.Context, requester fosite.Requester, audience string) (string, error) {
-	downscoped := fosite.NewAccessRequest(requester.GetSession())
-	downscoped.Client.(*fosite.DefaultClient).ID = audience
+func (t *TokenExchangeHandler) mintJWT(ctx context.Context, requester fosite.Requester, actorRequester fosite.Requester, params *stsParams) (string, error) {
+	// Copy the session so that the claims which are only for the new JWT do not change the original session.
+	session := requester.GetSession().Clone()
+	extraClaims := session.(openid.Session).IDTokenClaims().Extra
+	if len(params.requestedScopes) > 0 {
+		extraClaims[scopeClaim] = strings.Join(params.requestedScopes, " ")
+	}
+	if actorRequester != nil {
+		actorClaims := actorRequester.GetSession().(openid.Session).IDTokenClaims()
+		actor := map[string]interface{}{"sub": actorClaims.Subject}
+		if actorUsername, ok := actorClaims.Extra[DownstreamUsernameClaim]; ok {
+			actor[DownstreamUsernameClaim] = actorUsername
+		}
+		extraClaims[actClaim] = actor
+	}
+
+	downscoped := fosite.NewAccessRequest(session)
+	downscoped.Client.(*fosite.DefaultClient).ID = params.requestedAudience
 	return t.idTokenStrategy.GenerateIDToken(ctx, downscoped)
 }
 
+// sessionGroups returns the downstream groups of the user of the session.
+func sessionGroups(session fosite.Session) []string {
+	pinnipedSession, ok := session.(*psession.PinnipedSession)
+	if !ok || pinnipedSession.Fosite == nil || pinnipedSession.Fosite.Claims == nil {
+		return nil
+	}
+	switch groups := pinnipedSession.Fosite.Claims.Extra[DownstreamGroupsClaim].(type) {
+	case []string:
+		return groups
+	case []interface{}:
+		// Sessions which were read from storage have lost the type of their groups.
+		result := make([]string, 0, len(groups))
+		for _, group := range groups {
+			if groupName, ok := group.(string); ok {
+				result = append(result, groupName)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
 func (t *TokenExchangeHandler) validateParams(params url.Values) (*stsParams, error) {
 	var result stsParams
 
@@ -102,25 +209,36 @@ func (t *TokenExchangeHandler) validateParams(params url.Values) (*stsParams, er
 	if result.requestedAudience == "" {
 		return nil, fosite.ErrInvalidRequest.WithHint("missing audience parameter")
 	}
-	result.subjectAccessToken = params.Get("subject_token")
-	if result.subjectAccessToken == "" {
+	result.subjectToken = params.Get("subject_token")
+	if result.subjectToken == "" {
 		return nil, fosite.ErrInvalidRequest.WithHint("missing subject_token parameter")
 	}
 
 	// Validate some parameters with hardcoded values we support.
-	if params.Get("subject_token_type") != tokenTypeAccessToken {
-		return nil, fosite.ErrInvalidRequest.WithHintf("unsupported subject_token_type parameter value, must be %q", tokenTypeAccessToken)
+	result.subjectTokenType = params.Get("subject_token_type")
+	switch result.subjectTokenType {
+	case tokenTypeAccessToken, tokenTypeJWT, tokenTypeIDToken:
+	default:
+		return nil, fosite.ErrInvalidRequest.WithHintf("unsupported subject_token_type parameter value, must be %q, %q or %q", tokenTypeAccessToken, tokenTypeJWT, tokenTypeIDToken)
 	}
 	if params.Get("requested_token_type") != tokenTypeJWT {
 		return nil, fosite.ErrInvalidRequest.WithHintf("unsupported requested_token_type parameter value, must be %q", tokenTypeJWT)
 	}
 
+	// Validate the optional parameters which narrow the scopes and which identify an actor.
+	result.requestedScopes = fosite.RemoveEmpty(strings.Split(params.Get("scope"), " "))
+	result.actorAccessToken = params.Get("actor_token")
+	actorTokenType := params.Get("actor_token_type")
+	if result.actorAccessToken != "" && actorTokenType != tokenTypeAccessToken {
+		return nil, fosite.ErrInvalidRequest.WithHintf("unsupported actor_token_type parameter value, must be %q", tokenTypeAccessToken)
+	}
+	if result.actorAccessToken == "" && actorTokenType != "" {
+		return nil, fosite.ErrInvalidRequest.WithHint("actor_token_type parameter must not be sent without the actor_token parameter")
+	}
+
 	// Validate that none of these unsupported parameters were sent. These are optional and we do not currently support them.
 	for _, param := range []string{
 		"resource",
-		"scope",
-		"actor_token",
-		"actor_token_type",
 	} {
 		if params.Get(param) != "" {
 			return nil, fosite.ErrInvalidRequest.WithHintf("unsupported parameter %s", param)
@@ -139,9 +257,65 @@ func (t *TokenExchangeHandler) validateAccessToken(ctx context.Context, requeste
 	if err != nil {
 		return nil, fosite.ErrRequestUnauthorized.WithWrap(err).WithHint("invalid subject_token")
 	}
+	// Access tokens which are bound to a key with DPoP may only be exchanged with a DPoP proof of that key.
+	if session, ok := originalRequester.GetSession().(*psession.PinnipedSession); ok {
+		if err := dpop.CheckBinding(session.DPoPJKT, dpop.ThumbprintFromContext(ctx)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
 	return originalRequester, nil
 }
 
+// validateTrustedJWT validates a JWT of an issuer which is trusted by the policy, such as a ServiceAccount token of
+// another cluster or an ID token of a CI platform, using the verifier which trustedIssuer returns for its issuer.
+// It returns a request for the downstream identity of the JWT, which was granted the scopes which are required for
+// token exchange.
+func (t *TokenExchangeHandler) validateTrustedJWT(
+	ctx context.Context,
+	requester fosite.AccessRequester,
+	token string,
+	trustedIssuer func(issuer string) provider.TrustedTokenVerifier,
+) (fosite.Requester, error) {
+	// The issuer of the JWT decides how to verify it, so read the issuer before the JWT is verified.
+	parsedJWT, err := josejwt.ParseSigned(token)
+	if err != nil {
+		return nil, fosite.ErrRequestUnauthorized.WithWrap(err).WithHint("invalid subject_token")
+	}
+	var unverifiedClaims josejwt.Claims
+	if err := parsedJWT.UnsafeClaimsWithoutVerification(&unverifiedClaims); err != nil {
+		return nil, fosite.ErrRequestUnauthorized.WithWrap(err).WithHint("invalid subject_token")
+	}
+	verifier := trustedIssuer(unverifiedClaims.Issuer)
+	if verifier == nil {
+		return nil, fosite.ErrRequestUnauthorized.WithHintf("the issuer %q of the subject_token is not trusted", unverifiedClaims.Issuer)
+	}
+	identity, err := verifier.VerifyToken(ctx, token)
+	if err != nil {
+		return nil, fosite.ErrRequestUnauthorized.WithWrap(err).WithHint("invalid subject_token")
+	}
+
+	now := time.Now().UTC()
+	session := psession.NewPinnipedSession()
+	session.Fosite.Claims.Subject = identity.Subject
+	session.Fosite.Claims.RequestedAt = now
+	session.Fosite.Claims.AuthTime = now
+	groups := identity.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	session.Fosite.Claims.Extra = map[string]interface{}{
+		DownstreamUsernameClaim: identity.Username,
+		DownstreamGroupsClaim:   groups,
+	}
+
+	trustedRequester := fosite.NewRequest()
+	trustedRequester.Client = requester.GetClient()
+	trustedRequester.Session = session
+	trustedRequester.GrantScope(oidc.ScopeOpenID)
+	trustedRequester.GrantScope(pinnipedTokenExchangeScope)
+	return trustedRequester, nil
+}
+
 func (t *TokenExchangeHandler) CanSkipClientAuth(_ fosite.AccessRequester) bool {
 	return false
 }
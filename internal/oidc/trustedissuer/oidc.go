@@ -0,0 +1,137 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package trustedissuer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+// claimReference matches the references to claims, like {repository}, in the usernames and groups of rules.
+var claimReference = regexp.MustCompile(`\{([^{}]+)\}`) //nolint:gochecknoglobals
+
+// ClaimRule maps the ID tokens whose claims match to a downstream identity.
+type ClaimRule struct {
+	// Claims are the requirements which must all be met by the claims of an ID token for the rule to match. A rule
+	// without requirements never matches, so that it cannot accidentally match every ID token of the issuer.
+	Claims []ClaimRequirement
+
+	// Username and Groups are the username and groups of the downstream identity. They may reference the string
+	// claims of the ID token by their names in braces, e.g. {repository}.
+	Username string
+	Groups   []string
+}
+
+// ClaimRequirement requires a string claim to have a value. When the value ends with "*", the claim must start with
+// the rest of the value instead.
+type ClaimRequirement struct {
+	Claim string
+	Value string
+}
+
+type oidcVerifier struct {
+	issuer   string
+	rules    []ClaimRule
+	verifier *coreosoidc.IDTokenVerifier
+}
+
+var _ provider.TrustedTokenVerifier = (*oidcVerifier)(nil)
+
+// NewOIDCVerifier returns a verifier of the ID tokens of an OIDC issuer, such as a CI platform, which were requested
+// for the given audience. The first rule which matches the claims of an ID token decides its username and groups,
+// and ID tokens which do not match any rule are rejected. When jwksURL is empty, it is discovered from the issuer.
+// The client is used to fetch the keys of the issuer.
+func NewOIDCVerifier(issuer, jwksURL, audience string, rules []ClaimRule, client *http.Client) provider.TrustedTokenVerifier {
+	return &oidcVerifier{
+		issuer: issuer,
+		rules:  rules,
+		verifier: coreosoidc.NewVerifier(issuer, newKeySet(issuer, jwksURL, client), &coreosoidc.Config{
+			ClientID:             audience,
+			SupportedSigningAlgs: supportedSigningAlgs,
+		}),
+	}
+}
+
+func (v *oidcVerifier) VerifyToken(ctx context.Context, token string) (*provider.TrustedIdentity, error) {
+	verified, err := v.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := verified.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("could not decode the claims of the token: %w", err)
+	}
+
+	for _, rule := range v.rules {
+		if !rule.matches(claims) {
+			continue
+		}
+		username, err := expandClaims(rule.Username, claims)
+		if err != nil {
+			return nil, fmt.Errorf("could not determine the username: %w", err)
+		}
+		if username == "" {
+			return nil, fmt.Errorf("the username of the token is empty")
+		}
+		groups := make([]string, 0, len(rule.Groups))
+		for _, group := range rule.Groups {
+			groupName, err := expandClaims(group, claims)
+			if err != nil {
+				return nil, fmt.Errorf("could not determine the groups: %w", err)
+			}
+			groups = append(groups, groupName)
+		}
+		return &provider.TrustedIdentity{
+			Subject:  downstreamSubject(v.issuer, verified.Subject),
+			Username: username,
+			Groups:   groups,
+		}, nil
+	}
+	return nil, fmt.Errorf("the claims of the token do not match any rule")
+}
+
+func (r *ClaimRule) matches(claims map[string]interface{}) bool {
+	if len(r.Claims) == 0 {
+		return false
+	}
+	for _, requirement := range r.Claims {
+		value, ok := claims[requirement.Claim].(string)
+		if !ok {
+			return false
+		}
+		if strings.HasSuffix(requirement.Value, "*") {
+			if !strings.HasPrefix(value, strings.TrimSuffix(requirement.Value, "*")) {
+				return false
+			}
+		} else if value != requirement.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// expandClaims replaces the references to claims in the template by the values of those claims, which must be
+// strings.
+func expandClaims(template string, claims map[string]interface{}) (string, error) {
+	var err error
+	expanded := claimReference.ReplaceAllStringFunc(template, func(reference string) string {
+		claim := strings.TrimSuffix(strings.TrimPrefix(reference, "{"), "}")
+		value, ok := claims[claim].(string)
+		if !ok && err == nil {
+			err = fmt.Errorf("the token does not have a string claim %q", claim)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
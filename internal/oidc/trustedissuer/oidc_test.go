@@ -0,0 +1,152 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package trustedissuer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+func TestOIDCVerifier(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// Stand in for the JWKS endpoint of a CI platform.
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: signingKey.Public(), KeyID: "some-key", Algorithm: string(jose.ES256), Use: "sig"},
+		}}))
+	}))
+	t.Cleanup(server.Close)
+
+	makeToken := func(t *testing.T, extraClaims map[string]interface{}) string {
+		t.Helper()
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.ES256, Key: signingKey},
+			(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "some-key"),
+		)
+		require.NoError(t, err)
+		token, err := jwt.Signed(signer).Claims(jwt.Claims{
+			Issuer:   "https://ci.example.com",
+			Subject:  "repo:some-org/some-repo:ref:refs/heads/main",
+			Audience: jwt.Audience{"some-audience"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		}).Claims(extraClaims).CompactSerialize()
+		require.NoError(t, err)
+		return token
+	}
+
+	rules := []ClaimRule{
+		{
+			Claims: []ClaimRequirement{
+				{Claim: "repository", Value: "some-org/some-repo"},
+				{Claim: "ref", Value: "refs/heads/release-*"},
+			},
+			Username: "ci:{repository}:release",
+			Groups:   []string{"ci:releasers"},
+		},
+		{
+			Claims: []ClaimRequirement{
+				{Claim: "repository", Value: "some-org/some-repo"},
+				{Claim: "ref", Value: "refs/heads/main"},
+			},
+			Username: "ci:{repository}:{ref}",
+			Groups:   []string{"ci:{repository_owner}", "ci:deployers"},
+		},
+		{
+			Claims:   []ClaimRequirement{{Claim: "repository", Value: "some-org/other-repo"}},
+			Username: "{workflow}",
+		},
+		{
+			Username: "everyone",
+		},
+	}
+
+	tests := []struct {
+		name         string
+		claims       map[string]interface{}
+		wantIdentity *provider.TrustedIdentity
+		wantErr      string
+	}{
+		{
+			name:   "matches a rule with exact values",
+			claims: map[string]interface{}{"repository": "some-org/some-repo", "repository_owner": "some-org", "ref": "refs/heads/main"},
+			wantIdentity: &provider.TrustedIdentity{
+				Subject:  "https://ci.example.com?sub=repo%3Asome-org%2Fsome-repo%3Aref%3Arefs%2Fheads%2Fmain",
+				Username: "ci:some-org/some-repo:refs/heads/main",
+				Groups:   []string{"ci:some-org", "ci:deployers"},
+			},
+		},
+		{
+			name:   "matches a rule with a prefix",
+			claims: map[string]interface{}{"repository": "some-org/some-repo", "ref": "refs/heads/release-1.2"},
+			wantIdentity: &provider.TrustedIdentity{
+				Subject:  "https://ci.example.com?sub=repo%3Asome-org%2Fsome-repo%3Aref%3Arefs%2Fheads%2Fmain",
+				Username: "ci:some-org/some-repo:release",
+				Groups:   []string{"ci:releasers"},
+			},
+		},
+		{
+			name:    "does not match any rule, including the rule without requirements",
+			claims:  map[string]interface{}{"repository": "some-org/some-repo", "ref": "refs/heads/feature"},
+			wantErr: "the claims of the token do not match any rule",
+		},
+		{
+			name:    "claim of the requirement is not a string",
+			claims:  map[string]interface{}{"repository": []string{"some-org/some-repo"}, "ref": "refs/heads/main"},
+			wantErr: "the claims of the token do not match any rule",
+		},
+		{
+			name:    "claim of the username is missing",
+			claims:  map[string]interface{}{"repository": "some-org/other-repo"},
+			wantErr: `could not determine the username: the token does not have a string claim "workflow"`,
+		},
+		{
+			name:    "username is empty",
+			claims:  map[string]interface{}{"repository": "some-org/other-repo", "workflow": ""},
+			wantErr: "the username of the token is empty",
+		},
+		{
+			name:    "claim of a group is missing",
+			claims:  map[string]interface{}{"repository": "some-org/some-repo", "ref": "refs/heads/main"},
+			wantErr: `could not determine the groups: the token does not have a string claim "repository_owner"`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := NewOIDCVerifier("https://ci.example.com", server.URL, "some-audience", rules, server.Client())
+			identity, err := verifier.VerifyToken(context.Background(), makeToken(t, tt.claims))
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, identity)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantIdentity, identity)
+		})
+	}
+
+	t.Run("wrong audience", func(t *testing.T) {
+		verifier := NewOIDCVerifier("https://ci.example.com", server.URL, "other-audience", rules, server.Client())
+		identity, err := verifier.VerifyToken(context.Background(), makeToken(t, nil))
+		require.EqualError(t, err, `oidc: expected audience "other-audience" got ["some-audience"]`)
+		require.Nil(t, identity)
+	})
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package trustedissuer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+const serviceAccountUsernamePrefix = "system:serviceaccount:"
+
+type serviceAccountVerifier struct {
+	issuer         string
+	usernamePrefix string
+	verifier       *coreosoidc.IDTokenVerifier
+}
+
+var _ provider.TrustedTokenVerifier = (*serviceAccountVerifier)(nil)
+
+// NewServiceAccountVerifier returns a verifier of the ServiceAccount tokens of another Kubernetes cluster, which
+// are signed by the given service account issuer and were requested for the given audience. The username and the
+// groups of the ServiceAccount are the same as in its own cluster, except that they are prefixed by usernamePrefix.
+// When jwksURL is empty, it is discovered from the issuer. The client is used to fetch the keys of the issuer.
+func NewServiceAccountVerifier(issuer, jwksURL, audience, usernamePrefix string, client *http.Client) provider.TrustedTokenVerifier {
+	return &serviceAccountVerifier{
+		issuer:         issuer,
+		usernamePrefix: usernamePrefix,
+		verifier: coreosoidc.NewVerifier(issuer, newKeySet(issuer, jwksURL, client), &coreosoidc.Config{
+			ClientID:             audience,
+			SupportedSigningAlgs: supportedSigningAlgs,
+		}),
+	}
+}
+
+func (v *serviceAccountVerifier) VerifyToken(ctx context.Context, token string) (*provider.TrustedIdentity, error) {
+	verified, err := v.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// ServiceAccount tokens identify their ServiceAccount by a subject like system:serviceaccount:<namespace>:<name>.
+	parts := strings.Split(strings.TrimPrefix(verified.Subject, serviceAccountUsernamePrefix), ":")
+	if !strings.HasPrefix(verified.Subject, serviceAccountUsernamePrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("token subject %q is not a ServiceAccount", verified.Subject)
+	}
+	namespace := parts[0]
+
+	return &provider.TrustedIdentity{
+		Subject:  downstreamSubject(v.issuer, verified.Subject),
+		Username: v.usernamePrefix + verified.Subject,
+		Groups: []string{
+			v.usernamePrefix + "system:serviceaccounts",
+			v.usernamePrefix + "system:serviceaccounts:" + namespace,
+		},
+	}, nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package trustedissuer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+func TestServiceAccountVerifier(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherSigningKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var discoveryRequests, jwksRequests int
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		discoveryRequests++
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   server.URL,
+			"jwks_uri": server.URL + "/openid/v1/jwks",
+		}))
+	})
+	mux.HandleFunc("/openid/v1/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwksRequests++
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: signingKey.Public(), KeyID: "some-key", Algorithm: string(jose.RS256), Use: "sig"},
+		}}))
+	})
+
+	makeToken := func(t *testing.T, key *rsa.PrivateKey, claims jwt.Claims) string {
+		t.Helper()
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.RS256, Key: key},
+			(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "some-key"),
+		)
+		require.NoError(t, err)
+		token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return token
+	}
+	validClaims := func() jwt.Claims {
+		return jwt.Claims{
+			Issuer:   server.URL,
+			Subject:  "system:serviceaccount:some-namespace:some-name",
+			Audience: jwt.Audience{"some-audience"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		}
+	}
+
+	tests := []struct {
+		name          string
+		jwksURL       string
+		key           *rsa.PrivateKey
+		modifyClaims  func(claims *jwt.Claims)
+		wantIdentity  *provider.TrustedIdentity
+		wantErr       string
+		wantDiscovery bool
+	}{
+		{
+			name: "valid token with discovered keys",
+			key:  signingKey,
+			wantIdentity: &provider.TrustedIdentity{
+				Subject:  server.URL + "?sub=system%3Aserviceaccount%3Asome-namespace%3Asome-name",
+				Username: "some-cluster:system:serviceaccount:some-namespace:some-name",
+				Groups:   []string{"some-cluster:system:serviceaccounts", "some-cluster:system:serviceaccounts:some-namespace"},
+			},
+			wantDiscovery: true,
+		},
+		{
+			name:    "valid token with configured keys",
+			jwksURL: server.URL + "/openid/v1/jwks",
+			key:     signingKey,
+			wantIdentity: &provider.TrustedIdentity{
+				Subject:  server.URL + "?sub=system%3Aserviceaccount%3Asome-namespace%3Asome-name",
+				Username: "some-cluster:system:serviceaccount:some-namespace:some-name",
+				Groups:   []string{"some-cluster:system:serviceaccounts", "some-cluster:system:serviceaccounts:some-namespace"},
+			},
+		},
+		{
+			name:         "wrong audience",
+			key:          signingKey,
+			modifyClaims: func(claims *jwt.Claims) { claims.Audience = jwt.Audience{"other-audience"} },
+			wantErr:      `oidc: expected audience "some-audience" got ["other-audience"]`,
+		},
+		{
+			name:         "wrong issuer",
+			key:          signingKey,
+			modifyClaims: func(claims *jwt.Claims) { claims.Issuer = "https://other-issuer.example.com" },
+			wantErr:      `oidc: id token issued by a different provider, expected "` + server.URL + `" got "https://other-issuer.example.com"`,
+		},
+		{
+			name:         "expired",
+			key:          signingKey,
+			modifyClaims: func(claims *jwt.Claims) { claims.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Minute)) },
+			wantErr:      "oidc: token is expired",
+		},
+		{
+			name:    "wrong signing key",
+			key:     otherSigningKey,
+			wantErr: "failed to verify signature: failed to verify id token signature",
+		},
+		{
+			name:         "subject which is not a ServiceAccount",
+			key:          signingKey,
+			modifyClaims: func(claims *jwt.Claims) { claims.Subject = "system:node:some-node" },
+			wantErr:      `token subject "system:node:some-node" is not a ServiceAccount`,
+		},
+		{
+			name:         "subject which is a ServiceAccount with too many parts",
+			key:          signingKey,
+			modifyClaims: func(claims *jwt.Claims) { claims.Subject = "system:serviceaccount:some-namespace:some-name:extra" },
+			wantErr:      `token subject "system:serviceaccount:some-namespace:some-name:extra" is not a ServiceAccount`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			discoveryRequests, jwksRequests = 0, 0
+			claims := validClaims()
+			if tt.modifyClaims != nil {
+				tt.modifyClaims(&claims)
+			}
+
+			verifier := NewServiceAccountVerifier(server.URL, tt.jwksURL, "some-audience", "some-cluster:", server.Client())
+			identity, err := verifier.VerifyToken(context.Background(), makeToken(t, tt.key, claims))
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				require.Nil(t, identity)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantIdentity, identity)
+
+			// The keys are only discovered and fetched once.
+			_, err = verifier.VerifyToken(context.Background(), makeToken(t, tt.key, claims))
+			require.NoError(t, err)
+			if tt.wantDiscovery {
+				require.Equal(t, 1, discoveryRequests)
+			} else {
+				require.Zero(t, discoveryRequests)
+			}
+			require.Equal(t, 1, jwksRequests)
+		})
+	}
+
+	t.Run("discovery failure", func(t *testing.T) {
+		verifier := NewServiceAccountVerifier(server.URL+"/does-not-exist", "", "some-audience", "some-cluster:", server.Client())
+		claims := validClaims()
+		claims.Issuer = server.URL + "/does-not-exist"
+		identity, err := verifier.VerifyToken(context.Background(), makeToken(t, signingKey, claims))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `could not perform OIDC discovery for issuer "`+server.URL+`/does-not-exist": 404 Not Found`)
+		require.Nil(t, identity)
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package trustedissuer verifies the tokens of issuers which a FederationDomain trusts to identify workloads,
+// so that they may be exchanged for tokens of the FederationDomain.
+package trustedissuer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+)
+
+// supportedSigningAlgs are the algorithms which may be used to sign the tokens of trusted issuers.
+var supportedSigningAlgs = []string{coreosoidc.RS256, coreosoidc.ES256} //nolint:gochecknoglobals
+
+// keySet is a coreosoidc.KeySet which fetches the keys of an issuer from its JWKS URL. When the JWKS URL is not
+// configured, it is discovered from the discovery document of the issuer. Discovery is delayed until the first token
+// is verified, so that an issuer which cannot be reached does not prevent the FederationDomain from being loaded.
+type keySet struct {
+	issuer  string
+	jwksURL string
+	client  *http.Client
+
+	mutex        sync.Mutex
+	remoteKeySet *coreosoidc.RemoteKeySet
+}
+
+var _ coreosoidc.KeySet = (*keySet)(nil)
+
+func newKeySet(issuer string, jwksURL string, client *http.Client) *keySet {
+	return &keySet{issuer: issuer, jwksURL: jwksURL, client: client}
+}
+
+func (k *keySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	remoteKeySet, err := k.remote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return remoteKeySet.VerifySignature(ctx, jwt)
+}
+
+func (k *keySet) remote(ctx context.Context) (*coreosoidc.RemoteKeySet, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.remoteKeySet != nil {
+		return k.remoteKeySet, nil
+	}
+
+	jwksURL := k.jwksURL
+	if jwksURL == "" {
+		discoveredProvider, err := coreosoidc.NewProvider(coreosoidc.ClientContext(ctx, k.client), k.issuer)
+		if err != nil {
+			return nil, fmt.Errorf("could not perform OIDC discovery for issuer %q: %w", k.issuer, err)
+		}
+		var claims struct {
+			JWKSURL string `json:"jwks_uri"`
+		}
+		if err := discoveredProvider.Claims(&claims); err != nil {
+			return nil, fmt.Errorf("could not decode discovery document of issuer %q: %w", k.issuer, err)
+		}
+		if claims.JWKSURL == "" {
+			return nil, fmt.Errorf("discovery document of issuer %q does not have a jwks_uri", k.issuer)
+		}
+		jwksURL = claims.JWKSURL
+	}
+
+	// The keys are refreshed long after the request which first needed them, so they must not use its context.
+	k.remoteKeySet = coreosoidc.NewRemoteKeySet(coreosoidc.ClientContext(context.Background(), k.client), jwksURL)
+	return k.remoteKeySet, nil
+}
+
+// downstreamSubject returns the subject of the downstream identity of a token, in the same format as the
+// subjects of the downstream identities of upstream OIDC identity providers.
+func downstreamSubject(issuer string, subject string) string {
+	return fmt.Sprintf("%s?%s=%s", issuer, "sub", url.QueryEscape(subject))
+}
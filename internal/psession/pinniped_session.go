@@ -20,6 +20,11 @@ type PinnipedSession struct {
 
 	// Custom Pinniped extensions to the session data.
 	Custom *CustomSessionData `json:"custom,omitempty"`
+
+	// The JWK SHA-256 thumbprint of the key which the access and refresh tokens of this session are bound to with
+	// DPoP (RFC 9449), or empty when they are bearer tokens. Used during a downstream refresh and token exchange to
+	// require a DPoP proof of the same key.
+	DPoPJKT string `json:"dpopJKT,omitempty"`
 }
 
 var _ openid.Session = &PinnipedSession{}
@@ -53,6 +58,15 @@ type CustomSessionData struct {
 	LDAP *LDAPSessionData `json:"ldap,omitempty"`
 
 	ActiveDirectory *ActiveDirectorySessionData `json:"activedirectory,omitempty"`
+
+	// Only used when ProviderType == "github".
+	GitHub *GitHubSessionData `json:"github,omitempty"`
+
+	// Only used when ProviderType == "saml".
+	SAML *SAMLSessionData `json:"saml,omitempty"`
+
+	// Only used when ProviderType == "certificate".
+	Certificate *CertificateSessionData `json:"certificate,omitempty"`
 }
 
 type ProviderType string
@@ -61,6 +75,9 @@ const (
 	ProviderTypeOIDC            ProviderType = "oidc"
 	ProviderTypeLDAP            ProviderType = "ldap"
 	ProviderTypeActiveDirectory ProviderType = "activedirectory"
+	ProviderTypeGitHub          ProviderType = "github"
+	ProviderTypeSAML            ProviderType = "saml"
+	ProviderTypeCertificate     ProviderType = "certificate"
 )
 
 // OIDCSessionData is the additional data needed by Pinniped when the upstream IDP is an OIDC provider.
@@ -100,6 +117,37 @@ type ActiveDirectorySessionData struct {
 	ExtraRefreshAttributes map[string]string `json:"extraRefreshAttributes,omitempty"`
 }
 
+// GitHubSessionData is the additional data needed by Pinniped when the upstream IDP is GitHub.
+type GitHubSessionData struct {
+	// UpstreamAccessToken is the access token returned by GitHub during initial authorization. GitHub does not
+	// issue refresh tokens for OAuth apps, so this token is used during downstream refresh to check that the
+	// user still exists and to reload their organization and team memberships.
+	UpstreamAccessToken string `json:"upstreamAccessToken"`
+}
+
+// SAMLSessionData is the additional data needed by Pinniped when the upstream IDP is a SAML identity provider.
+type SAMLSessionData struct {
+	// NameID is the NameID of the subject of the assertion from the user's initial login.
+	NameID string `json:"nameID"`
+
+	// SessionExpiry is the time after which the upstream identity provider no longer vouches for the user's
+	// session, taken from the SessionNotOnOrAfter of the assertion's AuthnStatement. SAML has no equivalent of
+	// an OIDC refresh token, so downstream refreshes are allowed only until this time, after which the user must
+	// log in again. It is the zero time when the identity provider did not limit the session, in which case the
+	// usual lifetime of the downstream session applies.
+	SessionExpiry time.Time `json:"sessionExpiry"`
+}
+
+// CertificateSessionData is the additional data needed by Pinniped when the upstream IDP is a client certificate
+// identity provider.
+type CertificateSessionData struct {
+	// PeerCertificates are the DER encoded certificates which the client presented during the TLS handshake of the
+	// user's initial login, starting with the client's own certificate. The user cannot be asked for their certificate
+	// again during a refresh, so instead the stored certificates are verified again, which fails after the client
+	// certificate has expired or has been revoked.
+	PeerCertificates [][]byte `json:"peerCertificates"`
+}
+
 // NewPinnipedSession returns a new empty session.
 func NewPinnipedSession() *PinnipedSession {
 	return &PinnipedSession{
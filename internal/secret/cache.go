@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package secret
@@ -9,17 +9,21 @@ import (
 )
 
 type Cache struct {
-	csrfCookieEncoderHashKey atomic.Value
-	federationDomainCacheMap sync.Map
+	csrfCookieEncoderHashKey          atomic.Value
+	previousCSRFCookieEncoderHashKeys atomic.Value
+	totpEncryptionKey                 atomic.Value
+	federationDomainCacheMap          sync.Map
 }
 
 // New returns an empty Cache.
 func New() *Cache { return &Cache{} }
 
 type federationDomainCache struct {
-	tokenHMACKey         atomic.Value
-	stateEncoderHashKey  atomic.Value
-	stateEncoderBlockKey atomic.Value
+	tokenHMACKey                  atomic.Value
+	stateEncoderHashKey           atomic.Value
+	previousStateEncoderHashKeys  atomic.Value
+	stateEncoderBlockKey          atomic.Value
+	previousStateEncoderBlockKeys atomic.Value
 }
 
 func (c *Cache) GetCSRFCookieEncoderHashKey() []byte {
@@ -30,6 +34,24 @@ func (c *Cache) SetCSRFCookieEncoderHashKey(key []byte) {
 	c.csrfCookieEncoderHashKey.Store(key)
 }
 
+// GetPreviousCSRFCookieEncoderHashKeys returns the keys which were replaced by rotations, most recent first.
+func (c *Cache) GetPreviousCSRFCookieEncoderHashKeys() [][]byte {
+	return byteSlicesOrNil(c.previousCSRFCookieEncoderHashKeys.Load())
+}
+
+func (c *Cache) SetPreviousCSRFCookieEncoderHashKeys(keys [][]byte) {
+	c.previousCSRFCookieEncoderHashKeys.Store(keys)
+}
+
+// GetTOTPEncryptionKey returns the key which encrypts the TOTP enrollments of users. It is never rotated.
+func (c *Cache) GetTOTPEncryptionKey() []byte {
+	return bytesOrNil(c.totpEncryptionKey.Load())
+}
+
+func (c *Cache) SetTOTPEncryptionKey(key []byte) {
+	c.totpEncryptionKey.Store(key)
+}
+
 func (c *Cache) GetTokenHMACKey(oidcIssuer string) []byte {
 	return bytesOrNil(c.getFederationDomainCache(oidcIssuer).tokenHMACKey.Load())
 }
@@ -46,6 +68,15 @@ func (c *Cache) SetStateEncoderHashKey(oidcIssuer string, key []byte) {
 	c.getFederationDomainCache(oidcIssuer).stateEncoderHashKey.Store(key)
 }
 
+// GetPreviousStateEncoderHashKeys returns the keys which were replaced by rotations, most recent first.
+func (c *Cache) GetPreviousStateEncoderHashKeys(oidcIssuer string) [][]byte {
+	return byteSlicesOrNil(c.getFederationDomainCache(oidcIssuer).previousStateEncoderHashKeys.Load())
+}
+
+func (c *Cache) SetPreviousStateEncoderHashKeys(oidcIssuer string, keys [][]byte) {
+	c.getFederationDomainCache(oidcIssuer).previousStateEncoderHashKeys.Store(keys)
+}
+
 func (c *Cache) GetStateEncoderBlockKey(oidcIssuer string) []byte {
 	return bytesOrNil(c.getFederationDomainCache(oidcIssuer).stateEncoderBlockKey.Load())
 }
@@ -54,6 +85,15 @@ func (c *Cache) SetStateEncoderBlockKey(oidcIssuer string, key []byte) {
 	c.getFederationDomainCache(oidcIssuer).stateEncoderBlockKey.Store(key)
 }
 
+// GetPreviousStateEncoderBlockKeys returns the keys which were replaced by rotations, most recent first.
+func (c *Cache) GetPreviousStateEncoderBlockKeys(oidcIssuer string) [][]byte {
+	return byteSlicesOrNil(c.getFederationDomainCache(oidcIssuer).previousStateEncoderBlockKeys.Load())
+}
+
+func (c *Cache) SetPreviousStateEncoderBlockKeys(oidcIssuer string, keys [][]byte) {
+	c.getFederationDomainCache(oidcIssuer).previousStateEncoderBlockKeys.Store(keys)
+}
+
 func (c *Cache) getFederationDomainCache(oidcIssuer string) *federationDomainCache {
 	value, ok := c.federationDomainCacheMap.Load(oidcIssuer)
 	if !ok {
@@ -69,3 +109,10 @@ func bytesOrNil(b interface{}) []byte {
 	}
 	return b.([]byte)
 }
+
+func byteSlicesOrNil(b interface{}) [][]byte {
+	if b == nil {
+		return nil
+	}
+	return b.([][]byte)
+}
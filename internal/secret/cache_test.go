@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package secret
@@ -19,10 +19,13 @@ const (
 
 var (
 	csrfCookieEncoderHashKey = []byte("csrf-cookie-encoder-hash-key")
+	totpEncryptionKey        = []byte("totp-encryption-key")
 	tokenHMACKey             = []byte("token-hmac-key")
 	stateEncoderHashKey      = []byte("state-encoder-hash-key")
 	otherStateEncoderHashKey = []byte("other-state-encoder-hash-key")
 	stateEncoderBlockKey     = []byte("state-encoder-block-key")
+	previousKeys             = [][]byte{[]byte("previous-key-1"), []byte("previous-key-2")}
+	otherPreviousKeys        = [][]byte{[]byte("other-previous-key")}
 )
 
 func TestCache(t *testing.T) {
@@ -30,9 +33,13 @@ func TestCache(t *testing.T) {
 
 	// Validate we get a nil return value when stuff does not exist.
 	require.Nil(t, c.GetCSRFCookieEncoderHashKey())
+	require.Nil(t, c.GetTOTPEncryptionKey())
 	require.Nil(t, c.GetTokenHMACKey(issuer))
 	require.Nil(t, c.GetStateEncoderHashKey(issuer))
 	require.Nil(t, c.GetStateEncoderBlockKey(issuer))
+	require.Nil(t, c.GetPreviousCSRFCookieEncoderHashKeys())
+	require.Nil(t, c.GetPreviousStateEncoderHashKeys(issuer))
+	require.Nil(t, c.GetPreviousStateEncoderBlockKeys(issuer))
 
 	// Validate we get some nil and non-nil values when some stuff exists.
 	c.SetCSRFCookieEncoderHashKey(csrfCookieEncoderHashKey)
@@ -44,18 +51,30 @@ func TestCache(t *testing.T) {
 
 	// Validate we get non-nil values when all stuff exists.
 	c.SetCSRFCookieEncoderHashKey(csrfCookieEncoderHashKey)
+	c.SetTOTPEncryptionKey(totpEncryptionKey)
 	c.SetTokenHMACKey(issuer, tokenHMACKey)
 	c.SetStateEncoderHashKey(issuer, otherStateEncoderHashKey)
 	c.SetStateEncoderBlockKey(issuer, stateEncoderBlockKey)
 	require.Equal(t, csrfCookieEncoderHashKey, c.GetCSRFCookieEncoderHashKey())
+	require.Equal(t, totpEncryptionKey, c.GetTOTPEncryptionKey())
 	require.Equal(t, tokenHMACKey, c.GetTokenHMACKey(issuer))
 	require.Equal(t, otherStateEncoderHashKey, c.GetStateEncoderHashKey(issuer))
 	require.Equal(t, stateEncoderBlockKey, c.GetStateEncoderBlockKey(issuer))
 
+	// Validate we get the previous keys which were replaced by rotations.
+	c.SetPreviousCSRFCookieEncoderHashKeys(previousKeys)
+	c.SetPreviousStateEncoderHashKeys(issuer, otherPreviousKeys)
+	c.SetPreviousStateEncoderBlockKeys(issuer, previousKeys)
+	require.Equal(t, previousKeys, c.GetPreviousCSRFCookieEncoderHashKeys())
+	require.Equal(t, otherPreviousKeys, c.GetPreviousStateEncoderHashKeys(issuer))
+	require.Equal(t, previousKeys, c.GetPreviousStateEncoderBlockKeys(issuer))
+
 	// Validate that stuff is still nil for an unknown issuer.
 	require.Nil(t, c.GetTokenHMACKey(otherIssuer))
 	require.Nil(t, c.GetStateEncoderHashKey(otherIssuer))
 	require.Nil(t, c.GetStateEncoderBlockKey(otherIssuer))
+	require.Nil(t, c.GetPreviousStateEncoderHashKeys(otherIssuer))
+	require.Nil(t, c.GetPreviousStateEncoderBlockKeys(otherIssuer))
 }
 
 // TestCacheSynchronized should mimic the behavior of an FederationDomain: multiple goroutines
@@ -8,6 +8,7 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
@@ -35,12 +36,17 @@ import (
 	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
 	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
 	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/acmecert"
 	"go.pinniped.dev/internal/config/supervisor"
 	"go.pinniped.dev/internal/controller/supervisorconfig"
 	"go.pinniped.dev/internal/controller/supervisorconfig/activedirectoryupstreamwatcher"
+	"go.pinniped.dev/internal/controller/supervisorconfig/certificateupstreamwatcher"
 	"go.pinniped.dev/internal/controller/supervisorconfig/generator"
+	"go.pinniped.dev/internal/controller/supervisorconfig/githubupstreamwatcher"
 	"go.pinniped.dev/internal/controller/supervisorconfig/ldapupstreamwatcher"
 	"go.pinniped.dev/internal/controller/supervisorconfig/oidcupstreamwatcher"
+	"go.pinniped.dev/internal/controller/supervisorconfig/samlupstreamwatcher"
+	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamprober"
 	"go.pinniped.dev/internal/controller/supervisorstorage"
 	"go.pinniped.dev/internal/controllerinit"
 	"go.pinniped.dev/internal/controllerlib"
@@ -50,11 +56,13 @@ import (
 	"go.pinniped.dev/internal/groupsuffix"
 	"go.pinniped.dev/internal/kubeclient"
 	"go.pinniped.dev/internal/leaderelection"
+	"go.pinniped.dev/internal/loginlimit"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/oidc/provider/manager"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/secret"
+	"go.pinniped.dev/internal/upstreamhealth"
 )
 
 const (
@@ -64,7 +72,7 @@ const (
 
 func startServer(ctx context.Context, shutdown *sync.WaitGroup, l net.Listener, handler http.Handler) {
 	handler = genericapifilters.WithWarningRecorder(handler)
-	handler = withBootstrapPaths(handler, "/healthz") // only health checks are allowed for bootstrap connections
+	handler = withBootstrapPaths(handler, "/healthz", upstreamhealth.EndpointPath) // only health checks are allowed for bootstrap connections
 
 	server := http.Server{
 		Handler:     handler,
@@ -96,6 +104,19 @@ func startServer(ctx context.Context, shutdown *sync.WaitGroup, l net.Listener,
 	}()
 }
 
+// withUpstreamHealthSummary answers the upstream health endpoint with only the overall readiness of the Supervisor,
+// since the details of the upstreams and FederationDomains should not be shown to anyone who can reach the listener.
+func withUpstreamHealthSummary(handler http.Handler, cache *upstreamhealth.Cache) http.Handler {
+	summaryHandler := upstreamhealth.NewSummaryHandler(cache)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == upstreamhealth.EndpointPath {
+			summaryHandler.ServeHTTP(w, req)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
 func signalCtx() context.Context {
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
@@ -119,6 +140,8 @@ func prepareControllers(
 	dynamicTLSCertProvider provider.DynamicTLSCertProvider,
 	dynamicUpstreamIDPProvider provider.DynamicUpstreamIDPProvider,
 	secretCache *secret.Cache,
+	upstreamHealthCache *upstreamhealth.Cache,
+	acmeIssuer supervisorconfig.CertificateIssuer,
 	supervisorDeployment *appsv1.Deployment,
 	kubeClient kubernetes.Interface,
 	pinnipedClient pinnipedclientset.Interface,
@@ -128,6 +151,7 @@ func prepareControllers(
 ) controllerinit.RunnerBuilder {
 	federationDomainInformer := pinnipedInformers.Config().V1alpha1().FederationDomains()
 	secretInformer := kubeInformers.Core().V1().Secrets()
+	configMapInformer := kubeInformers.Core().V1().ConfigMaps()
 
 	// Create controller manager.
 	controllerManager := controllerlib.
@@ -148,6 +172,7 @@ func prepareControllers(
 				clock.RealClock{},
 				pinnipedClient,
 				federationDomainInformer,
+				configMapInformer,
 				controllerlib.WithInformer,
 			),
 			singletonWorker,
@@ -172,6 +197,20 @@ func prepareControllers(
 			),
 			singletonWorker,
 		).
+		WithController(
+			supervisorconfig.NewACMECertWriterController(
+				cfg.Labels,
+				acmeIssuer,
+				clock.RealClock{},
+				kubeClient,
+				pinnipedClient,
+				secretInformer,
+				federationDomainInformer,
+				controllerlib.WithInformer,
+				controllerlib.WithInitialEvent,
+			),
+			singletonWorker,
+		).
 		WithController(
 			supervisorconfig.NewTLSCertObserverController(
 				dynamicTLSCertProvider,
@@ -185,13 +224,37 @@ func prepareControllers(
 		WithController(
 			generator.NewSupervisorSecretsController(
 				supervisorDeployment,
+				"-key",
+				generator.SupervisorCSRFSigningKeySecretType,
 				cfg.Labels,
 				kubeClient,
 				secretInformer,
-				func(secret []byte) {
+				func(secret []byte, previousSecrets [][]byte) {
 					plog.Debug("setting csrf cookie secret")
 					secretCache.SetCSRFCookieEncoderHashKey(secret)
+					secretCache.SetPreviousCSRFCookieEncoderHashKeys(previousSecrets)
 				},
+				generator.SupervisorKeyRotationInterval(generator.SupervisorCSRFSigningKeySecretType),
+				clock.RealClock{},
+				controllerlib.WithInformer,
+				controllerlib.WithInitialEvent,
+			),
+			singletonWorker,
+		).
+		WithController(
+			generator.NewSupervisorSecretsController(
+				supervisorDeployment,
+				"-totp-key",
+				generator.SupervisorTOTPEncryptionKeySecretType,
+				cfg.Labels,
+				kubeClient,
+				secretInformer,
+				func(secret []byte, _ [][]byte) {
+					plog.Debug("setting totp encryption key")
+					secretCache.SetTOTPEncryptionKey(secret)
+				},
+				generator.SupervisorKeyRotationInterval(generator.SupervisorTOTPEncryptionKeySecretType),
+				clock.RealClock{},
 				controllerlib.WithInformer,
 				controllerlib.WithInitialEvent,
 			),
@@ -204,7 +267,7 @@ func prepareControllers(
 					cfg.Labels,
 					rand.Reader,
 					generator.SecretUsageTokenSigningKey,
-					func(federationDomainIssuer string, symmetricKey []byte) {
+					func(federationDomainIssuer string, symmetricKey []byte, _ [][]byte) {
 						plog.Debug("setting hmac secret", "issuer", federationDomainIssuer)
 						secretCache.SetTokenHMACKey(federationDomainIssuer, symmetricKey)
 					},
@@ -216,6 +279,8 @@ func prepareControllers(
 				pinnipedClient,
 				secretInformer,
 				federationDomainInformer,
+				0, // the HMAC key is not rotated, since the tokens which it signs may be used for a long time
+				clock.RealClock{},
 				controllerlib.WithInformer,
 			),
 			singletonWorker,
@@ -227,9 +292,10 @@ func prepareControllers(
 					cfg.Labels,
 					rand.Reader,
 					generator.SecretUsageStateSigningKey,
-					func(federationDomainIssuer string, symmetricKey []byte) {
+					func(federationDomainIssuer string, symmetricKey []byte, previousSymmetricKeys [][]byte) {
 						plog.Debug("setting state signature key", "issuer", federationDomainIssuer)
 						secretCache.SetStateEncoderHashKey(federationDomainIssuer, symmetricKey)
+						secretCache.SetPreviousStateEncoderHashKeys(federationDomainIssuer, previousSymmetricKeys)
 					},
 				),
 				func(fd *configv1alpha1.FederationDomainStatus) *corev1.LocalObjectReference {
@@ -239,6 +305,8 @@ func prepareControllers(
 				pinnipedClient,
 				secretInformer,
 				federationDomainInformer,
+				generator.DefaultKeyRotationInterval,
+				clock.RealClock{},
 				controllerlib.WithInformer,
 			),
 			singletonWorker,
@@ -250,9 +318,10 @@ func prepareControllers(
 					cfg.Labels,
 					rand.Reader,
 					generator.SecretUsageStateEncryptionKey,
-					func(federationDomainIssuer string, symmetricKey []byte) {
+					func(federationDomainIssuer string, symmetricKey []byte, previousSymmetricKeys [][]byte) {
 						plog.Debug("setting state encryption key", "issuer", federationDomainIssuer)
 						secretCache.SetStateEncoderBlockKey(federationDomainIssuer, symmetricKey)
+						secretCache.SetPreviousStateEncoderBlockKeys(federationDomainIssuer, previousSymmetricKeys)
 					},
 				),
 				func(fd *configv1alpha1.FederationDomainStatus) *corev1.LocalObjectReference {
@@ -262,6 +331,8 @@ func prepareControllers(
 				pinnipedClient,
 				secretInformer,
 				federationDomainInformer,
+				generator.DefaultKeyRotationInterval,
+				clock.RealClock{},
 				controllerlib.WithInformer,
 			),
 			singletonWorker,
@@ -293,6 +364,52 @@ func prepareControllers(
 				secretInformer,
 				controllerlib.WithInformer,
 			),
+			singletonWorker).
+		WithController(
+			githubupstreamwatcher.New(
+				dynamicUpstreamIDPProvider,
+				pinnipedClient,
+				pinnipedInformers.IDP().V1alpha1().GitHubIdentityProviders(),
+				secretInformer,
+				klogr.New(),
+				controllerlib.WithInformer,
+			),
+			singletonWorker).
+		WithController(
+			samlupstreamwatcher.New(
+				dynamicUpstreamIDPProvider,
+				pinnipedClient,
+				pinnipedInformers.IDP().V1alpha1().SAMLIdentityProviders(),
+				klogr.New(),
+				controllerlib.WithInformer,
+			),
+			singletonWorker).
+		WithController(
+			certificateupstreamwatcher.New(
+				dynamicUpstreamIDPProvider,
+				pinnipedClient,
+				pinnipedInformers.IDP().V1alpha1().CertificateIdentityProviders(),
+				secretInformer,
+				configMapInformer,
+				klogr.New(),
+				controllerlib.WithInformer,
+			),
+			singletonWorker).
+		WithController(
+			upstreamprober.New(
+				dynamicUpstreamIDPProvider,
+				upstreamHealthCache,
+				federationDomainInformer,
+				pinnipedInformers.IDP().V1alpha1().OIDCIdentityProviders(),
+				pinnipedInformers.IDP().V1alpha1().LDAPIdentityProviders(),
+				pinnipedInformers.IDP().V1alpha1().ActiveDirectoryIdentityProviders(),
+				pinnipedInformers.IDP().V1alpha1().GitHubIdentityProviders(),
+				pinnipedInformers.IDP().V1alpha1().SAMLIdentityProviders(),
+				pinnipedInformers.IDP().V1alpha1().CertificateIdentityProviders(),
+				clock.RealClock{},
+				controllerlib.WithInformer,
+				controllerlib.WithInitialEvent,
+			),
 			singletonWorker)
 
 	return controllerinit.Prepare(controllerManager.Start, leaderElector, kubeInformers, pinnipedInformers)
@@ -354,11 +471,23 @@ func runSupervisor(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 		pinnipedinformers.WithNamespace(serverInstallationNamespace),
 	)
 
-	// Serve the /healthz endpoint and make all other paths result in 404.
+	// Serve the /healthz and upstream health endpoints and make all other paths result in 404. The HTTPS listener
+	// replaces the details of the upstream health endpoint with a summary, since it is usually exposed publicly.
+	upstreamHealthCache := upstreamhealth.NewCache()
 	healthMux := http.NewServeMux()
 	healthMux.Handle("/healthz", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		_, _ = writer.Write([]byte("ok"))
 	}))
+	healthMux.Handle(upstreamhealth.EndpointPath, upstreamhealth.NewHandler(upstreamHealthCache))
+
+	// Answer the HTTP-01 challenges of ACME certificate authorities for any hostname. The responses are written by
+	// the leader and read from the informer cache of every pod.
+	acmeChallenges := acmecert.NewChallengeStorage(
+		client.Kubernetes.CoreV1().Secrets(serverInstallationNamespace),
+		kubeInformers.Core().V1().Secrets().Lister().Secrets(serverInstallationNamespace),
+		time.Now,
+	)
+	healthMux.Handle(acmecert.HTTP01ChallengePathPrefix, acmecert.NewHTTP01Handler(acmeChallenges))
 
 	dynamicJWKSProvider := jwks.NewDynamicJWKSProvider()
 	dynamicTLSCertProvider := provider.NewDynamicTLSCertProvider()
@@ -372,6 +501,7 @@ func runSupervisor(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 		dynamicUpstreamIDPProvider,
 		&secretCache,
 		clientWithoutLeaderElection.Kubernetes.CoreV1().Secrets(serverInstallationNamespace), // writes to kube storage are allowed for non-leaders
+		loginlimit.DefaultPolicies(cfg.LoginLimits.ClientIP),
 	)
 
 	buildControllersFunc := prepareControllers(
@@ -381,6 +511,8 @@ func runSupervisor(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 		dynamicTLSCertProvider,
 		dynamicUpstreamIDPProvider,
 		&secretCache,
+		upstreamHealthCache,
+		acmecert.NewIssuer(acmeChallenges, rand.Reader),
 		supervisorDeployment,
 		client.Kubernetes,
 		client.PinnipedSupervisor,
@@ -422,7 +554,13 @@ func runSupervisor(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 		}
 
 		c := ptls.Default(nil)
+		c.NextProtos = append(c.NextProtos, acmecert.TLSALPN01Protocol)
 		c.GetCertificate = func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if acmecert.IsTLSALPN01Hello(info) {
+				// An ACME certificate authority is validating a TLS-ALPN-01 challenge for the server name.
+				return acmeChallenges.GetTLSALPN01Certificate(info)
+			}
+
 			cert := dynamicTLSCertProvider.GetTLSCert(strings.ToLower(info.ServerName))
 
 			defaultCert := dynamicTLSCertProvider.GetDefaultTLSCert()
@@ -450,6 +588,30 @@ func runSupervisor(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 
 			return cert, nil
 		}
+		c.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			if acmecert.IsTLSALPN01Hello(info) {
+				return nil, nil // use the config as is
+			}
+			// Client certificates are only used by the FederationDomains which authenticate users with a client
+			// certificate identity provider, so clients which connect to any other hostname, e.g. to check the health
+			// of the Supervisor, are not asked for a certificate.
+			certificateAuthorities := oidProvidersManager.ClientCertificateAuthorities(info.ServerName)
+			if len(certificateAuthorities) == 0 {
+				return nil, nil
+			}
+
+			// Ask the client for a certificate issued by the client certificate identity provider of the
+			// FederationDomain. The certificate is optional and unverified here, since it is only relevant to the
+			// authorize endpoint, which verifies it against the identity provider.
+			clientCAs := x509.NewCertPool()
+			for _, ca := range certificateAuthorities {
+				clientCAs.AddCert(ca)
+			}
+			configForClient := c.Clone()
+			configForClient.ClientAuth = tls.RequestClientCert
+			configForClient.ClientCAs = clientCAs
+			return configForClient, nil
+		}
 
 		httpsListener, err := tls.Listen(e.Network, e.Address, c)
 		if err != nil {
@@ -461,7 +623,7 @@ func runSupervisor(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 		}
 
 		defer func() { _ = httpsListener.Close() }()
-		startServer(ctx, shutdown, httpsListener, oidProvidersManager)
+		startServer(ctx, shutdown, httpsListener, withUpstreamHealthSummary(oidProvidersManager, upstreamHealthCache))
 		plog.Debug("supervisor https listener started", "address", httpsListener.Addr().String())
 	}
 
@@ -7,6 +7,7 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/x509"
 	"fmt"
 	"net/url"
 	"regexp"
@@ -34,6 +35,7 @@ import (
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
@@ -101,6 +103,8 @@ type TestUpstreamLDAPIdentityProvider struct {
 	performRefreshCallCount int
 	performRefreshArgs      []*PerformRefreshArgs
 	PerformRefreshErr       error
+	PerformRefreshGroups    []string
+	TOTPMode                totp.Mode
 }
 
 var _ provider.UpstreamLDAPIdentityProviderI = &TestUpstreamLDAPIdentityProvider{}
@@ -113,6 +117,10 @@ func (u *TestUpstreamLDAPIdentityProvider) GetName() string {
 	return u.Name
 }
 
+func (u *TestUpstreamLDAPIdentityProvider) GetTOTPMode() totp.Mode {
+	return u.TOTPMode
+}
+
 func (u *TestUpstreamLDAPIdentityProvider) AuthenticateUser(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
 	return u.AuthenticateFunc(ctx, username, password)
 }
@@ -121,7 +129,7 @@ func (u *TestUpstreamLDAPIdentityProvider) GetURL() *url.URL {
 	return u.URL
 }
 
-func (u *TestUpstreamLDAPIdentityProvider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) error {
+func (u *TestUpstreamLDAPIdentityProvider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) ([]string, error) {
 	if u.performRefreshArgs == nil {
 		u.performRefreshArgs = make([]*PerformRefreshArgs, 0)
 	}
@@ -133,9 +141,9 @@ func (u *TestUpstreamLDAPIdentityProvider) PerformRefresh(ctx context.Context, s
 		ExpectedSubject:  storedRefreshAttributes.Subject,
 	})
 	if u.PerformRefreshErr != nil {
-		return u.PerformRefreshErr
+		return nil, u.PerformRefreshErr
 	}
-	return nil
+	return u.PerformRefreshGroups, nil
 }
 
 func (u *TestUpstreamLDAPIdentityProvider) PerformRefreshCallCount() int {
@@ -149,6 +157,182 @@ func (u *TestUpstreamLDAPIdentityProvider) PerformRefreshArgs(call int) *Perform
 	return u.performRefreshArgs[call]
 }
 
+// ExchangeAuthcodeArgs is used to spy on calls to
+// TestUpstreamGitHubIdentityProvider.ExchangeAuthcodeFunc().
+type ExchangeAuthcodeArgs struct {
+	Ctx              context.Context
+	Authcode         string
+	PKCECodeVerifier pkce.Code
+	RedirectURI      string
+}
+
+// GetUserArgs is used to spy on calls to
+// TestUpstreamGitHubIdentityProvider.GetUserFunc().
+type GetUserArgs struct {
+	Ctx         context.Context
+	AccessToken string
+}
+
+type TestUpstreamGitHubIdentityProvider struct {
+	Name                 string
+	ClientID             string
+	ResourceUID          types.UID
+	AuthorizationURL     url.URL
+	Scopes               []string
+	ExchangeAuthcodeFunc func(ctx context.Context, authcode string) (string, error)
+	GetUserFunc          func(ctx context.Context, accessToken string) (*provider.GitHubUser, error)
+	exchangeAuthcodeArgs []*ExchangeAuthcodeArgs
+	getUserArgs          []*GetUserArgs
+}
+
+var _ provider.UpstreamGitHubIdentityProviderI = &TestUpstreamGitHubIdentityProvider{}
+
+func (u *TestUpstreamGitHubIdentityProvider) GetName() string {
+	return u.Name
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) GetResourceUID() types.UID {
+	return u.ResourceUID
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) GetClientID() string {
+	return u.ClientID
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) GetAuthorizationURL() *url.URL {
+	return &u.AuthorizationURL
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) GetScopes() []string {
+	return u.Scopes
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) ExchangeAuthcode(ctx context.Context, authcode string, pkceCodeVerifier pkce.Code, redirectURI string) (string, error) {
+	u.exchangeAuthcodeArgs = append(u.exchangeAuthcodeArgs, &ExchangeAuthcodeArgs{
+		Ctx:              ctx,
+		Authcode:         authcode,
+		PKCECodeVerifier: pkceCodeVerifier,
+		RedirectURI:      redirectURI,
+	})
+	return u.ExchangeAuthcodeFunc(ctx, authcode)
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) ExchangeAuthcodeCallCount() int {
+	return len(u.exchangeAuthcodeArgs)
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) ExchangeAuthcodeArgs(call int) *ExchangeAuthcodeArgs {
+	return u.exchangeAuthcodeArgs[call]
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) GetUser(ctx context.Context, accessToken string) (*provider.GitHubUser, error) {
+	u.getUserArgs = append(u.getUserArgs, &GetUserArgs{Ctx: ctx, AccessToken: accessToken})
+	return u.GetUserFunc(ctx, accessToken)
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) GetUserCallCount() int {
+	return len(u.getUserArgs)
+}
+
+func (u *TestUpstreamGitHubIdentityProvider) GetUserArgs(call int) *GetUserArgs {
+	return u.getUserArgs[call]
+}
+
+// AuthnRequestURLArgs is used to spy on calls to
+// TestUpstreamSAMLIdentityProvider.AuthnRequestURL().
+type AuthnRequestURLArgs struct {
+	SP         provider.SAMLServiceProvider
+	RequestID  string
+	RelayState string
+}
+
+// ParseResponseArgs is used to spy on calls to
+// TestUpstreamSAMLIdentityProvider.ParseResponseFunc().
+type ParseResponseArgs struct {
+	SP           provider.SAMLServiceProvider
+	RequestID    string
+	SAMLResponse string
+}
+
+type TestUpstreamSAMLIdentityProvider struct {
+	Name              string
+	ResourceUID       types.UID
+	SSOURL            url.URL
+	ParseResponseFunc func(samlResponse string) (*provider.SAMLUser, error)
+	parseResponseArgs []*ParseResponseArgs
+}
+
+var _ provider.UpstreamSAMLIdentityProviderI = &TestUpstreamSAMLIdentityProvider{}
+
+func (u *TestUpstreamSAMLIdentityProvider) GetName() string {
+	return u.Name
+}
+
+func (u *TestUpstreamSAMLIdentityProvider) GetResourceUID() types.UID {
+	return u.ResourceUID
+}
+
+// AuthnRequestURL returns the SSOURL with the arguments added as query params, so that tests can easily
+// make assertions about them.
+func (u *TestUpstreamSAMLIdentityProvider) AuthnRequestURL(sp provider.SAMLServiceProvider, requestID string, relayState string) (*url.URL, error) {
+	result := u.SSOURL
+	q := result.Query()
+	q.Set("entityID", sp.EntityID)
+	q.Set("acsURL", sp.AssertionConsumerServiceURL.String())
+	q.Set("requestID", requestID)
+	q.Set("RelayState", relayState)
+	result.RawQuery = q.Encode()
+	return &result, nil
+}
+
+func (u *TestUpstreamSAMLIdentityProvider) ParseResponse(sp provider.SAMLServiceProvider, requestID string, samlResponse string) (*provider.SAMLUser, error) {
+	u.parseResponseArgs = append(u.parseResponseArgs, &ParseResponseArgs{SP: sp, RequestID: requestID, SAMLResponse: samlResponse})
+	return u.ParseResponseFunc(samlResponse)
+}
+
+func (u *TestUpstreamSAMLIdentityProvider) ParseResponseCallCount() int {
+	return len(u.parseResponseArgs)
+}
+
+func (u *TestUpstreamSAMLIdentityProvider) ParseResponseArgs(call int) *ParseResponseArgs {
+	return u.parseResponseArgs[call]
+}
+
+type TestUpstreamCertificateIdentityProvider struct {
+	Name                        string
+	ResourceUID                 types.UID
+	CertificateAuthorities      []*x509.Certificate
+	AuthenticateCertificateFunc func(peerCertificates []*x509.Certificate) (*provider.CertificateUser, error)
+	authenticateCertificateArgs [][]*x509.Certificate
+}
+
+var _ provider.UpstreamCertificateIdentityProviderI = &TestUpstreamCertificateIdentityProvider{}
+
+func (u *TestUpstreamCertificateIdentityProvider) GetName() string {
+	return u.Name
+}
+
+func (u *TestUpstreamCertificateIdentityProvider) GetResourceUID() types.UID {
+	return u.ResourceUID
+}
+
+func (u *TestUpstreamCertificateIdentityProvider) GetCertificateAuthorities() []*x509.Certificate {
+	return u.CertificateAuthorities
+}
+
+func (u *TestUpstreamCertificateIdentityProvider) AuthenticateCertificate(peerCertificates []*x509.Certificate) (*provider.CertificateUser, error) {
+	u.authenticateCertificateArgs = append(u.authenticateCertificateArgs, peerCertificates)
+	return u.AuthenticateCertificateFunc(peerCertificates)
+}
+
+func (u *TestUpstreamCertificateIdentityProvider) AuthenticateCertificateCallCount() int {
+	return len(u.authenticateCertificateArgs)
+}
+
+func (u *TestUpstreamCertificateIdentityProvider) AuthenticateCertificateArgs(call int) []*x509.Certificate {
+	return u.authenticateCertificateArgs[call]
+}
+
 type TestUpstreamOIDCIdentityProvider struct {
 	Name                     string
 	ClientID                 string
@@ -161,6 +345,7 @@ type TestUpstreamOIDCIdentityProvider struct {
 	Scopes                   []string
 	AdditionalAuthcodeParams map[string]string
 	AllowPasswordGrant       bool
+	TOTPMode                 totp.Mode
 
 	ExchangeAuthcodeAndValidateTokensFunc func(
 		ctx context.Context,
@@ -207,6 +392,10 @@ func (u *TestUpstreamOIDCIdentityProvider) GetName() string {
 	return u.Name
 }
 
+func (u *TestUpstreamOIDCIdentityProvider) GetTOTPMode() totp.Mode {
+	return u.TOTPMode
+}
+
 func (u *TestUpstreamOIDCIdentityProvider) GetClientID() string {
 	return u.ClientID
 }
@@ -358,6 +547,9 @@ type UpstreamIDPListerBuilder struct {
 	upstreamOIDCIdentityProviders            []*TestUpstreamOIDCIdentityProvider
 	upstreamLDAPIdentityProviders            []*TestUpstreamLDAPIdentityProvider
 	upstreamActiveDirectoryIdentityProviders []*TestUpstreamLDAPIdentityProvider
+	upstreamGitHubIdentityProviders          []*TestUpstreamGitHubIdentityProvider
+	upstreamSAMLIdentityProviders            []*TestUpstreamSAMLIdentityProvider
+	upstreamCertificateIdentityProviders     []*TestUpstreamCertificateIdentityProvider
 }
 
 func (b *UpstreamIDPListerBuilder) WithOIDC(upstreamOIDCIdentityProviders ...*TestUpstreamOIDCIdentityProvider) *UpstreamIDPListerBuilder {
@@ -375,6 +567,21 @@ func (b *UpstreamIDPListerBuilder) WithActiveDirectory(upstreamActiveDirectoryId
 	return b
 }
 
+func (b *UpstreamIDPListerBuilder) WithGitHub(upstreamGitHubIdentityProviders ...*TestUpstreamGitHubIdentityProvider) *UpstreamIDPListerBuilder {
+	b.upstreamGitHubIdentityProviders = append(b.upstreamGitHubIdentityProviders, upstreamGitHubIdentityProviders...)
+	return b
+}
+
+func (b *UpstreamIDPListerBuilder) WithSAML(upstreamSAMLIdentityProviders ...*TestUpstreamSAMLIdentityProvider) *UpstreamIDPListerBuilder {
+	b.upstreamSAMLIdentityProviders = append(b.upstreamSAMLIdentityProviders, upstreamSAMLIdentityProviders...)
+	return b
+}
+
+func (b *UpstreamIDPListerBuilder) WithCertificate(upstreamCertificateIdentityProviders ...*TestUpstreamCertificateIdentityProvider) *UpstreamIDPListerBuilder {
+	b.upstreamCertificateIdentityProviders = append(b.upstreamCertificateIdentityProviders, upstreamCertificateIdentityProviders...)
+	return b
+}
+
 func (b *UpstreamIDPListerBuilder) Build() provider.DynamicUpstreamIDPProvider {
 	idpProvider := provider.NewDynamicUpstreamIDPProvider()
 
@@ -396,6 +603,24 @@ func (b *UpstreamIDPListerBuilder) Build() provider.DynamicUpstreamIDPProvider {
 	}
 	idpProvider.SetActiveDirectoryIdentityProviders(adUpstreams)
 
+	gitHubUpstreams := make([]provider.UpstreamGitHubIdentityProviderI, len(b.upstreamGitHubIdentityProviders))
+	for i := range b.upstreamGitHubIdentityProviders {
+		gitHubUpstreams[i] = provider.UpstreamGitHubIdentityProviderI(b.upstreamGitHubIdentityProviders[i])
+	}
+	idpProvider.SetGitHubIdentityProviders(gitHubUpstreams)
+
+	samlUpstreams := make([]provider.UpstreamSAMLIdentityProviderI, len(b.upstreamSAMLIdentityProviders))
+	for i := range b.upstreamSAMLIdentityProviders {
+		samlUpstreams[i] = provider.UpstreamSAMLIdentityProviderI(b.upstreamSAMLIdentityProviders[i])
+	}
+	idpProvider.SetSAMLIdentityProviders(samlUpstreams)
+
+	certificateUpstreams := make([]provider.UpstreamCertificateIdentityProviderI, len(b.upstreamCertificateIdentityProviders))
+	for i := range b.upstreamCertificateIdentityProviders {
+		certificateUpstreams[i] = provider.UpstreamCertificateIdentityProviderI(b.upstreamCertificateIdentityProviders[i])
+	}
+	idpProvider.SetCertificateIdentityProviders(certificateUpstreams)
+
 	return idpProvider
 }
 
@@ -607,6 +832,43 @@ func (b *UpstreamIDPListerBuilder) RequireExactlyZeroCallsToRevokeToken(t *testi
 	)
 }
 
+func (b *UpstreamIDPListerBuilder) RequireExactlyOneCallToGetUser(
+	t *testing.T,
+	expectedPerformedByUpstreamName string,
+	expectedArgs *GetUserArgs,
+) {
+	t.Helper()
+	var actualArgs *GetUserArgs
+	var actualNameOfUpstreamWhichMadeCall string
+	actualCallCountAcrossAllGitHubUpstreams := 0
+	for _, upstreamGitHub := range b.upstreamGitHubIdentityProviders {
+		callCountOnThisUpstream := upstreamGitHub.GetUserCallCount()
+		actualCallCountAcrossAllGitHubUpstreams += callCountOnThisUpstream
+		if callCountOnThisUpstream == 1 {
+			actualNameOfUpstreamWhichMadeCall = upstreamGitHub.Name
+			actualArgs = upstreamGitHub.getUserArgs[0]
+		}
+	}
+	require.Equal(t, 1, actualCallCountAcrossAllGitHubUpstreams,
+		"should have been exactly one call to GetUser() by all GitHub upstreams",
+	)
+	require.Equal(t, expectedPerformedByUpstreamName, actualNameOfUpstreamWhichMadeCall,
+		"GetUser() was called on the wrong GitHub upstream",
+	)
+	require.Equal(t, expectedArgs, actualArgs)
+}
+
+func (b *UpstreamIDPListerBuilder) RequireExactlyZeroCallsToGetUser(t *testing.T) {
+	t.Helper()
+	actualCallCountAcrossAllGitHubUpstreams := 0
+	for _, upstreamGitHub := range b.upstreamGitHubIdentityProviders {
+		actualCallCountAcrossAllGitHubUpstreams += upstreamGitHub.GetUserCallCount()
+	}
+	require.Equal(t, 0, actualCallCountAcrossAllGitHubUpstreams,
+		"expected exactly zero calls to GetUser()",
+	)
+}
+
 func NewUpstreamIDPListerBuilder() *UpstreamIDPListerBuilder {
 	return &UpstreamIDPListerBuilder{}
 }
@@ -627,6 +889,7 @@ type TestUpstreamOIDCIdentityProviderBuilder struct {
 	hasUserInfoURL                       bool
 	additionalAuthcodeParams             map[string]string
 	allowPasswordGrant                   bool
+	totpMode                             totp.Mode
 	authcodeExchangeErr                  error
 	passwordGrantErr                     error
 	performRefreshErr                    error
@@ -669,6 +932,11 @@ func (u *TestUpstreamOIDCIdentityProviderBuilder) WithAllowPasswordGrant(value b
 	return u
 }
 
+func (u *TestUpstreamOIDCIdentityProviderBuilder) WithTOTPMode(value totp.Mode) *TestUpstreamOIDCIdentityProviderBuilder {
+	u.totpMode = value
+	return u
+}
+
 func (u *TestUpstreamOIDCIdentityProviderBuilder) WithScopes(values []string) *TestUpstreamOIDCIdentityProviderBuilder {
 	u.scopes = values
 	return u
@@ -785,6 +1053,7 @@ func (u *TestUpstreamOIDCIdentityProviderBuilder) Build() *TestUpstreamOIDCIdent
 		GroupsClaim:              u.groupsClaim,
 		Scopes:                   u.scopes,
 		AllowPasswordGrant:       u.allowPasswordGrant,
+		TOTPMode:                 u.totpMode,
 		AuthorizationURL:         u.authorizationURL,
 		UserInfoURL:              u.hasUserInfoURL,
 		AdditionalAuthcodeParams: u.additionalAuthcodeParams,
@@ -829,10 +1098,12 @@ func NewTestUpstreamOIDCIdentityProviderBuilder() *TestUpstreamOIDCIdentityProvi
 type ExpectedUpstreamStateParamFormat struct {
 	P string `json:"p"`
 	U string `json:"u"`
+	T string `json:"t"`
 	N string `json:"n"`
 	C string `json:"c"`
 	K string `json:"k"`
 	V string `json:"v"`
+	R int64  `json:"r,omitempty"`
 }
 
 type staticKeySet struct {
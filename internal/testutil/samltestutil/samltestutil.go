@@ -0,0 +1,118 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package samltestutil provides a local stand-in for a SAML identity provider.
+package samltestutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// EntityID is the entity ID of the identity provider returned by NewIdentityProvider.
+	EntityID = "https://idp.example.com/metadata"
+
+	// SSOURL is the single sign-on URL of the identity provider returned by NewIdentityProvider.
+	SSOURL = "https://idp.example.com/sso"
+)
+
+// NewIdentityProvider returns an identity provider with a freshly generated signing key, which will accept
+// authentication requests from the service provider with the given entity ID and ACS URL.
+func NewIdentityProvider(t *testing.T, spEntityID string, spACSURL string) *saml.IdentityProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-saml-idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(certDER)
+	require.NoError(t, err)
+
+	metadataURL, err := url.Parse(EntityID)
+	require.NoError(t, err)
+	ssoURL, err := url.Parse(SSOURL)
+	require.NoError(t, err)
+
+	return &saml.IdentityProvider{
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *metadataURL,
+		SSOURL:      *ssoURL,
+		ServiceProviderProvider: &serviceProviderProvider{metadata: &saml.EntityDescriptor{
+			EntityID: spEntityID,
+			SPSSODescriptors: []saml.SPSSODescriptor{{
+				AssertionConsumerServices: []saml.IndexedEndpoint{{
+					Binding:  saml.HTTPPostBinding,
+					Location: spACSURL,
+				}},
+			}},
+		}},
+	}
+}
+
+// MetadataXML returns the metadata document of the identity provider.
+func MetadataXML(t *testing.T, idp *saml.IdentityProvider) string {
+	t.Helper()
+	metadata, err := xml.Marshal(idp.Metadata())
+	require.NoError(t, err)
+	return string(metadata)
+}
+
+// Login plays the role of the identity provider for an SP-initiated login. Given the URL to which the service
+// provider redirected the user's browser, it logs in the user described by the session and returns the
+// base64-encoded SAMLResponse and the RelayState that the browser would POST to the service provider.
+// When modifyAssertion is not nil, it may change the assertion before it is signed.
+func Login(
+	t *testing.T,
+	idp *saml.IdentityProvider,
+	authnRequestURL *url.URL,
+	session *saml.Session,
+	modifyAssertion func(*saml.Assertion),
+) (string, string) {
+	t.Helper()
+
+	req, err := saml.NewIdpAuthnRequest(idp, httptest.NewRequest(http.MethodGet, authnRequestURL.String(), nil))
+	require.NoError(t, err)
+	require.NoError(t, req.Validate())
+	require.NoError(t, saml.DefaultAssertionMaker{}.MakeAssertion(req, session))
+	if modifyAssertion != nil {
+		modifyAssertion(req.Assertion)
+	}
+
+	form, err := req.PostBinding()
+	require.NoError(t, err)
+	return form.SAMLResponse, form.RelayState
+}
+
+type serviceProviderProvider struct {
+	metadata *saml.EntityDescriptor
+}
+
+func (s *serviceProviderProvider) GetServiceProvider(_ *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	if serviceProviderID != s.metadata.EntityID {
+		return nil, os.ErrNotExist
+	}
+	return s.metadata, nil
+}
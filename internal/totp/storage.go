@@ -0,0 +1,167 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package totp
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/crud"
+)
+
+const (
+	// TypeLabelValue is the value of the storage.pinniped.dev/type label of the Secrets which hold TOTP enrollments.
+	TypeLabelValue = "totp"
+
+	ErrInvalidEnrollmentData = constable.Error("TOTP enrollment data is not valid")
+	ErrNoEncryptionKey       = constable.Error("the TOTP encryption key is not available yet")
+
+	enrollmentStorageVersion = "1"
+
+	// encryptionKeyLabel is used to derive the key which encrypts the stored secrets, so that the derived key is
+	// different from any other key which is derived from the same base key.
+	encryptionKeyLabel = "pinniped-totp-secret-encryption-key"
+)
+
+// Enrollment is the TOTP enrollment of a single user.
+type Enrollment struct {
+	// Secret is the user's TOTP secret.
+	Secret []byte
+
+	// Confirmed is true after the user has proven that they configured their authenticator app by providing a
+	// valid code. The secret of an unconfirmed enrollment is shown to the user again until they confirm it.
+	Confirmed bool
+
+	// LastUsedCounter is the time step of the most recently accepted code, which prevents the reuse of codes.
+	LastUsedCounter uint64
+
+	// saved is true when the enrollment has already been saved, and resourceVersion is the version which was saved.
+	saved           bool
+	resourceVersion string
+}
+
+type storedEnrollment struct {
+	EncryptedSecret []byte `json:"encryptedSecret"`
+	Confirmed       bool   `json:"confirmed"`
+	LastUsedCounter uint64 `json:"lastUsedCounter"`
+	Version         string `json:"version"`
+}
+
+// Storage stores the TOTP enrollments of users in Secrets. The secrets of the users are encrypted by a key which is
+// derived from the base key. The Secrets are never garbage collected.
+type Storage struct {
+	storage crud.Storage
+	baseKey func() []byte
+	rand    io.Reader
+}
+
+// NewStorage returns a Storage. Enrollments are stored for as long as users are enrolled, so the base key must never
+// be rotated.
+func NewStorage(secrets corev1client.SecretInterface, clock func() time.Time, baseKey func() []byte, rand io.Reader) *Storage {
+	return &Storage{
+		storage: crud.New(TypeLabelValue, secrets, clock, 0),
+		baseKey: baseKey,
+		rand:    rand,
+	}
+}
+
+// Get returns the enrollment of the user, or nil when the user has not enrolled.
+func (s *Storage) Get(ctx context.Context, userKey string) (*Enrollment, error) {
+	var stored storedEnrollment
+	rv, err := s.storage.Get(ctx, signature(userKey), &stored)
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored.Version != enrollmentStorageVersion {
+		return nil, fmt.Errorf("%w: version %q is not supported", ErrInvalidEnrollmentData, stored.Version)
+	}
+
+	gcm, err := s.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(stored.EncryptedSecret) < gcm.NonceSize() {
+		return nil, ErrInvalidEnrollmentData
+	}
+	nonce, ciphertext := stored.EncryptedSecret[:gcm.NonceSize()], stored.EncryptedSecret[gcm.NonceSize():]
+	// The user key is authenticated along with the secret, so that a secret cannot be copied to another user.
+	secret, err := gcm.Open(nil, nonce, ciphertext, []byte(userKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decrypt secret: %s", ErrInvalidEnrollmentData, err)
+	}
+
+	return &Enrollment{
+		Secret:          secret,
+		Confirmed:       stored.Confirmed,
+		LastUsedCounter: stored.LastUsedCounter,
+		saved:           true,
+		resourceVersion: rv,
+	}, nil
+}
+
+// Save creates or updates the enrollment of the user. An enrollment which was read by Get can only be saved when it
+// was not changed by someone else in the meantime.
+func (s *Storage) Save(ctx context.Context, userKey string, enrollment *Enrollment) error {
+	gcm, err := s.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(s.rand, nonce); err != nil {
+		return fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	stored := &storedEnrollment{
+		EncryptedSecret: gcm.Seal(nonce, nonce, enrollment.Secret, []byte(userKey)),
+		Confirmed:       enrollment.Confirmed,
+		LastUsedCounter: enrollment.LastUsedCounter,
+		Version:         enrollmentStorageVersion,
+	}
+
+	if !enrollment.saved {
+		enrollment.resourceVersion, err = s.storage.Create(ctx, signature(userKey), stored, nil)
+	} else {
+		enrollment.resourceVersion, err = s.storage.Update(ctx, signature(userKey), enrollment.resourceVersion, stored, nil)
+	}
+	if err != nil {
+		return err
+	}
+	enrollment.saved = true
+	return nil
+}
+
+// cipher derives the encryption key from the base key.
+func (s *Storage) cipher() (cipher.AEAD, error) {
+	baseKey := s.baseKey()
+	if len(baseKey) == 0 {
+		return nil, ErrNoEncryptionKey
+	}
+	mac := hmac.New(sha256.New, baseKey)
+	_, _ = mac.Write([]byte(encryptionKeyLabel))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// signature returns a fixed length name for the user, since user keys may be long and contain any characters.
+func signature(userKey string) string {
+	sum := sha256.Sum256([]byte(userKey))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
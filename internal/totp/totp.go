@@ -0,0 +1,115 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package totp implements time-based one-time passwords (TOTP, RFC 6238), which the Supervisor can require as a
+// second factor after a user's password.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // RFC 6238 uses HMAC-SHA1 by default, and it is the only algorithm that all authenticator apps support.
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+const (
+	// period is the length of each time step, as recommended by RFC 6238.
+	period = 30 * time.Second
+
+	// digits is the length of each code.
+	digits = 6
+
+	// secretLength is the length of generated secrets, which matches the output length of HMAC-SHA1 as recommended
+	// by RFC 4226.
+	secretLength = 20
+
+	// allowedSkew is the number of time steps before and after the current time step for which a code is accepted,
+	// to allow for clock drift and for the time that it takes the user to type the code.
+	allowedSkew = 1
+)
+
+//nolint:gochecknoglobals
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret generates a new random TOTP secret.
+func GenerateSecret(rand io.Reader) ([]byte, error) {
+	secret := make([]byte, secretLength)
+	if _, err := io.ReadFull(rand, secret); err != nil {
+		return nil, fmt.Errorf("could not generate TOTP secret: %w", err)
+	}
+	return secret, nil
+}
+
+// EncodeSecret returns the secret in the base32 form which users can type into their authenticator app.
+func EncodeSecret(secret []byte) string {
+	return b32.EncodeToString(secret)
+}
+
+// KeyURI returns the otpauth:// URI which authenticator apps use to enroll a secret, for example by scanning it
+// as a QR code. See https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func KeyURI(issuer string, accountName string, secret []byte) string {
+	query := url.Values{
+		"secret":    []string{EncodeSecret(secret)},
+		"issuer":    []string{issuer},
+		"algorithm": []string{"SHA1"},
+		"digits":    []string{fmt.Sprintf("%d", digits)},
+		"period":    []string{fmt.Sprintf("%d", int(period.Seconds()))},
+	}
+	keyURI := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + accountName,
+		RawQuery: query.Encode(),
+	}
+	return keyURI.String()
+}
+
+// Code returns the code for the secret at time t.
+func Code(secret []byte, t time.Time) string {
+	return codeForCounter(secret, counterAt(t))
+}
+
+// Validate checks the code for the secret at time t. It returns the time step of the code, which callers should
+// remember to reject later attempts to reuse the same code. Codes from time steps which are not after notAfterCounter
+// are rejected.
+func Validate(secret []byte, code string, t time.Time, notAfterCounter uint64) (uint64, bool) {
+	if len(code) != digits {
+		return 0, false
+	}
+	current := counterAt(t)
+	for offset := -allowedSkew; offset <= allowedSkew; offset++ {
+		counter := uint64(int64(current) + int64(offset))
+		if counter <= notAfterCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(codeForCounter(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+func counterAt(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(period.Seconds()))
+}
+
+// codeForCounter implements the HOTP algorithm of RFC 4226.
+func codeForCounter(secret []byte, counter uint64) string {
+	var counterBytes [8]byte
+	binary.BigEndian.PutUint64(counterBytes[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	_, _ = mac.Write(counterBytes[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, as described in section 5.3 of RFC 4226.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, value%1_000_000)
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package totp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors in appendix B of RFC 6238.
+const rfcSecret = "12345678901234567890"
+
+func TestCode(t *testing.T) {
+	// The test vectors of RFC 6238 have 8 digits, so these are their last 6 digits.
+	tests := []struct {
+		unix     int64
+		wantCode string
+	}{
+		{unix: 59, wantCode: "287082"},
+		{unix: 1111111109, wantCode: "081804"},
+		{unix: 1111111111, wantCode: "050471"},
+		{unix: 1234567890, wantCode: "005924"},
+		{unix: 2000000000, wantCode: "279037"},
+		{unix: 20000000000, wantCode: "353130"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.wantCode, Code([]byte(rfcSecret), time.Unix(test.unix, 0)), "at %d", test.unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := []byte(rfcSecret)
+	now := time.Unix(1111111111, 0)
+	currentCounter := counterAt(now)
+
+	counter, ok := Validate(secret, Code(secret, now), now, 0)
+	require.True(t, ok)
+	require.Equal(t, currentCounter, counter)
+
+	// Codes from the previous and next time steps are accepted to allow for clock skew.
+	counter, ok = Validate(secret, Code(secret, now.Add(-period)), now, 0)
+	require.True(t, ok)
+	require.Equal(t, currentCounter-1, counter)
+	counter, ok = Validate(secret, Code(secret, now.Add(period)), now, 0)
+	require.True(t, ok)
+	require.Equal(t, currentCounter+1, counter)
+
+	// Codes from further away are rejected.
+	_, ok = Validate(secret, Code(secret, now.Add(-2*period)), now, 0)
+	require.False(t, ok)
+	_, ok = Validate(secret, Code(secret, now.Add(2*period)), now, 0)
+	require.False(t, ok)
+
+	// Codes which are not after the last used counter are rejected to prevent reuse.
+	_, ok = Validate(secret, Code(secret, now), now, currentCounter)
+	require.False(t, ok)
+	counter, ok = Validate(secret, Code(secret, now.Add(period)), now, currentCounter)
+	require.True(t, ok)
+	require.Equal(t, currentCounter+1, counter)
+
+	// Codes for other secrets and malformed codes are rejected.
+	_, ok = Validate([]byte("some-other-secret-20"), Code(secret, now), now, 0)
+	require.False(t, ok)
+	_, ok = Validate(secret, "", now, 0)
+	require.False(t, ok)
+	_, ok = Validate(secret, "94287082", time.Unix(59, 0), 0)
+	require.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret(bytes.NewReader(bytes.Repeat([]byte{0x42}, 100)))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{0x42}, secretLength), secret)
+
+	_, err = GenerateSecret(bytes.NewReader([]byte{0x42}))
+	require.EqualError(t, err, "could not generate TOTP secret: unexpected EOF")
+}
+
+func TestKeyURI(t *testing.T) {
+	require.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", EncodeSecret([]byte(rfcSecret)))
+	require.Equal(t,
+		"otpauth://totp/Pinniped:pinny%20%28my-ldap%29?algorithm=SHA1&digits=6&issuer=Pinniped&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		KeyURI("Pinniped", "pinny (my-ldap)", []byte(rfcSecret)),
+	)
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package totp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Mode controls whether users of an upstream identity provider must provide a TOTP code after their password.
+type Mode string
+
+const (
+	// ModeDisabled means that codes are never requested.
+	ModeDisabled Mode = "Disabled"
+
+	// ModeOptional means that codes are only requested from users who chose to enroll.
+	ModeOptional Mode = "Optional"
+
+	// ModeRequired means that all users must enroll and provide codes.
+	ModeRequired Mode = "Required"
+
+	// keyURIIssuer is the name of the issuer which authenticator apps show next to the codes.
+	keyURIIssuer = "Pinniped"
+)
+
+// ChallengeReason describes why a ChallengeError was returned.
+type ChallengeReason string
+
+const (
+	// ChallengeCodeRequired means that the user has enrolled and must provide a code.
+	ChallengeCodeRequired ChallengeReason = "code"
+
+	// ChallengeEnrollmentRequired means that the user must configure their authenticator app with the secret of the
+	// ChallengeError and then provide a code to confirm their enrollment.
+	ChallengeEnrollmentRequired ChallengeReason = "enroll"
+)
+
+// ChallengeError is returned by Verifier.Verify when the user must provide a valid code before they may log in.
+type ChallengeError struct {
+	Reason ChallengeReason
+
+	// InvalidCode is true when the user provided a code which was not valid.
+	InvalidCode bool
+
+	// KeyURI and EncodedSecret are only set when the Reason is ChallengeEnrollmentRequired.
+	KeyURI        string
+	EncodedSecret string
+}
+
+func (e *ChallengeError) Error() string {
+	if e.InvalidCode {
+		return fmt.Sprintf("TOTP code is not valid (%s)", e.Reason)
+	}
+	return fmt.Sprintf("TOTP code is required (%s)", e.Reason)
+}
+
+// User identifies the user whose code is verified.
+type User struct {
+	// Key uniquely identifies the user, e.g. by their downstream subject.
+	Key string
+
+	// AccountName is the name which the user's authenticator app shows for the secret.
+	AccountName string
+}
+
+// Verifier verifies the TOTP codes of users and manages their enrollments.
+type Verifier struct {
+	storage *Storage
+	clock   func() time.Time
+	rand    io.Reader
+}
+
+// NewVerifier returns a Verifier.
+func NewVerifier(storage *Storage, clock func() time.Time, rand io.Reader) *Verifier {
+	return &Verifier{storage: storage, clock: clock, rand: rand}
+}
+
+// Verify checks the code of the user after they have already provided a valid password. It returns nil when the user
+// may log in, a *ChallengeError when the user must provide a (different) code, or any other error when the user's
+// enrollment could not be read or saved. The code may be empty when the user has not provided one yet. When the mode
+// is ModeOptional, users who have not enrolled yet are only asked to enroll when wantsToEnroll is true.
+func (v *Verifier) Verify(ctx context.Context, mode Mode, user User, code string, wantsToEnroll bool) error {
+	if mode != ModeOptional && mode != ModeRequired {
+		return nil
+	}
+
+	enrollment, err := v.storage.Get(ctx, user.Key)
+	if err != nil {
+		return fmt.Errorf("could not read TOTP enrollment: %w", err)
+	}
+
+	if enrollment != nil && enrollment.Confirmed {
+		if code == "" {
+			return &ChallengeError{Reason: ChallengeCodeRequired}
+		}
+		return v.validate(ctx, user, enrollment, code, &ChallengeError{Reason: ChallengeCodeRequired, InvalidCode: true})
+	}
+
+	if mode == ModeOptional && !wantsToEnroll {
+		return nil
+	}
+
+	if enrollment == nil {
+		secret, err := GenerateSecret(v.rand)
+		if err != nil {
+			return err
+		}
+		enrollment = &Enrollment{Secret: secret}
+		if err := v.storage.Save(ctx, user.Key, enrollment); err != nil {
+			return fmt.Errorf("could not save TOTP enrollment: %w", err)
+		}
+	}
+
+	challenge := &ChallengeError{
+		Reason:        ChallengeEnrollmentRequired,
+		KeyURI:        KeyURI(keyURIIssuer, user.AccountName, enrollment.Secret),
+		EncodedSecret: EncodeSecret(enrollment.Secret),
+	}
+	if code == "" {
+		return challenge
+	}
+	challenge.InvalidCode = true
+	return v.validate(ctx, user, enrollment, code, challenge)
+}
+
+// validate checks the code against the enrollment, and confirms the enrollment when the code is valid.
+func (v *Verifier) validate(ctx context.Context, user User, enrollment *Enrollment, code string, invalidCodeErr error) error {
+	counter, ok := Validate(enrollment.Secret, code, v.clock(), enrollment.LastUsedCounter)
+	if !ok {
+		return invalidCodeErr
+	}
+
+	enrollment.Confirmed = true
+	enrollment.LastUsedCounter = counter
+	// Saving fails when another login used a code of the same user concurrently, which prevents the same code from
+	// being used twice.
+	if err := v.storage.Save(ctx, user.Key, enrollment); err != nil {
+		return fmt.Errorf("could not save TOTP enrollment: %w", err)
+	}
+	return nil
+}
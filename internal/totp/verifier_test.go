@@ -0,0 +1,161 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package totp
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+)
+
+func TestVerifier(t *testing.T) {
+	const namespace = "test-ns"
+	ctx := context.Background()
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	user := User{Key: "https://ldap.example.com?sub=some-user", AccountName: "pinny (my-ldap)"}
+	baseKey := []byte("some-base-key")
+
+	newVerifier := func(t *testing.T) (*Verifier, *Storage, *fake.Clientset) {
+		t.Helper()
+		client := fake.NewSimpleClientset()
+		storage := NewStorage(client.CoreV1().Secrets(namespace), clock, func() []byte { return baseKey }, rand.Reader)
+		return NewVerifier(storage, clock, rand.Reader), storage, client
+	}
+
+	requireChallenge := func(t *testing.T, err error, wantReason ChallengeReason, wantInvalidCode bool) *ChallengeError {
+		t.Helper()
+		var challenge *ChallengeError
+		require.True(t, errors.As(err, &challenge), "wanted a ChallengeError but got %v", err)
+		require.Equal(t, wantReason, challenge.Reason)
+		require.Equal(t, wantInvalidCode, challenge.InvalidCode)
+		return challenge
+	}
+
+	enroll := func(t *testing.T, verifier *Verifier, storage *Storage, mode Mode) []byte {
+		t.Helper()
+		challenge := requireChallenge(t, verifier.Verify(ctx, mode, user, "", true), ChallengeEnrollmentRequired, false)
+		enrollment, err := storage.Get(ctx, user.Key)
+		require.NoError(t, err)
+		require.Equal(t, EncodeSecret(enrollment.Secret), challenge.EncodedSecret)
+		require.Equal(t, KeyURI("Pinniped", user.AccountName, enrollment.Secret), challenge.KeyURI)
+		require.NoError(t, verifier.Verify(ctx, mode, user, Code(enrollment.Secret, now.Add(-period)), true))
+		return enrollment.Secret
+	}
+
+	t.Run("disabled mode never asks for codes", func(t *testing.T) {
+		verifier, storage, client := newVerifier(t)
+		require.NoError(t, verifier.Verify(ctx, ModeDisabled, user, "", true))
+		require.NoError(t, verifier.Verify(ctx, "", user, "", true))
+		require.Empty(t, client.Actions())
+
+		// Even enrolled users may log in without a code.
+		enroll(t, verifier, storage, ModeRequired)
+		require.NoError(t, verifier.Verify(ctx, ModeDisabled, user, "", false))
+	})
+
+	t.Run("optional mode only asks users who want to enroll", func(t *testing.T) {
+		verifier, storage, _ := newVerifier(t)
+		require.NoError(t, verifier.Verify(ctx, ModeOptional, user, "", false))
+		enrollment, err := storage.Get(ctx, user.Key)
+		require.NoError(t, err)
+		require.Nil(t, enrollment)
+
+		// Abandoning an enrollment does not prevent the user from logging in without a code.
+		requireChallenge(t, verifier.Verify(ctx, ModeOptional, user, "", true), ChallengeEnrollmentRequired, false)
+		require.NoError(t, verifier.Verify(ctx, ModeOptional, user, "", false))
+
+		secret := enroll(t, verifier, storage, ModeOptional)
+		requireChallenge(t, verifier.Verify(ctx, ModeOptional, user, "", false), ChallengeCodeRequired, false)
+		require.NoError(t, verifier.Verify(ctx, ModeOptional, user, Code(secret, now), false))
+	})
+
+	t.Run("required mode asks all users to enroll and then to provide codes", func(t *testing.T) {
+		verifier, storage, _ := newVerifier(t)
+
+		first := requireChallenge(t, verifier.Verify(ctx, ModeRequired, user, "", false), ChallengeEnrollmentRequired, false)
+		// The same secret is shown until the enrollment is confirmed.
+		second := requireChallenge(t, verifier.Verify(ctx, ModeRequired, user, "", false), ChallengeEnrollmentRequired, false)
+		require.Equal(t, first, second)
+		invalid := requireChallenge(t, verifier.Verify(ctx, ModeRequired, user, "000000", false), ChallengeEnrollmentRequired, true)
+		require.Equal(t, first.EncodedSecret, invalid.EncodedSecret)
+
+		enrollment, err := storage.Get(ctx, user.Key)
+		require.NoError(t, err)
+		require.False(t, enrollment.Confirmed)
+		require.NoError(t, verifier.Verify(ctx, ModeRequired, user, Code(enrollment.Secret, now), false))
+
+		enrollment, err = storage.Get(ctx, user.Key)
+		require.NoError(t, err)
+		require.True(t, enrollment.Confirmed)
+		require.Equal(t, counterAt(now), enrollment.LastUsedCounter)
+
+		requireChallenge(t, verifier.Verify(ctx, ModeRequired, user, "", false), ChallengeCodeRequired, false)
+		// Codes cannot be reused.
+		requireChallenge(t, verifier.Verify(ctx, ModeRequired, user, Code(enrollment.Secret, now), false), ChallengeCodeRequired, true)
+		require.NoError(t, verifier.Verify(ctx, ModeRequired, user, Code(enrollment.Secret, now.Add(period)), false))
+
+		// Other users have their own enrollments.
+		otherUser := User{Key: "https://ldap.example.com?sub=other-user", AccountName: "other (my-ldap)"}
+		requireChallenge(t, verifier.Verify(ctx, ModeRequired, otherUser, Code(enrollment.Secret, now.Add(period)), false), ChallengeEnrollmentRequired, true)
+	})
+
+	t.Run("enrollments are stored encrypted", func(t *testing.T) {
+		verifier, storage, client := newVerifier(t)
+		secret := enroll(t, verifier, storage, ModeRequired)
+
+		secrets, err := client.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{LabelSelector: "storage.pinniped.dev/type=totp"})
+		require.NoError(t, err)
+		require.Len(t, secrets.Items, 1)
+		require.NotContains(t, string(secrets.Items[0].Data["pinniped-storage-data"]), EncodeSecret(secret))
+		require.Empty(t, secrets.Items[0].Annotations)
+
+		// A different base key cannot decrypt the secret.
+		otherStorage := NewStorage(client.CoreV1().Secrets(namespace), clock, func() []byte { return []byte("other-key") }, rand.Reader)
+		_, err = otherStorage.Get(ctx, user.Key)
+		require.ErrorIs(t, err, ErrInvalidEnrollmentData)
+
+		// The encrypted secret cannot be copied to another user.
+		stored := secrets.Items[0].DeepCopy()
+		client.PrependReactor("get", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			return true, stored, nil
+		})
+		_, err = storage.Get(ctx, "some-other-user-key")
+		require.ErrorIs(t, err, ErrInvalidEnrollmentData)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		verifier, _, client := newVerifier(t)
+		client.PrependReactor("get", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("some get error")
+		})
+		err := verifier.Verify(ctx, ModeRequired, user, "", false)
+		require.EqualError(t, err, "could not read TOTP enrollment: failed to get totp for signature PZRcoXsrCdF6cRbzjcFgDM4OlqLsb9ZBAPpGuKpYBoc: some get error")
+
+		noKeyVerifier := NewVerifier(NewStorage(fake.NewSimpleClientset().CoreV1().Secrets(namespace), clock, func() []byte { return nil }, rand.Reader), clock, rand.Reader)
+		require.ErrorIs(t, noKeyVerifier.Verify(ctx, ModeRequired, user, "", false), ErrNoEncryptionKey)
+	})
+
+	t.Run("concurrent use of the same code", func(t *testing.T) {
+		verifier, storage, client := newVerifier(t)
+		secret := enroll(t, verifier, storage, ModeRequired)
+		// Simulate another login which saved the enrollment after this login read it.
+		client.PrependReactor("update", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			obj := action.(coretesting.UpdateAction).GetObject().(*corev1.Secret)
+			return true, nil, errors.New("conflict for " + obj.Name)
+		})
+		err := verifier.Verify(ctx, ModeRequired, user, Code(secret, now), false)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "could not save TOTP enrollment")
+	})
+}
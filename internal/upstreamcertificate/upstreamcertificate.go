@@ -0,0 +1,310 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstreamcertificate implements an abstraction of upstream client certificate identity provider interactions.
+package upstreamcertificate
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+var (
+	// oidExtensionSubjectAltName is the OID of the subject alternative name extension of X.509 certificates.
+	oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17} //nolint:gochecknoglobals
+
+	// oidUserPrincipalName is the OID of the Microsoft user principal name (UPN) other name.
+	oidUserPrincipalName = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3} //nolint:gochecknoglobals
+)
+
+// ProviderConfig holds the active configuration of an upstream client certificate identity provider.
+type ProviderConfig struct {
+	Name        string
+	ResourceUID types.UID
+
+	// CertificateAuthorities are the CA certificates which issue the client certificates of users.
+	CertificateAuthorities []*x509.Certificate
+
+	// RevocationLists are the CRLs against which each certificate of a verified chain is checked.
+	RevocationLists []*pkix.CertificateList
+
+	// UsernameField is the field of the client certificate which holds the username.
+	UsernameField v1alpha1.CertificateField
+
+	// GroupsField is the field of the client certificate's subject which holds the group names. When empty, no
+	// groups are returned.
+	GroupsField v1alpha1.CertificateField
+
+	// Clock returns the current time, against which the validity of certificates and CRLs is checked.
+	Clock func() time.Time
+}
+
+var _ provider.UpstreamCertificateIdentityProviderI = (*ProviderConfig)(nil)
+
+func (p *ProviderConfig) GetName() string {
+	return p.Name
+}
+
+func (p *ProviderConfig) GetResourceUID() types.UID {
+	return p.ResourceUID
+}
+
+func (p *ProviderConfig) GetCertificateAuthorities() []*x509.Certificate {
+	return p.CertificateAuthorities
+}
+
+// TestConnection checks whether users can still authenticate. The Supervisor never connects anywhere to verify client
+// certificates, so this only checks that at least one of the CAs is currently valid and that none of the CRLs has
+// passed its next update time, since either would cause every login to fail.
+func (p *ProviderConfig) TestConnection(_ context.Context) error {
+	now := p.Clock()
+	validCA := false
+	for _, ca := range p.CertificateAuthorities {
+		if !now.Before(ca.NotBefore) && !now.After(ca.NotAfter) {
+			validCA = true
+			break
+		}
+	}
+	if !validCA {
+		return errors.New("none of the certificate authorities is currently valid")
+	}
+	for _, crl := range p.RevocationLists {
+		if crl.HasExpired(now) {
+			return fmt.Errorf("certificate revocation list of %q has passed its next update time", crl.TBSCertList.Issuer.String())
+		}
+	}
+	return nil
+}
+
+func (p *ProviderConfig) AuthenticateCertificate(peerCertificates []*x509.Certificate) (*provider.CertificateUser, error) {
+	if len(peerCertificates) == 0 {
+		return nil, errors.New("no client certificate was presented")
+	}
+	leaf := peerCertificates[0]
+
+	roots := x509.NewCertPool()
+	for _, ca := range p.CertificateAuthorities {
+		roots.AddCert(ca)
+	}
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range peerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	now := p.Clock()
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not verify client certificate: %w", err)
+	}
+
+	// Any chain is good enough, as long as none of its certificates have been revoked.
+	var revocationErr error
+	for _, chain := range chains {
+		if revocationErr = p.checkRevocation(chain, now); revocationErr == nil {
+			break
+		}
+	}
+	if revocationErr != nil {
+		return nil, revocationErr
+	}
+
+	username, err := usernameFromCertificate(leaf, p.UsernameField)
+	if err != nil {
+		return nil, err
+	}
+
+	return &provider.CertificateUser{
+		Username:          username,
+		Groups:            groupsFromCertificate(leaf, p.GroupsField),
+		DownstreamSubject: downstreamSubject(leaf),
+	}, nil
+}
+
+// checkRevocation checks each certificate of the chain, except for the trusted CA at its end, against the CRLs
+// which were issued by the next certificate of the chain. When any CRLs are configured, every issuer of the chain
+// must have issued one of them, so that a missing CRL does not silently disable revocation checking.
+func (p *ProviderConfig) checkRevocation(chain []*x509.Certificate, now time.Time) error {
+	if len(p.RevocationLists) == 0 {
+		return nil
+	}
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		found := false
+		for _, crl := range p.RevocationLists {
+			if !crlIssuedBy(crl, issuer) {
+				continue
+			}
+			found = true
+			if crl.HasExpired(now) {
+				return fmt.Errorf("certificate revocation list of %q has passed its next update time", issuer.Subject.String())
+			}
+			for _, revoked := range crl.TBSCertList.RevokedCertificates {
+				if revoked.SerialNumber != nil && revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("certificate %q has been revoked", cert.Subject.String())
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("no certificate revocation list of %q was found", issuer.Subject.String())
+		}
+	}
+	return nil
+}
+
+// crlIssuedBy returns whether the CRL names the certificate's subject as its issuer and was signed by the
+// certificate's key. The names are compared as they were encoded, since encoding the parsed name of the CRL again
+// may use different string types, for example PrintableString instead of UTF8String.
+func crlIssuedBy(crl *pkix.CertificateList, issuer *x509.Certificate) bool {
+	var tbsCertList struct {
+		Version   int `asn1:"optional,default:0"`
+		Signature pkix.AlgorithmIdentifier
+		Issuer    asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(crl.TBSCertList.Raw, &tbsCertList); err != nil {
+		return false
+	}
+	if !bytes.Equal(tbsCertList.Issuer.FullBytes, issuer.RawSubject) {
+		return false
+	}
+	return issuer.CheckCRLSignature(crl) == nil
+}
+
+// ParseRevocationLists parses all CRLs from the given file contents, which may be either a single DER encoded CRL
+// or any number of PEM encoded CRLs.
+func ParseRevocationLists(data []byte) ([]*pkix.CertificateList, error) {
+	var crls []*pkix.CertificateList
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) > 0 {
+		return crls, nil
+	}
+
+	crl, err := x509.ParseDERCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("no PEM encoded CRLs were found, and could not parse as a DER encoded CRL: %w", err)
+	}
+	return []*pkix.CertificateList{crl}, nil
+}
+
+func usernameFromCertificate(cert *x509.Certificate, field v1alpha1.CertificateField) (string, error) {
+	var username string
+	switch field {
+	case v1alpha1.CertificateFieldCommonName, "":
+		username = cert.Subject.CommonName
+	case v1alpha1.CertificateFieldEmailAddress:
+		username = first(cert.EmailAddresses)
+	case v1alpha1.CertificateFieldUserPrincipalName:
+		names, err := userPrincipalNames(cert)
+		if err != nil {
+			return "", err
+		}
+		username = first(names)
+	case v1alpha1.CertificateFieldDNSName:
+		username = first(cert.DNSNames)
+	case v1alpha1.CertificateFieldURI:
+		if len(cert.URIs) > 0 {
+			username = cert.URIs[0].String()
+		}
+	default:
+		return "", fmt.Errorf("unsupported username field %q", field)
+	}
+	if username == "" {
+		return "", fmt.Errorf("client certificate has no value for username field %q", field)
+	}
+	return username, nil
+}
+
+func groupsFromCertificate(cert *x509.Certificate, field v1alpha1.CertificateField) []string {
+	var values []string
+	switch field {
+	case v1alpha1.CertificateFieldOrganization:
+		values = cert.Subject.Organization
+	case v1alpha1.CertificateFieldOrganizationalUnit:
+		values = cert.Subject.OrganizationalUnit
+	}
+	return sets.NewString(values...).Delete("").List()
+}
+
+// userPrincipalNames returns the values of all Microsoft UPN other names in the certificate's subject alternative
+// name extension, which the standard library does not parse.
+func userPrincipalNames(cert *x509.Certificate) ([]string, error) {
+	var names []string
+	for _, extension := range cert.Extensions {
+		if !extension.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		var generalNames []asn1.RawValue
+		if _, err := asn1.Unmarshal(extension.Value, &generalNames); err != nil {
+			return nil, fmt.Errorf("could not parse subject alternative names: %w", err)
+		}
+		for _, generalName := range generalNames {
+			// An otherName is the context-specific, constructed [0] choice of GeneralName.
+			if generalName.Class != asn1.ClassContextSpecific || generalName.Tag != 0 || !generalName.IsCompound {
+				continue
+			}
+			var otherName struct {
+				TypeID asn1.ObjectIdentifier
+				Value  asn1.RawValue // the explicitly tagged [0] value
+			}
+			if _, err := asn1.UnmarshalWithParams(generalName.FullBytes, &otherName, "tag:0"); err != nil {
+				return nil, fmt.Errorf("could not parse subject alternative name: %w", err)
+			}
+			if !otherName.TypeID.Equal(oidUserPrincipalName) {
+				continue
+			}
+			var upn string
+			if _, err := asn1.Unmarshal(otherName.Value.Bytes, &upn); err != nil {
+				return nil, fmt.Errorf("could not parse user principal name: %w", err)
+			}
+			names = append(names, upn)
+		}
+	}
+	return names, nil
+}
+
+// downstreamSubject follows the same pattern as subjects from OIDC upstreams, using the subject of the issuer of
+// the client certificate in place of the issuer.
+func downstreamSubject(cert *x509.Certificate) string {
+	return fmt.Sprintf("x509:%s?%s=%s",
+		url.QueryEscape(cert.Issuer.String()), oidc.IDTokenSubjectClaim, url.QueryEscape(cert.Subject.String()))
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,482 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamcertificate
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var nextSerial int64 = 1000
+
+func newSerial() *big.Int {
+	nextSerial++
+	return big.NewInt(nextSerial)
+}
+
+func newTestCA(t *testing.T, commonName string, parent *testCA) *testCA {
+	t.Helper()
+	return newTestCAWithRawSubject(t, commonName, nil, parent)
+}
+
+// newTestCAWithRawSubject creates a CA whose subject is encoded as rawSubject, when it is not nil.
+func newTestCAWithRawSubject(t *testing.T, commonName string, rawSubject []byte, parent *testCA) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: commonName},
+		RawSubject:            rawSubject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	issuerCert, issuerKey := template, crypto.Signer(key)
+	if parent != nil {
+		issuerCert, issuerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuerCert, key.Public(), issuerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// utf8CommonName returns a distinguished name which only has the common name, encoded as a UTF8String rather than
+// the PrintableString which the standard library would choose.
+func utf8CommonName(t *testing.T, commonName string) []byte {
+	t.Helper()
+	rawSubject, err := asn1.Marshal(pkix.RDNSequence{{{
+		Type:  asn1.ObjectIdentifier{2, 5, 4, 3},
+		Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagUTF8String, Bytes: []byte(commonName)},
+	}}})
+	require.NoError(t, err)
+	return rawSubject
+}
+
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = newSerial()
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	if template.ExtKeyUsage == nil {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func (ca *testCA) crl(t *testing.T, nextUpdate time.Time, revoked ...*x509.Certificate) *pkix.CertificateList {
+	t.Helper()
+	crls, err := ParseRevocationLists(ca.crlDER(t, nextUpdate, revoked...))
+	require.NoError(t, err)
+	require.Len(t, crls, 1)
+	return crls[0]
+}
+
+// crlDER creates a CRL by hand, since older versions of the standard library encode the issuer of CRLs again
+// instead of copying the subject of the CA as it was encoded.
+func (ca *testCA) crlDER(t *testing.T, nextUpdate time.Time, revoked ...*x509.Certificate) []byte {
+	t.Helper()
+	var revokedCerts []pkix.RevokedCertificate
+	for _, cert := range revoked {
+		revokedCerts = append(revokedCerts, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: time.Now().UTC()})
+	}
+	signatureAlgorithm := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}} // ECDSA with SHA-256
+	tbsCertList, err := asn1.Marshal(struct {
+		Version             int
+		Signature           pkix.AlgorithmIdentifier
+		Issuer              asn1.RawValue
+		ThisUpdate          time.Time
+		NextUpdate          time.Time
+		RevokedCertificates []pkix.RevokedCertificate `asn1:"optional"`
+	}{
+		Version:             1,
+		Signature:           signatureAlgorithm,
+		Issuer:              asn1.RawValue{FullBytes: ca.cert.RawSubject},
+		ThisUpdate:          time.Now().Add(-time.Minute).UTC(),
+		NextUpdate:          nextUpdate.UTC(),
+		RevokedCertificates: revokedCerts,
+	})
+	require.NoError(t, err)
+	digest := sha256.Sum256(tbsCertList)
+	signature, err := ca.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	der, err := asn1.Marshal(struct {
+		TBSCertList        asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		SignatureValue     asn1.BitString
+	}{
+		TBSCertList:        asn1.RawValue{FullBytes: tbsCertList},
+		SignatureAlgorithm: signatureAlgorithm,
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+	require.NoError(t, err)
+	return der
+}
+
+func userPrincipalNameExtension(t *testing.T, upn string) pkix.Extension {
+	t.Helper()
+	value, err := asn1.MarshalWithParams(upn, "utf8")
+	require.NoError(t, err)
+	otherName, err := asn1.MarshalWithParams(struct {
+		TypeID asn1.ObjectIdentifier
+		Value  asn1.RawValue
+	}{
+		TypeID: oidUserPrincipalName,
+		Value:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+	}, "tag:0")
+	require.NoError(t, err)
+	sans, err := asn1.Marshal([]asn1.RawValue{{FullBytes: otherName}})
+	require.NoError(t, err)
+	return pkix.Extension{Id: oidExtensionSubjectAltName, Value: sans}
+}
+
+func TestAuthenticateCertificate(t *testing.T) {
+	rootCA := newTestCA(t, "some-root-ca", nil)
+	intermediateCA := newTestCA(t, "some-intermediate-ca", rootCA)
+	otherCA := newTestCA(t, "some-other-ca", nil)
+	impostorRootCA := newTestCA(t, "some-root-ca", nil)
+	utf8CA := newTestCAWithRawSubject(t, "some-utf8-ca", utf8CommonName(t, "some-utf8-ca"), nil)
+
+	userCert := rootCA.issue(t, &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "some-user",
+			Organization:       []string{"org-b", "org-a", "org-b"},
+			OrganizationalUnit: []string{"some-ou"},
+		},
+		EmailAddresses: []string{"some-user@example.com", "other@example.com"},
+		DNSNames:       []string{"some-user.example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/some-user"}},
+	})
+	upnCert := rootCA.issue(t, &x509.Certificate{
+		Subject:         pkix.Name{CommonName: "Some User"},
+		ExtraExtensions: []pkix.Extension{userPrincipalNameExtension(t, "some-user@corp.example.com")},
+	})
+	intermediateUserCert := intermediateCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "intermediate-user"}})
+	otherUserCert := otherCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other-user"}})
+	utf8UserCert := utf8CA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "utf8-user"}})
+	noCommonNameCert := rootCA.issue(t, &x509.Certificate{Subject: pkix.Name{Organization: []string{"org-a"}}})
+	serverCert := rootCA.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "some-server"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	expiredCert := rootCA.issue(t, &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "expired-user"},
+		NotBefore: time.Now().Add(-2 * time.Hour),
+		NotAfter:  time.Now().Add(-time.Hour),
+	})
+
+	now := time.Now()
+	tomorrow := now.Add(24 * time.Hour)
+
+	tests := []struct {
+		name             string
+		usernameField    v1alpha1.CertificateField
+		groupsField      v1alpha1.CertificateField
+		revocationLists  []*pkix.CertificateList
+		peerCertificates []*x509.Certificate
+		wantUser         *provider.CertificateUser
+		wantErr          string
+	}{
+		{
+			name:             "common name and organizations",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			groupsField:      v1alpha1.CertificateFieldOrganization,
+			peerCertificates: []*x509.Certificate{userCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "some-user",
+				Groups:            []string{"org-a", "org-b"},
+				DownstreamSubject: "x509:CN%3Dsome-root-ca?sub=CN%3Dsome-user%2COU%3Dsome-ou%2CO%3Dorg-a%2BO%3Dorg-b%2BO%3Dorg-b",
+			},
+		},
+		{
+			name:             "organizational units",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			groupsField:      v1alpha1.CertificateFieldOrganizationalUnit,
+			peerCertificates: []*x509.Certificate{userCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "some-user",
+				Groups:            []string{"some-ou"},
+				DownstreamSubject: "x509:CN%3Dsome-root-ca?sub=CN%3Dsome-user%2COU%3Dsome-ou%2CO%3Dorg-a%2BO%3Dorg-b%2BO%3Dorg-b",
+			},
+		},
+		{
+			name:             "no groups field",
+			usernameField:    v1alpha1.CertificateFieldEmailAddress,
+			peerCertificates: []*x509.Certificate{userCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "some-user@example.com",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-root-ca?sub=CN%3Dsome-user%2COU%3Dsome-ou%2CO%3Dorg-a%2BO%3Dorg-b%2BO%3Dorg-b",
+			},
+		},
+		{
+			name:             "DNS name",
+			usernameField:    v1alpha1.CertificateFieldDNSName,
+			peerCertificates: []*x509.Certificate{userCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "some-user.example.com",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-root-ca?sub=CN%3Dsome-user%2COU%3Dsome-ou%2CO%3Dorg-a%2BO%3Dorg-b%2BO%3Dorg-b",
+			},
+		},
+		{
+			name:             "URI",
+			usernameField:    v1alpha1.CertificateFieldURI,
+			peerCertificates: []*x509.Certificate{userCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "spiffe://example.com/some-user",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-root-ca?sub=CN%3Dsome-user%2COU%3Dsome-ou%2CO%3Dorg-a%2BO%3Dorg-b%2BO%3Dorg-b",
+			},
+		},
+		{
+			name:             "user principal name",
+			usernameField:    v1alpha1.CertificateFieldUserPrincipalName,
+			peerCertificates: []*x509.Certificate{upnCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "some-user@corp.example.com",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-root-ca?sub=CN%3DSome+User",
+			},
+		},
+		{
+			name:             "no user principal name",
+			usernameField:    v1alpha1.CertificateFieldUserPrincipalName,
+			peerCertificates: []*x509.Certificate{userCert},
+			wantErr:          `client certificate has no value for username field "UserPrincipalName"`,
+		},
+		{
+			name:             "no common name",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			peerCertificates: []*x509.Certificate{noCommonNameCert},
+			wantErr:          `client certificate has no value for username field "CommonName"`,
+		},
+		{
+			name:             "intermediate presented by the client",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			peerCertificates: []*x509.Certificate{intermediateUserCert, intermediateCA.cert},
+			wantUser: &provider.CertificateUser{
+				Username:          "intermediate-user",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-intermediate-ca?sub=CN%3Dintermediate-user",
+			},
+		},
+		{
+			name:             "intermediate not presented by the client",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			peerCertificates: []*x509.Certificate{intermediateUserCert},
+			wantErr:          "could not verify client certificate: x509: certificate signed by unknown authority",
+		},
+		{
+			name:             "untrusted issuer",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			peerCertificates: []*x509.Certificate{otherUserCert},
+			wantErr:          "could not verify client certificate: x509: certificate signed by unknown authority",
+		},
+		{
+			name:             "server certificate",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			peerCertificates: []*x509.Certificate{serverCert},
+			wantErr:          "could not verify client certificate: x509: certificate specifies an incompatible key usage",
+		},
+		{
+			name:             "expired certificate",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			peerCertificates: []*x509.Certificate{expiredCert},
+			wantErr: fmt.Sprintf("could not verify client certificate: x509: certificate has expired or is not yet valid: current time %s is after %s",
+				now.UTC().Format(time.RFC3339), expiredCert.NotAfter.UTC().Format(time.RFC3339)),
+		},
+		{
+			name:          "no certificate",
+			usernameField: v1alpha1.CertificateFieldCommonName,
+			wantErr:       "no client certificate was presented",
+		},
+		{
+			name:             "not revoked",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{rootCA.crl(t, tomorrow, upnCert), otherCA.crl(t, tomorrow, otherUserCert)},
+			peerCertificates: []*x509.Certificate{userCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "some-user",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-root-ca?sub=CN%3Dsome-user%2COU%3Dsome-ou%2CO%3Dorg-a%2BO%3Dorg-b%2BO%3Dorg-b",
+			},
+		},
+		{
+			name:             "revoked",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{rootCA.crl(t, tomorrow, upnCert, userCert)},
+			peerCertificates: []*x509.Certificate{userCert},
+			wantErr:          `certificate "CN=some-user,OU=some-ou,O=org-a+O=org-b+O=org-b" has been revoked`,
+		},
+		{
+			name:             "intermediate revoked",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{intermediateCA.crl(t, tomorrow), rootCA.crl(t, tomorrow, intermediateCA.cert)},
+			peerCertificates: []*x509.Certificate{intermediateUserCert, intermediateCA.cert},
+			wantErr:          `certificate "CN=some-intermediate-ca" has been revoked`,
+		},
+		{
+			name:             "revoked by a CRL of an impostor with the same name is ignored",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{impostorRootCA.crl(t, tomorrow, userCert), rootCA.crl(t, tomorrow)},
+			peerCertificates: []*x509.Certificate{userCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "some-user",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-root-ca?sub=CN%3Dsome-user%2COU%3Dsome-ou%2CO%3Dorg-a%2BO%3Dorg-b%2BO%3Dorg-b",
+			},
+		},
+		{
+			name:             "only a CRL of an impostor with the same name",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{impostorRootCA.crl(t, tomorrow)},
+			peerCertificates: []*x509.Certificate{userCert},
+			wantErr:          `no certificate revocation list of "CN=some-root-ca" was found`,
+		},
+		{
+			name:             "no CRL of an issuer in the chain",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{intermediateCA.crl(t, tomorrow)},
+			peerCertificates: []*x509.Certificate{intermediateUserCert, intermediateCA.cert},
+			wantErr:          `no certificate revocation list of "CN=some-root-ca" was found`,
+		},
+		{
+			name:             "CRLs of every issuer in the chain",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{intermediateCA.crl(t, tomorrow), rootCA.crl(t, tomorrow)},
+			peerCertificates: []*x509.Certificate{intermediateUserCert, intermediateCA.cert},
+			wantUser: &provider.CertificateUser{
+				Username:          "intermediate-user",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-intermediate-ca?sub=CN%3Dintermediate-user",
+			},
+		},
+		{
+			name:             "issuer name encoded as a UTF8String, not revoked",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{utf8CA.crl(t, tomorrow)},
+			peerCertificates: []*x509.Certificate{utf8UserCert},
+			wantUser: &provider.CertificateUser{
+				Username:          "utf8-user",
+				Groups:            []string{},
+				DownstreamSubject: "x509:CN%3Dsome-utf8-ca?sub=CN%3Dutf8-user",
+			},
+		},
+		{
+			name:             "issuer name encoded as a UTF8String, revoked",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{utf8CA.crl(t, tomorrow, utf8UserCert)},
+			peerCertificates: []*x509.Certificate{utf8UserCert},
+			wantErr:          `certificate "CN=utf8-user" has been revoked`,
+		},
+		{
+			name:             "expired CRL",
+			usernameField:    v1alpha1.CertificateFieldCommonName,
+			revocationLists:  []*pkix.CertificateList{rootCA.crl(t, now.Add(-time.Second))},
+			peerCertificates: []*x509.Certificate{userCert},
+			wantErr:          `certificate revocation list of "CN=some-root-ca" has passed its next update time`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			p := &ProviderConfig{
+				Name:                   "some-idp",
+				CertificateAuthorities: []*x509.Certificate{rootCA.cert, utf8CA.cert},
+				RevocationLists:        test.revocationLists,
+				UsernameField:          test.usernameField,
+				GroupsField:            test.groupsField,
+				Clock:                  func() time.Time { return now },
+			}
+			user, err := p.AuthenticateCertificate(test.peerCertificates)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Nil(t, user)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantUser, user)
+		})
+	}
+}
+
+func TestTestConnection(t *testing.T) {
+	ca := newTestCA(t, "some-ca", nil)
+	now := time.Now()
+
+	p := ProviderConfig{
+		CertificateAuthorities: []*x509.Certificate{ca.cert},
+		RevocationLists:        []*pkix.CertificateList{ca.crl(t, now.Add(time.Hour))},
+		Clock:                  func() time.Time { return now },
+	}
+	require.NoError(t, p.TestConnection(context.Background()))
+
+	p.RevocationLists = append(p.RevocationLists, ca.crl(t, now.Add(-time.Minute)))
+	require.EqualError(t, p.TestConnection(context.Background()),
+		`certificate revocation list of "CN=some-ca" has passed its next update time`)
+
+	p.RevocationLists = nil
+	p.Clock = func() time.Time { return now.Add(48 * time.Hour) }
+	require.EqualError(t, p.TestConnection(context.Background()), "none of the certificate authorities is currently valid")
+}
+
+func TestParseRevocationLists(t *testing.T) {
+	ca := newTestCA(t, "some-ca", nil)
+	der1 := ca.crlDER(t, time.Now().Add(time.Hour))
+	der2 := ca.crlDER(t, time.Now().Add(time.Hour))
+
+	crls, err := ParseRevocationLists(der1)
+	require.NoError(t, err)
+	require.Len(t, crls, 1)
+
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der1}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der2})...)
+	crls, err = ParseRevocationLists(bundle)
+	require.NoError(t, err)
+	require.Len(t, crls, 2)
+
+	_, err = ParseRevocationLists([]byte("not a CRL"))
+	require.ErrorContains(t, err, "no PEM encoded CRLs were found, and could not parse as a DER encoded CRL: ")
+
+	_, err = ParseRevocationLists(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: []byte("junk")}))
+	require.Error(t, err)
+}
@@ -0,0 +1,320 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstreamgithub implements an abstraction of upstream GitHub provider interactions.
+package upstreamgithub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/pkg/oidcclient/pkce"
+)
+
+const (
+	// pageSize is the largest page size allowed by the GitHub REST API.
+	pageSize = 100
+
+	// maxPages protects against an unexpectedly large number of results, or a misbehaving server.
+	maxPages = 100
+)
+
+// nextPageLinkRegexp finds the URL of the next page in a GitHub API Link response header.
+// See https://docs.github.com/en/rest/using-the-rest-api/using-pagination-in-the-rest-api.
+var nextPageLinkRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// ProviderConfig holds the active configuration of an upstream GitHub provider.
+type ProviderConfig struct {
+	Name        string
+	ResourceUID types.UID
+
+	// APIBaseURL is the base URL of the GitHub REST API, e.g. "https://api.github.com" for github.com or
+	// "https://github.example.com/api/v3" for GitHub Enterprise Server.
+	APIBaseURL *url.URL
+
+	UsernameAttribute  v1alpha1.GitHubUsernameAttribute
+	GroupNameAttribute v1alpha1.GitHubGroupNameAttribute
+
+	// AllowedOrganizations restricts login to members of at least one of these organizations, matched
+	// case-insensitively. When empty, all GitHub users are allowed to log in.
+	AllowedOrganizations []string
+
+	// Config holds the client credentials, the authorize and token endpoints, and the scopes.
+	Config *oauth2.Config
+
+	// Client is used for all requests to GitHub.
+	Client *http.Client
+}
+
+var _ provider.UpstreamGitHubIdentityProviderI = (*ProviderConfig)(nil)
+
+// Endpoint returns the OAuth2 endpoints of the GitHub server at the given host, e.g. "github.com".
+func Endpoint(host string) oauth2.Endpoint {
+	return oauth2.Endpoint{
+		AuthURL:   fmt.Sprintf("https://%s/login/oauth/authorize", host),
+		TokenURL:  fmt.Sprintf("https://%s/login/oauth/access_token", host),
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+}
+
+// APIBaseURL returns the base URL of the GitHub REST API for the GitHub server at the given host.
+// GitHub's public API is hosted on its own subdomain, while GitHub Enterprise Server uses a path.
+func APIBaseURL(host string) (*url.URL, error) {
+	if host == "github.com" {
+		return url.Parse("https://api.github.com")
+	}
+	return url.Parse(fmt.Sprintf("https://%s/api/v3", host))
+}
+
+func (p *ProviderConfig) GetName() string {
+	return p.Name
+}
+
+func (p *ProviderConfig) GetResourceUID() types.UID {
+	return p.ResourceUID
+}
+
+func (p *ProviderConfig) GetClientID() string {
+	return p.Config.ClientID
+}
+
+func (p *ProviderConfig) GetAuthorizationURL() *url.URL {
+	result, _ := url.Parse(p.Config.Endpoint.AuthURL)
+	return result
+}
+
+func (p *ProviderConfig) GetScopes() []string {
+	return p.Config.Scopes
+}
+
+func (p *ProviderConfig) ExchangeAuthcode(ctx context.Context, authcode string, pkceCodeVerifier pkce.Code, redirectURI string) (string, error) {
+	tok, err := p.Config.Exchange(
+		coreosoidc.ClientContext(ctx, p.Client),
+		authcode,
+		pkceCodeVerifier.Verifier(),
+		oauth2.SetAuthURLParam("redirect_uri", redirectURI),
+	)
+	if err != nil {
+		return "", err
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("token response did not contain an access token")
+	}
+	return tok.AccessToken, nil
+}
+
+// TestConnection checks whether the GitHub API is reachable by fetching its meta endpoint, which does not require
+// authentication.
+func (p *ProviderConfig) TestConnection(ctx context.Context) error {
+	metaURL := p.apiURL("meta").String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metaURL, nil)
+	if err != nil {
+		return fmt.Errorf("could not build request to %q: %w", metaURL, err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request to %q: %w", metaURL, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q from %q", resp.Status, metaURL)
+	}
+	return nil
+}
+
+type userResponse struct {
+	Login string `json:"login"`
+	ID    int64  `json:"id"`
+}
+
+type orgResponse struct {
+	Login string `json:"login"`
+}
+
+type teamResponse struct {
+	Name         string      `json:"name"`
+	Slug         string      `json:"slug"`
+	Organization orgResponse `json:"organization"`
+}
+
+func (p *ProviderConfig) GetUser(ctx context.Context, accessToken string) (*provider.GitHubUser, error) {
+	var user userResponse
+	if err := p.get(ctx, accessToken, "user", &user); err != nil {
+		return nil, err
+	}
+	if user.Login == "" || user.ID == 0 {
+		return nil, fmt.Errorf(`response from "user" endpoint did not include both "login" and "id"`)
+	}
+	userID := strconv.FormatInt(user.ID, 10)
+
+	allowedOrgs := sets.NewString()
+	for _, org := range p.AllowedOrganizations {
+		allowedOrgs.Insert(strings.ToLower(org))
+	}
+
+	if allowedOrgs.Len() > 0 {
+		var orgs []orgResponse
+		if err := p.getAllPages(ctx, accessToken, "user/orgs", func() interface{} { return &[]orgResponse{} }, func(page interface{}) {
+			orgs = append(orgs, *page.(*[]orgResponse)...)
+		}); err != nil {
+			return nil, err
+		}
+		isMember := false
+		for _, org := range orgs {
+			if allowedOrgs.Has(strings.ToLower(org.Login)) {
+				isMember = true
+				break
+			}
+		}
+		if !isMember {
+			return nil, fmt.Errorf("%w: user %q", provider.ErrGitHubUserNotAllowed, user.Login)
+		}
+	}
+
+	var teams []teamResponse
+	if err := p.getAllPages(ctx, accessToken, "user/teams", func() interface{} { return &[]teamResponse{} }, func(page interface{}) {
+		teams = append(teams, *page.(*[]teamResponse)...)
+	}); err != nil {
+		return nil, err
+	}
+
+	groups := sets.NewString()
+	for _, team := range teams {
+		if allowedOrgs.Len() > 0 && !allowedOrgs.Has(strings.ToLower(team.Organization.Login)) {
+			continue
+		}
+		teamName := team.Slug
+		if p.GroupNameAttribute == v1alpha1.GitHubUseTeamNameForGroupName {
+			teamName = team.Name
+		}
+		groups.Insert(team.Organization.Login + "/" + teamName)
+	}
+
+	return &provider.GitHubUser{
+		Username:          p.username(user.Login, userID),
+		Groups:            groups.List(),
+		DownstreamSubject: p.downstreamSubject(userID),
+	}, nil
+}
+
+func (p *ProviderConfig) username(login string, userID string) string {
+	switch p.UsernameAttribute {
+	case v1alpha1.GitHubUsernameLogin:
+		return login
+	case v1alpha1.GitHubUsernameID:
+		return userID
+	default:
+		return login + ":" + userID
+	}
+}
+
+// downstreamSubject uses the user's ID rather than their login name, since users may change their login names.
+func (p *ProviderConfig) downstreamSubject(userID string) string {
+	subjectURL := *p.APIBaseURL
+	q := subjectURL.Query()
+	q.Set("idpName", p.Name)
+	q.Set(oidc.IDTokenSubjectClaim, userID)
+	subjectURL.RawQuery = q.Encode()
+	return subjectURL.String()
+}
+
+// getAllPages fetches every page of a paginated GitHub API list endpoint. For each page, newPage is called to
+// allocate a value into which the page will be decoded, and then handlePage is called with that value.
+func (p *ProviderConfig) getAllPages(
+	ctx context.Context,
+	accessToken string,
+	path string,
+	newPage func() interface{},
+	handlePage func(interface{}),
+) error {
+	nextURL := p.apiURL(path)
+	q := nextURL.Query()
+	q.Set("per_page", strconv.Itoa(pageSize))
+	nextURL.RawQuery = q.Encode()
+
+	for i := 0; nextURL != nil; i++ {
+		if i >= maxPages {
+			return fmt.Errorf("too many pages of results from %q endpoint", path)
+		}
+		page := newPage()
+		linkHeader, err := p.doGet(ctx, accessToken, path, nextURL, page)
+		if err != nil {
+			return err
+		}
+		handlePage(page)
+
+		nextURL = nil
+		if matches := nextPageLinkRegexp.FindStringSubmatch(linkHeader); matches != nil {
+			nextURL, err = url.Parse(matches[1])
+			if err != nil {
+				return fmt.Errorf("could not parse next page link from %q endpoint: %w", path, err)
+			}
+			// The access token is sent along with the request for the next page, so it must not go anywhere else.
+			if nextURL.Scheme != p.APIBaseURL.Scheme || nextURL.Host != p.APIBaseURL.Host {
+				return fmt.Errorf("next page link from %q endpoint does not point to the GitHub API: %q", path, nextURL.Redacted())
+			}
+		}
+	}
+	return nil
+}
+
+func (p *ProviderConfig) get(ctx context.Context, accessToken string, path string, into interface{}) error {
+	_, err := p.doGet(ctx, accessToken, path, p.apiURL(path), into)
+	return err
+}
+
+func (p *ProviderConfig) apiURL(path string) *url.URL {
+	result := *p.APIBaseURL
+	result.Path = strings.TrimSuffix(result.Path, "/") + "/" + path
+	return &result
+}
+
+// doGet performs a GET request and decodes the JSON response. It returns the Link response header.
+func (p *ProviderConfig) doGet(ctx context.Context, accessToken string, path string, requestURL *url.URL, into interface{}) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("could not build request to %q endpoint: %w", path, err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error making request to %q endpoint: %w", path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response status from %q endpoint: %s", path, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response from %q endpoint: %w", path, err)
+	}
+	if err := json.Unmarshal(body, into); err != nil {
+		return "", fmt.Errorf("error decoding response from %q endpoint: %w", path, err)
+	}
+
+	return resp.Header.Get("Link"), nil
+}
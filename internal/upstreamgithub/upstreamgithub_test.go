@@ -0,0 +1,321 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamgithub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idp/v1alpha1"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/pkg/oidcclient/pkce"
+)
+
+// fakeGitHub is a tiny stand-in for the GitHub OAuth and REST APIs.
+type fakeGitHub struct {
+	t           *testing.T
+	accessToken string
+	user        string
+	orgsPages   []string
+	teamsPages  []string
+	statusCode  int
+
+	// nextPageLinkPrefix replaces the scheme and host of the links to next pages, when it is set.
+	nextPageLinkPrefix string
+}
+
+func (f *fakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/login/oauth/access_token" {
+		require.NoError(f.t, r.ParseForm())
+		require.Equal(f.t, "authorization_code", r.Form.Get("grant_type"))
+		require.Equal(f.t, "test-client-id", r.Form.Get("client_id"))
+		require.Equal(f.t, "test-client-secret", r.Form.Get("client_secret"))
+		require.Equal(f.t, "test-authcode", r.Form.Get("code"))
+		require.Equal(f.t, "https://example.com/callback", r.Form.Get("redirect_uri"))
+		require.NotEmpty(f.t, r.Form.Get("code_verifier"))
+		// GitHub returns form-encoded token responses unless asked for JSON.
+		w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+		_, _ = fmt.Fprintf(w, "access_token=%s&scope=read%%3Aorg&token_type=bearer", f.accessToken)
+		return
+	}
+
+	require.Equal(f.t, "Bearer "+f.accessToken, r.Header.Get("Authorization"))
+	require.Equal(f.t, "application/vnd.github+json", r.Header.Get("Accept"))
+	if f.statusCode != 0 {
+		http.Error(w, "fake error", f.statusCode)
+		return
+	}
+
+	var pages []string
+	switch r.URL.Path {
+	case "/api/v3/user":
+		_, _ = w.Write([]byte(f.user))
+		return
+	case "/api/v3/user/orgs":
+		pages = f.orgsPages
+	case "/api/v3/user/teams":
+		pages = f.teamsPages
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	require.Equal(f.t, "100", r.URL.Query().Get("per_page"))
+	page := 0
+	if p := r.URL.Query().Get("page"); p != "" {
+		_, err := fmt.Sscanf(p, "%d", &page)
+		require.NoError(f.t, err)
+	}
+	if page+1 < len(pages) {
+		next := *r.URL
+		next.Scheme, next.Host = "http", r.Host
+		q := next.Query()
+		q.Set("page", fmt.Sprintf("%d", page+1))
+		next.RawQuery = q.Encode()
+		if f.nextPageLinkPrefix != "" {
+			next.Scheme, next.Host = "", ""
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s>; rel="next"`, f.nextPageLinkPrefix, next.String()))
+			_, _ = w.Write([]byte(pages[page]))
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="last"`, next.String(), next.String()))
+	}
+	_, _ = w.Write([]byte(pages[page]))
+}
+
+func TestProviderConfig(t *testing.T) {
+	t.Run("getters get", func(t *testing.T) {
+		p := ProviderConfig{
+			Name:        "test-name",
+			ResourceUID: "test-uid",
+			Config: &oauth2.Config{
+				ClientID: "test-client-id",
+				Endpoint: Endpoint("github.example.com"),
+				Scopes:   []string{"read:user", "read:org"},
+			},
+		}
+		require.Equal(t, "test-name", p.GetName())
+		require.Equal(t, "test-uid", string(p.GetResourceUID()))
+		require.Equal(t, "test-client-id", p.GetClientID())
+		require.Equal(t, "https://github.example.com/login/oauth/authorize", p.GetAuthorizationURL().String())
+		require.Equal(t, []string{"read:user", "read:org"}, p.GetScopes())
+	})
+
+	t.Run("APIBaseURL", func(t *testing.T) {
+		u, err := APIBaseURL("github.com")
+		require.NoError(t, err)
+		require.Equal(t, "https://api.github.com", u.String())
+
+		u, err = APIBaseURL("github.example.com:8443")
+		require.NoError(t, err)
+		require.Equal(t, "https://github.example.com:8443/api/v3", u.String())
+	})
+}
+
+func TestTestConnection(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v3/meta", r.URL.Path)
+		require.Empty(t, r.Header.Get("Authorization"))
+		if !healthy {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+
+	apiBaseURL, err := url.Parse(server.URL + "/api/v3")
+	require.NoError(t, err)
+	p := ProviderConfig{APIBaseURL: apiBaseURL, Client: server.Client()}
+	require.NoError(t, p.TestConnection(context.Background()))
+
+	healthy = false
+	require.EqualError(t, p.TestConnection(context.Background()),
+		`unexpected status "502 Bad Gateway" from "`+server.URL+`/api/v3/meta"`)
+
+	server.Close()
+	err = p.TestConnection(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error making request to")
+}
+
+func TestExchangeAuthcode(t *testing.T) {
+	fake := &fakeGitHub{t: t, accessToken: "test-access-token"}
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(server.Close)
+
+	p := ProviderConfig{
+		Config: &oauth2.Config{
+			ClientID:     "test-client-id",
+			ClientSecret: "test-client-secret",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   server.URL + "/login/oauth/authorize",
+				TokenURL:  server.URL + "/login/oauth/access_token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+		Client: server.Client(),
+	}
+
+	pkceCode, err := pkce.Generate()
+	require.NoError(t, err)
+	token, err := p.ExchangeAuthcode(context.Background(), "test-authcode", pkceCode, "https://example.com/callback")
+	require.NoError(t, err)
+	require.Equal(t, "test-access-token", token)
+}
+
+func TestGetUser(t *testing.T) {
+	const (
+		happyUser  = `{"login": "some-login", "id": 1234, "name": "Some Name"}`
+		happyTeams = `[
+			{"name": "Team One", "slug": "team-one", "organization": {"login": "Org-1"}},
+			{"name": "Team Two", "slug": "team-two", "organization": {"login": "org-2"}}
+		]`
+	)
+
+	tests := []struct {
+		name               string
+		fake               fakeGitHub
+		usernameAttribute  v1alpha1.GitHubUsernameAttribute
+		groupNameAttribute v1alpha1.GitHubGroupNameAttribute
+		allowedOrgs        []string
+		wantUser           *provider.GitHubUser
+		wantErr            string
+		wantNotAllowed     bool
+	}{
+		{
+			name: "all users allowed, default username and group attributes",
+			fake: fakeGitHub{user: happyUser, teamsPages: []string{happyTeams}},
+			wantUser: &provider.GitHubUser{
+				Username:          "some-login:1234",
+				Groups:            []string{"Org-1/team-one", "org-2/team-two"},
+				DownstreamSubject: "SERVER_URL/api/v3?idpName=test-name&sub=1234",
+			},
+		},
+		{
+			name:               "username from login, group names from team names",
+			fake:               fakeGitHub{user: happyUser, teamsPages: []string{happyTeams}},
+			usernameAttribute:  v1alpha1.GitHubUsernameLogin,
+			groupNameAttribute: v1alpha1.GitHubUseTeamNameForGroupName,
+			wantUser: &provider.GitHubUser{
+				Username:          "some-login",
+				Groups:            []string{"Org-1/Team One", "org-2/Team Two"},
+				DownstreamSubject: "SERVER_URL/api/v3?idpName=test-name&sub=1234",
+			},
+		},
+		{
+			name:              "username from id",
+			fake:              fakeGitHub{user: happyUser, teamsPages: []string{`[]`}},
+			usernameAttribute: v1alpha1.GitHubUsernameID,
+			wantUser: &provider.GitHubUser{
+				Username:          "1234",
+				Groups:            []string{},
+				DownstreamSubject: "SERVER_URL/api/v3?idpName=test-name&sub=1234",
+			},
+		},
+		{
+			name: "allowed orgs are matched case-insensitively across pages, and groups are filtered to allowed orgs",
+			fake: fakeGitHub{
+				user:       happyUser,
+				orgsPages:  []string{`[{"login": "some-other-org"}]`, `[{"login": "org-1"}]`},
+				teamsPages: []string{happyTeams, `[{"name": "Team Three", "slug": "team-three", "organization": {"login": "org-1"}}]`},
+			},
+			allowedOrgs: []string{"ORG-1"},
+			wantUser: &provider.GitHubUser{
+				Username:          "some-login:1234",
+				Groups:            []string{"Org-1/team-one", "org-1/team-three"},
+				DownstreamSubject: "SERVER_URL/api/v3?idpName=test-name&sub=1234",
+			},
+		},
+		{
+			name: "user is not a member of any allowed org",
+			fake: fakeGitHub{
+				user:       happyUser,
+				orgsPages:  []string{`[{"login": "some-other-org"}]`},
+				teamsPages: []string{happyTeams},
+			},
+			allowedOrgs:    []string{"org-1"},
+			wantErr:        `user is not a member of any allowed GitHub organization: user "some-login"`,
+			wantNotAllowed: true,
+		},
+		{
+			name: "next page link points to another host",
+			fake: fakeGitHub{
+				user:               happyUser,
+				teamsPages:         []string{happyTeams, `[]`},
+				nextPageLinkPrefix: "https://attacker.example.com",
+			},
+			wantErr: `next page link from "user/teams" endpoint does not point to the GitHub API: "https://attacker.example.com/api/v3/user/teams?page=1&per_page=100"`,
+		},
+		{
+			name: "next page link uses another scheme",
+			fake: fakeGitHub{
+				user:               happyUser,
+				teamsPages:         []string{happyTeams, `[]`},
+				nextPageLinkPrefix: "ftp://SERVER_HOST",
+			},
+			wantErr: `next page link from "user/teams" endpoint does not point to the GitHub API: "ftp://SERVER_HOST/api/v3/user/teams?page=1&per_page=100"`,
+		},
+		{
+			name:    "user response is missing the ID",
+			fake:    fakeGitHub{user: `{"login": "some-login"}`},
+			wantErr: `response from "user" endpoint did not include both "login" and "id"`,
+		},
+		{
+			name:    "user response is not JSON",
+			fake:    fakeGitHub{user: `not-json`},
+			wantErr: `error decoding response from "user" endpoint: invalid character 'o' in literal null (expecting 'u')`,
+		},
+		{
+			name:    "access token was revoked",
+			fake:    fakeGitHub{statusCode: http.StatusUnauthorized},
+			wantErr: `unexpected response status from "user" endpoint: 401 Unauthorized`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fake := tt.fake
+			fake.t = t
+			fake.accessToken = "test-access-token"
+			server := httptest.NewServer(http.HandlerFunc(fake.serve))
+			t.Cleanup(server.Close)
+			serverHost := strings.TrimPrefix(server.URL, "http://")
+			fake.nextPageLinkPrefix = strings.ReplaceAll(fake.nextPageLinkPrefix, "SERVER_HOST", serverHost)
+
+			apiBaseURL, err := url.Parse(server.URL + "/api/v3")
+			require.NoError(t, err)
+
+			p := ProviderConfig{
+				Name:                 "test-name",
+				APIBaseURL:           apiBaseURL,
+				UsernameAttribute:    tt.usernameAttribute,
+				GroupNameAttribute:   tt.groupNameAttribute,
+				AllowedOrganizations: tt.allowedOrgs,
+				Client:               server.Client(),
+			}
+
+			user, err := p.GetUser(context.Background(), "test-access-token")
+			if tt.wantErr != "" {
+				require.EqualError(t, err, strings.ReplaceAll(tt.wantErr, "SERVER_HOST", serverHost))
+				require.Equal(t, tt.wantNotAllowed, errors.Is(err, provider.ErrGitHubUserNotAllowed))
+				require.Nil(t, user)
+				return
+			}
+			require.NoError(t, err)
+			tt.wantUser.DownstreamSubject = server.URL + tt.wantUser.DownstreamSubject[len("SERVER_URL"):]
+			require.Equal(t, tt.wantUser, user)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstreamhealth holds the reachability of the upstream identity providers of the Supervisor and the
+// readiness of its FederationDomains, and serves them on an HTTP health endpoint. Unlike /healthz, which only
+// tells whether the Supervisor process is alive, this endpoint lets load balancers and alerts notice when the
+// Supervisor is up but cannot reach an upstream identity provider.
+package upstreamhealth
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+// EndpointPath is the path of the health endpoint.
+const EndpointPath = "/healthz/upstreams"
+
+// UpstreamType is the type of an upstream identity provider.
+type UpstreamType string
+
+const (
+	UpstreamTypeOIDC            UpstreamType = "oidc"
+	UpstreamTypeLDAP            UpstreamType = "ldap"
+	UpstreamTypeActiveDirectory UpstreamType = "activedirectory"
+	UpstreamTypeGitHub          UpstreamType = "github"
+	UpstreamTypeSAML            UpstreamType = "saml"
+	UpstreamTypeCertificate     UpstreamType = "certificate"
+)
+
+// Reasons why a FederationDomain is not ready.
+const (
+	ReasonFederationDomainNotValid          = "FederationDomainNotValid"
+	ReasonNoUpstreamIdentityProviders       = "NoUpstreamIdentityProviders"
+	ReasonUpstreamIdentityProvidersNotReady = "UpstreamIdentityProvidersNotReady"
+)
+
+// UpstreamStatus is the reachability of a single upstream identity provider. The reason why an upstream could not
+// be reached is only logged, since the endpoint does not require authentication.
+type UpstreamStatus struct {
+	Name                string       `json:"name"`
+	Type                UpstreamType `json:"type"`
+	Ready               bool         `json:"ready"`
+	LastProbeTime       *time.Time   `json:"lastProbeTime,omitempty"`
+	ConsecutiveFailures int          `json:"consecutiveFailures,omitempty"`
+}
+
+// FederationDomainStatus is the readiness of a single FederationDomain. A FederationDomain is ready when it is
+// valid and all of the upstream identity providers are ready, since users may log in using any of them.
+type FederationDomainStatus struct {
+	Issuer string `json:"issuer"`
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Status is the response of the health endpoint.
+type Status struct {
+	Ready                     bool                     `json:"ready"`
+	UpstreamIdentityProviders []UpstreamStatus         `json:"upstreamIdentityProviders"`
+	FederationDomains         []FederationDomainStatus `json:"federationDomains"`
+}
+
+// NewStatus returns the Status of the upstreams and of the FederationDomains with the given issuers and validity.
+func NewStatus(upstreams []UpstreamStatus, federationDomainValidity map[string]bool) *Status {
+	upstreamsReady := true
+	for _, upstream := range upstreams {
+		upstreamsReady = upstreamsReady && upstream.Ready
+	}
+
+	status := &Status{
+		Ready:                     len(upstreams) > 0 && upstreamsReady,
+		UpstreamIdentityProviders: upstreams,
+		FederationDomains:         []FederationDomainStatus{},
+	}
+	if status.UpstreamIdentityProviders == nil {
+		status.UpstreamIdentityProviders = []UpstreamStatus{}
+	}
+	for issuer, valid := range federationDomainValidity {
+		federationDomain := FederationDomainStatus{Issuer: issuer}
+		switch {
+		case !valid:
+			federationDomain.Reason = ReasonFederationDomainNotValid
+		case len(upstreams) == 0:
+			federationDomain.Reason = ReasonNoUpstreamIdentityProviders
+		case !upstreamsReady:
+			federationDomain.Reason = ReasonUpstreamIdentityProvidersNotReady
+		default:
+			federationDomain.Ready = true
+		}
+		status.Ready = status.Ready && federationDomain.Ready
+		status.FederationDomains = append(status.FederationDomains, federationDomain)
+	}
+	sort.Slice(status.FederationDomains, func(i, j int) bool {
+		return status.FederationDomains[i].Issuer < status.FederationDomains[j].Issuer
+	})
+	return status
+}
+
+// Cache holds the most recent Status. It is safe for concurrent use.
+type Cache struct {
+	status atomic.Value
+}
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache { return &Cache{} }
+
+// Get returns the most recent Status, or nil when the upstreams have not been probed yet.
+func (c *Cache) Get() *Status {
+	status, _ := c.status.Load().(*Status)
+	return status
+}
+
+// Set replaces the most recent Status.
+func (c *Cache) Set(status *Status) {
+	c.status.Store(status)
+}
+
+// NewHandler returns the handler of the health endpoint. It responds with 200 when the Supervisor is ready and
+// with 503 otherwise, including before the upstreams have been probed for the first time. The response includes
+// the names of the upstreams and the issuers of the FederationDomains, so it should only be served to trusted clients.
+func NewHandler(cache *Cache) http.Handler {
+	return newHandler(cache, func(status *Status) interface{} { return status })
+}
+
+// NewSummaryHandler returns a handler of the health endpoint which responds with the same status codes as the
+// handler returned by NewHandler, but only tells whether the Supervisor is ready, so it may be served to anyone.
+func NewSummaryHandler(cache *Cache) http.Handler {
+	return newHandler(cache, func(status *Status) interface{} {
+		return struct {
+			Ready bool `json:"ready"`
+		}{Ready: status.Ready}
+	})
+}
+
+func newHandler(cache *Cache, response func(status *Status) interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := cache.Get()
+		if status == nil {
+			status = NewStatus(nil, nil)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		if status.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(response(status)); err != nil {
+			plog.WarningErr("error writing upstream health response", err)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamhealth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStatus(t *testing.T) {
+	ready := UpstreamStatus{Name: "ready", Type: UpstreamTypeLDAP, Ready: true}
+	notReady := UpstreamStatus{Name: "not-ready", Type: UpstreamTypeOIDC, ConsecutiveFailures: 2}
+
+	tests := []struct {
+		name                     string
+		upstreams                []UpstreamStatus
+		federationDomainValidity map[string]bool
+		wantStatus               *Status
+	}{
+		{
+			name: "nothing is configured",
+			wantStatus: &Status{
+				UpstreamIdentityProviders: []UpstreamStatus{},
+				FederationDomains:         []FederationDomainStatus{},
+			},
+		},
+		{
+			name:                     "all upstreams are ready",
+			upstreams:                []UpstreamStatus{ready},
+			federationDomainValidity: map[string]bool{"https://b.example.com": true, "https://a.example.com": true},
+			wantStatus: &Status{
+				Ready:                     true,
+				UpstreamIdentityProviders: []UpstreamStatus{ready},
+				FederationDomains: []FederationDomainStatus{
+					{Issuer: "https://a.example.com", Ready: true},
+					{Issuer: "https://b.example.com", Ready: true},
+				},
+			},
+		},
+		{
+			name:                     "an upstream is not ready",
+			upstreams:                []UpstreamStatus{ready, notReady},
+			federationDomainValidity: map[string]bool{"https://a.example.com": true},
+			wantStatus: &Status{
+				UpstreamIdentityProviders: []UpstreamStatus{ready, notReady},
+				FederationDomains: []FederationDomainStatus{
+					{Issuer: "https://a.example.com", Reason: ReasonUpstreamIdentityProvidersNotReady},
+				},
+			},
+		},
+		{
+			name:                     "federation domains are not valid or have no upstreams",
+			federationDomainValidity: map[string]bool{"https://a.example.com": false, "https://b.example.com": true},
+			wantStatus: &Status{
+				UpstreamIdentityProviders: []UpstreamStatus{},
+				FederationDomains: []FederationDomainStatus{
+					{Issuer: "https://a.example.com", Reason: ReasonFederationDomainNotValid},
+					{Issuer: "https://b.example.com", Reason: ReasonNoUpstreamIdentityProviders},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.wantStatus, NewStatus(tt.upstreams, tt.federationDomainValidity))
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	cache := NewCache()
+	handler := NewHandler(cache)
+	serve := func(method string) *httptest.ResponseRecorder {
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, httptest.NewRequest(method, EndpointPath, nil))
+		return rsp
+	}
+
+	// The upstreams have not been probed yet.
+	rsp := serve(http.MethodGet)
+	require.Equal(t, http.StatusServiceUnavailable, rsp.Code)
+	require.Equal(t, "application/json", rsp.Header().Get("Content-Type"))
+	require.Equal(t, "no-cache, no-store", rsp.Header().Get("Cache-Control"))
+	require.JSONEq(t, `{"ready":false,"upstreamIdentityProviders":[],"federationDomains":[]}`, rsp.Body.String())
+
+	lastProbeTime := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	cache.Set(NewStatus(
+		[]UpstreamStatus{{Name: "my-ldap", Type: UpstreamTypeLDAP, Ready: true, LastProbeTime: &lastProbeTime}},
+		map[string]bool{"https://a.example.com": true},
+	))
+	rsp = serve(http.MethodGet)
+	require.Equal(t, http.StatusOK, rsp.Code)
+	require.JSONEq(t, `{
+		"ready": true,
+		"upstreamIdentityProviders": [{"name":"my-ldap","type":"ldap","ready":true,"lastProbeTime":"2030-01-01T00:00:00Z"}],
+		"federationDomains": [{"issuer":"https://a.example.com","ready":true}]
+	}`, rsp.Body.String())
+
+	require.Equal(t, http.StatusOK, serve(http.MethodHead).Code)
+
+	rsp = serve(http.MethodPost)
+	require.Equal(t, http.StatusMethodNotAllowed, rsp.Code)
+	require.Equal(t, "GET, HEAD", rsp.Header().Get("Allow"))
+}
+
+func TestSummaryHandler(t *testing.T) {
+	cache := NewCache()
+	handler := NewSummaryHandler(cache)
+	serve := func(method string) *httptest.ResponseRecorder {
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, httptest.NewRequest(method, EndpointPath, nil))
+		return rsp
+	}
+
+	// The upstreams have not been probed yet.
+	rsp := serve(http.MethodGet)
+	require.Equal(t, http.StatusServiceUnavailable, rsp.Code)
+	require.Equal(t, "application/json", rsp.Header().Get("Content-Type"))
+	require.Equal(t, "no-cache, no-store", rsp.Header().Get("Cache-Control"))
+	require.JSONEq(t, `{"ready":false}`, rsp.Body.String())
+
+	// The names of the upstreams and the issuers of the FederationDomains are left out.
+	cache.Set(NewStatus(
+		[]UpstreamStatus{{Name: "my-ldap", Type: UpstreamTypeLDAP, Ready: true}},
+		map[string]bool{"https://a.example.com": true},
+	))
+	rsp = serve(http.MethodGet)
+	require.Equal(t, http.StatusOK, rsp.Code)
+	require.JSONEq(t, `{"ready":true}`, rsp.Body.String())
+
+	rsp = serve(http.MethodPost)
+	require.Equal(t, http.StatusMethodNotAllowed, rsp.Code)
+	require.Equal(t, "GET, HEAD", rsp.Header().Get("Allow"))
+}
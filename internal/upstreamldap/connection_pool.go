@@ -0,0 +1,145 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+const (
+	// defaultMaxIdleConnectionsPerKey is the maximum number of idle connections which will be kept for each
+	// combination of host, connection settings, and bind credentials.
+	defaultMaxIdleConnectionsPerKey = 10
+
+	// defaultIdleConnectionTimeout is how long an idle connection will be kept before it is closed. This should be
+	// shorter than the idle timeouts of typical LDAP servers, e.g. Active Directory's default MaxConnIdleTime is
+	// 15 minutes, so that the pool rarely holds connections which were already closed by the server.
+	defaultIdleConnectionTimeout = 2 * time.Minute
+
+	// defaultUnhealthyHostRetryInterval is how long a host which could not be dialed will be tried after
+	// all other hosts.
+	defaultUnhealthyHostRetryInterval = time.Minute
+)
+
+// ConnectionPool keeps idle connections which were already dialed and bound as the bind user so that they can be
+// reused by later requests, instead of dialing and binding a new connection for every request. It also remembers
+// which hosts recently could not be dialed, so that other hosts can be tried first.
+//
+// A ConnectionPool is safe for concurrent use. A single ConnectionPool may be shared by several Providers, including
+// the successive Providers which are created as an upstream's configuration changes, because connections are only
+// reused for the same host, connection protocol, CA bundle, and bind credentials. Idle connections are closed
+// lazily, the next time that the pool is used after their idle timeout has passed.
+type ConnectionPool struct {
+	clock                      clock.PassiveClock
+	maxIdleConnectionsPerKey   int
+	idleConnectionTimeout      time.Duration
+	unhealthyHostRetryInterval time.Duration
+
+	lock                 sync.Mutex
+	idleConnections      map[string][]*idleConnection
+	unhealthyHostsByTime map[string]time.Time
+}
+
+type idleConnection struct {
+	conn      Conn
+	idleSince time.Time
+}
+
+// NewConnectionPool creates an empty ConnectionPool.
+func NewConnectionPool() *ConnectionPool {
+	return newConnectionPool(clock.RealClock{})
+}
+
+func newConnectionPool(clock clock.PassiveClock) *ConnectionPool {
+	return &ConnectionPool{
+		clock:                      clock,
+		maxIdleConnectionsPerKey:   defaultMaxIdleConnectionsPerKey,
+		idleConnectionTimeout:      defaultIdleConnectionTimeout,
+		unhealthyHostRetryInterval: defaultUnhealthyHostRetryInterval,
+		idleConnections:            map[string][]*idleConnection{},
+		unhealthyHostsByTime:       map[string]time.Time{},
+	}
+}
+
+// take removes the most recently used idle connection for the key from the pool and returns it,
+// or returns nil when there are no idle connections for the key.
+func (cp *ConnectionPool) take(key string) Conn {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.closeExpiredConnectionsLocked()
+
+	idle := cp.idleConnections[key]
+	if len(idle) == 0 {
+		return nil
+	}
+	mostRecentlyUsed := idle[len(idle)-1]
+	cp.idleConnections[key] = idle[:len(idle)-1]
+	return mostRecentlyUsed.conn
+}
+
+// give adds a connection to the pool for reuse by a later call to take with the same key. The connection is
+// closed instead when the pool already has enough idle connections for the key.
+func (cp *ConnectionPool) give(key string, conn Conn) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.closeExpiredConnectionsLocked()
+
+	if len(cp.idleConnections[key]) >= cp.maxIdleConnectionsPerKey {
+		conn.Close()
+		return
+	}
+	cp.idleConnections[key] = append(cp.idleConnections[key], &idleConnection{conn: conn, idleSince: cp.clock.Now()})
+}
+
+// closeExpiredConnectionsLocked closes and removes the connections which have been idle for too long.
+// The caller must hold the lock.
+func (cp *ConnectionPool) closeExpiredConnectionsLocked() {
+	now := cp.clock.Now()
+	for key, idle := range cp.idleConnections {
+		// Connections are appended as they become idle, so they are ordered from least to most recently used.
+		expired := 0
+		for expired < len(idle) && now.Sub(idle[expired].idleSince) >= cp.idleConnectionTimeout {
+			idle[expired].conn.Close()
+			expired++
+		}
+		if expired == len(idle) {
+			delete(cp.idleConnections, key)
+			continue
+		}
+		cp.idleConnections[key] = idle[expired:]
+	}
+}
+
+// hostIsUnhealthy returns true when the host could not be dialed recently.
+func (cp *ConnectionPool) hostIsUnhealthy(host string) bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	failedAt, found := cp.unhealthyHostsByTime[host]
+	if !found {
+		return false
+	}
+	if cp.clock.Since(failedAt) >= cp.unhealthyHostRetryInterval {
+		delete(cp.unhealthyHostsByTime, host)
+		return false
+	}
+	return true
+}
+
+// setHostHealth records whether the host could be dialed.
+func (cp *ConnectionPool) setHostHealth(host string, healthy bool) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if healthy {
+		delete(cp.unhealthyHostsByTime, host)
+		return
+	}
+	cp.unhealthyHostsByTime[host] = cp.clock.Now()
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestConnectionPoolTakeAndGive(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	pool := newConnectionPool(fakeClock)
+
+	require.Nil(t, pool.take("key1"))
+
+	conn1 := mockldapconn.NewMockConn(ctrl)
+	conn2 := mockldapconn.NewMockConn(ctrl)
+	pool.give("key1", conn1)
+	pool.give("key1", conn2)
+
+	// Connections are only reused for the same key.
+	require.Nil(t, pool.take("key2"))
+
+	// The most recently used connection is taken first.
+	require.Same(t, conn2, pool.take("key1"))
+	require.Same(t, conn1, pool.take("key1"))
+	require.Nil(t, pool.take("key1"))
+}
+
+func TestConnectionPoolClosesConnectionsBeyondTheMaximum(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	pool := newConnectionPool(clocktesting.NewFakeClock(time.Now()))
+
+	for i := 0; i < defaultMaxIdleConnectionsPerKey; i++ {
+		pool.give("key1", mockldapconn.NewMockConn(ctrl))
+	}
+	extraConn := mockldapconn.NewMockConn(ctrl)
+	extraConn.EXPECT().Close().Times(1)
+	pool.give("key1", extraConn)
+
+	// Other keys have their own maximum.
+	pool.give("key2", mockldapconn.NewMockConn(ctrl))
+	require.Len(t, pool.idleConnections["key1"], defaultMaxIdleConnectionsPerKey)
+	require.Len(t, pool.idleConnections["key2"], 1)
+}
+
+func TestConnectionPoolClosesIdleConnectionsAfterTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	pool := newConnectionPool(fakeClock)
+
+	olderConn := mockldapconn.NewMockConn(ctrl)
+	pool.give("key1", olderConn)
+	fakeClock.Step(defaultIdleConnectionTimeout / 2)
+	newerConn := mockldapconn.NewMockConn(ctrl)
+	pool.give("key1", newerConn)
+	otherKeyConn := mockldapconn.NewMockConn(ctrl)
+	pool.give("key2", otherKeyConn)
+
+	// Only the oldest connection has reached its idle timeout. Expired connections are closed when any key is used.
+	fakeClock.Step(defaultIdleConnectionTimeout / 2)
+	olderConn.EXPECT().Close().Times(1)
+	require.Nil(t, pool.take("key3"))
+	require.Len(t, pool.idleConnections["key1"], 1)
+	require.Len(t, pool.idleConnections["key2"], 1)
+
+	fakeClock.Step(defaultIdleConnectionTimeout / 2)
+	newerConn.EXPECT().Close().Times(1)
+	otherKeyConn.EXPECT().Close().Times(1)
+	require.Nil(t, pool.take("key1"))
+	require.Empty(t, pool.idleConnections)
+}
+
+func TestConnectionPoolHostHealth(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	pool := newConnectionPool(fakeClock)
+
+	require.False(t, pool.hostIsUnhealthy("host1"))
+
+	pool.setHostHealth("host1", false)
+	require.True(t, pool.hostIsUnhealthy("host1"))
+	require.False(t, pool.hostIsUnhealthy("host2"))
+
+	// Marking the host as healthy forgets the failure.
+	pool.setHostHealth("host1", true)
+	require.False(t, pool.hostIsUnhealthy("host1"))
+
+	// The failure is forgotten after the retry interval.
+	pool.setHostHealth("host1", false)
+	fakeClock.Step(defaultUnhealthyHostRetryInterval - time.Second)
+	require.True(t, pool.hostIsUnhealthy("host1"))
+	fakeClock.Step(time.Second)
+	require.False(t, pool.hostIsUnhealthy("host1"))
+}
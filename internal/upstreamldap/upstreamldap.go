@@ -6,19 +6,24 @@ package upstreamldap
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/go-ldap/ldap/v3"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/utils/trace"
 
@@ -28,6 +33,7 @@ import (
 	"go.pinniped.dev/internal/oidc/downstreamsession"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/totp"
 )
 
 const (
@@ -37,12 +43,55 @@ const (
 	groupSearchPageSize                     = uint32(250)
 	defaultLDAPPort                         = uint16(389)
 	defaultLDAPSPort                        = uint16(636)
+
+	// ldapMatchingRuleInChainOID is the Active Directory LDAP_MATCHING_RULE_IN_CHAIN extensible matching rule, which
+	// walks the chain of ancestry of an attribute's values. See
+	// https://docs.microsoft.com/en-us/windows/win32/adsi/search-filter-syntax.
+	ldapMatchingRuleInChainOID = "1.2.840.113556.1.4.1941"
+
+	// maxNestedGroupSearchDepth is the maximum number of levels of group memberships, including the user's direct
+	// group memberships, which will be searched when using NestedGroupSearchRecursive.
+	maxNestedGroupSearchDepth = 10
 )
 
+// groupSearchFilterMemberAssertionRegexp matches the equality assertions in a group search filter which compare an
+// attribute to the interpolation marker, e.g. "member={}".
+var groupSearchFilterMemberAssertionRegexp = regexp.MustCompile(`([A-Za-z][A-Za-z0-9-]*)=\{\}`)
+
+// activeDirectoryBindErrorDataRegexp matches the extended error code in the diagnostic message of an Active Directory
+// bind failure, e.g. "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 775, v3839".
+var activeDirectoryBindErrorDataRegexp = regexp.MustCompile(`\bdata ([0-9a-fA-F]+),`)
+
+// activeDirectoryBindErrorAccountStates maps the Active Directory extended error codes of bind failures to the
+// corresponding account states. See https://ldapwiki.com/wiki/Common%20Active%20Directory%20Bind%20Errors.
+// Other codes, e.g. 52e for invalid credentials, are treated as a bad username or password.
+var activeDirectoryBindErrorAccountStates = map[string]authenticators.AccountStateReason{
+	"530": authenticators.AccountStateLoginNotPermitted, // not permitted to log on at this time
+	"531": authenticators.AccountStateLoginNotPermitted, // not permitted to log on at this workstation
+	"532": authenticators.AccountStatePasswordExpired,
+	"533": authenticators.AccountStateAccountDisabled,
+	"701": authenticators.AccountStateAccountExpired,
+	"773": authenticators.AccountStatePasswordMustChange,
+	"775": authenticators.AccountStateAccountLocked,
+}
+
+// passwordPolicyErrorAccountStates maps the error codes of the password policy response control to the corresponding
+// account states. See https://tools.ietf.org/html/draft-behera-ldap-password-policy-10#section-6.2.
+// The other error codes are only returned for password modifications.
+var passwordPolicyErrorAccountStates = map[int8]authenticators.AccountStateReason{
+	0: authenticators.AccountStatePasswordExpired,    // passwordExpired
+	1: authenticators.AccountStateAccountLocked,      // accountLocked
+	2: authenticators.AccountStatePasswordMustChange, // changeAfterReset
+}
+
 // Conn abstracts the upstream LDAP communication protocol (mostly for testing).
 type Conn interface {
 	Bind(username, password string) error
 
+	ExternalBind() error
+
+	SimpleBind(simpleBindRequest *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error)
+
 	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
 
 	SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
@@ -88,18 +137,32 @@ type ProviderConfig struct {
 	// the default LDAP port will be used.
 	Host string
 
+	// FailoverHosts are the hostnames or "hostname:port" of other LDAP servers which serve the same directory as
+	// the Host. They will be tried in order when the Host cannot be dialed. Can be empty.
+	FailoverHosts []string
+
 	// ConnectionProtocol determines how to establish the connection to the server. Either StartTLS or TLS.
 	ConnectionProtocol LDAPConnectionProtocol
 
 	// PEM-encoded CA cert bundle to trust when connecting to the LDAP server. Can be nil.
 	CABundle []byte
 
-	// BindUsername is the username to use when performing a bind with the upstream LDAP IDP.
+	// BindUsername is the username to use when performing a bind with the upstream LDAP IDP. When a
+	// BindCertificate is used instead of a BindPassword, this is the subject of the certificate, which is
+	// only used to describe the bind account in messages.
 	BindUsername string
 
 	// BindPassword is the password to use when performing a bind with the upstream LDAP IDP.
 	BindPassword string
 
+	// BindCertificate is the PEM-encoded client certificate to present when dialing the upstream LDAP IDP.
+	// When it is not empty, a SASL EXTERNAL bind will be performed instead of a simple bind using the BindUsername
+	// and BindPassword, so that the upstream LDAP IDP determines the bind account from the client certificate.
+	BindCertificate []byte
+
+	// BindPrivateKey is the PEM-encoded private key of the BindCertificate.
+	BindPrivateKey []byte
+
 	// UserSearch contains information about how to search for users in the upstream LDAP IDP.
 	UserSearch UserSearchConfig
 
@@ -109,6 +172,10 @@ type ProviderConfig struct {
 	// Dialer exists to enable testing. When nil, will use a default appropriate for production use.
 	Dialer LDAPDialer
 
+	// ConnectionPool is used to reuse connections across requests and to remember which hosts could not
+	// be dialed recently. When nil, a new connection will be dialed for every request.
+	ConnectionPool *ConnectionPool
+
 	// UIDAttributeParsingOverrides are mappings between an attribute name and a way to parse it as a UID when
 	// it comes out of LDAP.
 	UIDAttributeParsingOverrides map[string]func(*ldap.Entry) (string, error)
@@ -119,6 +186,9 @@ type ProviderConfig struct {
 
 	// RefreshAttributeChecks are extra checks that attributes in a refresh response are as expected.
 	RefreshAttributeChecks map[string]func(*ldap.Entry, provider.StoredRefreshAttributes) error
+
+	// TOTPMode determines whether users must also provide a TOTP code after their password.
+	TOTPMode totp.Mode
 }
 
 // UserSearchConfig contains information about how to search for users in the upstream LDAP IDP.
@@ -150,8 +220,29 @@ type GroupSearchConfig struct {
 	// GroupNameAttribute is the attribute in the LDAP group entry from which the group name should be
 	// retrieved. Empty means to use 'cn'.
 	GroupNameAttribute string
+
+	// NestedGroupSearch controls whether the groups of which the user is an indirect member should also be found.
+	// Empty means to only find the groups which are found by the Filter.
+	NestedGroupSearch NestedGroupSearchMode
 }
 
+// NestedGroupSearchMode controls how the group search finds the groups of which the user is an indirect member,
+// i.e. the groups which contain another group of which the user is a member.
+type NestedGroupSearchMode string
+
+const (
+	// NestedGroupSearchDisabled means that the group search is performed exactly as configured by the Filter.
+	NestedGroupSearchDisabled NestedGroupSearchMode = ""
+
+	// NestedGroupSearchMatchingRuleInChain means that each assertion in the Filter which compares an attribute to
+	// the user's DN will use Active Directory's LDAP_MATCHING_RULE_IN_CHAIN, so the server finds the nested groups.
+	NestedGroupSearchMatchingRuleInChain NestedGroupSearchMode = "MatchingRuleInChain"
+
+	// NestedGroupSearchRecursive means that the group search is repeated using the DN of each group which was found,
+	// up to maxNestedGroupSearchDepth levels, which works for any LDAP server.
+	NestedGroupSearchRecursive NestedGroupSearchMode = "Recursive"
+)
+
 type Provider struct {
 	c ProviderConfig
 }
@@ -170,87 +261,197 @@ func (p *Provider) GetConfig() ProviderConfig {
 	return p.c
 }
 
-func (p *Provider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) error {
+func (p *Provider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) ([]string, error) {
 	t := trace.FromContext(ctx).Nest("slow ldap refresh attempt", trace.Field{Key: "providerName", Value: p.GetName()})
 	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
-	userDN := storedRefreshAttributes.DN
 
-	searchResult, err := p.performRefresh(ctx, userDN)
+	groups, err := p.performRefresh(ctx, storedRefreshAttributes)
 	if err != nil {
 		p.traceRefreshFailure(t, err)
-		return err
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (p *Provider) performRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) ([]string, error) {
+	userDN := storedRefreshAttributes.DN
+
+	conn, releaseConn, err := p.dialAndBind(ctx, "before user search")
+	if err != nil {
+		return nil, err
+	}
+	defer releaseConn()
+
+	searchResult, err := conn.Search(p.refreshUserSearchRequest(userDN))
+	if err != nil {
+		return nil, fmt.Errorf(`error searching for user %q: %w`, userDN, err)
 	}
 
 	// if any more or less than one entry, error.
 	// we don't need to worry about logging this because we know it's a dn.
 	if len(searchResult.Entries) != 1 {
-		return fmt.Errorf(`searching for user %q resulted in %d search results, but expected 1 result`,
+		return nil, fmt.Errorf(`searching for user %q resulted in %d search results, but expected 1 result`,
 			userDN, len(searchResult.Entries),
 		)
 	}
 
 	userEntry := searchResult.Entries[0]
 	if len(userEntry.DN) == 0 {
-		return fmt.Errorf(`searching for user with original DN %q resulted in search result without DN`, userDN)
+		return nil, fmt.Errorf(`searching for user with original DN %q resulted in search result without DN`, userDN)
 	}
 
 	newUsername, err := p.getSearchResultAttributeValue(p.c.UserSearch.UsernameAttribute, userEntry, userDN)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if newUsername != storedRefreshAttributes.Username {
-		return fmt.Errorf(`searching for user %q returned a different username than the previous value. expected: %q, actual: %q`,
+		return nil, fmt.Errorf(`searching for user %q returned a different username than the previous value. expected: %q, actual: %q`,
 			userDN, storedRefreshAttributes.Username, newUsername,
 		)
 	}
 
 	newUID, err := p.getSearchResultAttributeRawValueEncoded(p.c.UserSearch.UIDAttribute, userEntry, userDN)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	newSubject := downstreamsession.DownstreamLDAPSubject(newUID, *p.GetURL())
 	if newSubject != storedRefreshAttributes.Subject {
-		return fmt.Errorf(`searching for user %q produced a different subject than the previous value. expected: %q, actual: %q`, userDN, storedRefreshAttributes.Subject, newSubject)
+		return nil, fmt.Errorf(`searching for user %q produced a different subject than the previous value. expected: %q, actual: %q`, userDN, storedRefreshAttributes.Subject, newSubject)
 	}
 	for attribute, validateFunc := range p.c.RefreshAttributeChecks {
 		err = validateFunc(userEntry, storedRefreshAttributes)
 		if err != nil {
-			return fmt.Errorf(`validation for attribute %q failed during upstream refresh: %w`, attribute, err)
+			return nil, fmt.Errorf(`validation for attribute %q failed during upstream refresh: %w`, attribute, err)
 		}
 	}
-	// we checked that the user still exists and their information is the same, so just return.
-	return nil
+
+	// We checked that the user still exists and their information is the same, so now find their current group
+	// memberships in the same way as during login, so that removals from groups take effect upon refresh.
+	var mappedGroupNames []string
+	if len(p.c.GroupSearch.Base) > 0 {
+		mappedGroupNames, err = p.searchGroupsForUserDN(conn, userEntry.DN)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(mappedGroupNames)
+
+	return mappedGroupNames, nil
 }
 
-func (p *Provider) performRefresh(ctx context.Context, userDN string) (*ldap.SearchResult, error) {
-	search := p.refreshUserSearchRequest(userDN)
+// dialAndBind returns a connection to the first host which can be dialed, which is already bound as the BindUsername,
+// along with a func which must be called to release the connection when the caller is finished using it. Hosts are
+// tried in the order returned by hostsInDialOrder, and an idle connection from the ConnectionPool is preferred over
+// dialing a new connection. The bindErrorContext describes the reason for the bind in error messages.
+func (p *Provider) dialAndBind(ctx context.Context, bindErrorContext string) (Conn, func(), error) {
+	var dialErrs []error
+	for _, host := range p.hostsInDialOrder() {
+		if conn := p.takeIdleConnection(host); conn != nil {
+			// Bind again because the connection may have been used to bind as an end user, which also
+			// confirms that the server did not close the connection while it was idle.
+			if err := p.bindAsServiceAccount(conn); err == nil {
+				return conn, p.releaseConnectionFunc(host, conn), nil
+			}
+			plog.Debug("discarding idle LDAP connection which could not be bound", "upstreamName", p.GetName(), "host", host)
+			conn.Close()
+		}
 
-	conn, err := p.dial(ctx)
-	if err != nil {
-		return nil, fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
+		conn, err := p.dialHost(ctx, host)
+		if err != nil {
+			p.setHostHealth(host, false)
+			dialErrs = append(dialErrs, fmt.Errorf(`error dialing host %q: %w`, host, err))
+			continue
+		}
+		p.setHostHealth(host, true)
+
+		err = p.bindAsServiceAccount(conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf(`error binding as %q %s: %w`, p.c.BindUsername, bindErrorContext, err)
+		}
+		return conn, p.releaseConnectionFunc(host, conn), nil
 	}
-	defer conn.Close()
 
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
-	if err != nil {
-		return nil, fmt.Errorf(`error binding as %q before user search: %w`, p.c.BindUsername, err)
+	if len(dialErrs) == 1 {
+		return nil, nil, dialErrs[0]
 	}
+	return nil, nil, utilerrors.NewAggregate(dialErrs)
+}
 
-	searchResult, err := conn.Search(search)
+// bindAsServiceAccount binds the connection as the bind account, using a SASL EXTERNAL bind when there is a
+// BindCertificate, since the certificate was already presented during the TLS handshake, or a simple bind otherwise.
+func (p *Provider) bindAsServiceAccount(conn Conn) error {
+	if len(p.c.BindCertificate) > 0 {
+		return conn.ExternalBind()
+	}
+	return conn.Bind(p.c.BindUsername, p.c.BindPassword)
+}
 
-	if err != nil {
-		return nil, fmt.Errorf(`error searching for user %q: %w`, userDN, err)
+// hostsInDialOrder returns the Host followed by the FailoverHosts, except that any hosts which recently could not
+// be dialed are moved to the end, so that a host which is down does not slow down every request.
+func (p *Provider) hostsInDialOrder() []string {
+	allHosts := append([]string{p.c.Host}, p.c.FailoverHosts...)
+	if p.c.ConnectionPool == nil {
+		return allHosts
+	}
+	healthyHosts := make([]string, 0, len(allHosts))
+	var unhealthyHosts []string
+	for _, host := range allHosts {
+		if p.c.ConnectionPool.hostIsUnhealthy(host) {
+			unhealthyHosts = append(unhealthyHosts, host)
+			continue
+		}
+		healthyHosts = append(healthyHosts, host)
+	}
+	return append(healthyHosts, unhealthyHosts...)
+}
+
+func (p *Provider) setHostHealth(host string, healthy bool) {
+	if p.c.ConnectionPool != nil {
+		p.c.ConnectionPool.setHostHealth(host, healthy)
+	}
+}
+
+func (p *Provider) takeIdleConnection(host string) Conn {
+	if p.c.ConnectionPool == nil {
+		return nil
 	}
-	return searchResult, nil
+	return p.c.ConnectionPool.take(p.connectionPoolKey(host))
 }
 
-func (p *Provider) dial(ctx context.Context) (Conn, error) {
-	tlsAddr, err := endpointaddr.Parse(p.c.Host, defaultLDAPSPort)
+// releaseConnectionFunc returns a func which gives the connection back to the ConnectionPool, or closes it
+// when there is no ConnectionPool.
+func (p *Provider) releaseConnectionFunc(host string, conn Conn) func() {
+	if p.c.ConnectionPool == nil {
+		return conn.Close
+	}
+	key := p.connectionPoolKey(host)
+	return func() {
+		p.c.ConnectionPool.give(key, conn)
+	}
+}
+
+// connectionPoolKey returns a key which is unique for every combination of settings which affect how a connection
+// to the host is established and bound, so that connections are never reused with different settings.
+func (p *Provider) connectionPoolKey(host string) string {
+	h := sha256.New()
+	for _, value := range []string{
+		host, string(p.c.ConnectionProtocol), string(p.c.CABundle),
+		p.c.BindUsername, p.c.BindPassword, string(p.c.BindCertificate), string(p.c.BindPrivateKey),
+	} {
+		_, _ = h.Write([]byte(value))
+		_, _ = h.Write([]byte{0}) // separator, so that different values cannot produce the same key
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (p *Provider) dialHost(ctx context.Context, host string) (Conn, error) {
+	tlsAddr, err := endpointaddr.Parse(host, defaultLDAPSPort)
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
 
-	startTLSAddr, err := endpointaddr.Parse(p.c.Host, defaultLDAPPort)
+	startTLSAddr, err := endpointaddr.Parse(host, defaultLDAPPort)
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
@@ -336,7 +537,15 @@ func (p *Provider) tlsConfig() (*tls.Config, error) {
 			return nil, fmt.Errorf("could not parse CA bundle")
 		}
 	}
-	return ptls.DefaultLDAP(rootCAs), nil
+	tlsConfig := ptls.DefaultLDAP(rootCAs)
+	if len(p.c.BindCertificate) > 0 {
+		clientCert, err := tls.X509KeyPair(p.c.BindCertificate, p.c.BindPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse bind certificate and private key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	return tlsConfig, nil
 }
 
 // A name for this upstream provider.
@@ -348,6 +557,11 @@ func (p *Provider) GetResourceUID() types.UID {
 	return p.c.ResourceUID
 }
 
+// Whether users must also provide a TOTP code after their password.
+func (p *Provider) GetTOTPMode() totp.Mode {
+	return p.c.TOTPMode
+}
+
 // Return a URL which uniquely identifies this LDAP provider, e.g. "ldaps://host.example.com:1234?base=user-search-base".
 // This URL is not used for connecting to the provider, but rather is used for creating a globally unique user
 // identifier by being combined with the user's UID, since user UIDs are only unique within one provider.
@@ -360,20 +574,21 @@ func (p *Provider) GetURL() *url.URL {
 }
 
 // TestConnection provides a method for testing the connection and bind settings. It performs a dial and bind
-// and returns any errors that we encountered.
+// and returns any errors that we encountered. It always dials a new connection to the Host, without using the
+// FailoverHosts or the ConnectionPool.
 func (p *Provider) TestConnection(ctx context.Context) error {
 	err := p.validateConfig()
 	if err != nil {
 		return err
 	}
 
-	conn, err := p.dial(ctx)
+	conn, err := p.dialHost(ctx, p.c.Host)
 	if err != nil {
 		return fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
 	}
 	defer conn.Close()
 
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
+	err = p.bindAsServiceAccount(conn)
 	if err != nil {
 		return fmt.Errorf(`error binding as %q: %w`, p.c.BindUsername, err)
 	}
@@ -396,11 +611,56 @@ func (p *Provider) DryRunAuthenticateUser(ctx context.Context, username string)
 // Authenticate an end user and return their mapped username, groups, and UID. Implements authenticators.UserAuthenticator.
 func (p *Provider) AuthenticateUser(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
 	endUserBindFunc := func(conn Conn, foundUserDN string) error {
-		return conn.Bind(foundUserDN, password)
+		return bindAsEndUser(conn, foundUserDN, password)
 	}
 	return p.authenticateUserImpl(ctx, username, endUserBindFunc)
 }
 
+// bindAsEndUser performs a simple bind as the end user. It requests the password policy response control, so that
+// when the bind fails because of the state of the user's account, an *authenticators.AccountStateError can be returned.
+func bindAsEndUser(conn Conn, userDN, password string) error {
+	result, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+		Username: userDN,
+		Password: password,
+		Controls: []ldap.Control{ldap.NewControlBeheraPasswordPolicy()},
+	})
+	if err == nil {
+		return nil
+	}
+	if reason, found := accountStateFromBindFailure(result, err); found {
+		return &authenticators.AccountStateError{Reason: reason, Err: err}
+	}
+	return err
+}
+
+// accountStateFromBindFailure determines whether a bind failed because of the state of the user's account, using
+// either the password policy response control, which is supported by OpenLDAP and other directory servers, or the
+// extended error code in the diagnostic message of an Active Directory bind failure.
+func accountStateFromBindFailure(result *ldap.SimpleBindResult, err error) (authenticators.AccountStateReason, bool) {
+	if result != nil {
+		for _, control := range result.Controls {
+			passwordPolicy, ok := control.(*ldap.ControlBeheraPasswordPolicy)
+			if !ok {
+				continue
+			}
+			if reason, found := passwordPolicyErrorAccountStates[passwordPolicy.Error]; found {
+				return reason, true
+			}
+		}
+	}
+
+	ldapErr := &ldap.Error{}
+	if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials && ldapErr.Err != nil {
+		if matches := activeDirectoryBindErrorDataRegexp.FindStringSubmatch(ldapErr.Err.Error()); matches != nil {
+			if reason, found := activeDirectoryBindErrorAccountStates[strings.ToLower(matches[1])]; found {
+				return reason, true
+			}
+		}
+	}
+
+	return "", false
+}
+
 func (p *Provider) authenticateUserImpl(ctx context.Context, username string, bindFunc func(conn Conn, foundUserDN string) error) (*authenticators.Response, bool, error) {
 	t := trace.FromContext(ctx).Nest("slow ldap authenticate user attempt", trace.Field{Key: "providerName", Value: p.GetName()})
 	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
@@ -417,18 +677,12 @@ func (p *Provider) authenticateUserImpl(ctx context.Context, username string, bi
 		return nil, false, nil
 	}
 
-	conn, err := p.dial(ctx)
-	if err != nil {
-		p.traceAuthFailure(t, err)
-		return nil, false, fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
-	}
-	defer conn.Close()
-
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
+	conn, releaseConn, err := p.dialAndBind(ctx, "before user search")
 	if err != nil {
 		p.traceAuthFailure(t, err)
-		return nil, false, fmt.Errorf(`error binding as %q before user search: %w`, p.c.BindUsername, err)
+		return nil, false, err
 	}
+	defer releaseConn()
 
 	response, err := p.searchAndBindUser(conn, username, bindFunc)
 	if err != nil {
@@ -445,9 +699,16 @@ func (p *Provider) authenticateUserImpl(ctx context.Context, username string, bi
 }
 
 func (p *Provider) searchGroupsForUserDN(conn Conn, userDN string) ([]string, error) {
-	searchResult, err := conn.SearchWithPaging(p.groupSearchRequest(userDN), groupSearchPageSize)
+	groupEntries, err := p.searchGroupEntriesForMemberDN(conn, userDN, userDN)
 	if err != nil {
-		return nil, fmt.Errorf(`error searching for group memberships for user with DN %q: %w`, userDN, err)
+		return nil, err
+	}
+
+	if p.c.GroupSearch.NestedGroupSearch == NestedGroupSearchRecursive {
+		groupEntries, err = p.searchNestedGroupEntries(conn, userDN, groupEntries)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	groupAttributeName := p.c.GroupSearch.GroupNameAttribute
@@ -457,10 +718,7 @@ func (p *Provider) searchGroupsForUserDN(conn Conn, userDN string) ([]string, er
 
 	var groups []string
 entries:
-	for _, groupEntry := range searchResult.Entries {
-		if len(groupEntry.DN) == 0 {
-			return nil, fmt.Errorf(`searching for group memberships for user with DN %q resulted in search result without DN`, userDN)
-		}
+	for _, groupEntry := range groupEntries {
 		if overrideFunc := p.c.GroupAttributeParsingOverrides[groupAttributeName]; overrideFunc != nil {
 			overrideGroupName, err := overrideFunc(groupEntry)
 			if err != nil {
@@ -480,6 +738,61 @@ entries:
 	return groups, nil
 }
 
+// searchGroupEntriesForMemberDN finds the groups which have the given member, which is either the user or,
+// when searching for nested groups, one of the user's groups. The userDN is only used in error messages.
+func (p *Provider) searchGroupEntriesForMemberDN(conn Conn, memberDN string, userDN string) ([]*ldap.Entry, error) {
+	searchResult, err := conn.SearchWithPaging(p.groupSearchRequest(memberDN), groupSearchPageSize)
+	if err != nil {
+		return nil, fmt.Errorf(`error searching for group memberships for user with DN %q: %w`, userDN, err)
+	}
+
+	for _, groupEntry := range searchResult.Entries {
+		if len(groupEntry.DN) == 0 {
+			return nil, fmt.Errorf(`searching for group memberships for user with DN %q resulted in search result without DN`, userDN)
+		}
+	}
+
+	return searchResult.Entries, nil
+}
+
+// searchNestedGroupEntries repeats the group search for each newly found group to find the groups which contain it,
+// until no more new groups are found or until maxNestedGroupSearchDepth levels have been searched. Each group is only
+// searched once, so group memberships which form a cycle cannot cause an infinite loop. Returns the direct group
+// entries followed by all the nested group entries.
+func (p *Provider) searchNestedGroupEntries(conn Conn, userDN string, directGroupEntries []*ldap.Entry) ([]*ldap.Entry, error) {
+	allGroupEntries := []*ldap.Entry{}
+	foundGroupDNs := sets.NewString()
+	addNewGroupEntries := func(groupEntries []*ldap.Entry) []*ldap.Entry {
+		var newGroupEntries []*ldap.Entry
+		for _, groupEntry := range groupEntries {
+			// DNs are case-insensitive.
+			normalizedDN := strings.ToLower(groupEntry.DN)
+			if foundGroupDNs.Has(normalizedDN) {
+				continue
+			}
+			foundGroupDNs.Insert(normalizedDN)
+			newGroupEntries = append(newGroupEntries, groupEntry)
+		}
+		allGroupEntries = append(allGroupEntries, newGroupEntries...)
+		return newGroupEntries
+	}
+
+	groupEntriesToSearch := addNewGroupEntries(directGroupEntries)
+	for depth := 1; depth < maxNestedGroupSearchDepth && len(groupEntriesToSearch) > 0; depth++ {
+		var parentGroupEntries []*ldap.Entry
+		for _, groupEntry := range groupEntriesToSearch {
+			entries, err := p.searchGroupEntriesForMemberDN(conn, groupEntry.DN, userDN)
+			if err != nil {
+				return nil, err
+			}
+			parentGroupEntries = append(parentGroupEntries, entries...)
+		}
+		groupEntriesToSearch = addNewGroupEntries(parentGroupEntries)
+	}
+
+	return allGroupEntries, nil
+}
+
 func (p *Provider) validateConfig() error {
 	if p.c.UserSearch.UsernameAttribute == distinguishedNameAttributeName && len(p.c.UserSearch.Filter) == 0 {
 		// LDAP search filters do not allow searching by DN, so we would have no reasonable default for Filter.
@@ -492,18 +805,12 @@ func (p *Provider) SearchForDefaultNamingContext(ctx context.Context) (string, e
 	t := trace.FromContext(ctx).Nest("slow ldap attempt when searching for default naming context", trace.Field{Key: "providerName", Value: p.GetName()})
 	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
 
-	conn, err := p.dial(ctx)
+	conn, releaseConn, err := p.dialAndBind(ctx, "before querying for defaultNamingContext")
 	if err != nil {
 		p.traceSearchBaseDiscoveryFailure(t, err)
-		return "", fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
-	}
-	defer conn.Close()
-
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
-	if err != nil {
-		p.traceSearchBaseDiscoveryFailure(t, err)
-		return "", fmt.Errorf(`error binding as %q before querying for defaultNamingContext: %w`, p.c.BindUsername, err)
+		return "", err
 	}
+	defer releaseConn()
 
 	searchResult, err := conn.Search(p.defaultNamingContextRequest())
 	if err != nil {
@@ -590,6 +897,10 @@ func (p *Provider) searchAndBindUser(conn Conn, username string, bindFunc func(c
 	if err != nil {
 		plog.DebugErr("error binding for user (if this is not the expected dn for this username, please check the user search configuration)",
 			err, "upstreamName", p.GetName(), "username", username, "dn", userEntry.DN)
+		accountStateErr := &authenticators.AccountStateError{}
+		if errors.As(err, &accountStateErr) {
+			return nil, accountStateErr
+		}
 		ldapErr := &ldap.Error{}
 		if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials {
 			return nil, nil
@@ -644,7 +955,7 @@ func (p *Provider) userSearchRequest(username string) *ldap.SearchRequest {
 	}
 }
 
-func (p *Provider) groupSearchRequest(userDN string) *ldap.SearchRequest {
+func (p *Provider) groupSearchRequest(memberDN string) *ldap.SearchRequest {
 	// See https://ldap.com/the-ldap-search-operation for general documentation of LDAP search options.
 	return &ldap.SearchRequest{
 		BaseDN:       p.c.GroupSearch.Base,
@@ -653,7 +964,7 @@ func (p *Provider) groupSearchRequest(userDN string) *ldap.SearchRequest {
 		SizeLimit:    0, // unlimited size because we will search with paging
 		TimeLimit:    90,
 		TypesOnly:    false,
-		Filter:       p.groupSearchFilter(userDN),
+		Filter:       p.groupSearchFilter(memberDN),
 		Attributes:   p.groupSearchRequestedAttributes(),
 		Controls:     nil, // nil because ldap.SearchWithPaging() will set the appropriate controls for us
 	}
@@ -707,11 +1018,19 @@ func (p *Provider) userSearchFilter(username string) string {
 	return interpolateSearchFilter(p.c.UserSearch.Filter, safeUsername)
 }
 
-func (p *Provider) groupSearchFilter(userDN string) string {
-	if len(p.c.GroupSearch.Filter) == 0 {
-		return fmt.Sprintf("(member=%s)", userDN)
+func (p *Provider) groupSearchFilter(memberDN string) string {
+	filterFormat := p.c.GroupSearch.Filter
+	if len(filterFormat) == 0 {
+		filterFormat = "member=" + searchFilterInterpolationLocationMarker
+	}
+	if p.c.GroupSearch.NestedGroupSearch == NestedGroupSearchMatchingRuleInChain {
+		// Rewrite the filter before interpolating the DN, so that only the filter itself is changed.
+		// Assertions which already use an extensible matching rule, e.g. "member:1.2.840.113556.1.4.1941:={}",
+		// are not matched by the regexp, so they are left unchanged.
+		filterFormat = groupSearchFilterMemberAssertionRegexp.ReplaceAllString(filterFormat,
+			"${1}:"+ldapMatchingRuleInChainOID+":="+searchFilterInterpolationLocationMarker)
 	}
-	return interpolateSearchFilter(p.c.GroupSearch.Filter, userDN)
+	return interpolateSearchFilter(filterFormat, memberDN)
 }
 
 func interpolateSearchFilter(filterFormat, valueToInterpolateIntoFilter string) string {
@@ -20,6 +20,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
 	"k8s.io/apiserver/pkg/authentication/user"
+	clocktesting "k8s.io/utils/clock/testing"
 
 	"go.pinniped.dev/internal/authenticators"
 	"go.pinniped.dev/internal/certauthority"
@@ -154,6 +155,13 @@ func TestEndUserAuthentication(t *testing.T) {
 		Controls:  []ldap.Control{},
 	}
 
+	// The end user bind requests the password policy response control.
+	expectedEndUserBind := &ldap.SimpleBindRequest{
+		Username: testUserSearchResultDNValue,
+		Password: testUpstreamPassword,
+		Controls: []ldap.Control{ldap.NewControlBeheraPasswordPolicy()},
+	}
+
 	// The auth response which matches the exampleUserSearchResult and exampleGroupSearchResult.
 	expectedAuthResponse := func(editFunc func(r *authenticators.Response)) *authenticators.Response {
 		u := &user.DefaultInfo{
@@ -180,6 +188,7 @@ func TestEndUserAuthentication(t *testing.T) {
 		wantToSkipDial             bool
 		wantAuthResponse           *authenticators.Response
 		wantUnauthenticated        bool
+		wantAccountState           authenticators.AccountStateReason
 		skipDryRunAuthenticateUser bool // tests about when the end user bind fails don't make sense for DryRunAuthenticateUser()
 	}{
 		{
@@ -195,7 +204,28 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when there is a bind certificate, it performs a SASL EXTERNAL bind instead of binding with a password",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.BindPassword = ""
+				p.BindCertificate = []byte("some-bind-certificate") // only parsed by the production dialer
+				p.BindPrivateKey = []byte("some-bind-private-key")
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().ExternalBind().Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
@@ -214,7 +244,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
@@ -233,7 +263,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
@@ -250,7 +280,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
 				info := r.User.(*user.DefaultInfo)
@@ -283,7 +313,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
 				info := r.User.(*user.DefaultInfo)
@@ -316,7 +346,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
 				info := r.User.(*user.DefaultInfo)
@@ -340,13 +370,164 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
 				info := r.User.(*user.DefaultInfo)
 				info.Groups = []string{testGroupSearchResultDNValue1, testGroupSearchResultDNValue2}
 			}),
 		},
+		{
+			name:     "when nested group search uses the matching rule in chain, the member assertions in the group search filter use it",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.Filter = "&(objectClass=group)(|(member={})(uniqueMember={})(member:1.2.840.113556.1.4.1941:={}))"
+				p.GroupSearch.NestedGroupSearch = NestedGroupSearchMatchingRuleInChain
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Filter = fmt.Sprintf("(&(objectClass=group)(|(member:1.2.840.113556.1.4.1941:=%s)(uniqueMember:1.2.840.113556.1.4.1941:=%s)(member:1.2.840.113556.1.4.1941:=%s)))",
+						testUserSearchResultDNValue, testUserSearchResultDNValue, testUserSearchResultDNValue)
+				}), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when nested group search uses the matching rule in chain and the group search filter is blank",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.Filter = ""
+				p.GroupSearch.NestedGroupSearch = NestedGroupSearchMatchingRuleInChain
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Filter = "(member:1.2.840.113556.1.4.1941:=" + testUserSearchResultDNValue + ")"
+				}), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when nested group search is recursive, it finds the groups of the user's groups and stops when the memberships form a cycle",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.Filter = "member={}"
+				p.GroupSearch.GroupNameAttribute = "dn"
+				p.GroupSearch.NestedGroupSearch = NestedGroupSearchRecursive
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				groupSearchForMember := func(memberDN string) *ldap.SearchRequest {
+					return expectedGroupSearch(func(r *ldap.SearchRequest) {
+						r.Filter = "(member=" + memberDN + ")"
+						r.Attributes = []string{}
+					})
+				}
+				groupSearchResult := func(groupDNs ...string) *ldap.SearchResult {
+					result := &ldap.SearchResult{}
+					for _, groupDN := range groupDNs {
+						result.Entries = append(result.Entries, &ldap.Entry{DN: groupDN})
+					}
+					return result
+				}
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(groupSearchForMember(testUserSearchResultDNValue), expectedGroupSearchPageSize).
+					Return(groupSearchResult("cn=z-direct-group"), nil).Times(1)
+				conn.EXPECT().SearchWithPaging(groupSearchForMember("cn=z-direct-group"), expectedGroupSearchPageSize).
+					Return(groupSearchResult("cn=parent-group", "cn=other-parent-group"), nil).Times(1)
+				conn.EXPECT().SearchWithPaging(groupSearchForMember("cn=parent-group"), expectedGroupSearchPageSize).
+					Return(groupSearchResult("cn=grandparent-group"), nil).Times(1)
+				conn.EXPECT().SearchWithPaging(groupSearchForMember("cn=other-parent-group"), expectedGroupSearchPageSize).
+					Return(groupSearchResult("CN=Grandparent-Group"), nil).Times(1) // DNs are case-insensitive
+				conn.EXPECT().SearchWithPaging(groupSearchForMember("cn=grandparent-group"), expectedGroupSearchPageSize).
+					Return(groupSearchResult("cn=z-direct-group"), nil).Times(1) // a cycle
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				info := r.User.(*user.DefaultInfo)
+				info.Groups = []string{"cn=grandparent-group", "cn=other-parent-group", "cn=parent-group", "cn=z-direct-group"}
+			}),
+		},
+		{
+			name:     "when nested group search is recursive, it stops searching after the maximum depth",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.Filter = "member={}"
+				p.GroupSearch.GroupNameAttribute = "dn"
+				p.GroupSearch.NestedGroupSearch = NestedGroupSearchRecursive
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				memberDN := testUserSearchResultDNValue
+				for i := 1; i <= 10; i++ {
+					groupDN := fmt.Sprintf("cn=group-at-depth-%02d", i)
+					conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+						r.Filter = "(member=" + memberDN + ")"
+						r.Attributes = []string{}
+					}), expectedGroupSearchPageSize).
+						Return(&ldap.SearchResult{Entries: []*ldap.Entry{{DN: groupDN}}}, nil).Times(1)
+					memberDN = groupDN
+				}
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				info := r.User.(*user.DefaultInfo)
+				info.Groups = []string{}
+				for i := 1; i <= 10; i++ {
+					info.Groups = append(info.Groups, fmt.Sprintf("cn=group-at-depth-%02d", i))
+				}
+			}),
+		},
+		{
+			name:     "when nested group search is recursive and a nested group search fails",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.Filter = "member={}"
+				p.GroupSearch.GroupNameAttribute = "dn"
+				p.GroupSearch.NestedGroupSearch = NestedGroupSearchRecursive
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Filter = "(member=" + testUserSearchResultDNValue + ")"
+					r.Attributes = []string{}
+				}), expectedGroupSearchPageSize).
+					Return(&ldap.SearchResult{Entries: []*ldap.Entry{{DN: "cn=direct-group"}}}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Filter = "(member=cn=direct-group)"
+					r.Attributes = []string{}
+				}), expectedGroupSearchPageSize).
+					Return(nil, errors.New("some nested group search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for group memberships for user with DN %q: some nested group search error`, testUserSearchResultDNValue),
+		},
 		{
 			name:     "when the GroupNameAttribute is dn",
 			username: testUpstreamUsername,
@@ -364,7 +545,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
 				info := r.User.(*user.DefaultInfo)
@@ -405,7 +586,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
@@ -426,7 +607,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
@@ -447,7 +628,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
@@ -466,7 +647,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
@@ -506,7 +687,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: &authenticators.Response{
 				User: &user.DefaultInfo{
@@ -550,7 +731,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, nil).Times(1)
 			},
 			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
 				r.ExtraRefreshAttributes = map[string]string{"some-attribute-to-check-during-refresh": "c29tZS1hdHRyaWJ1dGUtdmFsdWU"}
@@ -971,7 +1152,7 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Return(errors.New("some bind error")).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(nil, errors.New("some bind error")).Times(1)
 			},
 			skipDryRunAuthenticateUser: true,
 			wantError:                  fmt.Sprintf(`error binding for user "%s" using provided password against DN "%s": some bind error`, testUpstreamUsername, testUserSearchResultDNValue),
@@ -995,7 +1176,124 @@ func TestEndUserAuthentication(t *testing.T) {
 					Err:        errors.New("some bind error"),
 					ResultCode: ldap.LDAPResultInvalidCredentials,
 				}
-				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Return(err).Times(1)
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, err).Times(1)
+			},
+		},
+		{
+			name:           "when binding as the found user fails with a password policy response control error",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantAccountState:           authenticators.AccountStatePasswordExpired,
+			skipDryRunAuthenticateUser: true,
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				err := &ldap.Error{
+					Err:        errors.New("some bind error"),
+					ResultCode: ldap.LDAPResultInvalidCredentials,
+				}
+				passwordPolicy := ldap.NewControlBeheraPasswordPolicy()
+				passwordPolicy.Error = 0
+				passwordPolicy.ErrorString = "Password expired"
+				result := &ldap.SimpleBindResult{Controls: []ldap.Control{passwordPolicy}}
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(result, err).Times(1)
+			},
+		},
+		{
+			name:           "when binding as the found user fails with a password policy response control which only has a warning",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantUnauthenticated:        true,
+			skipDryRunAuthenticateUser: true,
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				err := &ldap.Error{
+					Err:        errors.New("some bind error"),
+					ResultCode: ldap.LDAPResultInvalidCredentials,
+				}
+				passwordPolicy := ldap.NewControlBeheraPasswordPolicy()
+				passwordPolicy.Grace = 2
+				result := &ldap.SimpleBindResult{Controls: []ldap.Control{passwordPolicy}}
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(result, err).Times(1)
+			},
+		},
+		{
+			name:           "when binding as the found user fails with an Active Directory account locked error",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantAccountState:           authenticators.AccountStateAccountLocked,
+			skipDryRunAuthenticateUser: true,
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				err := &ldap.Error{
+					Err:        errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 775, v3839"),
+					ResultCode: ldap.LDAPResultInvalidCredentials,
+				}
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, err).Times(1)
+			},
+		},
+		{
+			name:           "when binding as the found user fails with an Active Directory password must change error",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantAccountState:           authenticators.AccountStatePasswordMustChange,
+			skipDryRunAuthenticateUser: true,
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				err := &ldap.Error{
+					Err:        errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 773, v3839"),
+					ResultCode: ldap.LDAPResultInvalidCredentials,
+				}
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, err).Times(1)
+			},
+		},
+		{
+			name:           "when binding as the found user fails with an Active Directory invalid credentials error",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantUnauthenticated:        true,
+			skipDryRunAuthenticateUser: true,
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				err := &ldap.Error{
+					Err:        errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 52e, v3839"),
+					ResultCode: ldap.LDAPResultInvalidCredentials,
+				}
+				conn.EXPECT().SimpleBind(expectedEndUserBind).Return(&ldap.SimpleBindResult{}, err).Times(1)
 			},
 		},
 		{
@@ -1037,6 +1335,12 @@ func TestEndUserAuthentication(t *testing.T) {
 			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), tt.username, tt.password)
 			require.Equal(t, !tt.wantToSkipDial, dialWasAttempted)
 			switch {
+			case tt.wantAccountState != "":
+				accountStateErr := &authenticators.AccountStateError{}
+				require.True(t, errors.As(err, &accountStateErr))
+				require.Equal(t, tt.wantAccountState, accountStateErr.Reason)
+				require.False(t, authenticated)
+				require.Nil(t, authResponse)
 			case tt.wantError != "":
 				require.EqualError(t, err, tt.wantError)
 				require.False(t, authenticated)
@@ -1140,12 +1444,35 @@ func TestUpstreamRefresh(t *testing.T) {
 		},
 	}
 
+	providerConfigWithGroupSearch := *providerConfig
+	providerConfigWithGroupSearch.GroupSearch = GroupSearchConfig{
+		Base:               testGroupSearchBase,
+		Filter:             testGroupSearchFilter,
+		GroupNameAttribute: testGroupSearchGroupNameAttribute,
+	}
+
+	providerConfigWithNestedGroupSearch := providerConfigWithGroupSearch
+	providerConfigWithNestedGroupSearch.GroupSearch.NestedGroupSearch = NestedGroupSearchRecursive
+
+	expectedGroupSearch := &ldap.SearchRequest{
+		BaseDN:       testGroupSearchBase,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    0, // unlimited size because we will search with paging
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       testGroupSearchFilterInterpolated,
+		Attributes:   []string{testGroupSearchGroupNameAttribute},
+		Controls:     nil, // nil because ldap.SearchWithPaging() will set the appropriate controls for us
+	}
+
 	tests := []struct {
 		name           string
 		providerConfig *ProviderConfig
 		setupMocks     func(conn *mockldapconn.MockConn)
 		dialError      error
 		wantErr        string
+		wantGroups     []string
 	}{
 		{
 			name:           "happy path where searching the dn returns a single entry",
@@ -1156,6 +1483,89 @@ func TestUpstreamRefresh(t *testing.T) {
 				conn.EXPECT().Close().Times(1)
 			},
 		},
+		{
+			name:           "happy path where group search is configured returns the user's current groups, sorted",
+			providerConfig: &providerConfigWithGroupSearch,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch, expectedGroupSearchPageSize).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testGroupSearchResultDNValue2,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue2}),
+							},
+						},
+						{
+							DN: testGroupSearchResultDNValue1,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
+		},
+		{
+			name:           "happy path where group search is configured and the user no longer belongs to any groups",
+			providerConfig: &providerConfigWithGroupSearch,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch, expectedGroupSearchPageSize).Return(&ldap.SearchResult{}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: nil,
+		},
+		{
+			name:           "happy path where recursive nested group search is configured returns the user's current direct and nested groups",
+			providerConfig: &providerConfigWithNestedGroupSearch,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch, expectedGroupSearchPageSize).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testGroupSearchResultDNValue1,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
+							},
+						},
+					},
+				}, nil).Times(1)
+				nestedGroupSearch := *expectedGroupSearch
+				nestedGroupSearch.Filter = fmt.Sprintf("(some-group-filter=%s-and-more-filter=%s)", testGroupSearchResultDNValue1, testGroupSearchResultDNValue1)
+				conn.EXPECT().SearchWithPaging(&nestedGroupSearch, expectedGroupSearchPageSize).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testGroupSearchResultDNValue2,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue2}),
+							},
+						},
+					},
+				}, nil).Times(1)
+				nestedNestedGroupSearch := *expectedGroupSearch
+				nestedNestedGroupSearch.Filter = fmt.Sprintf("(some-group-filter=%s-and-more-filter=%s)", testGroupSearchResultDNValue2, testGroupSearchResultDNValue2)
+				conn.EXPECT().SearchWithPaging(&nestedNestedGroupSearch, expectedGroupSearchPageSize).Return(&ldap.SearchResult{}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
+		},
+		{
+			name:           "error where the group search fails",
+			providerConfig: &providerConfigWithGroupSearch,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch, expectedGroupSearchPageSize).Return(nil, errors.New("some group search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: `error searching for group memberships for user with DN "some-upstream-user-dn": some group search error`,
+		},
 		{
 			name:           "error where dial fails",
 			providerConfig: providerConfig,
@@ -1435,9 +1845,9 @@ func TestUpstreamRefresh(t *testing.T) {
 			}
 
 			dialWasAttempted := false
-			providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+			tt.providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
 				dialWasAttempted = true
-				require.Equal(t, providerConfig.Host, addr.Endpoint())
+				require.Equal(t, tt.providerConfig.Host, addr.Endpoint())
 				if tt.dialError != nil {
 					return nil, tt.dialError
 				}
@@ -1446,9 +1856,9 @@ func TestUpstreamRefresh(t *testing.T) {
 			})
 
 			initialPwdLastSetEncoded := base64.RawURLEncoding.EncodeToString([]byte("132801740800000000"))
-			ldapProvider := New(*providerConfig)
+			ldapProvider := New(*tt.providerConfig)
 			subject := "ldaps://ldap.example.com:8443?base=some-upstream-user-base-dn&sub=c29tZS11cHN0cmVhbS11aWQtdmFsdWU"
-			err := ldapProvider.PerformRefresh(context.Background(), provider.StoredRefreshAttributes{
+			groups, err := ldapProvider.PerformRefresh(context.Background(), provider.StoredRefreshAttributes{
 				Username:             testUserSearchResultUsernameAttributeValue,
 				Subject:              subject,
 				DN:                   testUserSearchResultDNValue,
@@ -1457,8 +1867,10 @@ func TestUpstreamRefresh(t *testing.T) {
 			if tt.wantErr != "" {
 				require.Error(t, err)
 				require.Equal(t, tt.wantErr, err.Error())
+				require.Nil(t, groups)
 			} else {
 				require.NoError(t, err)
+				require.Equal(t, tt.wantGroups, groups)
 			}
 			require.Equal(t, true, dialWasAttempted)
 		})
@@ -1513,6 +1925,31 @@ func TestTestConnection(t *testing.T) {
 			},
 			wantError: fmt.Sprintf(`error binding as "%s": some bind error`, testBindUsername),
 		},
+		{
+			name: "happy path with a bind certificate",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.BindPassword = ""
+				p.BindCertificate = []byte("some-bind-certificate") // only parsed by the production dialer
+				p.BindPrivateKey = []byte("some-bind-private-key")
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().ExternalBind().Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name: "when the SASL EXTERNAL bind returns an error",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.BindPassword = ""
+				p.BindCertificate = []byte("some-bind-certificate") // only parsed by the production dialer
+				p.BindPrivateKey = []byte("some-bind-private-key")
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().ExternalBind().Return(errors.New("some bind error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error binding as "%s": some bind error`, testBindUsername),
+		},
 		{
 			name: "when the config is invalid",
 			providerConfig: providerConfig(func(p *ProviderConfig) {
@@ -1561,6 +1998,228 @@ func TestTestConnection(t *testing.T) {
 	}
 }
 
+func TestFailoverHostsAndConnectionPool(t *testing.T) {
+	const (
+		testFailoverHost1 = "ldap-failover1.example.com:8443"
+		testFailoverHost2 = "ldap-failover2.example.com:8443"
+	)
+
+	expectSearchForDefaultNamingContext := func(conn *mockldapconn.MockConn) {
+		conn.EXPECT().Search(gomock.Any()).Return(&ldap.SearchResult{
+			Entries: []*ldap.Entry{
+				{
+					DN: "",
+					Attributes: []*ldap.EntryAttribute{
+						ldap.NewEntryAttribute("defaultNamingContext", []string{"dc=example,dc=com"}),
+					},
+				},
+			},
+		}, nil).Times(1)
+	}
+
+	type dialer struct {
+		dialedHosts  []string
+		connsByHost  map[string]Conn
+		errorsByHost map[string]error
+	}
+	newProvider := func(d *dialer, pool *ConnectionPool) *Provider {
+		return New(ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               testHost,
+			FailoverHosts:      []string{testFailoverHost1, testFailoverHost2},
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			ConnectionPool:     pool,
+			Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				d.dialedHosts = append(d.dialedHosts, addr.Endpoint())
+				if err := d.errorsByHost[addr.Endpoint()]; err != nil {
+					return nil, err
+				}
+				return d.connsByHost[addr.Endpoint()], nil
+			}),
+		})
+	}
+
+	t.Run("without a connection pool, the hosts are tried in order until one can be dialed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		conn := mockldapconn.NewMockConn(ctrl)
+		conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(2)
+		expectSearchForDefaultNamingContext(conn)
+		expectSearchForDefaultNamingContext(conn)
+		conn.EXPECT().Close().Times(2)
+
+		d := &dialer{
+			connsByHost:  map[string]Conn{testFailoverHost1: conn},
+			errorsByHost: map[string]error{testHost: errors.New("some dial error")},
+		}
+		p := newProvider(d, nil)
+
+		for i := 0; i < 2; i++ {
+			_, err := p.SearchForDefaultNamingContext(context.Background())
+			require.NoError(t, err)
+		}
+		// Without a pool, there is nowhere to remember that the first host is down.
+		require.Equal(t, []string{testHost, testFailoverHost1, testHost, testFailoverHost1}, d.dialedHosts)
+	})
+
+	t.Run("when no hosts can be dialed, all the errors are returned", func(t *testing.T) {
+		d := &dialer{
+			errorsByHost: map[string]error{
+				testHost:          errors.New("some dial error"),
+				testFailoverHost1: errors.New("some other dial error"),
+				testFailoverHost2: errors.New("yet another dial error"),
+			},
+		}
+		p := newProvider(d, NewConnectionPool())
+
+		_, err := p.SearchForDefaultNamingContext(context.Background())
+		require.EqualError(t, err, `[`+
+			`error dialing host "ldap.example.com:8443": some dial error, `+
+			`error dialing host "ldap-failover1.example.com:8443": some other dial error, `+
+			`error dialing host "ldap-failover2.example.com:8443": yet another dial error]`)
+		require.Equal(t, []string{testHost, testFailoverHost1, testFailoverHost2}, d.dialedHosts)
+	})
+
+	t.Run("when binding fails, the other hosts are not tried", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		conn := mockldapconn.NewMockConn(ctrl)
+		conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1)
+		conn.EXPECT().Close().Times(1)
+
+		d := &dialer{connsByHost: map[string]Conn{testHost: conn}}
+		p := newProvider(d, NewConnectionPool())
+
+		_, err := p.SearchForDefaultNamingContext(context.Background())
+		require.EqualError(t, err, fmt.Sprintf(`error binding as %q before querying for defaultNamingContext: some bind error`, testBindUsername))
+		require.Equal(t, []string{testHost}, d.dialedHosts)
+	})
+
+	t.Run("with a connection pool, connections are reused and bound again when reused", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		conn := mockldapconn.NewMockConn(ctrl)
+		conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(3)
+		expectSearchForDefaultNamingContext(conn)
+		expectSearchForDefaultNamingContext(conn)
+		expectSearchForDefaultNamingContext(conn)
+
+		d := &dialer{connsByHost: map[string]Conn{testHost: conn}}
+		pool := NewConnectionPool()
+		p := newProvider(d, pool)
+
+		for i := 0; i < 3; i++ {
+			_, err := p.SearchForDefaultNamingContext(context.Background())
+			require.NoError(t, err)
+		}
+		require.Equal(t, []string{testHost}, d.dialedHosts)
+
+		// A Provider with different bind credentials does not reuse the connection.
+		otherConn := mockldapconn.NewMockConn(ctrl)
+		otherConn.EXPECT().Bind(testBindUsername, "some-other-password").Times(1)
+		expectSearchForDefaultNamingContext(otherConn)
+		otherD := &dialer{connsByHost: map[string]Conn{testHost: otherConn}}
+		otherConfig := newProvider(otherD, pool).GetConfig()
+		otherConfig.BindPassword = "some-other-password"
+		_, err := New(otherConfig).SearchForDefaultNamingContext(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{testHost}, otherD.dialedHosts)
+	})
+
+	t.Run("with a connection pool, an idle connection which cannot be bound again is replaced by a new connection", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		staleConn := mockldapconn.NewMockConn(ctrl)
+		staleConn.EXPECT().Bind(testBindUsername, testBindPassword).Return(ldap.NewError(ldap.ErrorNetwork, errors.New("connection closed"))).Times(1)
+		staleConn.EXPECT().Close().Times(1)
+
+		newConn := mockldapconn.NewMockConn(ctrl)
+		newConn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+		expectSearchForDefaultNamingContext(newConn)
+
+		d := &dialer{connsByHost: map[string]Conn{testHost: newConn}}
+		pool := NewConnectionPool()
+		p := newProvider(d, pool)
+		pool.give(p.connectionPoolKey(testHost), staleConn)
+
+		_, err := p.SearchForDefaultNamingContext(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{testHost}, d.dialedHosts)
+	})
+
+	t.Run("with a connection pool, hosts which recently could not be dialed are tried last", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		failoverConn1 := mockldapconn.NewMockConn(ctrl)
+		failoverConn1.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+		failoverConn1.EXPECT().Search(gomock.Any()).Return(nil, errors.New("some search error")).Times(1)
+		failoverConn1.EXPECT().Close().Times(1) // closed by the test after it removes the connection from the pool
+
+		failoverConn2 := mockldapconn.NewMockConn(ctrl)
+		failoverConn2.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+		expectSearchForDefaultNamingContext(failoverConn2)
+
+		d := &dialer{
+			connsByHost: map[string]Conn{testFailoverHost1: failoverConn1, testFailoverHost2: failoverConn2},
+			errorsByHost: map[string]error{
+				testHost: errors.New("some dial error"),
+			},
+		}
+		fakeClock := clocktesting.NewFakeClock(time.Now())
+		pool := newConnectionPool(fakeClock)
+		p := newProvider(d, pool)
+
+		_, err := p.SearchForDefaultNamingContext(context.Background())
+		require.EqualError(t, err, "error querying RootDSE for defaultNamingContext: some search error")
+		require.Equal(t, []string{testHost, testFailoverHost1}, d.dialedHosts)
+
+		// Take the idle connection out of the pool so that the next request must dial. Now the first failover host
+		// also cannot be dialed, so the second failover host should be tried before retrying the unhealthy first host.
+		pool.take(p.connectionPoolKey(testFailoverHost1)).Close()
+		d.errorsByHost[testFailoverHost1] = errors.New("some other dial error")
+		d.dialedHosts = nil
+
+		_, err = p.SearchForDefaultNamingContext(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []string{testFailoverHost1, testFailoverHost2}, d.dialedHosts)
+		require.Equal(t, []string{testFailoverHost2, testHost, testFailoverHost1}, p.hostsInDialOrder())
+
+		// After the retry interval, the unhealthy hosts are tried in their configured order again.
+		fakeClock.Step(defaultUnhealthyHostRetryInterval)
+		require.Equal(t, []string{testHost, testFailoverHost1, testFailoverHost2}, p.hostsInDialOrder())
+	})
+}
+
+func TestTLSConfigWithBindCertificate(t *testing.T) {
+	ca, err := certauthority.New("test CA", time.Minute)
+	require.NoError(t, err)
+	certPEM, keyPEM, err := ca.IssueClientCertPEM("some-bind-user", nil, time.Minute)
+	require.NoError(t, err)
+	_, otherKeyPEM, err := ca.IssueClientCertPEM("some-other-user", nil, time.Minute)
+	require.NoError(t, err)
+
+	tlsConfig, err := New(ProviderConfig{}).tlsConfig()
+	require.NoError(t, err)
+	require.Empty(t, tlsConfig.Certificates)
+
+	tlsConfig, err = New(ProviderConfig{BindCertificate: certPEM, BindPrivateKey: keyPEM}).tlsConfig()
+	require.NoError(t, err)
+	require.Len(t, tlsConfig.Certificates, 1)
+	expectedCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	require.Equal(t, expectedCert.Certificate, tlsConfig.Certificates[0].Certificate)
+
+	_, err = New(ProviderConfig{BindCertificate: certPEM, BindPrivateKey: otherKeyPEM}).tlsConfig()
+	require.EqualError(t, err, "could not parse bind certificate and private key: tls: private key does not match public key")
+}
+
 func TestGetConfig(t *testing.T) {
 	c := ProviderConfig{
 		Name:         "original-provider-name",
@@ -1737,7 +2396,7 @@ func TestRealTLSDialing(t *testing.T) {
 				ConnectionProtocol: tt.connProto,
 				Dialer:             nil, // this test is for the default (production) TLS dialer
 			})
-			conn, err := provider.dial(tt.context)
+			conn, err := provider.dialHost(tt.context, tt.host)
 			if conn != nil {
 				defer conn.Close()
 			}
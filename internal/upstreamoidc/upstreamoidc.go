@@ -24,6 +24,7 @@ import (
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/totp"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
@@ -43,6 +44,7 @@ type ProviderConfig struct {
 	Client                   *http.Client
 	AllowPasswordGrant       bool
 	AdditionalAuthcodeParams map[string]string
+	TOTPMode                 totp.Mode
 	RevocationURL            *url.URL // will commonly be nil: many providers do not offer this
 	Provider                 interface {
 		Verifier(*coreosoidc.Config) *coreosoidc.IDTokenVerifier
@@ -74,6 +76,36 @@ func (p *ProviderConfig) HasUserInfoURL() bool {
 	return len(providerJSON.UserInfoURL) > 0
 }
 
+// TestConnection checks whether the upstream provider is reachable by fetching its discovery document.
+func (p *ProviderConfig) TestConnection(ctx context.Context) error {
+	providerJSON := &struct {
+		Issuer string `json:"issuer"`
+	}{}
+	if err := p.Provider.Claims(providerJSON); err != nil {
+		return fmt.Errorf("could not read issuer of upstream provider: %w", err)
+	}
+
+	discoveryURL := strings.TrimSuffix(providerJSON.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return fmt.Errorf("could not build discovery request: %w", err)
+	}
+	httpClient := p.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching discovery document %q: %w", discoveryURL, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q fetching discovery document %q", resp.Status, discoveryURL)
+	}
+	return nil
+}
+
 func (p *ProviderConfig) GetAdditionalAuthcodeParams() map[string]string {
 	return p.AdditionalAuthcodeParams
 }
@@ -107,6 +139,10 @@ func (p *ProviderConfig) AllowsPasswordGrant() bool {
 	return p.AllowPasswordGrant
 }
 
+func (p *ProviderConfig) GetTOTPMode() totp.Mode {
+	return p.TOTPMode
+}
+
 func (p *ProviderConfig) PasswordCredentialsGrantAndValidateTokens(ctx context.Context, username, password string) (*oidctypes.Token, error) {
 	// Disallow this grant when requested.
 	if !p.AllowPasswordGrant {
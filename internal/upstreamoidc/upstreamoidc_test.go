@@ -70,6 +70,39 @@ func TestProviderConfig(t *testing.T) {
 		require.False(t, p.HasUserInfoURL())
 	})
 
+	t.Run("TestConnection", func(t *testing.T) {
+		healthy := true
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/some/issuer/.well-known/openid-configuration", r.URL.Path)
+			if !healthy {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(`{}`))
+		}))
+		t.Cleanup(server.Close)
+
+		p := ProviderConfig{
+			Client:   server.Client(),
+			Provider: &mockProvider{rawClaims: []byte(`{"issuer": "` + server.URL + `/some/issuer/"}`)},
+		}
+		require.NoError(t, p.TestConnection(context.Background()))
+
+		healthy = false
+		require.EqualError(t, p.TestConnection(context.Background()),
+			`unexpected status "502 Bad Gateway" fetching discovery document "`+server.URL+`/some/issuer/.well-known/openid-configuration"`)
+
+		server.Close()
+		err := p.TestConnection(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "error fetching discovery document")
+
+		p.Provider = &mockProvider{rawClaims: []byte(`{`)}
+		err = p.TestConnection(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "could not read issuer of upstream provider")
+	})
+
 	const (
 		// Test JWTs generated with https://smallstep.com/docs/cli/crypto/jwt/:
 
@@ -0,0 +1,170 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstreamsaml implements an abstraction of upstream SAML identity provider interactions.
+package upstreamsaml
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/crewjam/saml"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+// ProviderConfig holds the active configuration of an upstream SAML identity provider.
+type ProviderConfig struct {
+	Name        string
+	ResourceUID types.UID
+
+	// Metadata is the parsed metadata of the identity provider, which includes its entity ID, its single sign-on
+	// endpoints, and the certificates which it uses to sign its responses.
+	Metadata *saml.EntityDescriptor
+
+	// UsernameAttribute is the name of the assertion attribute which holds the username. When empty, the NameID
+	// of the assertion's subject is used.
+	UsernameAttribute string
+
+	// GroupsAttribute is the name of the assertion attribute which holds the group names. When empty, no groups
+	// are returned.
+	GroupsAttribute string
+}
+
+var _ provider.UpstreamSAMLIdentityProviderI = (*ProviderConfig)(nil)
+
+func (p *ProviderConfig) GetName() string {
+	return p.Name
+}
+
+func (p *ProviderConfig) GetResourceUID() types.UID {
+	return p.ResourceUID
+}
+
+// TestConnection checks whether users can be sent to the identity provider. The Supervisor never connects to a
+// SAML identity provider itself, since the browser carries both the requests and the responses, so this only checks
+// that the metadata is still valid and includes a single sign-on service which the Supervisor can use.
+func (p *ProviderConfig) TestConnection(_ context.Context) error {
+	if !p.Metadata.ValidUntil.IsZero() && time.Now().After(p.Metadata.ValidUntil) {
+		return fmt.Errorf("identity provider metadata expired at %s", p.Metadata.ValidUntil.UTC().Format(time.RFC3339))
+	}
+	serviceProvider := &saml.ServiceProvider{IDPMetadata: p.Metadata}
+	if serviceProvider.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return fmt.Errorf("identity provider metadata does not include a single sign-on service with the HTTP-Redirect binding")
+	}
+	return nil
+}
+
+func (p *ProviderConfig) AuthnRequestURL(sp provider.SAMLServiceProvider, requestID string, relayState string) (*url.URL, error) {
+	serviceProvider := p.serviceProvider(sp)
+	ssoURL := serviceProvider.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if ssoURL == "" {
+		return nil, fmt.Errorf("identity provider metadata does not include a single sign-on service with the HTTP-Redirect binding")
+	}
+
+	req, err := serviceProvider.MakeAuthenticationRequest(ssoURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return nil, fmt.Errorf("could not create SAML authentication request: %w", err)
+	}
+	req.ID = requestID
+
+	// The AuthnRequest does not escape the RelayState, so escape it here.
+	redirectURL, err := req.Redirect(url.QueryEscape(relayState), serviceProvider)
+	if err != nil {
+		return nil, fmt.Errorf("could not create SAML authentication request redirect: %w", err)
+	}
+	return redirectURL, nil
+}
+
+func (p *ProviderConfig) ParseResponse(sp provider.SAMLServiceProvider, requestID string, samlResponse string) (*provider.SAMLUser, error) {
+	decodedResponse, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode SAML response: %w", err)
+	}
+
+	assertion, err := p.serviceProvider(sp).ParseXMLResponse(decodedResponse, []string{requestID})
+	if err != nil {
+		// The public error message of an InvalidResponseError is intentionally vague, so use the private error instead.
+		if invalidResponseErr, ok := err.(*saml.InvalidResponseError); ok && invalidResponseErr.PrivateErr != nil {
+			err = invalidResponseErr.PrivateErr
+		}
+		return nil, fmt.Errorf("invalid SAML response: %w", err)
+	}
+
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, fmt.Errorf("SAML assertion did not include a NameID")
+	}
+	nameID := assertion.Subject.NameID.Value
+
+	username := nameID
+	if p.UsernameAttribute != "" {
+		values := attributeValues(assertion, p.UsernameAttribute)
+		if len(values) != 1 || values[0] == "" {
+			return nil, fmt.Errorf("SAML assertion must include exactly one non-empty value for username attribute %q", p.UsernameAttribute)
+		}
+		username = values[0]
+	}
+
+	groups := []string{}
+	if p.GroupsAttribute != "" {
+		groups = sets.NewString(attributeValues(assertion, p.GroupsAttribute)...).Delete("").List()
+	}
+
+	return &provider.SAMLUser{
+		Username:          username,
+		Groups:            groups,
+		DownstreamSubject: p.downstreamSubject(nameID),
+		NameID:            nameID,
+		SessionExpiry:     sessionExpiry(assertion),
+	}, nil
+}
+
+func (p *ProviderConfig) serviceProvider(sp provider.SAMLServiceProvider) *saml.ServiceProvider {
+	return &saml.ServiceProvider{
+		EntityID:    sp.EntityID,
+		AcsURL:      *sp.AssertionConsumerServiceURL,
+		IDPMetadata: p.Metadata,
+		// Let the identity provider choose the format of the NameID.
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+	}
+}
+
+// downstreamSubject follows the same pattern as subjects from OIDC upstreams, using the entity ID of the identity
+// provider in place of the issuer.
+func (p *ProviderConfig) downstreamSubject(nameID string) string {
+	return fmt.Sprintf("%s?%s=%s", p.Metadata.EntityID, oidc.IDTokenSubjectClaim, url.QueryEscape(nameID))
+}
+
+// attributeValues returns all values of all attributes which have the given name or friendly name.
+func attributeValues(assertion *saml.Assertion, name string) []string {
+	var values []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != name && attribute.FriendlyName != name {
+				continue
+			}
+			for _, value := range attribute.Values {
+				values = append(values, value.Value)
+			}
+		}
+	}
+	return values
+}
+
+// sessionExpiry returns the end of the user's session with the identity provider, when the identity provider
+// specified one, or otherwise the zero time. The conditions of the assertion are not used, because they only say
+// how long the assertion itself may be consumed, which is typically a few minutes.
+func sessionExpiry(assertion *saml.Assertion) time.Time {
+	for _, statement := range assertion.AuthnStatements {
+		if statement.SessionNotOnOrAfter != nil && !statement.SessionNotOnOrAfter.IsZero() {
+			return statement.SessionNotOnOrAfter.UTC()
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,250 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamsaml
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/testutil/samltestutil"
+)
+
+const (
+	testSPEntityID = "https://supervisor.example.com/some/path"
+	testSPACSURL   = "https://supervisor.example.com/some/path/callback/saml"
+	testRequestID  = "id-0123456789abcdef"
+	testRelayState = "some+state/with=special&chars"
+	upnAttribute   = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/upn"
+)
+
+func testServiceProvider(t *testing.T) provider.SAMLServiceProvider {
+	acsURL, err := url.Parse(testSPACSURL)
+	require.NoError(t, err)
+	return provider.SAMLServiceProvider{EntityID: testSPEntityID, AssertionConsumerServiceURL: acsURL}
+}
+
+func TestProviderConfig(t *testing.T) {
+	p := ProviderConfig{Name: "test-name", ResourceUID: "test-uid"}
+	require.Equal(t, "test-name", p.GetName())
+	require.Equal(t, "test-uid", string(p.GetResourceUID()))
+}
+
+func TestTestConnection(t *testing.T) {
+	idp := samltestutil.NewIdentityProvider(t, testSPEntityID, testSPACSURL)
+
+	p := ProviderConfig{Metadata: idp.Metadata()}
+	require.NoError(t, p.TestConnection(context.Background()))
+
+	metadata := idp.Metadata()
+	metadata.ValidUntil = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	p = ProviderConfig{Metadata: metadata}
+	require.EqualError(t, p.TestConnection(context.Background()), "identity provider metadata expired at 2020-01-01T00:00:00Z")
+
+	metadata = idp.Metadata()
+	metadata.IDPSSODescriptors[0].SingleSignOnServices = []saml.Endpoint{{Binding: saml.HTTPPostBinding, Location: samltestutil.SSOURL}}
+	p = ProviderConfig{Metadata: metadata}
+	require.EqualError(t, p.TestConnection(context.Background()),
+		"identity provider metadata does not include a single sign-on service with the HTTP-Redirect binding")
+}
+
+func TestAuthnRequestURL(t *testing.T) {
+	idp := samltestutil.NewIdentityProvider(t, testSPEntityID, testSPACSURL)
+
+	t.Run("happy path", func(t *testing.T) {
+		p := ProviderConfig{Metadata: idp.Metadata()}
+		redirectURL, err := p.AuthnRequestURL(testServiceProvider(t), testRequestID, testRelayState)
+		require.NoError(t, err)
+		require.Equal(t, samltestutil.SSOURL, redirectURL.Scheme+"://"+redirectURL.Host+redirectURL.Path)
+		require.Equal(t, testRelayState, redirectURL.Query().Get("RelayState"))
+
+		idpRequest, err := saml.NewIdpAuthnRequest(idp, httptest.NewRequest(http.MethodGet, redirectURL.String(), nil))
+		require.NoError(t, err)
+		require.NoError(t, idpRequest.Validate())
+		require.Equal(t, testRequestID, idpRequest.Request.ID)
+		require.Equal(t, testSPEntityID, idpRequest.Request.Issuer.Value)
+		require.Equal(t, testSPACSURL, idpRequest.Request.AssertionConsumerServiceURL)
+		require.Equal(t, saml.HTTPPostBinding, idpRequest.Request.ProtocolBinding)
+		require.Equal(t, testRelayState, idpRequest.RelayState)
+	})
+
+	t.Run("no redirect binding", func(t *testing.T) {
+		metadata := idp.Metadata()
+		metadata.IDPSSODescriptors[0].SingleSignOnServices = []saml.Endpoint{{Binding: saml.HTTPPostBinding, Location: samltestutil.SSOURL}}
+		p := ProviderConfig{Metadata: metadata}
+		redirectURL, err := p.AuthnRequestURL(testServiceProvider(t), testRequestID, testRelayState)
+		require.EqualError(t, err, "identity provider metadata does not include a single sign-on service with the HTTP-Redirect binding")
+		require.Nil(t, redirectURL)
+	})
+}
+
+func TestParseResponse(t *testing.T) {
+	idp := samltestutil.NewIdentityProvider(t, testSPEntityID, testSPACSURL)
+	otherIDP := samltestutil.NewIdentityProvider(t, testSPEntityID, testSPACSURL)
+	sessionNotOnOrAfter := time.Now().Add(8 * time.Hour).UTC().Truncate(time.Second)
+
+	happySession := &saml.Session{
+		NameID:   "some-name-id",
+		UserName: "some-user",
+		Groups:   []string{"group-b", "group-a", "group-b"},
+		CustomAttributes: []saml.Attribute{{
+			Name:   upnAttribute,
+			Values: []saml.AttributeValue{{Value: "some-user@example.com"}},
+		}},
+	}
+
+	tests := []struct {
+		name              string
+		usernameAttribute string
+		groupsAttribute   string
+		signingIDP        *saml.IdentityProvider
+		session           *saml.Session
+		modifyAssertion   func(*saml.Assertion)
+		requestID         string
+		mangleResponse    func(string) string
+		wantUser          *provider.SAMLUser
+		wantSessionExpiry func(*testing.T, time.Time)
+		wantErr           string
+	}{
+		{
+			name:    "username from NameID without groups, no session expiry",
+			session: happySession,
+			wantUser: &provider.SAMLUser{
+				Username:          "some-name-id",
+				Groups:            []string{},
+				DownstreamSubject: samltestutil.EntityID + "?sub=some-name-id",
+				NameID:            "some-name-id",
+			},
+			wantSessionExpiry: func(t *testing.T, expiry time.Time) {
+				// The validity of the assertion, which is saml.MaxIssueDelay for the stand-in IDP, is not the session expiry.
+				require.True(t, expiry.IsZero())
+			},
+		},
+		{
+			name:              "username and groups from attributes by name and by friendly name, session expiry from AuthnStatement",
+			usernameAttribute: upnAttribute,
+			groupsAttribute:   "eduPersonAffiliation",
+			session:           happySession,
+			modifyAssertion: func(assertion *saml.Assertion) {
+				assertion.AuthnStatements[0].SessionNotOnOrAfter = &sessionNotOnOrAfter
+			},
+			wantUser: &provider.SAMLUser{
+				Username:          "some-user@example.com",
+				Groups:            []string{"group-a", "group-b"},
+				DownstreamSubject: samltestutil.EntityID + "?sub=some-name-id",
+				NameID:            "some-name-id",
+				SessionExpiry:     sessionNotOnOrAfter,
+			},
+		},
+		{
+			name:              "username attribute is missing",
+			usernameAttribute: "missing",
+			session:           happySession,
+			wantErr:           `SAML assertion must include exactly one non-empty value for username attribute "missing"`,
+		},
+		{
+			name:              "username attribute has several values",
+			usernameAttribute: "eduPersonAffiliation",
+			session:           happySession,
+			wantErr:           `SAML assertion must include exactly one non-empty value for username attribute "eduPersonAffiliation"`,
+		},
+		{
+			name:    "NameID is missing",
+			session: &saml.Session{UserName: "some-user"},
+			wantErr: "SAML assertion did not include a NameID",
+		},
+		{
+			name:      "response to a different request",
+			session:   happySession,
+			requestID: "id-some-other-request",
+			wantErr:   "invalid SAML response: `InResponseTo` does not match any of the possible request IDs (expected [id-some-other-request])",
+		},
+		{
+			name:       "signed by a different key",
+			session:    happySession,
+			signingIDP: otherIDP,
+			wantErr:    "invalid SAML response: cannot validate signature on Response: Could not verify certificate against trusted certs",
+		},
+		{
+			name:    "assertion for a different audience",
+			session: happySession,
+			modifyAssertion: func(assertion *saml.Assertion) {
+				assertion.Conditions.AudienceRestrictions[0].Audience.Value = "https://some-other-sp.example.com"
+			},
+			wantErr: `invalid SAML response: assertion Conditions AudienceRestriction does not contain "` + testSPEntityID + `"`,
+		},
+		{
+			name:    "expired assertion",
+			session: happySession,
+			modifyAssertion: func(assertion *saml.Assertion) {
+				assertion.Conditions.NotOnOrAfter = time.Now().Add(-time.Hour)
+			},
+			wantErr: "invalid SAML response: assertion Conditions is expired",
+		},
+		{
+			name:           "response is not base64",
+			session:        happySession,
+			mangleResponse: func(string) string { return "not base64!" },
+			wantErr:        "could not decode SAML response: illegal base64 data at input byte 3",
+		},
+		{
+			name:           "response is not XML",
+			session:        happySession,
+			mangleResponse: func(string) string { return base64.StdEncoding.EncodeToString([]byte("not xml")) },
+			wantErr:        "invalid SAML response: invalid xml: no root",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := ProviderConfig{
+				Metadata:          idp.Metadata(),
+				UsernameAttribute: tt.usernameAttribute,
+				GroupsAttribute:   tt.groupsAttribute,
+			}
+			sp := testServiceProvider(t)
+
+			authnRequestURL, err := p.AuthnRequestURL(sp, testRequestID, testRelayState)
+			require.NoError(t, err)
+
+			signingIDP := idp
+			if tt.signingIDP != nil {
+				signingIDP = tt.signingIDP
+				// Pretend to be the trusted IDP.
+				signingIDP.MetadataURL = idp.MetadataURL
+			}
+			samlResponse, relayState := samltestutil.Login(t, signingIDP, authnRequestURL, tt.session, tt.modifyAssertion)
+			require.Equal(t, testRelayState, relayState)
+			if tt.mangleResponse != nil {
+				samlResponse = tt.mangleResponse(samlResponse)
+			}
+
+			requestID := testRequestID
+			if tt.requestID != "" {
+				requestID = tt.requestID
+			}
+
+			user, err := p.ParseResponse(sp, requestID, samlResponse)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, user)
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantSessionExpiry != nil {
+				tt.wantSessionExpiry(t, user.SessionExpiry)
+				user.SessionExpiry = time.Time{}
+			}
+			require.Equal(t, tt.wantUser, user)
+		})
+	}
+}
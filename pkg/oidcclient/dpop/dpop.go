@@ -0,0 +1,114 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dpop implements the client side of RFC 9449: OAuth 2.0 Demonstrating Proof of Possession (DPoP).
+package dpop
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// HeaderName is the name of the HTTP header which contains the DPoP proof of a request.
+	HeaderName = "DPoP"
+
+	// SigningAlgorithm is the signing algorithm of the DPoP proofs of generated keys.
+	SigningAlgorithm = string(jose.ES256)
+
+	pemType = "EC PRIVATE KEY"
+)
+
+// Generate generates a new random DPoP key.
+func Generate() (*Key, error) { return generate(rand.Reader) }
+
+func generate(rand io.Reader) (*Key, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate DPoP key: %w", err)
+	}
+	return &Key{privateKey: privateKey, rand: rand}, nil
+}
+
+// Parse parses a DPoP key which was encoded by Key.Encode.
+func Parse(encoded string) (*Key, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("could not parse DPoP key: expected a PEM block of type %q", pemType)
+	}
+	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse DPoP key: %w", err)
+	}
+	return &Key{privateKey: privateKey, rand: rand.Reader}, nil
+}
+
+// Key is the private key of a client, which the tokens of the client are bound to.
+type Key struct {
+	privateKey *ecdsa.PrivateKey
+	rand       io.Reader
+}
+
+// Encode returns the PEM encoding of the key.
+func (k *Key) Encode() (string, error) {
+	der, err := x509.MarshalECPrivateKey(k.privateKey)
+	if err != nil {
+		return "", fmt.Errorf("could not encode DPoP key: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})), nil
+}
+
+// Thumbprint returns the JWK SHA-256 thumbprint (RFC 7638) of the public key, which servers bind the tokens to.
+func (k *Key) Thumbprint() (string, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: k.privateKey.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("could not compute thumbprint of DPoP key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// Proof returns a new DPoP proof for an HTTP request with the given method and URL.
+func (k *Key) Proof(method string, requestURL string, now time.Time) (string, error) {
+	htu, err := url.Parse(requestURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse URL of DPoP proof: %w", err)
+	}
+	htu.RawQuery = ""
+	htu.Fragment = ""
+
+	var jti [16]byte
+	if _, err := io.ReadFull(k.rand, jti[:]); err != nil {
+		return "", fmt.Errorf("could not generate ID of DPoP proof: %w", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: k.privateKey},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType("dpop+jwt"),
+	)
+	if err != nil {
+		return "", fmt.Errorf("could not create signer of DPoP proof: %w", err)
+	}
+	proof, err := josejwt.Signed(signer).Claims(map[string]interface{}{
+		"jti": hex.EncodeToString(jti[:]),
+		"htm": method,
+		"htu": htu.String(),
+		"iat": josejwt.NewNumericDate(now),
+	}).CompactSerialize()
+	if err != nil {
+		return "", fmt.Errorf("could not sign DPoP proof: %w", err)
+	}
+	return proof, nil
+}
@@ -1,16 +1,20 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package cachefile implements the file format for session caches.
 package filesession
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -33,6 +37,9 @@ const (
 	// apiKind is the Kubernetes-style Kind of the session file object.
 	apiKind = "SessionCache"
 
+	// dpopKeysAPIKind is the Kubernetes-style Kind of the DPoP key file object.
+	dpopKeysAPIKind = "DPoPKeyCache"
+
 	// sessionExpiration is how long a session can remain unused before it is automatically pruned from the session cache.
 	sessionExpiration = 90 * 24 * time.Hour
 )
@@ -50,6 +57,16 @@ type (
 		CreationTimestamp metav1.Time                `json:"creationTimestamp"`
 		LastUsedTimestamp metav1.Time                `json:"lastUsedTimestamp"`
 		Tokens            oidctypes.Token            `json:"tokens"`
+
+		// DPoPKeyID identifies the DPoP key of the tokens in the DPoP key file, if they are bound to a key.
+		DPoPKeyID string `json:"dpopKeyID,omitempty"`
+	}
+
+	// dpopKeyCache is the object which is YAML-serialized to form the contents of the DPoP key file. The private
+	// keys are kept out of the session file, so that the tokens of a session are useless without the key file.
+	dpopKeyCache struct {
+		metav1.TypeMeta
+		Keys map[string]string `json:"keys"`
 	}
 )
 
@@ -156,3 +173,85 @@ func (c *sessionCache) lookup(key oidcclient.SessionCacheKey) *sessionEntry {
 func (c *sessionCache) insert(entries ...sessionEntry) {
 	c.Sessions = append(c.Sessions, entries...)
 }
+
+// attachDPoPKeys sets the DPoP keys of the tokens of the sessions from the DPoP key cache.
+func (c *sessionCache) attachDPoPKeys(keys *dpopKeyCache) {
+	for i := range c.Sessions {
+		if c.Sessions[i].DPoPKeyID != "" {
+			c.Sessions[i].Tokens.DPoPKey = keys.Keys[c.Sessions[i].DPoPKeyID]
+		}
+	}
+}
+
+// detachDPoPKeys returns a DPoP key cache with the DPoP keys of the tokens of the sessions, and makes the sessions
+// reference them by their IDs.
+func (c *sessionCache) detachDPoPKeys() *dpopKeyCache {
+	keys := emptyDPoPKeyCache()
+	for i := range c.Sessions {
+		c.Sessions[i].DPoPKeyID = ""
+		if key := c.Sessions[i].Tokens.DPoPKey; key != "" {
+			sum := sha256.Sum256([]byte(key))
+			c.Sessions[i].DPoPKeyID = hex.EncodeToString(sum[:])
+			keys.Keys[c.Sessions[i].DPoPKeyID] = key
+		}
+	}
+	return keys
+}
+
+// dpopKeysPath returns the path of the DPoP key file which belongs to the session file at the given path.
+func dpopKeysPath(sessionsPath string) string {
+	ext := filepath.Ext(sessionsPath)
+	return strings.TrimSuffix(sessionsPath, ext) + ".dpop-keys" + ext
+}
+
+// readDPoPKeyCache loads a dpopKeyCache from a path on disk. If the requested path does not exist, it returns an
+// empty cache.
+func readDPoPKeyCache(path string) (*dpopKeyCache, error) {
+	keysYAML, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return emptyDPoPKeyCache(), nil
+		}
+		return nil, fmt.Errorf("could not read DPoP key file: %w", err)
+	}
+
+	var keys dpopKeyCache
+	if err := yaml.Unmarshal(keysYAML, &keys); err != nil {
+		return nil, fmt.Errorf("invalid DPoP key file: %w", err)
+	}
+	if !(keys.TypeMeta.APIVersion == apiVersion && keys.TypeMeta.Kind == dpopKeysAPIKind) {
+		return nil, fmt.Errorf("%w: %#v", errUnsupportedVersion, keys.TypeMeta)
+	}
+	if keys.Keys == nil {
+		keys.Keys = map[string]string{}
+	}
+	return &keys, nil
+}
+
+// emptyDPoPKeyCache returns an empty, initialized dpopKeyCache.
+func emptyDPoPKeyCache() *dpopKeyCache {
+	return &dpopKeyCache{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: dpopKeysAPIKind},
+		Keys:     map[string]string{},
+	}
+}
+
+// writeTo writes the DPoP keys to the specified file path, which is only readable by the current user. The file is
+// removed when there are no keys.
+func (c *dpopKeyCache) writeTo(path string) error {
+	if len(c.Keys) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	keysYAML, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// WriteFile only sets the permissions of new files, so remove any file which may have been created by someone else.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return ioutil.WriteFile(path, keysYAML, 0600)
+}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package filesession implements a simple YAML file-based login.sessionCache.
@@ -38,11 +38,13 @@ func WithErrorReporter(reporter func(error)) Option {
 	}
 }
 
-// New returns a login.SessionCache implementation backed by the specified file path.
+// New returns a login.SessionCache implementation backed by the specified file path. The DPoP keys of sessions are
+// stored in a separate file next to it.
 func New(path string, options ...Option) *Cache {
 	lock := flock.New(path + ".lock")
 	c := Cache{
-		path: path,
+		path:         path,
+		dpopKeysPath: dpopKeysPath(path),
 		trylockFunc: func() error {
 			ctx, cancel := context.WithTimeout(context.Background(), defaultFileLockTimeout)
 			defer cancel()
@@ -59,10 +61,11 @@ func New(path string, options ...Option) *Cache {
 }
 
 type Cache struct {
-	path        string
-	errReporter func(error)
-	trylockFunc func() error
-	unlockFunc  func() error
+	path         string
+	dpopKeysPath string
+	errReporter  func(error)
+	trylockFunc  func() error
+	unlockFunc   func() error
 }
 
 // GetToken looks up the cached data for the given parameters. It may return nil if no valid matching session is cached.
@@ -137,6 +140,14 @@ func (c *Cache) withCache(transact func(*sessionCache)) {
 		cache = emptySessionCache()
 	}
 
+	// Try to read the DPoP keys of the sessions.
+	keys, err := readDPoPKeyCache(c.dpopKeysPath)
+	if err != nil {
+		c.errReporter(fmt.Errorf("failed to read DPoP key cache, resetting: %w", err))
+		keys = emptyDPoPKeyCache()
+	}
+	cache.attachDPoPKeys(keys)
+
 	// Normalize the cache before modifying it, to remove any entries that have already expired.
 	cache = cache.normalized()
 
@@ -146,6 +157,12 @@ func (c *Cache) withCache(transact func(*sessionCache)) {
 	// Normalize again to put everything into a known order.
 	cache = cache.normalized()
 
+	// Save the DPoP keys which are still used by the sessions to their own file, before the sessions which
+	// reference them.
+	if err := cache.detachDPoPKeys().writeTo(c.dpopKeysPath); err != nil {
+		c.errReporter(fmt.Errorf("could not write DPoP key cache: %w", err))
+	}
+
 	// Marshal the session back to YAML and save it to the file.
 	if err := cache.writeTo(c.path); err != nil {
 		c.errReporter(fmt.Errorf("could not write session cache: %w", err))
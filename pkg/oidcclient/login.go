@@ -34,6 +34,7 @@ import (
 	"go.pinniped.dev/internal/net/phttp"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/upstreamoidc"
+	"go.pinniped.dev/pkg/oidcclient/dpop"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
@@ -56,6 +57,10 @@ const (
 
 	defaultLDAPUsernamePrompt = "Username: "
 	defaultLDAPPasswordPrompt = "Password: "
+	defaultTOTPCodePrompt     = "Authentication code: "
+
+	// maxTOTPCodeAttempts is the number of TOTP codes that the user may try during a single CLI-based login.
+	maxTOTPCodeAttempts = 3
 
 	// For CLI-based auth, such as with LDAP upstream identity providers, the user may use these environment variables
 	// to avoid getting interactively prompted for username and password.
@@ -82,6 +87,7 @@ type handlerState struct {
 	upstreamIdentityProviderName string
 	upstreamIdentityProviderType string
 	cliToSendCredentials         bool
+	cliToSendClientCertificate   bool
 
 	requestedAudience string
 
@@ -95,14 +101,20 @@ type handlerState struct {
 	provider     *oidc.Provider
 	oauth2Config *oauth2.Config
 	useFormPost  bool
+	parEndpoint  string
 	state        state.State
 	nonce        nonce.Nonce
 	pkce         pkce.Code
 
+	// The key of DPoP proofs (RFC 9449), which are sent to the token endpoint when the issuer supports them.
+	dpopSupported bool
+	dpopKey       *dpop.Key
+
 	// External calls for things.
 	generateState   func() (state.State, error)
 	generatePKCE    func() (pkce.Code, error)
 	generateNonce   func() (nonce.Nonce, error)
+	generateDPoPKey func() (*dpop.Key, error)
 	openURL         func(string) error
 	getEnv          func(key string) string
 	listen          func(string, string) (net.Listener, error)
@@ -245,6 +257,19 @@ func WithCLISendingCredentials() Option {
 	}
 }
 
+// WithCLISendingClientCertificate causes the call to the Issuer's authorize endpoint to be made directly (no web browser),
+// like WithCLISendingCredentials, but without prompting for a username and password. Instead, the user is authenticated
+// by the client certificate which the HTTP client presents during the TLS handshake, so the HTTP client provided by
+// WithClient must be configured with the user's client certificate. This is only intended to be used when the issuer
+// is a Pinniped Supervisor with a CertificateIdentityProvider.
+func WithCLISendingClientCertificate() Option {
+	return func(h *handlerState) error {
+		h.cliToSendCredentials = true
+		h.cliToSendClientCertificate = true
+		return nil
+	}
+}
+
 // WithUpstreamIdentityProvider causes the specified name and type to be sent as custom query parameters to the
 // issuer's authorize endpoint. This is only intended to be used when the issuer is a Pinniped Supervisor, in which
 // case it provides a mechanism to choose among several upstream identity providers.
@@ -278,14 +303,15 @@ func Login(issuer string, clientID string, opts ...Option) (*oidctypes.Token, er
 		httpClient:   phttp.Default(nil),
 
 		// Default implementations of external dependencies (to be mocked in tests).
-		generateState: state.Generate,
-		generateNonce: nonce.Generate,
-		generatePKCE:  pkce.Generate,
-		openURL:       browser.OpenURL,
-		getEnv:        os.Getenv,
-		listen:        net.Listen,
-		isTTY:         term.IsTerminal,
-		getProvider:   upstreamoidc.New,
+		generateState:   state.Generate,
+		generateNonce:   nonce.Generate,
+		generatePKCE:    pkce.Generate,
+		generateDPoPKey: dpop.Generate,
+		openURL:         browser.OpenURL,
+		getEnv:          os.Getenv,
+		listen:          net.Listen,
+		isTTY:           term.IsTerminal,
+		getProvider:     upstreamoidc.New,
 		validateIDToken: func(ctx context.Context, provider *oidc.Provider, audience string, token string) (*oidc.IDToken, error) {
 			return provider.Verifier(&oidc.Config{ClientID: audience}).Verify(ctx, token)
 		},
@@ -301,6 +327,7 @@ func Login(issuer string, clientID string, opts ...Option) (*oidctypes.Token, er
 	// Copy the configured HTTP client to set a request timeout (the Go default client has no timeout configured).
 	httpClientWithTimeout := *h.httpClient
 	httpClientWithTimeout.Timeout = httpRequestTimeout
+	httpClientWithTimeout.Transport = &dpopTransport{h: &h, base: httpClientWithTimeout.Transport}
 	h.httpClient = &httpClientWithTimeout
 
 	// Always set a long, but non-infinite timeout for this operation.
@@ -335,7 +362,10 @@ func Login(issuer string, clientID string, opts ...Option) (*oidctypes.Token, er
 		return baseToken, err
 	}
 
-	// Perform the RFC8693 token exchange.
+	// Perform the RFC8693 token exchange, with a DPoP proof of the key which the access token is bound to, if any.
+	if err := h.useDPoPKey(baseToken); err != nil {
+		return nil, err
+	}
 	exchangedToken, err := h.tokenExchangeRFC8693(baseToken)
 	if err != nil {
 		return nil, fmt.Errorf("failed to exchange token: %w", err)
@@ -367,12 +397,17 @@ func (h *handlerState) baseLogin() (*oidctypes.Token, error) {
 
 	// If there was a cached refresh token, attempt to use the refresh flow instead of a fresh login.
 	if cached != nil && cached.RefreshToken != nil && cached.RefreshToken.Token != "" {
+		// The refresh token may only be used with a DPoP proof of the key which it is bound to, if any.
+		if err := h.useDPoPKey(cached); err != nil {
+			return nil, err
+		}
 		freshToken, err := h.handleRefresh(h.ctx, cached.RefreshToken)
 		if err != nil {
 			return nil, err
 		}
 		// If we got a fresh token, we can update the cache and return it. Otherwise we fall through to the full refresh flow.
 		if freshToken != nil {
+			freshToken.DPoPKey = cached.DPoPKey
 			h.cache.PutToken(cacheKey, freshToken)
 			return freshToken, nil
 		}
@@ -400,11 +435,27 @@ func (h *handlerState) baseLogin() (*oidctypes.Token, error) {
 		authFunc = h.cliBasedAuth
 	}
 
+	// Bind the tokens of the new session to a new key, if the issuer supports DPoP.
+	h.dpopKey = nil
+	encodedDPoPKey := ""
+	if h.dpopSupported {
+		key, err := h.generateDPoPKey()
+		if err != nil {
+			return nil, err
+		}
+		encodedDPoPKey, err = key.Encode()
+		if err != nil {
+			return nil, err
+		}
+		h.dpopKey = key
+	}
+
 	// Perform the authorize request and authcode exchange to get back OIDC tokens.
 	token, err := authFunc(&authorizeOptions)
 
-	// If we got tokens, put them in the cache.
+	// If we got tokens, put them in the cache along with their key, which is needed to use them later.
 	if err == nil {
+		token.DPoPKey = encodedDPoPKey
 		h.cache.PutToken(cacheKey, token)
 	}
 
@@ -412,12 +463,18 @@ func (h *handlerState) baseLogin() (*oidctypes.Token, error) {
 }
 
 // Make a direct call to the authorize endpoint, including the user's username and password on custom http headers,
-// and parse the authcode from the response. Exchange the authcode for tokens. Return the tokens or an error.
+// or presenting the user's client certificate, and parse the authcode from the response. Exchange the authcode for
+// tokens. Return the tokens or an error.
 func (h *handlerState) cliBasedAuth(authorizeOptions *[]oauth2.AuthCodeOption) (*oidctypes.Token, error) {
 	// Ask the user for their username and password, or get them from env vars.
-	username, password, err := h.getUsernameAndPassword()
-	if err != nil {
-		return nil, err
+	// A client certificate is presented by the HTTP client instead, so no username or password is needed.
+	var username, password string
+	if !h.cliToSendClientCertificate {
+		var err error
+		username, password, err = h.getUsernameAndPassword()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Make a callback URL even though we won't be listening on this port, because providing a redirect URL is
@@ -441,20 +498,25 @@ func (h *handlerState) cliBasedAuth(authorizeOptions *[]oauth2.AuthCodeOption) (
 		return http.ErrUseLastResponse
 	}
 
-	// Send an authorize request.
-	authCtx, authorizeCtxCancelFunc := context.WithTimeout(h.ctx, httpRequestTimeout)
-	defer authorizeCtxCancelFunc()
-	authReq, err := http.NewRequestWithContext(authCtx, http.MethodGet, authorizeURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("could not build authorize request: %w", err)
-	}
-	authReq.Header.Set(supervisoroidc.AuthorizeUsernameHeaderName, username)
-	authReq.Header.Set(supervisoroidc.AuthorizePasswordHeaderName, password)
-	authRes, err := h.httpClient.Do(authReq)
-	if err != nil {
-		return nil, fmt.Errorf("authorization response error: %w", err)
+	// Send an authorize request. When the server asks for a TOTP code, prompt for one and send the request again.
+	var totpCode string
+	var authRes *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		sawRedirect = false
+		authRes, err = h.sendCLIBasedAuthorizeRequest(authorizeURL, username, password, totpCode)
+		if err != nil {
+			return nil, err
+		}
+		totpRequired := authRes.Header.Get(supervisoroidc.AuthorizeTOTPRequiredHeaderName)
+		if totpRequired == "" || attempt >= maxTOTPCodeAttempts {
+			break
+		}
+		totpCode, err = h.promptForTOTPCode(totpRequired, authRes.Header.Get(supervisoroidc.AuthorizeTOTPEnrollmentURIHeaderName))
+		if err != nil {
+			return nil, err
+		}
 	}
-	_ = authRes.Body.Close() // don't need the response body, and okay if it fails to close
 
 	// A successful authorization always results in a redirect (we are flexible on the exact status code).
 	if !sawRedirect {
@@ -509,6 +571,43 @@ func (h *handlerState) cliBasedAuth(authorizeOptions *[]oauth2.AuthCodeOption) (
 	return token, nil
 }
 
+// Make a single call to the authorize endpoint, including the user's credentials on custom http headers, unless the
+// user is authenticated by their client certificate.
+func (h *handlerState) sendCLIBasedAuthorizeRequest(authorizeURL, username, password, totpCode string) (*http.Response, error) {
+	authCtx, authorizeCtxCancelFunc := context.WithTimeout(h.ctx, httpRequestTimeout)
+	defer authorizeCtxCancelFunc()
+	authReq, err := http.NewRequestWithContext(authCtx, http.MethodGet, authorizeURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not build authorize request: %w", err)
+	}
+	if !h.cliToSendClientCertificate {
+		authReq.Header.Set(supervisoroidc.AuthorizeUsernameHeaderName, username)
+		authReq.Header.Set(supervisoroidc.AuthorizePasswordHeaderName, password)
+	}
+	if totpCode != "" {
+		authReq.Header.Set(supervisoroidc.AuthorizeTOTPCodeHeaderName, totpCode)
+	}
+	authRes, err := h.httpClient.Do(authReq)
+	if err != nil {
+		return nil, fmt.Errorf("authorization response error: %w", err)
+	}
+	_ = authRes.Body.Close() // don't need the response body, and okay if it fails to close
+	return authRes, nil
+}
+
+// Prompt for a TOTP code. When the user has not yet enrolled, first show them the key for their authenticator app.
+func (h *handlerState) promptForTOTPCode(totpRequired string, enrollmentURI string) (string, error) {
+	promptLabel := defaultTOTPCodePrompt
+	if totpRequired == supervisoroidc.AuthorizeTOTPRequiredEnroll && enrollmentURI != "" {
+		promptLabel = fmt.Sprintf("Add this key to your authenticator app to finish enrolling:\n\n    %s\n\n%s", enrollmentURI, defaultTOTPCodePrompt)
+	}
+	totpCode, err := h.promptForValue(h.ctx, promptLabel)
+	if err != nil {
+		return "", fmt.Errorf("error prompting for authentication code: %w", err)
+	}
+	return totpCode, nil
+}
+
 // Prompt for the user's username and password, or read them from env vars if they are available.
 func (h *handlerState) getUsernameAndPassword() (string, string, error) {
 	var err error
@@ -570,6 +669,19 @@ func (h *handlerState) webBrowserBasedAuth(authorizeOptions *[]oauth2.AuthCodeOp
 	// Now that we have a redirect URL with the listener port, we can build the authorize URL.
 	authorizeURL := h.oauth2Config.AuthCodeURL(h.state.String(), authParams...)
 
+	// If the server supports pushed authorization requests, push the parameters of the authorize request so that
+	// only a reference to them travels through the browser. Pushing is only an improvement, so when it fails, for
+	// example because the server is rate limiting pushed requests, the parameters are sent through the browser
+	// instead, logging but otherwise ignoring the error.
+	if h.parEndpoint != "" {
+		pushedAuthorizeURL, err := h.pushAuthorizeRequest(authorizeURL)
+		if err != nil {
+			h.logger.V(debugLogLevel).Error(err, "could not push authorization request")
+		} else {
+			authorizeURL = pushedAuthorizeURL
+		}
+	}
+
 	// If there is a listener running, start serving the callback handler in a background goroutine.
 	if listener != nil {
 		shutdown := h.serve(listener)
@@ -718,17 +830,103 @@ func (h *handlerState) initOIDCDiscovery() error {
 		Scopes:   h.scopes,
 	}
 
-	// Use response_mode=form_post if the provider supports it.
+	// Use response_mode=form_post, pushed authorization requests and DPoP if the provider supports them.
 	var discoveryClaims struct {
-		ResponseModesSupported []string `json:"response_modes_supported"`
+		ResponseModesSupported             []string `json:"response_modes_supported"`
+		PushedAuthorizationRequestEndpoint string   `json:"pushed_authorization_request_endpoint"`
+		DPoPSigningAlgValuesSupported      []string `json:"dpop_signing_alg_values_supported"`
 	}
 	if err := h.provider.Claims(&discoveryClaims); err != nil {
 		return fmt.Errorf("could not decode response_modes_supported in OIDC discovery from %q: %w", h.issuer, err)
 	}
 	h.useFormPost = stringSliceContains(discoveryClaims.ResponseModesSupported, "form_post")
+	h.parEndpoint = discoveryClaims.PushedAuthorizationRequestEndpoint
+	h.dpopSupported = stringSliceContains(discoveryClaims.DPoPSigningAlgValuesSupported, dpop.SigningAlgorithm)
 	return nil
 }
 
+// useDPoPKey makes the login send DPoP proofs of the key which the given cached tokens are bound to, if any.
+func (h *handlerState) useDPoPKey(token *oidctypes.Token) error {
+	h.dpopKey = nil
+	if token.DPoPKey == "" {
+		return nil
+	}
+	key, err := dpop.Parse(token.DPoPKey)
+	if err != nil {
+		return fmt.Errorf("could not load DPoP key of cached session: %w", err)
+	}
+	h.dpopKey = key
+	return nil
+}
+
+// dpopTransport adds a DPoP proof to the requests to the token endpoint when the login has a DPoP key, so that all
+// token requests of the login flows, including the ones which are made by the oauth2 package, prove the key.
+type dpopTransport struct {
+	h    *handlerState
+	base http.RoundTripper
+}
+
+func (t *dpopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.h.dpopKey == nil || t.h.oauth2Config == nil || req.Method != http.MethodPost ||
+		req.URL.String() != t.h.oauth2Config.Endpoint.TokenURL {
+		return base.RoundTrip(req)
+	}
+
+	proof, err := t.h.dpopKey.Proof(req.Method, req.URL.String(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(dpop.HeaderName, proof)
+	return base.RoundTrip(req)
+}
+
+// pushAuthorizeRequest sends the parameters of the authorize URL to the pushed authorization request endpoint
+// (RFC 9126), and returns an authorize URL which only refers to them.
+func (h *handlerState) pushAuthorizeRequest(authorizeURL string) (string, error) {
+	h.logger.V(debugLogLevel).Info("Pinniped: Pushing authorization request", "endpoint", h.parEndpoint)
+	parsedAuthorizeURL, err := url.Parse(authorizeURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse authorize URL: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodPost, h.parEndpoint, strings.NewReader(parsedAuthorizeURL.Query().Encode()))
+	if err != nil {
+		return "", fmt.Errorf("could not build pushed authorization request: %w", err)
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("pushed authorization request failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// Expect an HTTP 201 response with a request_uri.
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("pushed authorization request failed: unexpected HTTP response status %d", resp.StatusCode)
+	}
+	var respBody struct {
+		RequestURI string `json:"request_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return "", fmt.Errorf("pushed authorization request failed: could not decode response: %w", err)
+	}
+	if respBody.RequestURI == "" {
+		return "", fmt.Errorf("pushed authorization request failed: response did not include a request_uri")
+	}
+
+	parsedAuthorizeURL.RawQuery = url.Values{
+		"client_id":   []string{h.clientID},
+		"request_uri": []string{respBody.RequestURI},
+	}.Encode()
+	return parsedAuthorizeURL.String(), nil
+}
+
 func stringSliceContains(slice []string, s string) bool {
 	for _, item := range slice {
 		if item == s {
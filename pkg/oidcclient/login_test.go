@@ -30,10 +30,12 @@ import (
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/httputil/roundtripper"
 	"go.pinniped.dev/internal/mocks/mockupstreamoidcidentityprovider"
+	supervisordpop "go.pinniped.dev/internal/oidc/dpop"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/testlogger"
 	"go.pinniped.dev/internal/upstreamoidc"
+	"go.pinniped.dev/pkg/oidcclient/dpop"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
@@ -237,6 +239,87 @@ func TestLogin(t *testing.T) { // nolint:gocyclo
 	formPostProviderMux.HandleFunc("/.well-known/openid-configuration", discoveryHandler(formPostSuccessServer, []string{"query", "form_post"}))
 	formPostProviderMux.HandleFunc("/token", tokenHandler)
 
+	// Start a test server that returns a real discovery document and answers refresh requests, _and_ supports
+	// pushed authorization requests. The pushed parameters are checked by the test cases which use it.
+	parProviderMux := http.NewServeMux()
+	parSuccessServer := httptest.NewServer(parProviderMux)
+	t.Cleanup(parSuccessServer.Close)
+	var pushedParams url.Values
+	parProviderMux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(&struct {
+			Issuer                             string `json:"issuer"`
+			AuthURL                            string `json:"authorization_endpoint"`
+			TokenURL                           string `json:"token_endpoint"`
+			JWKSURL                            string `json:"jwks_uri"`
+			PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint"`
+		}{
+			Issuer:                             parSuccessServer.URL,
+			AuthURL:                            parSuccessServer.URL + "/authorize",
+			TokenURL:                           parSuccessServer.URL + "/token",
+			JWKSURL:                            parSuccessServer.URL + "/keys",
+			PushedAuthorizationRequestEndpoint: parSuccessServer.URL + "/par",
+		})
+	})
+	parProviderMux.HandleFunc("/par", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pushedParams = r.PostForm
+		if r.PostForm.Get("client_id") != "test-client-id" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"request_uri":"urn:ietf:params:oauth:request_uri:test-request","expires_in":90}`))
+	})
+	parProviderMux.HandleFunc("/token", tokenHandler)
+
+	// Start a test server that returns a real discovery document and answers refresh and token exchange requests,
+	// _and_ supports DPoP. The thumbprints of the keys of the DPoP proofs are checked by the test cases which use it.
+	dpopKey, err := dpop.Generate()
+	require.NoError(t, err)
+	encodedDPoPKey, err := dpopKey.Encode()
+	require.NoError(t, err)
+	dpopThumbprint, err := dpopKey.Thumbprint()
+	require.NoError(t, err)
+	dpopProviderMux := http.NewServeMux()
+	dpopSuccessServer := httptest.NewServer(dpopProviderMux)
+	t.Cleanup(dpopSuccessServer.Close)
+	var sawDPoPThumbprints map[string]string // by grant type
+	dpopReplayCache := supervisordpop.NewReplayCache(supervisordpop.DefaultReplayCacheSize)
+	dpopProviderMux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(&struct {
+			Issuer                        string   `json:"issuer"`
+			AuthURL                       string   `json:"authorization_endpoint"`
+			TokenURL                      string   `json:"token_endpoint"`
+			JWKSURL                       string   `json:"jwks_uri"`
+			DPoPSigningAlgValuesSupported []string `json:"dpop_signing_alg_values_supported"`
+		}{
+			Issuer:                        dpopSuccessServer.URL,
+			AuthURL:                       dpopSuccessServer.URL + "/authorize",
+			TokenURL:                      dpopSuccessServer.URL + "/token",
+			JWKSURL:                       dpopSuccessServer.URL + "/keys",
+			DPoPSigningAlgValuesSupported: []string{"ES256", "RS256"},
+		})
+	})
+	dpopProviderMux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		thumbprint, err := supervisordpop.VerifyProof(r, dpopSuccessServer.URL+"/token", time.Now(), dpopReplayCache)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sawDPoPThumbprints[r.PostFormValue("grant_type")] = thumbprint
+		tokenHandler(w, r)
+	})
+
 	defaultDiscoveryResponse := func(req *http.Request) (*http.Response, error) {
 		// Call the handler function from the test server to calculate the response.
 		handler, _ := providerMux.Handler(req)
@@ -330,6 +413,19 @@ func TestLogin(t *testing.T) { // nolint:gocyclo
 			},
 			wantErr: "some error generating PKCE",
 		},
+		{
+			name:     "error generating DPoP key",
+			issuer:   dpopSuccessServer.URL,
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					h.generateDPoPKey = func() (*dpop.Key, error) { return nil, fmt.Errorf("some error generating DPoP key") }
+					return nil
+				}
+			},
+			wantLogs: []string{"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + dpopSuccessServer.URL + "\""},
+			wantErr:  "some error generating DPoP key",
+		},
 		{
 			name:     "session cache hit but token expired",
 			issuer:   "test-issuer",
@@ -750,6 +846,97 @@ func TestLogin(t *testing.T) { // nolint:gocyclo
 			wantLogs:  []string{"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + formPostSuccessServer.URL + "\""},
 			wantToken: &testToken,
 		},
+		{
+			name:     "callback returns success with pushed authorization request",
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					h.generateState = func() (state.State, error) { return "test-state", nil }
+					h.generatePKCE = func() (pkce.Code, error) { return "test-pkce", nil }
+					h.generateNonce = func() (nonce.Nonce, error) { return "test-nonce", nil }
+
+					cache := &mockSessionCache{t: t, getReturnsToken: nil}
+					cacheKey := SessionCacheKey{
+						Issuer:      parSuccessServer.URL,
+						ClientID:    "test-client-id",
+						Scopes:      []string{"test-scope"},
+						RedirectURI: "http://localhost:0/callback",
+					}
+					t.Cleanup(func() {
+						require.Equal(t, []SessionCacheKey{cacheKey}, cache.sawGetKeys)
+						require.Equal(t, []SessionCacheKey{cacheKey}, cache.sawPutKeys)
+						require.Equal(t, []*oidctypes.Token{&testToken}, cache.sawPutTokens)
+					})
+					require.NoError(t, WithSessionCache(cache)(h))
+					require.NoError(t, WithClient(&http.Client{Timeout: 10 * time.Second})(h))
+
+					h.openURL = func(actualURL string) error {
+						require.Contains(t, pushedParams.Get("redirect_uri"), "http://127.0.0.1:")
+						pushedParams.Del("redirect_uri")
+						require.Equal(t, url.Values{
+							"code_challenge":        []string{"VVaezYqum7reIhoavCHD1n2d-piN3r_mywoYj7fCR7g"},
+							"code_challenge_method": []string{"S256"},
+							"response_type":         []string{"code"},
+							"scope":                 []string{"test-scope"},
+							"nonce":                 []string{"test-nonce"},
+							"state":                 []string{"test-state"},
+							"access_type":           []string{"offline"},
+							"client_id":             []string{"test-client-id"},
+						}, pushedParams)
+
+						// Only the reference to the pushed parameters travels through the browser.
+						require.Equal(t, parSuccessServer.URL+"/authorize?client_id=test-client-id&request_uri=urn%3Aietf%3Aparams%3Aoauth%3Arequest_uri%3Atest-request", actualURL)
+
+						go func() {
+							h.callbacks <- callbackResult{token: &testToken}
+						}()
+						return nil
+					}
+					return nil
+				}
+			},
+			issuer: parSuccessServer.URL,
+			wantLogs: []string{
+				"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + parSuccessServer.URL + "\"",
+				"\"level\"=4 \"msg\"=\"Pinniped: Pushing authorization request\"  \"endpoint\"=\"" + parSuccessServer.URL + "/par\"",
+			},
+			wantToken: &testToken,
+		},
+		{
+			name:     "pushed authorization request fails, so the parameters are sent through the browser",
+			clientID: "other-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					h.generateState = func() (state.State, error) { return "test-state", nil }
+					h.generatePKCE = func() (pkce.Code, error) { return "test-pkce", nil }
+					h.generateNonce = func() (nonce.Nonce, error) { return "test-nonce", nil }
+					h.cache = &mockSessionCache{t: t, getReturnsToken: nil}
+					require.NoError(t, WithClient(&http.Client{Timeout: 10 * time.Second})(h))
+					h.openURL = func(actualURL string) error {
+						parsedActualURL, err := url.Parse(actualURL)
+						require.NoError(t, err)
+						require.Equal(t, "other-client-id", parsedActualURL.Query().Get("client_id"))
+						require.Equal(t, "test-state", parsedActualURL.Query().Get("state"))
+						require.Empty(t, parsedActualURL.Query().Get("request_uri"))
+						parsedActualURL.RawQuery = ""
+						require.Equal(t, parSuccessServer.URL+"/authorize", parsedActualURL.String())
+
+						go func() {
+							h.callbacks <- callbackResult{token: &testToken}
+						}()
+						return nil
+					}
+					return nil
+				}
+			},
+			issuer: parSuccessServer.URL,
+			wantLogs: []string{
+				"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + parSuccessServer.URL + "\"",
+				"\"level\"=4 \"msg\"=\"Pinniped: Pushing authorization request\"  \"endpoint\"=\"" + parSuccessServer.URL + "/par\"",
+				`"msg"="could not push authorization request" "error"="pushed authorization request failed: unexpected HTTP response status 401"`,
+			},
+			wantToken: &testToken,
+		},
 		{
 			name:     "upstream name and type are included in authorize request if upstream name is provided",
 			clientID: "test-client-id",
@@ -1104,6 +1291,149 @@ func TestLogin(t *testing.T) { // nolint:gocyclo
 			wantLogs:  []string{"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + successServer.URL + "\""},
 			wantToken: &testToken,
 		},
+		{
+			name:     "successful ldap login with prompts for a TOTP code after the user enrolls",
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					fakeAuthCode := "test-authcode-value"
+					_ = defaultLDAPTestOpts(t, h, nil, nil)
+					h.getProvider = func(_ *oauth2.Config, _ *oidc.Provider, _ *http.Client) provider.UpstreamOIDCIdentityProviderI {
+						mock := mockUpstream(t)
+						mock.EXPECT().
+							ExchangeAuthcodeAndValidateTokens(
+								gomock.Any(), fakeAuthCode, pkce.Code("test-pkce"), nonce.Nonce("test-nonce"), "http://127.0.0.1:0/callback").
+							Return(&testToken, nil)
+						return mock
+					}
+
+					var sawPromptLabels []string
+					h.promptForValue = func(_ context.Context, promptLabel string) (string, error) {
+						sawPromptLabels = append(sawPromptLabels, promptLabel)
+						if len(sawPromptLabels) == 1 {
+							return "some-upstream-username", nil
+						}
+						return "123456", nil
+					}
+
+					var sawTOTPCodes []string
+					t.Cleanup(func() {
+						require.Equal(t, []string{
+							"Username: ",
+							"Add this key to your authenticator app to finish enrolling:\n\n    otpauth://totp/some-key-uri\n\nAuthentication code: ",
+						}, sawPromptLabels)
+						require.Equal(t, []string{"", "123456"}, sawTOTPCodes)
+					})
+
+					require.NoError(t, WithClient(&http.Client{
+						Transport: roundtripper.Func(func(req *http.Request) (*http.Response, error) {
+							switch req.URL.Scheme + "://" + req.URL.Host + req.URL.Path {
+							case "http://" + successServer.Listener.Addr().String() + "/.well-known/openid-configuration":
+								return defaultDiscoveryResponse(req)
+							case "http://" + successServer.Listener.Addr().String() + "/authorize":
+								require.Equal(t, "some-upstream-username", req.Header.Get("Pinniped-Username"))
+								require.Equal(t, "some-upstream-password", req.Header.Get("Pinniped-Password"))
+								sawTOTPCodes = append(sawTOTPCodes, req.Header.Get("Pinniped-TOTP-Code"))
+								if req.Header.Get("Pinniped-TOTP-Code") == "" {
+									return &http.Response{
+										StatusCode: http.StatusSeeOther,
+										Header: http.Header{
+											"Location":                     []string{"http://127.0.0.1:0/callback?error=access_denied&state=test-state"},
+											"Pinniped-Totp-Required":       []string{"enroll"},
+											"Pinniped-Totp-Enrollment-Uri": []string{"otpauth://totp/some-key-uri"},
+										},
+									}, nil
+								}
+								return &http.Response{
+									StatusCode: http.StatusSeeOther,
+									Header: http.Header{"Location": []string{
+										fmt.Sprintf("http://127.0.0.1:0/callback?code=%s&state=test-state", fakeAuthCode),
+									}},
+								}, nil
+							default:
+								require.FailNow(t, fmt.Sprintf("saw unexpected http call from the CLI: %s", req.URL.String()))
+								return nil, nil
+							}
+						}),
+					})(h))
+					return nil
+				}
+			},
+			issuer:    successServer.URL,
+			wantLogs:  []string{"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + successServer.URL + "\""},
+			wantToken: &testToken,
+		},
+		{
+			name:     "ldap login when the user keeps entering wrong TOTP codes",
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					_ = defaultLDAPTestOpts(t, h, nil, nil)
+
+					var sawPromptLabels []string
+					h.promptForValue = func(_ context.Context, promptLabel string) (string, error) {
+						sawPromptLabels = append(sawPromptLabels, promptLabel)
+						return "000000", nil
+					}
+
+					authorizeRequests := 0
+					t.Cleanup(func() {
+						require.Equal(t, []string{"Username: ", "Authentication code: ", "Authentication code: ", "Authentication code: "}, sawPromptLabels)
+						require.Equal(t, 4, authorizeRequests)
+					})
+
+					require.NoError(t, WithClient(&http.Client{
+						Transport: roundtripper.Func(func(req *http.Request) (*http.Response, error) {
+							switch req.URL.Scheme + "://" + req.URL.Host + req.URL.Path {
+							case "http://" + successServer.Listener.Addr().String() + "/.well-known/openid-configuration":
+								return defaultDiscoveryResponse(req)
+							case "http://" + successServer.Listener.Addr().String() + "/authorize":
+								authorizeRequests++
+								return &http.Response{
+									StatusCode: http.StatusSeeOther,
+									Header: http.Header{
+										"Location":               []string{"http://127.0.0.1:0/callback?error=access_denied&error_description=The+TOTP+code+was+not+accepted.&state=test-state"},
+										"Pinniped-Totp-Required": []string{"code"},
+									},
+								}, nil
+							default:
+								require.FailNow(t, fmt.Sprintf("saw unexpected http call from the CLI: %s", req.URL.String()))
+								return nil, nil
+							}
+						}),
+					})(h))
+					return nil
+				}
+			},
+			issuer:   successServer.URL,
+			wantLogs: []string{"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + successServer.URL + "\""},
+			wantErr:  `login failed with code "access_denied": The TOTP code was not accepted.`,
+		},
+		{
+			name:     "ldap login when prompting for a TOTP code fails",
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					_ = defaultLDAPTestOpts(t, h, &http.Response{
+						StatusCode: http.StatusSeeOther,
+						Header: http.Header{
+							"Location":               []string{"http://127.0.0.1:0/callback?error=access_denied&state=test-state"},
+							"Pinniped-Totp-Required": []string{"code"},
+						},
+					}, nil)
+					h.promptForValue = func(_ context.Context, promptLabel string) (string, error) {
+						if promptLabel == "Username: " {
+							return "some-upstream-username", nil
+						}
+						return "", errors.New("some prompt error")
+					}
+					return nil
+				}
+			},
+			issuer:   successServer.URL,
+			wantLogs: []string{"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + successServer.URL + "\""},
+			wantErr:  "error prompting for authentication code: some prompt error",
+		},
 		{
 			name:     "successful ldap login with env vars for username and password",
 			clientID: "test-client-id",
@@ -1215,6 +1545,111 @@ func TestLogin(t *testing.T) { // nolint:gocyclo
 			},
 			wantToken: &testToken,
 		},
+		{
+			name:     "successful client certificate login without prompts for username and password",
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					fakeAuthCode := "test-authcode-value"
+
+					h.getProvider = func(_ *oauth2.Config, _ *oidc.Provider, _ *http.Client) provider.UpstreamOIDCIdentityProviderI {
+						mock := mockUpstream(t)
+						mock.EXPECT().
+							ExchangeAuthcodeAndValidateTokens(
+								gomock.Any(), fakeAuthCode, pkce.Code("test-pkce"), nonce.Nonce("test-nonce"), "http://127.0.0.1:0/callback").
+							Return(&testToken, nil)
+						return mock
+					}
+
+					h.generateState = func() (state.State, error) { return "test-state", nil }
+					h.generatePKCE = func() (pkce.Code, error) { return "test-pkce", nil }
+					h.generateNonce = func() (nonce.Nonce, error) { return "test-nonce", nil }
+					h.getEnv = func(key string) string {
+						switch key {
+						case "PINNIPED_USERNAME":
+							return "some-upstream-username"
+						case "PINNIPED_PASSWORD":
+							return "some-upstream-password"
+						default:
+							return "" // all other env vars are treated as if they are unset
+						}
+					}
+					h.promptForValue = func(_ context.Context, promptLabel string) (string, error) {
+						require.FailNow(t, fmt.Sprintf("saw unexpected prompt from the CLI: %q", promptLabel))
+						return "", nil
+					}
+					h.promptForSecret = func(promptLabel string) (string, error) {
+						require.FailNow(t, fmt.Sprintf("saw unexpected prompt from the CLI: %q", promptLabel))
+						return "", nil
+					}
+
+					cache := &mockSessionCache{t: t, getReturnsToken: nil}
+					cacheKey := SessionCacheKey{
+						Issuer:      successServer.URL,
+						ClientID:    "test-client-id",
+						Scopes:      []string{"test-scope"},
+						RedirectURI: "http://localhost:0/callback",
+					}
+					t.Cleanup(func() {
+						require.Equal(t, []SessionCacheKey{cacheKey}, cache.sawGetKeys)
+						require.Equal(t, []SessionCacheKey{cacheKey}, cache.sawPutKeys)
+						require.Equal(t, []*oidctypes.Token{&testToken}, cache.sawPutTokens)
+					})
+					require.NoError(t, WithSessionCache(cache)(h))
+					require.NoError(t, WithCLISendingClientCertificate()(h))
+					require.NoError(t, WithUpstreamIdentityProvider("some-upstream-name", "certificate")(h))
+
+					discoveryRequestWasMade := false
+					authorizeRequestWasMade := false
+					t.Cleanup(func() {
+						require.True(t, discoveryRequestWasMade, "should have made an discovery request")
+						require.True(t, authorizeRequestWasMade, "should have made an authorize request")
+					})
+
+					require.NoError(t, WithClient(&http.Client{
+						Transport: roundtripper.Func(func(req *http.Request) (*http.Response, error) {
+							switch req.URL.Scheme + "://" + req.URL.Host + req.URL.Path {
+							case "http://" + successServer.Listener.Addr().String() + "/.well-known/openid-configuration":
+								discoveryRequestWasMade = true
+								return defaultDiscoveryResponse(req)
+							case "http://" + successServer.Listener.Addr().String() + "/authorize":
+								authorizeRequestWasMade = true
+								// The client certificate is sent during the TLS handshake instead of any headers.
+								require.Empty(t, req.Header.Values("Pinniped-Username"))
+								require.Empty(t, req.Header.Values("Pinniped-Password"))
+								require.Equal(t, url.Values{
+									"code_challenge":        []string{"VVaezYqum7reIhoavCHD1n2d-piN3r_mywoYj7fCR7g"},
+									"code_challenge_method": []string{"S256"},
+									"response_type":         []string{"code"},
+									"scope":                 []string{"test-scope"},
+									"nonce":                 []string{"test-nonce"},
+									"state":                 []string{"test-state"},
+									"access_type":           []string{"offline"},
+									"client_id":             []string{"test-client-id"},
+									"redirect_uri":          []string{"http://127.0.0.1:0/callback"},
+									"pinniped_idp_name":     []string{"some-upstream-name"},
+									"pinniped_idp_type":     []string{"certificate"},
+								}, req.URL.Query())
+								return &http.Response{
+									StatusCode: http.StatusFound,
+									Header: http.Header{"Location": []string{
+										fmt.Sprintf("http://127.0.0.1:0/callback?code=%s&state=test-state", fakeAuthCode),
+									}},
+								}, nil
+							default:
+								// Note that "/token" requests should not be made. They are mocked by mocking calls to ExchangeAuthcodeAndValidateTokens().
+								require.FailNow(t, fmt.Sprintf("saw unexpected http call from the CLI: %s", req.URL.String()))
+								return nil, nil
+							}
+						}),
+					})(h))
+					return nil
+				}
+			},
+			issuer:    successServer.URL,
+			wantLogs:  []string{"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + successServer.URL + "\""},
+			wantToken: &testToken,
+		},
 		{
 			name:     "successful ldap login with env vars for username and password, http.StatusSeeOther redirect",
 			clientID: "test-client-id",
@@ -1676,6 +2111,65 @@ func TestLogin(t *testing.T) { // nolint:gocyclo
 			},
 			wantToken: &testExchangedToken,
 		},
+		{
+			name:     "with requested audience, session cache hit with DPoP-bound refresh token, and token exchange request succeeds",
+			issuer:   dpopSuccessServer.URL,
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					sawDPoPThumbprints = map[string]string{}
+					cache := &mockSessionCache{t: t, getReturnsToken: &oidctypes.Token{
+						IDToken: &oidctypes.IDToken{
+							Token:  "expired-test-id-token",
+							Expiry: metav1.Now(), // less than Now() + minIDTokenValidity
+						},
+						RefreshToken: &oidctypes.RefreshToken{Token: "test-refresh-token"},
+						DPoPKey:      encodedDPoPKey,
+					}}
+					t.Cleanup(func() {
+						require.Len(t, cache.sawPutTokens, 1)
+						require.Equal(t, testToken.IDToken.Token, cache.sawPutTokens[0].IDToken.Token)
+						// The refreshed tokens are still bound to the same key.
+						require.Equal(t, encodedDPoPKey, cache.sawPutTokens[0].DPoPKey)
+						// Both the refresh and the token exchange had a DPoP proof of the key.
+						require.Equal(t, map[string]string{
+							"refresh_token": dpopThumbprint,
+							"urn:ietf:params:oauth:grant-type:token-exchange": dpopThumbprint,
+						}, sawDPoPThumbprints)
+					})
+					h.cache = cache
+
+					h.getProvider = func(config *oauth2.Config, provider *oidc.Provider, client *http.Client) provider.UpstreamOIDCIdentityProviderI {
+						mock := mockUpstream(t)
+						mock.EXPECT().
+							ValidateTokenAndMergeWithUserInfo(gomock.Any(), HasAccessToken(testToken.AccessToken.Token), nonce.Nonce(""), true, false).
+							Return(&oidctypes.Token{AccessToken: testToken.AccessToken, RefreshToken: testToken.RefreshToken, IDToken: testToken.IDToken}, nil)
+						mock.EXPECT().
+							PerformRefresh(gomock.Any(), testToken.RefreshToken.Token).
+							DoAndReturn(func(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+								// Call the real production code to perform a refresh.
+								return upstreamoidc.New(config, provider, client).PerformRefresh(ctx, refreshToken)
+							})
+						return mock
+					}
+
+					require.NoError(t, WithRequestAudience("test-audience")(h))
+
+					h.validateIDToken = func(ctx context.Context, provider *oidc.Provider, audience string, token string) (*oidc.IDToken, error) {
+						require.Equal(t, "test-audience", audience)
+						require.Equal(t, "test-id-token-with-requested-audience", token)
+						return &oidc.IDToken{Expiry: testExchangedToken.IDToken.Expiry.Time}, nil
+					}
+					return nil
+				}
+			},
+			wantLogs: []string{
+				"\"level\"=4 \"msg\"=\"Pinniped: Performing OIDC discovery\"  \"issuer\"=\"" + dpopSuccessServer.URL + "\"",
+				"\"level\"=4 \"msg\"=\"Pinniped: Refreshing cached token.\"",
+				"\"level\"=4 \"msg\"=\"Pinniped: Performing RFC8693 token exchange\"  \"requestedAudience\"=\"test-audience\"",
+			},
+			wantToken: &testExchangedToken,
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
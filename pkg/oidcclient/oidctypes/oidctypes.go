@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package oidctypes provides core data types for OIDC token structures.
@@ -48,4 +48,9 @@ type Token struct {
 
 	// IDToken is an OpenID Connect ID token.
 	IDToken *IDToken `json:"id,omitempty"`
+
+	// DPoPKey is the PEM encoded private key which the access and refresh tokens are bound to with DPoP (RFC 9449),
+	// if they are bound to a key. It is never serialized along with the tokens, so that it does not end up wherever
+	// the tokens are copied to. Session caches must store it separately.
+	DPoPKey string `json:"-"`
 }
@@ -201,6 +201,48 @@ func TestGetAPIResourceList(t *testing.T) {
 						Kind:       "ActiveDirectoryIdentityProvider",
 						Verbs:      []string{"get", "patch", "update"},
 					},
+					{
+						Name:         "githubidentityproviders",
+						SingularName: "githubidentityprovider",
+						Namespaced:   true,
+						Kind:         "GitHubIdentityProvider",
+						Verbs:        []string{"delete", "deletecollection", "get", "list", "patch", "create", "update", "watch"},
+						Categories:   []string{"pinniped", "pinniped-idp", "pinniped-idps"},
+					},
+					{
+						Name:       "githubidentityproviders/status",
+						Namespaced: true,
+						Kind:       "GitHubIdentityProvider",
+						Verbs:      []string{"get", "patch", "update"},
+					},
+					{
+						Name:         "samlidentityproviders",
+						SingularName: "samlidentityprovider",
+						Namespaced:   true,
+						Kind:         "SAMLIdentityProvider",
+						Verbs:        []string{"delete", "deletecollection", "get", "list", "patch", "create", "update", "watch"},
+						Categories:   []string{"pinniped", "pinniped-idp", "pinniped-idps"},
+					},
+					{
+						Name:       "samlidentityproviders/status",
+						Namespaced: true,
+						Kind:       "SAMLIdentityProvider",
+						Verbs:      []string{"get", "patch", "update"},
+					},
+					{
+						Name:         "certificateidentityproviders",
+						SingularName: "certificateidentityprovider",
+						Namespaced:   true,
+						Kind:         "CertificateIdentityProvider",
+						Verbs:        []string{"delete", "deletecollection", "get", "list", "patch", "create", "update", "watch"},
+						Categories:   []string{"pinniped", "pinniped-idp", "pinniped-idps"},
+					},
+					{
+						Name:       "certificateidentityproviders/status",
+						Namespaced: true,
+						Kind:       "CertificateIdentityProvider",
+						Verbs:      []string{"get", "patch", "update"},
+					},
 				},
 			},
 		},
@@ -463,6 +505,27 @@ func TestCRDAdditionalPrinterColumns_Parallel(t *testing.T) {
 				{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
 			},
 		},
+		addSuffix("githubidentityproviders.idp.supervisor"): {
+			"v1alpha1": []apiextensionsv1.CustomResourceColumnDefinition{
+				{Name: "Host", Type: "string", JSONPath: ".spec.githubAPI.host"},
+				{Name: "Status", Type: "string", JSONPath: ".status.phase"},
+				{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+			},
+		},
+		addSuffix("samlidentityproviders.idp.supervisor"): {
+			"v1alpha1": []apiextensionsv1.CustomResourceColumnDefinition{
+				{Name: "Metadata URL", Type: "string", JSONPath: ".spec.metadata.url"},
+				{Name: "Status", Type: "string", JSONPath: ".status.phase"},
+				{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+			},
+		},
+		addSuffix("certificateidentityproviders.idp.supervisor"): {
+			"v1alpha1": []apiextensionsv1.CustomResourceColumnDefinition{
+				{Name: "Username", Type: "string", JSONPath: ".spec.claims.username"},
+				{Name: "Status", Type: "string", JSONPath: ".status.phase"},
+				{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+			},
+		},
 		addSuffix("federationdomains.config.supervisor"): {
 			"v1alpha1": []apiextensionsv1.CustomResourceColumnDefinition{
 				{Name: "Issuer", Type: "string", JSONPath: ".spec.issuer"},
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package integration
@@ -495,18 +495,26 @@ func requireWellKnownEndpointIsWorking(t *testing.T, supervisorScheme, superviso
       "token_endpoint": "%s/oauth2/token",
       "token_endpoint_auth_methods_supported": ["client_secret_basic"],
       "jwks_uri": "%s/jwks.json",
+      "registration_endpoint": "%s/oauth2/register",
+      "pushed_authorization_request_endpoint": "%s/oauth2/par",
+      "dpop_signing_alg_values_supported": ["ES256", "ES384", "ES512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"],
       "scopes_supported": ["openid", "offline"],
       "response_types_supported": ["code"],
       "response_modes_supported": ["query", "form_post"],
-      "claims_supported": ["groups"],
+      "claims_supported": ["groups", "auth_time", "acr", "amr"],
       "discovery.supervisor.pinniped.dev/v1alpha1": {"pinniped_identity_providers_endpoint": "%s/v1alpha1/pinniped_identity_providers"},
       "subject_types_supported": ["public"],
       "id_token_signing_alg_values_supported": ["ES256"]
     }`)
-	expectedJSON := fmt.Sprintf(expectedResultTemplate, issuerName, issuerName, issuerName, issuerName, issuerName)
+	expectedJSON := fmt.Sprintf(expectedResultTemplate, issuerName, issuerName, issuerName, issuerName, issuerName, issuerName, issuerName)
 
 	require.Equal(t, "application/json", response.Header.Get("content-type"))
 	require.JSONEq(t, expectedJSON, responseBody)
+
+	// The same metadata is served as OAuth 2.0 Authorization Server Metadata at the location defined by RFC 8414.
+	authorizationServerMetadataURL := fmt.Sprintf("%s://%s/.well-known/oauth-authorization-server%s", supervisorScheme, supervisorAddress, issuerURL.Path)
+	_, responseBody = requireSuccessEndpointResponse(t, authorizationServerMetadataURL, issuerName, supervisorCABundle, dnsOverrides) //nolint:bodyclose
+	require.JSONEq(t, expectedJSON, responseBody)
 }
 
 type ExpectedJWKSResponseFormat struct {
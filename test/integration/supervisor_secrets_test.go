@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package integration
@@ -42,6 +42,13 @@ func TestSupervisorSecrets_Parallel(t *testing.T) {
 			},
 			ensureValid: ensureValidSymmetricSecretOfTypeFunc("secrets.pinniped.dev/supervisor-csrf-signing-key"),
 		},
+		{
+			name: "totp encryption key",
+			secretName: func(federationDomain *configv1alpha1.FederationDomain) string {
+				return env.SupervisorAppName + "-totp-key"
+			},
+			ensureValid: ensureValidSymmetricSecretOfTypeFunc("secrets.pinniped.dev/supervisor-totp-encryption-key"),
+		},
 		{
 			name: "jwks",
 			secretName: func(federationDomain *configv1alpha1.FederationDomain) string {